@@ -0,0 +1,75 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	mexporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/metric"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/detectors/gcp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Cloud Monitoring takes at most one point per time series every 10 seconds
+const minCloudMonitoringInterval = 10 * time.Second
+
+// cloudMonitoringOptions returns the meter provider options that push the proxy metrics to
+// Cloud Monitoring as custom.googleapis.com/gcsproxy/<metric> custom metrics. The monitored
+// resource is detected on GCE, GKE and Cloud Run, and generic_node elsewhere. The configured
+// labels are added to the resource, service.namespace and service.instance.id pick the
+// generic_node namespace and node, the other labels are added to every time series.
+func cloudMonitoringOptions(ctx context.Context, config *cfg.Config) ([]metric.Option, error) {
+	if config.CloudMonitoringInterval < minCloudMonitoringInterval {
+		return nil, fmt.Errorf("-cloud_monitoring_interval must be at least %v", minCloudMonitoringInterval)
+	}
+
+	attrs := []attribute.KeyValue{semconv.ServiceName("go-gcsproxy"), semconv.ServiceVersion(Version)}
+	for key, value := range config.CloudMonitoringLabels {
+		attrs = append(attrs, attribute.String(key, value))
+	}
+	res, err := resource.New(ctx,
+		resource.WithDetectors(gcp.NewDetector()),
+		resource.WithFromEnv(),
+		resource.WithAttributes(attrs...))
+	if errors.Is(err, resource.ErrPartialResource) || errors.Is(err, resource.ErrSchemaURLConflict) {
+		// off GCP the detector fails, the labels are still kept
+		log.Debugf("Cloud Monitoring resource detection: %v", err)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to detect the Cloud Monitoring resource: %v", err)
+	}
+
+	exporter, err := mexporter.New(
+		mexporter.WithProjectID(config.CloudMonitoringProject),
+		mexporter.WithMetricDescriptorTypeFormatter(func(m metricdata.Metrics) string {
+			return "custom.googleapis.com/gcsproxy/" + m.Name
+		}),
+		mexporter.WithFilteredResourceAttributes(func(kv attribute.KeyValue) bool {
+			_, configured := config.CloudMonitoringLabels[string(kv.Key)]
+			return configured || mexporter.DefaultResourceAttributesFilter(kv)
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the Cloud Monitoring exporter: %v", err)
+	}
+	log.Infof("pushing metrics to Cloud Monitoring in project %v every %v", config.CloudMonitoringProject, config.CloudMonitoringInterval)
+
+	return []metric.Option{
+		metric.WithResource(res),
+		metric.WithReader(metric.NewPeriodicReader(exporter, metric.WithInterval(config.CloudMonitoringInterval))),
+		// a time series per request would exhaust the custom metric quota
+		metric.WithView(metric.NewView(metric.Instrument{Name: "*"}, metric.Stream{
+			AttributeFilter: attribute.NewDenyKeysFilter("gcsproxy-request-id"),
+		})),
+	}, nil
+}
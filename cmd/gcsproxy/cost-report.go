@@ -0,0 +1,113 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"cloud.google.com/go/storage"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"google.golang.org/api/iterator"
+)
+
+// costTotals sums the live objects of a bucket or prefix
+type costTotals struct {
+	objects         int
+	encrypted       int
+	plaintextBytes  int64 // of every object, decrypted
+	storedBytes     int64 // as GCS bills them
+	encryptedStored int64 // of the encrypted objects only
+}
+
+func (t *costTotals) add(o costTotals) {
+	t.objects += o.objects
+	t.encrypted += o.encrypted
+	t.plaintextBytes += o.plaintextBytes
+	t.storedBytes += o.storedBytes
+	t.encryptedStored += o.encryptedStored
+}
+
+// costReport lists the live objects under each gs://bucket[/prefix] and reports the bytes and the
+// monthly storage cost the encryption envelopes add, e.g.
+// go-gcsproxy cost-report -cost_report_price_per_gib_month=0.026 gs://bucket-a gs://bucket-b/logs
+func costReport(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy cost-report [-cost_report_price_per_gib_month=0.02] gs://bucket[/prefix] ...")
+		return 2
+	}
+	ctx := context.Background()
+	client, err := gcsclient.Storage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	price := cfg.Current().CostReportPricePerGiBMonth
+	fmt.Printf("%-40v %9v %9v %10v %10v %10v %7v %11v\n",
+		"LOCATION", "OBJECTS", "ENCRYPTED", "PLAINTEXT", "STORED", "OVERHEAD", "RATIO", "COST/MONTH")
+	var total costTotals
+	for _, arg := range args {
+		bucketName, prefix, err := util.ParseGcsPrefix(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		totals, err := sumObjects(ctx, client, bucketName, prefix)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to list gs://%v/%v: %v\n", bucketName, prefix, err)
+			return 1
+		}
+		fmt.Println(formatCost(arg, totals, price))
+		total.add(totals)
+	}
+	if len(args) > 1 {
+		fmt.Println(formatCost("total", total, price))
+	}
+	return 0
+}
+
+func sumObjects(ctx context.Context, client *storage.Client, bucketName string, prefix string) (costTotals, error) {
+	var totals costTotals
+	it := util.Bucket(ctx, client, bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return totals, nil
+		}
+		if err != nil {
+			return totals, err
+		}
+		totals.objects++
+		totals.storedBytes += attrs.Size
+		plaintextSize, err := strconv.ParseInt(util.Meta(attrs.Metadata, util.MetaUnencryptedLength), 10, 64)
+		if err != nil {
+			// plaintext or csek objects, GCS stores them at their size
+			totals.plaintextBytes += attrs.Size
+			continue
+		}
+		totals.encrypted++
+		totals.plaintextBytes += plaintextSize
+		totals.encryptedStored += attrs.Size
+	}
+}
+
+// formatCost returns the report line of one location, the overhead is what the encrypted
+// objects store on top of their plaintext
+func formatCost(location string, t costTotals, pricePerGiBMonth float64) string {
+	overhead := t.storedBytes - t.plaintextBytes
+	ratio := 0.0
+	if encryptedPlaintext := t.encryptedStored - overhead; encryptedPlaintext > 0 {
+		ratio = float64(overhead) / float64(encryptedPlaintext)
+	}
+	cost := float64(overhead) / (1024 * 1024 * 1024) * pricePerGiBMonth
+	return fmt.Sprintf("%-40v %9v %9v %10v %10v %10v %6.2f%% %11.2f", location, t.objects, t.encrypted,
+		formatSize(int(t.plaintextBytes)), formatSize(int(t.storedBytes)), formatSize(int(overhead)), ratio*100, cost)
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+)
+
+// csekKey prints the customer-supplied encryption key of an object in a bucket using the csek
+// envelope format, so it can be read without the proxy, e.g.
+// gcloud storage cat --decryption-keys=$(go-gcsproxy csek-key gs://bucket/object) gs://bucket/object
+func csekKey(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy csek-key [flags] gs://bucket/object")
+		return 2
+	}
+	bucketName, objectName, err := util.ParseGcsUrl(args[0])
+	if err != nil || objectName == "" {
+		fmt.Fprintf(os.Stderr, "expected gs://bucket/object, got %q\n", args[0])
+		return 2
+	}
+	if util.GetEnvelopeFormat(bucketName) != util.EnvelopeFormatCsek {
+		fmt.Fprintf(os.Stderr, "bucket %v does not use the csek envelope format\n", bucketName)
+		return 1
+	}
+
+	key, err := crypto.DeriveCsekKey(context.Background(), util.GetKMSKeyName(bucketName), bucketName, objectName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(key))
+	return 0
+}
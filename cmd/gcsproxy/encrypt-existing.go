@@ -0,0 +1,523 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/inventory"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/keymap"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// outcome for one object of encrypt-existing
+const (
+	encryptDone     = "ENCRYPTED"
+	encryptAlready  = "ALREADY_ENCRYPTED"
+	encryptWould    = "WOULD_ENCRYPT" // dry run
+	encryptSkipped  = "SKIPPED"       // can't be encrypted in place, see the detail
+	encryptChanged  = "CHANGED"       // overwritten while we encrypted it, the new generation is left alone
+	encryptRetained = "RETAINED"      // under a hold or retention period, GCS won't let it be replaced
+	encryptFailed   = "FAILED"
+)
+
+// how often encrypt-existing saves its checkpoint
+const checkpointEvery = 5 * time.Second
+
+type encryptResult struct {
+	Object     string `json:"object"`
+	Generation int64  `json:"generation"`
+	Status     string `json:"status"`
+	Size       int64  `json:"size"`
+	Key        string `json:"key,omitempty"`
+	KeyVersion string `json:"keyVersion,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+
+	provenance util.Provenance // recorded in the metadata of the encrypted generation
+}
+
+// encryptExisting encrypts the plaintext objects under gs://bucket[/prefix] in place with the
+// bucket's mapped key, for onboarding buckets that already hold data, e.g.
+// go-gcsproxy encrypt-existing -kms_bucket_key_mappings=bucket:projects/.../cryptoKeys/key gs://bucket
+func encryptExisting(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy encrypt-existing [-encrypt_existing_dry_run] [flags] gs://bucket[/prefix]")
+		return 2
+	}
+	bucketName, prefix, err := util.ParseGcsPrefix(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	config := cfg.Current()
+	keyMap := util.KeyMap()
+	keyName := keyMap.Key(bucketName)
+	if keyName == "" {
+		fmt.Fprintf(os.Stderr, "gs://%v is not mapped to a KMS key, pass -kms_bucket_key_mappings\n", bucketName)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	format := keyMap.Format(bucketName)
+	if err := interceptor.CheckKey(ctx, bucketName, keyName, format); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to use %v: %v\n", keyName, err)
+		return 1
+	}
+
+	client, err := gcsclient.Storage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if bucketAttrs, err := util.Bucket(ctx, client, bucketName).Attrs(ctx); err == nil {
+		if bucketAttrs.VersioningEnabled {
+			fmt.Fprintf(os.Stderr, "warning: gs://%v has object versioning, the plaintext generations stay as noncurrent versions\n", bucketName)
+		}
+		if bucketAttrs.SoftDeletePolicy != nil && bucketAttrs.SoftDeletePolicy.RetentionDuration > 0 {
+			fmt.Fprintf(os.Stderr, "warning: gs://%v has soft delete, the plaintext generations stay soft-deleted for %v\n", bucketName, bucketAttrs.SoftDeletePolicy.RetentionDuration)
+		}
+		if bucketAttrs.RetentionPolicy != nil && bucketAttrs.RetentionPolicy.RetentionPeriod > 0 {
+			fmt.Fprintf(os.Stderr, "warning: gs://%v has a retention policy of %v, younger objects are left in plaintext as RETAINED\n", bucketName, bucketAttrs.RetentionPolicy.RetentionPeriod)
+		}
+	}
+
+	startAfter, err := readCheckpoint(config.EncryptExistingCheckpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if startAfter != "" {
+		fmt.Fprintf(os.Stderr, "resuming after %v\n", startAfter)
+	}
+
+	var report io.Writer
+	if config.EncryptExistingReport != "" {
+		file, err := os.OpenFile(config.EncryptExistingReport, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to open report: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		report = file
+	}
+	var table *inventory.BigQueryWriter
+	if config.BigQueryTable != "" {
+		if table, err = inventory.NewBigQueryWriter(ctx, config.BigQueryTable); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	var tableErr error
+
+	e := &bucketEncrypter{
+		client:  client,
+		bucket:  bucketName,
+		keyName: keyName,
+		format:  format,
+		keyMap:  keyMap,
+		dryRun:  config.EncryptExistingDryRun,
+	}
+	if config.EncryptExistingMBPerSecond > 0 {
+		bytesPerSecond := config.EncryptExistingMBPerSecond * 1024 * 1024
+		e.bandwidth = rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond))
+	}
+	parallelism := max(config.EncryptExistingParallelism, 1)
+
+	type job struct {
+		seq   int
+		attrs *storage.ObjectAttrs
+	}
+	type done struct {
+		seq    int
+		result encryptResult
+	}
+	jobs := make(chan job)
+	results := make(chan done)
+	var listErr error
+	go func() {
+		defer close(jobs)
+		it := util.Bucket(ctx, client, bucketName).Objects(ctx, &storage.Query{Prefix: prefix, StartOffset: startAfter})
+		for seq := 0; ; {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				return
+			}
+			if err != nil {
+				listErr = err
+				return
+			}
+			if attrs.Name == startAfter {
+				continue // StartOffset is inclusive
+			}
+			select {
+			case jobs <- job{seq, attrs}:
+				seq++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var workers sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				results <- done{j.seq, e.encrypt(ctx, j.attrs)}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	counts := make(map[string]int)
+	checkpoint := checkpointTracker{done: map[int]string{}}
+	lastSaved := time.Now()
+	for d := range results {
+		r := d.result
+		counts[r.Status]++
+		fmt.Printf("%-17v gs://%v/%v#%v %v\n", r.Status, bucketName, r.Object, r.Generation, r.Detail)
+		if report != nil {
+			line, _ := json.Marshal(r)
+			fmt.Fprintf(report, "%s\n", line)
+		}
+		if table != nil && tableErr == nil {
+			tableErr = table.Write(ctx, inventoryRow(bucketName, r))
+		}
+		// never move the checkpoint past an object that has to be retried
+		if r.Status != encryptFailed && r.Status != encryptRetained && checkpoint.complete(d.seq, r.Object) && !e.dryRun && time.Since(lastSaved) > checkpointEvery {
+			saveCheckpoint(config.EncryptExistingCheckpoint, checkpoint.last)
+			lastSaved = time.Now()
+		}
+	}
+	if !e.dryRun {
+		saveCheckpoint(config.EncryptExistingCheckpoint, checkpoint.last)
+	}
+	if table != nil && tableErr == nil {
+		// the run's context is cancelled when interrupted, the results so far are still sent
+		tableErr = table.Flush(context.Background())
+	}
+
+	fmt.Printf("\n%v encrypted, %v already encrypted, %v would be encrypted, %v skipped, %v changed, %v retained, %v failed\n",
+		counts[encryptDone], counts[encryptAlready], counts[encryptWould], counts[encryptSkipped], counts[encryptChanged], counts[encryptRetained], counts[encryptFailed])
+	if listErr != nil {
+		fmt.Fprintf(os.Stderr, "failed to list objects: %v\n", listErr)
+		return 1
+	}
+	if tableErr != nil {
+		fmt.Fprintln(os.Stderr, tableErr)
+		return 1
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, "interrupted, run again with the same -encrypt_existing_checkpoint to resume")
+		return 1
+	}
+	if counts[encryptRetained] > 0 {
+		fmt.Fprintf(os.Stderr, "%v objects are under a hold or retention period and were left in plaintext, run again once they are released\n", counts[encryptRetained])
+		return 1
+	}
+	if counts[encryptFailed] > 0 {
+		return 1
+	}
+	return 0
+}
+
+// inventoryRow is the BigQuery row of the result of one object, a dry run streams the
+// inventory of the bucket
+func inventoryRow(bucket string, r encryptResult) inventory.Row {
+	row := inventory.Row{
+		Tool:       "encrypt-existing",
+		Bucket:     bucket,
+		Object:     r.Object,
+		Generation: r.Generation,
+		Encrypted:  r.Status == encryptDone || r.Status == encryptAlready,
+		Status:     r.Status,
+		Size:       r.Size,
+		Detail:     r.Detail,
+	}
+	if row.Encrypted {
+		row.Key, row.KeyVersion = r.Key, r.KeyVersion
+		row.ProxyVersion, row.EnvelopeVersion = r.provenance.ProxyVersion, r.provenance.EnvelopeVersion
+		row.EncryptedAt, row.Policy = r.provenance.EncryptedAt, r.provenance.Policy
+	}
+	return row
+}
+
+type bucketEncrypter struct {
+	client    *storage.Client
+	bucket    string
+	keyName   string
+	format    string
+	keyMap    keymap.KeyMap // for the content type and size rules of the bucket
+	dryRun    bool
+	bandwidth *rate.Limiter // nil is unlimited
+}
+
+func (e *bucketEncrypter) encrypt(ctx context.Context, attrs *storage.ObjectAttrs) encryptResult {
+	r := encryptResult{Object: attrs.Name, Generation: attrs.Generation, Size: attrs.Size}
+	if ctx.Err() != nil {
+		r.Status, r.Detail = encryptFailed, "interrupted"
+		return r
+	}
+
+	retained := retention(attrs, time.Now())
+	switch {
+	case attrs.CustomerKeySHA256 != "" && e.format == util.EnvelopeFormatCsek:
+		r.Status, r.Key = encryptAlready, e.keyName
+		return r
+	case attrs.CustomerKeySHA256 != "":
+		r.Status, r.Detail = encryptSkipped, "encrypted with a customer-supplied key"
+		return r
+	case e.format == util.EnvelopeFormatTink && util.Meta(attrs.Metadata, util.MetaProxyVersion) != "":
+		r.provenance = util.ProvenanceOf(attrs.Metadata)
+		r.Status, r.Key, r.KeyVersion = encryptAlready, r.provenance.Key, r.provenance.KeyVersion
+		return r
+	case e.format == util.EnvelopeFormatTink && util.ForeignEncryptionKey(attrs.Metadata) != "":
+		r.provenance = util.ProvenanceOf(attrs.Metadata)
+		r.Status, r.Key, r.Detail = encryptAlready, r.provenance.Key, "written by another Tink client"
+		return r
+	case e.format == util.EnvelopeFormatTink && attrs.Size == 0:
+		// the proxy stores new empty uploads as they are too, an envelope would only add overhead
+		r.Status, r.Detail = encryptSkipped, "empty object"
+		return r
+	case e.format == util.EnvelopeFormatTink && !e.keyMap.EncryptsContentType(e.bucket, attrs.ContentType):
+		// the proxy would store new uploads of it in plaintext too
+		r.Status, r.Detail = encryptSkipped, fmt.Sprintf("content type %v is not encrypted", attrs.ContentType)
+		return r
+	case e.format == util.EnvelopeFormatTink && !e.keyMap.EncryptsSize(e.bucket, attrs.Size):
+		r.Status, r.Detail = encryptSkipped, fmt.Sprintf("size %v is outside the encrypted sizes", attrs.Size)
+		return r
+	case retained != "":
+		// replacing the generation would fail, and must not be attempted on locked data
+		r.Status, r.Detail = encryptRetained, retained+", GCS does not allow replacing it"
+		return r
+	case e.format == util.EnvelopeFormatTink && attrs.ContentEncoding == "gzip":
+		// GCS would decompress the ciphertext on download
+		r.Status, r.Detail = encryptSkipped, "gzip content encoding"
+		return r
+	case e.dryRun:
+		r.Status, r.Key = encryptWould, e.keyName
+		return r
+	}
+
+	var err error
+	if e.format == util.EnvelopeFormatCsek {
+		err = e.rewriteWithCsek(ctx, attrs, &r)
+	} else {
+		err = e.rewriteWithTink(ctx, attrs, &r)
+	}
+	var apiErr *googleapi.Error
+	switch {
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed:
+		r.Status, r.Detail = encryptChanged, "a newer generation was written"
+	case err != nil:
+		r.Status, r.Detail = encryptFailed, err.Error()
+	case r.Status == "":
+		r.Status, r.Key = encryptDone, e.keyName
+	}
+	return r
+}
+
+// retention describes why GCS won't let the generation be replaced at now, "" when it can be
+func retention(attrs *storage.ObjectAttrs, now time.Time) string {
+	switch {
+	case attrs.TemporaryHold:
+		return "under temporary hold"
+	case attrs.EventBasedHold:
+		return "under event-based hold"
+	case attrs.RetentionExpirationTime.After(now):
+		return fmt.Sprintf("retained by the bucket retention policy until %v", attrs.RetentionExpirationTime.Format(time.RFC3339))
+	case attrs.Retention != nil && attrs.Retention.RetainUntil.After(now):
+		return fmt.Sprintf("retained (%v mode) until %v", attrs.Retention.Mode, attrs.Retention.RetainUntil.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// rewriteWithCsek has GCS rewrite the generation with the object's derived CSEK, the data
+// does not leave GCS. metadata and storage class are kept by the rewrite.
+func (e *bucketEncrypter) rewriteWithCsek(ctx context.Context, attrs *storage.ObjectAttrs, r *encryptResult) error {
+	key, err := crypto.DeriveCsekKey(ctx, e.keyName, e.bucket, attrs.Name)
+	if err != nil {
+		return err
+	}
+	obj := util.Bucket(ctx, e.client, e.bucket).Object(attrs.Name)
+	dst := obj.Key(key).If(storage.Conditions{GenerationMatch: attrs.Generation})
+	newAttrs, err := dst.CopierFrom(obj.Generation(attrs.Generation)).Run(ctx)
+	if err != nil {
+		return err
+	}
+	r.Generation = newAttrs.Generation
+	return nil
+}
+
+// rewriteWithTink downloads the generation, encrypts it like the proxy does and uploads it
+// over the same generation
+func (e *bucketEncrypter) rewriteWithTink(ctx context.Context, attrs *storage.ObjectAttrs, r *encryptResult) error {
+	obj := util.Bucket(ctx, e.client, e.bucket).Object(attrs.Name)
+	if err := e.waitBandwidth(ctx, attrs.Size); err != nil {
+		return err
+	}
+	reader, err := obj.Generation(attrs.Generation).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read object: %w", err)
+	}
+	plaintext, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read object: %w", err)
+	}
+	if _, err := envelope.ParseHeader(plaintext); err == nil {
+		r.Status, r.Detail = encryptAlready, "an envelope without proxy metadata"
+		return nil
+	}
+	return e.writeWithTink(ctx, attrs, plaintext, r)
+}
+
+// writeWithTink encrypts plaintext like the proxy does and uploads it over the generation of
+// attrs, keeping its metadata but the encryption metadata of any previous encryption
+func (e *bucketEncrypter) writeWithTink(ctx context.Context, attrs *storage.ObjectAttrs, plaintext []byte, r *encryptResult) error {
+	obj := util.Bucket(ctx, e.client, e.bucket).Object(attrs.Name)
+	ciphertext, keyVersion, err := crypto.EncryptBytesWithKeyVersion(crypto.WithChunkSize(ctx, e.keyMap.ChunkSize(e.bucket)), e.keyName, plaintext)
+	if err != nil {
+		return err
+	}
+	r.KeyVersion = keyVersion
+	if err := e.waitBandwidth(ctx, int64(len(ciphertext))); err != nil {
+		return err
+	}
+
+	metadata := maps.Clone(attrs.Metadata)
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	util.DeleteMeta(metadata)
+	metadata[util.MetaKey(util.MetaUnencryptedLength)] = strconv.Itoa(len(plaintext))
+	metadata[util.MetaKey(util.MetaMd5Hash)] = crypto.Base64MD5Hash(plaintext)
+	metadata[util.MetaKey(util.MetaCrc32c)] = crypto.Base64Crc32cHash(plaintext)
+	metadata[util.MetaKey(util.MetaEncryptionKey)] = e.keyName
+	metadata[util.MetaKey(util.MetaEncryptionKeyVersion)] = keyVersion
+	metadata[util.MetaKey(util.MetaProxyVersion)] = cfg.Current().GCSProxyVersion
+	metadata[util.MetaKey(util.MetaEnvelopeVersion)] = strconv.Itoa(envelope.Version)
+	if crypto.EscrowKeyName != "" {
+		metadata[util.MetaKey(util.MetaEscrowKey)] = crypto.EscrowKeyName
+	}
+	maps.Copy(metadata, util.EncryptionProvenance(e.keyMap.Policy))
+
+	writer := obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).NewWriter(ctx)
+	writer.ContentType = attrs.ContentType
+	writer.ContentLanguage = attrs.ContentLanguage
+	writer.ContentDisposition = attrs.ContentDisposition
+	writer.CacheControl = attrs.CacheControl
+	writer.StorageClass = attrs.StorageClass
+	writer.CustomTime = attrs.CustomTime
+	writer.Metadata = metadata
+	md5Hash := md5.Sum(ciphertext)
+	writer.MD5 = md5Hash[:]
+	if _, err := writer.Write(ciphertext); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to write object: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to write object: %w", err)
+	}
+	r.Generation = writer.Attrs().Generation
+	r.provenance = util.ProvenanceOf(metadata)
+	return nil
+}
+
+func (e *bucketEncrypter) waitBandwidth(ctx context.Context, n int64) error {
+	if e.bandwidth == nil {
+		return nil
+	}
+	for n > 0 {
+		chunk := min(n, int64(e.bandwidth.Burst()))
+		if err := e.bandwidth.WaitN(ctx, int(chunk)); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// checkpointTracker keeps the last object name up to which every object is done. objects
+// finish out of order, the checkpoint only moves once all objects listed before are done.
+type checkpointTracker struct {
+	next int
+	done map[int]string
+	last string
+}
+
+// complete marks object seq done and reports whether the checkpoint moved
+func (t *checkpointTracker) complete(seq int, name string) bool {
+	t.done[seq] = name
+	moved := false
+	for {
+		name, ok := t.done[t.next]
+		if !ok {
+			return moved
+		}
+		delete(t.done, t.next)
+		t.last = name
+		t.next++
+		moved = true
+	}
+}
+
+func readCheckpoint(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading checkpoint: %v", err)
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+func saveCheckpoint(path string, last string) {
+	if path == "" || last == "" {
+		return
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, []byte(last+"\n"), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing checkpoint: %v\n", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing checkpoint: %v\n", err)
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+)
+
+// hybridKeyset writes a new HPKE keyset for the hybrid mode: the private keyset encrypted with
+// -hybrid_keyset_kms_key for the central readers and the public keyset for the producers, e.g.
+// go-gcsproxy hybrid-keyset -hybrid_keyset_kms_key=projects/.../cryptoKeys/k edge-private.json edge-public.json
+func hybridKeyset(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy hybrid-keyset -hybrid_keyset_kms_key=KEY private.json public.json")
+		return 2
+	}
+	kmsKeyName := cfg.Current().HybridKeysetKmsKey
+	if kmsKeyName == "" {
+		fmt.Fprintln(os.Stderr, "missing -hybrid_keyset_kms_key")
+		return 2
+	}
+	for _, file := range args {
+		if _, err := os.Stat(file); err == nil {
+			fmt.Fprintf(os.Stderr, "%v exists, not overwriting a keyset\n", file)
+			return 1
+		}
+	}
+
+	handle, err := crypto.NewHybridKeyset()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := crypto.WriteHybridKeyset(context.Background(), handle, kmsKeyName, args[0], args[1]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "wrote the private keyset to %v and the public keyset to %v\n", args[0], args[1])
+	return 0
+}
@@ -0,0 +1,337 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/cert"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// wizard asks the questions of init on a terminal, and takes the defaults without one or with
+// -init_yes
+type wizard struct {
+	in          *bufio.Reader
+	interactive bool
+}
+
+// ask prints question and returns the answer, def when it is empty
+func (w *wizard) ask(question string, def string) string {
+	if !w.interactive {
+		return def
+	}
+	if def != "" {
+		fmt.Printf("%v [%v]: ", question, def)
+	} else {
+		fmt.Printf("%v: ", question)
+	}
+	line, err := w.in.ReadString('\n')
+	if answer := strings.TrimSpace(line); answer != "" {
+		return answer
+	}
+	if err == io.EOF {
+		// the rest is answered with the defaults
+		w.interactive = false
+		fmt.Println()
+	}
+	return def
+}
+
+// initWizard writes a starter -config_file encrypting buckets the credentials can access with the
+// KMS keys suggested for them, creates the CA certificate of -cert_path and prints what the
+// clients need to use the proxy. It asks on a terminal, the init_ flags answer instead, e.g.
+// go-gcsproxy init -init_yes -init_buckets=data,logs -init_key=projects/.../cryptoKeys/k
+func initWizard(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy init [-init_project=P] [-init_buckets=B1,B2] [-init_key=KEY] [-init_output=FILE] [-init_yes]")
+		return 2
+	}
+	config := cfg.Current()
+	ctx := context.Background()
+	stdin, _ := os.Stdin.Stat()
+	w := &wizard{in: bufio.NewReader(os.Stdin), interactive: !config.InitYes && stdin != nil && stdin.Mode()&os.ModeCharDevice != 0}
+
+	if _, err := os.Stat(config.InitOutput); err == nil {
+		fmt.Fprintf(os.Stderr, "%v exists, remove it or write another file with -init_output\n", config.InitOutput)
+		return 1
+	}
+
+	project := config.InitProject
+	if project == "" {
+		project = credentialsProject(ctx)
+	}
+	project = w.ask("Project of the buckets", project)
+
+	client, err := gcsclient.Storage()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create the storage client: %v\n", err)
+		return 1
+	}
+	buckets, err := discoverBuckets(ctx, client, project, config.InitBuckets)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(buckets) == 0 {
+		fmt.Fprintf(os.Stderr, "no buckets found in project %q, name them with -init_buckets\n", project)
+		return 1
+	}
+	fmt.Println("Buckets:")
+	for i, b := range buckets {
+		fmt.Printf("  %3d. %-40v %v\n", i+1, b.Name, b.Location)
+	}
+	buckets, err = chooseBuckets(buckets, w.ask("Buckets to encrypt, numbers or names separated by commas", "all"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	keys := newKeySuggestions(ctx, project)
+	var mappings []string
+	for _, b := range buckets {
+		suggested := keys.suggest(b)
+		fmt.Printf("KMS keys for gs://%v:\n", b.Name)
+		for i, key := range suggested {
+			fmt.Printf("  %3d. %v\n", i+1, key)
+		}
+		def := config.InitKey
+		if def == "" && len(suggested) > 0 {
+			def = suggested[0]
+		}
+		answer := w.ask(fmt.Sprintf("Key for gs://%v, a number, a key name or skip", b.Name), def)
+		if answer == "skip" {
+			continue
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(suggested) {
+			answer = suggested[n-1]
+		}
+		if !strings.HasPrefix(answer, "projects/") || !strings.Contains(answer, "/cryptoKeys/") {
+			fmt.Fprintf(os.Stderr, "no KMS key for gs://%v, got %q: set -init_key or run init on a terminal\n", b.Name, answer)
+			return 1
+		}
+		if err := crypto.CheckKeyUsable(ctx, answer, ""); err != nil {
+			fmt.Printf("  warning: %v\n", err)
+		}
+		mappings = append(mappings, b.Name+":"+answer)
+	}
+	if len(mappings) == 0 {
+		fmt.Fprintln(os.Stderr, "no bucket to encrypt, nothing written")
+		return 1
+	}
+
+	certPath, err := filepath.Abs(config.CertPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := writeStarterConfig(config.InitOutput, map[string]any{
+		"kms_bucket_key_mappings": strings.Join(mappings, ","),
+		"cert_path":               certPath,
+		"port":                    config.Addr,
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("\nWrote %v, encrypting %v buckets\n", config.InitOutput, len(mappings))
+	if _, err := cert.NewSelfSignCA(certPath); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create the CA certificate in %v: %v\n", certPath, err)
+		return 1
+	}
+	caCert := filepath.Join(certPath, "mitmproxy-ca-cert.pem")
+	fmt.Printf("The proxy's CA certificate is %v\n", caCert)
+
+	fmt.Println("\nStart the proxy, with credentials that can use the keys (roles/cloudkms.cryptoKeyEncrypterDecrypter):")
+	fmt.Printf("  %v -config_file=%v\n", os.Args[0], config.InitOutput)
+	fmt.Println("\nThen point the clients at it:")
+	proxyUrl := "http://" + clientAddr(config.ListenAddrs)
+	fmt.Printf("  export HTTPS_PROXY=%v\n", proxyUrl)
+	fmt.Printf("  export https_proxy=%v\n", proxyUrl)
+	fmt.Printf("  export REQUESTS_CA_BUNDLE=%v\n", caCert)
+	fmt.Printf("  export SSL_CERT_FILE=%v\n", caCert)
+	fmt.Printf("  gcloud config set custom_ca_certs_file %v\n", caCert)
+	return 0
+}
+
+// credentialsProject is the project of the default credentials, or of GOOGLE_CLOUD_PROJECT
+func credentialsProject(ctx context.Context) string {
+	if project := os.Getenv("GOOGLE_CLOUD_PROJECT"); project != "" {
+		return project
+	}
+	if credentials, err := google.FindDefaultCredentials(ctx, storage.ScopeReadOnly); err == nil {
+		return credentials.ProjectID
+	}
+	return ""
+}
+
+// discoverBuckets returns the attributes of names, of the buckets of project without names
+func discoverBuckets(ctx context.Context, client *storage.Client, project string, names []string) ([]*storage.BucketAttrs, error) {
+	var buckets []*storage.BucketAttrs
+	if len(names) > 0 {
+		for _, name := range names {
+			attrs, err := util.Bucket(ctx, client, name).Attrs(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get bucket %v: %v", name, err)
+			}
+			buckets = append(buckets, attrs)
+		}
+		return buckets, nil
+	}
+	if project == "" {
+		return nil, errors.New("no project to list the buckets of, set -init_project or -init_buckets")
+	}
+	it := client.Buckets(ctx, project)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return buckets, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to list the buckets of %v: %v", project, err)
+		}
+		buckets = append(buckets, attrs)
+	}
+}
+
+// chooseBuckets returns the buckets answer selects by number or name, all of them for "all"
+func chooseBuckets(buckets []*storage.BucketAttrs, answer string) ([]*storage.BucketAttrs, error) {
+	if answer == "all" {
+		return buckets, nil
+	}
+	var chosen []*storage.BucketAttrs
+	for _, field := range strings.Split(answer, ",") {
+		field = strings.TrimSpace(field)
+		i := slices.IndexFunc(buckets, func(b *storage.BucketAttrs) bool { return b.Name == field })
+		if n, err := strconv.Atoi(field); err == nil {
+			i = n - 1
+		}
+		if i < 0 || i >= len(buckets) {
+			return nil, fmt.Errorf("no bucket %q in the list", field)
+		}
+		chosen = append(chosen, buckets[i])
+	}
+	return chosen, nil
+}
+
+// keySuggestions lists the KMS keys of a project once per location
+type keySuggestions struct {
+	ctx        context.Context
+	project    string
+	service    *cloudkms.Service // nil when KMS can't be called
+	byLocation map[string][]string
+}
+
+func newKeySuggestions(ctx context.Context, project string) *keySuggestions {
+	s := &keySuggestions{ctx: ctx, project: project, byLocation: map[string][]string{}}
+	ts, err := gcsclient.TokenSource(ctx, cloudkms.CloudPlatformScope)
+	if err == nil {
+		s.service, err = cloudkms.NewService(ctx, option.WithTokenSource(ts))
+	}
+	if err != nil {
+		fmt.Printf("  warning: no KMS keys to suggest: %v\n", err)
+	}
+	return s
+}
+
+// suggest returns the keys fit for bucket: its default CMEK key, and the symmetric keys of the
+// project in the bucket's location and in global
+func (s *keySuggestions) suggest(bucket *storage.BucketAttrs) []string {
+	var keys []string
+	if bucket.Encryption != nil && bucket.Encryption.DefaultKMSKeyName != "" {
+		keys = append(keys, bucket.Encryption.DefaultKMSKeyName)
+	}
+	for _, location := range []string{strings.ToLower(bucket.Location), "global"} {
+		for _, key := range s.keys(location) {
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// keys returns the encryption keys of the project in location
+func (s *keySuggestions) keys(location string) []string {
+	if keys, ok := s.byLocation[location]; ok || s.service == nil || s.project == "" {
+		return keys
+	}
+	var keys []string
+	rings := s.service.Projects.Locations.KeyRings
+	err := rings.List(fmt.Sprintf("projects/%v/locations/%v", s.project, location)).Pages(s.ctx, func(page *cloudkms.ListKeyRingsResponse) error {
+		for _, ring := range page.KeyRings {
+			err := rings.CryptoKeys.List(ring.Name).Filter("purpose=ENCRYPT_DECRYPT").Pages(s.ctx, func(page *cloudkms.ListCryptoKeysResponse) error {
+				for _, key := range page.CryptoKeys {
+					keys = append(keys, key.Name)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("  warning: unable to list the KMS keys of %v in %v: %v\n", s.project, location, err)
+	}
+	s.byLocation[location] = keys
+	return keys
+}
+
+// writeStarterConfig writes the -config_file of settings to path, failing when it exists
+func writeStarterConfig(path string, settings map[string]any) error {
+	data, err := json.MarshalIndent(map[string]any{"settings": settings}, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write the config file: %v", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write the config file: %v", err)
+	}
+	return f.Close()
+}
+
+// clientAddr is the address the local clients reach the first TCP listen addr at
+func clientAddr(listenAddrs []string) string {
+	for _, addr := range listenAddrs {
+		if strings.HasPrefix(addr, "unix://") {
+			continue
+		}
+		addr = strings.TrimPrefix(strings.TrimPrefix(addr, "tcp4://"), "tcp6://")
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "127.0.0.1"
+		}
+		return net.JoinHostPort(host, port)
+	}
+	return "127.0.0.1:9080"
+}
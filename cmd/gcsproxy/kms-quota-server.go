@@ -0,0 +1,40 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/kmsquota"
+	log "github.com/sirupsen/logrus"
+)
+
+// kmsQuotaServer hands out the KMS quota of -kms_qps to the replicas started with
+// -kms_quota_server, e.g. go-gcsproxy kms-quota-server -kms_qps=300 :9085
+func kmsQuotaServer(args []string) int {
+	config := cfg.Current()
+	if len(args) > 1 || config.KmsQps <= 0 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy kms-quota-server -kms_qps=N [-kms_quota_token=TOKEN] [listen-addr]")
+		return 2
+	}
+	listenAddr := ":9085"
+	if len(args) == 1 {
+		listenAddr = args[0]
+	}
+	if config.KmsQuotaToken == "" {
+		log.Warn("no -kms_quota_token, any client can lease KMS quota")
+	}
+	log.Infof("serving a KMS quota of %v requests per second on %v", config.KmsQps, listenAddr)
+	server := kmsquota.NewServer(config.KmsQps, config.KmsQuotaToken)
+	if err := http.ListenAndServe(listenAddr, server); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,673 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	rawLog "log"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/backend"
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsrewrite"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/keymap"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/logsample"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/manifest"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/mirror"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/notifications"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/redact"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/spool"
+	"github.com/byronwhitlock-google/go-gcsproxy/policy"
+	gcsproxy "github.com/byronwhitlock-google/go-gcsproxy/proxy"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"go.opentelemetry.io/otel/metric"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// makefile will turn this into a version
+var Version = ".3"
+
+// custom metadata key prefixes, GCS keeps the keys of the XML API lowercase
+var metadataPrefixPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*-$`)
+
+var subscriptionPattern = regexp.MustCompile(`^projects/[^/]+/subscriptions/[^/]+$`)
+
+// subcommands run a one off tool with the proxy configuration instead of starting the proxy,
+// e.g. go-gcsproxy verify-restore -kms_bucket_key_mappings=... gs://bucket/prefix
+var subcommands = map[string]func(args []string) int{
+	"init":              initWizard,
+	"verify-restore":    verifyRestore,
+	"verify-transfer":   verifyTransfer,
+	"recover":           recoverObject,
+	"csek-key":          csekKey,
+	"sign-policy":       signPolicy,
+	"replay":            replayDump,
+	"unix-shim":         unixShim,
+	"encrypt-existing":  encryptExisting,
+	"tail":              tail,
+	"monitoring-config": monitoringConfig,
+	"cost-report":       costReport,
+	"hybrid-keyset":     hybridKeyset,
+	"verify-manifest":   verifyManifest,
+	"kms-quota-server":  kmsQuotaServer,
+	"purge":             purge,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			initConfig()
+			os.Exit(subcommand(flag.Args()))
+		}
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		s := <-sigc
+		log.Info("Signal Caught: ", s)
+		os.Exit(0)
+	}()
+
+	initConfig()
+
+	// If OTEL or Cloud Monitoring is configured. Setup the custom metrics to capture encrypt/decrypt time.
+	if metricsEnabled(cfg.Current()) {
+		initMetrics()
+		startPolicyDistribution()
+		startMappingDir()
+		mustCheckKmsBucketKeyMapping()
+		runner := gcsproxy.NewProxyRunner(cfg.Current())
+
+		// Setup metrics, tracing, and context propagation
+		ctx := context.Background()
+		shutdown, err := setupOpenTelemetry(ctx, cfg.Current())
+		if err != nil {
+			log.Fatalf("Error setting up OpenTelemetry. Error: %v", err)
+		}
+
+		// Start the GCS proxy server, and shutdown and flush telemetry after it exits.
+		slog.InfoContext(ctx, "server starting...")
+		if err = errors.Join(runner.Start(), shutdown(ctx)); err != nil {
+			log.Fatalf("Server exited with error. Error: %v", err)
+		}
+	} else {
+		startPolicyDistribution()
+		startMappingDir()
+		mustCheckKmsBucketKeyMapping()
+		runner := gcsproxy.NewProxyRunner(cfg.Current())
+		err := runner.Start()
+		if err != nil {
+			log.Fatalf("Fatal error to start the GCS proxy. Error: %v", err)
+		} else {
+			log.Info("GCS proxy started successfully")
+		}
+	}
+}
+
+func initMetrics() {
+	var err error
+	crypto.EncryptTime, err = crypto.Meter.Float64Gauge(
+		"proxy.encryptTime",
+		metric.WithDescription("GCS Proxy Encryption time"),
+		metric.WithUnit("seconds"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.DecryptTime, err = crypto.Meter.Float64Gauge(
+		"proxy.decryptTime",
+		metric.WithDescription("GCS Proxy Decryption time"),
+		metric.WithUnit("seconds"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.AeadQueueTime, err = crypto.Meter.Float64Histogram(
+		"proxy.aeadQueueTime",
+		metric.WithDescription("GCS Proxy time encryptions and decryptions waited for a worker of -aead_workers"),
+		metric.WithUnit("seconds"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = crypto.Meter.Int64ObservableGauge(
+		"proxy.aeadQueued",
+		metric.WithDescription("GCS Proxy encryptions and decryptions waiting for a worker of -aead_workers"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			o.Observe(crypto.QueuedAeadOperations())
+			return nil
+		}),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.KmsRequests, err = crypto.Meter.Int64Counter(
+		"proxy.kmsRequests",
+		metric.WithDescription("GCS Proxy KMS requests by project, key, operation and result"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.KmsQuotaWait, err = crypto.Meter.Float64Histogram(
+		"proxy.kmsQuotaWait",
+		metric.WithDescription("GCS Proxy time KMS requests waited for -kms_qps and -kms_project_qps by project"),
+		metric.WithUnit("seconds"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.KmsErrors, err = crypto.Meter.Int64Counter(
+		"proxy.kmsErrors",
+		metric.WithDescription("GCS Proxy KMS failures by code and operation"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	interceptor.Requests, err = crypto.Meter.Int64Counter(
+		"proxy.requests",
+		metric.WithDescription("GCS Proxy GCS requests by action, result and upload"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	interceptor.PlaintextBytes, err = crypto.Meter.Int64Counter(
+		"proxy.plaintextBytes",
+		metric.WithDescription("GCS Proxy plaintext bytes of the uploads it encrypted by bucket"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	interceptor.CiphertextBytes, err = crypto.Meter.Int64Counter(
+		"proxy.ciphertextBytes",
+		metric.WithDescription("GCS Proxy stored bytes of the uploads it encrypted by bucket"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	mirror.Uploads, err = crypto.Meter.Int64Counter(
+		"proxy.mirrorUploads",
+		metric.WithDescription("GCS Proxy mirror copies by bucket and result"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	spool.Uploads, err = crypto.Meter.Int64Counter(
+		"proxy.spoolUploads",
+		metric.WithDescription("GCS Proxy spooled uploads forwarded to GCS by result"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = crypto.Meter.Int64ObservableGauge(
+		"proxy.spoolDepth",
+		metric.WithDescription("GCS Proxy spooled uploads waiting for GCS"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			uploads, _ := spool.Depth()
+			o.Observe(uploads)
+			return nil
+		}),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = crypto.Meter.Int64ObservableGauge(
+		"proxy.spoolBytes",
+		metric.WithDescription("GCS Proxy size of the spooled uploads waiting for GCS"),
+		metric.WithUnit("By"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			_, size := spool.Depth()
+			o.Observe(size)
+			return nil
+		}),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	gcsproxy.ThrottledRequests, err = crypto.Meter.Int64Counter(
+		"proxy.throttledRequests",
+		metric.WithDescription("GCS Proxy requests answered with 429 by scope and limit"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	gcsproxy.OversizedUploads, err = crypto.Meter.Int64Counter(
+		"proxy.oversizedUploads",
+		metric.WithDescription("GCS Proxy uploads over -max_object_sizes rejected by bucket"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	gcsproxy.TunneledConnections, err = crypto.Meter.Int64Counter(
+		"proxy.tunnels",
+		metric.WithDescription("GCS Proxy CONNECT tunnels passed through without interception by host"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	gcsproxy.TunneledBytes, err = crypto.Meter.Int64Counter(
+		"proxy.tunnelBytes",
+		metric.WithDescription("Bytes of the CONNECT tunnels passed through without interception by host and direction"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = crypto.Meter.Int64ObservableGauge(
+		"proxy.encryptionDisabled",
+		metric.WithDescription("GCS Proxy 1 while GCS_PROXY_DISABLE_ENCRYPTION passes every request through in plaintext"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			if cfg.Current().EncryptDisabled {
+				o.Observe(1)
+			} else {
+				o.Observe(0)
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	manifest.Written, err = crypto.Meter.Int64Counter(
+		"proxy.manifests",
+		metric.WithDescription("GCS Proxy integrity manifests written by bucket and result"),
+	)
+	if err != nil {
+		panic(err)
+	}
+	interceptor.CanaryRuns, err = crypto.Meter.Int64Counter(
+		"proxy.canaryRuns",
+		metric.WithDescription("GCS Proxy canary cycles by bucket, result and failed stage"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	hdl.ListPrefetches, err = crypto.Meter.Int64Counter(
+		"proxy.listPrefetches",
+		metric.WithDescription("GCS Proxy objects prefetched after a listing by bucket and result"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	notifications.Received, err = crypto.Meter.Int64Counter(
+		"proxy.notifications",
+		metric.WithDescription("GCS Proxy bucket notifications and policy updates received by bucket and event type"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.DedupHits, err = crypto.Meter.Int64Counter(
+		"proxy.dedupHits",
+		metric.WithDescription("GCS Proxy uploads encrypted with the reused ciphertext of an identical upload by bucket"),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func initConfig() {
+	config := cfg.LoadConfig()
+
+	if config.Version {
+		log.Infof("go-gcsproxy: %v", Version)
+		usage()
+		os.Exit(0)
+	}
+
+	if config.Debug > 0 {
+		rawLog.SetFlags(rawLog.LstdFlags | rawLog.Lshortfile)
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+	if config.Debug == 2 {
+		log.SetReportCaller(true)
+	}
+	log.SetOutput(os.Stdout)
+	var formatter log.Formatter = &log.TextFormatter{
+		FullTimestamp: true,
+	}
+	redact.SetEnabled(!config.UnsafeDisableRedaction)
+	if redact.Enabled() {
+		formatter = redact.NewFormatter(formatter)
+	}
+	if len(config.LogSampleRates) > 0 || len(config.LogRateLimits) > 0 {
+		formatter = logsample.NewFormatter(formatter, config.LogSampleRates, config.LogRateLimits)
+	}
+	log.SetFormatter(formatter)
+	if config.EncryptDisabled {
+		if !config.PlaintextConfirmed {
+			log.Fatal("GCS_PROXY_DISABLE_ENCRYPTION is set: the proxy would upload and download every object in plaintext. set -i_understand_plaintext (or GCS_PROXY_I_UNDERSTAND_PLAINTEXT) to run anyway")
+		}
+		log.Warn("ENCRYPTION IS DISABLED by GCS_PROXY_DISABLE_ENCRYPTION: every object is uploaded and downloaded in plaintext")
+	}
+	if config.UnsafeDisableRedaction {
+		log.Warn("-unsafe_disable_redaction: credentials and encryption keys are written to the logs and dumps as they are")
+	}
+
+	switch config.DoubleEncryption {
+	case hdl.DoubleEncryptionSkip, hdl.DoubleEncryptionError, hdl.DoubleEncryptionEncrypt:
+	default:
+		log.Fatalf("invalid -double_encryption %q, expected skip, error or encrypt", config.DoubleEncryption)
+	}
+	for bucket, size := range config.ChunkSizes {
+		if size != 0 && (size < keymap.MinChunkSize || size > keymap.MaxChunkSize) {
+			log.Fatalf("invalid -bucket_chunk_sizes %v:%v, expected 1KiB to 1GiB", bucket, size)
+		}
+	}
+	if !metadataPrefixPattern.MatchString(config.MetadataPrefix) || strings.HasPrefix(config.MetadataPrefix, "x-goog-") {
+		log.Fatalf("invalid -metadata_prefix %q, expected lowercase letters, digits and dashes ending with a dash, not starting with x-goog-", config.MetadataPrefix)
+	}
+	switch config.KeyFailurePolicy {
+	case interceptor.KeyFailureServe, interceptor.KeyFailureRejectUploads, interceptor.KeyFailureReject:
+	default:
+		log.Fatalf("invalid -key_failure_policy %q, expected serve, reject-uploads or reject", config.KeyFailurePolicy)
+	}
+	switch config.HmacPolicy {
+	case interceptor.HmacResign, interceptor.HmacReject, interceptor.HmacBypass:
+	default:
+		log.Fatalf("invalid -hmac_signed_requests %q, expected resign, reject or bypass", config.HmacPolicy)
+	}
+	if config.HmacPolicy == interceptor.HmacResign && config.HmacKeysFile == "" {
+		log.Fatal("-hmac_signed_requests=resign needs -hmac_keys_file")
+	}
+	for _, name := range config.Backends {
+		if _, ok := backend.Backends[name]; !ok {
+			log.Fatalf("invalid -backends %q, expected s3 or azure", name)
+		}
+	}
+	if s := config.NotificationsSubscription; s != "" && !subscriptionPattern.MatchString(s) {
+		log.Fatalf("invalid -notifications_subscription %q, expected projects/PROJECT/subscriptions/NAME", s)
+	}
+	if config.GcsMaxAttempts < 1 {
+		log.Fatal("-gcs_max_attempts must be at least 1")
+	}
+	if u, err := url.Parse(config.GcsEndpoint); config.GcsEndpoint != "" && (err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "") {
+		log.Fatalf("invalid -gcs_endpoint %q, expected https://HOST", config.GcsEndpoint)
+	}
+	if config.Upgrade && config.UpgradeSocket == "" {
+		log.Fatal("-upgrade needs -upgrade_socket")
+	}
+	if config.BypassMaxDuration <= 0 {
+		log.Fatal("-bypass_max_duration must be positive")
+	}
+	if config.AdminFetch && config.AdminAddr == "" {
+		log.Fatal("-admin_fetch is served by the admin API, it needs -admin_port")
+	}
+	if config.FlowHistory != "" && config.AdminAddr == "" {
+		log.Fatal("-flow_history is searched with the admin API, it needs -admin_port")
+	}
+	if config.FlowHistory != "" && (config.FlowHistoryMaxAge <= 0 || config.FlowHistoryMaxEntries <= 0) {
+		log.Fatal("-flow_history needs a positive -flow_history_max_age and -flow_history_max_entries")
+	}
+	if config.AeadWorkers < 0 {
+		log.Fatal("-aead_workers must not be negative")
+	}
+	if config.KekTTL < 0 {
+		log.Fatal("-kek_ttl must not be negative")
+	}
+	if len(config.DedupBuckets) > 0 && (config.DedupTTL <= 0 || config.DedupCacheMB <= 0) {
+		log.Fatal("-dedup_buckets needs a positive -dedup_ttl and -dedup_cache_mb")
+	}
+	if config.MetadataShimAddr != "" && len(config.MetadataShimScopes) == 0 {
+		log.Fatal("-metadata_shim_port needs -metadata_shim_scopes")
+	}
+	if config.RetryReuseTTL < 0 {
+		log.Fatal("-retry_reuse_ttl must not be negative")
+	}
+	if config.KmsQps < 0 || config.KmsQuotaReplicas < 1 {
+		log.Fatal("-kms_qps must not be negative and -kms_quota_replicas must be positive")
+	}
+	if config.KmsQuotaServer != "" && config.KmsQps == 0 {
+		log.Fatal("-kms_quota_server needs -kms_qps")
+	}
+	if config.SlowRequestThreshold < 0 {
+		log.Fatal("-slow_request_threshold must not be negative")
+	}
+	if config.SlowRequestHeader && config.SlowRequestThreshold == 0 {
+		log.Fatal("-slow_request_header needs -slow_request_threshold")
+	}
+	if config.ManifestSigningKey != "" && (config.ManifestInterval <= 0 || config.ManifestMaxObjects <= 0) {
+		log.Fatal("-manifest_signing_key needs a positive -manifest_interval and -manifest_max_objects")
+	}
+	if config.CanaryInterval > 0 && config.CanaryObject == "" {
+		log.Fatal("-canary_interval needs -canary_object")
+	}
+	if config.KmsMappingDir != "" && config.PolicySource != "" {
+		log.Fatal("-kms_mapping_dir and -policy_source both set the bucket mappings, use one")
+	}
+	if config.KmsMappingDir != "" && config.KmsMappingDirInterval <= 0 {
+		log.Fatal("-kms_mapping_dir_interval must be positive")
+	}
+	if (config.ListenTlsCert == "") != (config.ListenTlsKey == "") {
+		log.Fatal("-listen_tls_cert and -listen_tls_key must be set together")
+	}
+
+	interceptor.Configure(config)
+	if err := crypto.LoadHybridKeysets(context.Background(), config.HybridKeysets, config.HybridKeysetKmsKey); err != nil {
+		log.Fatal(err)
+	}
+	if config.AdminMappingsFile != "" {
+		if err := util.KeyMaps().MergeFile(config.AdminMappingsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	configJson, _ := json.MarshalIndent(config, "", "\t")
+	log.Infof("go-gcsproxy version '%v' Startting... %v", config.Version, string(configJson))
+}
+
+func usage() {
+	flag.Usage()
+	fmt.Println("\nSubcommands:")
+	fmt.Println("  init                                  write a starter -config_file, the CA certificate and the client settings")
+	fmt.Println("  verify-restore gs://bucket[/prefix]  check that soft-deleted generations can be decrypted once restored")
+	fmt.Println("  verify-transfer SOURCE DESTINATION   compare the plaintext checksums of a transfer between gs:// prefixes or local directories")
+	fmt.Println("  recover gs://bucket/object [file]     decrypt an object with the escrow key, to file or stdout")
+	fmt.Println("  csek-key gs://bucket/object           print the customer-supplied key of an object in a csek bucket")
+	fmt.Println("  sign-policy policy.json [gs://b/o]    sign a policy document with -policy_signing_key, and publish it")
+	fmt.Println("  replay dumpfile                       re-run the flows of a -dump file through the proxy against a fake GCS")
+	fmt.Println("  encrypt-existing gs://bucket[/prefix] encrypt the plaintext objects of an onboarded bucket in place")
+	fmt.Println("  unix-shim unix:///proxy.sock [addr]   relay a loopback TCP port (127.0.0.1:9080) to a proxy listening on a unix socket")
+	fmt.Println("  tail [bucket ...]                     print the flows of the proxy whose admin API is at -admin_port as they finish")
+	fmt.Println("  monitoring-config [dir]               write a Grafana dashboard and Prometheus alerting rules for the proxy metrics")
+	fmt.Println("  cost-report gs://bucket[/prefix] ...  sum what encryption adds to the stored bytes of buckets and its monthly cost")
+	fmt.Println("  verify-manifest gs://bucket/manifest  check the signature of an integrity manifest and the objects it lists")
+	fmt.Println("  hybrid-keyset PRIVATE PUBLIC          write a new hybrid keyset to two files, the private one encrypted with -hybrid_keyset_kms_key")
+	fmt.Println("\nEnvironment variables supported:")
+	fmt.Println("  PROXY_CERT_PATH")
+	fmt.Println("  SSL_INSECURE")
+	fmt.Println("  DEBUG_LEVEL")
+	fmt.Println("  GCP_KMS_BUCKET_KEY_MAPPING")
+	fmt.Println("  GCS_PROXY_KMS_MAPPING_DIR")
+	fmt.Println("  GCS_PROXY_KMS_MAPPING_DIR_INTERVAL")
+	fmt.Println("  GCP_KMS_FALLBACK_KEYS")
+	fmt.Println("  GCP_KMS_ESCROW_KEY")
+	fmt.Println("  GCS_PROXY_KEK_TTL")
+	fmt.Println("  GCS_PROXY_AEAD_WORKERS")
+	fmt.Println("  GCS_PROXY_DEDUP_BUCKETS")
+	fmt.Println("  GCS_PROXY_DEDUP_TTL")
+	fmt.Println("  GCS_PROXY_DEDUP_CACHE_MB")
+	fmt.Println("  GCS_PROXY_RETRY_REUSE_TTL")
+	fmt.Println("  GCS_PROXY_KMS_QPS")
+	fmt.Println("  GCS_PROXY_KMS_QUOTA_SERVER")
+	fmt.Println("  GCS_PROXY_KMS_QUOTA_TOKEN")
+	fmt.Println("  GCS_PROXY_KMS_QUOTA_REPLICAS")
+	fmt.Println("  GCS_PROXY_KMS_PROJECT_QPS")
+	fmt.Println("  GCS_PROXY_HYBRID_KEYSETS")
+	fmt.Println("  GCS_PROXY_HYBRID_KEYSET_KMS_KEY")
+	fmt.Println("  GCS_PROXY_CONFIG_FILE")
+	fmt.Println("  GCS_PROXY_PROFILE")
+	fmt.Println("  GCS_PROXY_BUCKET_ENVELOPE_FORMATS")
+	fmt.Println("  GCS_PROXY_ENCRYPT_CONTENT_TYPES")
+	fmt.Println("  GCS_PROXY_SKIP_CONTENT_TYPES")
+	fmt.Println("  GCS_PROXY_ENCRYPT_MIN_SIZES")
+	fmt.Println("  GCS_PROXY_ENCRYPT_MAX_SIZES")
+	fmt.Println("  GCS_PROXY_MAX_OBJECT_SIZES")
+	fmt.Println("  GCS_PROXY_DECRYPT_CLIENTS")
+	fmt.Println("  GCS_PROXY_OVERRIDE_CLIENTS")
+	fmt.Println("  GCS_PROXY_RESPONSE_HEADERS")
+	fmt.Println("  GCS_PROXY_MIRROR_BUCKETS")
+	fmt.Println("  GCS_PROXY_USER_PROJECT")
+	fmt.Println("  GCS_PROXY_GCS_ENDPOINT")
+	fmt.Println("  GCS_PROXY_IMPERSONATE_SERVICE_ACCOUNT")
+	fmt.Println("  GCS_PROXY_GCS_MAX_ATTEMPTS")
+	fmt.Println("  GCS_PROXY_MIRROR_WORKERS")
+	fmt.Println("  GCS_PROXY_MIRROR_QUEUE_MB")
+	fmt.Println("  GCS_PROXY_SPOOL_DIR")
+	fmt.Println("  GCS_PROXY_SPOOL_MAX_MB")
+	fmt.Println("  GCS_PROXY_SPOOL_RETRY_INTERVAL")
+	fmt.Println("  GCS_PROXY_HMAC_SIGNED_REQUESTS")
+	fmt.Println("  GCS_PROXY_HMAC_KEYS_FILE")
+	fmt.Println("  GCS_PROXY_BACKENDS")
+	fmt.Println("  GCS_PROXY_CLIENT_SHIMS")
+	fmt.Println("  GCS_PROXY_UPGRADE_SOCKET")
+	fmt.Println("  GCS_PROXY_UPGRADE")
+	fmt.Println("  GCS_PROXY_UPGRADE_DRAIN_TIMEOUT")
+	fmt.Println("  PROXY_RUN_AS_USER")
+	fmt.Println("  GCS_PROXY_MTLS_PASSTHROUGH")
+	fmt.Println("  GCS_PROXY_SLICED_DOWNLOAD_CACHE_MB")
+	fmt.Println("  GCS_PROXY_SLICED_DOWNLOAD_CACHE_TTL")
+	fmt.Println("  GCS_PROXY_LIST_PREFETCH_MAX_KB")
+	fmt.Println("  GCS_PROXY_LIST_PREFETCH_MAX_OBJECTS")
+	fmt.Println("  GCS_PROXY_NOTIFICATIONS_SUBSCRIPTION")
+	fmt.Println("  GCS_PROXY_HAR_FILE")
+	fmt.Println("  GCS_PROXY_HAR_REDACT_BODIES")
+	fmt.Println("  GCS_PROXY_AUDIT_LOG")
+	fmt.Println("  GCS_PROXY_ADMIN_ADDR")
+	fmt.Println("  GCS_PROXY_ADMIN_TOKEN")
+	fmt.Println("  GCS_PROXY_ADMIN_MAPPINGS_FILE")
+	fmt.Println("  GCS_PROXY_BYPASS_MAX_DURATION")
+	fmt.Println("  GCS_PROXY_ADMIN_FETCH")
+	fmt.Println("  GCS_PROXY_FLOW_HISTORY")
+	fmt.Println("  GCS_PROXY_FLOW_HISTORY_MAX_AGE")
+	fmt.Println("  GCS_PROXY_FLOW_HISTORY_MAX_ENTRIES")
+	fmt.Println("  GCS_PROXY_POLICY_SOURCE")
+	fmt.Println("  GCS_PROXY_POLICY_POLL_INTERVAL")
+	fmt.Println("  GCS_PROXY_POLICY_VERSION")
+	fmt.Println("  GCS_PROXY_POLICY_SIGNING_KEY")
+	fmt.Println("  GCS_PROXY_POLICY_ALLOW_UNSIGNED")
+	fmt.Println("  GCS_PROXY_REPLAY_LOCAL_KMS")
+	fmt.Println("  GCS_PROXY_DOUBLE_ENCRYPTION")
+	fmt.Println("  GCS_PROXY_METADATA_PREFIX")
+	fmt.Println("  GCS_PROXY_CSE_KEY_METADATA")
+	fmt.Println("  GCS_PROXY_CSE_ASSOCIATED_DATA")
+	fmt.Println("  GCS_PROXY_VERIFY_UPLOADS")
+	fmt.Println("  GCS_PROXY_WRITE_ONLY")
+	fmt.Println("  GCS_PROXY_DISABLE_ENCRYPTION")
+	fmt.Println("  GCS_PROXY_I_UNDERSTAND_PLAINTEXT")
+	fmt.Println("  GCS_PROXY_KEY_CHECK_INTERVAL")
+	fmt.Println("  GCS_PROXY_KEY_FAILURE_POLICY")
+	fmt.Println("  GCS_PROXY_HEALTH_ADDR")
+	fmt.Println("  GCS_PROXY_METADATA_SHIM_ADDR")
+	fmt.Println("  GCS_PROXY_METADATA_SHIM_SCOPES")
+	fmt.Println("  GCS_PROXY_CANARY_INTERVAL")
+	fmt.Println("  GCS_PROXY_CANARY_OBJECT")
+	fmt.Println("  GCS_PROXY_MANIFEST_SIGNING_KEY")
+	fmt.Println("  GCS_PROXY_MANIFEST_INTERVAL")
+	fmt.Println("  GCS_PROXY_MANIFEST_MAX_OBJECTS")
+	fmt.Println("  GCS_PROXY_CHAOS_KMS_LATENCY")
+	fmt.Println("  GCS_PROXY_CHAOS_KMS_LATENCY_RATE")
+	fmt.Println("  GCS_PROXY_CHAOS_KMS_ERROR_RATE")
+	fmt.Println("  GCS_PROXY_CHAOS_UPSTREAM_ERROR_RATE")
+	fmt.Println("  GCS_PROXY_CHAOS_TRUNCATE_RATE")
+	fmt.Println("  GCS_PROXY_LISTEN_ADDRS")
+	fmt.Println("  GCS_PROXY_UNIX_SOCKET_MODE")
+	fmt.Println("  GCS_PROXY_LISTEN_TLS_CERT")
+	fmt.Println("  GCS_PROXY_LISTEN_TLS_KEY")
+	fmt.Println("  GCS_PROXY_TENANTS_FILE")
+	fmt.Println("  GCS_PROXY_ENCRYPT_EXISTING_PARALLELISM")
+	fmt.Println("  GCS_PROXY_ENCRYPT_EXISTING_MB_PER_SECOND")
+	fmt.Println("  GCS_PROXY_ENCRYPT_EXISTING_CHECKPOINT")
+	fmt.Println("  GCS_PROXY_ENCRYPT_EXISTING_REPORT")
+	fmt.Println("  GCS_PROXY_ENCRYPT_EXISTING_DRY_RUN")
+	fmt.Println("  GCS_PROXY_PURGE_RULES")
+	fmt.Println("  GCS_PROXY_PURGE_PARALLELISM")
+	fmt.Println("  GCS_PROXY_PURGE_DRY_RUN")
+	fmt.Println("  GCS_PROXY_BIGQUERY_TABLE")
+	fmt.Println("  GCS_PROXY_COST_REPORT_PRICE_PER_GIB_MONTH")
+	fmt.Println("  GCS_PROXY_INIT_PROJECT")
+	fmt.Println("  GCS_PROXY_INIT_BUCKETS")
+	fmt.Println("  GCS_PROXY_INIT_KEY")
+	fmt.Println("  GCS_PROXY_INIT_OUTPUT")
+	fmt.Println("  GCS_PROXY_INIT_YES")
+	fmt.Println("  GCS_PROXY_LOG_SAMPLE_RATES")
+	fmt.Println("  GCS_PROXY_LOG_RATE_LIMITS")
+	fmt.Println("  GCS_PROXY_SLOW_REQUEST_THRESHOLD")
+	fmt.Println("  GCS_PROXY_SLOW_REQUEST_HEADER")
+	fmt.Println("  GCS_PROXY_UNSAFE_DISABLE_REDACTION")
+	fmt.Println("  GCS_PROXY_CLOUD_MONITORING_PROJECT")
+	fmt.Println("  GCS_PROXY_CLOUD_MONITORING_LABELS")
+	fmt.Println("  GCS_PROXY_CLOUD_MONITORING_INTERVAL")
+	fmt.Println("  GCS_PROXY_CLIENT_REQUESTS_PER_SECOND")
+	fmt.Println("  GCS_PROXY_CLIENT_MB_PER_SECOND")
+	fmt.Println("  GCS_PROXY_BUCKET_REQUESTS_PER_SECOND")
+	fmt.Println("  GCS_PROXY_BUCKET_MB_PER_SECOND")
+}
+
+// startPolicyDistribution applies the central policy before the proxy starts, then keeps polling it
+func startPolicyDistribution() {
+	config := cfg.Current()
+	if config.PolicySource == "" {
+		return
+	}
+	ctx := context.Background()
+	distributor, err := policy.NewDistributor(ctx, config)
+	if err != nil {
+		log.Fatalf("unable to initialize policy distribution: %v", err)
+	}
+	if err := distributor.Update(ctx); err != nil {
+		log.Fatalf("unable to apply policy: %v", err)
+	}
+	go distributor.Poll(ctx, config.PolicyPollInterval, notifications.PolicyUpdates())
+}
+
+// subcommands skip this check, recovering objects must work while the mapped keys are unusable
+func mustCheckKmsBucketKeyMapping() {
+	err := interceptor.CheckKeyMapping(context.TODO())
+	if err != nil {
+		log.Fatalf("\n>>> unable to initialize KmsBucketKeyMapping. %v", err)
+	}
+}
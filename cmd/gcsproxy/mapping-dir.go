@@ -0,0 +1,138 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"maps"
+	"time"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/keymap"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// startMappingDir has the proxy follow the changes of -kms_mapping_dir, LoadConfig applied its
+// mappings already
+func startMappingDir() {
+	config := cfg.Current()
+	if config.KmsMappingDir == "" {
+		return
+	}
+	log.Infof("following the bucket mappings of %v", config.KmsMappingDir)
+	go watchMappingDir(context.Background(), config)
+}
+
+// mappingDirSettle is how long watchMappingDir waits after an event for the others of the same
+// change, a ConfigMap update is a few of them
+const mappingDirSettle = 200 * time.Millisecond
+
+// watchMappingDir reads -kms_mapping_dir when a file of it changes and applies the buckets whose
+// file changed, appeared or disappeared. Kubernetes updates a projected ConfigMap by writing a new
+// hidden directory and swapping the ..data symlink to it, which is an event on the directory
+// itself. The directory is also read every -kms_mapping_dir_interval, for the events lost, e.g.
+// when the directory was replaced, and when the file system can't be watched.
+func watchMappingDir(ctx context.Context, config *cfg.Config) {
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warnf("reading %v every %v only, unable to watch it: %v", config.KmsMappingDir, config.KmsMappingDirInterval, err)
+	} else {
+		defer watcher.Close()
+		if err := watcher.Add(config.KmsMappingDir); err != nil {
+			log.Warnf("reading %v every %v until it can be watched: %v", config.KmsMappingDir, config.KmsMappingDirInterval, err)
+		}
+		events, watchErrors = watcher.Events, watcher.Errors
+	}
+
+	// the first read finds the changes made since LoadConfig, if any
+	var applied map[string]cfg.BucketMapping
+	read := func() {
+		mappings, err := cfg.ReadMappingDir(config.KmsMappingDir)
+		if err != nil {
+			log.Errorf("keeping the bucket mappings in use: %v", err)
+			return
+		}
+		if maps.Equal(mappings, applied) {
+			return
+		}
+		if err := applyMappingDir(ctx, mappings); err != nil {
+			log.Errorf("keeping the bucket mappings in use: %v", err)
+			return
+		}
+		applied = mappings
+	}
+	read()
+
+	ticker := time.NewTicker(config.KmsMappingDirInterval)
+	defer ticker.Stop()
+	settle := time.NewTimer(mappingDirSettle)
+	settle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			log.Debugf("mapping directory event %v", event)
+			settle.Reset(mappingDirSettle)
+		case err, ok := <-watchErrors:
+			if !ok {
+				watchErrors = nil
+				continue
+			}
+			log.Warnf("watching %v: %v", config.KmsMappingDir, err)
+		case <-settle.C:
+			read()
+		case <-ticker.C:
+			if watcher != nil {
+				// a directory replaced or created since is watched again, adding it twice is a no-op
+				watcher.Add(config.KmsMappingDir)
+			}
+			read()
+		}
+	}
+}
+
+// applyMappingDir makes the mappings of the directory the ones in use. The keys of the buckets
+// that changed must be usable, the mappings made otherwise, e.g. by the admin API, are kept.
+func applyMappingDir(ctx context.Context, mappings map[string]cfg.BucketMapping) error {
+	current := cfg.Current()
+	next := current.WithMappingDir(mappings)
+	before := keymap.KeyMap{Keys: current.KmsBucketKeyMapping, Formats: current.EnvelopeFormats}
+	after := keymap.KeyMap{Keys: next.KmsBucketKeyMapping, Formats: next.EnvelopeFormats}
+
+	var changed []string
+	for bucket, key := range after.Keys {
+		if before.Keys[bucket] == key && before.Format(bucket) == after.Format(bucket) {
+			continue
+		}
+		if err := interceptor.CheckKey(ctx, bucket, key, after.Format(bucket)); err != nil {
+			return err
+		}
+		changed = append(changed, bucket)
+	}
+
+	for _, bucket := range changed {
+		util.KeyMaps().SetBucket(bucket, after.Keys[bucket], after.Format(bucket))
+		log.Infof("%v maps bucket %v to %v (%v)", current.KmsMappingDir, bucket, after.Keys[bucket], after.Format(bucket))
+	}
+	for bucket, key := range before.Keys {
+		if _, ok := after.Keys[bucket]; !ok {
+			util.KeyMaps().DeleteBucket(bucket)
+			log.Warnf("%v no longer maps bucket %v (key %v), its objects are no longer encrypted", current.KmsMappingDir, bucket, key)
+		}
+	}
+	cfg.Runtime.Store(next)
+	return nil
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/*
+The proxy metrics as Prometheus names them, once exported over OTLP to a collector or through
+Google Cloud Managed Service for Prometheus: dots become underscores and counters get _total.
+Gauges get their unit appended by some exporters only, the queries match both names.
+*/
+const (
+	promRequests    = `proxy_requests_total`
+	promKmsErrors   = `proxy_kmsErrors_total`
+	promThrottled   = `proxy_throttledRequests_total`
+	promMirror      = `proxy_mirrorUploads_total`
+	promEncryptTime = `{__name__=~"proxy_encryptTime(_seconds)?"}`
+	promDecryptTime = `{__name__=~"proxy_decryptTime(_seconds)?"}`
+	promPlaintext   = `{__name__=~"proxy_plaintextBytes(_bytes)?_total"}`
+	promCiphertext  = `{__name__=~"proxy_ciphertextBytes(_bytes)?_total"}`
+)
+
+// KMS error codes that don't heal by retrying, see crypto/kms-errors.go
+const promKeyUnusableCodes = `KMS_PERMISSION_DENIED|KMS_API_DISABLED|KMS_KEY_DISABLED|KMS_KEY_DESTROYED|KMS_KEY_NOT_FOUND|KMS_WRONG_REGION`
+
+// monitoringConfig writes a Grafana dashboard and Prometheus alerting rules for the proxy
+// metrics to dir, e.g. go-gcsproxy monitoring-config deploy/monitoring
+func monitoringConfig(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy monitoring-config [dir]")
+		return 2
+	}
+	dir := "."
+	if len(args) == 1 {
+		dir = args[0]
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	dashboard, err := json.MarshalIndent(grafanaDashboard(), "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error marshalling the dashboard: %v\n", err)
+		return 1
+	}
+	files := map[string][]byte{
+		"gcsproxy-dashboard.json":   append(dashboard, '\n'),
+		"gcsproxy-alerts.rules.yml": []byte(prometheusRules()),
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("wrote", path)
+	}
+	return 0
+}
+
+// withMatchers adds label matchers to a metric name or a {__name__=~...} selector
+func withMatchers(metric string, matchers string) string {
+	if matchers == "" {
+		return metric
+	}
+	if metric[len(metric)-1] == '}' {
+		return metric[:len(metric)-1] + "," + matchers + "}"
+	}
+	return metric + "{" + matchers + "}"
+}
+
+// selector restricts metric to the dashboard's job variable
+func selector(metric string, matchers string) string {
+	if matchers != "" {
+		matchers = "," + matchers
+	}
+	return withMatchers(metric, `job=~"$job"`+matchers)
+}
+
+func grafanaPanel(id int, title string, kind string, unit string, x int, y int, width int, targets ...string) map[string]interface{} {
+	var queries []map[string]interface{}
+	for i, expr := range targets {
+		queries = append(queries, map[string]interface{}{
+			"refId":      string(rune('A' + i)),
+			"datasource": map[string]string{"type": "prometheus", "uid": "${datasource}"},
+			"expr":       expr,
+		})
+	}
+	return map[string]interface{}{
+		"id":          id,
+		"title":       title,
+		"type":        kind,
+		"datasource":  map[string]string{"type": "prometheus", "uid": "${datasource}"},
+		"gridPos":     map[string]int{"x": x, "y": y, "w": width, "h": 8},
+		"fieldConfig": map[string]interface{}{"defaults": map[string]interface{}{"unit": unit}, "overrides": []interface{}{}},
+		"targets":     queries,
+	}
+}
+
+func grafanaDashboard() map[string]interface{} {
+	plaintextUploads := `sum(increase(` + selector(promRequests, `action=~"passthrough|disabled",upload="true"`) + `[$__range]))`
+	panels := []map[string]interface{}{
+		grafanaPanel(1, "Requests by action", "timeseries", "reqps", 0, 0, 12,
+			`sum by (action) (rate(`+selector(promRequests, "")+`[$__rate_interval]))`),
+		grafanaPanel(2, "Failed requests by action", "timeseries", "reqps", 12, 0, 12,
+			`sum by (action) (rate(`+selector(promRequests, `result="error"`)+`[$__rate_interval]))`),
+		grafanaPanel(3, "Plaintext uploads", "stat", "short", 0, 8, 6, plaintextUploads),
+		grafanaPanel(4, "Decrypt failure ratio", "stat", "percentunit", 6, 8, 6,
+			`sum(rate(`+selector(promRequests, `action="decrypt",result="error"`)+`[$__range])) / sum(rate(`+selector(promRequests, `action="decrypt"`)+`[$__range]))`),
+		grafanaPanel(5, "KMS errors by code", "timeseries", "reqps", 12, 8, 12,
+			`sum by (code, operation) (rate(`+selector(promKmsErrors, "")+`[$__rate_interval]))`),
+		grafanaPanel(6, "Encrypt and decrypt time", "timeseries", "s", 0, 16, 12,
+			`avg(`+selector(promEncryptTime, "")+`)`, `avg(`+selector(promDecryptTime, "")+`)`),
+		grafanaPanel(7, "Throttled requests", "timeseries", "reqps", 12, 16, 12,
+			`sum by (scope, limit) (rate(`+selector(promThrottled, "")+`[$__rate_interval]))`),
+		grafanaPanel(8, "Encryption overhead by bucket", "timeseries", "Bps", 0, 24, 12,
+			`sum by (bucket) (rate(`+selector(promCiphertext, "")+`[$__rate_interval])) - sum by (bucket) (rate(`+selector(promPlaintext, "")+`[$__rate_interval]))`),
+	}
+	return map[string]interface{}{
+		"title":         "go-gcsproxy",
+		"uid":           "go-gcsproxy",
+		"tags":          []string{"gcsproxy", "gcs", "kms"},
+		"schemaVersion": 39,
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"refresh":       "1m",
+		"panels":        panels,
+		"templating": map[string]interface{}{"list": []map[string]interface{}{
+			{"name": "datasource", "type": "datasource", "query": "prometheus", "label": "Data source"},
+			{
+				"name":       "job",
+				"type":       "query",
+				"label":      "Job",
+				"datasource": map[string]string{"type": "prometheus", "uid": "${datasource}"},
+				"query":      "label_values(" + promRequests + ", job)",
+				"includeAll": true,
+				"multi":      true,
+				"allValue":   ".*",
+				"current":    map[string]interface{}{"text": "All", "value": "$__all"},
+				"refresh":    2,
+			},
+		}},
+	}
+}
+
+func prometheusRules() string {
+	return `# Alerting rules for go-gcsproxy, generated by go-gcsproxy monitoring-config
+groups:
+  - name: go-gcsproxy
+    rules:
+      - alert: GcsProxyKmsKeyUnusable
+        expr: sum by (job, code) (increase(` + withMatchers(promKmsErrors, `code=~"`+promKeyUnusableCodes+`"`) + `[5m])) > 0
+        for: 1m
+        labels:
+          severity: critical
+        annotations:
+          summary: "go-gcsproxy can't use its KMS key: {{ $labels.code }}"
+          description: "Uploads and downloads of the buckets mapped to the key fail until its permissions, state or location are fixed."
+      - alert: GcsProxyKmsErrors
+        expr: sum by (job, code) (rate(` + promKmsErrors + `[5m])) > 0.05
+        for: 10m
+        labels:
+          severity: warning
+        annotations:
+          summary: "go-gcsproxy KMS calls fail with {{ $labels.code }}"
+          description: "{{ $value | humanize }} KMS errors per second for 10 minutes."
+      - alert: GcsProxyDecryptFailures
+        expr: |
+          sum by (job) (rate(` + withMatchers(promRequests, `action="decrypt",result="error"`) + `[5m]))
+            / sum by (job) (rate(` + withMatchers(promRequests, `action="decrypt"`) + `[5m])) > 0.01
+        for: 10m
+        labels:
+          severity: critical
+        annotations:
+          summary: "go-gcsproxy fails to decrypt {{ $value | humanizePercentage }} of the downloads"
+          description: "Clients can't read their objects, check the proxy logs for the decrypt errors."
+      - alert: GcsProxyEncryptFailures
+        expr: |
+          sum by (job) (rate(` + withMatchers(promRequests, `action="encrypt",result="error"`) + `[5m]))
+            / sum by (job) (rate(` + withMatchers(promRequests, `action="encrypt"`) + `[5m])) > 0.01
+        for: 10m
+        labels:
+          severity: critical
+        annotations:
+          summary: "go-gcsproxy fails to encrypt {{ $value | humanizePercentage }} of the uploads"
+          description: "Uploads are rejected, check the proxy logs for the encrypt errors."
+      - alert: GcsProxyPlaintextUploads
+        expr: sum by (job) (increase(` + withMatchers(promRequests, `action=~"passthrough|disabled",upload="true"`) + `[15m])) > 0
+        labels:
+          severity: warning
+        annotations:
+          summary: "go-gcsproxy passed {{ $value | humanize }} uploads to GCS without encrypting them"
+          description: "The uploads went to buckets without a key mapping, or encryption is disabled. Silence this alert for proxies that serve unmapped buckets on purpose."
+      - alert: GcsProxyThrottling
+        expr: sum by (job, scope) (rate(` + promThrottled + `[5m])) > 1
+        for: 15m
+        labels:
+          severity: warning
+        annotations:
+          summary: "go-gcsproxy rejects {{ $value | humanize }} requests per second over the {{ $labels.scope }} limits"
+      - alert: GcsProxySlowEncryption
+        expr: avg by (job) (` + promEncryptTime + `) > 1
+        for: 15m
+        labels:
+          severity: warning
+        annotations:
+          summary: "go-gcsproxy takes {{ $value | humanizeDuration }} to encrypt an upload"
+      - alert: GcsProxyMirrorFailures
+        expr: sum by (job, bucket) (increase(` + withMatchers(promMirror, `result=~"error|dropped"`) + `[15m])) > 0
+        labels:
+          severity: warning
+        annotations:
+          summary: "go-gcsproxy did not mirror {{ $value | humanize }} uploads to {{ $labels.bucket }}"
+          description: "The disaster recovery copy is missing, check the proxy logs for the mirror errors, raise -mirror_queue_mb or -mirror_workers for dropped copies."
+`
+}
@@ -0,0 +1,476 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsrewrite"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// outcome for one object of purge, besides the encrypt-existing ones of re-encryptions
+const (
+	purgeDeleted     = "DELETED"
+	purgeWouldDelete = "WOULD_DELETE" // dry run
+	purgeReencrypted = "REENCRYPTED"
+	purgeWouldCrypt  = "WOULD_REENCRYPT" // dry run
+)
+
+// the most requests GCS takes in one batch
+const maxBatchSize = 100
+
+// purgeRule is one lifecycle rule of -purge_rules, e.g.
+// [{"action":"delete","prefix":"tmp/","minAgeDays":30,"encryption":"plaintext"},
+// {"action":"reencrypt","encryption":"encrypted","key":"projects/.../cryptoKeys/old"}]
+type purgeRule struct {
+	Action     string `json:"action"`               // delete or reencrypt, with the bucket's mapped key
+	Prefix     string `json:"prefix,omitempty"`     // of the object names
+	MinAgeDays int    `json:"minAgeDays,omitempty"` // days since the object was created
+	Encryption string `json:"encryption,omitempty"` // encrypted, plaintext, empty or csek, any when unset
+	Key        string `json:"key,omitempty"`        // the KMS key recorded on encrypted objects
+}
+
+// matches reports whether the rule applies to attrs at now
+func (rule purgeRule) matches(attrs *storage.ObjectAttrs, now time.Time) bool {
+	switch {
+	case !strings.HasPrefix(attrs.Name, rule.Prefix):
+		return false
+	case rule.MinAgeDays > 0 && now.Sub(attrs.Created) < time.Duration(rule.MinAgeDays)*24*time.Hour:
+		return false
+	case rule.Encryption != "" && rule.Encryption != "any" && rule.Encryption != encryptionOf(attrs):
+		return false
+	case rule.Key != "" && util.ProvenanceOf(attrs.Metadata).Key != rule.Key:
+		return false
+	}
+	return true
+}
+
+// encryptionOf classifies how an object is stored: encrypted by the proxy or another Tink client,
+// with a customer-supplied key, in plaintext, or empty with nothing to encrypt
+func encryptionOf(attrs *storage.ObjectAttrs) string {
+	switch {
+	case attrs.CustomerKeySHA256 != "":
+		return "csek"
+	case util.Meta(attrs.Metadata, util.MetaProxyVersion) != "" || util.ForeignEncryptionKey(attrs.Metadata) != "":
+		return "encrypted"
+	case attrs.Size == 0:
+		return "empty"
+	}
+	return "plaintext"
+}
+
+func readPurgeRules(path string) ([]purgeRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading purge rules: %v", err)
+	}
+	var rules []purgeRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("error parsing purge rules: %v", err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%v has no rules", path)
+	}
+	for i, rule := range rules {
+		if rule.Action != "delete" && rule.Action != "reencrypt" {
+			return nil, fmt.Errorf("rule %v: action must be delete or reencrypt, got %q", i, rule.Action)
+		}
+		switch rule.Encryption {
+		case "", "any", "encrypted", "plaintext", "empty", "csek":
+		default:
+			return nil, fmt.Errorf("rule %v: encryption must be encrypted, plaintext, empty, csek or any, got %q", i, rule.Encryption)
+		}
+		if rule.MinAgeDays < 0 {
+			return nil, fmt.Errorf("rule %v: negative minAgeDays", i)
+		}
+	}
+	return rules, nil
+}
+
+type purgeResult struct {
+	Object     string `json:"object"`
+	Generation int64  `json:"generation"`
+	Rule       int    `json:"rule"`
+	Status     string `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+// purge applies the lifecycle rules of -purge_rules to the objects under gs://bucket[/prefix]:
+// the first rule an object matches deletes it, with batch requests, or re-encrypts it with the
+// bucket's mapped key. -purge_dry_run simulates the rules, e.g.
+// go-gcsproxy purge -purge_rules=rules.json -purge_dry_run gs://bucket
+func purge(args []string) int {
+	config := cfg.Current()
+	if len(args) != 1 || config.PurgeRules == "" {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy purge -purge_rules=rules.json [-purge_dry_run] [flags] gs://bucket[/prefix]")
+		return 2
+	}
+	bucketName, prefix, err := util.ParseGcsPrefix(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	rules, err := readPurgeRules(config.PurgeRules)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	keyMap := util.KeyMap()
+	p := &purger{
+		bucket: bucketName,
+		dryRun: config.PurgeDryRun,
+		e: &bucketEncrypter{
+			bucket:  bucketName,
+			keyName: keyMap.Key(bucketName),
+			format:  keyMap.Format(bucketName),
+			keyMap:  keyMap,
+			dryRun:  config.PurgeDryRun,
+		},
+	}
+	for _, rule := range rules {
+		if rule.Action != "reencrypt" {
+			continue
+		}
+		if p.e.keyName == "" || p.e.format != util.EnvelopeFormatTink {
+			fmt.Fprintf(os.Stderr, "gs://%v is not mapped to a Tink KMS key, pass -kms_bucket_key_mappings to re-encrypt\n", bucketName)
+			return 2
+		}
+		if err := interceptor.CheckKey(ctx, bucketName, p.e.keyName, p.e.format); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to use %v: %v\n", p.e.keyName, err)
+			return 1
+		}
+		break
+	}
+
+	if p.e.client, err = gcsclient.Storage(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if p.http, err = gcsclient.HTTP(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// a job is a batch of deletes or one object to re-encrypt
+	type job struct {
+		deletes   []*storage.ObjectAttrs
+		reencrypt *storage.ObjectAttrs
+		rules     []int
+	}
+	jobs := make(chan job)
+	results := make(chan []purgeResult)
+	var listErr error
+	kept := 0
+	go func() {
+		defer close(jobs)
+		send := func(j job) bool {
+			select {
+			case jobs <- j:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		var deletes job
+		it := util.Bucket(ctx, p.e.client, bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				listErr = err
+				return
+			}
+			rule := firstMatch(rules, attrs, time.Now())
+			switch {
+			case rule < 0:
+				kept++
+			case rules[rule].Action == "reencrypt":
+				if !send(job{reencrypt: attrs, rules: []int{rule}}) {
+					return
+				}
+			default:
+				deletes.deletes = append(deletes.deletes, attrs)
+				deletes.rules = append(deletes.rules, rule)
+				if len(deletes.deletes) == maxBatchSize {
+					if !send(deletes) {
+						return
+					}
+					deletes = job{}
+				}
+			}
+		}
+		if len(deletes.deletes) > 0 {
+			send(deletes)
+		}
+	}()
+	var workers sync.WaitGroup
+	for i := 0; i < max(config.PurgeParallelism, 1); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				if j.reencrypt != nil {
+					r := p.reencrypt(ctx, j.reencrypt)
+					r.Rule = j.rules[0]
+					results <- []purgeResult{r}
+				} else {
+					results <- p.deleteBatch(ctx, j.deletes, j.rules)
+				}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	counts := make(map[string]int)
+	for batch := range results {
+		for _, r := range batch {
+			counts[r.Status]++
+			fmt.Printf("%-17v gs://%v/%v#%v rule %v %v\n", r.Status, bucketName, r.Object, r.Generation, r.Rule, r.Detail)
+		}
+	}
+
+	fmt.Printf("\n%v deleted, %v would be deleted, %v re-encrypted, %v would be re-encrypted, %v matched no rule, %v skipped, %v changed, %v retained, %v failed\n",
+		counts[purgeDeleted], counts[purgeWouldDelete], counts[purgeReencrypted], counts[purgeWouldCrypt], kept,
+		counts[encryptSkipped], counts[encryptChanged], counts[encryptRetained], counts[encryptFailed])
+	if listErr != nil {
+		fmt.Fprintf(os.Stderr, "failed to list objects: %v\n", listErr)
+		return 1
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, "interrupted, run again to apply the rules to the objects left")
+		return 1
+	}
+	if counts[encryptRetained] > 0 || counts[encryptFailed] > 0 {
+		return 1
+	}
+	return 0
+}
+
+// firstMatch returns the index of the first rule matching attrs, -1 when none does
+func firstMatch(rules []purgeRule, attrs *storage.ObjectAttrs, now time.Time) int {
+	for i, rule := range rules {
+		if rule.matches(attrs, now) {
+			return i
+		}
+	}
+	return -1
+}
+
+type purger struct {
+	bucket string
+	dryRun bool
+	e      *bucketEncrypter // re-encrypts with the bucket's mapped key
+	http   *http.Client     // of the batch requests
+}
+
+// reencrypt encrypts the generation of attrs with the bucket's mapped key, decrypting it first with
+// the key recorded on it
+func (p *purger) reencrypt(ctx context.Context, attrs *storage.ObjectAttrs) purgeResult {
+	var r encryptResult
+	switch encryptionOf(attrs) {
+	case "plaintext", "empty":
+		r = p.e.encrypt(ctx, attrs)
+	case "csek":
+		r = encryptResult{Object: attrs.Name, Generation: attrs.Generation, Status: encryptSkipped, Detail: "encrypted with a customer-supplied key"}
+	default:
+		r = p.rotate(ctx, attrs)
+	}
+	switch r.Status {
+	case encryptDone:
+		r.Status, r.Detail = purgeReencrypted, fmt.Sprintf("with %v", r.KeyVersion)
+	case encryptWould:
+		r.Status, r.Detail = purgeWouldCrypt, fmt.Sprintf("with %v", r.Key)
+	}
+	return purgeResult{Object: r.Object, Generation: r.Generation, Status: r.Status, Detail: r.Detail}
+}
+
+// rotate replaces the generation of an object the proxy encrypted with one encrypted with the
+// bucket's mapped key
+func (p *purger) rotate(ctx context.Context, attrs *storage.ObjectAttrs) encryptResult {
+	r := encryptResult{Object: attrs.Name, Generation: attrs.Generation, Size: attrs.Size}
+	key := util.Meta(attrs.Metadata, util.MetaEncryptionKey)
+	retained := retention(attrs, time.Now())
+	switch {
+	case ctx.Err() != nil:
+		r.Status, r.Detail = encryptFailed, "interrupted"
+		return r
+	case key == "":
+		r.Status, r.Detail = encryptSkipped, "written by another Tink client"
+		return r
+	case !slices.Contains(p.e.keyMap.CandidateKeys("", p.bucket), key):
+		r.Status, r.Detail = encryptSkipped, fmt.Sprintf("recorded key %v is neither the mapped nor a fallback key of the bucket", key)
+		return r
+	case retained != "":
+		r.Status, r.Detail = encryptRetained, retained+", GCS does not allow replacing it"
+		return r
+	case p.dryRun:
+		r.Status, r.Key = encryptWould, p.e.keyName
+		return r
+	}
+
+	err := func() error {
+		obj := util.Bucket(ctx, p.e.client, p.bucket).Object(attrs.Name)
+		reader, err := obj.Generation(attrs.Generation).ReadCompressed(true).NewReader(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read object: %w", err)
+		}
+		ciphertext, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read object: %w", err)
+		}
+		plaintext, err := crypto.DecryptBytes(crypto.WithPartManifest(ctx, util.PartManifest(attrs.Metadata)), key, ciphertext)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt with %v: %v", key, err)
+		}
+		return p.e.writeWithTink(ctx, attrs, plaintext, &r)
+	}()
+	var apiErr *googleapi.Error
+	switch {
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed:
+		r.Status, r.Detail = encryptChanged, "a newer generation was written"
+	case err != nil:
+		r.Status, r.Detail = encryptFailed, err.Error()
+	default:
+		r.Status, r.Key = encryptDone, p.e.keyName
+	}
+	return r
+}
+
+// deleteBatch deletes the generations of objects with one JSON API batch request, the deletes
+// fail when a newer generation was written since the listing
+func (p *purger) deleteBatch(ctx context.Context, objects []*storage.ObjectAttrs, rules []int) []purgeResult {
+	results := make([]purgeResult, len(objects))
+	var sent []int // the indexes of the objects the batch deletes
+	now := time.Now()
+	for i, attrs := range objects {
+		results[i] = purgeResult{Object: attrs.Name, Generation: attrs.Generation, Rule: rules[i]}
+		switch retained := retention(attrs, now); {
+		case retained != "":
+			results[i].Status, results[i].Detail = encryptRetained, retained+", GCS does not allow deleting it"
+		case p.dryRun:
+			results[i].Status = purgeWouldDelete
+		default:
+			sent = append(sent, i)
+		}
+	}
+	if len(sent) == 0 {
+		return results
+	}
+	fail := func(detail string) []purgeResult {
+		for _, i := range sent {
+			results[i].Status, results[i].Detail = encryptFailed, detail
+		}
+		return results
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, i := range sent {
+		query := url.Values{"ifGenerationMatch": {strconv.FormatInt(objects[i].Generation, 10)}}
+		if project := util.BilledProject(ctx); project != "" {
+			query.Set("userProject", project)
+		}
+		part, _ := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {fmt.Sprintf("<%d>", i)},
+		})
+		fmt.Fprintf(part, "DELETE /storage/v1/b/%v/o/%v?%v HTTP/1.1\r\n\r\n", url.PathEscape(p.bucket), url.PathEscape(objects[i].Name), query.Encode())
+	}
+	writer.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, gcsclient.URL(hdl.BatchPath), &body)
+	if err != nil {
+		return fail(err.Error())
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return fail(fmt.Sprintf("batch request failed: %v", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fail(fmt.Sprintf("batch request answered %v", resp.Status))
+	}
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return fail("batch response is not multipart")
+	}
+	answered := make(map[int]bool)
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(fmt.Sprintf("error reading batch response: %v", err))
+		}
+		// answered as <response-N> to the request <N>
+		id := strings.TrimSuffix(strings.TrimPrefix(part.Header.Get("Content-Id"), "<response-"), ">")
+		i, err := strconv.Atoi(id)
+		if err != nil || i < 0 || i >= len(objects) {
+			continue
+		}
+		deleted, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			continue
+		}
+		deleted.Body.Close()
+		answered[i] = true
+		switch deleted.StatusCode {
+		case http.StatusOK, http.StatusNoContent:
+			results[i].Status = purgeDeleted
+		case http.StatusNotFound:
+			results[i].Status, results[i].Detail = purgeDeleted, "already deleted"
+		case http.StatusPreconditionFailed:
+			results[i].Status, results[i].Detail = encryptChanged, "a newer generation was written"
+		default:
+			results[i].Status, results[i].Detail = encryptFailed, "delete answered "+deleted.Status
+		}
+	}
+	for _, i := range sent {
+		if !answered[i] {
+			results[i].Status, results[i].Detail = encryptFailed, "no answer in the batch response"
+		}
+	}
+	return results
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+)
+
+// recoverObject downloads the ciphertext of gs://bucket/object straight from GCS and decrypts it
+// with the escrow key, for when the key in the bucket mapping is lost or disabled. The escrow key
+// is -kms_escrow_key or else the gcsproxy-escrow-key recorded on the object.
+func recoverObject(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy recover [-kms_escrow_key=KEY] gs://bucket/object [file]")
+		return 2
+	}
+	bucketName, objectName, err := util.ParseGcsUrl(args[0])
+	if err != nil || objectName == "" {
+		fmt.Fprintf(os.Stderr, "expected gs://bucket/object, got %q\n", args[0])
+		return 2
+	}
+
+	ctx := context.Background()
+	client, err := gcsclient.Storage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	obj := util.Bucket(ctx, client, bucketName).Object(objectName)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get object attributes: %v\n", err)
+		return 1
+	}
+	escrowKey := cfg.Current().KmsEscrowKey
+	if escrowKey == "" {
+		escrowKey = util.Meta(attrs.Metadata, util.MetaEscrowKey)
+	}
+	if escrowKey == "" {
+		fmt.Fprintf(os.Stderr, "gs://%v/%v records no escrow key, pass -kms_escrow_key\n", bucketName, objectName)
+		return 1
+	}
+
+	// pin the generation we looked at, the ciphertext must match its metadata
+	reader, err := obj.Generation(attrs.Generation).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read object: %v\n", err)
+		return 1
+	}
+	ciphertext, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read object: %v\n", err)
+		return 1
+	}
+
+	plaintext, err := crypto.RecoverBytes(crypto.WithPartManifest(ctx, util.PartManifest(attrs.Metadata)), escrowKey, ciphertext)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to recover gs://%v/%v#%v: %v\n", bucketName, objectName, attrs.Generation, err)
+		return 1
+	}
+
+	out := os.Stdout
+	if len(args) == 2 && args[1] != "-" {
+		out, err = os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		defer out.Close()
+	}
+	if _, err := out.Write(plaintext); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "recovered gs://%v/%v#%v (%v bytes) with %v\n", bucketName, objectName, attrs.Generation, len(plaintext), escrowKey)
+	return 0
+}
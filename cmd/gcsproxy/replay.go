@@ -0,0 +1,46 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	gcsproxy "github.com/byronwhitlock-google/go-gcsproxy/proxy"
+)
+
+// replayDump re-runs the flows of a -dump file through the interceptor against a fake GCS, with
+// the bucket key mapping the dump was taken with, e.g.
+// go-gcsproxy replay -kms_bucket_key_mappings=bucket:projects/.../cryptoKeys/key flows.dump
+func replayDump(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy replay [-replay_local_kms=false] -kms_bucket_key_mappings=... dumpfile")
+		return 2
+	}
+	config := cfg.Current()
+	if config.ReplayLocalKms {
+		// the dumped objects were encrypted with the customer's keys, the fake GCS re-encrypts them
+		crypto.UseLocalKms()
+	}
+	if err := interceptor.CheckKeyMapping(context.Background()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	failures, err := gcsproxy.Replay(config, args[0], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if failures > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/policy"
+)
+
+// signPolicy signs a policy document with -policy_signing_key. It prints the signature, or
+// uploads the document with its signature when a gs:// location is given, e.g.
+// go-gcsproxy sign-policy -policy_signing_key=projects/.../cryptoKeyVersions/1 policy.json gs://bucket/policy.json
+func signPolicy(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy sign-policy -policy_signing_key=KEY_VERSION policy.json [gs://bucket/object]")
+		return 2
+	}
+	keyVersion := cfg.Current().PolicySigningKey
+	if keyVersion == "" {
+		fmt.Fprintln(os.Stderr, "missing -policy_signing_key")
+		return 2
+	}
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ctx := context.Background()
+	signature, err := policy.Sign(ctx, keyVersion, data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(args) == 1 {
+		fmt.Println(signature)
+		return 0
+	}
+	if err := policy.Publish(ctx, args[1], data, signature); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "published signed policy to %v\n", args[1])
+	return 0
+}
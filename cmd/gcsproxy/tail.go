@@ -0,0 +1,111 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/adminclient"
+)
+
+// how long tail waits before it reconnects to a proxy that went away
+const tailReconnectDelay = 2 * time.Second
+
+// tail prints the flows of a running proxy as they finish, from its admin API, e.g.
+// GCS_PROXY_ADMIN_TOKEN=... go-gcsproxy tail -admin_port=127.0.0.1:9082 gs://bucket
+func tail(args []string) int {
+	config := cfg.Current()
+	if config.AdminAddr == "" || config.AdminToken == "" {
+		fmt.Fprintln(os.Stderr, "usage: GCS_PROXY_ADMIN_TOKEN=... go-gcsproxy tail -admin_port=host:port [bucket ...]")
+		return 2
+	}
+	var buckets []string
+	for _, bucket := range args {
+		buckets = append(buckets, strings.TrimSuffix(strings.TrimPrefix(bucket, "gs://"), "/"))
+	}
+	host, port, err := net.SplitHostPort(config.AdminAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -admin_port %q: %v\n", config.AdminAddr, err)
+		return 2
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	client := adminclient.New("http://"+net.JoinHostPort(host, port), config.AdminToken, nil)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for {
+		err := client.StreamFlows(ctx, buckets, func(event adminclient.FlowEvent) error {
+			fmt.Println(formatFlow(event))
+			return nil
+		})
+		if ctx.Err() != nil {
+			return 0
+		}
+		// an answer that reconnecting won't change, e.g. a wrong token
+		var apiErr *adminclient.APIError
+		if errors.As(err, &apiErr) {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "%v, reconnecting\n", err)
+		select {
+		case <-time.After(tailReconnectDelay):
+		case <-ctx.Done():
+			return 0
+		}
+	}
+}
+
+// formatFlow returns one line per flow:
+//
+//	12:04:05.120 GET    decrypt     200  1.5MiB    48ms gs://bucket/object
+func formatFlow(event adminclient.FlowEvent) string {
+	action, target, size, result := "-", event.Url, 0, ""
+	if d := event.Decision; d != nil {
+		action = d.Action
+		if d.Bucket != "" {
+			target = "gs://" + d.Bucket + "/" + d.Object
+		}
+		size = max(d.PlaintextSize, d.CiphertextSize)
+		if d.Tenant != "" {
+			target = d.Tenant + " " + target
+		}
+		if d.Error != "" {
+			result = " error: " + d.Error
+		}
+	}
+	status := "---"
+	if event.Status != 0 {
+		status = fmt.Sprint(event.Status)
+	}
+	return fmt.Sprintf("%v %-6v %-11v %v %8v %7.0fms %v%v", event.Time.Local().Format("15:04:05.000"),
+		event.Method, action, status, formatSize(size), event.LatencyMs, target, result)
+}
+
+func formatSize(n int) string {
+	switch {
+	case n == 0:
+		return "-"
+	case n < 1024:
+		return fmt.Sprintf("%vB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.1fKiB", float64(n)/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.1fMiB", float64(n)/(1024*1024))
+	}
+	return fmt.Sprintf("%.1fGiB", float64(n)/(1024*1024*1024))
+}
@@ -0,0 +1,31 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+
+	gcsproxy "github.com/byronwhitlock-google/go-gcsproxy/proxy"
+)
+
+// unixShim serves a loopback TCP port for clients of a proxy that listens on a unix socket, e.g.
+// go-gcsproxy unix-shim unix:///run/gcsproxy/proxy.sock 127.0.0.1:9080
+func unixShim(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy unix-shim unix:///path/to/proxy.sock [listen-addr]")
+		return 2
+	}
+	listenAddr := "127.0.0.1:9080"
+	if len(args) == 2 {
+		listenAddr = args[1]
+	}
+	if err := gcsproxy.ServeUnixShim(listenAddr, args[0]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
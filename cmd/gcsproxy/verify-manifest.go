@@ -0,0 +1,130 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"cloud.google.com/go/storage"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/manifest"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+)
+
+// manifest verification outcome of one listed object
+const (
+	manifestOk         = "OK"
+	manifestMissing    = "MISSING"    // the listed generation no longer exists
+	manifestMismatch   = "MISMATCH"   // it decrypts to other plaintext than was uploaded
+	manifestUnreadable = "UNREADABLE" // it could not be read or decrypted
+)
+
+// verifyManifest checks the signature of an integrity manifest by -manifest_signing_key, that the
+// previous manifest it names is unchanged, and that every object it lists still decrypts to the
+// plaintext that was uploaded, e.g.
+// go-gcsproxy verify-manifest -manifest_signing_key=projects/.../cryptoKeyVersions/1 gs://bucket/logs/.gcsproxy-manifest/20250101T120000Z-3f2a9c1e.json
+func verifyManifest(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy verify-manifest -manifest_signing_key=KEY_VERSION gs://bucket/manifest")
+		return 2
+	}
+	signingKey := cfg.Current().ManifestSigningKey
+	if signingKey == "" {
+		fmt.Fprintln(os.Stderr, "missing -manifest_signing_key")
+		return 2
+	}
+	bucketName, name, err := util.ParseGcsUrl(args[0])
+	if err != nil || name == "" {
+		fmt.Fprintf(os.Stderr, "expected gs://bucket/manifest, got %q\n", args[0])
+		return 2
+	}
+
+	ctx := context.Background()
+	client, err := gcsclient.Storage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	m, _, err := manifest.Read(ctx, client, bucketName, name, signingKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "manifest gs://%v/%v is not valid: %v\n", bucketName, name, err)
+		return 1
+	}
+	fmt.Printf("manifest of gs://%v/%v created %v, signed by %v\n", m.Bucket, m.Prefix, m.Created.Format("2006-01-02T15:04:05Z07:00"), signingKey)
+	failed := false
+	if m.Previous != nil {
+		if _, data, err := manifest.Read(ctx, client, bucketName, m.Previous.Name, signingKey); err != nil {
+			fmt.Printf("previous manifest gs://%v/%v is not valid: %v\n", bucketName, m.Previous.Name, err)
+			failed = true
+		} else if digest := sha256.Sum256(data); hex.EncodeToString(digest[:]) != m.Previous.Sha256 {
+			fmt.Printf("previous manifest gs://%v/%v was replaced\n", bucketName, m.Previous.Name)
+			failed = true
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, entry := range m.Objects {
+		status, detail := checkManifestEntry(ctx, client, bucketName, entry)
+		counts[status]++
+		fmt.Printf("%-10v gs://%v/%v#%v %v\n", status, bucketName, entry.Name, entry.Generation, detail)
+	}
+	fmt.Printf("\n%v ok, %v missing, %v mismatch, %v unreadable\n",
+		counts[manifestOk], counts[manifestMissing], counts[manifestMismatch], counts[manifestUnreadable])
+	if failed || counts[manifestOk] != len(m.Objects) {
+		return 1
+	}
+	return 0
+}
+
+func checkManifestEntry(ctx context.Context, client *storage.Client, bucketName string, entry manifest.Entry) (string, string) {
+	obj := util.Bucket(ctx, client, bucketName).Object(entry.Name)
+	if entry.Generation != 0 {
+		obj = obj.Generation(entry.Generation)
+	}
+	reader, err := obj.NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return manifestMissing, "deleted or overwritten"
+	}
+	if err != nil {
+		return manifestUnreadable, err.Error()
+	}
+	ciphertext, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return manifestUnreadable, err.Error()
+	}
+	if h, err := envelope.ParseHeader(ciphertext); err == nil && h.Flags&envelope.FlagPart != 0 {
+		// an XML multipart upload, its parts decrypt with the manifest of its metadata
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			return manifestUnreadable, err.Error()
+		}
+		ctx = crypto.WithPartManifest(ctx, util.PartManifest(attrs.Metadata))
+	}
+	plaintext, err := crypto.DecryptBytes(ctx, entry.Key, ciphertext)
+	if err != nil {
+		return manifestUnreadable, err.Error()
+	}
+	switch {
+	case int64(len(plaintext)) != entry.Size:
+		return manifestMismatch, fmt.Sprintf("size %v != %v", len(plaintext), entry.Size)
+	case crypto.Base64MD5Hash(plaintext) != entry.Md5Hash:
+		return manifestMismatch, fmt.Sprintf("md5 %v != %v", crypto.Base64MD5Hash(plaintext), entry.Md5Hash)
+	case crypto.Base64Crc32cHash(plaintext) != entry.Crc32c:
+		return manifestMismatch, fmt.Sprintf("crc32c %v != %v", crypto.Base64Crc32cHash(plaintext), entry.Crc32c)
+	}
+	return manifestOk, "md5 " + entry.Md5Hash
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/storage"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/inventory"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"google.golang.org/api/iterator"
+)
+
+// restore verification outcome of one soft-deleted generation
+const (
+	restoreOk         = "OK"           // the recorded key version is enabled
+	restoreUnverified = "UNVERIFIED"   // no key recorded, a candidate key is enabled but may not be the right one
+	restoreKeyMissing = "KEY_UNUSABLE" // no enabled key can decrypt the generation
+	restorePlaintext  = "PLAINTEXT"    // written before the bucket was onboarded, reads through the proxy will fail
+	restoreEmpty      = "EMPTY"        // nothing to decrypt, reads through the proxy serve it as it is
+)
+
+// verifyRestore lists the soft-deleted generations under gs://bucket[/prefix] and reports
+// whether each one can still be decrypted through the proxy once restored.
+func verifyRestore(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy verify-restore [flags] gs://bucket[/prefix]")
+		return 2
+	}
+	bucketName, prefix, err := util.ParseGcsPrefix(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx := context.Background()
+	client, err := gcsclient.Storage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var table *inventory.BigQueryWriter
+	if bigQueryTable := cfg.Current().BigQueryTable; bigQueryTable != "" {
+		if table, err = inventory.NewBigQueryWriter(ctx, bigQueryTable); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	counts := make(map[string]int)
+	it := util.Bucket(ctx, client, bucketName).Objects(ctx, &storage.Query{Prefix: prefix, SoftDeleted: true})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to list soft-deleted objects: %v\n", err)
+			return 1
+		}
+
+		status, detail := checkRestorable(ctx, bucketName, attrs)
+		counts[status]++
+		fmt.Printf("%-12v gs://%v/%v#%v hard-delete=%v %v\n", status, bucketName, attrs.Name, attrs.Generation,
+			attrs.HardDeleteTime.Format("2006-01-02T15:04:05Z07:00"), detail)
+		if table != nil {
+			provenance := util.ProvenanceOf(attrs.Metadata)
+			row := inventory.Row{
+				Tool:       "verify-restore",
+				Bucket:     bucketName,
+				Object:     attrs.Name,
+				Generation: attrs.Generation,
+				Encrypted:  status != restorePlaintext && status != restoreEmpty,
+				Status:     status,
+				Key:        provenance.Key,
+				KeyVersion: provenance.KeyVersion,
+				Size:       attrs.Size,
+				Detail:     detail,
+
+				ProxyVersion:    provenance.ProxyVersion,
+				EnvelopeVersion: provenance.EnvelopeVersion,
+				EncryptedAt:     provenance.EncryptedAt,
+				Policy:          provenance.Policy,
+			}
+			if err := table.Write(ctx, row); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+	}
+	if table != nil {
+		if err := table.Flush(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	fmt.Printf("\n%v ok, %v unverified, %v key unusable, %v plaintext, %v empty\n",
+		counts[restoreOk], counts[restoreUnverified], counts[restoreKeyMissing], counts[restorePlaintext], counts[restoreEmpty])
+	if counts[restoreKeyMissing] > 0 || counts[restorePlaintext] > 0 {
+		return 1
+	}
+	return 0
+}
+
+func checkRestorable(ctx context.Context, bucketName string, attrs *storage.ObjectAttrs) (string, string) {
+	recordedKey := util.Meta(attrs.Metadata, util.MetaEncryptionKey)
+	if recordedKey != "" {
+		keyVersion := util.Meta(attrs.Metadata, util.MetaEncryptionKeyVersion)
+		if err := crypto.CheckKeyUsable(ctx, recordedKey, keyVersion); err != nil {
+			return restoreKeyMissing, err.Error()
+		}
+		if keyVersion == "" {
+			return restoreOk, recordedKey
+		}
+		return restoreOk, keyVersion
+	}
+
+	if attrs.Size == 0 && attrs.CustomerKeySHA256 == "" {
+		return restoreEmpty, "empty object"
+	}
+	if util.Meta(attrs.Metadata, util.MetaProxyVersion) == "" {
+		return restorePlaintext, "no proxy metadata"
+	}
+
+	// written by a proxy that did not record keys. any enabled candidate might be the one
+	var errs []string
+	for _, key := range util.GetDecryptionCandidateKeys("", bucketName) {
+		err := crypto.CheckKeyUsable(ctx, key, "")
+		if err == nil {
+			return restoreUnverified, "candidate " + key
+		}
+		errs = append(errs, err.Error())
+	}
+	return restoreKeyMissing, fmt.Sprintf("no enabled candidate key %v", errs)
+}
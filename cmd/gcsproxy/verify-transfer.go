@@ -0,0 +1,208 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"google.golang.org/api/iterator"
+)
+
+// transfer verification outcome of one object of the source
+const (
+	transferMatch        = "MATCH"        // the plaintext checksums agree
+	transferMismatch     = "MISMATCH"     // the destination holds different data
+	transferMissing      = "MISSING"      // not in the destination
+	transferUnverifiable = "UNVERIFIABLE" // the two sides have no checksum in common
+)
+
+// plaintextChecksums describes the plaintext of an object or local file, base64 like GCS
+type plaintextChecksums struct {
+	md5    string
+	crc32c string
+	size   int64 // -1 when unknown
+}
+
+// verifyTransfer compares the objects under a source with a destination, each a gs:// prefix or
+// a local directory, by the checksums of their plaintext. Transfer tools compare the hashes GCS
+// computed, which are those of the ciphertext for the objects the proxy encrypted.
+func verifyTransfer(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: go-gcsproxy verify-transfer [flags] SOURCE DESTINATION, each gs://bucket[/prefix] or a local directory")
+		return 2
+	}
+
+	ctx := context.Background()
+	var client *storage.Client
+	sides := make([]map[string]plaintextChecksums, 2)
+	for i, location := range args {
+		var err error
+		if strings.HasPrefix(location, "gs://") {
+			if client == nil {
+				if client, err = gcsclient.Storage(); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return 1
+				}
+			}
+			sides[i], err = gcsChecksums(ctx, client, location)
+		} else {
+			sides[i], err = localChecksums(location)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	source, destination := sides[0], sides[1]
+
+	names := make([]string, 0, len(source))
+	for name := range source {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	counts := make(map[string]int)
+	for _, name := range names {
+		status, detail := transferMissing, ""
+		if transferred, ok := destination[name]; ok {
+			status, detail = compareChecksums(source[name], transferred)
+		}
+		counts[status]++
+		fmt.Printf("%-12v %v %v\n", status, name, detail)
+	}
+	extra := 0
+	for name := range destination {
+		if _, ok := source[name]; !ok {
+			extra++
+		}
+	}
+
+	fmt.Printf("\n%v match, %v mismatch, %v missing, %v unverifiable, %v only in the destination\n",
+		counts[transferMatch], counts[transferMismatch], counts[transferMissing], counts[transferUnverifiable], extra)
+	if counts[transferMismatch] > 0 || counts[transferMissing] > 0 {
+		return 1
+	}
+	return 0
+}
+
+func compareChecksums(source plaintextChecksums, destination plaintextChecksums) (string, string) {
+	if source.size >= 0 && destination.size >= 0 && source.size != destination.size {
+		return transferMismatch, fmt.Sprintf("size %v != %v", source.size, destination.size)
+	}
+	if source.md5 != "" && destination.md5 != "" {
+		if source.md5 != destination.md5 {
+			return transferMismatch, fmt.Sprintf("md5 %v != %v", source.md5, destination.md5)
+		}
+		return transferMatch, "md5 " + source.md5
+	}
+	if source.crc32c != "" && destination.crc32c != "" {
+		if source.crc32c != destination.crc32c {
+			return transferMismatch, fmt.Sprintf("crc32c %v != %v", source.crc32c, destination.crc32c)
+		}
+		return transferMatch, "crc32c " + source.crc32c
+	}
+	return transferUnverifiable, "no plaintext checksum on both sides"
+}
+
+// gcsChecksums lists the objects under gs://bucket[/prefix] by their name relative to the prefix.
+// the objects the proxy encrypted are described by the plaintext checksums recorded in their
+// metadata, the others by the checksums GCS computed.
+func gcsChecksums(ctx context.Context, client *storage.Client, location string) (map[string]plaintextChecksums, error) {
+	bucketName, prefix, err := util.ParseGcsPrefix(location)
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[string]plaintextChecksums)
+	it := util.Bucket(ctx, client, bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %v: %v", location, err)
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(attrs.Name, prefix), "/")
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue // folder placeholders
+		}
+
+		if util.Meta(attrs.Metadata, util.MetaProxyVersion) != "" || util.Meta(attrs.Metadata, util.MetaEncryptionKey) != "" {
+			size := int64(-1)
+			if length, err := strconv.ParseInt(util.Meta(attrs.Metadata, util.MetaUnencryptedLength), 10, 64); err == nil {
+				size = length
+			}
+			checksums[name] = plaintextChecksums{md5: util.Meta(attrs.Metadata, util.MetaMd5Hash), crc32c: util.Meta(attrs.Metadata, util.MetaCrc32c), size: size}
+			continue
+		}
+		c := plaintextChecksums{size: attrs.Size}
+		if len(attrs.MD5) > 0 {
+			c.md5 = base64.StdEncoding.EncodeToString(attrs.MD5)
+		}
+		// objects encrypted with a customer-supplied key are listed without their checksums
+		if attrs.CustomerKeySHA256 == "" {
+			c.crc32c = base64Crc32c(attrs.CRC32C)
+		} else {
+			c.size = -1
+		}
+		checksums[name] = c
+	}
+	return checksums, nil
+}
+
+// localChecksums hashes the files under dir by their slash separated path relative to dir
+func localChecksums(dir string) (map[string]plaintextChecksums, error) {
+	checksums := make(map[string]plaintextChecksums)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		md5Hash, crc32cHash := md5.New(), crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		size, err := io.Copy(io.MultiWriter(md5Hash, crc32cHash), file)
+		if err != nil {
+			return fmt.Errorf("failed to read %v: %v", path, err)
+		}
+		checksums[filepath.ToSlash(name)] = plaintextChecksums{
+			md5:    base64.StdEncoding.EncodeToString(md5Hash.Sum(nil)),
+			crc32c: base64Crc32c(crc32cHash.Sum32()),
+			size:   size,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %v", dir, err)
+	}
+	return checksums, nil
+}
+
+func base64Crc32c(checksum uint32) string {
+	encoded := make([]byte, 4)
+	binary.BigEndian.PutUint32(encoded, checksum)
+	return base64.StdEncoding.EncodeToString(encoded)
+}
@@ -7,9 +7,11 @@ package cfg
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -17,9 +19,16 @@ import (
 type Config struct {
 	Version bool // show version
 
-	Addr        string // proxy listen addr
-	WebAddr     string // web interface listen addr
-	SslInsecure bool   // not verify upstream server SSL/TLS certificates.
+	ConfigFile string // JSON file of flag values by profile, see applyConfigFile
+	Profile    string // profile of ConfigFile applied, e.g. dev, staging or prod
+
+	Addr           string   // proxy listen addrs, comma separated
+	ListenAddrs    []string // Addr split, host:port, tcp4://, tcp6:// or unix:// addresses
+	UnixSocketMode string   // octal mode of the unix sockets
+	ListenTlsCert  string   // PEM certificate the proxy serves on its TCP listeners, plain HTTP when empty
+	ListenTlsKey   string   // PEM private key of ListenTlsCert
+	WebAddr        string   // web interface listen addr
+	SslInsecure    bool     // not verify upstream server SSL/TLS certificates.
 
 	CertPath string // path of generate cert files
 	Debug    int    // debug mode: 1 - print debug log, 2 - show debug from
@@ -27,29 +36,339 @@ type Config struct {
 	Dump      string // dump filename
 	DumpLevel int    // dump level: 0 - header, 1 - header + body
 
+	HarFile         string // HAR export filename
+	HarRedactBodies bool   // leave request and response bodies out of the HAR file
+
+	UnsafeDisableRedaction bool // log and dump credentials, signed URL signatures and keys as they are
+
+	AuditLog string // JSON lines file the IAM and ACL changes sent through the proxy are appended to
+
+	// log sampling by category, the level or the category field of the entry, see pkg/logsample
+	logSampleRatesString string
+	LogSampleRates       map[string]float64 // share of the entries kept
+	logRateLimitsString  string
+	LogRateLimits        map[string]float64 // entries logged per second at most
+
+	SlowRequestThreshold time.Duration // flows taking longer are logged with where their time went, 0 logs none
+	SlowRequestHeader    bool          // answer the slow flows with a Server-Timing header of their breakdown
+
 	// kms options
 	kmsBucketKeyMappingString string
 	KmsBucketKeyMapping       map[string]string
+	KmsMappingDir             string        // directory of one file per bucket mapping, see ReadMappingDir
+	KmsMappingDirInterval     time.Duration // how often the directory is read again for the changes not watched
+	kmsFallbackKeysString     string
+	KmsFallbackKeys           map[string][]string // extra keys tried when an object does not decrypt with its recorded or mapped key
+	KmsEscrowKey              string              // every DEK is also wrapped with this key for break-glass recovery
+	KekTTL                    time.Duration       // lifetime of the cached per bucket KEKs wrapping the DEKs, 0 has KMS wrap every DEK
+	AeadWorkers               int                 // AEAD operations run at once, GOMAXPROCS when 0
+	dedupBucketsString        string
+	DedupBuckets              []string      // buckets whose identical uploads get the ciphertext of the first one, see crypto.DedupBuckets
+	DedupTTL                  time.Duration // how long a ciphertext is reused
+	DedupCacheMB              int           // memory of the reused ciphertexts
+	RetryReuseTTL             time.Duration // how long the ciphertext of an upload is reused for its retries, see crypto.RetryTTL
+	KmsQps                    float64       // KMS requests per second of the proxy, of the whole cluster with KmsQuotaServer, 0 is unlimited
+	KmsQuotaServer            string        // URL of the kms-quota-server the replicas lease their KMS requests from
+	KmsQuotaToken             string        `json:"-"` // bearer token of the kms-quota-server
+	KmsQuotaReplicas          int           // replicas sharing KmsQps, each keeps to its share while the server is unreachable
+	kmsProjectQpsString       string
+	KmsProjectQps             map[string]float64 // project to the KMS requests per second to its keys, on top of KmsQps
+	hybridKeysetsString       string
+	HybridKeysets             map[string]string // hybrid key name to its Tink keyset file, public on producers and private on readers
+	HybridKeysetKmsKey        string            // KMS key the private hybrid keysets are encrypted with
+	envelopeFormatsString     string
+	EnvelopeFormats           map[string]string // bucket to envelope format, tink (default) or csek
+
+	// content type and size rules of the uploads, see keymap.KeyMap
+	encryptContentTypesString string
+	EncryptContentTypes       map[string][]string // bucket to the only content types encrypted
+	skipContentTypesString    string
+	SkipContentTypes          map[string][]string // bucket to the content types never encrypted
+	encryptMinSizesString     string
+	EncryptMinSizes           map[string]int64 // bucket to the smallest upload encrypted, in bytes
+	encryptMaxSizesString     string
+	EncryptMaxSizes           map[string]int64 // bucket to the largest upload encrypted, in bytes
+	chunkSizesString          string
+	ChunkSizes                map[string]int64 // bucket to the plaintext size of the chunks its objects are encrypted in, in bytes
+	maxObjectSizesString      string
+	MaxObjectSizes            map[string]int64 // bucket to the largest upload the proxy accepts, in bytes
+	decryptClientsString      string
+	DecryptClients            map[string][]string // bucket or bucket/prefix to the only clients that may download decrypted objects
+	overrideClientsString     string
+	OverrideClients           map[string][]string // bucket to the only clients that may override the encryption of their requests with headers
+	responseHeadersString     string
+	ResponseHeaders           map[string][]string // bucket to the headers set on or stripped from its decrypted downloads
+	mirrorBucketsString       string
+	MirrorBuckets             map[string]string // bucket to the bucket its encrypted uploads are copied to
+	MirrorWorkers             int               // mirror copies written at once
+	MirrorQueueMB             int               // plaintext MiB waiting to be mirrored, further uploads are not mirrored
+	UserProject               string            // billed for the proxy's own requests to Requester Pays buckets when the client names no project
+	GcsEndpoint               string            // endpoint of the proxy's own GCS calls, e.g. Private Service Connect
+	ImpersonateServiceAccount string            // the proxy's own GCS calls are made as this service account
+	GcsMaxAttempts            int               // attempts of each idempotent GCS call the proxy makes itself
+	SpoolDir                  string            // encrypted uploads are stored there and forwarded to GCS in the background
+	SpoolMaxMB                int               // size of the spool, further uploads go to GCS directly
+	SpoolRetryInterval        time.Duration     // time between two tries to forward the spooled uploads
+	HmacPolicy                string            // resign, reject or bypass the HMAC signed requests the proxy has to change
+	HmacKeysFile              string            // JSON file of the HMAC access ids and secrets requests are re-signed with
+	backendsString            string
+	Backends                  []string // the object stores besides GCS whose mapped buckets are encrypted: s3, azure
+	ClientShims               bool     // work around the quirks of gsutil, gcloud and the Java SDK
 
 	Upstream        string // upstream proxy
 	UpstreamCert    bool   // Connect to upstream server to look up certificate details. Default: True
 	EncryptDisabled bool
 	GCSProxyVersion string
-}
 
-var GlobalConfig *Config // Global variable
+	RunAsUser string // user to switch to once the listening sockets are bound
+
+	UpgradeSocket       string        // unix socket the running proxy hands its listening sockets over on
+	Upgrade             bool          // take over the listening sockets of the proxy serving UpgradeSocket
+	UpgradeDrainTimeout time.Duration // how long a proxy that handed its sockets over serves its open connections
+
+	MtlsPassthrough bool // tunnel mTLS GCS endpoints instead of intercepting them
+
+	SlicedDownloadCacheMB  int           // memory for decrypted objects shared by ranged reads of one generation, 0 disables
+	SlicedDownloadCacheTTL time.Duration // how long a decrypted object stays in that cache
+	ListPrefetchMaxKB      int           // objects listed up to this plaintext size are decrypted into that cache, 0 disables
+	ListPrefetchMaxObjects int           // objects prefetched per listing at most
+
+	NotificationsSubscription string // Pub/Sub subscription to the notifications of the mapped buckets and the policy updates, keeps the caches and the policy of replicas current
+
+	AdminAddr         string        // admin API listen addr, empty disables the API
+	AdminToken        string        `json:"-"` // bearer token admin API callers must present
+	AdminMappingsFile string        // buckets onboarded through the admin API are saved here and loaded at startup
+	BypassMaxDuration time.Duration // longest emergency bypass of a bucket the admin API starts
+	AdminFetch        bool          // the admin API serves decrypted objects, for break-glass inspection
+
+	FlowHistory           string        // JSON lines file of the finished flows the admin API searches, empty disables
+	FlowHistoryMaxAge     time.Duration // flows older than this are dropped from the history
+	FlowHistoryMaxEntries int           // flows kept in the history at most
+
+	PolicySource        string        // gs:// or firestore:// location of the central bucket key mapping
+	PolicyPollInterval  time.Duration // how often the policy is fetched
+	PolicyVersion       int64         // only apply this policy version, 0 applies the latest
+	PolicySigningKey    string        // KMS asymmetric key version the policy must be signed with
+	PolicyAllowUnsigned bool          // apply policies without a signature
+
+	ReplayLocalKms bool // replay dumps with in-memory keys instead of Cloud KMS
+
+	DoubleEncryption string // skip, error or encrypt uploads that already are a proxy envelope
+	MetadataPrefix   string // prefix of the custom metadata keys the proxy writes
+
+	// objects written by other Tink clients, see util.ForeignEncryptionKey
+	cseKeyMetadataString string
+	CseKeyMetadata       []string // custom metadata keys those clients record the KMS key URI in
+	CseAssociatedData    string   // associated data they encrypt with, {bucket} and {object} are replaced
+
+	VerifyUploads bool // read back uploaded generations and fail uploads GCS did not store as sent
+
+	WriteOnly bool // encrypt uploads but refuse every download the proxy would decrypt
+
+	PlaintextConfirmed bool // the operator confirmed that GCS_PROXY_DISABLE_ENCRYPTION is meant
+
+	KeyCheckInterval time.Duration // how often every mapped key is checked in the background, 0 disables
+	KeyFailurePolicy string        // serve, reject-uploads or reject the requests of buckets whose key failed its check
+	HealthAddr       string        // /healthz and /readyz listen addr, empty disables them
+
+	MetadataShimAddr          string // listen addr of the metadata server shim, empty disables it
+	metadataShimScopesString  string
+	MetadataShimScopes        []string // OAuth scopes the shim grants tokens for
+	metadataShimClientsString string
+	MetadataShimClients       []string // the only clients the shim answers, any client of a loopback or unix socket address when empty
+
+	CanaryInterval time.Duration // how often the canary object of every mapped bucket is written and read back, 0 disables
+	CanaryObject   string        // name of the canary object
+
+	ManifestSigningKey string        // KMS asymmetric key version the integrity manifests are signed with, empty disables them
+	ManifestInterval   time.Duration // how often the collected uploads are written to manifests
+	ManifestMaxObjects int           // objects per manifest that write it before the interval ends
+
+	// fault injection for resilience testing, rates are between 0 and 1
+	ChaosKmsLatency        time.Duration // added to a share of the KMS calls
+	ChaosKmsLatencyRate    float64       // share of the KMS calls that get ChaosKmsLatency
+	ChaosKmsErrorRate      float64       // share of the KMS calls that fail
+	ChaosUpstreamErrorRate float64       // share of the requests answered with 503 instead of going to GCS
+	ChaosTruncateRate      float64       // share of the response bodies cut short
+
+	TenantsFile string // JSON file of the tenants sharing the proxy, see pkg/tenant
+
+	// encrypt-existing options
+	EncryptExistingParallelism int     // objects encrypted at once
+	EncryptExistingMBPerSecond float64 // download plus upload MiB per second, 0 is unlimited
+	EncryptExistingCheckpoint  string  // file recording progress, a run resumes where the last one stopped
+	EncryptExistingReport      string  // JSON lines file the per object results are appended to
+	EncryptExistingDryRun      bool    // report what would be encrypted without writing
+
+	// purge options
+	PurgeRules       string // JSON file of the lifecycle rules purge applies, see cmd/gcsproxy/purge.go
+	PurgeParallelism int    // objects re-encrypted, and batches of deletes sent, at once
+	PurgeDryRun      bool   // report what the rules would do without changing anything
+
+	BigQueryTable string // project.dataset.table the verify-restore and encrypt-existing results are streamed to
+
+	CostReportPricePerGiBMonth float64 // cost-report: storage price of the buckets' class, in currency per GiB and month
+
+	// init options, the wizard asks for what they leave out
+	InitProject       string // project the buckets are discovered in, the one of the credentials when empty
+	initBucketsString string
+	InitBuckets       []string // buckets to encrypt instead of the discovered ones
+	InitKey           string   // KMS key of every bucket instead of the first suggested one
+	InitOutput        string   // config file written
+	InitYes           bool     // accept the defaults and suggestions without asking
+
+	// Cloud Monitoring export of the proxy metrics, off when the project is empty
+	CloudMonitoringProject      string
+	cloudMonitoringLabelsString string
+	CloudMonitoringLabels       map[string]string // resource labels added to every time series
+	CloudMonitoringInterval     time.Duration     // how often the metrics are pushed
+
+	// throttles applied to every client address and every bucket, 0 is unlimited
+	ClientRequestsPerSecond float64
+	ClientMBPerSecond       float64
+	BucketRequestsPerSecond float64
+	BucketMBPerSecond       float64
+}
 
 func LoadConfig() *Config {
 	config := new(Config)
 	config.EncryptDisabled = isEncryptDisabled()
 
+	defaultConfigFile := envConfigStringWithDefault("GCS_PROXY_CONFIG_FILE", "")
+	defaultProfile := envConfigStringWithDefault("GCS_PROXY_PROFILE", "")
 	defaultSslInsecure := envConfigBoolWithDefault("SSL_INSECURE", true)
 	defaultCertPath := envConfigStringWithDefault("PROXY_CERT_PATH", "/proxy/certs")
 	defaultDebug := envConfigIntWithDefault("DEBUG_LEVEL", 0)
 	defaultKmsBucketKeyMappingString := envConfigStringWithDefault("GCP_KMS_BUCKET_KEY_MAPPING", "")
+	defaultKmsMappingDir := envConfigStringWithDefault("GCS_PROXY_KMS_MAPPING_DIR", "")
+	defaultKmsMappingDirInterval := envConfigDurationWithDefault("GCS_PROXY_KMS_MAPPING_DIR_INTERVAL", time.Minute)
+	defaultKmsFallbackKeysString := envConfigStringWithDefault("GCP_KMS_FALLBACK_KEYS", "")
+	defaultKmsEscrowKey := envConfigStringWithDefault("GCP_KMS_ESCROW_KEY", "")
+	defaultKekTTL := envConfigDurationWithDefault("GCS_PROXY_KEK_TTL", 0)
+	defaultAeadWorkers := envConfigIntWithDefault("GCS_PROXY_AEAD_WORKERS", 0)
+	defaultDedupBucketsString := envConfigStringWithDefault("GCS_PROXY_DEDUP_BUCKETS", "")
+	defaultDedupTTL := envConfigDurationWithDefault("GCS_PROXY_DEDUP_TTL", time.Hour)
+	defaultDedupCacheMB := envConfigIntWithDefault("GCS_PROXY_DEDUP_CACHE_MB", 256)
+	defaultRetryReuseTTL := envConfigDurationWithDefault("GCS_PROXY_RETRY_REUSE_TTL", 0)
+	defaultKmsQps := envConfigFloatWithDefault("GCS_PROXY_KMS_QPS", 0)
+	defaultKmsQuotaServer := envConfigStringWithDefault("GCS_PROXY_KMS_QUOTA_SERVER", "")
+	defaultKmsQuotaToken := envConfigStringWithDefault("GCS_PROXY_KMS_QUOTA_TOKEN", "")
+	defaultKmsQuotaReplicas := envConfigIntWithDefault("GCS_PROXY_KMS_QUOTA_REPLICAS", 1)
+	defaultKmsProjectQpsString := envConfigStringWithDefault("GCS_PROXY_KMS_PROJECT_QPS", "")
+	defaultHybridKeysetsString := envConfigStringWithDefault("GCS_PROXY_HYBRID_KEYSETS", "")
+	defaultHybridKeysetKmsKey := envConfigStringWithDefault("GCS_PROXY_HYBRID_KEYSET_KMS_KEY", "")
+	defaultEnvelopeFormatsString := envConfigStringWithDefault("GCS_PROXY_BUCKET_ENVELOPE_FORMATS", "")
+	defaultEncryptContentTypesString := envConfigStringWithDefault("GCS_PROXY_ENCRYPT_CONTENT_TYPES", "")
+	defaultSkipContentTypesString := envConfigStringWithDefault("GCS_PROXY_SKIP_CONTENT_TYPES", "")
+	defaultEncryptMinSizesString := envConfigStringWithDefault("GCS_PROXY_ENCRYPT_MIN_SIZES", "")
+	defaultEncryptMaxSizesString := envConfigStringWithDefault("GCS_PROXY_ENCRYPT_MAX_SIZES", "")
+	defaultMaxObjectSizesString := envConfigStringWithDefault("GCS_PROXY_MAX_OBJECT_SIZES", "")
+	defaultChunkSizesString := envConfigStringWithDefault("GCS_PROXY_BUCKET_CHUNK_SIZES", "")
+	defaultRunAsUser := envConfigStringWithDefault("PROXY_RUN_AS_USER", "")
+	defaultMtlsPassthrough := envConfigBoolWithDefault("GCS_PROXY_MTLS_PASSTHROUGH", false)
+	defaultSlicedDownloadCacheMB := envConfigIntWithDefault("GCS_PROXY_SLICED_DOWNLOAD_CACHE_MB", 256)
+	defaultSlicedDownloadCacheTTL := envConfigDurationWithDefault("GCS_PROXY_SLICED_DOWNLOAD_CACHE_TTL", 2*time.Minute)
+	defaultListPrefetchMaxKB := envConfigIntWithDefault("GCS_PROXY_LIST_PREFETCH_MAX_KB", 0)
+	defaultListPrefetchMaxObjects := envConfigIntWithDefault("GCS_PROXY_LIST_PREFETCH_MAX_OBJECTS", 100)
+	defaultNotificationsSubscription := envConfigStringWithDefault("GCS_PROXY_NOTIFICATIONS_SUBSCRIPTION", "")
+
+	defaultHarFile := envConfigStringWithDefault("GCS_PROXY_HAR_FILE", "")
+	defaultHarRedactBodies := envConfigBoolWithDefault("GCS_PROXY_HAR_REDACT_BODIES", true)
+	defaultAdminAddr := envConfigStringWithDefault("GCS_PROXY_ADMIN_ADDR", "")
+	defaultAdminToken := envConfigStringWithDefault("GCS_PROXY_ADMIN_TOKEN", "")
+	defaultAdminMappingsFile := envConfigStringWithDefault("GCS_PROXY_ADMIN_MAPPINGS_FILE", "")
+	defaultBypassMaxDuration := envConfigDurationWithDefault("GCS_PROXY_BYPASS_MAX_DURATION", time.Hour)
+	defaultAdminFetch := envConfigBoolWithDefault("GCS_PROXY_ADMIN_FETCH", false)
+	defaultFlowHistory := envConfigStringWithDefault("GCS_PROXY_FLOW_HISTORY", "")
+	defaultFlowHistoryMaxAge := envConfigDurationWithDefault("GCS_PROXY_FLOW_HISTORY_MAX_AGE", 7*24*time.Hour)
+	defaultFlowHistoryMaxEntries := envConfigIntWithDefault("GCS_PROXY_FLOW_HISTORY_MAX_ENTRIES", 100000)
+	defaultPolicySource := envConfigStringWithDefault("GCS_PROXY_POLICY_SOURCE", "")
+	defaultPolicyPollInterval := envConfigDurationWithDefault("GCS_PROXY_POLICY_POLL_INTERVAL", time.Minute)
+	defaultPolicyVersion := envConfigIntWithDefault("GCS_PROXY_POLICY_VERSION", 0)
+	defaultPolicySigningKey := envConfigStringWithDefault("GCS_PROXY_POLICY_SIGNING_KEY", "")
+	defaultPolicyAllowUnsigned := envConfigBoolWithDefault("GCS_PROXY_POLICY_ALLOW_UNSIGNED", false)
+	defaultReplayLocalKms := envConfigBoolWithDefault("GCS_PROXY_REPLAY_LOCAL_KMS", true)
+	defaultDoubleEncryption := envConfigStringWithDefault("GCS_PROXY_DOUBLE_ENCRYPTION", "skip")
+	defaultMetadataPrefix := envConfigStringWithDefault("GCS_PROXY_METADATA_PREFIX", "gcsproxy-")
+	defaultCseKeyMetadata := envConfigStringWithDefault("GCS_PROXY_CSE_KEY_METADATA", "")
+	defaultCseAssociatedData := envConfigStringWithDefault("GCS_PROXY_CSE_ASSOCIATED_DATA", "")
+	defaultVerifyUploads := envConfigBoolWithDefault("GCS_PROXY_VERIFY_UPLOADS", false)
+	defaultWriteOnly := envConfigBoolWithDefault("GCS_PROXY_WRITE_ONLY", false)
+	defaultPlaintextConfirmed := envConfigBoolWithDefault("GCS_PROXY_I_UNDERSTAND_PLAINTEXT", false)
+	defaultKeyCheckInterval := envConfigDurationWithDefault("GCS_PROXY_KEY_CHECK_INTERVAL", 5*time.Minute)
+	defaultKeyFailurePolicy := envConfigStringWithDefault("GCS_PROXY_KEY_FAILURE_POLICY", "serve")
+	defaultHealthAddr := envConfigStringWithDefault("GCS_PROXY_HEALTH_ADDR", "")
+	defaultMetadataShimAddr := envConfigStringWithDefault("GCS_PROXY_METADATA_SHIM_ADDR", "")
+	defaultMetadataShimScopes := envConfigStringWithDefault("GCS_PROXY_METADATA_SHIM_SCOPES", "https://www.googleapis.com/auth/devstorage.read_write")
+	defaultMetadataShimClientsString := envConfigStringWithDefault("GCS_PROXY_METADATA_SHIM_CLIENTS", "")
+	defaultCanaryInterval := envConfigDurationWithDefault("GCS_PROXY_CANARY_INTERVAL", 0)
+	defaultCanaryObject := envConfigStringWithDefault("GCS_PROXY_CANARY_OBJECT", ".gcsproxy-canary")
+	defaultManifestSigningKey := envConfigStringWithDefault("GCS_PROXY_MANIFEST_SIGNING_KEY", "")
+	defaultManifestInterval := envConfigDurationWithDefault("GCS_PROXY_MANIFEST_INTERVAL", 5*time.Minute)
+	defaultManifestMaxObjects := envConfigIntWithDefault("GCS_PROXY_MANIFEST_MAX_OBJECTS", 1000)
+	defaultChaosKmsLatency := envConfigDurationWithDefault("GCS_PROXY_CHAOS_KMS_LATENCY", 0)
+	defaultChaosKmsLatencyRate := envConfigFloatWithDefault("GCS_PROXY_CHAOS_KMS_LATENCY_RATE", 1)
+	defaultChaosKmsErrorRate := envConfigFloatWithDefault("GCS_PROXY_CHAOS_KMS_ERROR_RATE", 0)
+	defaultChaosUpstreamErrorRate := envConfigFloatWithDefault("GCS_PROXY_CHAOS_UPSTREAM_ERROR_RATE", 0)
+	defaultChaosTruncateRate := envConfigFloatWithDefault("GCS_PROXY_CHAOS_TRUNCATE_RATE", 0)
+	defaultListenAddrs := envConfigStringWithDefault("GCS_PROXY_LISTEN_ADDRS", ":9080")
+	defaultUnixSocketMode := envConfigStringWithDefault("GCS_PROXY_UNIX_SOCKET_MODE", "0660")
+	defaultListenTlsCert := envConfigStringWithDefault("GCS_PROXY_LISTEN_TLS_CERT", "")
+	defaultListenTlsKey := envConfigStringWithDefault("GCS_PROXY_LISTEN_TLS_KEY", "")
+	defaultEncryptExistingParallelism := envConfigIntWithDefault("GCS_PROXY_ENCRYPT_EXISTING_PARALLELISM", 8)
+	defaultEncryptExistingMBPerSecond := envConfigFloatWithDefault("GCS_PROXY_ENCRYPT_EXISTING_MB_PER_SECOND", 0)
+	defaultEncryptExistingCheckpoint := envConfigStringWithDefault("GCS_PROXY_ENCRYPT_EXISTING_CHECKPOINT", "")
+	defaultEncryptExistingReport := envConfigStringWithDefault("GCS_PROXY_ENCRYPT_EXISTING_REPORT", "")
+	defaultEncryptExistingDryRun := envConfigBoolWithDefault("GCS_PROXY_ENCRYPT_EXISTING_DRY_RUN", false)
+	defaultPurgeRules := envConfigStringWithDefault("GCS_PROXY_PURGE_RULES", "")
+	defaultPurgeParallelism := envConfigIntWithDefault("GCS_PROXY_PURGE_PARALLELISM", 8)
+	defaultPurgeDryRun := envConfigBoolWithDefault("GCS_PROXY_PURGE_DRY_RUN", false)
+	defaultBigQueryTable := envConfigStringWithDefault("GCS_PROXY_BIGQUERY_TABLE", "")
+	defaultCostReportPricePerGiBMonth := envConfigFloatWithDefault("GCS_PROXY_COST_REPORT_PRICE_PER_GIB_MONTH", 0.02)
+	defaultInitProject := envConfigStringWithDefault("GCS_PROXY_INIT_PROJECT", "")
+	defaultInitBuckets := envConfigStringWithDefault("GCS_PROXY_INIT_BUCKETS", "")
+	defaultInitKey := envConfigStringWithDefault("GCS_PROXY_INIT_KEY", "")
+	defaultInitOutput := envConfigStringWithDefault("GCS_PROXY_INIT_OUTPUT", "gcsproxy.json")
+	defaultInitYes := envConfigBoolWithDefault("GCS_PROXY_INIT_YES", false)
+	defaultCloudMonitoringProject := envConfigStringWithDefault("GCS_PROXY_CLOUD_MONITORING_PROJECT", "")
+	defaultCloudMonitoringLabels := envConfigStringWithDefault("GCS_PROXY_CLOUD_MONITORING_LABELS", "")
+	defaultCloudMonitoringInterval := envConfigDurationWithDefault("GCS_PROXY_CLOUD_MONITORING_INTERVAL", time.Minute)
+	defaultLogSampleRates := envConfigStringWithDefault("GCS_PROXY_LOG_SAMPLE_RATES", "")
+	defaultLogRateLimits := envConfigStringWithDefault("GCS_PROXY_LOG_RATE_LIMITS", "")
+	defaultSlowRequestThreshold := envConfigDurationWithDefault("GCS_PROXY_SLOW_REQUEST_THRESHOLD", 0)
+	defaultSlowRequestHeader := envConfigBoolWithDefault("GCS_PROXY_SLOW_REQUEST_HEADER", false)
+	defaultUnsafeDisableRedaction := envConfigBoolWithDefault("GCS_PROXY_UNSAFE_DISABLE_REDACTION", false)
+	defaultAuditLog := envConfigStringWithDefault("GCS_PROXY_AUDIT_LOG", "")
+	defaultDecryptClientsString := envConfigStringWithDefault("GCS_PROXY_DECRYPT_CLIENTS", "")
+	defaultOverrideClientsString := envConfigStringWithDefault("GCS_PROXY_OVERRIDE_CLIENTS", "")
+	defaultResponseHeadersString := envConfigStringWithDefault("GCS_PROXY_RESPONSE_HEADERS", "")
+	defaultMirrorBucketsString := envConfigStringWithDefault("GCS_PROXY_MIRROR_BUCKETS", "")
+	defaultUserProject := envConfigStringWithDefault("GCS_PROXY_USER_PROJECT", "")
+	defaultGcsEndpoint := envConfigStringWithDefault("GCS_PROXY_GCS_ENDPOINT", "")
+	defaultImpersonateServiceAccount := envConfigStringWithDefault("GCS_PROXY_IMPERSONATE_SERVICE_ACCOUNT", "")
+	defaultGcsMaxAttempts := envConfigIntWithDefault("GCS_PROXY_GCS_MAX_ATTEMPTS", 5)
+	defaultMirrorWorkers := envConfigIntWithDefault("GCS_PROXY_MIRROR_WORKERS", 4)
+	defaultMirrorQueueMB := envConfigIntWithDefault("GCS_PROXY_MIRROR_QUEUE_MB", 256)
+	defaultSpoolDir := envConfigStringWithDefault("GCS_PROXY_SPOOL_DIR", "")
+	defaultSpoolMaxMB := envConfigIntWithDefault("GCS_PROXY_SPOOL_MAX_MB", 10240)
+	defaultSpoolRetryInterval := envConfigDurationWithDefault("GCS_PROXY_SPOOL_RETRY_INTERVAL", 30*time.Second)
+	defaultHmacPolicy := envConfigStringWithDefault("GCS_PROXY_HMAC_SIGNED_REQUESTS", "reject")
+	defaultHmacKeysFile := envConfigStringWithDefault("GCS_PROXY_HMAC_KEYS_FILE", "")
+	defaultBackendsString := envConfigStringWithDefault("GCS_PROXY_BACKENDS", "")
+	defaultClientShims := envConfigBoolWithDefault("GCS_PROXY_CLIENT_SHIMS", true)
+	defaultUpgradeSocket := envConfigStringWithDefault("GCS_PROXY_UPGRADE_SOCKET", "")
+	defaultUpgrade := envConfigBoolWithDefault("GCS_PROXY_UPGRADE", false)
+	defaultUpgradeDrainTimeout := envConfigDurationWithDefault("GCS_PROXY_UPGRADE_DRAIN_TIMEOUT", 5*time.Minute)
+	defaultTenantsFile := envConfigStringWithDefault("GCS_PROXY_TENANTS_FILE", "")
+	defaultClientRequestsPerSecond := envConfigFloatWithDefault("GCS_PROXY_CLIENT_REQUESTS_PER_SECOND", 0)
+	defaultClientMBPerSecond := envConfigFloatWithDefault("GCS_PROXY_CLIENT_MB_PER_SECOND", 0)
+	defaultBucketRequestsPerSecond := envConfigFloatWithDefault("GCS_PROXY_BUCKET_REQUESTS_PER_SECOND", 0)
+	defaultBucketMBPerSecond := envConfigFloatWithDefault("GCS_PROXY_BUCKET_MB_PER_SECOND", 0)
 
 	flag.BoolVar(&config.Version, "version", false, "show go-gcsproxy version")
-	flag.StringVar(&config.Addr, "port", ":9080", "proxy listen addr")
+	flag.StringVar(&config.ConfigFile, "config_file", defaultConfigFile, "JSON file of flag values, shared settings and per environment profiles. flags given on the command line win over it")
+	flag.StringVar(&config.Profile, "profile", defaultProfile, "profile of -config_file to apply, e.g. dev, staging or prod. required when the file defines profiles")
+	flag.StringVar(&config.Addr, "port", defaultListenAddrs, "proxy listen addrs, comma separated, e.g. :9080 or 127.0.0.1:9080,[::1]:9080,unix:///run/gcsproxy/proxy.sock")
 	flag.StringVar(&config.WebAddr, "web_port", ":9081", "web interface listen addr")
 	flag.BoolVar(&config.SslInsecure, "ssl_insecure", defaultSslInsecure, "don't verify upstream server SSL/TLS certificates.")
 
@@ -57,15 +376,171 @@ func LoadConfig() *Config {
 	flag.IntVar(&config.Debug, "debug", defaultDebug, "debug level: 0 - ERROR, 1 - DEBUG, 2 - TRACE")
 	flag.StringVar(&config.Dump, "dump", "", "filename to dump req/responses for debugging")
 	flag.IntVar(&config.DumpLevel, "dump_level", 0, "dump level: 0 - header, 1 - header + body")
+	flag.StringVar(&config.HarFile, "har", defaultHarFile, "filename to write intercepted flows to as HAR, for Chrome devtools and other HAR viewers")
+	flag.BoolVar(&config.HarRedactBodies, "har_redact_bodies", defaultHarRedactBodies, "leave bodies out of the HAR file. bodies are plaintext, only disable on test data")
 	flag.StringVar(&config.Upstream, "upstream", "", "upstream proxy")
 	// "*:global-key" or "bucket/path:project/key,bucket2:key2" but the global key overrides all the other keys
 	flag.StringVar(&config.kmsBucketKeyMappingString, "kms_bucket_key_mappings", defaultKmsBucketKeyMappingString, "Maps Bucket name to KMS keys. Proxy encrypts object uploaded to BUCKET with KEY stored in KMS. Setting BUCKET to * will encrypt/decrypt all GCS calls. Format is `BUCKET:KEY1,BUCKET2:KEY2` for example: `mygcsbucket:projects/<project_id>/locations/<global|region>/keyRings/<key_ring>/cryptoKeys/<key>`")
+	flag.StringVar(&config.KmsMappingDir, "kms_mapping_dir", defaultKmsMappingDir, "directory of one file per bucket, named after the bucket and holding `KEY [FORMAT]`, e.g. a mounted Kubernetes ConfigMap. its buckets win over -kms_bucket_key_mappings, changes are applied while the proxy runs")
+	flag.DurationVar(&config.KmsMappingDirInterval, "kms_mapping_dir_interval", defaultKmsMappingDirInterval, "how often -kms_mapping_dir is read again, a fallback for the file system events lost")
 
 	flag.BoolVar(&config.UpstreamCert, "upstream_cert", false, "connect to upstream server to look up certificate details")
+	flag.StringVar(&config.RunAsUser, "run_as_user", defaultRunAsUser, "user name or uid to switch to after binding the listen socket (requires starting as root)")
+	flag.BoolVar(&config.MtlsPassthrough, "mtls_passthrough", defaultMtlsPassthrough, "tunnel *.mtls.googleapis.com connections without interception so client certificates reach GCS. WARNING: these objects are not encrypted")
+	flag.IntVar(&config.SlicedDownloadCacheMB, "sliced_download_cache_mb", defaultSlicedDownloadCacheMB, "MB of decrypted objects kept for the parallel ranged reads of sliced downloads. 0 disables the cache")
+	flag.DurationVar(&config.SlicedDownloadCacheTTL, "sliced_download_cache_ttl", defaultSlicedDownloadCacheTTL, "how long a decrypted object is kept for further ranged reads. raise it for random read workloads such as the Hadoop GCS connector")
+	flag.IntVar(&config.ListPrefetchMaxKB, "list_prefetch_max_kb", defaultListPrefetchMaxKB, "download and decrypt the encrypted objects of up to this many KB an objects.list returns in the background, so reading them next is served from the sliced download cache. 0 disables prefetching")
+	flag.IntVar(&config.ListPrefetchMaxObjects, "list_prefetch_max_objects", defaultListPrefetchMaxObjects, "objects prefetched per listing at most, see -list_prefetch_max_kb")
+	flag.StringVar(&config.NotificationsSubscription, "notifications_subscription", defaultNotificationsSubscription, "Pub/Sub subscription `projects/PROJECT/subscriptions/NAME` to the notifications of the mapped buckets and to policy updates. the objects other clients delete or overwrite are dropped from the sliced download cache, and -policy_source is fetched right away when it changes")
+	flag.StringVar(&config.kmsFallbackKeysString, "kms_fallback_keys", defaultKmsFallbackKeysString, "Retired KMS keys to try when decrypting generations that don't record their key, for example restored soft-deleted objects. Format is `BUCKET:KEY1|KEY2,BUCKET2:KEY3`, BUCKET * applies to all buckets")
+	flag.StringVar(&config.KmsEscrowKey, "kms_escrow_key", defaultKmsEscrowKey, "KMS key that additionally wraps every data encryption key so objects can be recovered with `go-gcsproxy recover` if the mapped key is lost. The proxy only needs encrypt permission on it")
+	flag.IntVar(&config.AeadWorkers, "aead_workers", defaultAeadWorkers, "encrypt and decrypt at most this many payloads at once on a dedicated worker pool, the others queue. 0 uses GOMAXPROCS")
+	flag.DurationVar(&config.KekTTL, "kek_ttl", defaultKekTTL, "wrap the data encryption keys with a key encryption key per bucket the mapped KMS key wraps, generated and cached for this long, instead of calling KMS for every object. 0 disables the key hierarchy")
+	flag.StringVar(&config.dedupBucketsString, "dedup_buckets", defaultDedupBucketsString, "comma separated buckets whose uploads of a plaintext encrypted within -dedup_ttl get the same DEK and ciphertext, saving CPU and KMS calls. identical objects then have identical ciphertext, readers of the bucket see which objects are equal")
+	flag.DurationVar(&config.DedupTTL, "dedup_ttl", defaultDedupTTL, "how long the ciphertext of an upload to -dedup_buckets is reused for identical uploads")
+	flag.IntVar(&config.DedupCacheMB, "dedup_cache_mb", defaultDedupCacheMB, "memory of the ciphertexts reused for -dedup_buckets and retried uploads, the least recently used are dropped first")
+	flag.DurationVar(&config.RetryReuseTTL, "retry_reuse_ttl", defaultRetryReuseTTL, "how long a retry of an upload, the same plaintext to the same object in the same resumable session, XML API multipart upload or client library call, gets the DEK and ciphertext of the first attempt. 0, the default, encrypts every attempt anew")
+	flag.Float64Var(&config.KmsQps, "kms_qps", defaultKmsQps, "KMS requests per second the proxy sends at most, with -kms_quota_server the limit of every replica together. 0 is unlimited")
+	flag.StringVar(&config.KmsQuotaServer, "kms_quota_server", defaultKmsQuotaServer, "URL of the go-gcsproxy kms-quota-server the replicas lease their KMS requests from, e.g. http://kms-quota:9085")
+	flag.StringVar(&config.KmsQuotaToken, "kms_quota_token", defaultKmsQuotaToken, "bearer token of the kms-quota-server. prefer GCS_PROXY_KMS_QUOTA_TOKEN, flags are visible in the process list")
+	flag.StringVar(&config.kmsProjectQpsString, "kms_project_qps", defaultKmsProjectQpsString, "KMS requests per second the proxy sends at most to the keys of a project, on top of -kms_qps. Format is `PROJECT:QPS,...`, for example `payments-kms:100,analytics-kms:20`")
+	flag.IntVar(&config.KmsQuotaReplicas, "kms_quota_replicas", defaultKmsQuotaReplicas, "replicas sharing -kms_qps, each keeps to -kms_qps / -kms_quota_replicas while the kms-quota-server is unreachable")
+	flag.StringVar(&config.hybridKeysetsString, "hybrid_keysets", defaultHybridKeysetsString, "Tink hybrid keysets of the buckets mapped to hybrid/NAME, `NAME:FILE,NAME2:FILE2`. producers get the public keyset and encrypt without KMS, readers the private keyset written by `go-gcsproxy hybrid-keyset`")
+	flag.StringVar(&config.HybridKeysetKmsKey, "hybrid_keyset_kms_key", defaultHybridKeysetKmsKey, "KMS key the private -hybrid_keysets are encrypted with. only central readers need it")
+	flag.StringVar(&config.envelopeFormatsString, "bucket_envelope_formats", defaultEnvelopeFormatsString, "Envelope format per bucket, `BUCKET:FORMAT,BUCKET2:FORMAT`. tink (default) encrypts in the proxy, csek has GCS encrypt with a customer-supplied key derived by the mapped KMS MAC key version")
+	flag.StringVar(&config.AdminAddr, "admin_port", defaultAdminAddr, "admin API listen addr for onboarding buckets at runtime, e.g. 127.0.0.1:9082. disabled when empty")
+	flag.StringVar(&config.AdminToken, "admin_token", defaultAdminToken, "bearer token required by the admin API. prefer GCS_PROXY_ADMIN_TOKEN, flags are visible in the process list")
+	flag.StringVar(&config.AdminMappingsFile, "admin_mappings_file", defaultAdminMappingsFile, "file the admin API saves bucket key mappings to. its mappings are loaded at startup and override -kms_bucket_key_mappings")
+	flag.DurationVar(&config.BypassMaxDuration, "bypass_max_duration", defaultBypassMaxDuration, "longest emergency bypass of a bucket the admin API starts, its requests are neither encrypted nor decrypted")
+	flag.BoolVar(&config.AdminFetch, "admin_fetch", defaultAdminFetch, "serve the admin API's GET /v1/fetch, which answers decrypted objects to any caller of the admin token, for break-glass inspection")
+	flag.StringVar(&config.FlowHistory, "flow_history", defaultFlowHistory, "JSON lines file keeping the finished flows across restarts, searched with the admin API's GET /v1/flows/history. disabled when empty")
+	flag.DurationVar(&config.FlowHistoryMaxAge, "flow_history_max_age", defaultFlowHistoryMaxAge, "flows older than this are dropped from -flow_history")
+	flag.IntVar(&config.FlowHistoryMaxEntries, "flow_history_max_entries", defaultFlowHistoryMaxEntries, "flows kept in -flow_history at most, the oldest are dropped first")
+	flag.StringVar(&config.PolicySource, "policy_source", defaultPolicySource, "central bucket key mapping, `gs://BUCKET/OBJECT` or `firestore://projects/PROJECT/databases/DATABASE/documents/PATH`. replaces -kms_bucket_key_mappings")
+	flag.DurationVar(&config.PolicyPollInterval, "policy_poll_interval", defaultPolicyPollInterval, "how often -policy_source is fetched")
+	flag.Int64Var(&config.PolicyVersion, "policy_version", int64(defaultPolicyVersion), "only apply this version of -policy_source. 0 applies every newer version")
+	flag.StringVar(&config.PolicySigningKey, "policy_signing_key", defaultPolicySigningKey, "KMS asymmetric signing key version the -policy_source document must be signed with")
+	flag.BoolVar(&config.PolicyAllowUnsigned, "policy_allow_unsigned", defaultPolicyAllowUnsigned, "apply -policy_source documents without checking a signature. WARNING: anyone who can write the policy can turn encryption off")
+	flag.BoolVar(&config.ReplayLocalKms, "replay_local_kms", defaultReplayLocalKms, "replay dumps with keys that only live in memory, so no KMS access is needed. disable to reproduce KMS permission or key state issues with the real keys")
+	flag.StringVar(&config.DoubleEncryption, "double_encryption", defaultDoubleEncryption, "uploads that already are a gcs-proxy envelope, e.g. sent through two proxies: skip uploads them as they are, error rejects them with 400, encrypt encrypts them again")
+	flag.StringVar(&config.MetadataPrefix, "metadata_prefix", defaultMetadataPrefix, "prefix of the custom metadata keys the proxy records the encryption in, gcsproxy- for x-goog-meta-gcsproxy-encryption-key. objects an earlier proxy wrote with the x- prefix keep decrypting")
+	flag.StringVar(&config.cseKeyMetadataString, "cse_key_metadata", defaultCseKeyMetadata, "comma separated custom metadata keys other Tink clients, e.g. the Java or Python GCS client-side encryption samples, record the KMS key URI in. their objects are decrypted through the proxy")
+	flag.StringVar(&config.CseAssociatedData, "cse_associated_data", defaultCseAssociatedData, "associated data the -cse_key_metadata clients encrypt with, {bucket} and {object} are replaced, e.g. gs://{bucket}/{object}. empty for none")
+	flag.DurationVar(&config.KeyCheckInterval, "key_check_interval", defaultKeyCheckInterval, "re-check every mapped KMS key this often in the background, one encrypt or MAC call per key. 0 disables")
+	flag.StringVar(&config.KeyFailurePolicy, "key_failure_policy", defaultKeyFailurePolicy, "what to do with the requests of a bucket whose key failed its last check: serve (call KMS anyway), reject-uploads or reject, both answer 503 without calling KMS")
+	flag.StringVar(&config.HealthAddr, "health_port", defaultHealthAddr, "listen addr of the unauthenticated /healthz and /readyz probes, e.g. :9083. /readyz fails while a mapped key fails its check. disabled when empty")
+	flag.StringVar(&config.MetadataShimAddr, "metadata_shim_port", defaultMetadataShimAddr, "listen addr of a GCE metadata server shim, e.g. 127.0.0.1:9084, serving the access tokens of the proxy's identity to the clients pointed at it with GCE_METADATA_HOST. other than loopback and unix socket addresses need -metadata_shim_clients. disabled when empty")
+	flag.StringVar(&config.metadataShimScopesString, "metadata_shim_scopes", defaultMetadataShimScopes, "comma separated OAuth scopes the metadata shim grants tokens for, tokens asking for others are refused")
+	flag.StringVar(&config.metadataShimClientsString, "metadata_shim_clients", defaultMetadataShimClientsString, "comma separated clients the metadata shim answers, others get 403: client addresses, CIDRs, tenant:NAME or *, as in -decrypt_clients. every client of the address when empty")
+	flag.DurationVar(&config.CanaryInterval, "canary_interval", defaultCanaryInterval, "every interval encrypt, upload, download and decrypt -canary_object in every mapped bucket with the proxy's own identity, to catch IAM or KMS drift. 0 disables")
+	flag.StringVar(&config.CanaryObject, "canary_object", defaultCanaryObject, "object the canary overwrites in every mapped bucket")
+	flag.StringVar(&config.ManifestSigningKey, "manifest_signing_key", defaultManifestSigningKey, "KMS asymmetric signing key version that signs a manifest of the encrypted uploads of every prefix, written next to the objects for downstream verification. empty disables manifests")
+	flag.DurationVar(&config.ManifestInterval, "manifest_interval", defaultManifestInterval, "how often the uploads collected since the last manifest of a prefix are written to a new one")
+	flag.IntVar(&config.ManifestMaxObjects, "manifest_max_objects", defaultManifestMaxObjects, "objects that write the manifest of a prefix before -manifest_interval ends")
+	flag.BoolVar(&config.WriteOnly, "write_only", defaultWriteOnly, "ingest mode: encrypt uploads but answer 403 to every download of an encrypted bucket, so the proxy never reads data back. grant it only roles/cloudkms.cryptoKeyEncrypter")
+	flag.BoolVar(&config.PlaintextConfirmed, "i_understand_plaintext", defaultPlaintextConfirmed, "confirm that GCS_PROXY_DISABLE_ENCRYPTION is meant: the proxy uploads and downloads every object in plaintext. the proxy refuses to start disabled without it")
+	flag.BoolVar(&config.VerifyUploads, "verify_uploads", defaultVerifyUploads, "after each upload read the stored object's hashes back and fail the upload unless they match the ciphertext sent. costs one metadata request per upload")
+	flag.DurationVar(&config.ChaosKmsLatency, "chaos_kms_latency", defaultChaosKmsLatency, "chaos testing: delay KMS calls by this duration")
+	flag.Float64Var(&config.ChaosKmsLatencyRate, "chaos_kms_latency_rate", defaultChaosKmsLatencyRate, "chaos testing: share of the KMS calls delayed by -chaos_kms_latency, 0 to 1")
+	flag.Float64Var(&config.ChaosKmsErrorRate, "chaos_kms_error_rate", defaultChaosKmsErrorRate, "chaos testing: share of the KMS calls that fail as if KMS was unavailable, 0 to 1")
+	flag.Float64Var(&config.ChaosUpstreamErrorRate, "chaos_upstream_error_rate", defaultChaosUpstreamErrorRate, "chaos testing: share of the requests answered with 503 instead of being sent to GCS, 0 to 1")
+	flag.Float64Var(&config.ChaosTruncateRate, "chaos_truncate_rate", defaultChaosTruncateRate, "chaos testing: share of the response bodies cut short, 0 to 1")
+	flag.StringVar(&config.TenantsFile, "tenants_file", defaultTenantsFile, "JSON file of tenants with their own bucket key mappings, KMS credentials, rate limits and metric labels")
+	flag.Float64Var(&config.ClientRequestsPerSecond, "client_requests_per_second", defaultClientRequestsPerSecond, "requests per second allowed from each client address, 0 is unlimited")
+	flag.Float64Var(&config.ClientMBPerSecond, "client_mb_per_second", defaultClientMBPerSecond, "request and response body MiB per second allowed for each client address, 0 is unlimited")
+	flag.Float64Var(&config.BucketRequestsPerSecond, "bucket_requests_per_second", defaultBucketRequestsPerSecond, "requests per second allowed to each bucket, 0 is unlimited")
+	flag.Float64Var(&config.BucketMBPerSecond, "bucket_mb_per_second", defaultBucketMBPerSecond, "request and response body MiB per second allowed for each bucket, 0 is unlimited")
+	flag.StringVar(&config.UnixSocketMode, "unix_socket_mode", defaultUnixSocketMode, "octal file mode of the unix sockets the proxy listens on")
+	flag.StringVar(&config.ListenTlsCert, "listen_tls_cert", defaultListenTlsCert, "PEM certificate file to serve the proxy over TLS, clients use HTTPS_PROXY=https://host:port")
+	flag.StringVar(&config.ListenTlsKey, "listen_tls_key", defaultListenTlsKey, "PEM private key file of -listen_tls_cert")
+	flag.IntVar(&config.EncryptExistingParallelism, "encrypt_existing_parallelism", defaultEncryptExistingParallelism, "encrypt-existing: objects encrypted at once")
+	flag.Float64Var(&config.EncryptExistingMBPerSecond, "encrypt_existing_mb_per_second", defaultEncryptExistingMBPerSecond, "encrypt-existing: download plus upload MiB per second, 0 is unlimited")
+	flag.StringVar(&config.EncryptExistingCheckpoint, "encrypt_existing_checkpoint", defaultEncryptExistingCheckpoint, "encrypt-existing: file recording progress, a run resumes where the previous one stopped")
+	flag.StringVar(&config.EncryptExistingReport, "encrypt_existing_report", defaultEncryptExistingReport, "encrypt-existing: JSON lines file the result of every object is appended to")
+	flag.BoolVar(&config.EncryptExistingDryRun, "encrypt_existing_dry_run", defaultEncryptExistingDryRun, "encrypt-existing: report what would be encrypted without writing anything")
+	flag.StringVar(&config.PurgeRules, "purge_rules", defaultPurgeRules, "purge: JSON file of the lifecycle rules, the first rule an object matches applies")
+	flag.IntVar(&config.PurgeParallelism, "purge_parallelism", defaultPurgeParallelism, "purge: objects re-encrypted, and batches of up to 100 deletes sent, at once")
+	flag.BoolVar(&config.PurgeDryRun, "purge_dry_run", defaultPurgeDryRun, "purge: report what the rules would delete or re-encrypt without changing anything")
+	flag.Float64Var(&config.CostReportPricePerGiBMonth, "cost_report_price_per_gib_month", defaultCostReportPricePerGiBMonth, "cost-report: storage price per GiB and month of the buckets' storage class, the default is Standard storage in a region")
+	flag.StringVar(&config.InitProject, "init_project", defaultInitProject, "init: project whose buckets are offered, the project of the credentials when empty")
+	flag.StringVar(&config.initBucketsString, "init_buckets", defaultInitBuckets, "init: comma separated buckets to encrypt, instead of choosing among the buckets of the project")
+	flag.StringVar(&config.InitKey, "init_key", defaultInitKey, "init: KMS key of every bucket instead of the first key suggested for it, `projects/P/locations/L/keyRings/R/cryptoKeys/K`")
+	flag.StringVar(&config.InitOutput, "init_output", defaultInitOutput, "init: config file to write, for -config_file. an existing file is not overwritten")
+	flag.BoolVar(&config.InitYes, "init_yes", defaultInitYes, "init: don't ask, take the flags, the defaults and the first key suggested for every bucket")
+	flag.StringVar(&config.BigQueryTable, "bigquery_table", defaultBigQueryTable, "verify-restore and encrypt-existing: BigQuery table project.dataset.table the result of every object is streamed to, created if missing")
+	flag.StringVar(&config.CloudMonitoringProject, "cloud_monitoring_project", defaultCloudMonitoringProject, "project the proxy metrics are pushed to as Cloud Monitoring custom metrics, no export when empty")
+	flag.StringVar(&config.cloudMonitoringLabelsString, "cloud_monitoring_labels", defaultCloudMonitoringLabels, "resource labels added to the Cloud Monitoring time series, `KEY=VALUE,KEY2=VALUE2`")
+	flag.DurationVar(&config.CloudMonitoringInterval, "cloud_monitoring_interval", defaultCloudMonitoringInterval, "how often the metrics are pushed to Cloud Monitoring, at least 10s")
+	flag.StringVar(&config.logSampleRatesString, "log_sample_rates", defaultLogSampleRates, "share of the log entries kept per category, `CATEGORY=RATE,CATEGORY2=RATE`, e.g. debug=0.01. categories are debug, info, warning, error, encrypt, decrypt, upstream, tunnel and slow")
+	flag.StringVar(&config.logRateLimitsString, "log_rate_limits", defaultLogRateLimits, "log entries per second logged at most per category, `CATEGORY=N,CATEGORY2=N`, e.g. decrypt=10,error=50")
+	flag.DurationVar(&config.SlowRequestThreshold, "slow_request_threshold", defaultSlowRequestThreshold, "log the flows taking longer than this with the time spent reading the client request, in KMS, upstream and encrypting or decrypting, e.g. 2s. 0 logs none")
+	flag.BoolVar(&config.SlowRequestHeader, "slow_request_header", defaultSlowRequestHeader, "answer the flows slower than -slow_request_threshold with a Server-Timing header of where their time went")
+	flag.BoolVar(&config.UnsafeDisableRedaction, "unsafe_disable_redaction", defaultUnsafeDisableRedaction, "UNSAFE: log and dump authorization headers, encryption keys and signed URL signatures as they are, for debugging only")
+	flag.StringVar(&config.encryptContentTypesString, "encrypt_content_types", defaultEncryptContentTypesString, "Only encrypt uploads of these content types, others are stored in plaintext. Format is `BUCKET:TYPE1|TYPE2,BUCKET2:TYPE3`, for example `*:application/json|text/*`. BUCKET * applies to buckets without their own rule")
+	flag.StringVar(&config.skipContentTypesString, "skip_content_types", defaultSkipContentTypesString, "Never encrypt uploads of these content types, for example `media-bucket:video/*|audio/*`. Takes precedence over -encrypt_content_types")
+	flag.StringVar(&config.encryptMinSizesString, "encrypt_min_sizes", defaultEncryptMinSizesString, "Store smaller uploads in plaintext, e.g. marker files. Format is `BUCKET:SIZE,BUCKET2:SIZE` with sizes in bytes or with a KB, MB, GB, KiB, MiB or GiB suffix, BUCKET * applies to buckets without their own threshold")
+	flag.StringVar(&config.encryptMaxSizesString, "encrypt_max_sizes", defaultEncryptMaxSizesString, "Store larger uploads in plaintext, for example `*:50GiB`")
+	flag.StringVar(&config.chunkSizesString, "bucket_chunk_sizes", defaultChunkSizesString, "Encrypt the objects of a bucket in chunks of this plaintext size, recorded in the envelope header, for example `analytics:64KiB,archive:64MiB`. 1KiB to 1GiB, unset or 0 encrypts objects as one chunk")
+	flag.StringVar(&config.maxObjectSizesString, "max_object_sizes", defaultMaxObjectSizesString, "Reject larger uploads with 413 before the proxy reads them into memory, for example `big-bucket:20GiB,*:2GiB`")
+	flag.StringVar(&config.AuditLog, "audit_log", defaultAuditLog, "append the IAM policy and ACL changes clients send through the proxy, with their identity, to this JSON lines file")
+	flag.StringVar(&config.decryptClientsString, "decrypt_clients", defaultDecryptClientsString, "Only these clients may download decrypted objects of a bucket or prefix, others get 403 before any KMS call. Format is `BUCKET[/PREFIX]:CLIENT|CLIENT,...` with client addresses, CIDRs, account emails, tenant:NAME or *, for example `bucket-a:10.8.0.0/16|tenant:analytics,bucket-b:etl@p.iam.gserviceaccount.com`")
+	flag.StringVar(&config.overrideClientsString, "override_clients", defaultOverrideClientsString, "Only these clients may skip the encryption of their requests to a bucket with the x-gcsproxy-skip-encrypt header or pick one of its fallback keys with x-gcsproxy-key-override, others get 403. Format is `BUCKET:CLIENT|CLIENT,...` with the clients of -decrypt_clients, for example `*:migrate@p.iam.gserviceaccount.com`")
+	flag.StringVar(&config.responseHeadersString, "response_headers", defaultResponseHeadersString, "Set or strip headers of the downloads the proxy decrypts, e.g. so downstream caches never store sensitive objects. Format is `BUCKET:HEADER=VALUE|-HEADER,...`, -HEADER* strips every header with the prefix and rules setting the same header add its values, for example `*:Cache-Control=no-store|-X-Goog-Meta-*,reports:Content-Disposition=attachment`")
+	flag.StringVar(&config.mirrorBucketsString, "mirror_buckets", defaultMirrorBucketsString, "Copy the encrypted uploads of a bucket to a second bucket for disaster recovery, asynchronously. Format is `BUCKET:MIRROR,BUCKET2:MIRROR2`, every mirror bucket needs its own key mapping")
+	flag.StringVar(&config.UserProject, "user_project", defaultUserProject, "project billed for the requests the proxy and its subcommands make to Requester Pays buckets when the client names none in userProject or x-goog-user-project")
+	flag.StringVar(&config.GcsEndpoint, "gcs_endpoint", defaultGcsEndpoint, "endpoint of the GCS calls the proxy and its subcommands make themselves, e.g. https://storage-myendpoint.p.googleapis.com for Private Service Connect. https://storage.googleapis.com when empty")
+	flag.StringVar(&config.ImpersonateServiceAccount, "impersonate_service_account", defaultImpersonateServiceAccount, "make the proxy's own GCS calls as this service account, the default credentials need roles/iam.serviceAccountTokenCreator on it")
+	flag.IntVar(&config.GcsMaxAttempts, "gcs_max_attempts", defaultGcsMaxAttempts, "attempts of each idempotent GCS call the proxy makes itself, retried on 408, 429, 5xx and network errors")
+	flag.IntVar(&config.MirrorWorkers, "mirror_workers", defaultMirrorWorkers, "mirror copies written at once")
+	flag.IntVar(&config.MirrorQueueMB, "mirror_queue_mb", defaultMirrorQueueMB, "memory for the plaintext of the uploads waiting to be mirrored, uploads that don't fit are not mirrored and counted as dropped")
+	flag.StringVar(&config.SpoolDir, "spool_dir", defaultSpoolDir, "Store-and-forward: answer encrypted uploads once they are written to this directory and forward them to GCS in the background")
+	flag.IntVar(&config.SpoolMaxMB, "spool_max_mb", defaultSpoolMaxMB, "size of the spool directory, uploads that don't fit go to GCS directly")
+	flag.DurationVar(&config.SpoolRetryInterval, "spool_retry_interval", defaultSpoolRetryInterval, "time between two tries to forward the spooled uploads while GCS is unreachable")
+	flag.StringVar(&config.HmacPolicy, "hmac_signed_requests", defaultHmacPolicy, "what to do with XML API requests signed with an HMAC key that the proxy has to change: resign (with -hmac_keys_file), reject with 403, or bypass and send them unencrypted")
+	flag.StringVar(&config.HmacKeysFile, "hmac_keys_file", defaultHmacKeysFile, "JSON file of HMAC access ids to their secrets, to re-sign the requests the proxy changes")
+	flag.StringVar(&config.backendsString, "backends", defaultBackendsString, "object stores besides GCS to encrypt the mapped buckets of, `s3,azure`. their buckets are mapped as s3/BUCKET and azure/ACCOUNT/CONTAINER")
+	flag.BoolVar(&config.ClientShims, "client_shims", defaultClientShims, "work around the client quirks the proxy can't encrypt as they are: refuse gsutil and gcloud parallel composite uploads to encrypted buckets and collect the chunks of Java SDK resumable uploads")
+	flag.StringVar(&config.UpgradeSocket, "upgrade_socket", defaultUpgradeSocket, "unix socket a new proxy process started with -upgrade takes over the listening sockets on, e.g. /run/gcsproxy/upgrade.sock. disabled when empty")
+	flag.BoolVar(&config.Upgrade, "upgrade", defaultUpgrade, "take over the listening sockets of the proxy serving -upgrade_socket, which drains its connections and exits")
+	flag.DurationVar(&config.UpgradeDrainTimeout, "upgrade_drain_timeout", defaultUpgradeDrainTimeout, "how long the old process of an upgrade serves its open connections before it exits")
 	flag.Parse()
+	if err := applyConfigFile(config.ConfigFile, config.Profile); err != nil {
+		log.Fatal(err)
+	}
+	config.ListenAddrs = getListenAddrs(config.Addr)
+	config.CseKeyMetadata = getList(config.cseKeyMetadataString)
+	config.DedupBuckets = getList(config.dedupBucketsString)
+	config.MetadataShimScopes = getList(config.metadataShimScopesString)
+	config.MetadataShimClients = getList(config.metadataShimClientsString)
+	config.Backends = getList(config.backendsString)
+	config.InitBuckets = getList(config.initBucketsString)
+	config.LogSampleRates = getCategoryRates(config.logSampleRatesString)
+	config.LogRateLimits = getCategoryRates(config.logRateLimitsString)
+	config.CloudMonitoringLabels = getLabels(config.cloudMonitoringLabelsString)
 	config.KmsBucketKeyMapping = getBucketKeyMappings(config.kmsBucketKeyMappingString)
+	config.KmsFallbackKeys = getBucketLists(config.kmsFallbackKeysString)
+	config.EncryptContentTypes = getBucketLists(config.encryptContentTypesString)
+	config.SkipContentTypes = getBucketLists(config.skipContentTypesString)
+	config.EncryptMinSizes = getBucketSizes(config.encryptMinSizesString)
+	config.EncryptMaxSizes = getBucketSizes(config.encryptMaxSizesString)
+	config.MaxObjectSizes = getBucketSizes(config.maxObjectSizesString)
+	config.ChunkSizes = getBucketSizes(config.chunkSizesString)
+	config.KmsProjectQps = getProjectRates(config.kmsProjectQpsString)
+	config.DecryptClients = getBucketLists(config.decryptClientsString)
+	config.OverrideClients = getBucketLists(config.overrideClientsString)
+	config.ResponseHeaders = getBucketLists(config.responseHeadersString)
+	config.MirrorBuckets = getBucketKeyMappings(config.mirrorBucketsString)
+	config.EnvelopeFormats = getBucketKeyMappings(config.envelopeFormatsString)
+	config.HybridKeysets = getBucketKeyMappings(config.hybridKeysetsString)
+	if config.KmsMappingDir != "" {
+		mappings, err := ReadMappingDir(config.KmsMappingDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config = config.WithMappingDir(mappings)
+	}
 	config.GCSProxyVersion = "0.3"
-	GlobalConfig = config
+	Runtime.Store(config)
 	return config
 }
 
@@ -90,6 +565,154 @@ func getBucketKeyMappings(bucketKeyMapString string) map[string]string {
 
 }
 
+// Parsing "kek-uri,encryption-kek"
+func getList(listString string) []string {
+	var list []string
+	for _, entry := range strings.Split(listString, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// Parsing ":9080,[::1]:9080,unix:///run/gcsproxy/proxy.sock"
+func getListenAddrs(addrsString string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(addrsString, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return []string{":9080"}
+	}
+	return addrs
+}
+
+// Parsing "env=prod,service.namespace=storage"
+func getLabels(labelsString string) map[string]string {
+	if labelsString == "" {
+		return nil
+	}
+
+	labels := make(map[string]string)
+	for _, entry := range strings.Split(labelsString, ",") {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			log.Errorf("ignoring invalid label %q", entry)
+			continue
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return labels
+}
+
+// Parsing "debug=0.01,decrypt=10"
+func getCategoryRates(ratesString string) map[string]float64 {
+	if ratesString == "" {
+		return nil
+	}
+
+	rates := make(map[string]float64)
+	for key, value := range getLabels(ratesString) {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 {
+			log.Errorf("ignoring invalid rate %q of %v", value, key)
+			continue
+		}
+		rates[key] = rate
+	}
+	return rates
+}
+
+// Parsing "bucket:key1|key2,bucket2:key3" or "bucket:video/*|audio/*"
+func getBucketLists(listsString string) map[string][]string {
+	if listsString == "" {
+		return nil
+	}
+
+	lists := make(map[string][]string)
+	for _, entry := range strings.Split(listsString, ",") {
+		bucketValues := strings.SplitN(entry, ":", 2)
+		if len(bucketValues) != 2 {
+			log.Errorf("ignoring invalid entry %q", entry)
+			continue
+		}
+		lists[bucketValues[0]] = append(lists[bucketValues[0]], strings.Split(bucketValues[1], "|")...)
+	}
+
+	log.Debugf("BucketLists: %v", lists)
+	return lists
+}
+
+// Parsing "bucket:1,*:50GiB"
+func getBucketSizes(sizesString string) map[string]int64 {
+	if sizesString == "" {
+		return nil
+	}
+
+	sizes := make(map[string]int64)
+	for _, entry := range strings.Split(sizesString, ",") {
+		bucket, sizeString, ok := strings.Cut(entry, ":")
+		size, err := parseSize(sizeString)
+		if !ok || err != nil {
+			log.Errorf("ignoring invalid size entry %q", entry)
+			continue
+		}
+		sizes[bucket] = size
+	}
+
+	log.Debugf("BucketSizes: %v", sizes)
+	return sizes
+}
+
+// Parsing "project-a:100,project-b:2.5"
+func getProjectRates(ratesString string) map[string]float64 {
+	if ratesString == "" {
+		return nil
+	}
+
+	rates := make(map[string]float64)
+	for _, entry := range strings.Split(ratesString, ",") {
+		project, rateString, ok := strings.Cut(entry, ":")
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rateString), 64)
+		if !ok || err != nil || rate <= 0 {
+			log.Errorf("ignoring invalid rate entry %q", entry)
+			continue
+		}
+		rates[strings.TrimSpace(project)] = rate
+	}
+
+	log.Debugf("ProjectRates: %v", rates)
+	return rates
+}
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12}, {"B", 1},
+}
+
+// Parsing "1048576", "512KiB" or "50GB"
+func parseSize(sizeString string) (int64, error) {
+	sizeString = strings.TrimSpace(sizeString)
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if number, ok := strings.CutSuffix(sizeString, u.suffix); ok {
+			sizeString, unit = strings.TrimSpace(number), u.bytes
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(sizeString, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", sizeString)
+	}
+	return int64(size * float64(unit)), nil
+}
+
 func isEncryptDisabled() bool {
 	if os.Getenv("GCS_PROXY_DISABLE_ENCRYPTION") == "" {
 		return false
@@ -120,3 +743,19 @@ func envConfigIntWithDefault(key string, defValue int) int {
 	}
 	return defValue
 }
+
+func envConfigFloatWithDefault(key string, defValue float64) float64 {
+	envVar, floatError := strconv.ParseFloat(os.Getenv(key), 64)
+	if floatError == nil {
+		return envVar
+	}
+	return defValue
+}
+
+func envConfigDurationWithDefault(key string, defValue time.Duration) time.Duration {
+	envVar, durationError := time.ParseDuration(os.Getenv(key))
+	if durationError == nil {
+		return envVar
+	}
+	return defValue
+}
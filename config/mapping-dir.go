@@ -0,0 +1,90 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package cfg
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+The -kms_mapping_dir holds one file per bucket, named after the bucket. The file holds the key of
+the bucket and optionally its envelope format, lines starting with # are comments:
+
+	$ cat /etc/gcsproxy/mappings/payments-data
+	projects/p/locations/us/keyRings/r/cryptoKeys/k csek
+
+That is how Kubernetes projects a ConfigMap with one key per bucket as a volume, so a fleet's
+mappings are managed as a ConfigMap instead of one -kms_bucket_key_mappings string. The names
+starting with a dot are skipped, Kubernetes keeps the versions of the projection there (..data,
+..2025_01_02_...). The buckets of the directory win over -kms_bucket_key_mappings and
+-envelope_formats.
+*/
+
+// BucketMapping is the key and envelope format a file of -kms_mapping_dir maps its bucket to
+type BucketMapping struct {
+	Key    string
+	Format string // empty for the format of -envelope_formats
+}
+
+// ReadMappingDir returns the mappings of the files of dir by bucket
+func ReadMappingDir(dir string) (map[string]BucketMapping, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read mapping directory: %v", err)
+	}
+	mappings := map[string]BucketMapping{}
+	for _, entry := range entries {
+		bucket := entry.Name()
+		if strings.HasPrefix(bucket, ".") {
+			continue
+		}
+		path := filepath.Join(dir, bucket)
+		// ConfigMap projections are symlinks to the files
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read mapping of bucket %v: %v", bucket, err)
+		}
+		var fields []string
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				fields = append(fields, strings.Fields(line)...)
+			}
+		}
+		if len(fields) == 0 || len(fields) > 2 || !strings.HasPrefix(fields[0], "projects/") {
+			return nil, fmt.Errorf("invalid mapping of bucket %v in %v: expected `KEY [FORMAT]`", bucket, path)
+		}
+		mapping := BucketMapping{Key: fields[0]}
+		if len(fields) == 2 {
+			mapping.Format = fields[1]
+		}
+		mappings[bucket] = mapping
+	}
+	return mappings, nil
+}
+
+// WithMappingDir returns a copy of c whose keys and envelope formats are those of the flags with
+// mappings, read by ReadMappingDir, laid over them
+func (c *Config) WithMappingDir(mappings map[string]BucketMapping) *Config {
+	config := *c
+	config.KmsBucketKeyMapping = map[string]string{}
+	maps.Copy(config.KmsBucketKeyMapping, getBucketKeyMappings(c.kmsBucketKeyMappingString))
+	config.EnvelopeFormats = map[string]string{}
+	maps.Copy(config.EnvelopeFormats, getBucketKeyMappings(c.envelopeFormatsString))
+	for bucket, mapping := range mappings {
+		config.KmsBucketKeyMapping[bucket] = mapping.Key
+		if mapping.Format != "" {
+			config.EnvelopeFormats[bucket] = mapping.Format
+		}
+	}
+	return &config
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package cfg
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+)
+
+/*
+The -config_file is a JSON document of flag values, so one artifact can be promoted from dev to
+staging to prod with only -profile changing:
+
+	{
+	  "settings": {"metadata_prefix": "gcsproxy-", "key_check_interval": "1m"},
+	  "profiles": {
+	    "dev":  {"kms_bucket_key_mappings": "dev-data:projects/dev/...", "debug": 1},
+	    "prod": {"kms_bucket_key_mappings": "prod-data:projects/prod/...", "key_failure_policy": "reject"}
+	  }
+	}
+
+The settings apply to every profile, the selected profile overrides them. Values are strings,
+numbers or booleans, parsed like the flag of the same name. A flag given on the command line wins
+over the file, the file wins over the environment variables and the defaults. A file defining
+profiles can't be used without selecting one, so a proxy never starts with a mix of environments.
+*/
+
+// configFile is the document of -config_file, values by flag name
+type configFile struct {
+	Settings map[string]any            `json:"settings"`
+	Profiles map[string]map[string]any `json:"profiles"`
+}
+
+// unsetFlags select the file and the profile, the file can't set them
+var unsetFlags = []string{"config_file", "profile", "version"}
+
+// applyConfigFile sets the flags of profile in the config file at path that the command line did
+// not set
+func applyConfigFile(path string, profile string) error {
+	if path == "" {
+		if profile != "" {
+			return fmt.Errorf("-profile %v needs -config_file", profile)
+		}
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	var file configFile
+	if err := decoder.Decode(&file); err != nil {
+		return fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+
+	settings := map[string]any{}
+	maps.Copy(settings, file.Settings)
+	if profile != "" {
+		values, ok := file.Profiles[profile]
+		if !ok {
+			return fmt.Errorf("config file %v has no profile %q, expected one of %v", path, profile, slices.Sorted(maps.Keys(file.Profiles)))
+		}
+		maps.Copy(settings, values)
+	} else if len(file.Profiles) > 0 {
+		return fmt.Errorf("config file %v defines the profiles %v, select one with -profile", path, slices.Sorted(maps.Keys(file.Profiles)))
+	}
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		if slices.Contains(unsetFlags, name) || flag.Lookup(name) == nil {
+			return fmt.Errorf("config file %v: unknown setting %q", path, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		var value string
+		switch v := settings[name].(type) {
+		case string:
+			value = v
+		case json.Number, bool:
+			value = fmt.Sprint(v)
+		default:
+			return fmt.Errorf("config file %v: %v must be a string, a number or a boolean", path, name)
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("config file %v: invalid %v: %v", path, name, err)
+		}
+	}
+	return nil
+}
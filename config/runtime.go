@@ -0,0 +1,81 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package cfg
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+/*
+The configuration in use is a *Config that is never modified once stored: a reload stores a
+new one as a whole, so a reader sees either the old or the new configuration, not a mix. The
+interceptor binds the configuration in use to every flow when its request arrives, the handlers
+read it back with For and one flow is handled with one configuration from start to end.
+
+The background work that belongs to no flow, e.g. the mirror workers or the canary, reads
+Current each time.
+*/
+
+// Provider supplies the configuration in use
+type Provider interface {
+	Config() *Config
+}
+
+// RuntimeConfig is a Provider whose configuration is swapped atomically
+type RuntimeConfig struct {
+	current atomic.Pointer[Config]
+}
+
+// NewRuntimeConfig returns a RuntimeConfig using config
+func NewRuntimeConfig(config *Config) *RuntimeConfig {
+	r := &RuntimeConfig{}
+	r.Store(config)
+	return r
+}
+
+// Config returns the configuration in use, nil before one was stored. Don't modify it
+func (r *RuntimeConfig) Config() *Config {
+	return r.current.Load()
+}
+
+// Store replaces the configuration in use, the flows already bound keep theirs
+func (r *RuntimeConfig) Store(config *Config) {
+	r.current.Store(config)
+}
+
+// Runtime is the configuration of the process, stored by LoadConfig and interceptor.Configure
+var Runtime = &RuntimeConfig{}
+
+// Current returns the configuration of the process, nil before it was loaded
+func Current() *Config {
+	return Runtime.Config()
+}
+
+var flows sync.Map // flow id -> *Config
+
+// Bind records the configuration f is handled with
+func Bind(f *proxy.Flow, config *Config) {
+	flows.Store(f.Id, config)
+}
+
+// For returns the configuration f is handled with, the process configuration in use when f is
+// not bound
+func For(f *proxy.Flow) *Config {
+	if f != nil {
+		if config, ok := flows.Load(f.Id); ok {
+			return config.(*Config)
+		}
+	}
+	return Current()
+}
+
+// Unbind drops the configuration of a finished flow
+func Unbind(f *proxy.Flow) {
+	flows.Delete(f.Id)
+}
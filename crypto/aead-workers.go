@@ -0,0 +1,111 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/tink/go/tink"
+	"go.opentelemetry.io/otel/metric"
+)
+
+/*
+Encrypting and decrypting payloads is CPU bound. Run on the goroutines of their requests, large
+AES-GCM operations take the CPUs from the network I/O of every other request and the latency of
+small requests suffers under mixed load. The AEAD operations run on a bounded set of workers
+instead, AeadWorkers at once, and the others queue for a worker in the order they arrive.
+
+A worker that waits on KMS to wrap or unwrap a data encryption key hands its slot to the next
+operation meanwhile, the workers only bound the CPU work.
+*/
+
+// AeadWorkers is how many AEAD operations run at once, GOMAXPROCS when 0. Set by the binary
+// before the first operation.
+var AeadWorkers int
+
+// AeadQueueTime records how long the AEAD operations waited for a worker in seconds, set up by the
+// binary when metrics are exported.
+var AeadQueueTime metric.Float64Histogram
+
+var (
+	workersOnce sync.Once
+	workerSlots chan struct{}
+	aeadQueued  atomic.Int64
+)
+
+// QueuedAeadOperations returns the number of AEAD operations waiting for a worker.
+func QueuedAeadOperations() int64 {
+	return aeadQueued.Load()
+}
+
+func slots() chan struct{} {
+	workersOnce.Do(func() {
+		workers := AeadWorkers
+		if workers <= 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		workerSlots = make(chan struct{}, workers)
+	})
+	return workerSlots
+}
+
+// acquireWorker waits for a free worker, unless ctx is done first
+func acquireWorker(ctx context.Context) error {
+	select {
+	case slots() <- struct{}{}:
+		return nil
+	default:
+	}
+
+	aeadQueued.Add(1)
+	defer aeadQueued.Add(-1)
+	start := time.Now()
+	select {
+	case slots() <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if AeadQueueTime != nil {
+		AeadQueueTime.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(metricAttributes(ctx)...))
+	}
+	return nil
+}
+
+func releaseWorker() {
+	<-slots()
+}
+
+// onWorker runs operation on a worker. The calls of remote within it give the worker up until KMS
+// answered, operation must use the AEAD it is passed instead of remote.
+func onWorker(ctx context.Context, remote tink.AEAD, operation func(remote tink.AEAD) error) error {
+	if err := acquireWorker(ctx); err != nil {
+		return err
+	}
+	defer releaseWorker()
+	return operation(&offWorkerAEAD{remote: remote, ctx: ctx})
+}
+
+// offWorkerAEAD gives up the worker of its operation while the remote AEAD it wraps is called
+type offWorkerAEAD struct {
+	remote tink.AEAD
+	ctx    context.Context
+}
+
+func (a *offWorkerAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	releaseWorker()
+	defer acquireWorker(context.WithoutCancel(a.ctx))
+	return a.remote.Encrypt(plaintext, associatedData)
+}
+
+func (a *offWorkerAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	releaseWorker()
+	defer acquireWorker(context.WithoutCancel(a.ctx))
+	return a.remote.Decrypt(ciphertext, associatedData)
+}
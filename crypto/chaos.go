@@ -0,0 +1,78 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// KmsFaults describes the failures InjectKmsFaults adds to KMS calls. Rates are between 0 and 1.
+type KmsFaults struct {
+	Latency     time.Duration // added to a call
+	LatencyRate float64       // share of calls that get Latency
+	ErrorRate   float64       // share of calls that fail as if KMS was unavailable
+}
+
+func (f KmsFaults) Enabled() bool {
+	return (f.Latency > 0 && f.LatencyRate > 0) || f.ErrorRate > 0
+}
+
+/*
+InjectKmsFaults makes KMS encrypt and decrypt calls slow or fail at the given rates, so
+applications can be tested against a degraded proxy. Injected failures are classified like
+a real outage, KMS_UNAVAILABLE answered with 503. Never use it in production.
+*/
+func InjectKmsFaults(faults KmsFaults) {
+	create := newRemoteAEAD
+	newRemoteAEAD = func(ctx context.Context, keyName string) (remoteAEAD, error) {
+		a, err := create(ctx, keyName)
+		if err != nil {
+			return nil, err
+		}
+		return &faultyAEAD{remoteAEAD: a, keyName: keyName, faults: faults}, nil
+	}
+}
+
+type faultyAEAD struct {
+	remoteAEAD
+	keyName string
+	faults  KmsFaults
+}
+
+func (a *faultyAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	if err := a.inject("encrypt"); err != nil {
+		return nil, err
+	}
+	return a.remoteAEAD.Encrypt(plaintext, associatedData)
+}
+
+func (a *faultyAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	if err := a.inject("decrypt"); err != nil {
+		return nil, err
+	}
+	return a.remoteAEAD.Decrypt(ciphertext, associatedData)
+}
+
+func (a *faultyAEAD) inject(operation string) error {
+	if a.faults.Latency > 0 && rand.Float64() < a.faults.LatencyRate {
+		log.Warnf("chaos: delaying KMS %v with %v by %v", operation, a.keyName, a.faults.Latency)
+		time.Sleep(a.faults.Latency)
+	}
+	if rand.Float64() < a.faults.ErrorRate {
+		log.Warnf("chaos: failing KMS %v with %v", operation, a.keyName)
+		return classifyKmsError(a.keyName, &googleapi.Error{
+			Code:    http.StatusServiceUnavailable,
+			Message: "injected by gcs-proxy chaos mode",
+		})
+	}
+	return nil
+}
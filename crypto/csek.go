@@ -0,0 +1,75 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"google.golang.org/api/cloudkms/v1"
+)
+
+/*
+	The csek envelope format leaves the payload alone and has GCS encrypt it with a
+	customer-supplied encryption key (CSEK). The key of gs://bucket/object is the HMAC-SHA256 of
+	the object URL computed by a Cloud KMS MAC key version, so it never needs to be stored:
+	anyone allowed to use the MAC key can derive it again and read the object with any CSEK
+	capable tool, for example gcloud storage --decryption-keys.
+*/
+
+// DeriveCsekKey returns the 256 bit CSEK of gs://bucket/object. macKeyVersion is a HMAC_SHA256
+// KMS key version in the format:
+// projects/<projectname>/locations/<location>/keyRings/<key-ring>/cryptoKeys/<key>/cryptoKeyVersions/1
+func DeriveCsekKey(ctx context.Context, macKeyVersion string, bucketName string, objectName string) ([]byte, error) {
+	data := fmt.Sprintf("gs://%v/%v", bucketName, objectName)
+	if local != nil {
+		return local.mac(macKeyVersion, []byte(data))
+	}
+
+	kmsService, err := kmsService(ctx, macKeyVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create KMS client: %v", err)
+	}
+	if err := waitKmsQuota(ctx, macKeyVersion); err != nil {
+		return nil, err
+	}
+
+	req := &cloudkms.MacSignRequest{Data: base64.StdEncoding.EncodeToString([]byte(data))}
+	resp, err := kmsService.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.MacSign(macKeyVersion, req).Context(ctx).Do()
+	if err != nil {
+		kmsErr := classifyKmsError(macKeyVersion, err)
+		recordKmsError(ctx, "mac", kmsErr)
+		recordKmsRequest(ctx, macKeyVersion, "mac", kmsErr)
+		return nil, fmt.Errorf("error deriving CSEK: %w", kmsErr)
+	}
+	recordKmsRequest(ctx, macKeyVersion, "mac", nil)
+
+	key, err := base64.StdEncoding.DecodeString(resp.Mac)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding MAC: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%v is not a HMAC_SHA256 key, got a %v byte MAC", macKeyVersion, len(key))
+	}
+	return key, nil
+}
+
+// CsekHeaders returns the request headers that make GCS encrypt or decrypt with key.
+// The copy source variant is used for the object read by a rewrite or copy.
+func CsekHeaders(key []byte, copySource bool) map[string]string {
+	prefix := "X-Goog-Encryption-"
+	if copySource {
+		prefix = "X-Goog-Copy-Source-Encryption-"
+	}
+	keyHash := sha256.Sum256(key)
+	return map[string]string{
+		prefix + "Algorithm":  "AES256",
+		prefix + "Key":        base64.StdEncoding.EncodeToString(key),
+		prefix + "Key-Sha256": base64.StdEncoding.EncodeToString(keyHash[:]),
+	}
+}
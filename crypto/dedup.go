@@ -0,0 +1,164 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+/*
+For the buckets of DedupBuckets a plaintext encrypted again within DedupTTL gets the ciphertext of
+the first encryption, DEK included, instead of a new DEK, KMS call and AES pass: repeated uploads
+of container layers or build artifacts cost neither CPU nor KMS. The ciphertexts are kept in
+memory, the least recently used are dropped beyond DedupMaxBytes.
+
+This gives up a property of the envelope encryption: anyone who can read the bucket sees which
+objects have the same content, and a DEK protects every copy. Disabling the KMS key stops the
+reuse once the TTL ended, not immediately.
+
+Client libraries retry the uploads that failed or timed out, and may retry one that reached GCS.
+A retry encrypted with a new DEK stores a ciphertext with other hashes than the first attempt,
+so the objects of one logical upload differ and transfer and verification tools see a change.
+The uploads made with WithRetryScope are retries of one another when they share the scope, which
+names the object and the upload session of the client, and write the same plaintext within
+RetryTTL: they get the ciphertext of the first attempt in every bucket. The digest of the plaintext
+only guards against a session that sends another payload. That tells readers no more than that an
+object was written twice with the same content.
+*/
+
+// DedupBuckets are the buckets whose identical plaintexts share their ciphertext. Set by the binary.
+var DedupBuckets []string
+
+// DedupTTL is how long a ciphertext is reused after its encryption, 0 disables the reuse
+var DedupTTL time.Duration
+
+// DedupMaxBytes is the memory of the reused ciphertexts
+var DedupMaxBytes int64
+
+// RetryTTL is how long the ciphertext of an upload is reused for its retries, 0, the default,
+// disables the reuse
+var RetryTTL time.Duration
+
+// DedupHits counts the encryptions answered with a reused ciphertext
+var DedupHits metric.Int64Counter
+
+// dedupScope identifies a plaintext encrypted for a bucket, key and credentials by the digest of
+// the plaintext and its envelope header, and for the retries of an upload its retry scope
+type dedupScope struct {
+	keyName     string
+	bucket      string
+	credentials string
+	retry       string // of WithRetryScope, "" across the objects of DedupBuckets
+	digest      [sha256.Size]byte
+}
+
+// WithRetryScope makes the encryptions with ctx reuse the ciphertext of the same plaintext
+// encrypted in the same scope within RetryTTL, scope names the object and the upload session, e.g.
+// bucket/name@resumable:ID
+func WithRetryScope(ctx context.Context, scope string) context.Context {
+	return context.WithValue(ctx, retryScopeKey, scope)
+}
+
+type dedupEntry struct {
+	scope      dedupScope
+	ciphertext []byte
+	keyVersion string
+	expires    time.Time
+}
+
+var (
+	dedupMu      sync.Mutex
+	dedupEntries = map[dedupScope]*list.Element{}
+	dedupOrder   = list.New() // of *dedupEntry, the most recently used first
+	dedupBytes   int64
+)
+
+// dedupScopeOf returns the scope of plaintext encrypted with ctx, false when neither its bucket
+// nor its retries reuse ciphertexts
+func dedupScopeOf(ctx context.Context, keyName string, header []byte, plaintext []byte) (dedupScope, bool) {
+	bucket, _ := ctx.Value(bucketKey).(string)
+	retry, _ := ctx.Value(retryScopeKey).(string)
+	noCache, _ := ctx.Value(noKekCacheKey).(bool)
+	dedup := DedupTTL > 0 && slices.Contains(DedupBuckets, bucket)
+	if !dedup && (RetryTTL <= 0 || retry == "") {
+		return dedupScope{}, false
+	}
+	if noCache || int64(len(plaintext)) > DedupMaxBytes {
+		return dedupScope{}, false
+	}
+	scope := dedupScope{keyName: keyName, bucket: bucket}
+	if !dedup {
+		scope.retry = retry
+	}
+	scope.credentials, _ = ctx.Value(credentialsFileKey).(string)
+	digest := sha256.New()
+	digest.Write(header)
+	digest.Write(plaintext)
+	digest.Sum(scope.digest[:0])
+	return scope, true
+}
+
+// reusedCiphertext returns the ciphertext and key version of scope while they are reused
+func reusedCiphertext(ctx context.Context, scope dedupScope) ([]byte, string, bool) {
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+	element, ok := dedupEntries[scope]
+	if !ok {
+		return nil, "", false
+	}
+	entry := element.Value.(*dedupEntry)
+	if time.Now().After(entry.expires) {
+		dropDedupEntry(element)
+		return nil, "", false
+	}
+	dedupOrder.MoveToFront(element)
+	if DedupHits != nil {
+		DedupHits.Add(ctx, 1, metric.WithAttributes(metricAttributes(ctx, attribute.String("bucket", scope.bucket))...))
+	}
+	if scope.retry != "" {
+		log.Debugf("reusing the ciphertext of the first attempt of an upload to %v", scope.retry)
+	} else {
+		log.Debugf("reusing the ciphertext of an identical upload to %v", scope.bucket)
+	}
+	return bytes.Clone(entry.ciphertext), entry.keyVersion, true
+}
+
+// keepCiphertext reuses ciphertext for scope for DedupTTL, RetryTTL for the retries of an upload
+func keepCiphertext(scope dedupScope, ciphertext []byte, keyVersion string) {
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+	if element, ok := dedupEntries[scope]; ok {
+		// encrypted twice at once, the first one stays
+		dedupOrder.MoveToFront(element)
+		return
+	}
+	ttl := DedupTTL
+	if scope.retry != "" {
+		ttl = RetryTTL
+	}
+	entry := &dedupEntry{scope: scope, ciphertext: bytes.Clone(ciphertext), keyVersion: keyVersion, expires: time.Now().Add(ttl)}
+	dedupEntries[scope] = dedupOrder.PushFront(entry)
+	dedupBytes += int64(len(entry.ciphertext))
+	for dedupBytes > DedupMaxBytes {
+		dropDedupEntry(dedupOrder.Back())
+	}
+}
+
+func dropDedupEntry(element *list.Element) {
+	entry := dedupOrder.Remove(element).(*dedupEntry)
+	delete(dedupEntries, entry.scope)
+	dedupBytes -= int64(len(entry.ciphertext))
+}
@@ -9,13 +9,14 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
-	"os"
+	"hash/crc32"
 	"time"
 
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
 	"github.com/google/tink/go/aead"
-	"github.com/google/tink/go/core/registry"
-	"github.com/google/tink/go/integration/gcpkms"
+	"github.com/google/tink/go/tink"
 	log "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -25,10 +26,10 @@ import (
 const scopeName = "github.com/byronwhitlock-google/go-gcsproxy"
 
 var (
-	otelEnabled = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
 	Meter       = otel.Meter(scopeName)
 	EncryptTime metric.Float64Gauge
 	DecryptTime metric.Float64Gauge
+	KmsErrors   metric.Int64Counter
 )
 
 func Base64MD5Hash(byteStream []byte) string {
@@ -50,52 +51,132 @@ func Base64MD5Hash(byteStream []byte) string {
 	return base64MD5Hash
 }
 
+// Base64Crc32cHash returns the CRC32C (Castagnoli) checksum of byteStream in the
+// big-endian base64 format GCS uses for the crc32c object field and x-goog-hash header.
+func Base64Crc32cHash(byteStream []byte) string {
+	checksum := crc32.Checksum(byteStream, crc32.MakeTable(crc32.Castagnoli))
+	encoded := make([]byte, 4)
+	binary.BigEndian.PutUint32(encoded, checksum)
+	return base64.StdEncoding.EncodeToString(encoded)
+}
+
 // Encrypt bytes with KMS key referenced by resourceName in the format:
 // projects/<projectname>/locations/<location>/keyRings/<project>/cryptoKeys/<key-ring>/cryptoKeyVersions/1
 func EncryptBytes(ctx context.Context, resourceName string, bytesToEncrypt []byte) ([]byte, error) {
+	encryptedBytes, _, err := EncryptBytesWithKeyVersion(ctx, resourceName, bytesToEncrypt)
+	return encryptedBytes, err
+}
+
+// EncryptBytesWithKeyVersion encrypts like EncryptBytes and also returns the KMS key version
+// that wrapped the data encryption key, e.g.
+// projects/<projectname>/locations/<location>/keyRings/<key-ring>/cryptoKeys/<key>/cryptoKeyVersions/3
+func EncryptBytesWithKeyVersion(ctx context.Context, resourceName string, bytesToEncrypt []byte) ([]byte, string, error) {
 	// Capture the encryption latency
 	latencyStart := time.Now()
 
-	// Construct the full key URI for Google Cloud KMS
-	//projects/<projectname>/locations/<location>/keyRings/<project>/cryptoKeys/<key-ring>/cryptoKeyVersions/1
-	keyURI := fmt.Sprintf("gcp-kms://%s", resourceName)
-
-	// Create a KMS client
-	kmsClient, err := gcpkms.NewClientWithOptions(ctx, keyURI)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create KMS client: %v", err)
-	}
-
 	// Create a KMS AEAD client
-	kmsAEAD, err := kmsClient.GetAEAD(keyURI)
+	kmsAEAD, err := remoteKey(ctx, resourceName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create KMS AEAD client: %v", err)
+		return nil, "", fmt.Errorf("failed to create KMS AEAD client: %v", err)
 	}
-
-	// 2. Register the KMS AEAD primitive wrapper.
-	registry.RegisterKMSClient(kmsClient)
-
-	// 3. Create the KMS-backed envelope AEAD.
-	envAEAD := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), kmsAEAD)
-	if envAEAD == nil {
-		return nil, fmt.Errorf("failed to create KMS AEAD envelope: %v", err)
+	chunkSize, _ := ctx.Value(chunkSizeKey).(uint32)
+	header := envelope.NewChunkedHeader(len(bytesToEncrypt), chunkSize)
+	var remote tink.AEAD = kmsAEAD
+	if EscrowKeyName != "" {
+		escrowKmsAEAD, err := remoteKey(ctx, EscrowKeyName)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create escrow KMS AEAD client: %v", err)
+		}
+		remote = &escrowAEAD{primary: kmsAEAD, escrow: escrowKmsAEAD}
+		header.Flags |= envelope.FlagEscrow
 	}
-
-	// Encrypt the bytes
-	aad := []byte("")
-	encryptedBytes, err := envAEAD.Encrypt(bytesToEncrypt, aad)
+	b, _ := ctx.Value(bindingKey).(binding)
+	header.Flags |= b.flags
+
+	// Encrypt the bytes. the envelope header and binding are authenticated as associated data
+	headerBytes := header.Marshal()
+	associatedData := append(append([]byte(nil), headerBytes...), b.associatedData...)
+	scope, dedup := dedupScopeOf(ctx, resourceName, associatedData, bytesToEncrypt)
+	if dedup {
+		if encryptedBytes, keyVersion, ok := reusedCiphertext(ctx, scope); ok {
+			return encryptedBytes, keyVersion, nil
+		}
+	}
+	var ciphertext []byte
+	err = onWorker(ctx, remote, func(remote tink.AEAD) error {
+		if header.ChunkSize != 0 {
+			ciphertext, err = envelope.EncryptChunked(remote, header, bytesToEncrypt, b.associatedData)
+			if err == nil {
+				ciphertext = ciphertext[envelope.HeaderSize:]
+			}
+			return err
+		}
+		// Create the KMS-backed envelope AEAD.
+		envAEAD := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), remote)
+		if envAEAD == nil {
+			return fmt.Errorf("failed to create KMS AEAD envelope")
+		}
+		ciphertext, err = envAEAD.Encrypt(bytesToEncrypt, associatedData)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error encrypting data: %v", err)
+		recordKmsError(ctx, "encrypt", err)
+		return nil, "", fmt.Errorf("error encrypting data: %w", err)
+	}
+	encryptedBytes := append(headerBytes, ciphertext...)
+	if dedup {
+		keepCiphertext(scope, encryptedBytes, kmsAEAD.KeyVersion())
 	}
 
 	elapsed := time.Since(latencyStart).Seconds()
 	requestId, ok := ctx.Value("requestid").(string)
-	if otelEnabled != "" && ok {
+	if EncryptTime != nil && ok {
 		metricAttribute := attribute.String("gcsproxy-request-id", requestId)
-		EncryptTime.Record(ctx, elapsed, metric.WithAttributes(metricAttribute))
+		EncryptTime.Record(ctx, elapsed, metric.WithAttributes(metricAttributes(ctx, metricAttribute)...))
+	}
+
+	return encryptedBytes, kmsAEAD.KeyVersion(), nil
+}
+
+// WithChunkSize makes the encryptions with ctx split plaintexts into chunks of chunkSize bytes,
+// each encrypted on its own, see the envelope package. 0 encrypts them as one chunk.
+func WithChunkSize(ctx context.Context, chunkSize uint32) context.Context {
+	if chunkSize == 0 {
+		return ctx
 	}
+	return context.WithValue(ctx, chunkSizeKey, chunkSize)
+}
 
-	return encryptedBytes, nil
+// binding is authenticated after the envelope header of the encryptions of a context
+type binding struct {
+	flags          uint8
+	associatedData []byte
+}
+
+// WithPart makes the encryptions with ctx parts partNumber of the XML multipart upload uploadID,
+// read back in the order of the manifest sealed by SealPartManifest.
+func WithPart(ctx context.Context, uploadID string, partNumber int) context.Context {
+	return context.WithValue(ctx, bindingKey, binding{envelope.FlagPart, envelope.PartAssociatedData(uploadID, partNumber)})
+}
+
+// SealPartManifest encrypts the manifest of an XML multipart upload with the KMS key of its parts,
+// e.g. for the object metadata. DecryptBytes reads the parts with it, see WithPartManifest.
+func SealPartManifest(ctx context.Context, resourceName string, m envelope.PartManifest) ([]byte, error) {
+	encoded, err := m.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, bindingKey, binding{envelope.FlagManifest, envelope.ManifestAssociatedData()})
+	return EncryptBytes(ctx, resourceName, encoded)
+}
+
+// WithPartManifest gives the decryptions with ctx the sealed part manifest recorded with an
+// object, see SealPartManifest. It is needed by the objects of XML multipart uploads only.
+func WithPartManifest(ctx context.Context, manifest []byte) context.Context {
+	if len(manifest) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, partManifestKey, manifest)
 }
 
 // Decrypts bytes with using KMS key referenced by resourceName in the format:
@@ -103,42 +184,68 @@ func EncryptBytes(ctx context.Context, resourceName string, bytesToEncrypt []byt
 func DecryptBytes(ctx context.Context, resourceName string, bytesToDecrypt []byte) ([]byte, error) {
 	// Capture the decryption latency
 	latencyStart := time.Now()
-	// Construct the full key URI for Google Cloud KMS
-	keyURI := fmt.Sprintf("gcp-kms://%s", resourceName)
-
-	// Create a KMS client
-	kmsClient, err := gcpkms.NewClientWithOptions(ctx, keyURI /*, option.WithCredentialsFile("path/to/credentials.json")*/)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create KMS client: %v", err)
-	}
-
-	// Create a KMS AEAD client
-	kmsAEAD, err := kmsClient.GetAEAD(keyURI)
+	// Create a KMS AEAD client. symmetric KMS keys find the key version that wrapped the DEK
+	// themselves, so the key name is enough to decrypt every generation
+	kmsAEAD, err := remoteKey(ctx, resourceName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create KMS AEAD client: %v", err)
 	}
 
-	// Register the KMS AEAD primitive wrapper.
-	registry.RegisterKMSClient(kmsClient)
-
-	// Create the KMS-backed envelope AEAD.
-	envAEAD := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), kmsAEAD)
-	if envAEAD == nil {
-		return nil, fmt.Errorf("failed to create KMS AEAD envelope: %v", err)
-	}
-	// Decrypt bytes with KMS key
-	aad := []byte("")
-	decryptedBytes, err := envAEAD.Decrypt(bytesToDecrypt, aad)
+	var decryptedBytes []byte
+	err = onWorker(ctx, kmsAEAD, func(remote tink.AEAD) error {
+		decryptedBytes, err = envelope.DecryptParts(remote, bytesToDecrypt, partManifest(ctx))
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error encrypting data: %v", err)
+		recordKmsError(ctx, "decrypt", err)
+		return nil, err
 	}
 
 	elapsed := time.Since(latencyStart).Seconds()
 	requestId, ok := ctx.Value("requestid").(string)
-	if otelEnabled != "" && ok {
+	if DecryptTime != nil && ok {
 		metricAttribute := attribute.String("gcsproxy-request-id", requestId)
-		DecryptTime.Record(ctx, elapsed, metric.WithAttributes(metricAttribute))
+		DecryptTime.Record(ctx, elapsed, metric.WithAttributes(metricAttributes(ctx, metricAttribute)...))
 	}
 
 	return decryptedBytes, nil
 }
+
+// DecryptForeignBytes decrypts an object another Tink client wrote with the KMS key resourceName
+// and associatedData, see envelope.DecryptBare
+func DecryptForeignBytes(ctx context.Context, resourceName string, bytesToDecrypt []byte, associatedData []byte) ([]byte, error) {
+	kmsAEAD, err := newRemoteAEAD(ctx, resourceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create KMS AEAD client: %v", err)
+	}
+	var decryptedBytes []byte
+	err = onWorker(ctx, timedAEAD(ctx, kmsAEAD), func(remote tink.AEAD) error {
+		decryptedBytes, err = envelope.DecryptBare(remote, bytesToDecrypt, associatedData)
+		return err
+	})
+	if err != nil {
+		recordKmsError(ctx, "decrypt", err)
+		return nil, err
+	}
+	return decryptedBytes, nil
+}
+
+// RecoverBytes decrypts an object written with escrow enabled using the escrow key instead of
+// the primary key. This is the break-glass path when the primary key is lost or disabled.
+func RecoverBytes(ctx context.Context, escrowKeyName string, bytesToDecrypt []byte) ([]byte, error) {
+	escrowKmsAEAD, err := remoteKey(ctx, escrowKeyName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create escrow KMS AEAD client: %v", err)
+	}
+	var decryptedBytes []byte
+	err = onWorker(ctx, escrowKmsAEAD, func(remote tink.AEAD) error {
+		decryptedBytes, err = envelope.DecryptPartsWithEscrow(remote, bytesToDecrypt, partManifest(ctx))
+		return err
+	})
+	return decryptedBytes, err
+}
+
+func partManifest(ctx context.Context) []byte {
+	manifest, _ := ctx.Value(partManifestKey).([]byte)
+	return manifest
+}
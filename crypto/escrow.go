@@ -0,0 +1,45 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+	"github.com/google/tink/go/tink"
+)
+
+// EscrowKeyName is the KMS key every DEK is additionally wrapped with, empty disables escrow.
+// The proxy only needs encrypt permission on it; decrypting with it is left to the recover tool.
+var EscrowKeyName string
+
+// escrowAEAD is the remote AEAD used for envelopes with envelope.FlagEscrow. It wraps the DEK
+// with both keys and hands Tink one blob, see envelope.JoinWrappedKeys, which Tink stores in
+// place of the single wrapped DEK.
+type escrowAEAD struct {
+	primary remoteAEAD
+	escrow  remoteAEAD
+}
+
+var _ tink.AEAD = (*escrowAEAD)(nil)
+
+func (a *escrowAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	primaryWrapped, err := a.primary.Encrypt(plaintext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	escrowWrapped, err := a.escrow.Encrypt(plaintext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	return envelope.JoinWrappedKeys(primaryWrapped, escrowWrapped), nil
+}
+
+func (a *escrowAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	primaryWrapped, _, err := envelope.SplitWrappedKeys(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return a.primary.Decrypt(primaryWrapped, associatedData)
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"runtime"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/cpu"
+)
+
+// Acceleration reports whether the CPU lets Go's crypto/aes run AES-GCM on hardware
+// instructions. Without them AES-GCM runs in constant time software several times slower, e.g. on
+// ARM instances without the cryptographic extension.
+type Acceleration struct {
+	Arch        string `json:"arch"`
+	AES         bool   `json:"aes"`         // AES round instructions, AES-NI on amd64
+	GHASH       bool   `json:"ghash"`       // carry-less multiplication for the GCM hash, PCLMULQDQ on amd64, PMULL on arm64
+	Accelerated bool   `json:"accelerated"` // AES-GCM runs on the hardware instructions
+}
+
+// HardwareAcceleration detects the AES-GCM acceleration of the CPU, the way crypto/aes does.
+func HardwareAcceleration() Acceleration {
+	a := Acceleration{Arch: runtime.GOARCH}
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		a.AES, a.GHASH = cpu.X86.HasAES, cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		a.AES, a.GHASH = cpu.ARM64.HasAES, cpu.ARM64.HasPMULL
+	case "s390x":
+		a.AES, a.GHASH = cpu.S390X.HasAES, cpu.S390X.HasAESGCM
+	case "ppc64", "ppc64le":
+		// POWER8 and later, which Go requires, have the vector crypto instructions
+		a.AES, a.GHASH = true, true
+	}
+	a.Accelerated = a.AES && a.GHASH && runtime.GOARCH != "386"
+	return a
+}
+
+// LogHardwareAcceleration logs the AES-GCM acceleration of the CPU, a warning when there is none.
+func LogHardwareAcceleration() {
+	a := HardwareAcceleration()
+	if a.Accelerated {
+		log.Infof("AES-GCM runs on hardware instructions (%v)", a.Arch)
+		return
+	}
+	log.Warnf("AES-GCM runs in software on this %v CPU (AES instructions %v, carry-less multiplication %v): encryption and decryption are several times slower, "+
+		"use an instance type whose CPU has AES acceleration", a.Arch, a.AES, a.GHASH)
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/tink/go/hybrid"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+)
+
+/*
+A bucket mapped to hybrid/NAME has the DEKs of its objects wrapped with the HPKE public key of the
+Tink keyset NAME (-hybrid_keysets) instead of a KMS key. Producers at the edge only hold the
+public keyset: they encrypt without KMS access or network, and cannot decrypt what they wrote.
+Central readers hold the same keyset with its private key, encrypted by the KMS key
+-hybrid_keyset_kms_key, and decrypt the objects as usual. The envelope is the same as with KMS
+keys, only its wrapped DEK differs.
+*/
+
+// HybridKeyPrefix starts the mapped key names of the hybrid keysets, e.g. hybrid/edge
+const HybridKeyPrefix = "hybrid/"
+
+// hybridAEAD wraps DEKs with the public key of a hybrid keyset and unwraps them with its private
+// key, when this proxy has it
+type hybridAEAD struct {
+	name       string
+	encrypt    tink.HybridEncrypt
+	decrypt    tink.HybridDecrypt // nil with only the public keyset
+	keyVersion string
+}
+
+var _ remoteAEAD = (*hybridAEAD)(nil)
+
+// hybridKeys are the loaded hybrid keysets by name, set at startup by LoadHybridKeysets
+var hybridKeys = map[string]*hybridAEAD{}
+
+// IsHybridKey reports whether keyName names a hybrid keyset rather than a KMS key
+func IsHybridKey(keyName string) bool {
+	return strings.HasPrefix(keyName, HybridKeyPrefix)
+}
+
+// NewHybridKeyset returns a new HPKE keyset, X25519 with AES-256-GCM
+func NewHybridKeyset() (*keyset.Handle, error) {
+	return keyset.NewHandle(hybrid.DHKEM_X25519_HKDF_SHA256_HKDF_SHA256_AES_256_GCM_Key_Template())
+}
+
+// WriteHybridKeyset writes the private keyset of handle encrypted by the KMS key kmsKeyName to
+// privateFile, and its public keyset to publicFile
+func WriteHybridKeyset(ctx context.Context, handle *keyset.Handle, kmsKeyName string, privateFile string, publicFile string) error {
+	masterKey, err := newRemoteAEAD(ctx, kmsKeyName)
+	if err != nil {
+		return fmt.Errorf("failed to create KMS AEAD client: %v", err)
+	}
+	var private bytes.Buffer
+	if err := handle.Write(keyset.NewJSONWriter(&private), masterKey); err != nil {
+		return fmt.Errorf("unable to encrypt the private keyset: %w", err)
+	}
+	publicHandle, err := handle.Public()
+	if err != nil {
+		return err
+	}
+	var public bytes.Buffer
+	if err := publicHandle.WriteWithNoSecrets(keyset.NewJSONWriter(&public)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(privateFile, private.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(publicFile, public.Bytes(), 0644)
+}
+
+// LoadHybridKeysets reads the Tink keyset files of the hybrid keys by name. Public keysets are
+// read as they are, private keysets must be encrypted by the KMS key kmsKeyName.
+func LoadHybridKeysets(ctx context.Context, files map[string]string, kmsKeyName string) error {
+	keys := map[string]*hybridAEAD{}
+	for name, file := range files {
+		key, err := loadHybridKeyset(ctx, name, file, kmsKeyName)
+		if err != nil {
+			return fmt.Errorf("hybrid keyset %v: %v", name, err)
+		}
+		keys[name] = key
+	}
+	hybridKeys = keys
+	return nil
+}
+
+func loadHybridKeyset(ctx context.Context, name string, file string, kmsKeyName string) (*hybridAEAD, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var encrypted struct {
+		EncryptedKeyset string `json:"encryptedKeyset"`
+	}
+	if err := json.Unmarshal(data, &encrypted); err != nil {
+		return nil, fmt.Errorf("%v is not a Tink JSON keyset: %v", file, err)
+	}
+
+	key := &hybridAEAD{name: name}
+	var publicHandle *keyset.Handle
+	if encrypted.EncryptedKeyset != "" {
+		if kmsKeyName == "" {
+			return nil, fmt.Errorf("%v holds an encrypted private keyset, -hybrid_keyset_kms_key is needed to read it", file)
+		}
+		masterKey, err := newRemoteAEAD(ctx, kmsKeyName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create KMS AEAD client: %v", err)
+		}
+		handle, err := keyset.Read(keyset.NewJSONReader(bytes.NewReader(data)), masterKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt %v with %v: %w", file, kmsKeyName, err)
+		}
+		if key.decrypt, err = hybrid.NewHybridDecrypt(handle); err != nil {
+			return nil, err
+		}
+		if publicHandle, err = handle.Public(); err != nil {
+			return nil, err
+		}
+	} else {
+		// cleartext private keysets are refused here, they would put the readers' key on disk
+		if publicHandle, err = keyset.ReadWithNoSecrets(keyset.NewJSONReader(bytes.NewReader(data))); err != nil {
+			return nil, fmt.Errorf("%v must be a public keyset or a private keyset encrypted by KMS: %v", file, err)
+		}
+	}
+	if key.encrypt, err = hybrid.NewHybridEncrypt(publicHandle); err != nil {
+		return nil, err
+	}
+	key.keyVersion = fmt.Sprintf("%v%v/keys/%v", HybridKeyPrefix, name, publicHandle.KeysetInfo().PrimaryKeyId)
+	return key, nil
+}
+
+// hybridKey returns the hybrid keyset of a mapped key name hybrid/NAME
+func hybridKey(keyName string) (*hybridAEAD, error) {
+	name := strings.TrimPrefix(keyName, HybridKeyPrefix)
+	key, ok := hybridKeys[name]
+	if !ok {
+		return nil, fmt.Errorf("no hybrid keyset %v, see -hybrid_keysets", name)
+	}
+	return key, nil
+}
+
+func (a *hybridAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	return a.encrypt.Encrypt(plaintext, associatedData)
+}
+
+func (a *hybridAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	if a.decrypt == nil {
+		return nil, fmt.Errorf("this proxy only has the public keyset of hybrid key %v, objects encrypted with it decrypt where its private keyset is", a.name)
+	}
+	return a.decrypt.Decrypt(ciphertext, associatedData)
+}
+
+func (a *hybridAEAD) KeyVersion() string {
+	return a.keyVersion
+}
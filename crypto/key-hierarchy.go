@@ -0,0 +1,205 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+)
+
+/*
+With KekTTL set the DEK of every object is wrapped by a key encryption key (KEK) of its bucket
+instead of by KMS, see envelope.JoinKekWrapped. The proxy generates the KEK, has the mapped KMS key
+wrap it once and keeps it in memory for KekTTL, then starts a new one: uploads cost one KMS call
+per bucket and TTL instead of one per object. Downloads unwrap every KEK they meet once per TTL,
+and objects whose DEK KMS wrapped directly keep decrypting either way. A KEK unwrapped for one
+set of credentials is not used for another. Revoking access to a KMS key stops the cached KEKs
+once their TTL ended.
+*/
+
+// KekTTL is how long a KEK wraps new DEKs and stays cached, 0 wraps every DEK with KMS. Set by
+// the binary.
+var KekTTL time.Duration
+
+// kekScope tells the KEKs of the buckets, keys and tenants apart
+type kekScope struct {
+	keyName     string
+	bucket      string // "" when the caller did not name one, see WithBucket
+	credentials string // KMS credentials file, see WithKmsCredentials
+}
+
+// unwrappedScope identifies a KEK read back from an object
+type unwrappedScope struct {
+	keyName     string
+	credentials string
+	wrapped     [sha256.Size]byte
+}
+
+type kekEntry struct {
+	kek        []byte
+	wrapped    []byte // by the KMS key
+	keyVersion string // of the KMS key that wrapped it
+	expires    time.Time
+}
+
+var (
+	kekMu     sync.Mutex
+	kekCache  = map[kekScope]*kekEntry{}
+	unwrapped = map[unwrappedScope]*kekEntry{}
+)
+
+// WithBucket makes the DEKs wrapped with ctx use the KEKs of bucket, see KekTTL
+func WithBucket(ctx context.Context, bucket string) context.Context {
+	return context.WithValue(ctx, bucketKey, bucket)
+}
+
+// WithoutKekCache makes the encryptions with ctx call KMS, e.g. to check that a key still works
+func WithoutKekCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noKekCacheKey, true)
+}
+
+// kekAEAD wraps DEKs with the KEK of its scope, and unwraps DEKs of both kinds
+type kekAEAD struct {
+	remote     remoteAEAD
+	scope      kekScope
+	cached     bool
+	keyVersion string
+}
+
+var _ remoteAEAD = (*kekAEAD)(nil)
+
+// remoteKey returns the remote AEAD of keyName, a KMS key or a hybrid keyset, seen through the
+// key hierarchy
+func remoteKey(ctx context.Context, keyName string) (remoteAEAD, error) {
+	var remote remoteAEAD
+	var err error
+	if IsHybridKey(keyName) {
+		remote, err = hybridKey(keyName)
+	} else {
+		if remote, err = newRemoteAEAD(ctx, keyName); err == nil {
+			remote = timedAEAD(ctx, remote)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	a := &kekAEAD{remote: remote, scope: kekScope{keyName: keyName}}
+	a.scope.bucket, _ = ctx.Value(bucketKey).(string)
+	a.scope.credentials, _ = ctx.Value(credentialsFileKey).(string)
+	noCache, _ := ctx.Value(noKekCacheKey).(bool)
+	a.cached = KekTTL > 0 && !noCache
+	return a, nil
+}
+
+func (a *kekAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	if !a.cached {
+		return a.remote.Encrypt(plaintext, associatedData)
+	}
+	entry, err := a.currentKek()
+	if err != nil {
+		return nil, err
+	}
+	wrappedDek, err := envelope.WrapWithKek(entry.kek, plaintext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	a.keyVersion = entry.keyVersion
+	return envelope.JoinKekWrapped(entry.wrapped, wrappedDek), nil
+}
+
+func (a *kekAEAD) KeyVersion() string {
+	if a.keyVersion != "" {
+		return a.keyVersion
+	}
+	return a.remote.KeyVersion()
+}
+
+func (a *kekAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	wrappedKek, wrappedDek, ok := envelope.SplitKekWrapped(ciphertext)
+	if !ok {
+		return a.remote.Decrypt(ciphertext, associatedData)
+	}
+	kek, err := a.unwrapKek(wrappedKek)
+	if err != nil {
+		return nil, err
+	}
+	return envelope.UnwrapWithKek(kek, wrappedDek, associatedData)
+}
+
+// currentKek returns the KEK of the scope, a new one once the last expired
+func (a *kekAEAD) currentKek() (*kekEntry, error) {
+	now := time.Now()
+	kekMu.Lock()
+	entry, ok := kekCache[a.scope]
+	kekMu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry, nil
+	}
+
+	// concurrent uploads may each start a KEK, the last one stays
+	kek := make([]byte, envelope.KekSize)
+	if _, err := rand.Read(kek); err != nil {
+		return nil, err
+	}
+	wrapped, err := a.remote.Encrypt(kek, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to wrap a new KEK: %w", err)
+	}
+	entry = &kekEntry{kek: kek, wrapped: wrapped, keyVersion: a.remote.KeyVersion(), expires: now.Add(KekTTL)}
+	kekMu.Lock()
+	kekCache[a.scope] = entry
+	// a producer holding only the public hybrid key must not read back what it wrote
+	if hybrid, ok := a.remote.(*hybridAEAD); !ok || hybrid.decrypt != nil {
+		a.remember(entry, now)
+	}
+	kekMu.Unlock()
+	return entry, nil
+}
+
+// unwrapKek returns the KEK wrapped by the KMS key, cached when the hierarchy is enabled
+func (a *kekAEAD) unwrapKek(wrappedKek []byte) ([]byte, error) {
+	if !a.cached {
+		kek, err := a.remote.Decrypt(wrappedKek, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to unwrap the KEK: %w", err)
+		}
+		return kek, nil
+	}
+	now := time.Now()
+	scope := unwrappedScope{keyName: a.scope.keyName, credentials: a.scope.credentials, wrapped: sha256.Sum256(wrappedKek)}
+	kekMu.Lock()
+	entry, ok := unwrapped[scope]
+	kekMu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.kek, nil
+	}
+
+	kek, err := a.remote.Decrypt(wrappedKek, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap the KEK: %w", err)
+	}
+	kekMu.Lock()
+	a.remember(&kekEntry{kek: kek, wrapped: wrappedKek, expires: now.Add(KekTTL)}, now)
+	kekMu.Unlock()
+	return kek, nil
+}
+
+// remember caches an unwrapped KEK and drops the expired ones, kekMu must be held
+func (a *kekAEAD) remember(entry *kekEntry, now time.Time) {
+	for scope, e := range unwrapped {
+		if !now.Before(e.expires) {
+			delete(unwrapped, scope)
+		}
+	}
+	scope := unwrappedScope{keyName: a.scope.keyName, credentials: a.scope.credentials, wrapped: sha256.Sum256(entry.wrapped)}
+	unwrapped[scope] = entry
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/google/tink/go/tink"
+	"google.golang.org/api/cloudkms/v1"
+)
+
+// kmsAEAD is the remote AEAD that wraps data encryption keys with a Cloud KMS key. It does the
+// same as tink's gcpkms AEAD but keeps the key version KMS used, which tink discards.
+type kmsAEAD struct {
+	ctx        context.Context
+	keyName    string
+	kms        *cloudkms.Service
+	keyVersion string
+}
+
+// KmsQuota, when set, is waited for before every Cloud KMS request, e.g. a kmsquota.Client sharing
+// the QPS quota of a cluster. Set by the binary.
+var KmsQuota interface {
+	Wait(ctx context.Context) error
+}
+
+// remoteAEAD wraps data encryption keys with a KMS key and remembers the key version it used
+type remoteAEAD interface {
+	tink.AEAD
+	KeyVersion() string
+}
+
+var _ remoteAEAD = (*kmsAEAD)(nil)
+
+// newRemoteAEAD creates the remote AEAD of a key, Cloud KMS unless UseLocalKms was called
+var newRemoteAEAD = func(ctx context.Context, keyName string) (remoteAEAD, error) {
+	return newKmsAEAD(ctx, keyName)
+}
+
+// newKmsAEAD returns a remote AEAD for the key in the format:
+// projects/<projectname>/locations/<location>/keyRings/<key-ring>/cryptoKeys/<key>
+func newKmsAEAD(ctx context.Context, keyName string) (*kmsAEAD, error) {
+	if keyName == "" {
+		return nil, fmt.Errorf("missing KMS key name")
+	}
+	kmsService, err := kmsService(ctx, keyName)
+	if err != nil {
+		return nil, err
+	}
+	return &kmsAEAD{ctx: ctx, keyName: keyName, kms: kmsService}, nil
+}
+
+func (a *kmsAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	if err := waitKmsQuota(a.ctx, a.keyName); err != nil {
+		return nil, err
+	}
+	req := &cloudkms.EncryptRequest{
+		Plaintext:                   base64.URLEncoding.EncodeToString(plaintext),
+		AdditionalAuthenticatedData: base64.URLEncoding.EncodeToString(associatedData),
+	}
+	resp, err := a.kms.Projects.Locations.KeyRings.CryptoKeys.Encrypt(a.keyName, req).Do()
+	if err != nil {
+		kmsErr := classifyKmsError(a.keyName, err)
+		recordKmsRequest(a.ctx, a.keyName, "encrypt", kmsErr)
+		return nil, kmsErr
+	}
+	recordKmsRequest(a.ctx, a.keyName, "encrypt", nil)
+	// the response names the primary version that encrypted the data
+	a.keyVersion = resp.Name
+	return base64.StdEncoding.DecodeString(resp.Ciphertext)
+}
+
+func (a *kmsAEAD) KeyVersion() string {
+	return a.keyVersion
+}
+
+func (a *kmsAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	if err := waitKmsQuota(a.ctx, a.keyName); err != nil {
+		return nil, err
+	}
+	req := &cloudkms.DecryptRequest{
+		Ciphertext:                  base64.URLEncoding.EncodeToString(ciphertext),
+		AdditionalAuthenticatedData: base64.URLEncoding.EncodeToString(associatedData),
+	}
+	resp, err := a.kms.Projects.Locations.KeyRings.CryptoKeys.Decrypt(a.keyName, req).Do()
+	if err != nil {
+		kmsErr := classifyKmsError(a.keyName, err)
+		recordKmsRequest(a.ctx, a.keyName, "decrypt", kmsErr)
+		return nil, kmsErr
+	}
+	recordKmsRequest(a.ctx, a.keyName, "decrypt", nil)
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
+
+// CheckKeyUsable returns an error unless KMS can currently decrypt with keyVersion, or with the
+// primary version of keyName when no version is known. Requires cloudkms.cryptoKeyVersions.get.
+func CheckKeyUsable(ctx context.Context, keyName string, keyVersion string) error {
+	kmsService, err := kmsService(ctx, keyName)
+	if err != nil {
+		return fmt.Errorf("failed to create KMS client: %v", err)
+	}
+
+	if keyVersion != "" {
+		version, err := kmsService.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.Get(keyVersion).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("unable to get key version %v: %v", keyVersion, err)
+		}
+		if version.State != "ENABLED" {
+			return fmt.Errorf("key version %v is %v", keyVersion, version.State)
+		}
+		return nil
+	}
+
+	key, err := kmsService.Projects.Locations.KeyRings.CryptoKeys.Get(keyName).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("unable to get key %v: %v", keyName, err)
+	}
+	if key.Primary == nil || key.Primary.State != "ENABLED" {
+		return fmt.Errorf("key %v has no enabled primary version", keyName)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"sort"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/option"
+)
+
+type contextKey int
+
+const (
+	credentialsFileKey contextKey = iota
+	metricLabelsKey
+	bucketKey
+	noKekCacheKey
+	kmsTimerKey
+	retryScopeKey
+	chunkSizeKey
+	bindingKey
+	partManifestKey
+)
+
+// WithKmsCredentials makes the KMS calls made with ctx authenticate with the service account
+// key or workload identity federation file credentialsFile instead of the application
+// default credentials. An empty credentialsFile keeps the default.
+func WithKmsCredentials(ctx context.Context, credentialsFile string) context.Context {
+	if credentialsFile == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, credentialsFileKey, credentialsFile)
+}
+
+// WithMetricLabels adds labels to the metrics recorded for the KMS calls made with ctx.
+func WithMetricLabels(ctx context.Context, labels map[string]string) context.Context {
+	if len(labels) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, metricLabelsKey, labels)
+}
+
+func kmsClientOptions(ctx context.Context) []option.ClientOption {
+	if credentialsFile, ok := ctx.Value(credentialsFileKey).(string); ok {
+		return []option.ClientOption{option.WithCredentialsFile(credentialsFile)}
+	}
+	return nil
+}
+
+// metricAttributes returns attributes followed by the labels set by WithMetricLabels
+func metricAttributes(ctx context.Context, attributes ...attribute.KeyValue) []attribute.KeyValue {
+	labels, _ := ctx.Value(metricLabelsKey).(map[string]string)
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attributes = append(attributes, attribute.String(name, labels[name]))
+	}
+	return attributes
+}
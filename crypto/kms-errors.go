@@ -0,0 +1,112 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/api/googleapi"
+)
+
+// KMS failure classes. they are returned to clients as the error reason and used as metric label.
+const (
+	KmsPermissionDenied = "KMS_PERMISSION_DENIED"
+	KmsApiDisabled      = "KMS_API_DISABLED"
+	KmsKeyNotFound      = "KMS_KEY_NOT_FOUND"
+	KmsWrongRegion      = "KMS_WRONG_REGION"
+	KmsKeyDisabled      = "KMS_KEY_DISABLED"
+	KmsKeyDestroyed     = "KMS_KEY_DESTROYED"
+	KmsWrongKey         = "KMS_WRONG_KEY"
+	KmsQuotaExceeded    = "KMS_QUOTA_EXCEEDED"
+	KmsUnavailable      = "KMS_UNAVAILABLE"
+	KmsInvalidRequest   = "KMS_INVALID_REQUEST"
+)
+
+var kmsErrorGuidance = map[string]string{
+	KmsPermissionDenied: "the proxy service account needs roles/cloudkms.cryptoKeyEncrypterDecrypter on the key",
+	KmsApiDisabled:      "enable the Cloud KMS API (cloudkms.googleapis.com) in the key's project",
+	KmsKeyNotFound:      "check the key name in the bucket key mapping",
+	KmsWrongRegion:      "the key location in the mapping does not match the key ring's location",
+	KmsKeyDisabled:      "the key version is disabled, re-enable it in Cloud KMS",
+	KmsKeyDestroyed:     "the key version is destroyed or scheduled for destruction, data encrypted with it cannot be decrypted unless destruction is cancelled",
+	KmsWrongKey:         "the object was encrypted with a different key, check gcsproxy-encryption-key on the object and the fallback keys",
+	KmsQuotaExceeded:    "Cloud KMS quota exceeded, retry later or request more quota",
+	KmsUnavailable:      "Cloud KMS is unavailable, retry later",
+	KmsInvalidRequest:   "Cloud KMS rejected the request",
+}
+
+// KmsError is a classified Cloud KMS failure.
+type KmsError struct {
+	Code       string
+	KeyName    string
+	StatusCode int // HTTP status to return to the client
+	Err        error
+}
+
+func (e *KmsError) Error() string {
+	return fmt.Sprintf("%v: %v (key %v): %v", e.Code, e.Guidance(), e.KeyName, e.Err)
+}
+
+func (e *KmsError) Unwrap() error {
+	return e.Err
+}
+
+func (e *KmsError) Guidance() string {
+	return kmsErrorGuidance[e.Code]
+}
+
+// classifyKmsError maps an error returned by the Cloud KMS API to a KmsError.
+func classifyKmsError(keyName string, err error) *KmsError {
+	kmsErr := &KmsError{Code: KmsUnavailable, KeyName: keyName, StatusCode: http.StatusServiceUnavailable, Err: err}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		// transport failures, timeouts
+		return kmsErr
+	}
+	message := apiErr.Message
+	switch {
+	case apiErr.Code == http.StatusForbidden && (strings.Contains(message, "has not been used") || strings.Contains(message, "is disabled")):
+		kmsErr.Code, kmsErr.StatusCode = KmsApiDisabled, http.StatusForbidden
+	case apiErr.Code == http.StatusForbidden:
+		kmsErr.Code, kmsErr.StatusCode = KmsPermissionDenied, http.StatusForbidden
+	case apiErr.Code == http.StatusNotFound:
+		kmsErr.Code, kmsErr.StatusCode = KmsKeyNotFound, http.StatusInternalServerError
+	case apiErr.Code == http.StatusTooManyRequests:
+		kmsErr.Code, kmsErr.StatusCode = KmsQuotaExceeded, http.StatusTooManyRequests
+	case apiErr.Code >= 500:
+		kmsErr.Code, kmsErr.StatusCode = KmsUnavailable, http.StatusServiceUnavailable
+	case strings.Contains(message, "DESTROY"):
+		kmsErr.Code, kmsErr.StatusCode = KmsKeyDestroyed, http.StatusForbidden
+	case strings.Contains(message, "DISABLED") || strings.Contains(message, "not enabled"):
+		kmsErr.Code, kmsErr.StatusCode = KmsKeyDisabled, http.StatusForbidden
+	case strings.Contains(message, "ciphertext is invalid") || strings.Contains(message, "Decryption failed"):
+		kmsErr.Code, kmsErr.StatusCode = KmsWrongKey, http.StatusInternalServerError
+	case strings.Contains(strings.ToLower(message), "location"):
+		kmsErr.Code, kmsErr.StatusCode = KmsWrongRegion, http.StatusInternalServerError
+	default:
+		kmsErr.Code, kmsErr.StatusCode = KmsInvalidRequest, http.StatusInternalServerError
+	}
+	return kmsErr
+}
+
+// recordKmsError counts KMS failures by class and operation (encrypt/decrypt).
+func recordKmsError(ctx context.Context, operation string, err error) {
+	var kmsErr *KmsError
+	if KmsErrors == nil || !errors.As(err, &kmsErr) {
+		return
+	}
+	KmsErrors.Add(ctx, 1, metric.WithAttributes(metricAttributes(ctx,
+		attribute.String("code", kmsErr.Code),
+		attribute.String("operation", operation),
+		attribute.String("project", kmsProject(kmsErr.KeyName)))...))
+}
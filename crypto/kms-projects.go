@@ -0,0 +1,158 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/cloudkms/v1"
+)
+
+/*
+Large organizations spread their keys over the projects of their teams, and KMS has a request quota
+per project. The proxy keeps one KMS client per project and credentials, limits the requests to the
+keys of a project to its KmsProjectQps on top of KmsQuota, and labels the KMS metrics with the
+project and key so that an exhausted quota is traced to the team it belongs to.
+*/
+
+// KmsProjectQps limits the KMS requests per second to the keys of a project, on top of KmsQuota.
+// Set by the binary.
+var KmsProjectQps map[string]float64
+
+// KmsRequests counts the KMS requests by project, key, operation and result, ok or the KmsError
+// code. KmsQuotaWait records how long they waited for KmsQuota and KmsProjectQps by project, in
+// seconds. Set up by the binary when metrics are exported.
+var (
+	KmsRequests  metric.Int64Counter
+	KmsQuotaWait metric.Float64Histogram
+)
+
+// kmsClientScope tells the pooled KMS clients apart
+type kmsClientScope struct {
+	project     string
+	credentials string // KMS credentials file, see WithKmsCredentials
+}
+
+var (
+	kmsClientsMu sync.Mutex
+	kmsClients   = map[kmsClientScope]*cloudkms.Service{}
+
+	projectLimitersMu sync.Mutex
+	projectLimiters   = map[string]*rate.Limiter{}
+)
+
+// kmsProject returns the project of a KMS resource name, "" when it names none
+func kmsProject(keyName string) string {
+	rest, ok := strings.CutPrefix(keyName, "projects/")
+	if !ok {
+		return ""
+	}
+	project, _, _ := strings.Cut(rest, "/")
+	return project
+}
+
+// kmsService returns the KMS client of the project of keyName for the credentials of ctx, created
+// on first use
+func kmsService(ctx context.Context, keyName string) (*cloudkms.Service, error) {
+	scope := kmsClientScope{project: kmsProject(keyName)}
+	scope.credentials, _ = ctx.Value(credentialsFileKey).(string)
+
+	kmsClientsMu.Lock()
+	defer kmsClientsMu.Unlock()
+	if service, ok := kmsClients[scope]; ok {
+		return service, nil
+	}
+	// the client refreshes its tokens long after the request that created it ended
+	service, err := cloudkms.NewService(context.WithoutCancel(ctx), kmsClientOptions(ctx)...)
+	if err != nil {
+		return nil, err
+	}
+	kmsClients[scope] = service
+	return service, nil
+}
+
+// projectLimiter returns the limiter of the KMS requests to project, nil when it has no limit
+func projectLimiter(project string) *rate.Limiter {
+	qps, ok := KmsProjectQps[project]
+	if !ok || qps <= 0 {
+		return nil
+	}
+	projectLimitersMu.Lock()
+	defer projectLimitersMu.Unlock()
+	limiter, ok := projectLimiters[project]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(qps), max(int(qps), 1))
+		projectLimiters[project] = limiter
+	}
+	return limiter
+}
+
+// waitKmsQuota blocks until KmsQuota and the limit of the project of keyName let a KMS request
+// through
+func waitKmsQuota(ctx context.Context, keyName string) error {
+	project := kmsProject(keyName)
+	start := time.Now()
+	if KmsQuota != nil {
+		if err := KmsQuota.Wait(ctx); err != nil {
+			return fmt.Errorf("waiting for KMS quota: %w", err)
+		}
+	}
+	if limiter := projectLimiter(project); limiter != nil {
+		if err := limiter.Wait(ctx); err != nil {
+			return fmt.Errorf("waiting for the KMS quota of project %v: %w", project, err)
+		}
+	}
+	if KmsQuotaWait != nil {
+		KmsQuotaWait.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(metricAttributes(ctx,
+			attribute.String("project", project))...))
+	}
+	return nil
+}
+
+var kmsCallsByBucket sync.Map // bucket -> *atomic.Int64
+
+// KmsCalls returns the KMS requests made since the start for the objects of every bucket, by the
+// bucket of the context they were made with, see WithBucket
+func KmsCalls() map[string]int64 {
+	calls := map[string]int64{}
+	kmsCallsByBucket.Range(func(bucket, count any) bool {
+		calls[bucket.(string)] = count.(*atomic.Int64).Load()
+		return true
+	})
+	return calls
+}
+
+// recordKmsRequest counts a KMS request to keyName by operation and result
+func recordKmsRequest(ctx context.Context, keyName string, operation string, err error) {
+	if bucket, _ := ctx.Value(bucketKey).(string); bucket != "" {
+		count, _ := kmsCallsByBucket.LoadOrStore(bucket, &atomic.Int64{})
+		count.(*atomic.Int64).Add(1)
+	}
+	if KmsRequests == nil {
+		return
+	}
+	result := "ok"
+	var kmsErr *KmsError
+	if errors.As(err, &kmsErr) {
+		result = kmsErr.Code
+	} else if err != nil {
+		result = "error"
+	}
+	KmsRequests.Add(ctx, 1, metric.WithAttributes(metricAttributes(ctx,
+		attribute.String("project", kmsProject(keyName)),
+		attribute.String("key", keyName),
+		attribute.String("operation", operation),
+		attribute.String("result", result))...))
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/cloudkms/v1"
+)
+
+type kmsPublicKey struct {
+	algorithm string
+	key       interface{}
+}
+
+// public keys never change for a key version, fetch them once
+var publicKeys sync.Map // key version name -> *kmsPublicKey
+
+// VerifySignature checks that signature was made over data by the asymmetric signing key version
+// keyVersionName, e.g. projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1.
+// The public key is fetched from Cloud KMS, verification happens locally.
+func VerifySignature(ctx context.Context, keyVersionName string, data []byte, signature []byte) error {
+	publicKey, err := getPublicKey(ctx, keyVersionName)
+	if err != nil {
+		return err
+	}
+
+	hash := signatureHash(publicKey.algorithm)
+	h := hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch key := publicKey.key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, signature) {
+			return fmt.Errorf("invalid signature for key %v", keyVersionName)
+		}
+	case *rsa.PublicKey:
+		if strings.HasPrefix(publicKey.algorithm, "RSA_SIGN_PSS") {
+			err = rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			err = rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid signature for key %v: %v", keyVersionName, err)
+		}
+	default:
+		return fmt.Errorf("unsupported signing algorithm %v of key %v", publicKey.algorithm, keyVersionName)
+	}
+	return nil
+}
+
+// SignData signs data with the asymmetric signing key version keyVersionName and returns the
+// signature VerifySignature checks.
+func SignData(ctx context.Context, keyVersionName string, data []byte) ([]byte, error) {
+	publicKey, err := getPublicKey(ctx, keyVersionName)
+	if err != nil {
+		return nil, err
+	}
+	hash := signatureHash(publicKey.algorithm)
+	h := hash.New()
+	h.Write(data)
+	encoded := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	digest := &cloudkms.Digest{}
+	switch hash {
+	case crypto.SHA384:
+		digest.Sha384 = encoded
+	case crypto.SHA512:
+		digest.Sha512 = encoded
+	default:
+		digest.Sha256 = encoded
+	}
+
+	kmsService, err := cloudkms.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create KMS client: %v", err)
+	}
+	resp, err := kmsService.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.AsymmetricSign(keyVersionName, &cloudkms.AsymmetricSignRequest{Digest: digest}).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyKmsError(keyVersionName, err)
+	}
+	return base64.StdEncoding.DecodeString(resp.Signature)
+}
+
+// signatureHash returns the digest a KMS signing algorithm such as EC_SIGN_P384_SHA384 signs
+func signatureHash(algorithm string) crypto.Hash {
+	switch {
+	case strings.HasSuffix(algorithm, "SHA384"):
+		return crypto.SHA384
+	case strings.HasSuffix(algorithm, "SHA512"):
+		return crypto.SHA512
+	}
+	return crypto.SHA256
+}
+
+func getPublicKey(ctx context.Context, keyVersionName string) (*kmsPublicKey, error) {
+	if cached, ok := publicKeys.Load(keyVersionName); ok {
+		return cached.(*kmsPublicKey), nil
+	}
+
+	kmsService, err := cloudkms.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create KMS client: %v", err)
+	}
+	resp, err := kmsService.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.GetPublicKey(keyVersionName).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyKmsError(keyVersionName, err)
+	}
+	if !strings.HasPrefix(resp.Algorithm, "EC_SIGN_") && !strings.HasPrefix(resp.Algorithm, "RSA_SIGN_") {
+		return nil, fmt.Errorf("key %v is not a signing key: %v", keyVersionName, resp.Algorithm)
+	}
+	block, _ := pem.Decode([]byte(resp.Pem))
+	if block == nil {
+		return nil, fmt.Errorf("invalid public key PEM for key %v", keyVersionName)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key of %v: %v", keyVersionName, err)
+	}
+
+	publicKey := &kmsPublicKey{algorithm: resp.Algorithm, key: key}
+	publicKeys.Store(keyVersionName, publicKey)
+	return publicKey, nil
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"time"
+)
+
+// WithKmsTimer has the time of every KMS call made with ctx passed to observe, e.g. to tell KMS
+// latency apart from the rest of a request. The calls of one context may run at once.
+func WithKmsTimer(ctx context.Context, observe func(time.Duration)) context.Context {
+	return context.WithValue(ctx, kmsTimerKey, observe)
+}
+
+// kmsTimer times the calls of the remote AEAD it wraps
+type kmsTimer struct {
+	remoteAEAD
+	observe func(time.Duration)
+}
+
+// timedAEAD wraps remote in a kmsTimer when ctx has one, see WithKmsTimer
+func timedAEAD(ctx context.Context, remote remoteAEAD) remoteAEAD {
+	observe, ok := ctx.Value(kmsTimerKey).(func(time.Duration))
+	if !ok {
+		return remote
+	}
+	return &kmsTimer{remoteAEAD: remote, observe: observe}
+}
+
+func (t *kmsTimer) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	start := time.Now()
+	defer func() { t.observe(time.Since(start)) }()
+	return t.remoteAEAD.Encrypt(plaintext, associatedData)
+}
+
+func (t *kmsTimer) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	start := time.Now()
+	defer func() { t.observe(time.Since(start)) }()
+	return t.remoteAEAD.Decrypt(ciphertext, associatedData)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+)
+
+// localKms replaces Cloud KMS with keys that only live in this process, see UseLocalKms
+type localKms struct {
+	mu      sync.Mutex
+	aeads   map[string]tink.AEAD
+	macKeys map[string][]byte
+}
+
+var local *localKms
+
+/*
+UseLocalKms makes every KMS key name resolve to a random key kept in memory, so the proxy
+pipeline runs without Cloud KMS access or credentials, e.g. to replay dumps. Objects encrypted
+this way can only be decrypted by the same process. Never use it for real data.
+*/
+func UseLocalKms() {
+	local = &localKms{aeads: map[string]tink.AEAD{}, macKeys: map[string][]byte{}}
+	newRemoteAEAD = func(ctx context.Context, keyName string) (remoteAEAD, error) {
+		return local.aead(keyName)
+	}
+}
+
+type localAEAD struct {
+	tink.AEAD
+	keyName string
+}
+
+func (a *localAEAD) KeyVersion() string {
+	return a.keyName + "/cryptoKeyVersions/1"
+}
+
+func (k *localKms) aead(keyName string) (remoteAEAD, error) {
+	if keyName == "" {
+		return nil, fmt.Errorf("missing KMS key name")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	primitive, ok := k.aeads[keyName]
+	if !ok {
+		handle, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+		if err != nil {
+			return nil, fmt.Errorf("error creating local key: %v", err)
+		}
+		primitive, err = aead.New(handle)
+		if err != nil {
+			return nil, fmt.Errorf("error creating local key: %v", err)
+		}
+		k.aeads[keyName] = primitive
+	}
+	return &localAEAD{AEAD: primitive, keyName: keyName}, nil
+}
+
+// mac computes the HMAC-SHA256 of data with the local MAC key of keyName
+func (k *localKms) mac(keyName string, data []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	macKey, ok := k.macKeys[keyName]
+	if !ok {
+		macKey = make([]byte, 32)
+		if _, err := rand.Read(macKey); err != nil {
+			return nil, fmt.Errorf("error creating local MAC key: %v", err)
+		}
+		k.macKeys[keyName] = macKey
+	}
+	h := hmac.New(sha256.New, macKey)
+	h.Write(data)
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package inventory streams the per object results of the verification and onboarding tools
+into a BigQuery table, for compliance dashboards over which objects are encrypted and with
+which key:
+
+	SELECT bucket, COUNTIF(NOT encrypted) AS plaintext
+	FROM `project.dataset.gcsproxy_inventory`
+	WHERE DATE(time) = CURRENT_DATE()
+	GROUP BY bucket
+
+The table is created, partitioned by day, when it does not exist.
+*/
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+)
+
+// rows sent per insertAll call
+const batchSize = 500
+
+// Row is the result of one tool for one object generation.
+type Row struct {
+	Tool       string // verify-restore, encrypt-existing
+	Bucket     string
+	Object     string
+	Generation int64
+	Encrypted  bool
+	Status     string
+	Key        string
+	KeyVersion string
+	Size       int64
+	Detail     string
+
+	// provenance recorded in the object metadata, see util.Provenance
+	ProxyVersion    string
+	EnvelopeVersion string
+	EncryptedAt     string // RFC 3339
+	Policy          string
+}
+
+var schema = &bigquery.TableSchema{Fields: []*bigquery.TableFieldSchema{
+	{Name: "time", Type: "TIMESTAMP", Mode: "REQUIRED"},
+	{Name: "run_id", Type: "STRING", Mode: "REQUIRED"},
+	{Name: "tool", Type: "STRING", Mode: "REQUIRED"},
+	{Name: "bucket", Type: "STRING", Mode: "REQUIRED"},
+	{Name: "object", Type: "STRING", Mode: "REQUIRED"},
+	{Name: "generation", Type: "INTEGER"},
+	{Name: "encrypted", Type: "BOOLEAN"},
+	{Name: "status", Type: "STRING"},
+	{Name: "key", Type: "STRING"},
+	{Name: "key_version", Type: "STRING"},
+	{Name: "size", Type: "INTEGER"},
+	{Name: "detail", Type: "STRING"},
+	{Name: "proxy_version", Type: "STRING"},
+	{Name: "envelope_version", Type: "STRING"},
+	{Name: "encrypted_at", Type: "TIMESTAMP"},
+	{Name: "policy", Type: "STRING"},
+}}
+
+// BigQueryWriter buffers rows and streams them into a table. It is not safe for concurrent use.
+type BigQueryWriter struct {
+	service   *bigquery.Service
+	projectId string
+	datasetId string
+	tableId   string
+	runId     string
+	rows      []*bigquery.TableDataInsertAllRequestRows
+}
+
+// NewBigQueryWriter returns a writer for the table project.dataset.table, or project:dataset.table,
+// and creates the table if it does not exist. The dataset must exist.
+func NewBigQueryWriter(ctx context.Context, table string) (*BigQueryWriter, error) {
+	projectId, rest, ok := strings.Cut(table, ":")
+	if !ok {
+		projectId, rest, ok = strings.Cut(table, ".")
+	}
+	datasetId, tableId, ok2 := strings.Cut(rest, ".")
+	if !ok || !ok2 || projectId == "" || datasetId == "" || tableId == "" {
+		return nil, fmt.Errorf("expected a BigQuery table as project.dataset.table, got %q", table)
+	}
+
+	service, err := bigquery.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create BigQuery client: %v", err)
+	}
+	w := &BigQueryWriter{
+		service:   service,
+		projectId: projectId,
+		datasetId: datasetId,
+		tableId:   tableId,
+		runId:     strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+	if err := w.createTable(ctx); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *BigQueryWriter) createTable(ctx context.Context) error {
+	existing, err := w.service.Tables.Get(w.projectId, w.datasetId, w.tableId).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if err == nil || !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+		if err != nil {
+			return fmt.Errorf("unable to get BigQuery table %v.%v.%v: %v", w.projectId, w.datasetId, w.tableId, err)
+		}
+		return w.addColumns(ctx, existing)
+	}
+
+	table := &bigquery.Table{
+		TableReference:   &bigquery.TableReference{ProjectId: w.projectId, DatasetId: w.datasetId, TableId: w.tableId},
+		Schema:           schema,
+		TimePartitioning: &bigquery.TimePartitioning{Type: "DAY", Field: "time"},
+		Description:      "go-gcsproxy object inventory",
+	}
+	_, err = w.service.Tables.Insert(w.projectId, w.datasetId, table).Context(ctx).Do()
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		return nil // created by a concurrent run
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create BigQuery table %v.%v.%v: %v", w.projectId, w.datasetId, w.tableId, err)
+	}
+	return nil
+}
+
+// addColumns adds the columns of schema missing from a table created by an earlier version
+func (w *BigQueryWriter) addColumns(ctx context.Context, table *bigquery.Table) error {
+	if table.Schema == nil {
+		return nil
+	}
+	present := make(map[string]bool)
+	for _, field := range table.Schema.Fields {
+		present[field.Name] = true
+	}
+	fields := table.Schema.Fields
+	for _, field := range schema.Fields {
+		if !present[field.Name] {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == len(table.Schema.Fields) {
+		return nil
+	}
+	patch := &bigquery.Table{Schema: &bigquery.TableSchema{Fields: fields}}
+	if _, err := w.service.Tables.Patch(w.projectId, w.datasetId, w.tableId, patch).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("unable to add the new columns to BigQuery table %v.%v.%v: %v", w.projectId, w.datasetId, w.tableId, err)
+	}
+	return nil
+}
+
+// Write adds a row, rows are sent in batches.
+func (w *BigQueryWriter) Write(ctx context.Context, row Row) error {
+	values := map[string]bigquery.JsonValue{
+		"time":        time.Now().UTC().Format(time.RFC3339Nano),
+		"run_id":      w.runId,
+		"tool":        row.Tool,
+		"bucket":      row.Bucket,
+		"object":      row.Object,
+		"generation":  row.Generation,
+		"encrypted":   row.Encrypted,
+		"status":      row.Status,
+		"key":         row.Key,
+		"key_version": row.KeyVersion,
+		"size":        row.Size,
+		"detail":      row.Detail,
+	}
+	for column, value := range map[string]string{"proxy_version": row.ProxyVersion, "envelope_version": row.EnvelopeVersion,
+		"encrypted_at": row.EncryptedAt, "policy": row.Policy} {
+		if value != "" {
+			values[column] = value
+		}
+	}
+	w.rows = append(w.rows, &bigquery.TableDataInsertAllRequestRows{
+		// retried inserts of the same row are deduplicated by BigQuery
+		InsertId: fmt.Sprintf("%v/%v/%v/%v#%v", w.runId, row.Tool, row.Bucket, row.Object, row.Generation),
+		Json:     values,
+	})
+	if len(w.rows) >= batchSize {
+		return w.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush sends the buffered rows.
+func (w *BigQueryWriter) Flush(ctx context.Context) error {
+	if len(w.rows) == 0 {
+		return nil
+	}
+	rows := w.rows
+	w.rows = nil
+	resp, err := w.service.Tabledata.InsertAll(w.projectId, w.datasetId, w.tableId,
+		&bigquery.TableDataInsertAllRequest{Rows: rows}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error streaming %v rows to BigQuery: %v", len(rows), err)
+	}
+	if len(resp.InsertErrors) > 0 {
+		first := resp.InsertErrors[0]
+		var reasons []string
+		for _, e := range first.Errors {
+			reasons = append(reasons, e.Message)
+		}
+		return fmt.Errorf("BigQuery rejected %v of %v rows, row %v: %v", len(resp.InsertErrors), len(rows), first.Index, strings.Join(reasons, ", "))
+	}
+	return nil
+}
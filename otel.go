@@ -1,62 +0,0 @@
-/*
-Copyright 2025 Google.
-
-This software is provided as-is, without warranty or representation for any use or purpose.
-*/
-
-package main
-
-import (
-	"context"
-	"errors"
-
-	"go.opentelemetry.io/contrib/exporters/autoexport"
-	"go.opentelemetry.io/contrib/propagators/autoprop"
-	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/sdk/metric"
-	"go.opentelemetry.io/otel/sdk/trace"
-)
-
-// setupOpenTelemetry sets up the OpenTelemetry SDK and exporters for metrics and
-// traces. If it does not return an error, call shutdown for proper cleanup.
-func setupOpenTelemetry(ctx context.Context) (shutdown func(context.Context) error, err error) {
-	var shutdownFuncs []func(context.Context) error
-
-	// shutdown combines shutdown functions from multiple OpenTelemetry
-	// components into a single function.
-	shutdown = func(ctx context.Context) error {
-		var err error
-		for _, fn := range shutdownFuncs {
-			err = errors.Join(err, fn(ctx))
-		}
-		shutdownFuncs = nil
-		return err
-	}
-
-	// Configure Context Propagation to use the default W3C traceparent format
-	otel.SetTextMapPropagator(autoprop.NewTextMapPropagator())
-
-	// Configure Trace Export to send spans as OTLP
-	texporter, err := autoexport.NewSpanExporter(ctx)
-	if err != nil {
-		err = errors.Join(err, shutdown(ctx))
-		return
-	}
-	tp := trace.NewTracerProvider(trace.WithBatcher(texporter))
-	shutdownFuncs = append(shutdownFuncs, tp.Shutdown)
-	otel.SetTracerProvider(tp)
-
-	// Configure Metric Export to send metrics as OTLP
-	mreader, err := autoexport.NewMetricReader(ctx)
-	if err != nil {
-		err = errors.Join(err, shutdown(ctx))
-		return
-	}
-	mp := metric.NewMeterProvider(
-		metric.WithReader(mreader),
-	)
-	shutdownFuncs = append(shutdownFuncs, mp.Shutdown)
-	otel.SetMeterProvider(mp)
-
-	return shutdown, nil
-}
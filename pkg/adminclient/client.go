@@ -0,0 +1,435 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package adminclient is the Go client of the admin API a proxy serves on -admin_port, described by
+docs/admin-api.yaml, for the automation onboarding buckets or following the flows of a fleet:
+
+	client := adminclient.New("http://127.0.0.1:9082", os.Getenv("GCS_PROXY_ADMIN_TOKEN"), nil)
+	mapping, err := client.PutBucket(ctx, "my-bucket", adminclient.BucketMapping{Key: "projects/..."})
+
+The package only depends on the standard library, the types mirror the schemas of the spec.
+*/
+package adminclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BucketMapping is the key a bucket is encrypted with
+type BucketMapping struct {
+	Key    string `json:"key"`
+	Format string `json:"format,omitempty"` // tink (default) or csek
+}
+
+// BucketOverhead is what encryption added to the uploads of a bucket since the proxy started
+type BucketOverhead struct {
+	Objects         int64   `json:"objects"`
+	PlaintextBytes  int64   `json:"plaintextBytes"`
+	CiphertextBytes int64   `json:"ciphertextBytes"`
+	OverheadBytes   int64   `json:"overheadBytes"`
+	OverheadRatio   float64 `json:"overheadRatio"` // of the plaintext bytes
+}
+
+// BucketStats counts the requests to a mapped bucket since the proxy started
+type BucketStats struct {
+	Requests         int64   `json:"requests"`
+	Uploads          int64   `json:"uploads"`
+	Downloads        int64   `json:"downloads"`
+	BytesIn          int64   `json:"bytesIn"`  // of the request bodies, the plaintext of uploads
+	BytesOut         int64   `json:"bytesOut"` // of the response bodies, the plaintext of downloads
+	KmsCalls         int64   `json:"kmsCalls"`
+	Failures         int64   `json:"failures"`
+	AverageLatencyMs float64 `json:"averageLatencyMs"`
+}
+
+// Upload is an upload the proxy is sending to GCS
+type Upload struct {
+	Bucket    string    `json:"bucket"`
+	Object    string    `json:"object,omitempty"` // absent when the request names it in its body
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Started   time.Time `json:"started"`   // when the proxy started sending it to GCS
+	Bytes     int64     `json:"bytes"`     // sent to GCS in total, the ciphertext of encrypted uploads
+	SentBytes int64     `json:"sentBytes"` // sent to GCS so far
+}
+
+// ObjectListing is a page of the objects of a bucket
+type ObjectListing struct {
+	Bucket        string         `json:"bucket"`
+	Mapped        bool           `json:"mapped"`             // the proxy encrypts the uploads to the bucket
+	Prefixes      []string       `json:"prefixes,omitempty"` // the "directories" under the prefix
+	Objects       []ObjectStatus `json:"objects"`
+	NextPageToken string         `json:"nextPageToken,omitempty"` // empty on the last page
+}
+
+// ObjectStatus is a listed object and how it is encrypted, from its metadata
+type ObjectStatus struct {
+	Name          string    `json:"name"`
+	Generation    int64     `json:"generation"`
+	Size          int64     `json:"size"`                    // stored, the ciphertext of encrypted objects
+	PlaintextSize int64     `json:"plaintextSize,omitempty"` // of encrypted objects, when recorded
+	ContentType   string    `json:"contentType,omitempty"`
+	Updated       time.Time `json:"updated"`
+	Encryption    string    `json:"encryption"` // envelope, foreign, csek, plaintext or empty
+	Key           string    `json:"key,omitempty"`
+	KeyVersion    string    `json:"keyVersion,omitempty"`
+	EncryptedAt   string    `json:"encryptedAt,omitempty"`
+	ProxyVersion  string    `json:"proxyVersion,omitempty"`
+	Previewable   bool      `json:"previewable"` // small text that FetchObject decrypts
+}
+
+// Status is the profile and mode of the proxy
+type Status struct {
+	Version            string `json:"version"`
+	Profile            string `json:"profile,omitempty"`
+	EncryptionDisabled bool   `json:"encryptionDisabled"`
+	PlaintextRequests  int64  `json:"plaintextRequests"` // passed through since the start because encryption is disabled
+	WriteOnly          bool   `json:"writeOnly"`
+	Bypasses           int    `json:"bypasses"` // buckets in an emergency bypass
+
+	AesAcceleration Acceleration `json:"aesAcceleration"`
+}
+
+// Acceleration is whether the CPU of the proxy runs AES-GCM on hardware instructions
+type Acceleration struct {
+	Arch        string `json:"arch"`
+	AES         bool   `json:"aes"`   // AES round instructions
+	GHASH       bool   `json:"ghash"` // carry-less multiplication for the GCM hash
+	Accelerated bool   `json:"accelerated"`
+}
+
+// Bypass is an emergency bypass of a bucket, its requests are neither encrypted nor decrypted
+// until it expires
+type Bypass struct {
+	Bucket      string    `json:"bucket"`
+	Reason      string    `json:"reason"`
+	RequestedBy string    `json:"requestedBy,omitempty"`
+	Started     time.Time `json:"started"`
+	Expires     time.Time `json:"expires"`
+	Requests    int64     `json:"requests"` // passed through so far
+}
+
+// FlowEvent is a finished flow
+type FlowEvent struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"` // HTTP method
+	Url       string    `json:"url"`
+	Status    int       `json:"status"`    // 0 when the upstream call failed
+	LatencyMs float64   `json:"latencyMs"` // from the request headers to the end of the response
+	Decision  *Decision `json:"decision,omitempty"`
+}
+
+// Decision is what the proxy did with a flow
+type Decision struct {
+	Intercepted    bool    `json:"intercepted"` // the payload was rewritten
+	Method         string  `json:"method"`
+	Tenant         string  `json:"tenant,omitempty"`
+	Bucket         string  `json:"bucket,omitempty"`
+	Object         string  `json:"object,omitempty"`
+	Mapping        string  `json:"mapping,omitempty"` // the bucket key mapping entry that matched, * for the global key
+	Key            string  `json:"key,omitempty"`
+	Format         string  `json:"format,omitempty"`
+	Action         string  `json:"action"`
+	Error          string  `json:"error,omitempty"`
+	DurationMs     float64 `json:"durationMs"` // time spent in the proxy's handlers, without the upstream call
+	PlaintextSize  int     `json:"plaintextSize,omitempty"`
+	CiphertextSize int     `json:"ciphertextSize,omitempty"`
+}
+
+// FlowQuery selects the flows of the history a proxy keeps with -flow_history, the zero value
+// selects the newest flows
+type FlowQuery struct {
+	Buckets []string  // any of these buckets, all when empty
+	Object  string    // a substring of the object name
+	Status  int       // the HTTP status, any when 0
+	Action  string    // the action of the decision, e.g. encrypt or refused
+	Errors  bool      // only the flows the proxy reported an error for
+	Since   time.Time // finished at or after
+	Until   time.Time // finished before
+	Limit   int       // the newest flows returned at most, 100 when 0 and at most 1000
+}
+
+// APIError is an answer of the admin API other than success
+type APIError struct {
+	StatusCode int
+	Status     string
+	Message    string // the error the API gave, if any
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return "admin API answered " + e.Status
+	}
+	return fmt.Sprintf("admin API answered %v: %v", e.Status, e.Message)
+}
+
+// Client calls the admin API of one proxy
+type Client struct {
+	baseUrl string
+	token   string
+	http    *http.Client
+}
+
+// New returns a client of the admin API at baseUrl, e.g. http://127.0.0.1:9082, authenticating
+// with token. httpClient may be nil for http.DefaultClient.
+func New(baseUrl string, token string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{baseUrl: strings.TrimSuffix(baseUrl, "/"), token: token, http: httpClient}
+}
+
+// ListBuckets returns the mapping of every bucket, by bucket name
+func (c *Client) ListBuckets(ctx context.Context) (map[string]BucketMapping, error) {
+	var buckets map[string]BucketMapping
+	return buckets, c.call(ctx, http.MethodGet, "/v1/buckets", nil, &buckets)
+}
+
+// GetBucket returns the mapping of bucket, an *APIError of status 404 when it is not mapped
+func (c *Client) GetBucket(ctx context.Context, bucket string) (BucketMapping, error) {
+	var mapping BucketMapping
+	return mapping, c.call(ctx, http.MethodGet, "/v1/buckets/"+url.PathEscape(bucket), nil, &mapping)
+}
+
+// PutBucket maps bucket and returns the applied mapping. The proxy checks the key first and
+// answers 400 when it can't use it.
+func (c *Client) PutBucket(ctx context.Context, bucket string, mapping BucketMapping) (BucketMapping, error) {
+	var applied BucketMapping
+	return applied, c.call(ctx, http.MethodPut, "/v1/buckets/"+url.PathEscape(bucket), mapping, &applied)
+}
+
+// DeleteBucket stops encrypting bucket
+func (c *Client) DeleteBucket(ctx context.Context, bucket string) error {
+	return c.call(ctx, http.MethodDelete, "/v1/buckets/"+url.PathEscape(bucket), nil, nil)
+}
+
+// Overhead returns what encryption added to the uploads of every bucket, by bucket name
+func (c *Client) Overhead(ctx context.Context) (map[string]BucketOverhead, error) {
+	var buckets map[string]BucketOverhead
+	return buckets, c.call(ctx, http.MethodGet, "/v1/overhead", nil, &buckets)
+}
+
+// Uploads returns the uploads the proxy is sending to GCS, the oldest first
+func (c *Client) Uploads(ctx context.Context) ([]Upload, error) {
+	var uploads []Upload
+	return uploads, c.call(ctx, http.MethodGet, "/v1/uploads", nil, &uploads)
+}
+
+// Stats returns the requests to every mapped bucket since the proxy started, by bucket name
+func (c *Client) Stats(ctx context.Context) (map[string]BucketStats, error) {
+	var buckets map[string]BucketStats
+	return buckets, c.call(ctx, http.MethodGet, "/v1/stats", nil, &buckets)
+}
+
+// Status returns the profile and mode of the proxy
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	var status Status
+	return status, c.call(ctx, http.MethodGet, "/v1/status", nil, &status)
+}
+
+// ListBypasses returns the emergency bypasses by bucket name
+func (c *Client) ListBypasses(ctx context.Context) ([]Bypass, error) {
+	var bypasses []Bypass
+	return bypasses, c.call(ctx, http.MethodGet, "/v1/bypasses", nil, &bypasses)
+}
+
+// StartBypass stops encrypting and decrypting bucket for duration, at most -bypass_max_duration.
+// reason is mandatory, it is audited with requestedBy.
+func (c *Client) StartBypass(ctx context.Context, bucket string, reason string, requestedBy string, duration time.Duration) (Bypass, error) {
+	body := map[string]string{"reason": reason, "duration": duration.String(), "requestedBy": requestedBy}
+	var bypass Bypass
+	return bypass, c.call(ctx, http.MethodPut, "/v1/bypasses/"+url.PathEscape(bucket), body, &bypass)
+}
+
+// EndBypass encrypts bucket again before its bypass expires, an *APIError of status 404 without one
+func (c *Client) EndBypass(ctx context.Context, bucket string) error {
+	return c.call(ctx, http.MethodDelete, "/v1/bypasses/"+url.PathEscape(bucket), nil, nil)
+}
+
+// FetchObject returns the plaintext of a generation of gs://bucket/object, the live one when
+// generation is 0, decrypted by the proxy. The proxy must run with -admin_fetch. reason is
+// mandatory, it is audited with requestedBy.
+func (c *Client) FetchObject(ctx context.Context, bucket string, object string, generation int64, reason string, requestedBy string) ([]byte, error) {
+	query := url.Values{"bucket": {bucket}, "object": {object}, "reason": {reason}}
+	if generation != 0 {
+		query.Set("generation", strconv.FormatInt(generation, 10))
+	}
+	if requestedBy != "" {
+		query.Set("requestedBy", requestedBy)
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/v1/fetch", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	plaintext, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("lost the admin API: %v", err)
+	}
+	return plaintext, nil
+}
+
+// ListObjects returns a page of the objects of bucket one level under prefix, listed by the proxy,
+// from pageToken, the first page when empty. limit is 100 when 0.
+func (c *Client) ListObjects(ctx context.Context, bucket string, prefix string, pageToken string, limit int) (ObjectListing, error) {
+	query := url.Values{"bucket": {bucket}}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if pageToken != "" {
+		query.Set("pageToken", pageToken)
+	}
+	if limit != 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/v1/objects", query, nil)
+	if err != nil {
+		return ObjectListing{}, err
+	}
+	defer resp.Body.Close()
+	var listing ObjectListing
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return ObjectListing{}, fmt.Errorf("invalid answer of the admin API to GET /v1/objects: %v", err)
+	}
+	return listing, nil
+}
+
+// StreamFlows calls handle with every flow of buckets, all when empty, as it finishes. It returns
+// the error of handle, or why the stream ended: it never ends before ctx is done otherwise.
+func (c *Client) StreamFlows(ctx context.Context, buckets []string, handle func(FlowEvent) error) error {
+	query := url.Values{}
+	for _, bucket := range buckets {
+		query.Add("bucket", bucket)
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/v1/flows", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event FlowEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("invalid flow from the admin API: %v", err)
+		}
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("lost the admin API: %v", err)
+	}
+	return fmt.Errorf("the admin API closed the stream")
+}
+
+// SearchFlows returns the flows of the history q selects, newest first, an *APIError of status 404
+// when the proxy keeps no history
+func (c *Client) SearchFlows(ctx context.Context, q FlowQuery) ([]FlowEvent, error) {
+	query := url.Values{}
+	for _, bucket := range q.Buckets {
+		query.Add("bucket", bucket)
+	}
+	if q.Object != "" {
+		query.Set("object", q.Object)
+	}
+	if q.Status != 0 {
+		query.Set("status", strconv.Itoa(q.Status))
+	}
+	if q.Action != "" {
+		query.Set("action", q.Action)
+	}
+	if q.Errors {
+		query.Set("errors", "true")
+	}
+	if !q.Since.IsZero() {
+		query.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		query.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if q.Limit != 0 {
+		query.Set("limit", strconv.Itoa(q.Limit))
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/v1/flows/history", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var events []FlowEvent
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		return nil, fmt.Errorf("invalid answer of the admin API to GET /v1/flows/history: %v", err)
+	}
+	return events, nil
+}
+
+// call sends body as JSON, if not nil, and decodes the answer into result, if not nil
+func (c *Client) call(ctx context.Context, method string, path string, body any, result any) error {
+	resp, err := c.do(ctx, method, path, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("invalid answer of the admin API to %v %v: %v", method, path, err)
+	}
+	return nil
+}
+
+// do returns the response of a successful request, an *APIError for the other statuses
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	target := c.baseUrl + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach the admin API: %v", err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	apiErr := &APIError{StatusCode: resp.StatusCode, Status: resp.Status}
+	var answer struct {
+		Error string `json:"error"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&answer) == nil {
+		apiErr.Message = answer.Error
+	}
+	return nil, apiErr
+}
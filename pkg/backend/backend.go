@@ -0,0 +1,221 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package backend recognizes the requests to the object stores other than GCS the proxy encrypts
+for, AWS S3 and Azure Blob Storage, with -backends=s3,azure. Their buckets are named in the key
+mapping with the backend as prefix, so they never collide with GCS bucket names:
+
+	s3/BUCKET                    https://BUCKET.s3.REGION.amazonaws.com/KEY, or path style
+	azure/ACCOUNT/CONTAINER      https://ACCOUNT.blob.core.windows.net/CONTAINER/BLOB
+
+Objects carry the same envelope and proxy metadata as in GCS, in the user metadata headers of
+the backend: x-amz-meta-x-encryption-key in S3, x-ms-meta-x_encryption_key in Azure, whose
+metadata names are C# identifiers.
+*/
+package backend
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// Backend is an object store and its conventions
+type Backend struct {
+	Name       string // in -backends and the bucket names of the key mapping
+	MetaPrefix string // of the user metadata headers
+	metaName   func(string) string
+}
+
+var (
+	S3    = &Backend{Name: "s3", MetaPrefix: "x-amz-meta-", metaName: func(name string) string { return name }}
+	Azure = &Backend{Name: "azure", MetaPrefix: "x-ms-meta-", metaName: func(name string) string {
+		return strings.ReplaceAll(name, "-", "_")
+	}}
+)
+
+// Backends lists the backends by name
+var Backends = map[string]*Backend{S3.Name: S3, Azure.Name: Azure}
+
+// the S3 endpoints of a region, virtual hosted style when prefixed by a bucket: s3, s3.REGION,
+// s3-REGION and their dualstack variants
+var s3HostPattern = regexp.MustCompile(`^(?:(.+)\.)?s3(?:\.dualstack)?(?:[.-][a-z]{2}(?:-[a-z]+)+-\d+)?\.amazonaws\.com(?:\.cn)?$`)
+
+// the Blob Storage endpoints of an account in the public and sovereign clouds
+var azureHostPattern = regexp.MustCompile(`^([a-z0-9]{3,24})\.blob\.core\.(?:windows\.net|usgovcloudapi\.net|chinacloudapi\.cn)$`)
+
+// Object is the object of a request to a backend
+type Object struct {
+	*Backend
+	Bucket string // as named in the key mapping, e.g. s3/my-bucket
+	Name   string // the S3 key or Azure blob name, empty for requests of the bucket itself
+}
+
+func (o Object) String() string {
+	return o.Backend.Name + "://" + strings.TrimPrefix(o.Bucket, o.Backend.Name+"/") + "/" + o.Name
+}
+
+// Of returns the object f names when it is sent to an enabled backend
+func Of(f *proxy.Flow) (Object, bool) {
+	config := cfg.For(f)
+	if config == nil || len(config.Backends) == 0 {
+		return Object{}, false
+	}
+	host := strings.ToLower(f.Request.URL.Hostname())
+	path := strings.TrimPrefix(f.Request.URL.Path, "/")
+	if m := s3HostPattern.FindStringSubmatch(host); m != nil && enabled(config, S3) {
+		bucket := m[1]
+		if bucket == "" {
+			// path style, /BUCKET/KEY
+			bucket, path, _ = strings.Cut(path, "/")
+		}
+		if bucket == "" {
+			return Object{}, false
+		}
+		return Object{Backend: S3, Bucket: S3.Name + "/" + bucket, Name: path}, true
+	}
+	if m := azureHostPattern.FindStringSubmatch(host); m != nil && enabled(config, Azure) {
+		container, blob, _ := strings.Cut(path, "/")
+		if container == "" {
+			return Object{}, false
+		}
+		return Object{Backend: Azure, Bucket: Azure.Name + "/" + m[1] + "/" + container, Name: blob}, true
+	}
+	return Object{}, false
+}
+
+func enabled(config *cfg.Config, b *Backend) bool {
+	return slices.Contains(config.Backends, b.Name)
+}
+
+// MetaHeader returns the header the proxy metadata key is sent in, key as util.MetaKey names it
+func (b *Backend) MetaHeader(key string) string {
+	return b.MetaPrefix + b.metaName(key)
+}
+
+// Metadata returns the proxy metadata recorded in the headers of a response, by the keys
+// util.Meta and util.ProvenanceOf look up
+func (b *Backend) Metadata(header http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for _, name := range util.ProxyMetadataNames {
+		for _, key := range []string{util.MetaKey(name), util.LegacyMetadataPrefix + name} {
+			if value := header.Get(b.MetaHeader(key)); value != "" {
+				metadata[key] = value
+			}
+		}
+	}
+	return metadata
+}
+
+// ReservedMetadata returns the user metadata headers of a request the proxy would overwrite
+func (b *Backend) ReservedMetadata(header http.Header) []string {
+	var names []string
+	for _, name := range util.ProxyMetadataNames {
+		if header.Get(b.MetaHeader(util.MetaKey(name))) != "" {
+			names = append(names, b.MetaHeader(util.MetaKey(name)))
+		}
+	}
+	// the legacy proxy version would have the legacy keys read as the proxy's
+	if legacy := util.LegacyMetadataPrefix + util.MetaProxyVersion; legacy != util.MetaKey(util.MetaProxyVersion) && header.Get(b.MetaHeader(legacy)) != "" {
+		names = append(names, b.MetaHeader(legacy))
+	}
+	return names
+}
+
+// Operation is what a request does with the data of an object
+type Operation int
+
+const (
+	Other       Operation = iota // no object data, or data copied as it is stored: metadata, listings, copies, deletes
+	Upload                       // the whole object in one request
+	Download                     // reads the object data
+	Unsupported                  // writes data the proxy can't encrypt, e.g. S3 multipart uploads or Azure blocks
+)
+
+// the S3 subresources of an object that carry no object data
+var s3Subresources = []string{"acl", "tagging", "attributes", "legal-hold", "retention", "torrent", "restore", "select"}
+
+// Operation returns what f does with o, and why the proxy can't encrypt it when Unsupported
+func (o Object) Operation(f *proxy.Flow) (Operation, string) {
+	if o.Name == "" {
+		return Other, ""
+	}
+	query := f.Request.URL.Query()
+	if o.Backend == Azure {
+		return o.azureOperation(f, query)
+	}
+	for _, subresource := range s3Subresources {
+		if query.Has(subresource) {
+			return Other, ""
+		}
+	}
+	switch f.Request.Method {
+	case http.MethodGet:
+		if query.Has("uploadId") {
+			// the parts of a multipart upload
+			return Other, ""
+		}
+		return Download, ""
+	case http.MethodPost:
+		if query.Has("uploads") || query.Has("uploadId") {
+			return Unsupported, "S3 multipart uploads are not supported for encrypted buckets, use single PUT uploads"
+		}
+	case http.MethodPut:
+		if f.Request.Header.Get("x-amz-copy-source") != "" {
+			return Other, ""
+		}
+		if query.Has("uploadId") || query.Has("partNumber") {
+			return Unsupported, "S3 multipart uploads are not supported for encrypted buckets, use single PUT uploads"
+		}
+		if strings.HasPrefix(f.Request.Header.Get("x-amz-content-sha256"), "STREAMING-") ||
+			strings.Contains(f.Request.Header.Get("Content-Encoding"), "aws-chunked") {
+			return Unsupported, "aws-chunked payloads can't be encrypted, send the payload in one piece"
+		}
+		return Upload, ""
+	}
+	return Other, ""
+}
+
+func (o Object) azureOperation(f *proxy.Flow, query url.Values) (Operation, string) {
+	// Shared Key signs the length, the MD5 and the x-ms- headers the proxy changes
+	sharedKey := strings.HasPrefix(f.Request.Header.Get("Authorization"), "SharedKey ")
+	switch f.Request.Method {
+	case http.MethodGet:
+		if query.Has("comp") {
+			return Other, ""
+		}
+		if sharedKey && (f.Request.Header.Get("Range") != "" || f.Request.Header.Get("x-ms-range") != "") {
+			return Unsupported, "ranged reads signed with a Shared Key can't be decrypted, use a SAS or an Entra ID token"
+		}
+		return Download, ""
+	case http.MethodPut:
+		switch query.Get("comp") {
+		case "":
+		case "block", "blocklist", "appendblock", "page":
+			return Unsupported, "Azure block, append and page uploads are not supported for encrypted containers, use single Put Blob uploads"
+		default:
+			return Other, ""
+		}
+		if f.Request.Header.Get("x-ms-copy-source") != "" {
+			return Other, ""
+		}
+		if blobType := f.Request.Header.Get("x-ms-blob-type"); blobType != "BlockBlob" {
+			return Unsupported, "Azure " + blobType + " uploads are not supported for encrypted containers, use block blobs"
+		}
+		if sharedKey {
+			return Unsupported, "uploads signed with a Shared Key can't be encrypted, use a SAS or an Entra ID token"
+		}
+		return Upload, ""
+	}
+	return Other, ""
+}
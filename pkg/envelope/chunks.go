@@ -0,0 +1,145 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package envelope
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/core/registry"
+	"github.com/google/tink/go/tink"
+)
+
+/*
+	An envelope whose header has a chunk size encrypts every chunk of the plaintext on its own,
+	with one DEK for the whole object:
+
+	offset  size  field
+	0       22    envelope header, chunk size S and chunk count C
+	22      4     length N of the wrapped DEK
+	26      N     wrapped DEK, as in single chunk envelopes
+	26+N    ...   C chunks: AES-256-GCM, 12 byte IV, ciphertext and 16 byte tag
+
+	Chunk i is encrypted with the 22 header bytes, the PartAssociatedData of a part of an XML
+	multipart upload, and i as a 4 byte big-endian integer as associated data, so chunks can't be
+	dropped, reordered or moved to another object. Every chunk
+	but the last holds S plaintext bytes, chunk i starts at 26+N+i*(S+28).
+*/
+
+const (
+	ivSize  = 12
+	tagSize = 16
+
+	// ChunkOverhead is the ciphertext size of a chunk beyond its plaintext
+	ChunkOverhead = ivSize + tagSize
+)
+
+// NewChunkedHeader describes a plaintext encrypted in chunks of chunkSize bytes, the last one
+// shorter. An empty plaintext is a single chunk without a chunk size.
+func NewChunkedHeader(plaintextLength int, chunkSize uint32) Header {
+	h := NewHeader(plaintextLength)
+	if plaintextLength == 0 || chunkSize == 0 {
+		return h
+	}
+	h.ChunkSize = chunkSize
+	h.ChunkCount = uint32((uint64(plaintextLength) + uint64(chunkSize) - 1) / uint64(chunkSize))
+	return h
+}
+
+// ChunkAssociatedData is the associated data chunk i of an envelope is encrypted with,
+// associatedData is its header and part binding
+func ChunkAssociatedData(associatedData []byte, i int) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte(nil), associatedData...), uint32(i))
+}
+
+// EncryptChunked encrypts plaintext into a chunked envelope described by h, e.g. from
+// NewChunkedHeader, with a new DEK wrapped by kek. binding is authenticated after the header, the
+// PartAssociatedData of a part or nil.
+func EncryptChunked(kek tink.AEAD, h Header, plaintext []byte, binding []byte) ([]byte, error) {
+	if h.ChunkSize == 0 || h.PlaintextLength != uint64(len(plaintext)) {
+		return nil, fmt.Errorf("header %+v does not describe chunks of a %v byte plaintext", h, len(plaintext))
+	}
+	keyData, err := registry.NewKeyData(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DEK: %v", err)
+	}
+	wrappedDEK, err := kek.Encrypt(keyData.Value, []byte{})
+	if err != nil {
+		return nil, err
+	}
+	dek, err := chunkAEAD(keyData.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	header := h.Marshal()
+	associatedData := append(append([]byte(nil), header...), binding...)
+	object := make([]byte, 0, HeaderSize+4+len(wrappedDEK)+int(h.ChunkCount)*ChunkOverhead+len(plaintext))
+	object = append(object, header...)
+	object = binary.BigEndian.AppendUint32(object, uint32(len(wrappedDEK)))
+	object = append(object, wrappedDEK...)
+	for i := 0; i < int(h.ChunkCount); i++ {
+		start := i * int(h.ChunkSize)
+		end := min(start+int(h.ChunkSize), len(plaintext))
+		chunk, err := dek.Encrypt(plaintext[start:end], ChunkAssociatedData(associatedData, i))
+		if err != nil {
+			return nil, fmt.Errorf("error encrypting chunk %v: %v", i, err)
+		}
+		object = append(object, chunk...)
+	}
+	return object, nil
+}
+
+// decryptChunked decrypts an envelope whose header h has a chunk size
+func decryptChunked(kek tink.AEAD, object []byte, h Header, binding []byte) ([]byte, error) {
+	e, err := Parse(object)
+	if err != nil {
+		return nil, err
+	}
+	serializedDEK, err := kek.Decrypt(e.WrappedDEK, []byte{})
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data: %w", err)
+	}
+	dek, err := chunkAEAD(serializedDEK)
+	if err != nil {
+		return nil, err
+	}
+
+	associatedData := append(append([]byte(nil), object[:HeaderSize]...), binding...)
+	plaintext := make([]byte, 0, h.PlaintextLength)
+	chunks := e.Payload
+	for i := 0; i < int(h.ChunkCount); i++ {
+		n, _ := h.ChunkPlaintextLength(i)
+		size := n + ChunkOverhead
+		if uint64(len(chunks)) < size {
+			return nil, fmt.Errorf("truncated envelope, chunk %v of %v is missing", i, h.ChunkCount)
+		}
+		chunk, err := dek.Decrypt(chunks[:size], ChunkAssociatedData(associatedData, i))
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting data: chunk %v: %w", i, err)
+		}
+		plaintext = append(plaintext, chunk...)
+		chunks = chunks[size:]
+	}
+	if len(chunks) != 0 {
+		return nil, fmt.Errorf("%v bytes after the last chunk of the envelope", len(chunks))
+	}
+	return plaintext, nil
+}
+
+// chunkAEAD is the AES-256-GCM primitive of a serialized DEK, without a Tink output prefix
+func chunkAEAD(serializedDEK []byte) (tink.AEAD, error) {
+	p, err := registry.Primitive(aead.AES256GCMKeyTemplate().TypeUrl, serializedDEK)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEK: %v", err)
+	}
+	dek, ok := p.(tink.AEAD)
+	if !ok {
+		return nil, fmt.Errorf("DEK is not an AEAD key")
+	}
+	return dek, nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package envelope reads the objects go-gcsproxy writes to GCS, so other Go programs can decrypt
+them without going through the proxy.
+
+# Format, version 1
+
+All integers are big-endian.
+
+	offset  size  field
+	0       22    envelope header, see Header
+	22      4     length N of the wrapped DEK
+	26      N     wrapped DEK
+	26+N    ...   payload
+
+Everything after the header is exactly the ciphertext of Tink's KMS envelope AEAD
+(aead.NewKMSEnvelopeAEAD2 with aead.AES256GCMKeyTemplate), encrypted with the 22 header bytes as
+associated data. Any Tink implementation can therefore decrypt it by stripping the header and
+passing it as associated data:
+
+  - the wrapped DEK is a serialized google.crypto.tink.AesGcmKey proto encrypted by Cloud KMS
+    without associated data.
+  - the payload is AES-256-GCM without a Tink output prefix: 12 byte IV, ciphertext, 16 byte tag.
+
+When the header has FlagEscrow set the wrapped DEK field holds two copies of the DEK, see
+SplitWrappedKeys. Tink readers must pick one of them before unwrapping.
+
+A proxy running with its key hierarchy wraps the DEK with a key encryption key of the bucket
+instead, which the KMS key wraps, see JoinKekWrapped. Such a wrapped DEK field starts with "GCSK":
+Tink readers have to unwrap it with UnwrapWithKek, NewKMSKeyEncryptionKey does so for Decrypt.
+Objects whose gcsproxy-encryption-key is hybrid/NAME have their DEK wrapped by the Tink hybrid keyset
+NAME instead of KMS: pass Decrypt a tink.AEAD that unwraps it with the keyset's HybridDecrypt.
+
+# Chunked envelopes
+
+A header with a chunk size describes an object encrypted in chunks under one DEK, see
+EncryptChunked. The wrapped DEK is followed by the chunks, each an AES-256-GCM IV, ciphertext and
+tag encrypted with the header and the 4 byte big-endian chunk index as associated data, see
+ChunkAssociatedData. Tink readers unwrap the DEK with the KMS key, without associated data, and
+decrypt every chunk with it. Decrypt does so.
+
+# Concatenated envelopes
+
+The parts of an XML multipart upload are encrypted independently, each into a complete envelope
+with its own DEK, and GCS stores their concatenation. The header's plaintext length and the wrapped
+DEK length give the size of every envelope, see Length, so Decrypt decrypts them one after the
+other. Tink readers have to split the object the same way.
+
+The parts of the proxy's current uploads have FlagPart set and are encrypted with the upload id
+and part number after the header as associated data, see PartAssociatedData. The order of their
+part numbers is in a PartManifest, sealed into an envelope with FlagManifest and
+ManifestAssociatedData and stored base64 in the gcsproxy-parts metadata. DecryptParts reads them
+with it and fails for parts that were reordered, dropped or taken from another upload.
+
+Objects written before the header was introduced (no envelope-version metadata) are a bare
+Tink ciphertext encrypted without associated data. Decrypt handles both.
+
+Other Tink clients, the GCS client-side encryption samples for Java and Python among them, write
+the same bare ciphertext, often with associated data such as the object's path. DecryptBare
+decrypts them. To read the proxy's objects they strip the header and pass it as associated data:
+
+	header, ciphertext := object[:envelope.HeaderSize], object[envelope.HeaderSize:]
+	plaintext, err := kmsEnvelopeAead.Decrypt(ciphertext, header)
+
+# Reading objects
+
+	plaintext, err := envelope.DecryptWithKMS(ctx, attrs.Metadata["gcsproxy-encryption-key"], object)
+
+Objects of XML multipart uploads also need their part manifest:
+
+	manifest, err := base64.StdEncoding.DecodeString(attrs.Metadata["gcsproxy-parts"])
+	kek, err := envelope.NewKMSKeyEncryptionKey(ctx, attrs.Metadata["gcsproxy-encryption-key"])
+	plaintext, err := envelope.DecryptParts(kek, object, manifest)
+
+The GCS object metadata records gcsproxy-envelope-version, gcsproxy-encryption-key (the KMS
+key), gcsproxy-encryption-key-version, gcsproxy-unencrypted-content-length, gcsproxy-md5Hash and
+gcsproxy-crc32c of the plaintext, and with escrow enabled gcsproxy-escrow-key. The keys carry the
+proxy's -metadata_prefix instead of gcsproxy- when it is set, objects of proxies before the prefix
+have them with x-.
+*/
+package envelope
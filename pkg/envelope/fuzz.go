@@ -0,0 +1,68 @@
+//go:build gofuzz
+
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+package envelope
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Fuzz is the go-fuzz target of the envelope parsers, objects are read from GCS and may have been
+// written by anyone with access to the bucket:
+//
+//	go-fuzz-build -tags gofuzz ./pkg/envelope && go-fuzz -bin envelope-fuzz.zip -workdir test/fuzz/envelope
+//
+// It panics when a parsed header does not marshal back to the same bytes or describes chunks
+// that don't add up to its plaintext length, or when Length names more bytes than the object has.
+func Fuzz(data []byte) int {
+	interesting := 0
+	if h, err := ParseHeader(data); err == nil {
+		interesting = 1
+		if !bytes.Equal(h.Marshal(), data[:HeaderSize]) {
+			panic(fmt.Sprintf("header %+v marshals to %x, parsed from %x", h, h.Marshal(), data[:HeaderSize]))
+		}
+		// the chunk lengths of every parsed header add up, checked for the layouts of a few chunks
+		if h.ChunkCount <= 1024 {
+			var total uint64
+			for i := 0; i < int(h.ChunkCount); i++ {
+				n, err := h.ChunkPlaintextLength(i)
+				if err != nil {
+					panic(fmt.Sprintf("chunk %v of header %+v: %v", i, h, err))
+				}
+				total += n
+			}
+			if total != h.PlaintextLength {
+				panic(fmt.Sprintf("chunks of header %+v hold %v bytes", h, total))
+			}
+		}
+		if _, err := h.ChunkPlaintextLength(int(h.ChunkCount)); err == nil {
+			panic(fmt.Sprintf("header %+v has a chunk past its last", h))
+		}
+	}
+	if n, err := Length(data); err == nil && (n > len(data) || n < HeaderSize) {
+		panic(fmt.Sprintf("envelope length %v of a %v byte object", n, len(data)))
+	}
+
+	e, err := Parse(data)
+	if err != nil {
+		return interesting
+	}
+	if e.Header != nil && e.Header.Flags&FlagEscrow != 0 {
+		primary, escrow, err := SplitWrappedKeys(e.WrappedDEK)
+		if err == nil && len(primary)+len(escrow) > len(e.WrappedDEK) {
+			panic(fmt.Sprintf("wrapped keys of %v and %v bytes in a %v byte field", len(primary), len(escrow), len(e.WrappedDEK)))
+		}
+	}
+	if wrappedKek, wrappedDek, ok := SplitKekWrapped(e.WrappedDEK); ok {
+		if !bytes.Equal(JoinKekWrapped(wrappedKek, wrappedDek), e.WrappedDEK) {
+			panic(fmt.Sprintf("KEK wrapped DEK %x does not join back", e.WrappedDEK))
+		}
+	}
+	return 1
+}
@@ -0,0 +1,32 @@
+//go:build gofuzz
+
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+package envelope
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// FuzzEnvelope runs Fuzz with go test's native fuzzing, seeded with the go-fuzz corpus:
+//
+//	go test -tags gofuzz -fuzz FuzzEnvelope ./pkg/envelope
+func FuzzEnvelope(f *testing.F) {
+	seeds, _ := filepath.Glob("../../test/fuzz/envelope/corpus/*")
+	for _, seed := range seeds {
+		data, err := os.ReadFile(seed)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Fuzz(data)
+	})
+}
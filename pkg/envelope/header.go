@@ -0,0 +1,125 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package envelope
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	Version    = 1
+	HeaderSize = 22
+
+	// the wrapped DEK field holds a copy wrapped by the primary key and one wrapped by the
+	// escrow key, see SplitWrappedKeys
+	FlagEscrow uint8 = 1 << 0
+	// a part of an XML multipart upload, encrypted with PartAssociatedData, see DecryptParts
+	FlagPart uint8 = 1 << 1
+	// the part manifest of an XML multipart upload, see PartManifest
+	FlagManifest uint8 = 1 << 2
+)
+
+var envelopeMagic = []byte("GCSP")
+
+/*
+Header is the fixed size header at the start of every object. It is passed to the AEAD as
+associated data, a modified header fails decryption.
+
+	offset  size  field
+	0       4     magic "GCSP"
+	4       1     envelope version (1)
+	5       1     flags, see FlagEscrow, FlagPart and FlagManifest
+	6       8     plaintext length of the whole object
+	14      4     plaintext chunk size, 0 when the object is encrypted as one chunk
+	18      4     number of chunks
+
+Every chunk but the last holds exactly chunk size plaintext bytes, so the plaintext length of
+any chunk follows from the header alone.
+*/
+type Header struct {
+	Version         uint8
+	Flags           uint8
+	PlaintextLength uint64
+	ChunkSize       uint32
+	ChunkCount      uint32
+}
+
+// NewHeader describes a plaintext encrypted as a single chunk.
+func NewHeader(plaintextLength int) Header {
+	return Header{
+		Version:         Version,
+		PlaintextLength: uint64(plaintextLength),
+		ChunkCount:      1,
+	}
+}
+
+func (h Header) Marshal() []byte {
+	b := make([]byte, HeaderSize)
+	copy(b[0:4], envelopeMagic)
+	b[4] = h.Version
+	b[5] = h.Flags
+	binary.BigEndian.PutUint64(b[6:14], h.PlaintextLength)
+	binary.BigEndian.PutUint32(b[14:18], h.ChunkSize)
+	binary.BigEndian.PutUint32(b[18:22], h.ChunkCount)
+	return b
+}
+
+// ChunkPlaintextLength returns the plaintext length of chunk i.
+func (h Header) ChunkPlaintextLength(i int) (uint64, error) {
+	if i < 0 || uint32(i) >= h.ChunkCount {
+		return 0, fmt.Errorf("chunk %v out of range, object has %v chunks", i, h.ChunkCount)
+	}
+	if h.ChunkSize == 0 {
+		return h.PlaintextLength, nil
+	}
+	if uint32(i) < h.ChunkCount-1 {
+		return uint64(h.ChunkSize), nil
+	}
+	return h.PlaintextLength - uint64(h.ChunkCount-1)*uint64(h.ChunkSize), nil
+}
+
+// HasHeader reports whether ciphertext starts with an envelope header.
+func HasHeader(ciphertext []byte) bool {
+	return len(ciphertext) >= HeaderSize && bytes.Equal(ciphertext[0:4], envelopeMagic)
+}
+
+// ParseHeader reads the envelope header at the start of ciphertext.
+func ParseHeader(ciphertext []byte) (Header, error) {
+	if !HasHeader(ciphertext) {
+		return Header{}, fmt.Errorf("missing envelope header")
+	}
+	h := Header{
+		Version:         ciphertext[4],
+		Flags:           ciphertext[5],
+		PlaintextLength: binary.BigEndian.Uint64(ciphertext[6:14]),
+		ChunkSize:       binary.BigEndian.Uint32(ciphertext[14:18]),
+		ChunkCount:      binary.BigEndian.Uint32(ciphertext[18:22]),
+	}
+	if h.Version != Version {
+		return Header{}, fmt.Errorf("unsupported envelope version %v", h.Version)
+	}
+	if h.Flags&^(FlagEscrow|FlagPart|FlagManifest) != 0 || h.Flags&(FlagPart|FlagManifest) == FlagPart|FlagManifest {
+		return Header{}, fmt.Errorf("unsupported envelope flags %#x", h.Flags)
+	}
+	if h.ChunkCount == 0 || (h.ChunkSize == 0 && h.ChunkCount != 1) {
+		return Header{}, fmt.Errorf("invalid envelope chunk layout: size %v count %v", h.ChunkSize, h.ChunkCount)
+	}
+	if h.ChunkCount > 1 && uint64(h.ChunkCount-1)*uint64(h.ChunkSize) >= h.PlaintextLength {
+		return Header{}, fmt.Errorf("invalid envelope chunk layout: %v chunks of %v for %v bytes", h.ChunkCount, h.ChunkSize, h.PlaintextLength)
+	}
+	return h, nil
+}
+
+// PlaintextLength returns the plaintext size recorded in the envelope header without decrypting.
+func PlaintextLength(ciphertext []byte) (int, bool) {
+	h, err := ParseHeader(ciphertext)
+	if err != nil {
+		return 0, false
+	}
+	return int(h.PlaintextLength), true
+}
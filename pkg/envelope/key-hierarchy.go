@@ -0,0 +1,120 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/tink/go/tink"
+)
+
+/*
+	With the proxy's key hierarchy (-kek_ttl) the DEK is not wrapped by the KMS key itself but by a
+	key encryption key (KEK) of the bucket, which the KMS key wraps. The wrapped DEK field of the
+	Tink envelope then holds:
+
+	offset  size  field
+	0       4     magic "GCSK"
+	4       4     length K of the wrapped KEK
+	8       K     256 bit KEK wrapped by the KMS key, without associated data
+	8+K     ...   DEK wrapped by the KEK: AES-256-GCM, 12 byte IV, ciphertext and 16 byte tag
+
+	With FlagEscrow each of the two copies of the DEK is such a field.
+*/
+
+var kekMagic = []byte("GCSK")
+
+// KekSize is the size of the key encryption keys of the key hierarchy
+const KekSize = 32
+
+// JoinKekWrapped builds the wrapped DEK field of the key hierarchy.
+func JoinKekWrapped(wrappedKek []byte, wrappedDek []byte) []byte {
+	blob := make([]byte, 0, 8+len(wrappedKek)+len(wrappedDek))
+	blob = append(blob, kekMagic...)
+	blob = binary.BigEndian.AppendUint32(blob, uint32(len(wrappedKek)))
+	blob = append(blob, wrappedKek...)
+	return append(blob, wrappedDek...)
+}
+
+// SplitKekWrapped returns the wrapped KEK of a wrapped DEK field and the DEK wrapped by it. ok is
+// false when the DEK was wrapped by the KMS key directly.
+func SplitKekWrapped(blob []byte) (wrappedKek []byte, wrappedDek []byte, ok bool) {
+	if len(blob) < 8 || string(blob[:4]) != string(kekMagic) {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(blob[4:])
+	if uint64(n) > uint64(len(blob)-8) {
+		return nil, nil, false
+	}
+	return blob[8 : 8+n], blob[8+n:], true
+}
+
+// WrapWithKek wraps dek with the KEK kek, authenticating associatedData.
+func WrapWithKek(kek []byte, dek []byte, associatedData []byte) ([]byte, error) {
+	gcm, err := kekCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(iv, iv, dek, associatedData), nil
+}
+
+// UnwrapWithKek unwraps a DEK wrapped by WrapWithKek.
+func UnwrapWithKek(kek []byte, wrappedDek []byte, associatedData []byte) ([]byte, error) {
+	gcm, err := kekCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrappedDek) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("truncated KEK wrapped DEK")
+	}
+	iv, ciphertext := wrappedDek[:gcm.NonceSize()], wrappedDek[gcm.NonceSize():]
+	dek, err := gcm.Open(nil, iv, ciphertext, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap the DEK with its KEK: %v", err)
+	}
+	return dek, nil
+}
+
+func kekCipher(kek []byte) (cipher.AEAD, error) {
+	if len(kek) != KekSize {
+		return nil, fmt.Errorf("invalid KEK of %v bytes", len(kek))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// kekReader unwraps the DEKs of both kinds with a KMS key, the KEKs of the key hierarchy are
+// unwrapped for every object.
+type kekReader struct {
+	kms tink.AEAD
+}
+
+func (r *kekReader) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	return nil, fmt.Errorf("kekReader can only decrypt")
+}
+
+func (r *kekReader) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	wrappedKek, wrappedDek, ok := SplitKekWrapped(ciphertext)
+	if !ok {
+		return r.kms.Decrypt(ciphertext, associatedData)
+	}
+	kek, err := r.kms.Decrypt(wrappedKek, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap the KEK: %w", err)
+	}
+	return UnwrapWithKek(kek, wrappedDek, associatedData)
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package envelope
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/tink/go/tink"
+)
+
+/*
+	Every part of an XML multipart upload is an envelope with FlagPart, encrypted with its upload id
+	and part number as associated data after the header, see PartAssociatedData. The object GCS
+	assembles is their concatenation. The order and number of the parts are recorded when the
+	upload completes, in a manifest sealed into an envelope with FlagManifest:
+
+	offset  size  field
+	0       2     length U of the upload id
+	2       U     upload id
+	2+U     4     number of runs R
+	6+U     8*R   runs of consecutive part numbers: first part number and number of parts, 4 bytes each
+
+	DecryptParts decrypts the parts with the part numbers of the manifest in turn and fails when
+	a part is missing, added, moved or comes from another upload.
+*/
+
+// maxManifestRuns keeps the sealed manifest small enough for the object metadata
+const maxManifestRuns = 64
+
+// PartManifest lists the parts an XML multipart upload was completed with, in their order
+type PartManifest struct {
+	UploadID string
+	Parts    []int // ascending part numbers
+}
+
+// PartAssociatedData is the binding of part partNumber of upload uploadID, authenticated after
+// the header of its envelope
+func PartAssociatedData(uploadID string, partNumber int) []byte {
+	binding := append([]byte("part"), binary.BigEndian.AppendUint32(nil, uint32(partNumber))...)
+	return append(binding, uploadID...)
+}
+
+// ManifestAssociatedData is the binding of a part manifest, authenticated after the header of its
+// envelope
+func ManifestAssociatedData() []byte {
+	return []byte("manifest")
+}
+
+// Marshal encodes the manifest, the plaintext of its sealed envelope
+func (m PartManifest) Marshal() ([]byte, error) {
+	if len(m.UploadID) == 0 || len(m.UploadID) > 0xffff {
+		return nil, fmt.Errorf("invalid upload id of %v bytes", len(m.UploadID))
+	}
+	var runs [][2]uint32
+	for i, part := range m.Parts {
+		if part < 1 || (i > 0 && part <= m.Parts[i-1]) {
+			return nil, fmt.Errorf("part numbers %v are not ascending", m.Parts)
+		}
+		if n := len(runs); n > 0 && uint32(part) == runs[n-1][0]+runs[n-1][1] {
+			runs[n-1][1]++
+			continue
+		}
+		runs = append(runs, [2]uint32{uint32(part), 1})
+	}
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("manifest without parts")
+	}
+	if len(runs) > maxManifestRuns {
+		return nil, fmt.Errorf("part numbers %v have more than %v gaps", m.Parts, maxManifestRuns-1)
+	}
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(m.UploadID)))
+	b = append(b, m.UploadID...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(runs)))
+	for _, run := range runs {
+		b = binary.BigEndian.AppendUint32(b, run[0])
+		b = binary.BigEndian.AppendUint32(b, run[1])
+	}
+	return b, nil
+}
+
+// ParsePartManifest decodes the plaintext of a sealed manifest
+func ParsePartManifest(b []byte) (PartManifest, error) {
+	if len(b) < 2 {
+		return PartManifest{}, fmt.Errorf("truncated part manifest")
+	}
+	u := int(binary.BigEndian.Uint16(b))
+	if u == 0 || len(b) < 2+u+4 {
+		return PartManifest{}, fmt.Errorf("truncated part manifest")
+	}
+	m := PartManifest{UploadID: string(b[2 : 2+u])}
+	r := binary.BigEndian.Uint32(b[2+u:])
+	runs := b[2+u+4:]
+	if r == 0 || r > maxManifestRuns || uint64(len(runs)) != 8*uint64(r) {
+		return PartManifest{}, fmt.Errorf("invalid part manifest of %v runs in %v bytes", r, len(runs))
+	}
+	next := uint64(1)
+	for ; len(runs) > 0; runs = runs[8:] {
+		first, count := uint64(binary.BigEndian.Uint32(runs)), uint64(binary.BigEndian.Uint32(runs[4:]))
+		if first < next || count == 0 || first+count > 1<<32 {
+			return PartManifest{}, fmt.Errorf("invalid part manifest run of %v parts from %v", count, first)
+		}
+		for part := first; part < first+count; part++ {
+			m.Parts = append(m.Parts, int(part))
+		}
+		next = first + count
+	}
+	return m, nil
+}
+
+// decryptParts decrypts the part envelopes of an XML multipart upload in the order and number the
+// sealed manifest lists them
+func decryptParts(kek tink.AEAD, object []byte, useEscrow bool, sealedManifest []byte) ([]byte, error) {
+	if len(sealedManifest) == 0 {
+		return nil, fmt.Errorf("XML multipart upload without its part manifest")
+	}
+	h, err := ParseHeader(sealedManifest)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the part manifest: %v", err)
+	}
+	if h.Flags&FlagManifest == 0 {
+		return nil, fmt.Errorf("the part manifest is not sealed as one")
+	}
+	encoded, err := decryptEnvelope(kek, sealedManifest, useEscrow, ManifestAssociatedData())
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting the part manifest: %w", err)
+	}
+	m, err := ParsePartManifest(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext []byte
+	i := 0
+	for ; len(object) > 0; i++ {
+		if i == len(m.Parts) {
+			return nil, fmt.Errorf("%v bytes after the %v parts of the part manifest", len(object), len(m.Parts))
+		}
+		length, err := Length(object)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing part %v: %v", m.Parts[i], err)
+		}
+		if h, _ := ParseHeader(object); h.Flags&FlagPart == 0 {
+			return nil, fmt.Errorf("envelope of part %v is not a part", m.Parts[i])
+		}
+		part, err := decryptEnvelope(kek, object[:length], useEscrow, PartAssociatedData(m.UploadID, m.Parts[i]))
+		if err != nil {
+			return nil, fmt.Errorf("part %v: %w", m.Parts[i], err)
+		}
+		plaintext = append(plaintext, part...)
+		object = object[length:]
+	}
+	if i < len(m.Parts) {
+		return nil, fmt.Errorf("%v of the %v parts of the part manifest", i, len(m.Parts))
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package envelope
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/integration/gcpkms"
+	"github.com/google/tink/go/tink"
+)
+
+// Envelope is a parsed object, see the package documentation for the layout.
+type Envelope struct {
+	Header     *Header // nil for objects written before the header existed
+	WrappedDEK []byte  // both copies with FlagEscrow, see SplitWrappedKeys
+	Payload    []byte  // AES-256-GCM: IV, ciphertext and tag. the chunks of chunked envelopes
+}
+
+// Parse splits an object into its parts without decrypting it.
+func Parse(object []byte) (*Envelope, error) {
+	e := &Envelope{}
+	tinkCiphertext := object
+	if HasHeader(object) {
+		h, err := ParseHeader(object)
+		if err != nil {
+			return nil, err
+		}
+		e.Header = &h
+		tinkCiphertext = object[HeaderSize:]
+	}
+
+	if len(tinkCiphertext) < 4 {
+		return nil, fmt.Errorf("truncated envelope")
+	}
+	n := binary.BigEndian.Uint32(tinkCiphertext)
+	if uint64(n) > uint64(len(tinkCiphertext)-4) {
+		return nil, fmt.Errorf("invalid wrapped DEK length %v", n)
+	}
+	e.WrappedDEK = tinkCiphertext[4 : 4+n]
+	e.Payload = tinkCiphertext[4+n:]
+	return e, nil
+}
+
+// Decrypt decrypts an object. kek is the remote AEAD of the KMS key recorded in the object's
+// x-encryption-key metadata, for example from NewKMSKeyEncryptionKey.
+func Decrypt(kek tink.AEAD, object []byte) ([]byte, error) {
+	return decrypt(kek, object, false, nil)
+}
+
+// DecryptParts decrypts an object like Decrypt, manifest is the sealed part manifest recorded
+// with an XML multipart upload, see PartManifest. Objects of other uploads ignore it.
+func DecryptParts(kek tink.AEAD, object []byte, manifest []byte) ([]byte, error) {
+	return decrypt(kek, object, false, manifest)
+}
+
+// DecryptBare decrypts the plain Tink KMS envelope AEAD ciphertext that Tink clients other than
+// the proxy write, without an envelope header, encrypted with associatedData.
+func DecryptBare(kek tink.AEAD, ciphertext []byte, associatedData []byte) ([]byte, error) {
+	envAEAD := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), kek)
+	if envAEAD == nil {
+		return nil, fmt.Errorf("failed to create KMS AEAD envelope")
+	}
+	plaintext, err := envAEAD.Decrypt(ciphertext, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data: %w", err)
+	}
+	return plaintext, nil
+}
+
+// DecryptWithEscrow decrypts an object written with escrow enabled using the DEK copy wrapped by
+// the escrow key recorded in the x-escrow-key metadata.
+func DecryptWithEscrow(escrowKek tink.AEAD, object []byte) ([]byte, error) {
+	return DecryptPartsWithEscrow(escrowKek, object, nil)
+}
+
+// DecryptPartsWithEscrow decrypts like DecryptWithEscrow, with the sealed part manifest of an XML
+// multipart upload as DecryptParts.
+func DecryptPartsWithEscrow(escrowKek tink.AEAD, object []byte, manifest []byte) ([]byte, error) {
+	h, err := ParseHeader(object)
+	if err != nil {
+		return nil, err
+	}
+	if h.Flags&FlagEscrow == 0 {
+		return nil, fmt.Errorf("object was written without an escrow copy of its key")
+	}
+	return decrypt(escrowKek, object, true, manifest)
+}
+
+// DecryptWithKMS decrypts an object with the Cloud KMS key
+// projects/<project>/locations/<location>/keyRings/<key-ring>/cryptoKeys/<key>
+// using application default credentials.
+func DecryptWithKMS(ctx context.Context, keyName string, object []byte) ([]byte, error) {
+	kek, err := NewKMSKeyEncryptionKey(ctx, keyName)
+	if err != nil {
+		return nil, err
+	}
+	return Decrypt(kek, object)
+}
+
+// NewKMSKeyEncryptionKey returns the remote AEAD unwrapping DEKs with a Cloud KMS key, directly
+// or through the KEK of the proxy's key hierarchy.
+func NewKMSKeyEncryptionKey(ctx context.Context, keyName string) (tink.AEAD, error) {
+	keyURI := "gcp-kms://" + keyName
+	kmsClient, err := gcpkms.NewClientWithOptions(ctx, keyURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create KMS client: %v", err)
+	}
+	kek, err := kmsClient.GetAEAD(keyURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create KMS AEAD client: %v", err)
+	}
+	return &kekReader{kms: kek}, nil
+}
+
+// Length returns the size of the envelope at the start of object, computed from its header and
+// wrapped DEK length, so the envelopes of a concatenation can be told apart.
+func Length(object []byte) (int, error) {
+	h, err := ParseHeader(object)
+	if err != nil {
+		return 0, err
+	}
+	if len(object) < HeaderSize+4 {
+		return 0, fmt.Errorf("truncated envelope")
+	}
+	n := uint64(binary.BigEndian.Uint32(object[HeaderSize:]))
+	// AES-256-GCM payload or chunks: 12 byte IV, ciphertext as long as the plaintext and 16 byte tag
+	length := uint64(HeaderSize) + 4 + n + uint64(h.ChunkCount)*ChunkOverhead + h.PlaintextLength
+	if length > uint64(len(object)) {
+		return 0, fmt.Errorf("truncated envelope, %v of %v bytes", len(object), length)
+	}
+	return int(length), nil
+}
+
+func decrypt(kek tink.AEAD, object []byte, useEscrow bool, manifest []byte) ([]byte, error) {
+	if HasHeader(object) {
+		if h, err := ParseHeader(object); err == nil && h.Flags&FlagPart != 0 {
+			return decryptParts(kek, object, useEscrow, manifest)
+		}
+		length, err := Length(object)
+		if err == nil && length < len(object) {
+			// an XML multipart upload of a proxy before the part manifests: one envelope per part
+			var plaintext []byte
+			for len(object) > 0 {
+				if length, err = Length(object); err != nil {
+					return nil, fmt.Errorf("error parsing the envelope after %v plaintext bytes: %v", len(plaintext), err)
+				}
+				if h, _ := ParseHeader(object); h.Flags&FlagPart != 0 {
+					return nil, fmt.Errorf("part envelope after %v plaintext bytes of an upload without parts", len(plaintext))
+				}
+				part, err := decryptEnvelope(kek, object[:length], useEscrow, nil)
+				if err != nil {
+					return nil, err
+				}
+				plaintext = append(plaintext, part...)
+				object = object[length:]
+			}
+			return plaintext, nil
+		}
+	}
+	return decryptEnvelope(kek, object, useEscrow, nil)
+}
+
+// decryptEnvelope decrypts a single envelope, binding is authenticated after its header
+func decryptEnvelope(kek tink.AEAD, object []byte, useEscrow bool, binding []byte) ([]byte, error) {
+	aad := []byte("")
+	ciphertext := object
+	var header *Header
+	if HasHeader(object) {
+		h, err := ParseHeader(object)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing envelope header: %v", err)
+		}
+		header = &h
+		aad = append(append([]byte(nil), object[:HeaderSize]...), binding...)
+		ciphertext = object[HeaderSize:]
+		if h.Flags&FlagEscrow != 0 {
+			kek = &wrappedKeyCopy{kek: kek, useEscrow: useEscrow}
+		}
+		if h.ChunkSize != 0 {
+			return decryptChunked(kek, object, h, binding)
+		}
+	}
+
+	envAEAD := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), kek)
+	if envAEAD == nil {
+		return nil, fmt.Errorf("failed to create KMS AEAD envelope")
+	}
+	plaintext, err := envAEAD.Decrypt(ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data: %w", err)
+	}
+	if header != nil && uint64(len(plaintext)) != header.PlaintextLength {
+		return nil, fmt.Errorf("decrypted length %v does not match envelope header length %v", len(plaintext), header.PlaintextLength)
+	}
+	return plaintext, nil
+}
+
+// wrappedKeyCopy unwraps one of the two DEK copies of an escrow envelope.
+type wrappedKeyCopy struct {
+	kek       tink.AEAD
+	useEscrow bool
+}
+
+func (w *wrappedKeyCopy) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	return nil, fmt.Errorf("wrappedKeyCopy can only decrypt")
+}
+
+func (w *wrappedKeyCopy) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	primaryWrapped, escrowWrapped, err := SplitWrappedKeys(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if w.useEscrow {
+		return w.kek.Decrypt(escrowWrapped, associatedData)
+	}
+	return w.kek.Decrypt(primaryWrapped, associatedData)
+}
@@ -0,0 +1,365 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package envelope
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+)
+
+// seal encrypts plaintext into a complete envelope, as the proxy encrypts an XML multipart part
+func seal(t *testing.T, kek tink.AEAD, plaintext []byte) []byte {
+	t.Helper()
+	header := NewHeader(len(plaintext)).Marshal()
+	ciphertext, err := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), kek).Encrypt(plaintext, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(header, ciphertext...)
+}
+
+func TestDecryptConcatenatedEnvelopes(t *testing.T) {
+	handle, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek, err := aead.New(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		parts []string
+		// changes the concatenation, nil keeps it
+		alter func(object []byte) []byte
+		err   bool
+	}{
+		{name: "one part", parts: []string{"hello world"}},
+		{name: "two parts", parts: []string{"hello ", "world"}},
+		{name: "many parts", parts: []string{"a", "bb", "ccc", "dddd", "eeeee"}},
+		{name: "empty part", parts: []string{"first", "", "last"}},
+		{name: "large part", parts: []string{string(bytes.Repeat([]byte("x"), 1<<20)), "tail"}},
+		{name: "truncated last part", parts: []string{"hello ", "world"},
+			alter: func(object []byte) []byte { return object[:len(object)-1] }, err: true},
+		{name: "trailing bytes", parts: []string{"hello ", "world"},
+			alter: func(object []byte) []byte { return append(object, 0) }, err: true},
+		{name: "corrupted second part", parts: []string{"hello ", "world"},
+			alter: func(object []byte) []byte { object[len(object)-1] ^= 1; return object }, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var object, want []byte
+			for _, part := range test.parts {
+				object = append(object, seal(t, kek, []byte(part))...)
+				want = append(want, part...)
+			}
+			if test.alter != nil {
+				object = test.alter(object)
+			}
+			got, err := Decrypt(kek, object)
+			switch {
+			case test.err && err == nil:
+				t.Fatal("decrypted an invalid concatenation")
+			case test.err:
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case !bytes.Equal(got, want):
+				t.Fatalf("got %v bytes, want %v bytes", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestLength(t *testing.T) {
+	handle, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek, err := aead.New(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := seal(t, kek, []byte("first part")), seal(t, kek, []byte("second"))
+
+	tests := []struct {
+		name   string
+		object []byte
+		want   int
+		err    bool
+	}{
+		{name: "envelope", object: first, want: len(first)},
+		{name: "concatenation", object: append(bytes.Clone(first), second...), want: len(first)},
+		{name: "truncated", object: first[:len(first)-1], err: true},
+		{name: "header only", object: first[:HeaderSize], err: true},
+		{name: "no header", object: []byte("plaintext"), err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Length(test.object)
+			switch {
+			case test.err && err == nil:
+				t.Fatalf("got %v, want an error", got)
+			case test.err:
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case got != test.want:
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecryptChunked(t *testing.T) {
+	handle, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek, err := aead.New(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const chunkSize = 1024
+	// the ciphertext offset of chunk i of an object with a wrapped DEK of n bytes
+	chunkAt := func(object []byte, i int) int {
+		n := int(binary.BigEndian.Uint32(object[HeaderSize:]))
+		return HeaderSize + 4 + n + i*(chunkSize+ChunkOverhead)
+	}
+
+	tests := []struct {
+		name  string
+		size  int
+		alter func(object []byte) []byte
+		err   bool
+	}{
+		{name: "one byte", size: 1},
+		{name: "one full chunk", size: chunkSize},
+		{name: "one chunk and a byte", size: chunkSize + 1},
+		{name: "many chunks", size: 10*chunkSize + 17},
+		{name: "empty", size: 0},
+		{name: "swapped chunks", size: 3 * chunkSize, err: true,
+			alter: func(object []byte) []byte {
+				first, second := chunkAt(object, 0), chunkAt(object, 1)
+				swapped := append(bytes.Clone(object[:first]), object[second:chunkAt(object, 2)]...)
+				swapped = append(swapped, object[first:second]...)
+				return append(swapped, object[chunkAt(object, 2):]...)
+			}},
+		{name: "dropped last chunk", size: 3 * chunkSize, err: true,
+			alter: func(object []byte) []byte { return object[:chunkAt(object, 2)] }},
+		{name: "dropped chunk and header count", size: 3 * chunkSize, err: true,
+			alter: func(object []byte) []byte {
+				binary.BigEndian.PutUint32(object[18:22], 2)
+				binary.BigEndian.PutUint64(object[6:14], 2*chunkSize)
+				return object[:chunkAt(object, 2)]
+			}},
+		{name: "trailing bytes", size: 2 * chunkSize, err: true,
+			alter: func(object []byte) []byte { return append(object, 0) }},
+		{name: "corrupted chunk", size: 2 * chunkSize, err: true,
+			alter: func(object []byte) []byte { object[chunkAt(object, 1)+20] ^= 1; return object }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plaintext := make([]byte, test.size)
+			for i := range plaintext {
+				plaintext[i] = byte(i * 7)
+			}
+			h := NewChunkedHeader(len(plaintext), chunkSize)
+			var object []byte
+			if h.ChunkSize == 0 {
+				object = seal(t, kek, plaintext)
+			} else if object, err = EncryptChunked(kek, h, plaintext, nil); err != nil {
+				t.Fatal(err)
+			}
+			if test.alter == nil {
+				if n, err := Length(object); err != nil || n != len(object) {
+					t.Fatalf("length %v, %v of a %v byte envelope", n, err, len(object))
+				}
+			} else {
+				object = test.alter(object)
+			}
+
+			got, err := Decrypt(kek, object)
+			switch {
+			case test.err && err == nil:
+				t.Fatal("decrypted an altered envelope")
+			case test.err:
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case !bytes.Equal(got, plaintext):
+				t.Fatalf("got %v bytes, want %v bytes", len(got), len(plaintext))
+			}
+		})
+	}
+}
+
+// sealPart encrypts plaintext into the envelope of part partNumber of upload uploadID, chunked
+// when chunkSize is not 0
+func sealPart(t *testing.T, kek tink.AEAD, uploadID string, partNumber int, plaintext []byte, chunkSize uint32) []byte {
+	t.Helper()
+	h := NewChunkedHeader(len(plaintext), chunkSize)
+	h.Flags |= FlagPart
+	binding := PartAssociatedData(uploadID, partNumber)
+	if h.ChunkSize != 0 {
+		object, err := EncryptChunked(kek, h, plaintext, binding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return object
+	}
+	header := h.Marshal()
+	ciphertext, err := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), kek).Encrypt(plaintext, append(bytes.Clone(header), binding...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(header, ciphertext...)
+}
+
+// sealManifest encrypts a part manifest as the proxy stores it with a completed upload
+func sealManifest(t *testing.T, kek tink.AEAD, m PartManifest) []byte {
+	t.Helper()
+	encoded, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHeader(len(encoded))
+	h.Flags |= FlagManifest
+	header := h.Marshal()
+	ciphertext, err := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), kek).Encrypt(encoded, append(bytes.Clone(header), ManifestAssociatedData()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(header, ciphertext...)
+}
+
+func TestDecryptParts(t *testing.T) {
+	handle, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek, err := aead.New(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type part struct {
+		upload string
+		number int
+		data   string
+	}
+	three := []part{{"u1", 1, "hello "}, {"u1", 2, "big "}, {"u1", 3, "world"}}
+	tests := []struct {
+		name string
+		// the parts in the order GCS concatenated them
+		parts []part
+		// the part manifest, nil for none
+		manifest *PartManifest
+		// a manifest sealed as a plain envelope instead
+		unsealed bool
+		err      bool
+	}{
+		{name: "in order", parts: three, manifest: &PartManifest{"u1", []int{1, 2, 3}}},
+		{name: "one part", parts: three[:1], manifest: &PartManifest{"u1", []int{1}}},
+		{name: "gaps", parts: []part{{"u1", 1, "a"}, {"u1", 5, "b"}, {"u1", 6, "c"}}, manifest: &PartManifest{"u1", []int{1, 5, 6}}},
+		{name: "reordered", parts: []part{three[1], three[0], three[2]}, manifest: &PartManifest{"u1", []int{1, 2, 3}}, err: true},
+		{name: "dropped last part", parts: three[:2], manifest: &PartManifest{"u1", []int{1, 2, 3}}, err: true},
+		{name: "dropped middle part", parts: []part{three[0], three[2]}, manifest: &PartManifest{"u1", []int{1, 2, 3}}, err: true},
+		{name: "added part", parts: three, manifest: &PartManifest{"u1", []int{1, 2}}, err: true},
+		{name: "repeated part", parts: []part{three[0], three[0], three[2]}, manifest: &PartManifest{"u1", []int{1, 2, 3}}, err: true},
+		{name: "part of another upload", parts: []part{three[0], {"u2", 2, "big "}, three[2]}, manifest: &PartManifest{"u1", []int{1, 2, 3}}, err: true},
+		{name: "manifest of another upload", parts: three, manifest: &PartManifest{"u2", []int{1, 2, 3}}, err: true},
+		{name: "without manifest", parts: three, err: true},
+		{name: "unsealed manifest", parts: three, manifest: &PartManifest{"u1", []int{1, 2, 3}}, unsealed: true, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var object, want []byte
+			for _, p := range test.parts {
+				object = append(object, sealPart(t, kek, p.upload, p.number, []byte(p.data), 0)...)
+				want = append(want, p.data...)
+			}
+			var manifest []byte
+			if test.manifest != nil && test.unsealed {
+				encoded, err := test.manifest.Marshal()
+				if err != nil {
+					t.Fatal(err)
+				}
+				manifest = seal(t, kek, encoded)
+			} else if test.manifest != nil {
+				manifest = sealManifest(t, kek, *test.manifest)
+			}
+
+			got, err := DecryptParts(kek, object, manifest)
+			switch {
+			case test.err && err == nil:
+				t.Fatal("decrypted parts that don't match the manifest")
+			case test.err:
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case !bytes.Equal(got, want):
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		})
+	}
+
+	t.Run("chunked parts", func(t *testing.T) {
+		plaintext := bytes.Repeat([]byte("0123456789"), 500)
+		object := append(sealPart(t, kek, "u1", 1, plaintext[:3000], 1024), sealPart(t, kek, "u1", 2, plaintext[3000:], 1024)...)
+		got, err := DecryptParts(kek, object, sealManifest(t, kek, PartManifest{"u1", []int{1, 2}}))
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Fatalf("got %v bytes, %v", len(got), err)
+		}
+		if _, err := DecryptParts(kek, object, sealManifest(t, kek, PartManifest{"u1", []int{2, 3}})); err == nil {
+			t.Fatal("decrypted chunked parts with other part numbers")
+		}
+	})
+
+	t.Run("older proxies", func(t *testing.T) {
+		// concatenations without part envelopes decrypt without a manifest, mixing them is refused
+		object := append(seal(t, kek, []byte("hello ")), seal(t, kek, []byte("world"))...)
+		if got, err := Decrypt(kek, object); err != nil || string(got) != "hello world" {
+			t.Fatalf("got %q, %v", got, err)
+		}
+		mixed := append(seal(t, kek, []byte("hello ")), sealPart(t, kek, "u1", 2, []byte("world"), 0)...)
+		if _, err := Decrypt(kek, mixed); err == nil {
+			t.Fatal("decrypted a part envelope without its manifest")
+		}
+	})
+}
+
+func TestPartManifest(t *testing.T) {
+	parts := []int{1, 2, 3, 7, 9, 10}
+	encoded, err := PartManifest{"upload", parts}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// three runs: 1-3, 7 and 9-10
+	if len(encoded) != 2+len("upload")+4+3*8 {
+		t.Fatalf("encoded %v bytes", len(encoded))
+	}
+	m, err := ParsePartManifest(encoded)
+	if err != nil || m.UploadID != "upload" || !slices.Equal(m.Parts, parts) {
+		t.Fatalf("parsed %+v, %v", m, err)
+	}
+
+	for _, invalid := range [][]int{nil, {2, 1}, {1, 1}, {0, 1}} {
+		if _, err := (PartManifest{"upload", invalid}).Marshal(); err == nil {
+			t.Errorf("marshalled parts %v", invalid)
+		}
+	}
+	var gaps []int
+	for part := 1; part <= 2*maxManifestRuns+1; part += 2 {
+		gaps = append(gaps, part)
+	}
+	if _, err := (PartManifest{"upload", gaps}).Marshal(); err == nil {
+		t.Errorf("marshalled %v runs", len(gaps))
+	}
+}
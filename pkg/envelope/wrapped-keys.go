@@ -0,0 +1,52 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package envelope
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+	With FlagEscrow the wrapped DEK field of the Tink envelope holds the DEK wrapped by both keys:
+
+	offset  size  field
+	0       4     length P of the DEK wrapped by the primary key
+	4       P     DEK wrapped by the primary key
+	4+P     4     length E of the DEK wrapped by the escrow key
+	8+P     E     DEK wrapped by the escrow key
+*/
+
+// JoinWrappedKeys builds the wrapped DEK field of an escrow envelope.
+func JoinWrappedKeys(primaryWrapped []byte, escrowWrapped []byte) []byte {
+	blob := make([]byte, 0, 8+len(primaryWrapped)+len(escrowWrapped))
+	blob = binary.BigEndian.AppendUint32(blob, uint32(len(primaryWrapped)))
+	blob = append(blob, primaryWrapped...)
+	blob = binary.BigEndian.AppendUint32(blob, uint32(len(escrowWrapped)))
+	blob = append(blob, escrowWrapped...)
+	return blob
+}
+
+// SplitWrappedKeys returns the primary and escrow copies of the DEK of an escrow envelope.
+func SplitWrappedKeys(blob []byte) ([]byte, []byte, error) {
+	var parts [][]byte
+	for i := 0; i < 2; i++ {
+		if len(blob) < 4 {
+			return nil, nil, fmt.Errorf("truncated escrow wrapped DEK")
+		}
+		n := binary.BigEndian.Uint32(blob)
+		blob = blob[4:]
+		if uint64(n) > uint64(len(blob)) {
+			return nil, nil, fmt.Errorf("truncated escrow wrapped DEK")
+		}
+		parts = append(parts, blob[:n])
+		blob = blob[n:]
+	}
+	if len(blob) != 0 {
+		return nil, nil, fmt.Errorf("trailing bytes after escrow wrapped DEK")
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package gcsclient makes the GCS calls the proxy originates itself, as opposed to the client
+requests it intercepts: provenance lookups, mirroring, manifests, the canary, the spool and the
+subcommands. They share one storage client and one HTTP client, authenticated as the proxy:
+
+  - with the Application Default Credentials, or as -impersonate_service_account
+  - on -gcs_endpoint, e.g. a Private Service Connect endpoint, storage.googleapis.com by default
+  - retried -gcs_max_attempts times in all, idempotent calls only
+
+Calls made with a client's bearer token use WithToken, on the same endpoint and retries.
+*/
+package gcsclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// DefaultEndpoint is where the proxy's own calls go without -gcs_endpoint
+const DefaultEndpoint = "https://storage.googleapis.com"
+
+// the delays between two attempts of a raw HTTP call, doubled each time
+const (
+	initialBackoff = time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+var (
+	mu         sync.Mutex
+	shared     *storage.Client
+	sharedHttp *http.Client
+)
+
+// Storage returns the storage client of the proxy's own calls. It is shared, callers don't close it.
+func Storage() (*storage.Client, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if shared != nil {
+		return shared, nil
+	}
+	ctx := context.Background()
+	var opts []option.ClientOption
+	if cfg.Current().ImpersonateServiceAccount != "" {
+		ts, err := tokenSource(ctx)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithTokenSource(ts))
+	}
+	client, err := newClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	shared = client
+	return shared, nil
+}
+
+// WithToken returns a storage client authenticated with a client's bearer token, the caller
+// closes it
+func WithToken(ctx context.Context, bearerToken string) (*storage.Client, error) {
+	return newClient(ctx, option.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: bearerToken})))
+}
+
+// HTTP returns the HTTP client of the proxy's own JSON and XML API calls that the storage client
+// has no method for, e.g. batches. It is shared, address the calls with URL.
+func HTTP() (*http.Client, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if sharedHttp != nil {
+		return sharedHttp, nil
+	}
+	ctx := context.Background()
+	ts, err := tokenSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	base := oauth2.NewClient(ctx, ts)
+	sharedHttp = &http.Client{Transport: &retryTransport{base: base.Transport, attempts: cfg.Current().GcsMaxAttempts}}
+	return sharedHttp, nil
+}
+
+// URL returns the URL of path, e.g. /batch/storage/v1, on the endpoint of the proxy's own calls
+func URL(path string) string {
+	return Endpoint() + path
+}
+
+// Endpoint returns the endpoint of the proxy's own calls, without a trailing slash
+func Endpoint() string {
+	config := cfg.Current()
+	if config == nil || config.GcsEndpoint == "" {
+		return DefaultEndpoint
+	}
+	return strings.TrimSuffix(config.GcsEndpoint, "/")
+}
+
+func newClient(ctx context.Context, opts ...option.ClientOption) (*storage.Client, error) {
+	if cfg.Current().GcsEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(Endpoint()+"/storage/v1/"))
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+	if attempts := cfg.Current().GcsMaxAttempts; attempts > 0 {
+		client.SetRetry(storage.WithMaxAttempts(attempts))
+	}
+	return client, nil
+}
+
+// tokenSource returns the credentials of the proxy's own calls
+func tokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	return TokenSource(ctx, storage.ScopeFullControl)
+}
+
+// TokenSource returns the credentials of the proxy's own calls with scopes, for the APIs other
+// than GCS the proxy calls about its buckets, e.g. the Pub/Sub subscription of their notifications
+func TokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	if account := cfg.Current().ImpersonateServiceAccount; account != "" {
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: account,
+			Scopes:          scopes,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to impersonate %v: %v", account, err)
+		}
+		return ts, nil
+	}
+	ts, err := google.DefaultTokenSource(ctx, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find default credentials: %v", err)
+	}
+	return ts, nil
+}
+
+// retryTransport sends idempotent requests again on transport errors, 408, 429 and 5xx: reads,
+// and the writes conditional on a generation, as the storage client does
+type retryTransport struct {
+	base     http.RoundTripper
+	attempts int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead || req.URL.Query().Has("ifGenerationMatch")
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		retryable := err != nil || resp.StatusCode == http.StatusRequestTimeout ||
+			resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if !idempotent || !retryable || attempt >= t.attempts || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff = min(2*backoff, maxBackoff)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
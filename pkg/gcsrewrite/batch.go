@@ -0,0 +1,180 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// BatchPath is the endpoint of the JSON API batch requests, multipart/mixed bodies of up to 100
+// requests without payload: deletes, metadata reads and patches, ACL changes
+const BatchPath = "/batch/storage/v1"
+
+// IsBatchRequest reports whether f is a JSON API batch request
+func IsBatchRequest(f *proxy.Flow) bool {
+	return f.Request.Method == http.MethodPost && f.Request.URL.Path == BatchPath
+}
+
+// HandleBatchRequest has the metadata reads of the objects of encrypted buckets in a batch
+// answered with their metadata, like HandleMetadataRequest does for single reads. The reads
+// without Content-ID are answered with their whole resource, their response can't be told apart.
+// The batches the proxy can't parse are sent as they are, GCS answers them with the error.
+func HandleBatchRequest(f *proxy.Flow) error {
+	keyMap := util.KeyMapFor(f)
+	masks := map[string]fieldMask{}
+	body, err := rewriteBatch(f.Request.Body, f.Request.Header.Get("Content-Type"), func(header textproto.MIMEHeader, part []byte) ([]byte, error) {
+		line, rest, separator := cutLine(part)
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != http.MethodGet {
+			return part, nil
+		}
+		u, err := url.Parse(fields[1])
+		if err != nil || !strings.HasPrefix(u.Path, "/storage/v1/b/") || strings.HasSuffix(u.Path, "/o") ||
+			keyMap.Key(util.GetBucketNameFromRequestUri(u.Path)) == "" {
+			return part, nil
+		}
+		query := u.Query()
+		if query.Get("alt") == "media" || !query.Has("fields") {
+			return part, nil
+		}
+		if contentID := partID(header); contentID == "" {
+			query.Del("fields")
+		} else if mask, ok := expandFields(query, batchFields); ok {
+			masks[contentID] = mask
+		}
+		u.RawQuery = query.Encode()
+		return append([]byte(fields[0]+" "+u.String()+" "+fields[2]+separator), rest...), nil
+	})
+	if err != nil {
+		log.Debugf("sending batch request as it is: %v", err)
+		return nil
+	}
+	f.Request.Body = body
+	if len(masks) > 0 {
+		keepClientFields(f, masks)
+	}
+	return nil
+}
+
+// HandleBatchResponse rewrites the object resources of encrypted buckets among the responses of a
+// batch to describe their plaintext, like HandleMetadataResponse
+func HandleBatchResponse(f *proxy.Flow) error {
+	keyMap := util.KeyMapFor(f)
+	masks := takeClientFields(f)
+	body, err := f.Response.DecodedBody()
+	if err != nil {
+		return fmt.Errorf("error decoding batch response: %v", err)
+	}
+	rewritten, err := rewriteBatch(body, f.Response.Header.Get("Content-Type"), func(header textproto.MIMEHeader, part []byte) ([]byte, error) {
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(part)), nil)
+		if err != nil {
+			return nil, fmt.Errorf("error reading batch response part: %v", err)
+		}
+		defer resp.Body.Close()
+		resourceBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading batch response part: %v", err)
+		}
+		var resource map[string]interface{}
+		if json.Unmarshal(resourceBody, &resource) != nil || resource["kind"] != "storage#object" {
+			return part, nil
+		}
+		bucket, _ := resource["bucket"].(string)
+		mask, masked := masks[strings.TrimPrefix(partID(header), "response-")]
+		if rewritten := keyMap.Key(bucket) != "" && describeResource(f, resource); !rewritten && !masked {
+			return part, nil
+		}
+		if resourceBody, err = json.Marshal(mask.apply(resource)); err != nil {
+			return nil, fmt.Errorf("error marshalling gcsObjectMetadata: %v", err)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(resourceBody))
+		resp.ContentLength = int64(len(resourceBody))
+		resp.Header.Del("Content-Length")
+		var out bytes.Buffer
+		if err := resp.Write(&out); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	})
+	if err != nil {
+		return err
+	}
+	f.Response.Body = rewritten
+	f.Response.Header.Del("Content-Encoding")
+	return nil
+}
+
+// rewriteBatch returns the multipart body of contentType with every part's body replaced by
+// rewrite, the parts keep their headers and the boundary
+func rewriteBatch(body []byte, contentType string, rewrite func(header textproto.MIMEHeader, part []byte) ([]byte, error)) ([]byte, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, fmt.Errorf("batch of content type %q", contentType)
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var out bytes.Buffer
+	writer := multipart.NewWriter(&out)
+	if err := writer.SetBoundary(params["boundary"]); err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading batch: %v", err)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("error reading batch: %v", err)
+		}
+		if data, err = rewrite(part.Header, data); err != nil {
+			return nil, err
+		}
+		partWriter, err := writer.CreatePart(part.Header)
+		if err != nil {
+			return nil, err
+		}
+		partWriter.Write(data)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// partID returns the Content-ID of a part of a batch, GCS answers the part <id> with the part
+// <response-id>
+func partID(header textproto.MIMEHeader) string {
+	return strings.Trim(header.Get("Content-ID"), "<> ")
+}
+
+// cutLine returns the first line of data without its line ending, the rest and the line ending
+func cutLine(data []byte) (line string, rest []byte, separator string) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return string(data), nil, ""
+	}
+	if i > 0 && data[i-1] == '\r' {
+		return string(data[:i-1]), data[i+1:], "\r\n"
+	}
+	return string(data[:i]), data[i+1:], "\n"
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Deleting or overwriting an object makes what the proxy keeps of it stale: the plaintext in the
+cache of sliced downloads, the listed objects prefetched into it that generation-less downloads
+are answered with, and the key that decrypted a generation. They are dropped when the proxy sees
+the object deleted or written through it, and when the Pub/Sub notifications of the bucket report
+the writes of the clients that don't use the proxy, see the notifications package.
+
+Generations are immutable, so an overwrite only drops the generations other than the new one and
+the keys remembered are only forgotten with the generations deleted.
+*/
+
+// InvalidateGeneration drops what the caches hold of a generation of gs://bucketName/objectName
+// that was deleted or is no longer live, of every generation when generation is empty
+func InvalidateGeneration(bucketName string, objectName string, generation string) {
+	decryptionKeys.forget(bucketName, objectName, generation)
+	if cache := getPlaintextCache(); cache != nil {
+		dropped := cache.invalidate(bucketName, objectName, func(g string) bool { return generation == "" || g == generation })
+		if dropped > 0 {
+			log.Debugf("dropped %v cached plaintexts of gs://%v/%v#%v", dropped, bucketName, objectName, generation)
+		}
+	}
+}
+
+// InvalidateOverwritten drops what the caches hold of the generations of gs://bucketName/objectName
+// other than generation, the live one written last
+func InvalidateOverwritten(bucketName string, objectName string, generation string) {
+	if generation == "" {
+		InvalidateGeneration(bucketName, objectName, "")
+		return
+	}
+	if cache := getPlaintextCache(); cache != nil {
+		dropped := cache.invalidate(bucketName, objectName, func(g string) bool { return g != generation })
+		if dropped > 0 {
+			log.Debugf("dropped %v cached plaintexts of gs://%v/%v overwritten by #%v", dropped, bucketName, objectName, generation)
+		}
+	}
+}
+
+// InvalidateCaches drops what the caches hold of the objects the GCS request in f deleted or wrote,
+// once GCS answered it. Unsuccessful requests changed nothing, but for the deletes of objects
+// that are already gone.
+func InvalidateCaches(f *proxy.Flow) {
+	if f.Response == nil || !util.IsGcsHost(f.Request.URL.Host) {
+		return
+	}
+	status := f.Response.StatusCode
+	path := f.Request.URL.Path
+	query := f.Request.URL.Query()
+	switch {
+	case IsBatchRequest(f):
+		if status == http.StatusOK {
+			invalidateBatchDeletes(f)
+		}
+
+	case f.Request.Method == http.MethodDelete:
+		if (status < 200 || status > 299) && status != http.StatusNotFound {
+			return
+		}
+		// aborted XML multipart and resumable uploads wrote nothing
+		if query.Has("uploadId") || query.Has("upload_id") || strings.HasPrefix(path, "/upload/") || strings.HasPrefix(path, "/resumable/") {
+			return
+		}
+		if bucketName, objectName := util.GetBucketNameFromRequestUri(path), util.GetObjectNameFromRequestUri(path); bucketName != "" && objectName != "" {
+			InvalidateGeneration(bucketName, objectName, query.Get("generation"))
+		}
+
+	case f.Request.Method == http.MethodPost || f.Request.Method == http.MethodPut:
+		if status < 200 || status > 299 {
+			return
+		}
+		if bucketName, objectName, generation, ok := writtenObject(f); ok {
+			InvalidateOverwritten(bucketName, objectName, generation)
+			return
+		}
+		// XML API uploads and completed multipart uploads, the parts are not objects yet
+		if strings.HasPrefix(path, "/storage/") || strings.HasPrefix(path, "/upload/") || strings.HasPrefix(path, "/resumable/") ||
+			strings.HasPrefix(path, "/batch/") || query.Has("partNumber") || query.Has("uploads") || query.Has("acl") {
+			return
+		}
+		if f.Request.Method == http.MethodPost && !query.Has("uploadId") {
+			return
+		}
+		if bucketName, objectName := util.GetBucketNameFromRequestUri(path), util.GetObjectNameFromRequestUri(path); bucketName != "" && objectName != "" {
+			InvalidateOverwritten(bucketName, objectName, f.Response.Header.Get("X-Goog-Generation"))
+		}
+	}
+}
+
+// writtenObject returns the object a JSON API upload, copy, rewrite or compose wrote, from the
+// object resource GCS answered with
+func writtenObject(f *proxy.Flow) (bucketName string, objectName string, generation string, ok bool) {
+	if mediaType, _, _ := mime.ParseMediaType(f.Response.Header.Get("Content-Type")); mediaType != "application/json" {
+		return "", "", "", false
+	}
+	body, err := f.Response.DecodedBody()
+	if err != nil || len(body) == 0 {
+		return "", "", "", false
+	}
+	type object struct {
+		Kind       string `json:"kind"`
+		Bucket     string `json:"bucket"`
+		Name       string `json:"name"`
+		Generation string `json:"generation"`
+	}
+	var resource struct {
+		object
+		Done     bool    `json:"done"`
+		Resource *object `json:"resource"` // of a rewrite
+	}
+	if json.Unmarshal(body, &resource) != nil {
+		return "", "", "", false
+	}
+	written := resource.object
+	if resource.Kind == "storage#rewriteResponse" && resource.Done && resource.Resource != nil {
+		written = *resource.Resource
+	}
+	if written.Kind != "storage#object" || written.Bucket == "" || written.Name == "" {
+		return "", "", "", false
+	}
+	return written.Bucket, written.Name, written.Generation, true
+}
+
+// invalidateBatchDeletes drops what the caches hold of the objects a batch deleted. The parts of
+// the response are not matched to the requests, the deletes GCS refused are dropped too.
+func invalidateBatchDeletes(f *proxy.Flow) {
+	rewriteBatch(f.Request.Body, f.Request.Header.Get("Content-Type"), func(_ textproto.MIMEHeader, part []byte) ([]byte, error) {
+		line, _, _ := cutLine(part)
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != http.MethodDelete {
+			return part, nil
+		}
+		u, err := url.Parse(fields[1])
+		if err != nil || !strings.HasPrefix(u.Path, "/storage/v1/b/") || !strings.Contains(u.Path, "/o/") {
+			return part, nil
+		}
+		InvalidateGeneration(util.GetBucketNameFromRequestUri(u.Path), util.GetObjectNameFromRequestUri(u.Path), u.Query().Get("generation"))
+		return part, nil
+	})
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"slices"
+	"sync"
+)
+
+// generations whose decryption key is remembered, those of an arbitrary object are forgotten beyond that
+const decryptionKeyCacheSize = 100000
+
+// decryptionKeys remembers which candidate key decrypted a generation when it was not the first
+// one tried, so reads of objects written before a mapping change don't pay a failed KMS call
+// for every key ahead of it each time.
+var decryptionKeys = &decryptionKeyCache{keys: make(map[string]map[string]string)}
+
+type decryptionKeyCache struct {
+	mu   sync.Mutex
+	keys map[string]map[string]string // bucket/object -> generation -> key
+	size int                          // generations
+}
+
+// order returns candidates with the key that last decrypted the generation first
+func (c *decryptionKeyCache) order(bucketName string, objectName string, generation string, candidates []string) []string {
+	if generation == "" {
+		return candidates
+	}
+	c.mu.Lock()
+	key, ok := c.keys[bucketName+"/"+objectName][generation]
+	c.mu.Unlock()
+	i := slices.Index(candidates, key)
+	if !ok || i <= 0 {
+		return candidates
+	}
+	ordered := append([]string{key}, candidates[:i]...)
+	return append(ordered, candidates[i+1:]...)
+}
+
+// remember records that key decrypted the generation
+func (c *decryptionKeyCache) remember(bucketName string, objectName string, generation string, key string) {
+	if generation == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size >= decryptionKeyCacheSize {
+		for evicted, generations := range c.keys {
+			c.size -= len(generations)
+			delete(c.keys, evicted)
+			break
+		}
+	}
+	object := bucketName + "/" + objectName
+	if c.keys[object] == nil {
+		c.keys[object] = make(map[string]string)
+	}
+	if _, ok := c.keys[object][generation]; !ok {
+		c.size++
+	}
+	c.keys[object][generation] = key
+}
+
+// forget drops what is remembered of a generation that was deleted, of every generation when
+// generation is empty
+func (c *decryptionKeyCache) forget(bucketName string, objectName string, generation string) {
+	object := bucketName + "/" + objectName
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	generations := c.keys[object]
+	if _, ok := generations[generation]; ok {
+		delete(generations, generation)
+		c.size--
+	} else if generation == "" {
+		c.size -= len(generations)
+		clear(generations)
+	}
+	if generations != nil && len(generations) == 0 {
+		delete(c.keys, object)
+	}
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"errors"
+	"fmt"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// what to do with uploads that already are a proxy envelope, e.g. sent through two proxies
+const (
+	DoubleEncryptionSkip    = "skip"    // upload the envelope as it is
+	DoubleEncryptionError   = "error"   // reject the upload
+	DoubleEncryptionEncrypt = "encrypt" // encrypt it again
+)
+
+// AlreadyEncryptedHeader marks uploads sent as they are, their responses are not rewritten
+const AlreadyEncryptedHeader = "gcs-proxy-already-encrypted"
+
+var ErrAlreadyEncrypted = errors.New("upload is already encrypted by a gcs-proxy")
+
+// skipEncryption reports whether an upload of plaintext must be sent as it is because it
+// already is an envelope, or fails it if the policy says so.
+func skipEncryption(f *proxy.Flow, plaintext []byte) (bool, error) {
+	if _, err := envelope.ParseHeader(plaintext); err != nil {
+		return false, nil
+	}
+	switch cfg.For(f).DoubleEncryption {
+	case DoubleEncryptionEncrypt:
+		return false, nil
+	case DoubleEncryptionError:
+		return false, fmt.Errorf("%w: %v", ErrAlreadyEncrypted, f.Request.URL.Path)
+	}
+	log.Warnf("%v %v: upload is already encrypted, sending it without encrypting it again", f.Request.Method, f.Request.URL)
+	f.Request.Header.Set(AlreadyEncryptedHeader, "true")
+	return true, nil
+}
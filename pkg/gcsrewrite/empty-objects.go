@@ -0,0 +1,42 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Empty objects hold nothing to protect: the placeholders of directories, e.g. "logs/", the markers
+of jobs like _SUCCESS, and touched files. Encrypting one would store an envelope and cost a KMS
+call for no plaintext, and the tools reading the bucket outside the proxy would see a ciphertext
+where an empty object is expected. The proxy stores empty uploads as they are, without a key,
+marked with the MetaPlaintext of PlaintextEmpty, and serves empty downloads as they are.
+
+The marker carries no proxy version, so the tools classify the object as empty rather than as
+encrypted.
+*/
+
+// emptyRule is the PolicySkippedHeader of empty uploads
+const emptyRule = "empty"
+
+// skipEmpty reports whether an upload of size writes an empty object, and marks f as sent as it
+// is if so
+func skipEmpty(f *proxy.Flow, bucketName string, size uploadSize) bool {
+	if !size.exact || size.size != 0 {
+		return false
+	}
+	log.Debugf("%v %v: empty upload to gs://%v is stored as it is", f.Request.Method, f.Request.URL.Path, bucketName)
+	f.Request.Header.Set(PolicySkippedHeader, emptyRule)
+	return true
+}
+
+// emptyObjectMetadata returns the custom metadata the proxy marks the empty objects it stores with
+func emptyObjectMetadata() map[string]string {
+	return map[string]string{util.MetaKey(util.MetaPlaintext): util.PlaintextEmpty}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// PolicySkippedHeader marks uploads the bucket's rules store in plaintext, its value is the
+// rule. like already encrypted uploads they are sent and answered as they are.
+const PolicySkippedHeader = "gcs-proxy-policy-skipped"
+
+// SentAsIs reports whether the upload of f was sent without encrypting it.
+func SentAsIs(f *proxy.Flow) bool {
+	return f.Request.Header.Get(AlreadyEncryptedHeader) != "" || f.Request.Header.Get(PolicySkippedHeader) != ""
+}
+
+// uploadSize is the size of the object an upload writes. exact is false when only a lower
+// bound is known, e.g. for the first chunks of a resumable upload of unknown size.
+type uploadSize struct {
+	size  int64
+	exact bool
+}
+
+// skipByRules reports whether the content type and size rules of bucketName store an upload
+// in plaintext, and marks f if so.
+func skipByRules(f *proxy.Flow, bucketName string, contentType string, size uploadSize) bool {
+	keyMap := util.KeyMapFor(f)
+	_, maxSize := keyMap.SizeThresholds(bucketName)
+	rule := ""
+	switch {
+	case !keyMap.EncryptsContentType(bucketName, contentType):
+		rule = "content-type"
+	case size.exact && !keyMap.EncryptsSize(bucketName, size.size):
+		rule = "size"
+	case !size.exact && maxSize > 0 && size.size > maxSize:
+		// only a lower bound of the size is known, and it already is over the maximum
+		rule = "size"
+	default:
+		return false
+	}
+	log.Debugf("%v %v: %v of %v bytes to gs://%v is not encrypted by the %v rules",
+		f.Request.Method, f.Request.URL.Path, contentType, size.size, bucketName, rule)
+	f.Request.Header.Set(PolicySkippedHeader, rule)
+	return true
+}
+
+// StoredInPlaintext reports whether a downloaded object was stored in plaintext by the rules
+// of bucketName: it is no envelope, its stored metadata records no encryption and the rules skip
+// its content type or its size, the size of its plaintext. Empty objects are stored as they are,
+// see skipEmpty, as are the placeholders of directories created by the console or the Hadoop
+// connector without the proxy. The answer is kept for f, the interceptor and the handler ask both.
+func StoredInPlaintext(f *proxy.Flow, bucketName string) bool {
+	if plaintext, ok := plaintextDownloads.Load(f.Id); ok {
+		return plaintext.(bool)
+	}
+	plaintext := storedInPlaintext(f, bucketName)
+	plaintextDownloads.Store(f.Id, plaintext)
+	go func() {
+		<-f.Done()
+		plaintextDownloads.Delete(f.Id)
+	}()
+	return plaintext
+}
+
+var plaintextDownloads sync.Map // flow id -> StoredInPlaintext
+
+func storedInPlaintext(f *proxy.Flow, bucketName string) bool {
+	if envelope.HasHeader(f.Response.Body) {
+		return false
+	}
+	if len(f.Response.Body) == 0 {
+		return true
+	}
+	// XML API downloads carry the custom metadata, JSON API media downloads don't
+	metadata := metadataOfHeader(f.Response.Header)
+	if metadata == nil && !encryptsDownload(f, bucketName, int64(len(f.Response.Body))) {
+		var err error
+		if metadata, err = storedMetadata(f, bucketName); err != nil {
+			// decrypting fails with the reason if the object is encrypted after all
+			log.Warnf("unable to tell whether %v is stored in plaintext, decrypting it: %v", f.Request.URL.Path, err)
+			return false
+		}
+	}
+	if util.ProvenanceOf(metadata).Key != "" {
+		return false
+	}
+	// objects written before the proxy recorded keys only record the plaintext length. objects
+	// without any are stored as they are, their stored length is the one of their plaintext
+	if _, encrypted := util.LookupMeta(metadata, util.MetaUnencryptedLength); encrypted {
+		return false
+	}
+	return !encryptsDownload(f, bucketName, int64(len(f.Response.Body)))
+}
+
+// encryptsDownload reports whether the rules of bucketName encrypt the object f downloads, size
+// bytes of its plaintext
+func encryptsDownload(f *proxy.Flow, bucketName string, size int64) bool {
+	keyMap := util.KeyMapFor(f)
+	return keyMap.EncryptsContentType(bucketName, f.Response.Header.Get("Content-Type")) && keyMap.EncryptsSize(bucketName, size)
+}
+
+// metadataOfHeader returns the custom metadata of the X-Goog-Meta- headers, nil without any
+func metadataOfHeader(header http.Header) map[string]string {
+	var metadata map[string]string
+	for name := range header {
+		if key, ok := strings.CutPrefix(strings.ToLower(name), "x-goog-meta-"); ok {
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+			metadata[key] = header.Get(name)
+		}
+	}
+	return metadata
+}
+
+// storedMetadata looks up the custom metadata of the generation GCS is returning, like
+// downloadEncryptionKeys does for the key
+func storedMetadata(f *proxy.Flow, bucketName string) (map[string]string, error) {
+	var generation int64
+	if g := f.Response.Header.Get("X-Goog-Generation"); g != "" {
+		var err error
+		if generation, err = strconv.ParseInt(g, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid X-Goog-Generation header %v: %v", g, err)
+		}
+	}
+	return util.GetObjectMetadata(util.WithUserProject(kmsContext(f), util.UserProject(f)),
+		bucketName, util.GetObjectNameFromRequestUri(f.Request.URL.Path), generation)
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+)
+
+// FetchObject downloads a generation of gs://bucketName/objectName, the live one when generation
+// is 0, with the proxy's own credentials and decrypts it like a download through the proxy. It
+// returns the plaintext and the attributes of the generation, for the admin API's break-glass fetch.
+func FetchObject(ctx context.Context, bucketName string, objectName string, generation int64) ([]byte, *storage.ObjectAttrs, error) {
+	client, err := gcsclient.Storage()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obj := util.Bucket(ctx, client, bucketName).Object(objectName)
+	if generation != 0 {
+		obj = obj.Generation(generation)
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get object attributes: %w", err)
+	}
+	// pin the generation we looked at, the ciphertext must match its metadata
+	obj = obj.Generation(attrs.Generation)
+
+	keyMap := util.KeyMap()
+	if attrs.CustomerKeySHA256 != "" {
+		if keyMap.Key(bucketName) == "" || keyMap.Format(bucketName) != util.EnvelopeFormatCsek {
+			return nil, nil, fmt.Errorf("gs://%v/%v is encrypted with a customer-supplied key the proxy does not derive", bucketName, objectName)
+		}
+		key, err := crypto.DeriveCsekKey(ctx, keyMap.Key(bucketName), bucketName, objectName)
+		if err != nil {
+			return nil, nil, err
+		}
+		obj = obj.Key(key)
+	}
+
+	reader, err := obj.ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read object: %w", err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read object: %w", err)
+	}
+
+	provenance := util.ProvenanceOf(attrs.Metadata)
+	if attrs.CustomerKeySHA256 != "" || (!envelope.HasHeader(data) && provenance.Key == "") {
+		// GCS decrypted it, or it is stored in plaintext
+		return data, attrs, nil
+	}
+	if provenance.Newer() {
+		return nil, nil, fmt.Errorf("gs://%v/%v is %v, this proxy reads envelope versions up to %v: upgrade it",
+			bucketName, objectName, provenance, envelope.Version)
+	}
+	keyIDs := keyMap.CandidateKeys(provenance.Key, bucketName)
+	if len(keyIDs) == 0 {
+		return nil, nil, fmt.Errorf("no encryption key for gs://%v/%v", bucketName, objectName)
+	}
+	ctx = crypto.WithPartManifest(ctx, util.PartManifest(attrs.Metadata))
+	var errs []error
+	for _, keyID := range keyIDs {
+		var plaintext []byte
+		if provenance.Foreign {
+			plaintext, err = crypto.DecryptForeignBytes(ctx, keyID, data, util.ForeignAssociatedData(bucketName, objectName))
+		} else {
+			plaintext, err = crypto.DecryptBytes(ctx, keyID, data)
+		}
+		if err == nil {
+			return plaintext, attrs, nil
+		}
+		errs = append(errs, fmt.Errorf("%v: %w", keyID, err))
+	}
+	return nil, nil, fmt.Errorf("unable to decrypt gs://%v/%v (%v):%w", bucketName, objectName, provenance, errors.Join(errs...))
+}
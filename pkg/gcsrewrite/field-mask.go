@@ -0,0 +1,227 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+The fields query parameter asks for a partial response, the fields of the resource it selects:
+
+	fields=size,md5Hash
+	fields=items(name,size),nextPageToken
+	fields=items/metadata/x-unencrypted-content-length
+	fields=*
+
+The proxy describes the plaintext of an object from its metadata, which these masks may leave out.
+GCS is asked for the fields of the client and those the proxy needs, the response is rewritten and
+then cut down to the mask of the client, so it has the shape the client asked for.
+*/
+
+// fieldMask is a parsed fields parameter, the mask of the subfields by selected field. a nil mask
+// selects the whole value, "*" selects every field of an object.
+type fieldMask map[string]fieldMask
+
+// the fields the proxy needs to describe the plaintext of object resources and listings, the
+// listed objects are prefetched by name and generation
+const (
+	objectFields = "metadata"
+	listFields   = "items(name,generation,contentEncoding,metadata)"
+	batchFields  = "kind,bucket,metadata"
+)
+
+var clientFields sync.Map // flow id -> map[string]fieldMask
+
+// parseFieldMask parses a fields parameter: selections separated by commas, a selection is a path
+// of field names separated by slashes optionally followed by the selections of its subfields in
+// parentheses.
+func parseFieldMask(fields string) (fieldMask, error) {
+	p := &maskParser{s: fields}
+	mask, err := p.list()
+	if err == nil && p.pos < len(p.s) {
+		err = fmt.Errorf("unexpected %q at %v", p.s[p.pos], p.pos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid fields %q: %v", fields, err)
+	}
+	return mask, nil
+}
+
+type maskParser struct {
+	s   string
+	pos int
+}
+
+func (p *maskParser) next(c byte) bool {
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// list parses selections up to a closing parenthesis or the end
+func (p *maskParser) list() (fieldMask, error) {
+	mask := fieldMask{}
+	for {
+		path, err := p.path()
+		if err != nil {
+			return nil, err
+		}
+		var sub fieldMask
+		if p.next('(') {
+			if sub, err = p.list(); err != nil {
+				return nil, err
+			}
+			if !p.next(')') {
+				return nil, fmt.Errorf("missing ) at %v", p.pos)
+			}
+		}
+		mask.add(path, sub)
+		if !p.next(',') {
+			return mask, nil
+		}
+	}
+}
+
+// path parses field names separated by slashes
+func (p *maskParser) path() ([]string, error) {
+	var names []string
+	for {
+		start := p.pos
+		for p.pos < len(p.s) && !strings.ContainsRune("/,()", rune(p.s[p.pos])) {
+			p.pos++
+		}
+		name := strings.TrimSpace(p.s[start:p.pos])
+		if name == "" {
+			return nil, fmt.Errorf("missing field name at %v", start)
+		}
+		names = append(names, name)
+		if !p.next('/') {
+			return names, nil
+		}
+	}
+}
+
+// add selects sub at path, a field selected whole stays whole
+func (m fieldMask) add(path []string, sub fieldMask) {
+	for _, name := range path[:len(path)-1] {
+		next, ok := m[name]
+		if ok && next == nil {
+			return
+		}
+		if !ok {
+			next = fieldMask{}
+			m[name] = next
+		}
+		m = next
+	}
+	name := path[len(path)-1]
+	existing, ok := m[name]
+	switch {
+	case !ok:
+		m[name] = sub
+	case existing == nil:
+	case sub == nil:
+		m[name] = nil
+	default:
+		for field, fieldSub := range sub {
+			existing.add([]string{field}, fieldSub)
+		}
+	}
+}
+
+// String returns m as a fields parameter
+func (m fieldMask) String() string {
+	var selections []string
+	for name, sub := range m {
+		if sub == nil {
+			selections = append(selections, name)
+		} else {
+			selections = append(selections, name+"("+sub.String()+")")
+		}
+	}
+	slices.Sort(selections)
+	return strings.Join(selections, ",")
+}
+
+// apply returns the part of value, a decoded JSON value, m selects. like GCS it leaves out the
+// objects none of whose selected fields are set.
+func (m fieldMask) apply(value interface{}) interface{} {
+	if m == nil {
+		return value
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		selected := map[string]interface{}{}
+		for name, field := range v {
+			sub, ok := m[name]
+			if !ok {
+				sub, ok = m["*"]
+			}
+			if !ok {
+				continue
+			}
+			field = sub.apply(field)
+			if object, isObject := field.(map[string]interface{}); isObject && sub != nil && len(object) == 0 {
+				continue
+			}
+			selected[name] = field
+		}
+		return selected
+	case []interface{}:
+		selected := make([]interface{}, len(v))
+		for i, element := range v {
+			selected[i] = m.apply(element)
+		}
+		return selected
+	}
+	return value
+}
+
+// expandFields has GCS answer query with the fields the proxy needs, required, besides those the
+// client asked for. It returns the mask of the client, false when the client asked for the whole
+// resource or for fields GCS refuses, those are sent as they are.
+func expandFields(query url.Values, required string) (fieldMask, bool) {
+	fields := query.Get("fields")
+	if fields == "" {
+		return nil, false
+	}
+	mask, err := parseFieldMask(fields)
+	if err != nil {
+		log.Debugf("sending fields as they are: %v", err)
+		return nil, false
+	}
+	expanded, _ := parseFieldMask(fields + "," + required)
+	query.Set("fields", expanded.String())
+	return mask, true
+}
+
+// keepClientFields keeps the masks of the client for the response of f, by the Content-ID of the
+// requests of a batch, "" for the request of f itself
+func keepClientFields(f *proxy.Flow, masks map[string]fieldMask) {
+	if _, loaded := clientFields.Swap(f.Id, masks); !loaded {
+		go func() {
+			<-f.Done()
+			clientFields.Delete(f.Id)
+		}()
+	}
+}
+
+// takeClientFields returns the masks keepClientFields kept for f
+func takeClientFields(f *proxy.Flow) map[string]fieldMask {
+	masks, _ := clientFields.LoadAndDelete(f.Id)
+	m, _ := masks.(map[string]fieldMask)
+	return m
+}
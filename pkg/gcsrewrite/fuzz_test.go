@@ -0,0 +1,56 @@
+//go:build gofuzz
+
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+package gcsrewrite
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+Native go test fuzzing of the go-fuzz targets, seeded with their corpus:
+
+	go test -tags gofuzz -fuzz FuzzMultipartUpload ./pkg/gcsrewrite
+
+Without -fuzz the seeds run as tests.
+*/
+
+func FuzzMultipartUpload(f *testing.F) {
+	addCorpus(f, "multipart")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		FuzzMultipart(data)
+	})
+}
+
+func FuzzMetadataResource(f *testing.F) {
+	addCorpus(f, "metadata")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		FuzzMetadataResponse(data)
+	})
+}
+
+func FuzzFieldsParameter(f *testing.F) {
+	addCorpus(f, "fields")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		FuzzFieldMask(data)
+	})
+}
+
+// addCorpus seeds f with the inputs of test/fuzz/<target>/corpus
+func addCorpus(f *testing.F, target string) {
+	seeds, _ := filepath.Glob(filepath.Join("../../test/fuzz", target, "corpus", "*"))
+	for _, seed := range seeds {
+		data, err := os.ReadFile(seed)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strconv"
+	"strings"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/backend"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Single request uploads and downloads of the S3 and Azure Blob objects of mapped buckets, see the
+backend package. The payload of a PUT is encrypted into one envelope and the proxy metadata is
+sent in the backend's user metadata headers, downloads are decrypted whole and ranges are sliced
+from the plaintext, as for GCS.
+*/
+
+// HandleBackendUploadRequest encrypts the payload of a single request upload to o
+func HandleBackendUploadRequest(f *proxy.Flow, o backend.Object) error {
+	if names := o.ReservedMetadata(f.Request.Header); len(names) > 0 {
+		return fmt.Errorf("%w: metadata %v is reserved by the proxy, see -metadata_prefix", ErrInvalidUpload, strings.Join(names, ", "))
+	}
+	plaintext := f.Request.Body
+	if err := verifyBackendChecksums(f.Request.Header, plaintext); err != nil {
+		return err
+	}
+	size := uploadSize{int64(len(plaintext)), true}
+	if skipEmpty(f, o.Bucket, size) {
+		for key, value := range emptyObjectMetadata() {
+			f.Request.Header.Set(o.MetaHeader(key), value)
+		}
+		return nil
+	}
+	if skipByRules(f, o.Bucket, f.Request.Header.Get("Content-Type"), size) {
+		return nil
+	}
+	if skip, err := skipEncryption(f, plaintext); skip || err != nil {
+		return err
+	}
+
+	keyMap := util.KeyMapFor(f)
+	ciphertext, keyVersion, err := crypto.EncryptBytesWithKeyVersion(uploadContext(f, o.Bucket, o.Name), keyMap.Key(o.Bucket), plaintext)
+	if err != nil {
+		return fmt.Errorf("error encrypting %v: %w", o, err)
+	}
+
+	metadata := map[string]string{
+		util.MetaKey(util.MetaUnencryptedLength):    strconv.Itoa(len(plaintext)),
+		util.MetaKey(util.MetaMd5Hash):              crypto.Base64MD5Hash(plaintext),
+		util.MetaKey(util.MetaCrc32c):               crypto.Base64Crc32cHash(plaintext),
+		util.MetaKey(util.MetaEncryptionKey):        keyMap.Key(o.Bucket),
+		util.MetaKey(util.MetaEncryptionKeyVersion): keyVersion,
+		util.MetaKey(util.MetaProxyVersion):         cfg.For(f).GCSProxyVersion,
+		util.MetaKey(util.MetaEnvelopeVersion):      strconv.Itoa(envelope.Version),
+	}
+	if crypto.EscrowKeyName != "" {
+		metadata[util.MetaKey(util.MetaEscrowKey)] = crypto.EscrowKeyName
+	}
+	for key, value := range util.EncryptionProvenance(keyMap.Policy) {
+		metadata[key] = value
+	}
+	for key, value := range metadata {
+		f.Request.Header.Set(o.MetaHeader(key), value)
+	}
+
+	// the client's hashes describe the plaintext, the backend checks them against the ciphertext
+	plaintextMd5 := md5.Sum(plaintext)
+	f.Request.Header.Set("gcs-proxy-plaintext-md5", base64.StdEncoding.EncodeToString(plaintextMd5[:]))
+	if f.Request.Header.Get("Content-MD5") != "" {
+		f.Request.Header.Set("Content-MD5", crypto.Base64MD5Hash(ciphertext))
+	}
+	f.Request.Header.Del("x-ms-blob-content-md5")
+	setBackendChecksums(f.Request.Header, ciphertext)
+	f.Request.Header.Set("Content-Length", strconv.Itoa(len(ciphertext)))
+	f.Request.Body = ciphertext
+	log.Debugf("encrypted %v: %v bytes of plaintext, %v of ciphertext", o, len(plaintext), len(ciphertext))
+	return nil
+}
+
+// HandleBackendUploadResponse has the response of an upload describe the plaintext the client sent
+func HandleBackendUploadResponse(f *proxy.Flow, o backend.Object) error {
+	encoded := f.Request.Header.Get("gcs-proxy-plaintext-md5")
+	plaintextMd5, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(plaintextMd5) != md5.Size {
+		return fmt.Errorf("missing plaintext MD5 of upload to %v", o)
+	}
+	dropBackendChecksums(f.Response.Header)
+	if o.Backend == backend.S3 {
+		// S3 SDKs compare the ETag of single part uploads to the MD5 of what they sent
+		f.Response.Header.Set("ETag", fmt.Sprintf("\"%x\"", plaintextMd5))
+	} else if f.Response.Header.Get("Content-MD5") != "" {
+		f.Response.Header.Set("Content-MD5", encoded)
+	}
+	return nil
+}
+
+// HandleBackendDownloadRequest has the whole object downloaded, the range the client asked for is
+// sliced from the plaintext
+func HandleBackendDownloadRequest(f *proxy.Flow, o backend.Object) error {
+	for _, name := range []string{"x-ms-range", "Range"} {
+		if byteRange := f.Request.Header.Get(name); byteRange != "" {
+			f.Request.Header.Set("x-original-byte-range", byteRange)
+			f.Request.Header.Del(name)
+		}
+	}
+	// the hash of a range is only computed by Azure for the range it sends
+	f.Request.Header.Del("x-ms-range-get-content-md5")
+	f.Request.Header.Del("x-ms-range-get-content-crc64")
+	return nil
+}
+
+// HandleBackendDownloadResponse decrypts a download of o, plaintext is true when o is not encrypted
+func HandleBackendDownloadResponse(f *proxy.Flow, o backend.Object) (plaintext bool, err error) {
+	provenance := util.ProvenanceOf(o.Metadata(f.Response.Header))
+	if !envelope.HasHeader(f.Response.Body) && provenance.Key == "" {
+		log.Debugf("%v is not encrypted", o)
+		return true, writeBackendBody(f, f.Response.Body)
+	}
+	if provenance.Newer() {
+		return false, fmt.Errorf("%v is %v, this proxy reads envelope versions up to %v: upgrade it", o, provenance, envelope.Version)
+	}
+	keyIDs := util.KeyMapFor(f).CandidateKeys(provenance.Key, o.Bucket)
+	if len(keyIDs) == 0 {
+		return false, fmt.Errorf("no encryption key for %v", o)
+	}
+	ctx := kmsContext(f)
+	var errs []error
+	for _, keyID := range keyIDs {
+		unencryptedBytes, err := crypto.DecryptBytes(ctx, keyID, f.Response.Body)
+		if err == nil {
+			return false, writeBackendBody(f, unencryptedBytes)
+		}
+		errs = append(errs, fmt.Errorf("%v: %w", keyID, err))
+	}
+	return false, fmt.Errorf("unable to decrypt response body of %v (%v):%w", o, provenance, errors.Join(errs...))
+}
+
+// writeBackendBody sets the response body to the plaintext or the range of it the client asked for
+func writeBackendBody(f *proxy.Flow, unencryptedBytes []byte) error {
+	// the hashes the backend sent describe the ciphertext
+	dropBackendChecksums(f.Response.Header)
+	f.Response.Header.Del("x-ms-blob-content-md5")
+
+	objectSize := len(unencryptedBytes)
+	if byteRange := f.Request.Header.Get("x-original-byte-range"); byteRange != "" && objectSize > 0 {
+		start, end, err := parseRangeHeader(byteRange, objectSize)
+		if errors.Is(err, errRangeNotSatisfiable) {
+			f.Response.StatusCode = http.StatusRequestedRangeNotSatisfiable
+			f.Response.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", objectSize))
+			unencryptedBytes = []byte{}
+		} else if err != nil {
+			return err
+		} else {
+			unencryptedBytes = unencryptedBytes[start : end+1]
+			f.Response.StatusCode = http.StatusPartialContent
+			f.Response.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, objectSize))
+		}
+	}
+	f.Response.Body = unencryptedBytes
+	f.Response.Header.Set("Content-Length", strconv.Itoa(len(unencryptedBytes)))
+	return nil
+}
+
+// the S3 checksum headers the proxy computes for the ciphertext, and how
+var backendChecksums = map[string]func([]byte) []byte{
+	"x-amz-checksum-crc32": func(data []byte) []byte {
+		return binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(data))
+	},
+	"x-amz-checksum-crc32c": func(data []byte) []byte {
+		return binary.BigEndian.AppendUint32(nil, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	},
+	"x-amz-checksum-sha1": func(data []byte) []byte {
+		sum := sha1.Sum(data)
+		return sum[:]
+	},
+	"x-amz-checksum-sha256": func(data []byte) []byte {
+		sum := sha256.Sum256(data)
+		return sum[:]
+	},
+}
+
+// verifyBackendChecksums checks the checksums the client sent for the plaintext, the backend only
+// sees the ciphertext
+func verifyBackendChecksums(header http.Header, plaintext []byte) error {
+	if md5Header := header.Get("Content-MD5"); md5Header != "" && md5Header != crypto.Base64MD5Hash(plaintext) {
+		return fmt.Errorf("%w: Content-MD5 %v does not match the payload", ErrInvalidUpload, md5Header)
+	}
+	for name := range header {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, "x-amz-checksum-") || name == "x-amz-checksum-type" {
+			continue
+		}
+		checksum, ok := backendChecksums[name]
+		if !ok {
+			return fmt.Errorf("%w: %v can't be computed by the proxy, use CRC32, CRC32C, SHA1 or SHA256 checksums", ErrInvalidUpload, name)
+		}
+		if header.Get(name) != base64.StdEncoding.EncodeToString(checksum(plaintext)) {
+			return fmt.Errorf("%w: %v %v does not match the payload", ErrInvalidUpload, name, header.Get(name))
+		}
+	}
+	return nil
+}
+
+// setBackendChecksums replaces the checksums of the plaintext by those of the ciphertext, and the
+// SHA-256 of the payload of unsigned requests. Resign sets the latter for signed ones.
+func setBackendChecksums(header http.Header, ciphertext []byte) {
+	for name, checksum := range backendChecksums {
+		if header.Get(name) != "" {
+			header.Set(name, base64.StdEncoding.EncodeToString(checksum(ciphertext)))
+		}
+	}
+	if payloadHash := header.Get("x-amz-content-sha256"); payloadHash != "" && payloadHash != "UNSIGNED-PAYLOAD" {
+		sum := sha256.Sum256(ciphertext)
+		header.Set("x-amz-content-sha256", hex.EncodeToString(sum[:]))
+	}
+}
+
+// dropBackendChecksums removes the checksums of the ciphertext from a response
+func dropBackendChecksums(header http.Header) {
+	for name := range header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-checksum-") || lower == "x-ms-content-crc64" {
+			header.Del(name)
+		}
+	}
+	if header.Get("x-ms-blob-type") != "" {
+		// Azure's Content-MD5 of a download is the stored MD5, S3 sends none
+		header.Del("Content-MD5")
+	}
+}
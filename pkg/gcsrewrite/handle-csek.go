@@ -0,0 +1,131 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// HandleCsekRequest adds the customer-supplied encryption key headers to requests for objects in
+// buckets using the csek envelope format. GCS encrypts and decrypts the payload, so bodies and
+// responses are passed through unchanged.
+func HandleCsekRequest(f *proxy.Flow) error {
+	// rewrites and copies read one object and write another
+	for _, verb := range []string{"/rewriteTo/", "/copyTo/"} {
+		if source, destination, ok := strings.Cut(f.Request.URL.Path, verb); ok {
+			if err := setCsekHeaders(f, util.GetBucketNameFromRequestUri(source), util.GetObjectNameFromRequestUri(source), true); err != nil {
+				return err
+			}
+			destination = "/" + destination
+			return setCsekHeaders(f, util.GetBucketNameFromRequestUri(destination), util.GetObjectNameFromRequestUri(destination), false)
+		}
+	}
+
+	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	objectName, err := csekObjectName(f)
+	if err != nil {
+		return err
+	}
+	if objectName == "" {
+		// bucket level request such as a listing
+		return nil
+	}
+	return setCsekHeaders(f, bucketName, objectName, false)
+}
+
+// HandleCsekResponse remembers the object of a resumable upload session, its chunks are sent
+// with only the upload id.
+func HandleCsekResponse(f *proxy.Flow) error {
+	uploadId := f.Request.URL.Query().Get("upload_id")
+	if f.Request.Method == http.MethodPost && f.Request.URL.Query().Get("uploadType") == "resumable" && uploadId == "" {
+		return HandleResumablePostResponse(f)
+	}
+	if f.Request.Method == http.MethodPut && uploadId != "" {
+		// the upload is complete
+		_, err := LoadResumableData(uploadId)
+		return err
+	}
+	return nil
+}
+
+func setCsekHeaders(f *proxy.Flow, bucketName string, objectName string, copySource bool) error {
+	if util.KeyMapFor(f).Format(bucketName) != util.EnvelopeFormatCsek || objectName == "" {
+		return nil
+	}
+	key, err := crypto.DeriveCsekKey(kmsContext(f), util.KeyMapFor(f).Key(bucketName), bucketName, objectName)
+	if err != nil {
+		return err
+	}
+	for name, value := range crypto.CsekHeaders(key, copySource) {
+		f.Request.Header.Set(name, value)
+	}
+	log.Debugf("set customer-supplied encryption key for gs://%v/%v", bucketName, objectName)
+	return nil
+}
+
+// csekObjectName finds the object a request reads or writes: in the path for downloads and
+// metadata, the name parameter or the metadata part for uploads, the stored session for
+// resumable upload chunks.
+func csekObjectName(f *proxy.Flow) (string, error) {
+	query := f.Request.URL.Query()
+	if uploadId := query.Get("upload_id"); uploadId != "" && f.Request.Method == http.MethodPut {
+		resumeData, err := LoadResumableData(uploadId)
+		if err != nil {
+			return "", fmt.Errorf("error Loading Resumable Data: %v", err)
+		}
+		// keep the session for the following chunks, the final response removes it
+		if err := StoreResumableData(uploadId, resumeData); err != nil {
+			return "", err
+		}
+		return resumeData["name"], nil
+	}
+
+	if !strings.HasPrefix(f.Request.URL.Path, "/upload/") && !strings.HasPrefix(f.Request.URL.Path, "/resumable/") {
+		return util.GetObjectNameFromRequestUri(f.Request.URL.Path), nil
+	}
+	if name := query.Get("name"); name != "" {
+		return name, nil
+	}
+
+	// resumable session metadata is plain json, multipart uploads carry it in the first part
+	var metadata []byte
+	if query.Get("uploadType") == "resumable" {
+		metadata = f.Request.Body
+	}
+	mediaType, params, err := mime.ParseMediaType(f.Request.Header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		part, err := multipart.NewReader(bytes.NewReader(f.Request.Body), params["boundary"]).NextPart()
+		if err != nil {
+			return "", fmt.Errorf("error reading  multipart request: %v", err)
+		}
+		metadata, err = io.ReadAll(part)
+		if err != nil {
+			return "", fmt.Errorf("error reading  multipart request: %v", err)
+		}
+	}
+	if len(metadata) == 0 {
+		return "", nil
+	}
+	var objectMetadata struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(metadata, &objectMetadata); err != nil {
+		return "", fmt.Errorf("error unmarshalling gcsObjectMetadata: %v", err)
+	}
+	return objectMetadata.Name, nil
+}
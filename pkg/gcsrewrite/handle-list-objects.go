@@ -0,0 +1,59 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// HandleListRequest has the objects.list request of an encrypted bucket answered with the
+// metadata of the objects, which the fields of the client may leave out
+func HandleListRequest(f *proxy.Flow) error {
+	query := f.Request.URL.Query()
+	if mask, ok := expandFields(query, listFields); ok {
+		keepClientFields(f, map[string]fieldMask{"": mask})
+		f.Request.URL.RawQuery = query.Encode()
+		log.Debugf("listing with fields %v", query.Get("fields"))
+	}
+	return nil
+}
+
+// HandleListResponse rewrites the objects of an objects.list response to describe their
+// plaintext and link the endpoint of the client, like HandleMetadataResponse, after queueing them
+// for prefetching
+func HandleListResponse(f *proxy.Flow) error {
+	PrefetchListed(f)
+
+	body, err := f.Response.DecodedBody()
+	if err != nil {
+		return fmt.Errorf("error decoding listing: %v", err)
+	}
+	var listing map[string]interface{}
+	if err := json.Unmarshal(body, &listing); err != nil {
+		return fmt.Errorf("error unmarshalling listing: %v", err)
+	}
+	mask, masked := takeClientFields(f)[""]
+	rewritten := false
+	items, _ := listing["items"].([]interface{})
+	for _, item := range items {
+		if resource, ok := item.(map[string]interface{}); ok && describeResource(f, resource) {
+			rewritten = true
+		}
+	}
+	if !rewritten && !masked {
+		return nil
+	}
+	if body, err = json.Marshal(mask.apply(listing)); err != nil {
+		return fmt.Errorf("error marshalling listing: %v", err)
+	}
+	f.Response.Body = body
+	f.Response.Header.Del("Content-Encoding")
+	return nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+func HandleMetadataRequest(f *proxy.Flow) error {
+
+	log.Debug(fmt.Sprintf("HandleMetadataRequest got query string  %s", f.Request.URL.RawQuery))
+
+	queryString := f.Request.URL.Query()
+
+	// the plaintext is described from the metadata, which the fields of the client may leave out
+	if mask, ok := expandFields(queryString, objectFields); ok {
+		keepClientFields(f, map[string]fieldMask{"": mask})
+	}
+	f.Request.URL.RawQuery = queryString.Encode()
+
+	log.Debug(fmt.Sprintf("formatted query string to %s", f.Request.URL.RawQuery))
+	return nil
+}
+
+func HandleMetadataResponse(f *proxy.Flow) error {
+
+	log.Debug(fmt.Sprintf("got metadata response: %s", f.Response.Body))
+
+	// Unmarshal the json contents of the first part.
+	var gcsMetadataMap map[string]interface{}
+	err := json.Unmarshal(f.Response.Body, &gcsMetadataMap)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling gcsObjectMetadata: %v", err)
+	}
+
+	mask, masked := takeClientFields(f)[""]
+	if describeResource(f, gcsMetadataMap) || masked {
+		// Now write the gcs object metadata back, with the fields the client asked for
+		jsonData, err := json.MarshalIndent(mask.apply(gcsMetadataMap), "", "\t")
+		if err != nil {
+			return fmt.Errorf("error marshalling gcsObjectMetadata: %v", err)
+		}
+		f.Response.Body = jsonData
+		log.Debug(fmt.Sprintf("rewrote metadata response: %s", f.Response.Body))
+	}
+
+	return nil
+}
+
+// describePlaintext overwrites the size and hashes of an encrypted object's resource with those of
+// its plaintext. objects stored in plaintext have no unencrypted length to report, it returns false.
+func describePlaintext(gcsMetadataMap map[string]interface{}) bool {
+	customMetadata, ok := gcsMetadataMap["metadata"].(map[string]interface{})
+	size, encrypted := util.LookupMeta(customMetadata, util.MetaUnencryptedLength)
+	if !ok || !encrypted {
+		return false
+	}
+	// overwrite the size & hash parameter with the unencrypted size & hash
+	gcsMetadataMap["size"] = size
+	gcsMetadataMap["md5Hash"], _ = util.LookupMeta(customMetadata, util.MetaMd5Hash)
+
+	// the stored crc32c is the ciphertext checksum. sliced downloads validate the
+	// combined slices against it, so report the plaintext one or none at all.
+	if crc32c, ok := util.LookupMeta(customMetadata, util.MetaCrc32c); ok {
+		gcsMetadataMap["crc32c"] = crc32c
+	} else {
+		delete(gcsMetadataMap, "crc32c")
+	}
+	return true
+}
@@ -3,11 +3,10 @@ Copyright 2025 Google.
 
 This software is provided as-is, without warranty or representation for any use or purpose.
 */
-package handlers
+package gcsrewrite
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -19,6 +18,8 @@ import (
 
 	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
 	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/mirror"
 	"github.com/byronwhitlock-google/go-gcsproxy/util"
 	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
 	log "github.com/sirupsen/logrus"
@@ -126,7 +127,15 @@ func HandleMultipartRequest(f *proxy.Flow) error {
 		return fmt.Errorf("error reading  multipart request: %v", err)
 	}
 
+	// the object resource names the content type, GCS falls back to the one of the media part
+	objectContentType, _ := gcsMetadataMap["contentType"].(string)
+	if objectContentType == "" {
+		objectContentType = part.Header.Get("Content-Type")
+	}
+
 	var encryptedData []byte
+	var keyVersion string
+	empty := false
 	// Get file contents
 	if part.FileName() == "" {
 		rawBytes, err := io.ReadAll(part)
@@ -136,33 +145,66 @@ func HandleMultipartRequest(f *proxy.Flow) error {
 			return fmt.Errorf("error reading  multipart request: %v", err)
 		}
 
-		// Encrypt the intercepted file
-
-		ctx := f.Request.Raw().Context()
-		ctxValue := context.WithValue(ctx, "requestid", f.Id.String())
-		encryptedData, err = crypto.EncryptBytes(ctxValue,
-			util.GetKMSKeyName(bucketName),
-			unencryptedFileContent.Bytes())
-
-		if err != nil {
-			return fmt.Errorf("error encrypting  request: %v", err)
+		size := uploadSize{int64(len(rawBytes)), true}
+		if empty = skipEmpty(f, bucketName, size); !empty {
+			if skipByRules(f, bucketName, objectContentType, size) {
+				return nil
+			}
+			if skip, err := skipEncryption(f, rawBytes); skip || err != nil {
+				return err
+			}
+
+			// Encrypt the intercepted file
+
+			objectName, _ := gcsMetadataMap["name"].(string)
+			ctxValue := uploadContext(f, bucketName, objectName)
+			encryptedData, keyVersion, err = crypto.EncryptBytesWithKeyVersion(ctxValue,
+				util.KeyMapFor(f).Key(bucketName),
+				unencryptedFileContent.Bytes())
+
+			if err != nil {
+				return fmt.Errorf("error encrypting  request: %w", err)
+			}
 		}
-
 	}
 	///
 	///
 	/// Create multipart request
 	///
 	///
+	// client supplied checksums describe the plaintext, GCS would validate them against the
+	// ciphertext and reject the upload. verify them here instead and drop them from the request.
+	err = verifyClientChecksums(gcsMetadataMap, unencryptedFileContent.Bytes())
+	if err != nil {
+		return err
+	}
+
 	// TODO move this into its own method
 	// Access and modify the nested value dynamically
 	customMetadata, ok := gcsMetadataMap["metadata"].(map[string]interface{})
 	if ok {
-
-		customMetadata["x-unencrypted-content-length"] = len(unencryptedFileContent.String())
-		customMetadata["x-md5Hash"] = crypto.Base64MD5Hash(unencryptedFileContent.Bytes())
-		customMetadata["x-encryption-key"] = util.GetKMSKeyName(bucketName)
-		customMetadata["x-proxy-version"] = cfg.GlobalConfig.GCSProxyVersion
+		if err := checkReservedMetadata(customMetadata); err != nil {
+			return err
+		}
+	}
+	if ok && empty {
+		for key, value := range emptyObjectMetadata() {
+			customMetadata[key] = value
+		}
+	} else if ok {
+		customMetadata[util.MetaKey(util.MetaUnencryptedLength)] = len(unencryptedFileContent.String())
+		customMetadata[util.MetaKey(util.MetaMd5Hash)] = crypto.Base64MD5Hash(unencryptedFileContent.Bytes())
+		customMetadata[util.MetaKey(util.MetaCrc32c)] = crypto.Base64Crc32cHash(unencryptedFileContent.Bytes())
+		customMetadata[util.MetaKey(util.MetaEncryptionKey)] = util.KeyMapFor(f).Key(bucketName)
+		customMetadata[util.MetaKey(util.MetaEncryptionKeyVersion)] = keyVersion
+		customMetadata[util.MetaKey(util.MetaProxyVersion)] = cfg.For(f).GCSProxyVersion
+		customMetadata[util.MetaKey(util.MetaEnvelopeVersion)] = envelope.Version
+		if crypto.EscrowKeyName != "" {
+			customMetadata[util.MetaKey(util.MetaEscrowKey)] = crypto.EscrowKeyName
+		}
+		for key, value := range util.EncryptionProvenance(util.KeyMapFor(f).Policy) {
+			customMetadata[key] = value
+		}
 	}
 
 	log.Debug(string(gcsObjectMetadataJson))
@@ -190,6 +232,10 @@ func HandleMultipartRequest(f *proxy.Flow) error {
 
 	// write the final encrypted part
 	writer_part.Write(encryptedData)
+	if !empty {
+		recordCiphertextHashes(f, encryptedData)
+		mirror.Keep(f, bucketName, unencryptedFileContent.Bytes())
+	}
 
 	multipartWriter.Close()
 
@@ -209,10 +255,30 @@ func HandleMultipartRequest(f *proxy.Flow) error {
 	// save the original md5 has or gsutil/gcloud will delete after upload if it sees it is different
 	f.Request.Header.Set("gcs-proxy-original-md5-hash",
 		crypto.Base64MD5Hash(unencryptedFileContent.Bytes()))
+	f.Request.Header.Set("gcs-proxy-original-crc32c",
+		crypto.Base64Crc32cHash(unencryptedFileContent.Bytes()))
 
 	return nil
 }
 
+// verifyClientChecksums checks the md5Hash and crc32c fields of the object resource sent by the
+// client against the plaintext and removes them from the resource.
+func verifyClientChecksums(gcsMetadataMap map[string]interface{}, plaintext []byte) error {
+	if md5Hash, ok := gcsMetadataMap["md5Hash"].(string); ok {
+		if md5Hash != crypto.Base64MD5Hash(plaintext) {
+			return fmt.Errorf("md5Hash in upload metadata does not match the uploaded content")
+		}
+		delete(gcsMetadataMap, "md5Hash")
+	}
+	if crc32c, ok := gcsMetadataMap["crc32c"].(string); ok {
+		if crc32c != crypto.Base64Crc32cHash(plaintext) {
+			return fmt.Errorf("crc32c in upload metadata does not match the uploaded content")
+		}
+		delete(gcsMetadataMap, "crc32c")
+	}
+	return nil
+}
+
 func HandleMultipartResponse(f *proxy.Flow) error {
 	log.Debug("in HandleMultipartResponse")
 
@@ -226,11 +292,14 @@ func HandleMultipartResponse(f *proxy.Flow) error {
 
 	// update the response with the orginal md5 hash so gsutil/gcloud does not complain
 	jsonResponse["md5Hash"] = f.Request.Header.Get("gcs-proxy-original-md5-hash")
+	jsonResponse["crc32c"] = f.Request.Header.Get("gcs-proxy-original-crc32c")
 	jsonResponse["size"], err = strconv.Atoi(f.Request.Header.Get("gcs-proxy-unencrypted-file-size"))
 	if err != nil {
 		return fmt.Errorf("error setting json response: %v", err)
 	}
 
+	rewriteLinks(f, jsonResponse)
+
 	jsonData, err := json.Marshal(jsonResponse)
 	if err != nil {
 		return fmt.Errorf("error marshaling to JSON: %v", err)
@@ -239,3 +308,12 @@ func HandleMultipartResponse(f *proxy.Flow) error {
 	f.Response.Body = jsonData
 	return nil
 }
+
+// checkReservedMetadata refuses client metadata the proxy would overwrite with its own, also when it
+// was copied from an object the proxy wrote
+func checkReservedMetadata[V any](metadata map[string]V) error {
+	if keys := util.ReservedMetadata(metadata); len(keys) > 0 {
+		return fmt.Errorf("%w: metadata %v is reserved by the proxy, see -metadata_prefix", ErrInvalidUpload, strings.Join(keys, ", "))
+	}
+	return nil
+}
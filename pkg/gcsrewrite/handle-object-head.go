@@ -0,0 +1,86 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// HandleObjectHeadRequest has GCS answer a ranged HEAD for the whole object, the range is resolved
+// against the plaintext length like the one of a download
+func HandleObjectHeadRequest(f *proxy.Flow) error {
+	if byteRangeHeader := f.Request.Header.Get("range"); byteRangeHeader != "" {
+		f.Request.Header.Set("x-original-byte-range", byteRangeHeader)
+		f.Request.Header.Del("range")
+	}
+	return nil
+}
+
+// HandleObjectHeadResponse rewrites the length and hash headers of the HEAD of an encrypted object
+// to describe its plaintext, from the metadata recorded at upload and without reading the object,
+// like HandleMetadataResponse does for the object resource. Objects without the metadata are
+// stored as they are and answered as GCS sent them, it reports whether the headers were rewritten.
+func HandleObjectHeadResponse(f *proxy.Flow) (bool, error) {
+	header := f.Response.Header
+	sizeString := util.MetaHeader(header, util.MetaUnencryptedLength)
+	if sizeString == "" {
+		log.Debugf("%v has no unencrypted length, answering its HEAD as it is", f.Request.URL.Path)
+		return false, nil
+	}
+	objectSize, err := strconv.Atoi(sizeString)
+	if err != nil || objectSize < 0 {
+		return false, fmt.Errorf("invalid unencrypted length %q of %v", sizeString, f.Request.URL.Path)
+	}
+
+	// the stored crc32c and md5 are those of the ciphertext, report the plaintext ones or none at all
+	var hashes []string
+	if crc32c := util.MetaHeader(header, util.MetaCrc32c); crc32c != "" {
+		hashes = append(hashes, "crc32c="+crc32c)
+	}
+	md5Hash := util.MetaHeader(header, util.MetaMd5Hash)
+	if md5Hash != "" {
+		hashes = append(hashes, "md5="+md5Hash)
+	}
+	header.Del("X-Goog-Hash")
+	if len(hashes) > 0 {
+		header.Set("X-Goog-Hash", strings.Join(hashes, ","))
+	}
+	if sum, err := base64.StdEncoding.DecodeString(md5Hash); err == nil && len(sum) == md5.Size {
+		header.Set("X-Gcs-Proxy-Plaintext-Etag", fmt.Sprintf("\"%x\"", sum))
+	}
+	header.Set("X-Goog-Stored-Content-Length", strconv.Itoa(objectSize))
+
+	contentLength := objectSize
+	if byteRangeHeader := f.Request.Header.Get("x-original-byte-range"); byteRangeHeader != "" && objectSize > 0 {
+		start, end, err := parseRangeHeader(byteRangeHeader, objectSize)
+		switch {
+		case errors.Is(err, errRangeNotSatisfiable):
+			log.Debugf("%v", err)
+			f.Response.StatusCode = http.StatusRequestedRangeNotSatisfiable
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", objectSize))
+			contentLength = 0
+		case err != nil:
+			return false, err
+		default:
+			f.Response.StatusCode = http.StatusPartialContent
+			header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, objectSize))
+			contentLength = end - start + 1
+		}
+	}
+	log.Debugf("plaintext content length of HEAD %v: %v", f.Request.URL.Path, contentLength)
+	header.Set("Content-Length", strconv.Itoa(contentLength))
+	return true, nil
+}
@@ -3,7 +3,7 @@ Copyright 2025 Google.
 
 This software is provided as-is, without warranty or representation for any use or purpose.
 */
-package handlers
+package gcsrewrite
 
 import (
 	"encoding/json"
@@ -22,16 +22,6 @@ import (
 // this is the raw data to be encoded.
 func HandleResumablePutRequest(f *proxy.Flow) error {
 
-	byteRangeHeader := f.Request.Header.Get("Content-Range")
-	start, end, size, err := parseContentRangeHeader(byteRangeHeader)
-	if err != nil {
-		return err
-	}
-
-	if !(start == 0 && end+1 == size) {
-		return fmt.Errorf("unsupported Byte range detected '%v'", byteRangeHeader)
-	}
-
 	// first we need the uploader id so we can get the resumable metadata.
 	log.Debugf("HandleResumablePutRequest got query string  %s", f.Request.URL.RawQuery)
 
@@ -44,15 +34,64 @@ func HandleResumablePutRequest(f *proxy.Flow) error {
 	if err != nil {
 		return fmt.Errorf("error Loading Resumable Data: %v", err)
 	}
+	if f.Request.Header.Get(BufferChunksHeader) != "" {
+		// the rules and the encryption see the whole object once its last chunk arrived
+		if last, err := bufferChunk(f, uploadId, resumeData); err != nil || !last {
+			return err
+		}
+	}
 
+	// plaintext uploads continue the resumable session unchanged, in as many chunks as the client likes
+	contentType := resumeData["contentType"]
+	if contentType == "" {
+		contentType = f.Request.Header.Get("Content-Type")
+	}
+	// an empty upload finishes the session with "bytes */0", it is converted like the others and
+	// stored as it is by ConvertSinglePartUploadtoMultiPartUpload
+	uploadSize := resumableUploadSize(f, resumeData)
+	empty := uploadSize.exact && uploadSize.size == 0 && len(f.Request.Body) == 0
+	if !empty {
+		if skipByRules(f, resumeData["bucket"], contentType, uploadSize) {
+			return nil
+		}
+
+		byteRangeHeader := f.Request.Header.Get("Content-Range")
+		start, end, size, err := parseContentRangeHeader(byteRangeHeader)
+		if err != nil {
+			return err
+		}
+
+		if !(start == 0 && end+1 == size) {
+			return fmt.Errorf("unsupported Byte range detected '%v'", byteRangeHeader)
+		}
+
+		// already encrypted uploads continue the resumable session unchanged
+		if skip, err := skipEncryption(f, f.Request.Body); skip || err != nil {
+			return err
+		}
+	}
+
+	userProject := f.Request.URL.Query().Get("userProject")
+	if userProject == "" {
+		userProject = resumeData["userProject"]
+	}
 	url, err := url.Parse(fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%v/o?name=%v", resumeData["bucket"], resumeData["name"]))
 	if err != nil {
 		panic(err) // Handle the error appropriately in a real application
 	}
+	if userProject != "" {
+		// the upload replacing the session bills the same Requester Pays project
+		query := url.Query()
+		query.Set("userProject", userProject)
+		url.RawQuery = query.Encode()
+	}
 	f.Request.URL = url
+	rememberResumableSession(f, uploadId)
+	if contentType != "" {
+		f.Request.Header.Set("Content-Type", contentType)
+	}
 
-	ConvertSinglePartUploadtoMultiPartUpload(f)
-	return nil
+	return ConvertSinglePartUploadtoMultiPartUpload(f)
 }
 
 // TODO eshen remove the function if it's not needed
@@ -77,6 +116,8 @@ func HandleResumablePutResponse(f *proxy.Flow) error {
 		return fmt.Errorf("error setting json response: %v", err)
 	}
 
+	rewriteLinks(f, jsonResponse)
+
 	jsonData, err := json.Marshal(jsonResponse)
 	if err != nil {
 		return fmt.Errorf("error marshaling to JSON: %v", err)
@@ -86,6 +127,26 @@ func HandleResumablePutResponse(f *proxy.Flow) error {
 	return nil
 }
 
+// resumableUploadSize is the size the client announced when it started the session, or the
+// one of the chunk's Content-Range. chunks of uploads of unknown size only give a lower bound.
+func resumableUploadSize(f *proxy.Flow, resumeData map[string]string) uploadSize {
+	if size, err := strconv.ParseInt(resumeData["size"], 10, 64); err == nil {
+		return uploadSize{size, true}
+	}
+	// "bytes 0-262143/*", "bytes 262144-524287/524288" or "bytes */524288"
+	matches := contentRangeSizePattern.FindStringSubmatch(f.Request.Header.Get("Content-Range"))
+	if matches == nil {
+		return uploadSize{int64(len(f.Request.Body)), false}
+	}
+	if size, err := strconv.ParseInt(matches[2], 10, 64); err == nil {
+		return uploadSize{size, true}
+	}
+	end, _ := strconv.ParseInt(matches[1], 10, 64)
+	return uploadSize{end + 1, false}
+}
+
+var contentRangeSizePattern = regexp.MustCompile(`bytes (?:\d+-(\d+)|\*)/(\d+|\*)`)
+
 // rangeString = "bytes 0-72355493/72355494"
 func parseContentRangeHeader(rangeStr string) (start int, end int, size int, err error) {
 	// Regular expression to capture the start, end, and total values
@@ -115,7 +176,10 @@ func parseContentRangeHeader(rangeStr string) (start int, end int, size int, err
 }
 
 func HandleResumablePostRequest(f *proxy.Flow) error {
-	// strip X-upload-content-length
+	// strip X-upload-content-length, the session keeps it for the size rules
+	if size := f.Request.Header.Get("X-Upload-Content-Length"); size != "" {
+		f.Request.Header.Set("gcs-proxy-upload-content-length", size)
+	}
 	f.Request.Header.Del("x-upload-content-length")
 	f.Request.Header.Del("X-Upload-Content-Length")
 	return nil //do nothing
@@ -143,6 +207,15 @@ func HandleResumablePostResponse(f *proxy.Flow) error {
 	if !exists {
 		dataMap["bucket"] = util.GetBucketNameFromRequestUri(f.Request.URL.Path)
 	}
+	if dataMap["contentType"] == "" && f.Request.Header.Get("X-Upload-Content-Type") != "" {
+		dataMap["contentType"] = f.Request.Header.Get("X-Upload-Content-Type")
+	}
+	if size := f.Request.Header.Get("gcs-proxy-upload-content-length"); size != "" {
+		dataMap["size"] = size
+	}
+	if userProject := f.Request.URL.Query().Get("userProject"); userProject != "" {
+		dataMap["userProject"] = userProject
+	}
 
 	// uploader id comes from GCS so it is in the Response
 	uploaderId := f.Response.Header.Get("X-GUploader-UploadID")
@@ -0,0 +1,316 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// the requested range starts past the end of the object. GCS answers these with 416, which
+// range readers such as the Hadoop connector treat as end of file.
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// parseRangeHeader resolves a single byte range against an object of the given size.
+// The returned end is inclusive, as in the header. Supported forms:
+//
+//	bytes=0-72355493
+//	bytes=1000-
+//	bytes=-500
+func parseRangeHeader(header string, size int) (start int, end int, err error) {
+	parts := strings.Split(header, "=")
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) != "bytes" {
+		return 0, 0, fmt.Errorf("invalid Range header format")
+	}
+	if strings.Contains(parts[1], ",") {
+		return 0, 0, fmt.Errorf("multiple byte ranges are not supported: %v", header)
+	}
+
+	rangeValues := strings.Split(strings.TrimSpace(parts[1]), "-")
+	if len(rangeValues) != 2 {
+		return 0, 0, fmt.Errorf("invalid Range header format")
+	}
+
+	// suffix range: the last N bytes
+	if rangeValues[0] == "" {
+		n, err := strconv.Atoi(rangeValues[1])
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid suffix length: %v", rangeValues[1])
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, nil
+	}
+
+	s, err := strconv.Atoi(rangeValues[0])
+	if err != nil || s < 0 {
+		return 0, 0, fmt.Errorf("invalid start value: %v", rangeValues[0])
+	}
+	if s >= size {
+		return 0, 0, fmt.Errorf("%w: start byte %v, object length %v", errRangeNotSatisfiable, s, size)
+	}
+
+	e := size - 1
+	if rangeValues[1] != "" {
+		e, err = strconv.Atoi(rangeValues[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid end value: %w", err)
+		}
+		if e < s {
+			return 0, 0, fmt.Errorf("invalid byte range request: %v", header)
+		}
+		if e > size-1 {
+			e = size - 1
+		}
+	}
+
+	return s, e, nil
+}
+
+func HandleSimpleDownloadRequest(f *proxy.Flow) error {
+	// objects prefetched after a listing, whole or a range of them
+	if entry, ok := prefetchedDownload(f); ok {
+		if byteRangeHeader := f.Request.Header.Get("range"); byteRangeHeader != "" {
+			f.Request.Header.Set("x-original-byte-range", byteRangeHeader)
+			f.Request.Header.Del("range")
+		}
+		log.Debugf("serving %v from the objects prefetched after a listing", f.Request.URL.Path)
+		f.Response = &proxy.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+		}
+		f.Response.Header.Set("Content-Type", entry.contentType)
+		f.Response.Header.Set("X-Goog-Generation", entry.generation)
+		if entry.etag != "" {
+			f.Response.Header.Set("ETag", entry.etag)
+		}
+		return writeDownloadBody(f, entry.plaintext)
+	}
+
+	// handle streaming downloads in an ineffecient way. download whole file and return range.
+	byteRangeHeader := f.Request.Header.Get("range")
+	if byteRangeHeader == "" {
+		return nil
+	}
+	f.Request.Header.Set("x-original-byte-range", byteRangeHeader)
+	f.Request.Header.Del("range")
+
+	// slices of a sliced download pin the generation, so a previous slice may already have
+	// decrypted the exact object we need
+	// conditional requests are always evaluated by GCS against the stored object
+	generation := f.Request.URL.Query().Get("generation")
+	cache := getPlaintextCache()
+	if generation == "" || cache == nil || isConditionalRequest(f.Request.Header) {
+		return nil
+	}
+	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	objectName := util.GetObjectNameFromRequestUri(f.Request.URL.Path)
+	key := plaintextCacheKey(f.Request.Header.Get("Authorization"), bucketName, objectName, generation)
+	entry, ok := cache.get(key)
+	if !ok {
+		return nil
+	}
+
+	log.Debugf("serving slice %v of gs://%v/%v#%v from plaintext cache", byteRangeHeader, bucketName, objectName, generation)
+	f.Response = &proxy.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+	}
+	f.Response.Header.Set("Content-Type", entry.contentType)
+	f.Response.Header.Set("X-Goog-Generation", generation)
+	if entry.etag != "" {
+		f.Response.Header.Set("ETag", entry.etag)
+	}
+	return writeDownloadBody(f, entry.plaintext)
+}
+
+func isConditionalRequest(header http.Header) bool {
+	for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleSimpleDownloadResponseHeaders sets Content-Length to the plaintext length before the body
+// is read, using the unencrypted length recorded in the object metadata at upload.
+func HandleSimpleDownloadResponseHeaders(f *proxy.Flow) {
+	if f.Response.StatusCode != http.StatusOK || f.Response.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	objectSize, err := strconv.Atoi(util.MetaHeader(f.Response.Header, util.MetaUnencryptedLength))
+	if err != nil {
+		return
+	}
+
+	contentLength := objectSize
+	if byteRangeHeader := f.Request.Header.Get("x-original-byte-range"); byteRangeHeader != "" && objectSize > 0 {
+		start, end, err := parseRangeHeader(byteRangeHeader, objectSize)
+		if err != nil {
+			return
+		}
+		contentLength = end - start + 1
+	}
+	log.Debugf("plaintext content length from metadata: %v", contentLength)
+	f.Response.Header.Set("Content-Length", strconv.Itoa(contentLength))
+	f.Response.Header.Set("X-Goog-Stored-Content-Length", strconv.Itoa(objectSize))
+}
+
+func HandleSimpleDownloadResponse(f *proxy.Flow) error {
+	log.Debugf("encrypted content len :%v", len(f.Response.Body))
+
+	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	objectName := util.GetObjectNameFromRequestUri(f.Request.URL.Path)
+	if StoredInPlaintext(f, bucketName) {
+		log.Debugf("gs://%v/%v is empty or stored in plaintext by the content type or size rules", bucketName, objectName)
+		return writeDownloadBody(f, f.Response.Body)
+	}
+	keyIDs, provenance, err := downloadEncryptionKeys(f, bucketName, objectName)
+	if err != nil {
+		return err
+	}
+	if provenance.Newer() {
+		return fmt.Errorf("gs://%v/%v is %v, this proxy reads envelope versions up to %v: upgrade it",
+			bucketName, objectName, provenance, envelope.Version)
+	}
+
+	generation := f.Response.Header.Get("X-Goog-Generation")
+	keyIDs = decryptionKeys.order(bucketName, objectName, generation, keyIDs)
+	log.Debug(bucketName, objectName, keyIDs)
+	decrypt := func() ([]byte, error) {
+		ctxValue := crypto.WithPartManifest(kmsContext(f), util.PartManifestHeader(f.Response.Header))
+		var errs []error
+		for _, keyID := range keyIDs {
+			var unencryptedBytes []byte
+			var err error
+			if provenance.Foreign {
+				unencryptedBytes, err = crypto.DecryptForeignBytes(ctxValue, keyID, f.Response.Body,
+					util.ForeignAssociatedData(bucketName, objectName))
+			} else {
+				unencryptedBytes, err = crypto.DecryptBytes(ctxValue, keyID, f.Response.Body)
+			}
+			if err == nil {
+				if len(errs) > 0 {
+					log.Infof("gs://%v/%v decrypted with fallback key %v", bucketName, objectName, keyID)
+					decryptionKeys.remember(bucketName, objectName, generation, keyID)
+				}
+				return unencryptedBytes, nil
+			}
+			errs = append(errs, fmt.Errorf("%v: %w", keyID, err))
+		}
+		return nil, fmt.Errorf("unable to decrypt response body of gs://%v/%v (%v):%w", bucketName, objectName, provenance, errors.Join(errs...))
+	}
+
+	var unencryptedBytes []byte
+	cache := getPlaintextCache()
+	if cache != nil && generation != "" && f.Request.Header.Get("x-original-byte-range") != "" {
+		// ranged read, probably one slice of many. let the other slices share this decryption
+		key := plaintextCacheKey(f.Request.Header.Get("Authorization"), bucketName, objectName, generation)
+		unencryptedBytes, err = cache.getOrDecrypt(key, f.Response.Header.Get("Content-Type"), f.Response.Header.Get("ETag"), decrypt)
+	} else {
+		unencryptedBytes, err = decrypt()
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeDownloadBody(f, unencryptedBytes)
+}
+
+// downloadEncryptionKeys resolves the KMS keys to try for the generation GCS is returning, and its
+// recorded provenance. Keys are rotated and bucket mappings change, so older generations may use a
+// key other than the one mapped today. the key recorded in the object's own metadata comes first
+// when it is one of the bucket's keys, restored generations that predate key recording fall back to
+// the mapped and configured fallback keys.
+func downloadEncryptionKeys(f *proxy.Flow, bucketName string, objectName string) ([]string, util.Provenance, error) {
+	// XML API downloads already carry the custom metadata
+	provenance := util.ProvenanceOfHeader(f.Response.Header)
+	if provenance.Key == "" {
+		var generation int64
+		if g := f.Response.Header.Get("X-Goog-Generation"); g != "" {
+			var err error
+			generation, err = strconv.ParseInt(g, 10, 64)
+			if err != nil {
+				return nil, provenance, fmt.Errorf("invalid X-Goog-Generation header %v: %v", g, err)
+			}
+		}
+		var err error
+		provenance, err = util.GetObjectProvenance(util.WithUserProject(f.Request.Raw().Context(), util.UserProject(f)), bucketName, objectName, generation)
+		if err != nil {
+			return nil, provenance, fmt.Errorf("unable to look up encryption key: %v", err)
+		}
+		if provenance.Key == "" {
+			log.Debugf("gs://%v/%v#%v has no recorded encryption key", bucketName, objectName, generation)
+		}
+	}
+
+	keyIDs := util.KeyMapFor(f).CandidateKeys(provenance.Key, bucketName)
+	if len(keyIDs) == 0 {
+		return nil, provenance, fmt.Errorf("no encryption key for gs://%v/%v", bucketName, objectName)
+	}
+	return keyIDs, provenance, nil
+}
+
+// writeDownloadBody sets the response body to the plaintext, or to the slice of it
+// requested by the client's original Range header, and fixes up the length and hash headers.
+func writeDownloadBody(f *proxy.Flow, unencryptedBytes []byte) error {
+	objectSize := len(unencryptedBytes)
+
+	// hashes always describe the complete object, as they do for GCS ranged reads
+	md5Hash := md5.Sum(unencryptedBytes)
+	f.Response.Header.Set("X-Goog-Hash",
+		fmt.Sprintf("crc32c=%v,md5=%v", crypto.Base64Crc32cHash(unencryptedBytes), base64.StdEncoding.EncodeToString(md5Hash[:])))
+
+	// the ETag is left as GCS sent it, it identifies the stored object and is what GCS compares
+	// If-Match/If-None-Match against. caches that want a content hash of what they received use this one.
+	f.Response.Header.Set("X-Gcs-Proxy-Plaintext-Etag", fmt.Sprintf("\"%x\"", md5Hash))
+	f.Response.Header.Set("X-Goog-Stored-Content-Length", strconv.Itoa(objectSize))
+
+	// check if this was as streaming/chunked download
+	byteRangeHeader := f.Request.Header.Get("x-original-byte-range")
+	if byteRangeHeader != "" && objectSize > 0 {
+		log.Debugf("Grabbing requested byte range slice %v", byteRangeHeader)
+		start, end, err := parseRangeHeader(byteRangeHeader, objectSize)
+		if errors.Is(err, errRangeNotSatisfiable) {
+			log.Debugf("%v", err)
+			f.Response.StatusCode = http.StatusRequestedRangeNotSatisfiable
+			f.Response.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", objectSize))
+			f.Response.Header.Set("Content-Length", "0")
+			f.Response.Body = []byte{}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		unencryptedBytes = unencryptedBytes[start : end+1] //TODO: Performance/profiling
+		f.Response.StatusCode = http.StatusPartialContent
+		f.Response.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, objectSize))
+	}
+
+	f.Response.Body = unencryptedBytes
+	contentLength := len(unencryptedBytes)
+
+	log.Debugf("decrypted content len : %v", contentLength)
+
+	// Update content length headers with new length of decrypted data
+	f.Response.Header.Set("Content-Length", strconv.Itoa(contentLength))
+
+	return nil
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRangeHeader(t *testing.T) {
+	tests := []struct {
+		header         string
+		size           int
+		start, end     int
+		err            bool
+		notSatisfiable bool
+	}{
+		{header: "bytes=0-9", size: 100, start: 0, end: 9},
+		{header: "bytes=10-", size: 100, start: 10, end: 99},
+		{header: "bytes=-10", size: 100, start: 90, end: 99},
+		{header: "bytes=-1000", size: 100, start: 0, end: 99},
+		{header: "bytes=50-1000", size: 100, start: 50, end: 99},
+		{header: "bytes=99-99", size: 100, start: 99, end: 99},
+		{header: " bytes = 5-6", size: 100, start: 5, end: 6},
+		{header: "bytes=100-", size: 100, notSatisfiable: true},
+		{header: "bytes=0-", size: 0, notSatisfiable: true},
+		{header: "bytes=9-5", size: 100, err: true},
+		{header: "bytes=-0", size: 100, err: true},
+		{header: "bytes=a-5", size: 100, err: true},
+		{header: "bytes=-5-", size: 100, err: true},
+		{header: "bytes=0-1,5-6", size: 100, err: true},
+		{header: "items=0-9", size: 100, err: true},
+		{header: "bytes", size: 100, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.header, func(t *testing.T) {
+			start, end, err := parseRangeHeader(test.header, test.size)
+			switch {
+			case test.notSatisfiable:
+				if !errors.Is(err, errRangeNotSatisfiable) {
+					t.Fatalf("got %v, %v, %v, want errRangeNotSatisfiable", start, end, err)
+				}
+			case test.err:
+				if err == nil || errors.Is(err, errRangeNotSatisfiable) {
+					t.Fatalf("got %v, %v, %v, want an invalid range", start, end, err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case start != test.start || end != test.end:
+				t.Fatalf("got %v-%v, want %v-%v", start, end, test.start, test.end)
+			}
+		})
+	}
+}
@@ -3,17 +3,19 @@ Copyright 2025 Google.
 
 This software is provided as-is, without warranty or representation for any use or purpose.
 */
-package handlers
+package gcsrewrite
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"mime/multipart"
 	"strconv"
+	"strings"
 
 	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/mirror"
 	"github.com/byronwhitlock-google/go-gcsproxy/util"
 	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
 	log "github.com/sirupsen/logrus"
@@ -26,11 +28,41 @@ import (
 		3. Change the body to use boundary and add metadata and body(ecnrypted)
 */
 
+// ErrInvalidUpload is an upload GCS would refuse or the proxy would have to alter the metadata of,
+// it is answered with 400 without uploading
+var ErrInvalidUpload = errors.New("invalid upload")
+
 func ConvertSinglePartUploadtoMultiPartUpload(f *proxy.Flow) error {
+	if f.Request.URL.Query().Get("name") == "" {
+		return fmt.Errorf("%w: uploadType=media requires the name query parameter", ErrInvalidUpload)
+	}
+	size := uploadSize{int64(len(f.Request.Body)), true}
+	// empty uploads are still converted, a media upload carries no metadata to mark them with
+	empty := skipEmpty(f, util.GetBucketNameFromRequestUri(f.Request.URL.Path), size)
+	if !empty && skipByRules(f, util.GetBucketNameFromRequestUri(f.Request.URL.Path), f.Request.Header.Get("Content-Type"), size) {
+		return nil
+	}
+	if !empty {
+		if skip, err := skipEncryption(f, f.Request.Body); skip || err != nil {
+			return err
+		}
+	}
 
-	// URL change to use Multipart
-	objectName := f.Request.URL.Query().Get("name")
-	f.Request.URL.RawQuery = "uploadType=multipart&alt=json"
+	// URL change to use Multipart. keep the other parameters, clients such as terraform's
+	// gcs backend rely on preconditions like ifGenerationMatch
+	queryString := f.Request.URL.Query()
+	objectName := queryString.Get("name")
+	contentEncoding := queryString.Get("contentEncoding")
+	queryString.Del("name")
+	queryString.Del("contentEncoding") // a property of the object resource of multipart uploads
+	queryString.Set("uploadType", "multipart")
+	queryString.Set("alt", "json")
+	f.Request.URL.RawQuery = queryString.Encode()
+
+	// checksums sent along describe the plaintext, GCS would check them against the ciphertext
+	if err := verifyMediaChecksums(f); err != nil {
+		return err
+	}
 
 	//  Store original headers in variables, useful for generating metadata
 	orgContentType := f.Request.Header.Get("Content-Type")
@@ -54,21 +86,41 @@ func ConvertSinglePartUploadtoMultiPartUpload(f *proxy.Flow) error {
 	// save the original md5 has or gsutil/gcloud will delete after upload if it sees it is different
 	f.Request.Header.Set("gcs-proxy-original-md5-hash",
 		crypto.Base64MD5Hash(f.Request.Body))
+	f.Request.Header.Set("gcs-proxy-original-crc32c",
+		crypto.Base64Crc32cHash(f.Request.Body))
 
 	f.Request.Header.Del("Expect")
 
-	// Generate Metadata to insert in body
-	metadata := util.GenerateMetadata(f, orgContentType, objectName)
-
 	// Encrypt data in body
 	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
-	ctx := f.Request.Raw().Context()
-	ctxValue := context.WithValue(ctx, "requestid", f.Id.String())
-	encryptBody, err := crypto.EncryptBytes(ctxValue,
-		util.GetKMSKeyName(bucketName),
-		f.Request.Body)
-	if err != nil {
-		return fmt.Errorf("error encrypting  request: %v", err)
+	var encryptBody []byte
+	var metadata map[string]interface{}
+	var err error
+	if empty {
+		metadata = map[string]interface{}{
+			"bucket":      bucketName,
+			"contentType": orgContentType,
+			"name":        objectName,
+			"metadata":    emptyObjectMetadata(),
+		}
+	} else {
+		ctxValue := uploadContext(f, bucketName, objectName)
+		var keyVersion string
+		encryptBody, keyVersion, err = crypto.EncryptBytesWithKeyVersion(ctxValue,
+			util.KeyMapFor(f).Key(bucketName),
+			f.Request.Body)
+		if err != nil {
+			return fmt.Errorf("error encrypting  request: %w", err)
+		}
+
+		// Generate Metadata to insert in body
+		metadata = util.GenerateMetadata(f, orgContentType, objectName, keyVersion)
+	}
+	if contentEncoding != "" {
+		// the plaintext is compressed, the ciphertext is not: GCS must never decompress it for a
+		// client that does not accept the encoding
+		metadata["contentEncoding"] = contentEncoding
+		metadata["cacheControl"] = "no-transform"
 	}
 
 	//Write data to request body  to support multipart request
@@ -93,6 +145,10 @@ func ConvertSinglePartUploadtoMultiPartUpload(f *proxy.Flow) error {
 		return fmt.Errorf("failed to create second part in multipart-request: %v", err)
 	}
 	writer_part.Write(encryptBody)
+	if !empty {
+		recordCiphertextHashes(f, encryptBody)
+		mirror.Keep(f, bucketName, f.Request.Body)
+	}
 
 	multipartWriter.Close()
 
@@ -112,10 +168,15 @@ func HandleSinglePartUploadResponse(f *proxy.Flow) error {
 
 	// update the response with the orginal md5 hash so gsutil/gcloud does not complain
 	jsonResponse["md5Hash"] = f.Request.Header.Get("Gcs-proxy-original-md5-hash")
-	jsonResponse["size"], err = strconv.Atoi(f.Request.Header.Get("Gcs-proxy-unencrypted-file-size"))
+	jsonResponse["crc32c"] = f.Request.Header.Get("Gcs-proxy-original-crc32c")
+	size, err := strconv.Atoi(f.Request.Header.Get("Gcs-proxy-unencrypted-file-size"))
 	if err != nil {
 		return fmt.Errorf("error setting json response: %v", err)
 	}
+	// a decimal string, as GCS reports it
+	jsonResponse["size"] = strconv.Itoa(size)
+
+	rewriteLinks(f, jsonResponse)
 
 	log.Debugf("HandleSinglePartUploadResponse response with original size and md5: %v", jsonResponse)
 	jsonData, err := json.Marshal(jsonResponse)
@@ -127,16 +188,38 @@ func HandleSinglePartUploadResponse(f *proxy.Flow) error {
 	return nil
 }
 
+// verifyMediaChecksums checks the X-Goog-Hash and Content-MD5 headers of a simple upload against
+// the plaintext and drops them
+func verifyMediaChecksums(f *proxy.Flow) error {
+	expected := map[string]string{
+		"md5":    crypto.Base64MD5Hash(f.Request.Body),
+		"crc32c": crypto.Base64Crc32cHash(f.Request.Body),
+	}
+	for _, value := range f.Request.Header.Values("X-Goog-Hash") {
+		for _, hash := range strings.Split(value, ",") {
+			algorithm, checksum, _ := strings.Cut(strings.TrimSpace(hash), "=")
+			if want, ok := expected[algorithm]; ok && checksum != want {
+				return fmt.Errorf("%w: %v in X-Goog-Hash does not match the uploaded content", ErrInvalidUpload, algorithm)
+			}
+		}
+	}
+	if md5Hash := f.Request.Header.Get("Content-MD5"); md5Hash != "" && md5Hash != expected["md5"] {
+		return fmt.Errorf("%w: Content-MD5 does not match the uploaded content", ErrInvalidUpload)
+	}
+	f.Request.Header.Del("X-Goog-Hash")
+	f.Request.Header.Del("Content-MD5")
+	return nil
+}
+
 func HandleSinglePartUploadRequest(f *proxy.Flow) error {
 	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
-	ctx := f.Request.Raw().Context()
-	ctxValue := context.WithValue(ctx, "requestid", f.Id.String())
+	ctxValue := kmsContext(f)
 	encryptedData, err := crypto.EncryptBytes(ctxValue,
-		util.GetKMSKeyName(bucketName),
+		util.KeyMapFor(f).Key(bucketName),
 		f.Request.Body)
 
 	if err != nil {
-		return fmt.Errorf("error encrypting  request: %v", err)
+		return fmt.Errorf("error encrypting  request: %w", err)
 	}
 
 	f.Request.Header.Set("gcs-proxy-original-content-length",
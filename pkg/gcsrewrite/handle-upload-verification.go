@@ -0,0 +1,69 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// CiphertextSizeHeader holds the size of the object an upload stores, the plaintext size is in
+// gcs-proxy-unencrypted-file-size
+const CiphertextSizeHeader = "gcs-proxy-ciphertext-size"
+
+// recordCiphertextHashes remembers the size of the ciphertext sent to GCS for the overhead
+// accounting and its hashes for VerifyUpload
+func recordCiphertextHashes(f *proxy.Flow, ciphertext []byte) {
+	f.Request.Header.Set(CiphertextSizeHeader, strconv.Itoa(len(ciphertext)))
+	if !cfg.For(f).VerifyUploads {
+		return
+	}
+	f.Request.Header.Set("gcs-proxy-ciphertext-md5-hash", crypto.Base64MD5Hash(ciphertext))
+	f.Request.Header.Set("gcs-proxy-ciphertext-crc32c", crypto.Base64Crc32cHash(ciphertext))
+}
+
+// VerifyUpload reads back the generation an upload created and checks that GCS stored the
+// ciphertext the proxy sent. It must run before the upload response is rewritten to describe
+// the plaintext.
+func VerifyUpload(f *proxy.Flow) error {
+	md5Hash := f.Request.Header.Get("gcs-proxy-ciphertext-md5-hash")
+	crc32c := f.Request.Header.Get("gcs-proxy-ciphertext-crc32c")
+	if md5Hash == "" || crc32c == "" {
+		return nil
+	}
+
+	var resource struct {
+		Bucket     string `json:"bucket"`
+		Name       string `json:"name"`
+		Generation string `json:"generation"`
+	}
+	if err := json.Unmarshal(f.Response.Body, &resource); err != nil {
+		return fmt.Errorf("upload verification: error unmarshalling upload response: %v", err)
+	}
+	generation, err := strconv.ParseInt(resource.Generation, 10, 64)
+	if err != nil || resource.Bucket == "" || resource.Name == "" {
+		return fmt.Errorf("upload verification: upload response has no object generation")
+	}
+
+	storedMd5Hash, storedCrc32c, err := util.GetStoredObjectHashes(util.WithUserProject(f.Request.Raw().Context(), util.UserProject(f)),
+		f.Request.Header.Get("Authorization"), resource.Bucket, resource.Name, generation)
+	if err != nil {
+		return fmt.Errorf("upload verification of gs://%v/%v#%v: %v", resource.Bucket, resource.Name, generation, err)
+	}
+	if storedCrc32c != crc32c || (storedMd5Hash != "" && storedMd5Hash != md5Hash) {
+		return fmt.Errorf("upload verification of gs://%v/%v#%v failed: stored md5 %v crc32c %v, sent md5 %v crc32c %v",
+			resource.Bucket, resource.Name, generation, storedMd5Hash, storedCrc32c, md5Hash, crc32c)
+	}
+	log.Debugf("verified gs://%v/%v#%v", resource.Bucket, resource.Name, generation)
+	return nil
+}
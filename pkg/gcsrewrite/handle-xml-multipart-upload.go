@@ -0,0 +1,358 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+XML API multipart uploads, as S3 compatible SDKs send them:
+
+	POST   /bucket/object?uploads                      initiate, GCS answers with the upload id
+	PUT    /bucket/object?partNumber=N&uploadId=ID     one part, in any order and in parallel
+	POST   /bucket/object?uploadId=ID                  complete, the body lists the parts and their ETags
+	DELETE /bucket/object?uploadId=ID                  abort
+
+Every part is encrypted into its own envelope and GCS concatenates them, see the envelope package.
+The envelope of a part is bound to the upload id and its part number, the complete request seals
+the part numbers it lists into a manifest stored in the object metadata, so the parts of the
+object can't be reordered, dropped or taken from another upload. The client gets the ETag of its
+plaintext part, the ciphertext ETag GCS knows it by is stored next to the resumable upload
+sessions until the upload completes. The complete response has the multipart ETag of the
+plaintext, the MD5 of the part MD5s followed by the number of parts, as S3 computes it.
+*/
+
+// the part numbers S3 and GCS accept
+const maxXmlPartNumber = 10000
+
+// the ETag of a complete response, a quoted string in the XML body
+var xmlCompleteETagPattern = regexp.MustCompile(`<ETag>[^<]*</ETag>`)
+
+// the upload ids GCS hands out, anything else is not used in a file name
+var xmlUploadIdPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// xmlPart is what the proxy remembers of an uploaded part
+type xmlPart struct {
+	PlaintextETag   string `json:"plaintextETag"`
+	CiphertextETag  string `json:"ciphertextETag"`
+	PlaintextSize   int    `json:"plaintextSize"`
+	PlaintextCrc32c string `json:"plaintextCrc32c,omitempty"`
+	KeyVersion      string `json:"keyVersion"`
+	Bound           bool   `json:"bound,omitempty"` // encrypted with its upload id and part number, not by an older proxy
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func xmlPartFile(uploadId string, partNumber int) string {
+	return fmt.Sprintf("/tmp/go-gcsproxy-xml-%s-part-%d.json", uploadId, partNumber)
+}
+
+func xmlPartNumber(f *proxy.Flow) (int, error) {
+	partNumber, err := strconv.Atoi(f.Request.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxXmlPartNumber {
+		return 0, fmt.Errorf("%w: invalid part number in query string: %v", ErrInvalidUpload, f.Request.URL.RawQuery)
+	}
+	return partNumber, nil
+}
+
+func xmlUploadId(f *proxy.Flow) (string, error) {
+	uploadId := f.Request.URL.Query().Get("uploadId")
+	if !xmlUploadIdPattern.MatchString(uploadId) {
+		return "", fmt.Errorf("%w: invalid upload id in query string: %v", ErrInvalidUpload, f.Request.URL.RawQuery)
+	}
+	return uploadId, nil
+}
+
+// HandleXmlMultipartInitiateRequest records the encryption key in the metadata of the object the
+// upload will create, so downloads find it before the upload completes.
+func HandleXmlMultipartInitiateRequest(f *proxy.Flow) error {
+	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	clientMetadata := map[string]string{}
+	for name := range f.Request.Header {
+		if key, ok := strings.CutPrefix(strings.ToLower(name), "x-goog-meta-"); ok {
+			clientMetadata[key] = f.Request.Header.Get(name)
+		}
+	}
+	if err := checkReservedMetadata(clientMetadata); err != nil {
+		return err
+	}
+	f.Request.Header.Set("x-goog-meta-"+util.MetaKey(util.MetaEncryptionKey), util.KeyMapFor(f).Key(bucketName))
+	f.Request.Header.Set("x-goog-meta-"+util.MetaKey(util.MetaProxyVersion), cfg.For(f).GCSProxyVersion)
+	f.Request.Header.Set("x-goog-meta-"+util.MetaKey(util.MetaEnvelopeVersion), strconv.Itoa(envelope.Version))
+	if crypto.EscrowKeyName != "" {
+		f.Request.Header.Set("x-goog-meta-"+util.MetaKey(util.MetaEscrowKey), crypto.EscrowKeyName)
+	}
+	for key, value := range util.EncryptionProvenance(util.KeyMapFor(f).Policy) {
+		f.Request.Header.Set("x-goog-meta-"+key, value)
+	}
+	return nil
+}
+
+// HandleXmlMultipartPartRequest encrypts one part into a complete envelope.
+func HandleXmlMultipartPartRequest(f *proxy.Flow) error {
+	if f.Request.Header.Get("x-goog-copy-source") != "" || f.Request.Header.Get("x-amz-copy-source") != "" {
+		return fmt.Errorf("%w: copying parts from other objects is not supported for encrypted buckets", ErrInvalidUpload)
+	}
+	uploadId, err := xmlUploadId(f)
+	if err != nil {
+		return err
+	}
+	partNumber, err := xmlPartNumber(f)
+	if err != nil {
+		return err
+	}
+	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	plaintext := f.Request.Body
+	objectName := util.GetObjectNameFromRequestUri(f.Request.URL.Path)
+	ctx := crypto.WithPart(uploadContext(f, bucketName, objectName), uploadId, partNumber)
+	ciphertext, keyVersion, err := crypto.EncryptBytesWithKeyVersion(ctx, util.KeyMapFor(f).Key(bucketName), plaintext)
+	if err != nil {
+		return fmt.Errorf("error encrypting part: %w", err)
+	}
+
+	plaintextMd5 := md5.Sum(plaintext)
+	f.Request.Header.Set("gcs-proxy-part-plaintext-etag", fmt.Sprintf("\"%x\"", plaintextMd5))
+	f.Request.Header.Set("gcs-proxy-part-plaintext-hash",
+		fmt.Sprintf("crc32c=%v,md5=%v", crypto.Base64Crc32cHash(plaintext), base64.StdEncoding.EncodeToString(plaintextMd5[:])))
+	f.Request.Header.Set("gcs-proxy-part-plaintext-size", strconv.Itoa(len(plaintext)))
+	f.Request.Header.Set("gcs-proxy-part-plaintext-crc32c", crypto.Base64Crc32cHash(plaintext))
+	f.Request.Header.Set("gcs-proxy-part-key-version", keyVersion)
+
+	// the client's hashes describe the plaintext
+	f.Request.Header.Del("x-goog-hash")
+	if f.Request.Header.Get("Content-MD5") != "" {
+		f.Request.Header.Set("Content-MD5", crypto.Base64MD5Hash(ciphertext))
+	}
+	f.Request.Header.Set("Content-Length", strconv.Itoa(len(ciphertext)))
+	f.Request.Body = ciphertext
+	return nil
+}
+
+// HandleXmlMultipartPartResponse remembers the part and answers with the ETag of its plaintext,
+// which is what S3 SDKs check and list in the complete request.
+func HandleXmlMultipartPartResponse(f *proxy.Flow) error {
+	uploadId, err := xmlUploadId(f)
+	if err != nil {
+		return err
+	}
+	partNumber, err := xmlPartNumber(f)
+	if err != nil {
+		return err
+	}
+	plaintextSize, err := strconv.Atoi(f.Request.Header.Get("gcs-proxy-part-plaintext-size"))
+	if err != nil {
+		return fmt.Errorf("missing plaintext size of part %v", partNumber)
+	}
+	part := xmlPart{
+		PlaintextETag:   f.Request.Header.Get("gcs-proxy-part-plaintext-etag"),
+		CiphertextETag:  f.Response.Header.Get("ETag"),
+		PlaintextSize:   plaintextSize,
+		PlaintextCrc32c: f.Request.Header.Get("gcs-proxy-part-plaintext-crc32c"),
+		KeyVersion:      f.Request.Header.Get("gcs-proxy-part-key-version"),
+		Bound:           true,
+	}
+	jsonData, err := json.Marshal(part)
+	if err != nil {
+		return fmt.Errorf("error marshalling part: %v", err)
+	}
+	if err := os.WriteFile(xmlPartFile(uploadId, partNumber), jsonData, 0600); err != nil {
+		return fmt.Errorf("error storing part %v of upload %v: %v", partNumber, uploadId, err)
+	}
+	log.Debugf("stored part %v of XML multipart upload %v: %s", partNumber, uploadId, jsonData)
+
+	f.Response.Header.Set("ETag", part.PlaintextETag)
+	f.Response.Header.Set("X-Goog-Hash", f.Request.Header.Get("gcs-proxy-part-plaintext-hash"))
+	return nil
+}
+
+// HandleXmlMultipartCompleteRequest lists the ciphertext ETags of the parts GCS assembles and seals
+// their part numbers into the manifest the response records.
+func HandleXmlMultipartCompleteRequest(f *proxy.Flow) error {
+	uploadId, err := xmlUploadId(f)
+	if err != nil {
+		return err
+	}
+	var complete completeMultipartUpload
+	if err := xml.Unmarshal(f.Request.Body, &complete); err != nil {
+		return fmt.Errorf("%w: error unmarshalling CompleteMultipartUpload: %v", ErrInvalidUpload, err)
+	}
+
+	plaintextSize := 0
+	// the CRC32C of the assembled plaintext, from the parts' in the listed order
+	var plaintextCrc32c uint32
+	combinable := true
+	manifest := envelope.PartManifest{UploadID: uploadId}
+	bound := 0
+	// the multipart ETag of the plaintext, from the parts' MD5s
+	plaintextMd5s := md5.New()
+	for i, listed := range complete.Parts {
+		if i > 0 && listed.PartNumber <= complete.Parts[i-1].PartNumber {
+			return fmt.Errorf("%w: the parts of upload %v are not listed in ascending order", ErrInvalidUpload, uploadId)
+		}
+		data, err := os.ReadFile(xmlPartFile(uploadId, listed.PartNumber))
+		if err != nil {
+			return fmt.Errorf("%w: part %v of upload %v was not uploaded through the proxy: %v", ErrInvalidUpload, listed.PartNumber, uploadId, err)
+		}
+		var part xmlPart
+		if err := json.Unmarshal(data, &part); err != nil {
+			return fmt.Errorf("error unmarshalling part %v of upload %v: %v", listed.PartNumber, uploadId, err)
+		}
+		if strings.Trim(listed.ETag, `"`) != strings.Trim(part.PlaintextETag, `"`) {
+			return fmt.Errorf("%w: part %v of upload %v has ETag %v, the proxy uploaded %v", ErrInvalidUpload, listed.PartNumber, uploadId, listed.ETag, part.PlaintextETag)
+		}
+		complete.Parts[i].ETag = part.CiphertextETag
+		manifest.Parts = append(manifest.Parts, listed.PartNumber)
+		if part.Bound {
+			bound++
+		}
+		if sum, err := hex.DecodeString(strings.Trim(part.PlaintextETag, `"`)); err == nil {
+			plaintextMd5s.Write(sum)
+		}
+		if partCrc32c, err := base64.StdEncoding.DecodeString(part.PlaintextCrc32c); err == nil && len(partCrc32c) == 4 && combinable {
+			plaintextCrc32c = crypto.Crc32cCombine(plaintextCrc32c, binary.BigEndian.Uint32(partCrc32c), int64(part.PlaintextSize))
+		} else {
+			combinable = false // a part stored by an older proxy
+		}
+		plaintextSize += part.PlaintextSize
+		if i == 0 {
+			f.Request.Header.Set("gcs-proxy-part-key-version", part.KeyVersion)
+		}
+	}
+
+	switch bound {
+	case 0:
+		// all parts uploaded through an older proxy, they decrypt without a manifest
+	case len(complete.Parts):
+		bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+		sealed, err := crypto.SealPartManifest(kmsContext(f), partsKey(f, bucketName, f.Request.Header.Get("gcs-proxy-part-key-version")), manifest)
+		if err != nil {
+			return fmt.Errorf("error sealing the part manifest of upload %v: %w", uploadId, err)
+		}
+		f.Request.Header.Set("gcs-proxy-part-manifest", base64.StdEncoding.EncodeToString(sealed))
+	default:
+		return fmt.Errorf("%w: %v of the parts of upload %v were uploaded through an older proxy, upload them again", ErrInvalidUpload, len(complete.Parts)-bound, uploadId)
+	}
+	f.Request.Header.Set("gcs-proxy-plaintext-etag", fmt.Sprintf("\"%x-%d\"", plaintextMd5s.Sum(nil), len(complete.Parts)))
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return fmt.Errorf("error marshalling CompleteMultipartUpload: %v", err)
+	}
+	f.Request.Header.Set("gcs-proxy-unencrypted-file-size", strconv.Itoa(plaintextSize))
+	if combinable && len(complete.Parts) > 0 {
+		encoded := make([]byte, 4)
+		binary.BigEndian.PutUint32(encoded, plaintextCrc32c)
+		f.Request.Header.Set("gcs-proxy-original-crc32c", base64.StdEncoding.EncodeToString(encoded))
+	}
+	f.Request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	f.Request.Header.Del("Content-MD5")
+	f.Request.Body = body
+	return nil
+}
+
+// partsKey returns the KMS key the parts of an upload were encrypted with, from the key version of
+// its first part, the mapped key of the bucket for the parts of older proxies
+func partsKey(f *proxy.Flow, bucketName string, keyVersion string) string {
+	if key, _, found := strings.Cut(keyVersion, "/cryptoKeyVersions/"); found {
+		return key
+	}
+	return util.KeyMapFor(f).Key(bucketName)
+}
+
+// HandleXmlMultipartCompleteResponse records the part manifest, plaintext size and CRC32C of the
+// assembled object in its metadata, forgets the parts and describes the plaintext to the client.
+func HandleXmlMultipartCompleteResponse(f *proxy.Flow) error {
+	uploadId, err := xmlUploadId(f)
+	if err != nil {
+		return err
+	}
+	forgetXmlParts(uploadId)
+
+	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	objectName := util.GetObjectNameFromRequestUri(f.Request.URL.Path)
+	metadata := map[string]string{
+		util.MetaKey(util.MetaUnencryptedLength):    f.Request.Header.Get("gcs-proxy-unencrypted-file-size"),
+		util.MetaKey(util.MetaEncryptionKeyVersion): f.Request.Header.Get("gcs-proxy-part-key-version"),
+	}
+	// composite objects have no MD5, transfer tools can still check the plaintext CRC32C
+	crc32c := f.Request.Header.Get("gcs-proxy-original-crc32c")
+	if crc32c != "" {
+		metadata[util.MetaKey(util.MetaCrc32c)] = crc32c
+	}
+	manifest := f.Request.Header.Get("gcs-proxy-part-manifest")
+	if manifest != "" {
+		metadata[util.MetaKey(util.MetaParts)] = manifest
+	}
+	if err := util.UpdateObjectMetadata(util.WithUserProject(f.Request.Raw().Context(), util.UserProject(f)), f.Request.Header.Get("Authorization"),
+		bucketName, objectName, metadata); err != nil {
+		if manifest != "" {
+			// the parts don't decrypt without their manifest
+			return fmt.Errorf("XML multipart upload of gs://%v/%v is unreadable without its part manifest: %v", bucketName, objectName, err)
+		}
+		// the parts of older proxies decrypt without it, only the early Content-Length of downloads needs the size
+		log.Errorf("XML multipart upload of gs://%v/%v: %v", bucketName, objectName, err)
+	}
+
+	// like the JSON uploads, the client learns the ETag, hashes and size of its plaintext
+	etag := f.Request.Header.Get("gcs-proxy-plaintext-etag")
+	f.Response.Header.Set("ETag", etag)
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(etag))
+	f.Response.Body = xmlCompleteETagPattern.ReplaceAll(f.Response.Body, []byte("<ETag>"+escaped.String()+"</ETag>"))
+	f.Response.Header.Del("X-Goog-Hash")
+	if crc32c != "" {
+		f.Response.Header.Set("X-Goog-Hash", "crc32c="+crc32c)
+	}
+	f.Response.Header.Set("X-Goog-Stored-Content-Length", f.Request.Header.Get("gcs-proxy-unencrypted-file-size"))
+	if f.Response.Header.Get("Content-Length") != "" {
+		f.Response.Header.Set("Content-Length", strconv.Itoa(len(f.Response.Body)))
+	}
+	return nil
+}
+
+// HandleXmlMultipartAbortResponse forgets the parts of an aborted upload.
+func HandleXmlMultipartAbortResponse(f *proxy.Flow) error {
+	uploadId, err := xmlUploadId(f)
+	if err != nil {
+		return err
+	}
+	forgetXmlParts(uploadId)
+	return nil
+}
+
+func forgetXmlParts(uploadId string) {
+	files, _ := filepath.Glob(fmt.Sprintf("/tmp/go-gcsproxy-xml-%s-part-*.json", uploadId))
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
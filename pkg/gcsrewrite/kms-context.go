@@ -0,0 +1,91 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/backend"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/latency"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// kmsContext returns the context of the KMS calls made for f. it carries the request id of the
+// latency metrics, the bucket whose KEKs wrap the DEKs and, for clients of a tenant, the tenant's
+// KMS credentials and metric labels. the KMS calls of tracked flows count in their latency budget.
+func kmsContext(f *proxy.Flow) context.Context {
+	// flows built outside the proxy, e.g. by the fuzz targets, have no client request
+	parent := context.Background()
+	if raw := f.Request.Raw(); raw != nil {
+		parent = raw.Context()
+	}
+	ctx := context.WithValue(parent, "requestid", f.Id.String())
+	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	if o, ok := backend.Of(f); ok {
+		bucketName = o.Bucket
+	}
+	ctx = crypto.WithBucket(ctx, bucketName)
+	ctx = crypto.WithChunkSize(ctx, util.KeyMapFor(f).ChunkSize(bucketName))
+	if t := tenant.Of(f); t != nil {
+		ctx = crypto.WithKmsCredentials(ctx, t.KmsCredentialsFile)
+		ctx = crypto.WithMetricLabels(ctx, t.MetricLabels())
+	}
+	if b := latency.Of(f); b != nil {
+		ctx = crypto.WithKmsTimer(ctx, b.AddKms)
+	}
+	return ctx
+}
+
+var resumableSessions sync.Map // flow id -> upload id of the resumable session it finishes
+
+// rememberResumableSession records the upload id of the resumable session f finishes, before the
+// final PUT is converted to a multipart upload without it
+func rememberResumableSession(f *proxy.Flow, uploadId string) {
+	resumableSessions.Store(f.Id, uploadId)
+	go func() {
+		<-f.Done()
+		resumableSessions.Delete(f.Id)
+	}()
+}
+
+// uploadSession returns what every attempt of the logical upload f belongs to shares: the id of its
+// resumable session or of its XML API multipart upload and the part number, else the idempotency
+// token or invocation id the client libraries send with each attempt of a call. "" when the client
+// sends none of them.
+func uploadSession(f *proxy.Flow) string {
+	if uploadId, ok := resumableSessions.Load(f.Id); ok {
+		return "resumable:" + uploadId.(string)
+	}
+	query := f.Request.URL.Query()
+	if uploadId := query.Get("uploadId"); uploadId != "" && query.Has("partNumber") {
+		return "multipart:" + uploadId + "#" + query.Get("partNumber")
+	}
+	if token := f.Request.Header.Get("X-Goog-Gcs-Idempotency-Token"); token != "" {
+		return "idempotency:" + token
+	}
+	for _, field := range strings.Fields(f.Request.Header.Get("X-Goog-Api-Client")) {
+		if id, ok := strings.CutPrefix(field, "gccl-invocation-id/"); ok && id != "" {
+			return "invocation:" + id
+		}
+	}
+	return ""
+}
+
+// uploadContext returns the kmsContext of an upload writing object to bucketName. the retries of the
+// upload, the attempts of its uploadSession, get the ciphertext of its first attempt, see
+// crypto.WithRetryScope. the uploads of clients that name no session are encrypted anew.
+func uploadContext(f *proxy.Flow, bucketName string, object string) context.Context {
+	session := uploadSession(f)
+	if session == "" {
+		return kmsContext(f)
+	}
+	return crypto.WithRetryScope(kmsContext(f), bucketName+"/"+object+"@"+session)
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/logsample"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+/*
+Workloads that list a prefix and then read every small file in it (training data loaders, config
+trees) pay one GCS round trip and one KMS decrypt per file. With -list_prefetch_max_kb the small
+encrypted objects of an objects.list response are downloaded and decrypted in the background, with
+the caller's own credentials, into the plaintext cache of sliced downloads. The caller's JSON API
+downloads of those objects are then answered from the cache until -sliced_download_cache_ttl.
+
+A download without a generation gets the generation that was listed, which is the live one until
+the proxy sees the object deleted or overwritten, see InvalidateCaches.
+*/
+
+// ListPrefetches counts the objects prefetched after a listing by result: ok, error, dropped when
+// the prefetch queue was full, served for the downloads answered with a prefetched object. Set up
+// by the binary when metrics are exported.
+var ListPrefetches metric.Int64Counter
+
+const (
+	listPrefetchWorkers = 8
+	listPrefetchQueue   = 1024
+	listPrefetchTimeout = 30 * time.Second
+)
+
+// listedObject is an item of objects.list, the fields prefetching needs
+type listedObject struct {
+	Name            string            `json:"name"`
+	Generation      string            `json:"generation"`
+	ContentEncoding string            `json:"contentEncoding"`
+	Metadata        map[string]string `json:"metadata"`
+}
+
+// prefetch is one listed object to download and decrypt
+type prefetch struct {
+	authorization string
+	endpoint      string // scheme://host the listing was sent to
+	bucket        string
+	object        listedObject
+	keyIDs        []string
+	credentials   string // KMS credentials file of the caller's tenant
+	userProject   string // billed for a Requester Pays bucket
+	queued        time.Time
+}
+
+var (
+	prefetches   chan prefetch
+	prefetchOnce sync.Once
+	prefetchHttp = &http.Client{Timeout: listPrefetchTimeout}
+)
+
+func maxListedSize() int64 {
+	return int64(cfg.Current().ListPrefetchMaxKB) * 1024
+}
+
+// PrefetchListed queues the small encrypted objects of the objects.list response in f for
+// prefetching, if enabled.
+func PrefetchListed(f *proxy.Flow) {
+	config := cfg.For(f)
+	if config.ListPrefetchMaxKB <= 0 || config.WriteOnly || getPlaintextCache() == nil {
+		return
+	}
+	path := f.Request.URL.Path
+	if f.Request.Method != http.MethodGet || f.Response.StatusCode != http.StatusOK ||
+		!strings.HasPrefix(path, "/storage/v1/b/") || !strings.HasSuffix(path, "/o") {
+		return
+	}
+	bucketName := strings.TrimSuffix(strings.TrimPrefix(path, "/storage/v1/b/"), "/o")
+	keyMap := util.KeyMapFor(f)
+	if bucketName == "" || strings.Contains(bucketName, "/") || keyMap.Key(bucketName) == "" {
+		return
+	}
+
+	body, err := f.Response.DecodedBody()
+	if err != nil {
+		return
+	}
+	var listing struct {
+		Items []listedObject `json:"items"`
+	}
+	if err := json.Unmarshal(body, &listing); err != nil {
+		log.Debugf("not prefetching gs://%v: invalid listing: %v", bucketName, err)
+		return
+	}
+
+	var credentials string
+	if t := tenant.Of(f); t != nil {
+		credentials = t.KmsCredentialsFile
+	}
+	cache := getPlaintextCache()
+	authorization := f.Request.Header.Get("Authorization")
+	queued := 0
+	for _, item := range listing.Items {
+		if queued >= config.ListPrefetchMaxObjects {
+			break
+		}
+		size, err := strconv.ParseInt(util.Meta(item.Metadata, util.MetaUnencryptedLength), 10, 64)
+		if err != nil || size > maxListedSize() || item.ContentEncoding != "" || item.Generation == "" {
+			continue // not encrypted by the proxy, too large, or compressed
+		}
+		if util.ProvenanceOf(item.Metadata).Newer() {
+			continue // the download fails with the reason
+		}
+		// the decrypt clients are checked when the object is downloaded, don't decrypt ahead for them
+		if clients, restricted := keyMap.AllowedDecryptClients(bucketName, item.Name); restricted && !slices.Contains(clients, "*") {
+			continue
+		}
+		if entry, ok := cache.get(listedCacheKey(authorization, bucketName, item.Name)); ok && entry.generation == item.Generation {
+			continue
+		}
+		keyIDs := keyMap.CandidateKeys(util.Meta(item.Metadata, util.MetaEncryptionKey), bucketName)
+		keyIDs = decryptionKeys.order(bucketName, item.Name, item.Generation, keyIDs)
+
+		p := prefetch{
+			authorization: authorization,
+			endpoint:      f.Request.URL.Scheme + "://" + f.Request.URL.Host,
+			bucket:        bucketName,
+			object:        item,
+			keyIDs:        keyIDs,
+			credentials:   credentials,
+			userProject:   util.UserProject(f),
+			queued:        time.Now(),
+		}
+		select {
+		case prefetchQueue() <- p:
+			queued++
+		default:
+			countPrefetch(bucketName, "dropped")
+		}
+	}
+	if queued > 0 {
+		log.Debugf("prefetching %v objects listed in gs://%v", queued, bucketName)
+	}
+}
+
+// prefetchQueue starts the workers on first use
+func prefetchQueue() chan prefetch {
+	prefetchOnce.Do(func() {
+		prefetches = make(chan prefetch, listPrefetchQueue)
+		for range listPrefetchWorkers {
+			go func() {
+				for p := range prefetches {
+					if err := p.run(); err != nil {
+						log.WithField(logsample.CategoryField, "decrypt").Warnf("prefetch of gs://%v/%v failed: %v", p.bucket, p.object.Name, err)
+						countPrefetch(p.bucket, "error")
+						continue
+					}
+					countPrefetch(p.bucket, "ok")
+				}
+			}()
+		}
+	})
+	return prefetches
+}
+
+// run downloads the listed generation and puts its plaintext in the cache
+func (p prefetch) run() error {
+	ctx, cancel := context.WithTimeout(util.WithUserProject(crypto.WithKmsCredentials(context.Background(), p.credentials), p.userProject), listPrefetchTimeout)
+	defer cancel()
+
+	objectUrl := fmt.Sprintf("%v/storage/v1/b/%v/o/%v?alt=media&generation=%v",
+		p.endpoint, url.PathEscape(p.bucket), url.PathEscape(p.object.Name), url.QueryEscape(p.object.Generation))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectUrl, nil)
+	if err != nil {
+		return err
+	}
+	if p.authorization != "" {
+		req.Header.Set("Authorization", p.authorization)
+	}
+	util.BillRequest(ctx, req)
+	resp, err := prefetchHttp.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GCS answered %v", resp.Status)
+	}
+	// the envelope adds a header and a tag, never more than the plaintext itself
+	ciphertext, err := io.ReadAll(io.LimitReader(resp.Body, 2*maxListedSize()+64*1024))
+	if err != nil {
+		return err
+	}
+
+	ctx = crypto.WithPartManifest(ctx, util.PartManifestHeader(resp.Header))
+	var errs []error
+	for _, keyID := range p.keyIDs {
+		plaintext, err := crypto.DecryptBytes(ctx, keyID, ciphertext)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", keyID, err))
+			continue
+		}
+		if getPlaintextCache().invalidatedSince(p.bucket, p.object.Name, p.queued) {
+			log.Debugf("not caching gs://%v/%v#%v: deleted or overwritten since it was listed", p.bucket, p.object.Name, p.object.Generation)
+			return nil
+		}
+		getPlaintextCache().put(listedCacheKey(p.authorization, p.bucket, p.object.Name), &plaintextEntry{
+			plaintext:   plaintext,
+			contentType: resp.Header.Get("Content-Type"),
+			etag:        resp.Header.Get("ETag"),
+			generation:  p.object.Generation,
+		})
+		return nil
+	}
+	return fmt.Errorf("unable to decrypt: %v", errs)
+}
+
+// listedCacheKey identifies the generation of an object a caller listed last, the entry names it
+func listedCacheKey(authorization string, bucketName string, objectName string) plaintextKey {
+	return plaintextCacheKey(authorization, bucketName, objectName, "listed")
+}
+
+// prefetchedDownload returns the prefetched plaintext of the JSON API download in f, if any
+func prefetchedDownload(f *proxy.Flow) (*plaintextEntry, bool) {
+	cache := getPlaintextCache()
+	if cfg.For(f).ListPrefetchMaxKB <= 0 || cache == nil || isConditionalRequest(f.Request.Header) {
+		return nil, false
+	}
+	// the response headers are those of JSON API downloads, XML API clients get theirs from GCS
+	path := f.Request.URL.Path
+	if !strings.HasPrefix(path, "/storage/v1/b/") && !strings.HasPrefix(path, "/download/storage/v1/b/") {
+		return nil, false
+	}
+	query := f.Request.URL.Query()
+	for name := range query {
+		if strings.HasPrefix(name, "if") {
+			return nil, false // ifGenerationMatch and the other preconditions
+		}
+	}
+	bucketName := util.GetBucketNameFromRequestUri(path)
+	objectName := util.GetObjectNameFromRequestUri(path)
+	entry, ok := cache.get(listedCacheKey(f.Request.Header.Get("Authorization"), bucketName, objectName))
+	if !ok {
+		return nil, false
+	}
+	if generation := query.Get("generation"); generation != "" && generation != entry.generation {
+		return nil, false
+	}
+	countPrefetch(bucketName, "served")
+	return entry, true
+}
+
+func countPrefetch(bucketName string, result string) {
+	if ListPrefetches == nil {
+		return
+	}
+	ListPrefetches.Add(context.Background(), 1, metric.WithAttributes(attribute.String("bucket", bucketName), attribute.String("result", result)))
+}
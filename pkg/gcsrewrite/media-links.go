@@ -0,0 +1,60 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// globalHosts are the endpoints GCS links object resources to
+var globalHosts = []string{"storage.googleapis.com", "www.googleapis.com"}
+
+// clientHost returns the host the client sent f to, before the mTLS endpoints are rewritten
+func clientHost(f *proxy.Flow) string {
+	host := f.Request.URL.Host
+	if raw := f.Request.Raw(); raw != nil && raw.Host != "" {
+		host = raw.Host
+	}
+	return strings.ToLower((&url.URL{Host: host}).Hostname())
+}
+
+// rewriteLinks points the mediaLink and selfLink of an object resource GCS answered f with at the
+// endpoint the client sent f to. GCS links its global endpoints, so the clients of a regional or
+// mTLS endpoint following the links would leave the endpoint their proxy settings and routes send
+// through the proxy. it reports whether a link was rewritten.
+func rewriteLinks(f *proxy.Flow, resource map[string]interface{}) bool {
+	host := clientHost(f)
+	if !util.IsGcsHost(host) || slices.Contains(globalHosts, host) {
+		return false
+	}
+	rewritten := false
+	for _, field := range []string{"mediaLink", "selfLink"} {
+		link, ok := resource[field].(string)
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(link)
+		if err != nil || !util.IsGcsHost(u.Host) || u.Hostname() == host {
+			continue
+		}
+		u.Host = host
+		resource[field] = u.String()
+		rewritten = true
+	}
+	return rewritten
+}
+
+// describeResource rewrites an object resource GCS answered f with to describe the plaintext and
+// link the endpoint of the client, it reports whether the resource changed
+func describeResource(f *proxy.Flow, resource map[string]interface{}) bool {
+	described := describePlaintext(resource)
+	return rewriteLinks(f, resource) || described
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// plaintextCache keeps recently decrypted objects so the parallel ranged GETs issued by
+// sliced downloads (gcloud storage) or random/vectored reads (Hadoop GCS connector)
+// decrypt each object once instead of once per range.
+type plaintextCache struct {
+	mu          sync.Mutex
+	entries     map[plaintextKey]*plaintextEntry
+	objects     map[string]map[plaintextKey]struct{} // bucket/object -> its entries, of every caller
+	invalidated map[string]time.Time                 // bucket/object -> when it was deleted or overwritten last
+	prunedAt    time.Time
+	size        int
+	maxSize     int
+	ttl         time.Duration
+	inflight    singleflight.Group
+}
+
+// plaintextKey identifies one generation of an object as seen by one caller
+type plaintextKey struct {
+	authorization [sha256.Size]byte // hashed
+	bucket        string
+	object        string
+	generation    string // "listed" for the objects prefetched after a listing
+}
+
+func (k plaintextKey) String() string {
+	return hex.EncodeToString(k.authorization[:]) + "/" + k.bucket + "/" + k.object + "#" + k.generation
+}
+
+type plaintextEntry struct {
+	plaintext   []byte
+	contentType string
+	etag        string
+	generation  string
+	expires     time.Time
+}
+
+var (
+	slicedDownloadCache     *plaintextCache
+	slicedDownloadCacheOnce sync.Once
+)
+
+// getPlaintextCache returns the process wide cache, or nil if it is disabled.
+func getPlaintextCache() *plaintextCache {
+	slicedDownloadCacheOnce.Do(func() {
+		config := cfg.Current()
+		maxSize := config.SlicedDownloadCacheMB * 1024 * 1024
+		if maxSize <= 0 {
+			return
+		}
+		slicedDownloadCache = &plaintextCache{
+			entries:     make(map[plaintextKey]*plaintextEntry),
+			objects:     make(map[string]map[plaintextKey]struct{}),
+			invalidated: make(map[string]time.Time),
+			maxSize:     maxSize,
+			ttl:         config.SlicedDownloadCacheTTL,
+		}
+	})
+	return slicedDownloadCache
+}
+
+// plaintextCacheKey identifies one generation of an object as seen by one caller. The
+// authorization header is part of the key so a cached object is never served to a client
+// that GCS did not authorize to read it.
+func plaintextCacheKey(authorization string, bucketName string, objectName string, generation string) plaintextKey {
+	return plaintextKey{sha256.Sum256([]byte(authorization)), bucketName, objectName, generation}
+}
+
+func (c *plaintextCache) get(key plaintextKey) (*plaintextEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		c.removeLocked(key)
+		return nil, false
+	}
+	return entry, true
+}
+
+// getOrDecrypt returns the cached plaintext for key or runs decrypt once for all concurrent callers.
+func (c *plaintextCache) getOrDecrypt(key plaintextKey, contentType string, etag string, decrypt func() ([]byte, error)) ([]byte, error) {
+	if entry, ok := c.get(key); ok {
+		log.Debugf("plaintext cache hit for %v", key)
+		return entry.plaintext, nil
+	}
+
+	value, err, _ := c.inflight.Do(key.String(), func() (interface{}, error) {
+		plaintext, err := decrypt()
+		if err != nil {
+			return nil, err
+		}
+		c.put(key, &plaintextEntry{plaintext: plaintext, contentType: contentType, etag: etag, generation: key.generation})
+		return plaintext, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]byte), nil
+}
+
+func (c *plaintextCache) put(key plaintextKey, entry *plaintextEntry) {
+	if len(entry.plaintext) > c.maxSize {
+		return
+	}
+	entry.expires = time.Now().Add(c.ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(key)
+	// drop expired entries first, then the ones closest to expiring until the new entry fits
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			c.removeLocked(k)
+		}
+	}
+	for c.size+len(entry.plaintext) > c.maxSize {
+		var oldestKey plaintextKey
+		var oldest *plaintextEntry
+		for k, e := range c.entries {
+			if oldest == nil || e.expires.Before(oldest.expires) {
+				oldestKey, oldest = k, e
+			}
+		}
+		c.removeLocked(oldestKey)
+	}
+
+	c.entries[key] = entry
+	c.size += len(entry.plaintext)
+	object := key.bucket + "/" + key.object
+	if c.objects[object] == nil {
+		c.objects[object] = make(map[plaintextKey]struct{})
+	}
+	c.objects[object][key] = struct{}{}
+}
+
+func (c *plaintextCache) removeLocked(key plaintextKey) {
+	if entry, ok := c.entries[key]; ok {
+		c.size -= len(entry.plaintext)
+		delete(c.entries, key)
+		object := key.bucket + "/" + key.object
+		delete(c.objects[object], key)
+		if len(c.objects[object]) == 0 {
+			delete(c.objects, object)
+		}
+	}
+}
+
+// invalidate drops the entries of gs://bucketName/objectName, of every caller, whose generation
+// drop returns true for
+func (c *plaintextCache) invalidate(bucketName string, objectName string, drop func(generation string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	object := bucketName + "/" + objectName
+	now := time.Now()
+	c.invalidated[object] = now
+	if now.Sub(c.prunedAt) > time.Minute {
+		// the downloads that started before an invalidation are over by then
+		for k, t := range c.invalidated {
+			if now.Sub(t) > time.Minute {
+				delete(c.invalidated, k)
+			}
+		}
+		c.prunedAt = now
+	}
+
+	dropped := 0
+	for key := range c.objects[object] {
+		if drop(c.entries[key].generation) {
+			c.removeLocked(key)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// invalidatedSince reports whether gs://bucketName/objectName was deleted or overwritten after t,
+// the generation a download started with may no longer be the live one
+func (c *plaintextCache) invalidatedSince(bucketName string, objectName string, t time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	invalidated, ok := c.invalidated[bucketName+"/"+objectName]
+	return ok && !invalidated.Before(t)
+}
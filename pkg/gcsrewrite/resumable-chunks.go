@@ -0,0 +1,111 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package gcsrewrite
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// BufferChunksHeader has the chunks of a resumable upload collected by the proxy until the last
+// one, for the clients that upload in fixed size chunks however small the object is
+const BufferChunksHeader = "gcs-proxy-buffer-chunks"
+
+// UpstreamBytesHeader tells the client how many bytes of its upload the proxy sent to GCS, the
+// ciphertext of encrypted uploads. Buffered chunks are answered with 0, GCS has none of them yet.
+const UpstreamBytesHeader = "X-Gcs-Proxy-Upstream-Bytes"
+
+// "bytes 0-15728639/*", "bytes 15728640-20000000/20000001", "bytes */20000001" or "bytes */*"
+var chunkRangePattern = regexp.MustCompile(`^bytes (?:(\d+)-(\d+)|\*)/(\d+|\*)$`)
+
+// bufferChunk collects a chunk of the resumable upload uploadId on disk. The other chunks are
+// answered like GCS answers them, with 308 and the range received so far, and the session is
+// kept for the next one. last is true for the final chunk, its body then holds the whole object
+// and its Content-Range covers it.
+func bufferChunk(f *proxy.Flow, uploadId string, resumeData map[string]string) (last bool, err error) {
+	contentRange := f.Request.Header.Get("Content-Range")
+	matches := chunkRangePattern.FindStringSubmatch(contentRange)
+	if matches == nil {
+		return false, fmt.Errorf("%w: unsupported Content-Range %q", ErrInvalidUpload, contentRange)
+	}
+	partFile := fmt.Sprintf("/tmp/go-gcsproxy-%s.part", uploadId)
+	var received int64
+	if info, err := os.Stat(partFile); err == nil {
+		received = info.Size()
+	}
+
+	total := int64(-1)
+	if matches[3] != "*" {
+		total, _ = strconv.ParseInt(matches[3], 10, 64)
+	}
+	if matches[1] != "" {
+		start, _ := strconv.ParseInt(matches[1], 10, 64)
+		end, _ := strconv.ParseInt(matches[2], 10, 64)
+		if end-start+1 != int64(len(f.Request.Body)) {
+			return false, fmt.Errorf("%w: chunk %v has %v bytes", ErrInvalidUpload, contentRange, len(f.Request.Body))
+		}
+		if start > received {
+			return false, fmt.Errorf("%w: chunk %v starts after the %v bytes received", ErrInvalidUpload, contentRange, received)
+		}
+		// a chunk sent again after a failure replaces what the proxy has from its start
+		if err := appendChunk(partFile, start, f.Request.Body); err != nil {
+			return false, err
+		}
+		received = end + 1
+	}
+
+	if total < 0 || received < total {
+		// an intermediate chunk or a status query
+		if err := StoreResumableData(uploadId, resumeData); err != nil {
+			return false, err
+		}
+		f.Response = &proxy.Response{StatusCode: http.StatusPermanentRedirect, Header: make(http.Header)}
+		if received > 0 {
+			f.Response.Header.Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+		}
+		f.Response.Header.Set("X-GUploader-UploadID", uploadId)
+		f.Response.Header.Set(UpstreamBytesHeader, "0")
+		log.Debugf("buffered chunk %v of resumable upload %v, %v bytes so far", contentRange, uploadId, received)
+		return false, nil
+	}
+	if received != total {
+		return false, fmt.Errorf("%w: received %v bytes of an upload of %v", ErrInvalidUpload, received, total)
+	}
+
+	data, err := os.ReadFile(partFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("error reading the chunks of resumable upload %v: %v", uploadId, err)
+	}
+	os.Remove(partFile)
+	f.Request.Body = data
+	if total > 0 {
+		f.Request.Header.Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", total-1, total))
+	}
+	log.Debugf("resumable upload %v of %v bytes collected", uploadId, total)
+	return true, nil
+}
+
+// appendChunk writes chunk at offset start of partFile, dropping what follows
+func appendChunk(partFile string, start int64, chunk []byte) error {
+	file, err := os.OpenFile(partFile, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("error buffering resumable upload chunk: %v", err)
+	}
+	defer file.Close()
+	if err := file.Truncate(start); err != nil {
+		return fmt.Errorf("error buffering resumable upload chunk: %v", err)
+	}
+	if _, err := file.WriteAt(chunk, start); err != nil {
+		return fmt.Errorf("error buffering resumable upload chunk: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/backend"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// BucketStats counts the requests to a mapped bucket since the proxy started, for a quick look
+// without a metrics stack. Bytes are those of the client: the plaintext it uploaded and downloaded.
+type BucketStats struct {
+	Requests  int64 `json:"requests"`
+	Uploads   int64 `json:"uploads"`   // objects written
+	Downloads int64 `json:"downloads"` // object reads, ranges included
+	BytesIn   int64 `json:"bytesIn"`   // of the request bodies
+	BytesOut  int64 `json:"bytesOut"`  // of the response bodies
+	KmsCalls  int64 `json:"kmsCalls"`
+	Failures  int64 `json:"failures"` // answered with an error or not at all, see failed
+
+	latency time.Duration // of all the requests
+}
+
+// AverageLatency returns the mean time from the proxy reading a request to the client getting
+// the response, 0 without requests.
+func (s BucketStats) AverageLatency() time.Duration {
+	if s.Requests == 0 {
+		return 0
+	}
+	return s.latency / time.Duration(s.Requests)
+}
+
+var (
+	bucketStatsMu sync.Mutex
+	bucketStats   = map[string]*BucketStats{} // bucket ->
+)
+
+// AllBucketStats returns the stats of every mapped bucket the proxy had requests to, with the KMS
+// calls made for its objects.
+func AllBucketStats() map[string]BucketStats {
+	bucketStatsMu.Lock()
+	stats := make(map[string]BucketStats, len(bucketStats))
+	for bucket, s := range bucketStats {
+		stats[bucket] = *s
+	}
+	bucketStatsMu.Unlock()
+	for bucket, calls := range crypto.KmsCalls() {
+		s := stats[bucket]
+		s.KmsCalls = calls
+		stats[bucket] = s
+	}
+	return stats
+}
+
+// trackBucketStats counts f in the stats of the mapped bucket it names once it is done. It is
+// called before the request is rewritten, the body is the one of the client.
+func trackBucketStats(f *proxy.Flow) {
+	if _, ok := backend.Of(f); !ok && !util.IsGcsHost(f.Request.URL.Host) {
+		return
+	}
+	bucket := requestBucket(f)
+	if bucket == "" || util.KeyMapFor(f).Key(bucket) == "" {
+		return
+	}
+	m := gcsMethodOf(f)
+	bytesIn := int64(len(f.Request.Body))
+	start := time.Now()
+	go func() {
+		<-f.Done()
+		recordBucketStats(f, bucket, m, bytesIn, time.Since(start))
+	}()
+}
+
+func recordBucketStats(f *proxy.Flow, bucket string, m gcsMethod, bytesIn int64, latency time.Duration) {
+	succeeded := f.Response != nil && f.Response.StatusCode >= 200 && f.Response.StatusCode <= 299
+	bucketStatsMu.Lock()
+	defer bucketStatsMu.Unlock()
+	s := bucketStats[bucket]
+	if s == nil {
+		s = &BucketStats{}
+		bucketStats[bucket] = s
+	}
+	s.Requests++
+	s.BytesIn += bytesIn
+	s.latency += latency
+	if f.Response != nil {
+		s.BytesOut += int64(len(f.Response.Body))
+	}
+	switch {
+	case failed(f):
+		s.Failures++
+	case !succeeded:
+	case m == multiPartUpload || m == singlePartUpload || m == resumableUploadPut || m == xmlMultipartComplete || m == backendUpload:
+		// the chunks of a resumable upload before the last one are answered with 308
+		s.Uploads++
+	case m == simpleDownload || m == streamingDownload || m == backendDownload:
+		s.Downloads++
+	}
+}
+
+// failed reports whether f was answered with an error status or not at all. 404 Not Found and 412
+// Precondition Failed answer existence checks and conditional requests, they are no failures.
+func failed(f *proxy.Flow) bool {
+	if f.Response == nil {
+		return true
+	}
+	code := f.Response.StatusCode
+	return code >= 400 && code != http.StatusNotFound && code != http.StatusPreconditionFailed
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/sigv4"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+An emergency bypass passes the requests of one bucket to GCS as they are for a bounded time, e.g.
+while its key is unusable during an incident: uploads are stored in plaintext and downloads return
+what is stored, ciphertext included. It is started through the admin API with a mandatory reason,
+logged and audited when it starts, ends or expires, and ends by itself, so nobody has to remember
+to turn encryption back on. A write-only proxy keeps refusing downloads.
+*/
+
+// BucketBypassHeader marks the requests passed through by a bypass, their responses are not
+// rewritten either, even when the bypass ended in between
+const BucketBypassHeader = "gcs-proxy-bucket-bypass"
+
+// Bypass is an emergency bypass of a bucket
+type Bypass struct {
+	Bucket      string    `json:"bucket"`
+	Reason      string    `json:"reason"`
+	RequestedBy string    `json:"requestedBy,omitempty"` // as given by the caller
+	Started     time.Time `json:"started"`
+	Expires     time.Time `json:"expires"`
+	Requests    int64     `json:"requests"` // passed through so far
+}
+
+type bypassEntry struct {
+	Bypass
+	requests atomic.Int64
+	timer    *time.Timer
+}
+
+var (
+	bypassMu sync.Mutex
+	bypasses = map[string]*bypassEntry{}
+)
+
+// OnBypass is called when a bypass starts, ends or expires (event) with the address of the
+// admin API caller, empty on expiry. Set by the binary to audit them.
+var OnBypass func(event string, client string, b Bypass)
+
+// StartBypass passes the requests of bucket through for duration, replacing the bypass the
+// bucket may already have
+func StartBypass(bucket string, reason string, requestedBy string, duration time.Duration, client string) (Bypass, error) {
+	if strings.TrimSpace(reason) == "" {
+		return Bypass{}, fmt.Errorf("a bypass needs a reason")
+	}
+	if duration <= 0 {
+		return Bypass{}, fmt.Errorf("a bypass needs a positive duration")
+	}
+	now := time.Now()
+	entry := &bypassEntry{Bypass: Bypass{
+		Bucket:      bucket,
+		Reason:      reason,
+		RequestedBy: requestedBy,
+		Started:     now,
+		Expires:     now.Add(duration),
+	}}
+
+	bypassMu.Lock()
+	if previous, ok := bypasses[bucket]; ok {
+		previous.timer.Stop()
+	}
+	entry.timer = time.AfterFunc(duration, func() { expireBypass(bucket, entry) })
+	bypasses[bucket] = entry
+	bypassMu.Unlock()
+
+	log.WithField("bucket", bucket).Warnf("EMERGENCY BYPASS of bucket %v until %v requested by %q from %v: %v. its objects are neither encrypted nor decrypted",
+		bucket, entry.Expires.Format(time.RFC3339), requestedBy, client, reason)
+	notifyBypass("start", client, entry.Bypass)
+	return entry.Bypass, nil
+}
+
+// EndBypass re-enables encryption for bucket before its bypass expires, ok is false without one
+func EndBypass(bucket string, client string) (Bypass, bool) {
+	bypassMu.Lock()
+	entry, ok := bypasses[bucket]
+	if ok {
+		entry.timer.Stop()
+		delete(bypasses, bucket)
+	}
+	bypassMu.Unlock()
+	if !ok {
+		return Bypass{}, false
+	}
+	b := entry.snapshot()
+	log.WithField("bucket", bucket).Warnf("emergency bypass of bucket %v ended by %v after %v requests, encryption is enabled again", bucket, client, b.Requests)
+	notifyBypass("end", client, b)
+	return b, true
+}
+
+// Bypasses returns the active bypasses by bucket name
+func Bypasses() []Bypass {
+	bypassMu.Lock()
+	list := make([]Bypass, 0, len(bypasses))
+	for _, entry := range bypasses {
+		list = append(list, entry.snapshot())
+	}
+	bypassMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Bucket < list[j].Bucket })
+	return list
+}
+
+// bypassed marks f and counts it if its bucket is bypassed
+func bypassed(f *proxy.Flow, bucket string) bool {
+	bypassMu.Lock()
+	entry, ok := bypasses[bucket]
+	bypassMu.Unlock()
+	if !ok || !time.Now().Before(entry.Expires) {
+		return false
+	}
+	entry.requests.Add(1)
+	f.Request.Header.Set(BucketBypassHeader, "1")
+	return true
+}
+
+// passedThrough reports whether f was sent as it is by an HMAC or an emergency bypass
+func passedThrough(f *proxy.Flow) bool {
+	return f.Request.Header.Get(sigv4.BypassHeader) != "" || f.Request.Header.Get(BucketBypassHeader) != ""
+}
+
+func expireBypass(bucket string, entry *bypassEntry) {
+	bypassMu.Lock()
+	current, ok := bypasses[bucket]
+	if ok && current == entry {
+		delete(bypasses, bucket)
+	}
+	bypassMu.Unlock()
+	if !ok || current != entry {
+		return
+	}
+	b := entry.snapshot()
+	log.WithField("bucket", bucket).Warnf("emergency bypass of bucket %v expired after %v requests, encryption is enabled again", bucket, b.Requests)
+	notifyBypass("expire", "", b)
+}
+
+func (e *bypassEntry) snapshot() Bypass {
+	b := e.Bypass
+	b.Requests = e.requests.Load()
+	return b
+}
+
+func notifyBypass(event string, client string, b Bypass) {
+	if OnBypass != nil {
+		OnBypass(event, client, b)
+	}
+}
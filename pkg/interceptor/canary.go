@@ -0,0 +1,181 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/keymap"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+/*
+The key checks only prove that KMS still encrypts. With -canary_interval the proxy also writes the
+canary object -canary_object to every mapped bucket the way it writes uploads, encrypted with the
+bucket's key and format, reads it back and decrypts it, so a lost storage permission, a key that
+no longer decrypts or an envelope that does not round trip shows up before the users' requests
+fail. The canary runs with the proxy's own identity: it needs roles/storage.objectUser on the
+canary objects besides the KMS roles. Buckets mapped by the * entry or by tenants are not known
+by name and have no canary. A write-only proxy only encrypts and uploads.
+*/
+
+// CanaryRuns counts the canary cycles by bucket, result (ok or error) and the stage that
+// failed: encrypt, upload, download, decrypt or compare. Set up by the binary when metrics are
+// exported.
+var CanaryRuns metric.Int64Counter
+
+// canaryTimeout bounds one cycle of one bucket
+const canaryTimeout = time.Minute
+
+// canaryError is a failed stage of a canary cycle
+type canaryError struct {
+	stage string
+	err   error
+}
+
+func (e *canaryError) Error() string {
+	return fmt.Sprintf("%v: %v", e.stage, e.err)
+}
+
+// RunCanary runs a canary cycle in every mapped bucket every interval until ctx is done
+func RunCanary(ctx context.Context, interval time.Duration) {
+	client, err := gcsclient.Storage()
+	if err != nil {
+		log.Errorf("canary disabled: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failing := map[string]bool{}
+	for {
+		keyMap := util.KeyMap()
+		for bucket, key := range keyMap.Keys {
+			if bucket == keymap.AllBuckets {
+				continue
+			}
+			bucketCtx, cancel := context.WithTimeout(ctx, canaryTimeout)
+			err := canaryCycle(bucketCtx, client, bucket, key, keyMap.Format(bucket), keyMap.Policy)
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			countCanary(bucket, err)
+			object := fmt.Sprintf("gs://%v/%v", bucket, cfg.Current().CanaryObject)
+			if err != nil {
+				log.WithField("bucket", bucket).Errorf("canary %v failed at %v", object, err)
+			} else if failing[bucket] {
+				log.WithField("bucket", bucket).Infof("canary %v passes again", object)
+			}
+			failing[bucket] = err != nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// canaryCycle writes fresh random plaintext to the canary object of bucket and reads it back
+func canaryCycle(ctx context.Context, client *storage.Client, bucket string, key string, format string, policy string) error {
+	plaintext := make([]byte, 256)
+	if _, err := rand.Read(plaintext); err != nil {
+		return &canaryError{"encrypt", err}
+	}
+	obj := util.Bucket(ctx, client, bucket).Object(cfg.Current().CanaryObject)
+
+	var writer *storage.Writer
+	payload := plaintext
+	switch format {
+	case util.EnvelopeFormatCsek:
+		csekKey, err := crypto.DeriveCsekKey(ctx, key, bucket, cfg.Current().CanaryObject)
+		if err != nil {
+			return &canaryError{"encrypt", err}
+		}
+		obj = obj.Key(csekKey)
+		writer = obj.NewWriter(ctx)
+	default:
+		ciphertext, keyVersion, err := crypto.EncryptBytesWithKeyVersion(ctx, key, plaintext)
+		if err != nil {
+			return &canaryError{"encrypt", err}
+		}
+		payload = ciphertext
+		writer = obj.NewWriter(ctx)
+		writer.Metadata = map[string]string{
+			util.MetaKey(util.MetaUnencryptedLength):    strconv.Itoa(len(plaintext)),
+			util.MetaKey(util.MetaMd5Hash):              crypto.Base64MD5Hash(plaintext),
+			util.MetaKey(util.MetaCrc32c):               crypto.Base64Crc32cHash(plaintext),
+			util.MetaKey(util.MetaEncryptionKey):        key,
+			util.MetaKey(util.MetaEncryptionKeyVersion): keyVersion,
+			util.MetaKey(util.MetaProxyVersion):         cfg.Current().GCSProxyVersion,
+			util.MetaKey(util.MetaEnvelopeVersion):      strconv.Itoa(envelope.Version),
+		}
+		if crypto.EscrowKeyName != "" {
+			writer.Metadata[util.MetaKey(util.MetaEscrowKey)] = crypto.EscrowKeyName
+		}
+		maps.Copy(writer.Metadata, util.EncryptionProvenance(policy))
+	}
+	writer.ContentType = "application/octet-stream"
+	if _, err := writer.Write(payload); err != nil {
+		writer.Close()
+		return &canaryError{"upload", err}
+	}
+	if err := writer.Close(); err != nil {
+		return &canaryError{"upload", err}
+	}
+	if cfg.Current().WriteOnly {
+		return nil
+	}
+
+	reader, err := obj.Generation(writer.Attrs().Generation).NewReader(ctx)
+	if err != nil {
+		return &canaryError{"download", err}
+	}
+	stored, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return &canaryError{"download", err}
+	}
+	if format != util.EnvelopeFormatCsek {
+		if stored, err = crypto.DecryptBytes(ctx, key, stored); err != nil {
+			return &canaryError{"decrypt", err}
+		}
+	}
+	if !bytes.Equal(stored, plaintext) {
+		return &canaryError{"compare", fmt.Errorf("read back %v bytes that differ from the %v bytes written", len(stored), len(plaintext))}
+	}
+	return nil
+}
+
+func countCanary(bucket string, err error) {
+	if CanaryRuns == nil {
+		return
+	}
+	result, stage := "ok", ""
+	var canaryErr *canaryError
+	if errors.As(err, &canaryErr) {
+		result, stage = "error", canaryErr.stage
+	}
+	CanaryRuns.Add(context.Background(), 1, metric.WithAttributes(attribute.String("bucket", bucket),
+		attribute.String("result", result), attribute.String("stage", stage)))
+}
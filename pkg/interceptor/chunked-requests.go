@@ -0,0 +1,42 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"slices"
+	"strconv"
+
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Clients streaming an upload of unknown size, curl -T - or --data-binary @- with
+Transfer-Encoding: chunked among them, send no Content-Length. net/http decodes the chunks and
+mitmproxy collects the whole body before the Request addons run, so by then the size is known:
+the request is rewritten as if it had been sent with a Content-Length, which is what the
+handlers, the re-signing of HMAC requests and GCS see.
+*/
+
+// normalizeChunkedRequest gives a chunked request the Content-Length of its collected body. Its
+// trailers become headers, mitmproxy forwards neither trailers nor chunks, and the proxy already
+// answered Expect: 100-continue by reading the body.
+func normalizeChunkedRequest(f *proxy.Flow) {
+	raw := f.Request.Raw()
+	if raw == nil || !slices.Contains(raw.TransferEncoding, "chunked") {
+		return
+	}
+	f.Request.Header.Del("Transfer-Encoding")
+	f.Request.Header.Del("Trailer")
+	f.Request.Header.Del("Expect")
+	for name, values := range raw.Trailer {
+		for _, value := range values {
+			f.Request.Header.Add(name, value)
+		}
+	}
+	f.Request.Header.Set("Content-Length", strconv.Itoa(len(f.Request.Body)))
+	log.Debugf("chunked request %v %v of %v bytes, %v trailers", f.Request.Method, f.Request.URL.Path, len(f.Request.Body), len(raw.Trailer))
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsrewrite"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// client families told apart by their User-Agent and X-Goog-Api-Client headers
+const (
+	clientGsutil = "gsutil"
+	clientGcloud = "gcloud"
+	clientJava   = "java"
+	clientPython = "python"
+	clientGo     = "go"
+	clientNode   = "node"
+	clientCurl   = "curl"
+	clientOther  = "other"
+)
+
+// clientMarkers are checked in order, gsutil also names the Cloud SDK it ships with
+var clientMarkers = []struct {
+	family  string
+	markers []string
+}{
+	{clientGsutil, []string{"gsutil/"}},
+	{clientGcloud, []string{"command/gcloud", "gcloud/"}},
+	{clientJava, []string{"gl-java/", "gcloud-java/"}},
+	{clientPython, []string{"gl-python/", "gcloud-python/"}},
+	{clientGo, []string{"gl-go/", "gcloud-golang/"}},
+	{clientNode, []string{"gl-node/", "gcloud-node/"}},
+	{clientCurl, []string{"curl/"}},
+}
+
+// clientShim works around what a client family does that the proxy can't encrypt as it is
+type clientShim struct {
+	composeHint  string // refuse composing objects of encrypted buckets, with how to turn it off in the client
+	bufferChunks bool   // collect resumable uploads sent in fixed size chunks
+}
+
+var clientShims = map[string]clientShim{
+	// parallel composite uploads concatenate the ciphertext of their components
+	clientGsutil: {composeHint: "run gsutil with -o GSUtil:parallel_composite_upload_threshold=0"},
+	clientGcloud: {composeHint: "run gcloud config set storage/parallel_composite_upload_enabled False"},
+	// WriteChannel sends 15 MiB chunks (setChunkSize)
+	clientJava: {bufferChunks: true},
+}
+
+// errComposeEncrypted refuses composing objects the proxy encrypted, each component is a whole envelope
+var errComposeEncrypted = errors.New("composed objects of an encrypted bucket can't be decrypted")
+
+// clientFamily returns the client family of f, other when the headers name none
+func clientFamily(f *proxy.Flow) string {
+	agent := f.Request.Header.Get("User-Agent") + " " + f.Request.Header.Get("X-Goog-Api-Client")
+	for _, client := range clientMarkers {
+		for _, marker := range client.markers {
+			if strings.Contains(agent, marker) {
+				return client.family
+			}
+		}
+	}
+	return clientOther
+}
+
+// applyClientShims prepares f for the quirks of its client, err refuses it. It runs for the
+// requests of the buckets the proxy encrypts.
+func applyClientShims(f *proxy.Flow) error {
+	if !cfg.For(f).ClientShims {
+		return nil
+	}
+	family := clientFamily(f)
+	shim, ok := clientShims[family]
+	if !ok {
+		return nil
+	}
+	if shim.composeHint != "" && isComposeRequest(f) {
+		return fmt.Errorf("%w, %v uses parallel composite uploads: %v", errComposeEncrypted, family, shim.composeHint)
+	}
+	if shim.bufferChunks {
+		f.Request.Header.Set(hdl.BufferChunksHeader, family)
+	}
+	return nil
+}
+
+// isComposeRequest reports whether f is POST /storage/v1/b/bucket/o/object/compose
+func isComposeRequest(f *proxy.Flow) bool {
+	path, ok := strings.CutPrefix(f.Request.URL.EscapedPath(), "/storage/v1/b/")
+	if !ok || f.Request.Method != http.MethodPost {
+		return false
+	}
+	segments := strings.Split(path, "/")
+	return len(segments) == 4 && segments[1] == "o" && segments[3] == "compose"
+}
+
+// isTinkRequest reports whether the proxy encrypts the objects of the bucket of f itself
+func isTinkRequest(f *proxy.Flow) bool {
+	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	keyMap := util.KeyMapFor(f)
+	return keyMap.Key(bucketName) != "" && keyMap.Format(bucketName) != util.EnvelopeFormatCsek
+}
@@ -0,0 +1,32 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// ConfigAddon binds the configuration of its provider to every flow when the request arrives, the
+// addons and handlers read it back with cfg.For. It must be the first addon. A configuration stored
+// while a flow is handled applies from the next flow on, and a listener can run with its own
+// configuration by giving it another Provider.
+type ConfigAddon struct {
+	proxy.BaseAddon
+	provider cfg.Provider
+}
+
+func NewConfigAddon(provider cfg.Provider) *ConfigAddon {
+	return &ConfigAddon{provider: provider}
+}
+
+func (a *ConfigAddon) Requestheaders(f *proxy.Flow) {
+	cfg.Bind(f, a.provider.Config())
+	go func() {
+		<-f.Done()
+		cfg.Unbind(f)
+	}()
+}
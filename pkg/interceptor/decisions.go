@@ -0,0 +1,190 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/backend"
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsrewrite"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// Decision describes what the proxy did with a flow, for dumps and debugging.
+type Decision struct {
+	Intercepted    bool    `json:"intercepted"` // the payload was rewritten
+	Method         string  `json:"method"`
+	Tenant         string  `json:"tenant,omitempty"` // the tenant of the client, see pkg/tenant
+	Bucket         string  `json:"bucket,omitempty"`
+	Object         string  `json:"object,omitempty"`
+	Mapping        string  `json:"mapping,omitempty"` // the bucket key mapping entry that matched, * for the global key
+	Key            string  `json:"key,omitempty"`
+	Format         string  `json:"format,omitempty"`
+	Action         string  `json:"action"` // encrypt, decrypt, rewrite, csek, skip (already encrypted), plaintext (by the content type or size rules), refused (write-only or key failure policy), passthrough or disabled
+	Error          string  `json:"error,omitempty"`
+	DurationMs     float64 `json:"durationMs"` // time spent in the proxy's handlers, without the upstream call
+	PlaintextSize  int     `json:"plaintextSize,omitempty"`
+	CiphertextSize int     `json:"ciphertextSize,omitempty"`
+}
+
+type recordedDecision struct {
+	decision *Decision
+	readers  atomic.Int32 // readers that did not call ForgetDecision yet
+}
+
+var (
+	decisionReaders atomic.Int32
+	decisions       sync.Map // flow id -> *recordedDecision
+)
+
+// WatchDecisions turns on recording a Decision for every flow. Every caller must call
+// ForgetDecision for each flow once it is done with the flow's decision.
+func WatchDecisions() {
+	decisionReaders.Add(1)
+}
+
+// DecisionOf returns the decision recorded for f.
+func DecisionOf(f *proxy.Flow) (*Decision, bool) {
+	r, ok := decisions.Load(f.Id)
+	if !ok {
+		return nil, false
+	}
+	return r.(*recordedDecision).decision, true
+}
+
+// ForgetDecision releases f's decision, it is dropped when every watcher released it.
+func ForgetDecision(f *proxy.Flow) {
+	r, ok := decisions.Load(f.Id)
+	if ok && r.(*recordedDecision).readers.Add(-1) <= 0 {
+		decisions.Delete(f.Id)
+	}
+}
+
+func storeDecision(f *proxy.Flow, d *Decision) {
+	r := &recordedDecision{decision: d}
+	r.readers.Store(decisionReaders.Load())
+	decisions.Store(f.Id, r)
+}
+
+var methodActions = map[gcsMethod]string{
+	multiPartUpload:      "encrypt",
+	singlePartUpload:     "encrypt",
+	resumableUploadPut:   "encrypt",
+	resumableUploadPost:  "rewrite",
+	simpleDownload:       "decrypt",
+	metadataRequest:      "rewrite",
+	listObjects:          "rewrite",
+	passThru:             "passthrough",
+	xmlMultipartInitiate: "rewrite",
+	xmlMultipartPart:     "encrypt",
+	xmlMultipartComplete: "rewrite",
+	xmlMultipartAbort:    "passthrough",
+	batchRequest:         "rewrite",
+	backendUpload:        "encrypt",
+	backendDownload:      "decrypt",
+	backendUnsupported:   "refused",
+	objectHead:           "rewrite",
+}
+
+var methodNames = map[gcsMethod]string{
+	multiPartUpload:      "multiPartUpload",
+	singlePartUpload:     "singlePartUpload",
+	resumableUploadPost:  "resumableUploadPost",
+	resumableUploadPut:   "resumableUploadPut",
+	simpleDownload:       "simpleDownload",
+	streamingDownload:    "streamingDownload",
+	metadataRequest:      "metadataRequest",
+	listObjects:          "listObjects",
+	passThru:             "passThru",
+	xmlMultipartInitiate: "xmlMultipartInitiate",
+	xmlMultipartPart:     "xmlMultipartPart",
+	xmlMultipartComplete: "xmlMultipartComplete",
+	xmlMultipartAbort:    "xmlMultipartAbort",
+	batchRequest:         "batchRequest",
+	backendUpload:        "backendUpload",
+	backendDownload:      "backendDownload",
+	backendUnsupported:   "backendUnsupported",
+	objectHead:           "objectHead",
+}
+
+func (m gcsMethod) String() string {
+	return methodNames[m]
+}
+
+// recordRequestDecision records the request side of f's decision, the time since start
+// counts as proxy time.
+func recordRequestDecision(f *proxy.Flow, m gcsMethod, csek bool, plaintextSize int, start time.Time, err error) {
+	if decisionReaders.Load() == 0 {
+		return
+	}
+	d := &Decision{Method: m.String(), Action: methodActions[m]}
+	if t := tenant.Of(f); t != nil {
+		d.Tenant = t.Name
+	}
+	o, named := backend.Of(f)
+	if named {
+		d.Bucket, d.Object = o.Bucket, o.Name
+	} else if named = util.IsGcsHost(f.Request.URL.Host) && m != batchRequest; named {
+		d.Bucket = util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+		d.Object = util.GetObjectNameFromRequestUri(f.Request.URL.Path)
+	}
+	if named {
+		keyMap := util.KeyMapFor(f)
+		d.Mapping, d.Key = keyMap.Mapping(d.Bucket)
+		if d.Key != "" {
+			d.Format = keyMap.Format(d.Bucket)
+		}
+	}
+	if csek {
+		d.Method, d.Action = "csek", "csek"
+	}
+	if f.Request.Header.Get(hdl.AlreadyEncryptedHeader) != "" {
+		d.Action = "skip"
+	} else if f.Request.Header.Get(hdl.PolicySkippedHeader) != "" {
+		d.Action = "plaintext"
+	}
+	d.Intercepted = d.Action != "passthrough" && d.Action != "skip" && d.Action != "plaintext"
+	if d.Action == "encrypt" {
+		d.PlaintextSize = plaintextSize
+		d.CiphertextSize = len(f.Request.Body)
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	d.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	storeDecision(f, d)
+}
+
+// recordDisabledDecision records a flow that was not looked at because encryption is disabled.
+func recordDisabledDecision(f *proxy.Flow) {
+	if decisionReaders.Load() == 0 {
+		return
+	}
+	storeDecision(f, &Decision{Method: passThru.String(), Action: "disabled"})
+}
+
+// recordResponseDecision adds the response side of f's decision, plaintext downloads were
+// not decrypted.
+func recordResponseDecision(f *proxy.Flow, ciphertextSize int, plaintext bool, start time.Time, err error) {
+	d, ok := DecisionOf(f)
+	if !ok {
+		return
+	}
+	if d.Action == "decrypt" && plaintext {
+		d.Action, d.Intercepted = "plaintext", false
+	} else if d.Action == "decrypt" {
+		d.CiphertextSize = ciphertextSize
+		d.PlaintextSize = len(f.Response.Body)
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	d.DurationMs += float64(time.Since(start).Microseconds()) / 1000
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+GCS_PROXY_DISABLE_ENCRYPTION turns the proxy into a passthrough: every object is uploaded and
+downloaded as it is. A fleet left in that mode by accident looks healthy, so besides the
+confirmation the binary requires, the proxy warns every disabledWarningInterval with the number of
+requests passed through since the last warning, and reports the mode in the proxy.encryptionDisabled
+metric and GET /v1/status of the admin API.
+*/
+
+const disabledWarningInterval = 5 * time.Minute
+
+// disabledRequests counts the requests passed through since the start because encryption is disabled
+var disabledRequests atomic.Int64
+
+// DisabledRequests returns the number of requests passed through in plaintext since the start
+// because encryption is disabled
+func DisabledRequests() int64 {
+	return disabledRequests.Load()
+}
+
+// WarnEncryptDisabled logs a warning every disabledWarningInterval until ctx is done, if
+// encryption is disabled
+func WarnEncryptDisabled(ctx context.Context) {
+	if !cfg.Current().EncryptDisabled {
+		return
+	}
+	ticker := time.NewTicker(disabledWarningInterval)
+	defer ticker.Stop()
+	var warned int64
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		total := disabledRequests.Load()
+		log.WithField("plaintextRequests", total).Warnf("ENCRYPTION IS DISABLED by GCS_PROXY_DISABLE_ENCRYPTION: %v requests passed to GCS in plaintext in the last %v",
+			total-warned, disabledWarningInterval)
+		warned = total
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsrewrite"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// errorResponses map the errors of the handlers to the status and reason of their response, the
+// others are answered with 500
+var errorResponses = []struct {
+	err    error
+	status int
+	reason string
+	hint   string // appended to the message
+	retry  bool   // with a Retry-After of the key check interval
+}{
+	{errWriteOnly, http.StatusForbidden, "writeOnly", "", false},
+	{errKeyUnhealthy, http.StatusServiceUnavailable, "keyUnhealthy", "", true},
+	{hdl.ErrAlreadyEncrypted, http.StatusBadRequest, "alreadyEncrypted", ", upload the plaintext or send it through one proxy only", false},
+	{errComposeEncrypted, http.StatusBadRequest, "composeEncrypted", "", false},
+	{hdl.ErrInvalidUpload, http.StatusBadRequest, "invalid", "", false},
+}
+
+// GcsErrorResponse answers f with a GCS style JSON error, which gcloud and the client libraries
+// show with its reason, in place of any response it had.
+func GcsErrorResponse(f *proxy.Flow, status int, reason string, message string) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": message,
+			"errors": []map[string]interface{}{{
+				"domain":  "gcs-proxy",
+				"reason":  reason,
+				"message": message,
+			}},
+		},
+	})
+	f.Response = &proxy.Response{StatusCode: status, Header: make(http.Header), Body: body}
+	f.Response.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	f.Response.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// xmlErrorResponse answers f with an XML API error, for the S3 compatible clients of the XML API
+func xmlErrorResponse(f *proxy.Flow, status int, code string, message string) {
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(message))
+	body := []byte("<?xml version='1.0' encoding='UTF-8'?><Error><Code>" + code + "</Code><Message>" +
+		escaped.String() + "</Message></Error>")
+	f.Response = &proxy.Response{StatusCode: status, Header: make(http.Header), Body: body}
+	f.Response.Header.Set("Content-Type", "application/xml; charset=UTF-8")
+	f.Response.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// setErrorResponse answers f with err. KMS failures get their own status and reason, and the
+// hint of the KMS errors, the other known errors those of errorResponses. XML API multipart
+// uploads and HMAC signed requests, which come from S3 compatible clients, get an XML error.
+func setErrorResponse(f *proxy.Flow, err error) {
+	status, reason, message := http.StatusInternalServerError, "internalError", fmt.Sprintf("gcs-proxy: %v", err)
+	var errorHeader, retryAfter string
+	var kmsErr *crypto.KmsError
+	if errors.As(err, &kmsErr) {
+		status, reason, message = kmsErr.StatusCode, kmsErr.Code, "gcs-proxy "+kmsErr.Error()
+		errorHeader = kmsErr.Code
+	} else if errors.Is(err, errSignatureInvalidated) {
+		status, reason = http.StatusForbidden, "signatureInvalidated"
+		errorHeader = reason
+	} else {
+		for _, r := range errorResponses {
+			if errors.Is(err, r.err) {
+				status, reason, message = r.status, r.reason, fmt.Sprintf("gcs-proxy: %v%v", err, r.hint)
+				if r.retry {
+					retryAfter = strconv.Itoa(max(int(cfg.For(f).KeyCheckInterval.Seconds()), 1))
+				}
+				break
+			}
+		}
+	}
+
+	switch m := gcsMethodOf(f); {
+	case m == xmlMultipartInitiate || m == xmlMultipartPart || m == xmlMultipartComplete || m == xmlMultipartAbort,
+		errors.Is(err, errSignatureInvalidated):
+		// XML API error codes are capitalized
+		xmlErrorResponse(f, status, strings.ToUpper(reason[:1])+reason[1:], message)
+	default:
+		GcsErrorResponse(f, status, reason, message)
+	}
+	if errorHeader != "" {
+		f.Response.Header.Set("X-Gcs-Proxy-Error", errorHeader)
+	}
+	if retryAfter != "" {
+		f.Response.Header.Set("Retry-After", retryAfter)
+	}
+}
@@ -0,0 +1,638 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/backend"
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsrewrite"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/latency"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/logsample"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/manifest"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/mirror"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/sigv4"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/spool"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+type DecryptGcsPayload struct {
+	proxy.BaseAddon
+}
+type EncryptGcsPayload struct {
+	proxy.BaseAddon
+}
+
+type GetReqHeader struct {
+	proxy.BaseAddon
+}
+
+// https://cloud.google.com/storage/docs/json_api/v1/objects
+type gcsMethod int
+
+const (
+	multiPartUpload      gcsMethod = iota // uploadType=multipart, VERB=POST, path=/upload/storage/v1/b/  DOCS: https://cloud.google.com/storage/docs/json_api/v1/objects/insert
+	singlePartUpload                      // uploadType=media,     VERB=POST, path=/upload/storage/v1/b/
+	resumableUploadPost                   // uploadType=resumable, VERB=POST, path=/upload/storage/v1/b/
+	resumableUploadPut                    // uploadType=resumable, VERB=PUT , path=/upload/storage/v1/b/
+	simpleDownload                        // VERB=GET, path=/storage/v1/b/bucket/o/object?alt=media or path=/bucket-name/object-name
+	streamingDownload                     // unsupported
+	metadataRequest                       // VERB=GET, path=/storage/v1/b/bucket/o/object?alt=json or path=/storage/v1/b/bucket/o/object?fields=size,generation,updated
+	listObjects                           // VERB=GET, path=/storage/v1/b/bucket/o  DOCS: https://cloud.google.com/storage/docs/json_api/v1/objects/list
+	passThru                              // all other requests
+	xmlMultipartInitiate                  // VERB=POST, path=/bucket-name/object-name?uploads  DOCS: https://cloud.google.com/storage/docs/xml-api/post-object-multipart
+	xmlMultipartPart                      // VERB=PUT,  path=/bucket-name/object-name?partNumber=N&uploadId=ID
+	xmlMultipartComplete                  // VERB=POST, path=/bucket-name/object-name?uploadId=ID
+	xmlMultipartAbort                     // VERB=DELETE, path=/bucket-name/object-name?uploadId=ID
+	batchRequest                          // VERB=POST, path=/batch/storage/v1  DOCS: https://cloud.google.com/storage/docs/batch
+	backendUpload                         // VERB=PUT, an S3 PutObject or Azure Put Blob, see pkg/backend
+	backendDownload                       // VERB=GET, an S3 GetObject or Azure Get Blob
+	backendUnsupported                    // S3 multipart uploads, aws-chunked payloads, Azure blocks, append and page blobs
+	objectHead                            // VERB=HEAD, path=/bucket-name/object-name or path=/storage/v1/b/bucket/o/object?alt=media
+
+)
+
+func InterceptGcsMethod(f *proxy.Flow) gcsMethod {
+	m := gcsMethodOf(f)
+	if m == metadataRequest && f.Request.URL.Query().Get("alt") != "json" {
+		// alt=json is the default of the JSON API. fields= requests are answered with the fields of
+		// the client and the metadata, rewritten to describe the plaintext
+		query := f.Request.URL.Query()
+		query.Set("alt", "json")
+		f.Request.URL.RawQuery = query.Encode()
+	}
+	return m
+}
+
+// gcsMethodOf returns the method of f like InterceptGcsMethod, without rewriting the request
+func gcsMethodOf(f *proxy.Flow) gcsMethod {
+	if o, ok := backend.Of(f); ok {
+		if util.KeyMapFor(f).Key(o.Bucket) == "" {
+			return passThru
+		}
+		switch operation, _ := o.Operation(f); operation {
+		case backend.Upload:
+			return backendUpload
+		case backend.Download:
+			return backendDownload
+		case backend.Unsupported:
+			return backendUnsupported
+		}
+		return passThru
+	}
+	// GCS supports both hostnames
+	if util.IsGcsHost(f.Request.URL.Host) {
+		// the requests of a batch name their buckets themselves
+		if hdl.IsBatchRequest(f) {
+			return batchRequest
+		}
+		bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+		if util.KeyMapFor(f).Key(bucketName) == "" || isControlPlaneRequest(f) {
+			return passThru
+		}
+
+		// XML API multipart upload, listing the uploads and their parts passes through
+		if query := f.Request.URL.Query(); query.Has("uploads") || query.Has("uploadId") {
+			switch {
+			case f.Request.Method == "POST" && query.Has("uploads"):
+				return xmlMultipartInitiate
+			case f.Request.Method == "PUT" && query.Has("partNumber"):
+				return xmlMultipartPart
+			case f.Request.Method == "POST":
+				return xmlMultipartComplete
+			case f.Request.Method == "DELETE":
+				return xmlMultipartAbort
+			}
+			return passThru
+		}
+
+		// multi-part or simple upload
+		if strings.HasPrefix(f.Request.URL.Path, "/upload/storage/v1") {
+			if f.Request.Method == "POST" {
+
+				if f.Request.URL.Query().Get("uploadType") == "multipart" {
+					return multiPartUpload
+				}
+				if f.Request.URL.Query().Get("uploadType") == "media" {
+					return singlePartUpload
+				}
+			}
+		}
+
+		// Resumable upload
+		if strings.HasPrefix(f.Request.URL.Path, "/resumable/upload/storage/v1") ||
+			(strings.HasPrefix(f.Request.URL.Path, "/upload/storage/v1") && f.Request.URL.Query().Get("uploadType") == "resumable") {
+			if f.Request.Method == "POST" {
+				return resumableUploadPost
+			} else if f.Request.Method == "PUT" {
+				return resumableUploadPut
+			}
+		}
+
+		// the stat of the XML API clients, answered with the headers of a download
+		if f.Request.Method == http.MethodHead && util.GetObjectNameFromRequestUri(f.Request.URL.Path) != "" &&
+			!f.Request.URL.Query().Has("acl") {
+			return objectHead
+		}
+
+		// get metadata
+		if strings.HasPrefix(f.Request.URL.Path, "/storage/v1/b/") {
+			if f.Request.Method == "GET" {
+				// pass through for metadata request for bucket, an object named dir/o is no listing
+				// TODO eshen may need to bypass directory too
+				if util.GetObjectNameFromRequestUri(f.Request.URL.Path) == "" {
+					if strings.HasSuffix(f.Request.URL.Path, "/o") {
+						return listObjects
+					}
+					return passThru
+				}
+				switch f.Request.URL.Query().Get("alt") {
+				case "", "json":
+					return metadataRequest
+				case "media":
+					return simpleDownload
+				}
+				return passThru
+			}
+		}
+
+		// download object when path=/download
+		if strings.HasPrefix(f.Request.URL.Path, "/download") {
+			return simpleDownload
+		}
+		// download when path=/bucket-name/object-name, the bucket listings of the XML API and the
+		// ACLs of its objects pass through
+		if f.Request.Method == "GET" && util.GetObjectNameFromRequestUri(f.Request.URL.Path) != "" &&
+			!f.Request.URL.Query().Has("acl") {
+			return simpleDownload
+		}
+
+	}
+	return passThru
+}
+
+// errWriteOnly refuses the downloads of a write-only proxy
+var errWriteOnly = errors.New("the proxy is write-only and does not decrypt downloads")
+
+// DecryptedObject returns the object f reads in plaintext: a download the proxy decrypts, or
+// the source of a copy or rewrite GCS decrypts with the derived customer-supplied key. Either
+// needs the bucket's KMS key. ok is false when f decrypts nothing.
+func DecryptedObject(f *proxy.Flow) (bucketName string, objectName string, ok bool) {
+	if cfg.For(f).EncryptDisabled {
+		return "", "", false
+	}
+	path := f.Request.URL.Path
+	switch gcsMethodOf(f) {
+	case simpleDownload:
+		return util.GetBucketNameFromRequestUri(path), util.GetObjectNameFromRequestUri(path), true
+	case backendDownload:
+		o, _ := backend.Of(f)
+		return o.Bucket, o.Name, true
+	}
+	if !isCsekRequest(f) {
+		return "", "", false
+	}
+	for _, verb := range []string{"/rewriteTo/", "/copyTo/"} {
+		if source, _, found := strings.Cut(path, verb); found {
+			return util.GetBucketNameFromRequestUri(source), util.GetObjectNameFromRequestUri(source), true
+		}
+	}
+	return "", "", false
+}
+
+// refuseRequest answers f, a request m, with the error response of err before calling KMS
+func refuseRequest(f *proxy.Flow, m gcsMethod, err error, start time.Time) {
+	recordRequestDecision(f, m, false, 0, start, err)
+	if d, ok := DecisionOf(f); ok {
+		d.Action, d.Intercepted = "refused", false
+	}
+	countRequest(f, "refused", err)
+	log.WithField(logsample.CategoryField, methodActions[m]).Warnf("%v, refusing %v %v", err, f.Request.Method, f.Request.URL.Path)
+	setErrorResponse(f, err)
+}
+
+// isControlPlaneRequest reports whether f reads or changes bucket resources or an object's ACL
+// through the JSON API: bucket metadata, retention policies and their lock, IAM policies, ACLs,
+// notifications. they carry no object data and go to GCS untouched. object holds and retention
+// are set by PATCH and PUT of the object resource, which are never rewritten either.
+func isControlPlaneRequest(f *proxy.Flow) bool {
+	// object names are escaped in the JSON API, so the path segments are the resource names
+	path, ok := strings.CutPrefix(f.Request.URL.EscapedPath(), "/storage/v1/b")
+	if !ok || (path != "" && path[0] != '/') {
+		return false
+	}
+	// /storage/v1/b lists the buckets, /storage/v1/b/bucket[/iam|/acl|/lockRetentionPolicy|...]
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if path == "" || len(segments) == 1 || segments[1] != "o" {
+		return true
+	}
+	// /storage/v1/b/bucket/o/object/acl[/entity]
+	return len(segments) > 3 && segments[3] == "acl"
+}
+
+// requestBucket returns the bucket f names, as the key mapping names it
+func requestBucket(f *proxy.Flow) string {
+	if o, ok := backend.Of(f); ok {
+		return o.Bucket
+	}
+	return util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+}
+
+// isCsekRequest reports whether f targets a bucket whose objects GCS encrypts with a
+// customer-supplied key instead of the proxy encrypting the payload.
+func isCsekRequest(f *proxy.Flow) bool {
+	if !util.IsGcsHost(f.Request.URL.Host) {
+		return false
+	}
+	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	keyMap := util.KeyMapFor(f)
+	return keyMap.Key(bucketName) != "" && keyMap.Format(bucketName) == util.EnvelopeFormatCsek
+}
+
+// OnCachedResponse is called with the downloads the proxy answers from its caches, which skip
+// the Responseheaders and Response events of the addons. Set by the binary to run those of the
+// addons other than Addons.
+var OnCachedResponse func(f *proxy.Flow)
+
+func (c *EncryptGcsPayload) Request(f *proxy.Flow) {
+	start := time.Now()
+	defer func() { latency.AddProxy(f, time.Since(start)) }()
+	plaintextSize := len(f.Request.Body)
+	normalizeChunkedRequest(f)
+
+	debugRequest(f)
+	// before the proxy changes anything, the mTLS rewrite changes the signed host
+	signature, signed := sigv4.Parse(f)
+
+	// we terminate the client TLS session so we can't present the client certificate to an
+	// mTLS endpoint. send intercepted mTLS traffic to the equivalent regular endpoint instead.
+	if util.IsMtlsHost(f.Request.URL.Host) {
+		f.Request.URL.Host = util.NonMtlsHost(f.Request.URL.Host)
+		log.Debugf("rewrote mTLS endpoint request to %v", f.Request.URL.Host)
+	}
+	trackBucketStats(f)
+
+	if cfg.For(f).EncryptDisabled {
+		recordDisabledDecision(f)
+		countRequest(f, "disabled", nil)
+		disabledRequests.Add(1)
+		return
+	}
+
+	if cfg.For(f).WriteOnly {
+		if bucketName, objectName, ok := DecryptedObject(f); ok {
+			refuseRequest(f, simpleDownload, fmt.Errorf("%w: gs://%v/%v", errWriteOnly, bucketName, objectName), start)
+			return
+		}
+	}
+
+	if bypassed(f, requestBucket(f)) {
+		recordRequestDecision(f, passThru, false, plaintextSize, start, nil)
+		if d, ok := DecisionOf(f); ok {
+			d.Action = "bypass"
+		}
+		countRequest(f, "bypass", nil)
+		return
+	}
+
+	requested := gcsMethodOf(f)
+	if err := keyFailure(f, requested); err != nil {
+		refuseRequest(f, requested, err, start)
+		return
+	}
+
+	if signed && cfg.For(f).HmacPolicy == HmacBypass && (requested != passThru || isCsekRequest(f)) {
+		f.Request.Header.Set(sigv4.BypassHeader, "1")
+		recordRequestDecision(f, passThru, false, plaintextSize, start, nil)
+		if d, ok := DecisionOf(f); ok {
+			d.Action = "hmac-bypass"
+		}
+		countRequest(f, "hmac-bypass", nil)
+		log.WithField(logsample.CategoryField, methodActions[requested]).Warnf("HMAC signed request of %v, sending %v %v unencrypted",
+			signature.AccessId, f.Request.Method, f.Request.URL.Path)
+		return
+	}
+
+	if requested == backendUnsupported {
+		o, _ := backend.Of(f)
+		_, reason := o.Operation(f)
+		refuseRequest(f, requested, fmt.Errorf("%w: %v, %v", hdl.ErrInvalidUpload, o, reason), start)
+		return
+	}
+
+	if util.IsGcsHost(f.Request.URL.Host) && isTinkRequest(f) {
+		if err := applyClientShims(f); err != nil {
+			refuseRequest(f, requested, err, start)
+			return
+		}
+	}
+
+	var err error
+	if isCsekRequest(f) {
+		err = hdl.HandleCsekRequest(f)
+		if err == nil && signed {
+			err = resignRequest(f, signature)
+		}
+		recordRequestDecision(f, passThru, true, plaintextSize, start, err)
+		countRequest(f, "csek", err)
+		if err != nil {
+			log.WithField(logsample.CategoryField, "encrypt").Error(err)
+			setErrorResponse(f, err)
+		}
+		return
+	}
+
+	m := InterceptGcsMethod(f)
+out:
+	switch m {
+
+	case multiPartUpload:
+		// Parse the multipart request.
+		err = hdl.HandleMultipartRequest(f)
+		break out
+
+	case simpleDownload:
+		err = hdl.HandleSimpleDownloadRequest(f)
+		break out
+
+	case singlePartUpload:
+		err = hdl.ConvertSinglePartUploadtoMultiPartUpload(f)
+		break out
+
+	case metadataRequest:
+		err = hdl.HandleMetadataRequest(f)
+		break out
+
+	case listObjects:
+		err = hdl.HandleListRequest(f)
+		break out
+
+	case resumableUploadPost:
+		err = hdl.HandleResumablePostRequest(f)
+		break out
+
+	case resumableUploadPut:
+		err = hdl.HandleResumablePutRequest(f)
+		break out
+
+	case xmlMultipartInitiate:
+		err = hdl.HandleXmlMultipartInitiateRequest(f)
+		break out
+
+	case xmlMultipartPart:
+		err = hdl.HandleXmlMultipartPartRequest(f)
+		break out
+
+	case xmlMultipartComplete:
+		err = hdl.HandleXmlMultipartCompleteRequest(f)
+		break out
+
+	case batchRequest:
+		err = hdl.HandleBatchRequest(f)
+		break out
+
+	case backendUpload:
+		o, _ := backend.Of(f)
+		err = hdl.HandleBackendUploadRequest(f, o)
+		break out
+
+	case backendDownload:
+		o, _ := backend.Of(f)
+		err = hdl.HandleBackendDownloadRequest(f, o)
+		break out
+
+	case objectHead:
+		err = hdl.HandleObjectHeadRequest(f)
+		break out
+	}
+	if err == nil && signed && f.Response == nil {
+		err = resignRequest(f, signature)
+	}
+	recordRequestDecision(f, m, false, plaintextSize, start, err)
+	if action := methodActions[m]; (m != simpleDownload && m != backendDownload) || err != nil {
+		// downloads are counted once decrypted
+		if f.Request.Header.Get(hdl.AlreadyEncryptedHeader) != "" {
+			action = "skip"
+		} else if f.Request.Header.Get(hdl.PolicySkippedHeader) != "" {
+			action = "plaintext"
+		} else if m == resumableUploadPut && err == nil && f.Response != nil {
+			// a chunk the proxy keeps until the last one
+			action = "buffer"
+		}
+		countRequest(f, action, err)
+	}
+	if m == simpleDownload && err == nil && f.Response != nil {
+		answeredFromCache(f)
+		return
+	}
+	if err != nil {
+		// answered right away so that nothing reaches GCS, the client sees why instead of an upload error
+		f.Request.Body = nil
+		log.WithField(logsample.CategoryField, "encrypt").Error(err)
+		setErrorResponse(f, err)
+		return
+	}
+	// uploads sent as they are are answered by GCS as they are, they are not spooled
+	if (m == multiPartUpload || m == singlePartUpload) && !hdl.SentAsIs(f) {
+		if _, err := spool.Spool(f); err != nil {
+			log.WithField(logsample.CategoryField, "encrypt").Errorf("sending the upload to GCS directly: %v", err)
+		}
+	}
+}
+
+// Responseheaders runs before the response body is read, so downloads can advertise the plaintext length early.
+func (c *DecryptGcsPayload) Responseheaders(f *proxy.Flow) {
+	// CONNECT flows get their Responseheaders event when the tunnel is established
+	if cfg.For(f).EncryptDisabled || f.Request.Method == http.MethodConnect || passedThrough(f) {
+		return
+	}
+	if !isCsekRequest(f) && InterceptGcsMethod(f) == simpleDownload {
+		hdl.HandleSimpleDownloadResponseHeaders(f)
+	}
+}
+
+func (c *DecryptGcsPayload) Response(f *proxy.Flow) {
+	start := time.Now()
+	defer func() { latency.AddProxy(f, time.Since(start)) }()
+	ciphertextSize := len(f.Response.Body)
+
+	var err error
+	var plaintext bool // a download of an object the content type or size rules stored in plaintext
+	defer func() { recordResponseDecision(f, ciphertextSize, plaintext, start, err) }()
+
+	debugResponse(f)
+	// before the handlers rewrite the resource, and for every bucket: one may be mapped since
+	hdl.InvalidateCaches(f)
+
+	if f.Response.StatusCode < 200 || f.Response.StatusCode > 299 {
+		// 304 Not Modified and 412 Precondition Failed answer conditional requests. like any other
+		// non 2xx response they carry no object data, so pass them to the client untouched.
+		if f.Response.StatusCode == http.StatusNotModified || f.Response.StatusCode == http.StatusPreconditionFailed {
+			log.Debugf("conditional request '%s' returned %v", f.Request.URL, f.Response.StatusCode)
+		} else {
+			log.WithField(logsample.CategoryField, "upstream").Errorf("got invalid response code! '%s' '%v'......\n\n%s", f.Request.URL, f.Response.StatusCode, f.Response.Body)
+		}
+		return
+	}
+
+	if cfg.For(f).EncryptDisabled || passedThrough(f) {
+		return
+	}
+
+	if isCsekRequest(f) {
+		if err = hdl.HandleCsekResponse(f); err != nil {
+			log.WithField(logsample.CategoryField, "decrypt").Error(err)
+		} else if gcsMethodOf(f) == simpleDownload {
+			// GCS decrypted the download with the key of the proxy
+			setResponseHeaders(f, util.GetBucketNameFromRequestUri(f.Request.URL.Path))
+		}
+		return
+	}
+
+	m := InterceptGcsMethod(f)
+	if hdl.SentAsIs(f) {
+		// the upload was sent as it is, so is its response
+		return
+	}
+	if cfg.For(f).VerifyUploads && (m == multiPartUpload || m == singlePartUpload || m == resumableUploadPut) {
+		if err = hdl.VerifyUpload(f); err != nil {
+			setErrorResponse(f, err)
+			log.WithField(logsample.CategoryField, "encrypt").Error(err)
+			return
+		}
+	}
+	recordOverhead(f)
+	mirror.Enqueue(f)
+	manifest.Record(f)
+
+out:
+	switch m {
+
+	case multiPartUpload:
+		err = hdl.HandleMultipartResponse(f)
+		break out
+
+	case simpleDownload:
+		plaintext = hdl.StoredInPlaintext(f, util.GetBucketNameFromRequestUri(f.Request.URL.Path))
+		err = hdl.HandleSimpleDownloadResponse(f)
+		break out
+
+	case singlePartUpload:
+		err = hdl.HandleSinglePartUploadResponse(f)
+		break out
+
+	case metadataRequest:
+		err = hdl.HandleMetadataResponse(f)
+		break out
+
+	case listObjects:
+		err = hdl.HandleListResponse(f)
+		break out
+
+	case resumableUploadPost:
+		err = hdl.HandleResumablePostResponse(f)
+		break out
+
+	case resumableUploadPut:
+		err = hdl.HandleResumablePutResponse(f)
+		break out
+
+	case xmlMultipartPart:
+		err = hdl.HandleXmlMultipartPartResponse(f)
+		break out
+
+	case xmlMultipartComplete:
+		err = hdl.HandleXmlMultipartCompleteResponse(f)
+		break out
+
+	case xmlMultipartAbort:
+		err = hdl.HandleXmlMultipartAbortResponse(f)
+		break out
+
+	case batchRequest:
+		err = hdl.HandleBatchResponse(f)
+		break out
+
+	case backendUpload:
+		o, _ := backend.Of(f)
+		err = hdl.HandleBackendUploadResponse(f, o)
+		break out
+
+	case backendDownload:
+		o, _ := backend.Of(f)
+		plaintext, err = hdl.HandleBackendDownloadResponse(f, o)
+		break out
+
+	case objectHead:
+		var described bool
+		described, err = hdl.HandleObjectHeadResponse(f)
+		plaintext = !described
+		break out
+
+	}
+	finishResponse(f, m, plaintext, err)
+}
+
+// finishResponse counts the answer to f, a request m, and applies the response header rules of
+// the bucket to decrypted downloads. It runs for the responses of GCS and for the downloads the
+// proxy answers from its caches, err is the one of the handler.
+func finishResponse(f *proxy.Flow, m gcsMethod, plaintext bool, err error) {
+	if (m == simpleDownload || m == backendDownload) && plaintext {
+		countRequest(f, "plaintext", err)
+	} else if m == simpleDownload || m == backendDownload {
+		countRequest(f, "decrypt", err)
+	}
+	if err != nil {
+		setErrorResponse(f, err)
+		log.WithField(logsample.CategoryField, "decrypt").Error(err)
+		return
+	}
+	if (m == simpleDownload || m == backendDownload) && !plaintext {
+		bucketName, _, _ := DecryptedObject(f)
+		setResponseHeaders(f, bucketName)
+	} else if m == objectHead && !plaintext {
+		// caches revalidate with HEAD, it gets the headers of the download
+		setResponseHeaders(f, util.GetBucketNameFromRequestUri(f.Request.URL.Path))
+	}
+
+	// recalculate content length, HEAD responses have no body and keep the length of the object
+	if f.Request.Method != http.MethodHead {
+		f.Response.ReplaceToDecodedBody()
+	}
+}
+
+// answeredFromCache finishes a download the handler answered from the sliced download cache or
+// the objects prefetched after a listing. go-mitmproxy sends a response set in Request as it is,
+// the cache hits get the post-processing of the downloads GCS answers here, and the Response
+// events of the other addons through OnCachedResponse.
+func answeredFromCache(f *proxy.Flow) {
+	recordResponseDecision(f, 0, false, time.Now(), nil)
+	finishResponse(f, simpleDownload, false, nil)
+	if OnCachedResponse != nil {
+		OnCachedResponse(f)
+	}
+}
+
+func debugResponse(f *proxy.Flow) {
+	header := "<<<" + f.Id.String()
+	log.Debugf("%v url: %v %v", header, f.Request.Method, f.Request.URL.String())
+	log.Debugf("%v body len: %v, ", header, len(f.Response.Body))
+	log.Debugf("%v header: %#v", header, f.Response.Header)
+}
+
+func debugRequest(f *proxy.Flow) {
+	header := ">>>" + f.Id.String()
+	log.Debugf("%v url: %v %v", header, f.Request.Method, f.Request.URL.String())
+	log.Debugf("%v body len: %v, ", header, len(f.Request.Body))
+	log.Debugf("%v header: %#v", header, f.Request.Header)
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"errors"
+	"fmt"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/sigv4"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// what the proxy does with an HMAC signed request it has to change, GCS refuses its signature
+const (
+	HmacResign = "resign" // sign it again with the secret of the client's access id
+	HmacReject = "reject" // answer 403 SignatureInvalidated instead of forwarding a request GCS refuses
+	HmacBypass = "bypass" // send it as it is, uploads are stored unencrypted and downloads not decrypted
+)
+
+// errSignatureInvalidated refuses the HMAC signed requests the proxy changed and can't re-sign
+var errSignatureInvalidated = errors.New("the proxy changes the request, which invalidates its HMAC signature")
+
+// resignRequest signs f again if the proxy changed what signature covers
+func resignRequest(f *proxy.Flow, signature *sigv4.Signature) error {
+	if !signature.Changed(f) {
+		return nil
+	}
+	if cfg.For(f).HmacPolicy != HmacResign {
+		return fmt.Errorf("%w, set -hmac_signed_requests=resign or bypass", errSignatureInvalidated)
+	}
+	if signature.Streaming() {
+		return fmt.Errorf("%w, aws-chunked payloads can't be re-signed", errSignatureInvalidated)
+	}
+	secret, ok := sigv4.Secret(signature.AccessId)
+	if !ok {
+		return fmt.Errorf("%w, access id %v is not in -hmac_keys_file", errSignatureInvalidated, signature.AccessId)
+	}
+	if err := signature.Resign(f, secret); err != nil {
+		return fmt.Errorf("%w: %v", errSignatureInvalidated, err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package interceptor is the go-mitmproxy addon that encrypts GCS uploads and decrypts GCS
+downloads. Embed it in another proxy with:
+
+	config := cfg.LoadConfig() // or fill in a cfg.Config
+	interceptor.Configure(config)
+	if err := interceptor.CheckKeyMapping(ctx); err != nil {
+		log.Fatal(err)
+	}
+	for _, addon := range interceptor.Addons() {
+		p.AddAddon(addon)
+	}
+
+The GCS request rewriting it relies on lives in pkg/gcsrewrite, the bucket to key mapping in
+pkg/keymap and the object format in pkg/envelope.
+*/
+package interceptor
+
+import (
+	"context"
+	"fmt"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/keymap"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/kmsquota"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// Configure sets the configuration the addons use. Call it before the proxy starts.
+func Configure(config *cfg.Config) {
+	cfg.Runtime.Store(config)
+	crypto.EscrowKeyName = config.KmsEscrowKey
+	crypto.KekTTL = config.KekTTL
+	crypto.AeadWorkers = config.AeadWorkers
+	crypto.DedupBuckets = config.DedupBuckets
+	crypto.DedupTTL = config.DedupTTL
+	crypto.DedupMaxBytes = int64(config.DedupCacheMB) * 1024 * 1024
+	crypto.RetryTTL = config.RetryReuseTTL
+	crypto.KmsProjectQps = config.KmsProjectQps
+	if config.KmsQuotaServer != "" {
+		crypto.KmsQuota = kmsquota.NewClient(config.KmsQuotaServer, config.KmsQuotaToken, config.KmsQps, config.KmsQuotaReplicas)
+	} else if config.KmsQps > 0 {
+		crypto.KmsQuota = kmsquota.NewLocal(config.KmsQps)
+	}
+	util.KeyMaps().Set(keymap.KeyMap{
+		Keys:         config.KmsBucketKeyMapping,
+		FallbackKeys: config.KmsFallbackKeys,
+		Formats:      config.EnvelopeFormats,
+
+		EncryptContentTypes: config.EncryptContentTypes,
+		SkipContentTypes:    config.SkipContentTypes,
+		MinSizes:            config.EncryptMinSizes,
+		MaxSizes:            config.EncryptMaxSizes,
+		ChunkSizes:          config.ChunkSizes,
+		DecryptClients:      config.DecryptClients,
+		OverrideClients:     config.OverrideClients,
+		ResponseHeaders:     config.ResponseHeaders,
+		Mirrors:             config.MirrorBuckets,
+	})
+}
+
+// Addons returns the addons to add to a go-mitmproxy proxy, in order.
+func Addons() []proxy.Addon {
+	return []proxy.Addon{
+		&EncryptGcsPayload{},
+		&DecryptGcsPayload{},
+		&GetReqHeader{},
+	}
+}
+
+// IsAddon reports whether addon is one of Addons
+func IsAddon(addon proxy.Addon) bool {
+	switch addon.(type) {
+	case *EncryptGcsPayload, *DecryptGcsPayload, *GetReqHeader:
+		return true
+	}
+	return false
+}
+
+// CheckKeyMapping verifies that every mapped key can be used with its bucket's envelope format.
+func CheckKeyMapping(ctx context.Context) error {
+	keyMap := util.KeyMap()
+	// with the admin API buckets can be onboarded after startup, tenants bring their own mappings
+	if config := cfg.Current(); len(keyMap.Keys) == 0 && config.AdminAddr == "" && config.TenantsFile == "" {
+		return fmt.Errorf("No KmsBucketKeyMapping found")
+	}
+	for bucket, value := range keyMap.Keys {
+		if err := CheckKey(ctx, bucket, value, keyMap.Format(bucket)); err != nil {
+			return err
+		}
+	}
+	for bucket, mirror := range keyMap.Mirrors {
+		if keyMap.Key(mirror) == "" {
+			return fmt.Errorf("mirror bucket %v of %v has no KMS key mapped", mirror, bucket)
+		}
+	}
+	return nil
+}
+
+// CheckTenantKeys verifies the keys mapped by every tenant with the tenant's KMS credentials.
+func CheckTenantKeys(ctx context.Context, registry *tenant.Registry) error {
+	for _, t := range registry.Tenants() {
+		tenantCtx := crypto.WithKmsCredentials(ctx, t.KmsCredentialsFile)
+		for bucket, value := range t.Keys {
+			if err := CheckKey(tenantCtx, bucket, value, t.Format(bucket)); err != nil {
+				return fmt.Errorf("tenant %v: %v", t.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckKey verifies that keyName can encrypt objects of bucket in the given envelope format.
+func CheckKey(ctx context.Context, bucket string, keyName string, format string) error {
+	switch format {
+	case util.EnvelopeFormatTink:
+		// a cached KEK would hide a key that no longer encrypts
+		_, err := crypto.EncryptBytes(crypto.WithoutKekCache(ctx), keyName, []byte("Hello, World!"))
+		return err
+	case util.EnvelopeFormatCsek:
+		if crypto.IsHybridKey(keyName) {
+			return fmt.Errorf("bucket %v: hybrid key %v only works with the tink envelope format", bucket, keyName)
+		}
+		_, err := crypto.DeriveCsekKey(ctx, keyName, bucket, "Hello, World!")
+		return err
+	default:
+		return fmt.Errorf("unknown envelope format %q for bucket %v", format, bucket)
+	}
+}
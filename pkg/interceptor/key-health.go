@@ -0,0 +1,157 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// what the proxy does with the requests of a bucket whose key failed its last check
+const (
+	KeyFailureServe         = "serve"          // call KMS anyway, the requests fail if the key is still unusable
+	KeyFailureRejectUploads = "reject-uploads" // answer uploads with 503, downloads may still decrypt
+	KeyFailureReject        = "reject"         // answer every encrypted request with 503
+)
+
+// errKeyUnhealthy rejects the requests of a bucket whose key failed its last check
+var errKeyUnhealthy = errors.New("the bucket's KMS key failed its last check")
+
+// KeyStatus is the result of the last check of a bucket's key.
+type KeyStatus struct {
+	Tenant    string    `json:"tenant,omitempty"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+type keyCheck struct {
+	tenant string // "" for the proxy's own mapping
+	bucket string
+}
+
+var (
+	keyStatusMu sync.RWMutex
+	keyStatuses = map[keyCheck]KeyStatus{}
+)
+
+// KeyStatuses returns the last check of every mapped key, by tenant and bucket.
+func KeyStatuses() []KeyStatus {
+	keyStatusMu.RLock()
+	statuses := make([]KeyStatus, 0, len(keyStatuses))
+	for _, status := range keyStatuses {
+		statuses = append(statuses, status)
+	}
+	keyStatusMu.RUnlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Tenant != statuses[j].Tenant {
+			return statuses[i].Tenant < statuses[j].Tenant
+		}
+		return statuses[i].Bucket < statuses[j].Bucket
+	})
+	return statuses
+}
+
+// WatchKeys checks every key mapped by the proxy and by the tenants of registry, which may be
+// nil, every interval until ctx is done. Buckets onboarded at runtime are checked from the next
+// round on.
+func WatchKeys(ctx context.Context, interval time.Duration, registry *tenant.Registry) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		CheckKeys(ctx, registry)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CheckKeys checks every mapped key once and records the results.
+func CheckKeys(ctx context.Context, registry *tenant.Registry) {
+	checked := map[keyCheck]KeyStatus{}
+	keyMap := util.KeyMap()
+	for bucket, key := range keyMap.Keys {
+		checked[keyCheck{bucket: bucket}] = checkKeyStatus(ctx, "", bucket, key, keyMap.Format(bucket))
+	}
+	if registry != nil {
+		for _, t := range registry.Tenants() {
+			tenantCtx := crypto.WithKmsCredentials(ctx, t.KmsCredentialsFile)
+			for bucket, key := range t.Keys {
+				checked[keyCheck{tenant: t.Name, bucket: bucket}] = checkKeyStatus(tenantCtx, t.Name, bucket, key, t.Format(bucket))
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	keyStatusMu.Lock()
+	previous := keyStatuses
+	keyStatuses = checked
+	keyStatusMu.Unlock()
+	for check, status := range checked {
+		if was, ok := previous[check]; ok && was.Healthy && !status.Healthy {
+			log.WithField("bucket", status.Bucket).Errorf("KMS key %v of bucket %v failed its check, applying -key_failure_policy=%v: %v",
+				status.Key, status.Bucket, cfg.Current().KeyFailurePolicy, status.Error)
+		} else if ok && !was.Healthy && status.Healthy {
+			log.WithField("bucket", status.Bucket).Infof("KMS key %v of bucket %v is usable again", status.Key, status.Bucket)
+		}
+	}
+}
+
+func checkKeyStatus(ctx context.Context, tenantName string, bucket string, key string, format string) KeyStatus {
+	status := KeyStatus{Tenant: tenantName, Bucket: bucket, Key: key, Healthy: true}
+	if err := CheckKey(ctx, bucket, key, format); err != nil {
+		status.Healthy, status.Error = false, err.Error()
+		if tenantName != "" {
+			log.Warnf("tenant %v: KMS key %v of bucket %v is not usable: %v", tenantName, key, bucket, err)
+		} else {
+			log.Warnf("KMS key %v of bucket %v is not usable: %v", key, bucket, err)
+		}
+	}
+	status.CheckedAt = time.Now()
+	return status
+}
+
+// keyFailure returns errKeyUnhealthy when the key failure policy rejects f, a request m of a
+// bucket whose key failed its last check
+func keyFailure(f *proxy.Flow, m gcsMethod) error {
+	policy := cfg.For(f).KeyFailurePolicy
+	if policy == "" || policy == KeyFailureServe || m == passThru {
+		return nil
+	}
+	upload := m == multiPartUpload || m == singlePartUpload || m == resumableUploadPost || m == resumableUploadPut ||
+		m == xmlMultipartInitiate || m == xmlMultipartPart || m == xmlMultipartComplete || m == backendUpload
+	if policy == KeyFailureRejectUploads && !upload {
+		return nil
+	}
+	check := keyCheck{bucket: requestBucket(f)}
+	if t := tenant.Of(f); t != nil {
+		check.tenant = t.Name
+	}
+	keyStatusMu.RLock()
+	status, ok := keyStatuses[check]
+	keyStatusMu.RUnlock()
+	if !ok || status.Healthy {
+		return nil
+	}
+	return fmt.Errorf("%w at %v, %v: %v", errKeyUnhealthy, status.CheckedAt.Format(time.RFC3339), status.Key, status.Error)
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/backend"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Requests counts the GCS requests by action (encrypt, decrypt, rewrite, csek, skip, plaintext, buffer,
+// refused, passthrough or disabled), result (ok or error) and whether they upload an object, set up
+// by the binary when metrics are exported. passthrough uploads are objects written in plaintext to
+// unmapped buckets, plaintext ones were left unencrypted by the content type or size rules, refused
+// requests are downloads of a write-only proxy or were rejected by the key failure policy. client
+// is the client family, see clientFamily.
+var Requests metric.Int64Counter
+
+func countRequest(f *proxy.Flow, action string, err error) {
+	if _, ok := backend.Of(f); Requests == nil || (!util.IsGcsHost(f.Request.URL.Host) && !ok) {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	upload := (f.Request.Method == http.MethodPost || f.Request.Method == http.MethodPut) &&
+		strings.HasPrefix(f.Request.URL.Path, "/upload/")
+	Requests.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("action", action),
+		attribute.String("result", result),
+		attribute.Bool("upload", upload),
+		attribute.String("client", clientFamily(f))))
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsrewrite"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// PlaintextBytes and CiphertextBytes count the bytes of the objects the proxy encrypted by
+// bucket, the plaintext the clients uploaded and the envelopes GCS stores. Set up by the binary
+// when metrics are exported.
+var (
+	PlaintextBytes  metric.Int64Counter
+	CiphertextBytes metric.Int64Counter
+)
+
+// Overhead is what encryption added to the objects the proxy uploaded to a bucket since it started:
+// the envelope header, the wrapped data encryption key and the AEAD nonces and tags.
+type Overhead struct {
+	Objects         int64 `json:"objects"`
+	PlaintextBytes  int64 `json:"plaintextBytes"`
+	CiphertextBytes int64 `json:"ciphertextBytes"`
+}
+
+// Bytes returns the bytes stored on top of the plaintext.
+func (o Overhead) Bytes() int64 {
+	return o.CiphertextBytes - o.PlaintextBytes
+}
+
+// Ratio returns the overhead as a share of the plaintext, 0 without plaintext.
+func (o Overhead) Ratio() float64 {
+	if o.PlaintextBytes == 0 {
+		return 0
+	}
+	return float64(o.Bytes()) / float64(o.PlaintextBytes)
+}
+
+var (
+	overheadMu sync.Mutex
+	overheads  = map[string]*Overhead{} // bucket ->
+)
+
+// Overheads returns the overhead of every bucket the proxy encrypted uploads to.
+func Overheads() map[string]Overhead {
+	overheadMu.Lock()
+	defer overheadMu.Unlock()
+	totals := make(map[string]Overhead, len(overheads))
+	for bucket, o := range overheads {
+		totals[bucket] = *o
+	}
+	return totals
+}
+
+// recordOverhead accounts an upload GCS accepted, if the proxy encrypted it
+func recordOverhead(f *proxy.Flow) {
+	ciphertextSize, err := strconv.ParseInt(f.Request.Header.Get(hdl.CiphertextSizeHeader), 10, 64)
+	if err != nil {
+		return
+	}
+	plaintextSize, err := strconv.ParseInt(f.Request.Header.Get("gcs-proxy-unencrypted-file-size"), 10, 64)
+	if err != nil {
+		return
+	}
+	bucket := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+
+	overheadMu.Lock()
+	o := overheads[bucket]
+	if o == nil {
+		o = &Overhead{}
+		overheads[bucket] = o
+	}
+	o.Objects++
+	o.PlaintextBytes += plaintextSize
+	o.CiphertextBytes += ciphertextSize
+	overheadMu.Unlock()
+
+	if PlaintextBytes == nil || CiphertextBytes == nil {
+		return
+	}
+	attributes := metric.WithAttributes(attribute.String("bucket", bucket))
+	PlaintextBytes.Add(context.Background(), plaintextSize, attributes)
+	CiphertextBytes.Add(context.Background(), ciphertextSize, attributes)
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package interceptor
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// framingHeaders describe the body the client reads, rules never change them
+var framingHeaders = []string{"Content-Length", "Content-Range", "Content-Encoding", "Transfer-Encoding"}
+
+/*
+setResponseHeaders applies the response header rules of bucketName to the decrypted download f,
+so that the proxy decides how clients and the caches between them keep the plaintext, whatever
+the Cache-Control and Content-Disposition metadata of the object say:
+
+	Cache-Control=no-store     replaces the header GCS sent, rules of the same name add values
+	-X-Goog-Meta-Owner         strips a header
+	-X-Goog-Meta-*             strips every header with the prefix
+
+The HEAD of an encrypted object gets them too. Downloads of objects stored in plaintext are
+answered as GCS sent them.
+*/
+func setResponseHeaders(f *proxy.Flow, bucketName string) {
+	rules := util.KeyMapFor(f).ResponseHeaderRules(bucketName)
+	set := make(map[string]bool)
+	for _, rule := range rules {
+		name, value, isSet := strings.Cut(rule, "=")
+		name = strings.TrimSpace(name)
+		stripped, isStrip := strings.CutPrefix(name, "-")
+		switch {
+		case name == "" || isSet == isStrip:
+			log.Warnf("ignoring invalid response header rule %q of bucket %v", rule, bucketName)
+		case slices.Contains(framingHeaders, http.CanonicalHeaderKey(strings.TrimSuffix(stripped, "*"))):
+			log.Warnf("ignoring response header rule %q of bucket %v, the proxy sets %v", rule, bucketName, stripped)
+		case isSet:
+			if !set[http.CanonicalHeaderKey(name)] {
+				f.Response.Header.Del(name)
+				set[http.CanonicalHeaderKey(name)] = true
+			}
+			f.Response.Header.Add(name, strings.TrimSpace(value))
+		case strings.HasSuffix(stripped, "*"):
+			prefix := strings.ToLower(strings.TrimSuffix(stripped, "*"))
+			for key := range f.Response.Header {
+				if strings.HasPrefix(strings.ToLower(key), prefix) && !slices.Contains(framingHeaders, http.CanonicalHeaderKey(key)) {
+					delete(f.Response.Header, key)
+				}
+			}
+		default:
+			f.Response.Header.Del(stripped)
+		}
+	}
+	if len(rules) > 0 {
+		log.Debugf("applied %v response header rules of bucket %v to %v", len(rules), bucketName, f.Request.URL.Path)
+	}
+}
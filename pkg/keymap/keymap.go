@@ -0,0 +1,314 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package keymap resolves which Cloud KMS key and envelope format apply to a GCS bucket.
+
+	km := keymap.KeyMap{
+		Keys: map[string]string{
+			"my-bucket": "projects/p/locations/global/keyRings/r/cryptoKeys/k",
+		},
+	}
+	keyName := km.Key("my-bucket")
+
+Buckets without a key are not encrypted. The bucket "*" applies to every bucket.
+
+Content type rules encrypt only some uploads of a mapped bucket, e.g. leave its videos in
+plaintext or only encrypt its JSON and text objects:
+
+	km.SkipContentTypes = map[string][]string{"my-bucket": {"video/*"}}
+	km.EncryptContentTypes = map[string][]string{"*": {"application/json", "text/*"}}
+
+Size thresholds do the same by object size, e.g. skip tiny marker files:
+
+	km.MinSizes = map[string]int64{"my-bucket": 1}
+
+Decrypt clients restrict which clients may read a bucket or prefix in plaintext:
+
+	km.DecryptClients = map[string][]string{"my-bucket/reports/": {"10.8.0.0/16", "tenant:analytics"}}
+
+Override clients may change the encryption of their own requests to a bucket, e.g. a migration job
+that writes with the new key of a rotation:
+
+	km.OverrideClients = map[string][]string{"my-bucket": {"migrate@p.iam.gserviceaccount.com"}}
+	migration, err := km.WithKey("my-bucket", "projects/p/locations/global/keyRings/r/cryptoKeys/new")
+
+Response headers are set on or stripped from the downloads the proxy decrypts, e.g. to keep caches
+from storing them:
+
+	km.ResponseHeaders = map[string][]string{"*": {"Cache-Control=no-store", "-X-Goog-Meta-*"}}
+*/
+package keymap
+
+import (
+	"fmt"
+	"mime"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	FormatTink = "tink" // the proxy encrypts the payload, see pkg/envelope
+	FormatCsek = "csek" // GCS encrypts the payload with a customer-supplied key, see crypto/csek.go
+
+	AllBuckets = "*"
+
+	// the chunk sizes ChunkSize accepts
+	MinChunkSize = 1 << 10
+	MaxChunkSize = 1 << 30
+)
+
+type KeyMap struct {
+	Keys         map[string]string   `json:"keys,omitempty"`         // bucket to KMS key name
+	FallbackKeys map[string][]string `json:"fallbackKeys,omitempty"` // extra keys tried when an object does not decrypt with its recorded or mapped key
+	Formats      map[string]string   `json:"formats,omitempty"`      // bucket to envelope format, FormatTink when unset
+
+	// content types of the uploads to encrypt, text/* matches every text type. uploads of other
+	// types are stored in plaintext. all uploads are encrypted when a bucket has no rule.
+	EncryptContentTypes map[string][]string `json:"encryptContentTypes,omitempty"` // bucket to the only content types encrypted
+	SkipContentTypes    map[string][]string `json:"skipContentTypes,omitempty"`    // bucket to the content types never encrypted
+
+	// size thresholds of the uploads to encrypt in bytes, smaller and larger ones are stored in plaintext
+	MinSizes map[string]int64 `json:"minSizes,omitempty"` // bucket to the smallest upload encrypted
+	MaxSizes map[string]int64 `json:"maxSizes,omitempty"` // bucket to the largest upload encrypted, 0 is unlimited
+
+	// bucket to the plaintext size of the chunks its objects are encrypted in, see pkg/envelope.
+	// small chunks suit random reads, large ones archives. 0 or unset encrypts objects as one chunk.
+	ChunkSizes map[string]int64 `json:"chunkSizes,omitempty"`
+
+	// bucket or bucket/prefix to the only clients that may download decrypted objects: client
+	// addresses or CIDRs, account emails, tenant:NAME or * for every client
+	DecryptClients map[string][]string `json:"decryptClients,omitempty"`
+
+	// bucket to the only clients that may skip the encryption of their requests or encrypt them
+	// with another key of the bucket, same clients as DecryptClients
+	OverrideClients map[string][]string `json:"overrideClients,omitempty"`
+
+	// bucket to the header rules of its decrypted downloads, applied in order: NAME=VALUE sets a
+	// header, the rules of one name adding their values, -NAME strips it and -PREFIX* every header
+	// starting with PREFIX
+	ResponseHeaders map[string][]string `json:"responseHeaders,omitempty"`
+
+	// bucket to the bucket its encrypted uploads are copied to, encrypted with that bucket's own key
+	Mirrors map[string]string `json:"mirrors,omitempty"`
+
+	// the policy document the map was distributed in as source#version, recorded in the objects it
+	// encrypts. empty for the map of the local configuration.
+	Policy string `json:"-"`
+}
+
+// Key returns the KMS key objects of bucketName are encrypted with, "" when the bucket is
+// not encrypted. A global key takes precedence over the bucket's own mapping.
+func (m KeyMap) Key(bucketName string) string {
+	_, key := m.Mapping(bucketName)
+	return key
+}
+
+// Mapping returns the entry of Keys that applies to bucketName, AllBuckets or the bucket
+// itself, and its key. Both are "" when the bucket is not encrypted.
+func (m KeyMap) Mapping(bucketName string) (string, string) {
+	if m.Keys == nil {
+		log.Debug("No bucket mapping found")
+		return "", ""
+	}
+
+	if value, exists := m.Keys[AllBuckets]; exists {
+		log.Debugf("Global KMS Key entry exists with value: %v", value)
+		return AllBuckets, value
+	}
+	if value, exists := m.Keys[bucketName]; exists {
+		log.Debugf(" KMS Key entry exists with value: %v", value)
+		return bucketName, value
+	}
+	log.Debug("KMS key entry does not exist")
+	return "", ""
+}
+
+// Format returns how objects of bucketName are encrypted.
+func (m KeyMap) Format(bucketName string) string {
+	if format, ok := m.Formats[bucketName]; ok {
+		return format
+	}
+	if format, ok := m.Formats[AllBuckets]; ok {
+		return format
+	}
+	return FormatTink
+}
+
+// Mirror returns the bucket the encrypted uploads to bucketName are copied to, "" for none.
+func (m KeyMap) Mirror(bucketName string) string {
+	return m.Mirrors[bucketName]
+}
+
+// CandidateKeys lists the keys to try, in order, for an object of bucketName: the key
+// recorded on the object, the mapped key, then the bucket's and the global fallback keys.
+// Anyone with write access to a bucket can set the recorded key, it is only tried when it is
+// one of the others: a ciphertext copied from another bucket with its metadata must not decrypt
+// under the decrypt rules of this one.
+func (m KeyMap) CandidateKeys(recordedKey string, bucketName string) []string {
+	var candidates []string
+	seen := make(map[string]bool)
+	add := func(keys ...string) {
+		for _, key := range keys {
+			if key != "" && !seen[key] {
+				seen[key] = true
+				candidates = append(candidates, key)
+			}
+		}
+	}
+
+	add(m.Key(bucketName))
+	add(m.FallbackKeys[bucketName]...)
+	add(m.FallbackKeys[AllBuckets]...)
+	if recordedKey == "" || !seen[recordedKey] {
+		if recordedKey != "" {
+			log.Warnf("ignoring recorded key %v of an object of bucket %v, it is neither the mapped nor a fallback key of the bucket", recordedKey, bucketName)
+		}
+		return candidates
+	}
+	i := slices.Index(candidates, recordedKey)
+	return append([]string{recordedKey}, slices.Delete(candidates, i, i+1)...)
+}
+
+// ChunkSize returns the plaintext size of the chunks objects of bucketName are encrypted in, 0
+// for a single chunk. The bucket's own size takes precedence over the global one, sizes outside
+// MinChunkSize and MaxChunkSize are ignored.
+func (m KeyMap) ChunkSize(bucketName string) uint32 {
+	size, ok := m.ChunkSizes[bucketName]
+	if !ok {
+		size = m.ChunkSizes[AllBuckets]
+	}
+	if size != 0 && (size < MinChunkSize || size > MaxChunkSize) {
+		log.Warnf("ignoring chunk size %v of bucket %v, expected %v to %v bytes", size, bucketName, MinChunkSize, MaxChunkSize)
+		return 0
+	}
+	return uint32(size)
+}
+
+// EncryptsContentType reports whether uploads of contentType to bucketName are encrypted. The
+// bucket's own content type rules take precedence over the global ones, and skipped types
+// over encrypted ones. Uploads without a content type are application/octet-stream, as GCS
+// stores them.
+func (m KeyMap) EncryptsContentType(bucketName string, contentType string) bool {
+	encrypt, skip := m.EncryptContentTypes[bucketName], m.SkipContentTypes[bucketName]
+	if encrypt == nil && skip == nil {
+		encrypt, skip = m.EncryptContentTypes[AllBuckets], m.SkipContentTypes[AllBuckets]
+	}
+	if encrypt == nil && skip == nil {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(contentType)), ";")
+	}
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	if matchContentType(skip, mediaType) {
+		return false
+	}
+	return len(encrypt) == 0 || matchContentType(encrypt, mediaType)
+}
+
+// EncryptsSize reports whether an upload of size bytes to bucketName is encrypted.
+func (m KeyMap) EncryptsSize(bucketName string, size int64) bool {
+	minSize, maxSize := m.SizeThresholds(bucketName)
+	return size >= minSize && (maxSize <= 0 || size <= maxSize)
+}
+
+// SizeThresholds returns the smallest and largest uploads to bucketName that are encrypted,
+// maxSize is 0 when unlimited. The bucket's own thresholds take precedence over the global ones.
+func (m KeyMap) SizeThresholds(bucketName string) (minSize int64, maxSize int64) {
+	minSize, ok := m.MinSizes[bucketName]
+	if !ok {
+		minSize = m.MinSizes[AllBuckets]
+	}
+	maxSize, ok = m.MaxSizes[bucketName]
+	if !ok {
+		maxSize = m.MaxSizes[AllBuckets]
+	}
+	return minSize, maxSize
+}
+
+// AllowedDecryptClients returns the clients that may download objectName of bucketName
+// decrypted, from the longest bucket/prefix entry of DecryptClients that matches, bucket/prefix*
+// the same as bucket/prefix, or else the AllBuckets one. ok is false when no entry applies, every client may then.
+func (m KeyMap) AllowedDecryptClients(bucketName string, objectName string) (clients []string, ok bool) {
+	path := bucketName + "/" + objectName
+	longest := -1
+	for entry, entryClients := range m.DecryptClients {
+		// names are compared byte for byte, a trailing * is the prefix before it like for gcloud
+		prefix := strings.TrimSuffix(entry, "*")
+		matches := entry == bucketName || (strings.HasPrefix(prefix, bucketName+"/") && strings.HasPrefix(path, prefix))
+		if matches && len(prefix) > longest {
+			clients, longest = entryClients, len(prefix)
+		}
+	}
+	if longest < 0 {
+		clients, ok = m.DecryptClients[AllBuckets]
+		return clients, ok
+	}
+	return clients, true
+}
+
+// AllowedOverrideClients returns the clients that may override the encryption of their requests
+// to bucketName, from its OverrideClients entry or else the AllBuckets one. None may when no entry
+// applies.
+func (m KeyMap) AllowedOverrideClients(bucketName string) []string {
+	if clients, ok := m.OverrideClients[bucketName]; ok {
+		return clients
+	}
+	return m.OverrideClients[AllBuckets]
+}
+
+// ResponseHeaderRules returns the header rules of the decrypted downloads of bucketName, from its
+// ResponseHeaders entry or else the AllBuckets one.
+func (m KeyMap) ResponseHeaderRules(bucketName string) []string {
+	if rules, ok := m.ResponseHeaders[bucketName]; ok {
+		return rules
+	}
+	return m.ResponseHeaders[AllBuckets]
+}
+
+// WithoutEncryption returns a copy of m that encrypts and decrypts no bucket.
+func (m KeyMap) WithoutEncryption() KeyMap {
+	c := m.clone()
+	c.Keys = nil
+	return c
+}
+
+// WithKey returns a copy of m that encrypts bucketName with keyName instead of its mapped key.
+// keyName must be one of the bucket's candidate keys, so that its objects still decrypt.
+func (m KeyMap) WithKey(bucketName string, keyName string) (KeyMap, error) {
+	entry, mappedKey := m.Mapping(bucketName)
+	if mappedKey == "" {
+		return m, fmt.Errorf("bucket %v is not encrypted", bucketName)
+	}
+	if !slices.Contains(m.CandidateKeys("", bucketName), keyName) {
+		return m, fmt.Errorf("%v is neither the mapped nor a fallback key of bucket %v", keyName, bucketName)
+	}
+	c := m.clone()
+	c.Keys[entry] = keyName
+	return c, nil
+}
+
+// matchContentType reports whether mediaType matches one of patterns: a media type, type/*
+// or *.
+func matchContentType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*" || pattern == "*/*" || pattern == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
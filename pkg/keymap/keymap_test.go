@@ -0,0 +1,42 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package keymap
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCandidateKeys(t *testing.T) {
+	m := KeyMap{
+		Keys: map[string]string{"a": "key-a", "b": "key-b"},
+		FallbackKeys: map[string][]string{
+			"a": {"old-a", "older-a"},
+			"*": {"global"},
+		},
+	}
+	tests := []struct {
+		name        string
+		recordedKey string
+		bucketName  string
+		want        []string
+	}{
+		{"no recorded key", "", "a", []string{"key-a", "old-a", "older-a", "global"}},
+		{"mapped key", "key-a", "a", []string{"key-a", "old-a", "older-a", "global"}},
+		{"fallback key first", "older-a", "a", []string{"older-a", "key-a", "old-a", "global"}},
+		{"global fallback key first", "global", "b", []string{"global", "key-b"}},
+		{"key of another bucket", "key-b", "a", []string{"key-a", "old-a", "older-a", "global"}},
+		{"unknown key", "projects/p/locations/global/keyRings/r/cryptoKeys/evil", "a", []string{"key-a", "old-a", "older-a", "global"}},
+		{"unmapped bucket", "key-a", "c", []string{"global"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := m.CandidateKeys(test.recordedKey, test.bucketName); !slices.Equal(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package keymap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// Store holds the KeyMap in use. Requests keep reading the map they loaded while buckets are
+// onboarded or removed, writers replace the whole map.
+type Store struct {
+	current atomic.Pointer[KeyMap]
+	mu      sync.Mutex // serializes writers
+}
+
+// Load returns the current KeyMap, false when none was set.
+func (s *Store) Load() (KeyMap, bool) {
+	m := s.current.Load()
+	if m == nil {
+		return KeyMap{}, false
+	}
+	return *m, true
+}
+
+func (s *Store) Set(m KeyMap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current.Store(&m)
+}
+
+// SetBucket maps bucketName to keyName, with format when it is not empty.
+func (s *Store) SetBucket(bucketName string, keyName string, format string) KeyMap {
+	return s.update(func(m *KeyMap) {
+		m.Keys[bucketName] = keyName
+		if format != "" {
+			m.Formats[bucketName] = format
+		}
+	})
+}
+
+// DeleteBucket removes the key and format of bucketName. Objects of the bucket are no longer
+// encrypted or decrypted. Its fallback keys are kept.
+func (s *Store) DeleteBucket(bucketName string) KeyMap {
+	return s.update(func(m *KeyMap) {
+		delete(m.Keys, bucketName)
+		delete(m.Formats, bucketName)
+	})
+}
+
+func (s *Store) update(change func(m *KeyMap)) KeyMap {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var m KeyMap
+	if current := s.current.Load(); current != nil {
+		m = current.clone()
+	}
+	if m.Keys == nil {
+		m.Keys = map[string]string{}
+	}
+	if m.Formats == nil {
+		m.Formats = map[string]string{}
+	}
+	change(&m)
+	m.Policy = "" // changed locally, no longer the distributed policy
+	s.current.Store(&m)
+	return m
+}
+
+// MergeFile overlays the buckets saved in path by SaveFile on the current KeyMap. A missing
+// file is not an error.
+func (s *Store) MergeFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading key mappings file: %v", err)
+	}
+	var saved KeyMap
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("error unmarshalling key mappings file %v: %v", path, err)
+	}
+	s.update(func(m *KeyMap) {
+		maps.Copy(m.Keys, saved.Keys)
+		maps.Copy(m.Formats, saved.Formats)
+	})
+	return nil
+}
+
+// SaveFile writes the keys and formats of the current KeyMap to path.
+func (s *Store) SaveFile(path string) error {
+	m, _ := s.Load()
+	data, err := json.MarshalIndent(KeyMap{Keys: m.Keys, Formats: m.Formats}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling key mappings: %v", err)
+	}
+
+	// write a temp file and rename it so a crash never leaves a truncated file behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating key mappings file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing key mappings file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing key mappings file: %v", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (m KeyMap) clone() KeyMap {
+	return KeyMap{
+		Keys:                maps.Clone(m.Keys),
+		FallbackKeys:        cloneLists(m.FallbackKeys),
+		Formats:             maps.Clone(m.Formats),
+		EncryptContentTypes: cloneLists(m.EncryptContentTypes),
+		SkipContentTypes:    cloneLists(m.SkipContentTypes),
+		MinSizes:            maps.Clone(m.MinSizes),
+		MaxSizes:            maps.Clone(m.MaxSizes),
+		ChunkSizes:          maps.Clone(m.ChunkSizes),
+		DecryptClients:      cloneLists(m.DecryptClients),
+		OverrideClients:     cloneLists(m.OverrideClients),
+		ResponseHeaders:     cloneLists(m.ResponseHeaders),
+		Mirrors:             maps.Clone(m.Mirrors),
+		Policy:              m.Policy,
+	}
+}
+
+func cloneLists(lists map[string][]string) map[string][]string {
+	if lists == nil {
+		return nil
+	}
+	cloned := make(map[string][]string, len(lists))
+	for bucket, list := range lists {
+		cloned[bucket] = append([]string(nil), list...)
+	}
+	return cloned
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package kmsquota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// LeaseTTL is how long leased tokens can be spent
+const LeaseTTL = time.Second
+
+// a replica that can't reach the server uses its share of the quota this long before it tries again
+const fallbackInterval = 10 * time.Second
+
+// Client leases the tokens of the KMS requests of a replica from a Server
+type Client struct {
+	url      string
+	token    string
+	batch    int // tokens leased at once
+	fallback *rate.Limiter
+	http     *http.Client
+
+	mu            sync.Mutex
+	tokens        int
+	expires       time.Time
+	fallbackUntil time.Time
+}
+
+// NewClient returns the client of the server at serverURL of a quota of qps KMS requests per second
+// shared by replicas proxies
+func NewClient(serverURL string, token string, qps float64, replicas int) *Client {
+	share := qps / float64(max(replicas, 1))
+	return &Client{
+		url:   strings.TrimSuffix(serverURL, "/"),
+		token: token,
+		// what the replica spends of its share in a tenth of a second
+		batch:    min(max(int(share/10), 1), maxLease),
+		fallback: rate.NewLimiter(rate.Limit(share), burst(share)),
+		http:     &http.Client{Timeout: 2 * time.Second},
+	}
+}
+
+func (c *Client) Wait(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.tokens > 0 && now.Before(c.expires) {
+		c.tokens--
+		return nil
+	}
+	if now.Before(c.fallbackUntil) {
+		return c.fallback.Wait(ctx)
+	}
+
+	lease, err := c.lease(ctx)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		log.Warnf("KMS quota server unreachable, limiting this replica to its share of the quota for %v: %v", fallbackInterval, err)
+		c.fallbackUntil = now.Add(fallbackInterval)
+		return c.fallback.Wait(ctx)
+	}
+	if lease.WaitMs > 0 {
+		timer := time.NewTimer(time.Duration(lease.WaitMs) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	c.tokens = lease.Granted - 1
+	c.expires = time.Now().Add(LeaseTTL)
+	return nil
+}
+
+func (c *Client) lease(ctx context.Context) (*LeaseResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%v/v1/lease?n=%d", c.url, c.batch), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lease answered %v", resp.Status)
+	}
+	var lease LeaseResponse
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return nil, fmt.Errorf("invalid lease: %v", err)
+	}
+	if lease.Granted < 1 {
+		return nil, fmt.Errorf("lease of %v tokens", lease.Granted)
+	}
+	return &lease, nil
+}
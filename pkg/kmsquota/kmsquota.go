@@ -0,0 +1,40 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package kmsquota keeps the KMS requests of a proxy cluster under the QPS quota the replicas share.
+
+One Server, run by go-gcsproxy kms-quota-server, holds the token bucket of the whole cluster. Every
+replica's Client leases tokens from it in small batches, one per KMS request, so the aggregate rate
+stays below the limit however many replicas run. Leased tokens expire after LeaseTTL, a replica
+that went idle can't spend a batch later in a burst. When the server can't be reached the
+replicas fall back to a share of the limit each, Replicas tells their number.
+
+	limiter := kmsquota.NewClient("http://kms-quota:9085", token, 100, 4)
+	err := limiter.Wait(ctx) // before each KMS request
+*/
+package kmsquota
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiter blocks until a KMS request may be sent, or ctx is done
+type Limiter interface {
+	Wait(ctx context.Context) error
+}
+
+// NewLocal returns the limiter of a single process sending qps KMS requests per second at most
+func NewLocal(qps float64) Limiter {
+	return rate.NewLimiter(rate.Limit(qps), burst(qps))
+}
+
+// a second of requests, at least one
+func burst(qps float64) int {
+	return max(int(qps), 1)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package kmsquota
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxLease is the most tokens a client gets at once
+const maxLease = 1000
+
+// LeaseResponse answers POST /v1/lease?n=N
+type LeaseResponse struct {
+	Granted int   `json:"granted"`          // tokens the client may spend within LeaseTTL
+	WaitMs  int64 `json:"waitMs,omitempty"` // before spending them, when the bucket was empty
+}
+
+// Server hands out the tokens of the cluster's KMS quota
+type Server struct {
+	limiter *rate.Limiter
+	token   string
+}
+
+// NewServer returns the server of a quota of qps KMS requests per second, clients present token
+// as a bearer token unless it is empty
+func NewServer(qps float64, token string) *Server {
+	return &Server{limiter: rate.NewLimiter(rate.Limit(qps), burst(qps)), token: token}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/healthz" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.URL.Path != "/v1/lease" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n < 1 || n > maxLease {
+		http.Error(w, "n must be between 1 and "+strconv.Itoa(maxLease), http.StatusBadRequest)
+		return
+	}
+
+	response := s.lease(n)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// lease takes up to n of the tokens available now, or reserves the next one
+func (s *Server) lease(n int) LeaseResponse {
+	now := time.Now()
+	granted := 0
+	for granted < n && s.limiter.AllowN(now, 1) {
+		granted++
+	}
+	if granted > 0 {
+		return LeaseResponse{Granted: granted}
+	}
+	reservation := s.limiter.ReserveN(now, 1)
+	return LeaseResponse{Granted: 1, WaitMs: (reservation.DelayFrom(now) + time.Millisecond - 1).Milliseconds()}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package latency breaks the time of a flow down by where it went: reading the client request, the
+KMS calls, GCS and the proxy encrypting or decrypting.
+
+The proxy addons mark when the request was read and the response arrived, the handlers add the
+time they spent with AddProxy and the KMS calls theirs with AddKms, see crypto.WithKmsTimer.
+*/
+package latency
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+var flows sync.Map // flow id -> *Budget
+
+// Budget collects where the time of one flow went, the marks are the time since Start
+type Budget struct {
+	Start time.Time
+
+	requestRead     atomic.Int64 // the client request body was read
+	responseArrived atomic.Int64 // GCS answered with the response headers
+	responseRead    atomic.Int64 // the response body was read
+	requestProxy    atomic.Int64 // proxy time when the response arrived, spent before sending the request
+	proxy           atomic.Int64 // in the handlers, KMS included
+	kms             atomic.Int64
+}
+
+// Track starts the budget of f now
+func Track(f *proxy.Flow) *Budget {
+	b := &Budget{Start: time.Now()}
+	flows.Store(f.Id, b)
+	return b
+}
+
+// Of returns the budget of f, nil when it is not tracked
+func Of(f *proxy.Flow) *Budget {
+	b, ok := flows.Load(f.Id)
+	if !ok {
+		return nil
+	}
+	return b.(*Budget)
+}
+
+// Forget drops the budget of a finished flow
+func Forget(f *proxy.Flow) {
+	flows.Delete(f.Id)
+}
+
+// AddProxy adds time the proxy spent on f in its handlers
+func AddProxy(f *proxy.Flow, d time.Duration) {
+	if b := Of(f); b != nil {
+		b.proxy.Add(int64(d))
+	}
+}
+
+// AddKms adds the time of a KMS call, calls may run at once
+func (b *Budget) AddKms(d time.Duration) {
+	b.kms.Add(int64(d))
+}
+
+// RequestRead marks the client request body read
+func (b *Budget) RequestRead() {
+	b.requestRead.Store(int64(time.Since(b.Start)))
+}
+
+// ResponseArrived marks the response headers received from GCS
+func (b *Budget) ResponseArrived() {
+	b.responseArrived.Store(int64(time.Since(b.Start)))
+	b.requestProxy.Store(b.proxy.Load())
+}
+
+// ResponseRead marks the response body received from GCS
+func (b *Budget) ResponseRead() {
+	b.responseRead.Store(int64(time.Since(b.Start)))
+}
+
+// Breakdown is where the time of a flow went so far
+type Breakdown struct {
+	Total      time.Duration
+	ClientRead time.Duration // reading the request from the client
+	Kms        time.Duration
+	Upstream   time.Duration // from sending the request to GCS to reading its response
+	Proxy      time.Duration // encrypting, decrypting and rewriting, KMS excluded
+	Other      time.Duration // the rest, e.g. writing the response to the client
+}
+
+// Breakdown returns where the time of the flow went until now
+func (b *Budget) Breakdown() Breakdown {
+	d := Breakdown{
+		Total:      time.Since(b.Start),
+		ClientRead: time.Duration(b.requestRead.Load()),
+		Kms:        time.Duration(b.kms.Load()),
+	}
+	d.Proxy = max(time.Duration(b.proxy.Load())-d.Kms, 0)
+	if arrived := time.Duration(b.responseArrived.Load()); arrived > 0 && d.ClientRead > 0 {
+		if read := time.Duration(b.responseRead.Load()); read > arrived {
+			arrived = read
+		}
+		d.Upstream = max(arrived-d.ClientRead-time.Duration(b.requestProxy.Load()), 0)
+	}
+	d.Other = max(d.Total-d.ClientRead-d.Kms-d.Upstream-d.Proxy, 0)
+	return d
+}
+
+// ServerTiming returns d as the value of a Server-Timing header, in milliseconds
+func (d Breakdown) ServerTiming() string {
+	metrics := []struct {
+		name string
+		dur  time.Duration
+	}{
+		{"client", d.ClientRead}, {"kms", d.Kms}, {"upstream", d.Upstream}, {"proxy", d.Proxy}, {"total", d.Total},
+	}
+	timings := make([]string, len(metrics))
+	for i, m := range metrics {
+		timings[i] = fmt.Sprintf("%s;dur=%.1f", m.name, milliseconds(m.dur))
+	}
+	return strings.Join(timings, ", ")
+}
+
+// Fields returns d as log fields, in milliseconds
+func (d Breakdown) Fields() map[string]interface{} {
+	return map[string]interface{}{
+		"total_ms":       milliseconds(d.Total),
+		"client_read_ms": milliseconds(d.ClientRead),
+		"kms_ms":         milliseconds(d.Kms),
+		"upstream_ms":    milliseconds(d.Upstream),
+		"proxy_ms":       milliseconds(d.Proxy),
+		"other_ms":       milliseconds(d.Other),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
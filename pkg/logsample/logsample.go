@@ -0,0 +1,121 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package logsample samples and rate limits log entries by category, so debug logging of busy
+proxies and bursts of identical errors don't flood the log pipeline.
+
+	log.SetFormatter(logsample.NewFormatter(&log.TextFormatter{},
+		map[string]float64{"debug": 0.01},  // keep 1% of the debug entries
+		map[string]float64{"decrypt": 10})) // and at most 10 decrypt errors per second
+
+The category of an entry is its "category" field, or its level (debug, info, warning, error)
+when it has none. Dropped entries are counted and a summary is logged every SummaryInterval.
+Fatal and panic entries are always kept.
+*/
+package logsample
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// CategoryField is the entry field naming the category, log.WithField(logsample.CategoryField, "decrypt")
+const CategoryField = "category"
+
+// SummaryInterval is how often the counts of the dropped entries are logged
+const SummaryInterval = 10 * time.Second
+
+// the summaries are never dropped
+const summaryCategory = "logsample"
+
+// Formatter drops the sampled out and rate limited entries and formats the others with Next.
+type Formatter struct {
+	Next log.Formatter
+
+	sampleRates map[string]float64 // share of the entries kept, 0 to 1
+	limits      map[string]float64 // entries per second
+
+	mu         sync.Mutex
+	limiters   map[string]*rate.Limiter
+	suppressed map[string]int
+}
+
+// NewFormatter returns a Formatter keeping sampleRates of the entries of each category and at
+// most limits entries per second, categories missing from both are kept.
+func NewFormatter(next log.Formatter, sampleRates map[string]float64, limits map[string]float64) *Formatter {
+	f := &Formatter{
+		Next:        next,
+		sampleRates: sampleRates,
+		limits:      limits,
+		limiters:    map[string]*rate.Limiter{},
+		suppressed:  map[string]int{},
+	}
+	for category, limit := range limits {
+		// allow a burst of one second of entries
+		f.limiters[category] = rate.NewLimiter(rate.Limit(limit), max(int(limit), 1))
+	}
+	go func() {
+		for range time.Tick(SummaryInterval) {
+			f.logSummary()
+		}
+	}()
+	return f
+}
+
+// Format returns no bytes for a dropped entry, logrus then writes nothing.
+func (f *Formatter) Format(entry *log.Entry) ([]byte, error) {
+	if entry.Level <= log.FatalLevel || f.keep(category(entry)) {
+		return f.Next.Format(entry)
+	}
+	return nil, nil
+}
+
+func category(entry *log.Entry) string {
+	if c, ok := entry.Data[CategoryField].(string); ok && c != "" {
+		return c
+	}
+	return entry.Level.String()
+}
+
+func (f *Formatter) keep(category string) bool {
+	if category == summaryCategory {
+		return true
+	}
+	sampleRate, sampled := f.sampleRates[category]
+	keep := !sampled || rand.Float64() < sampleRate
+	if limiter := f.limiters[category]; keep && limiter != nil {
+		keep = limiter.Allow()
+	}
+	if !keep {
+		f.mu.Lock()
+		f.suppressed[category]++
+		f.mu.Unlock()
+	}
+	return keep
+}
+
+func (f *Formatter) logSummary() {
+	f.mu.Lock()
+	suppressed := f.suppressed
+	f.suppressed = map[string]int{}
+	f.mu.Unlock()
+
+	categories := make([]string, 0, len(suppressed))
+	for category := range suppressed {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		log.WithField(CategoryField, summaryCategory).Infof("suppressed %v %v log entries in the last %v",
+			suppressed[category], category, SummaryInterval)
+	}
+}
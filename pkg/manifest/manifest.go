@@ -0,0 +1,335 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package manifest writes signed integrity manifests of the uploads the proxy encrypted. The AEAD tag
+of an object proves that its ciphertext was not modified, not that the object is the one that was
+uploaded, still exists or was not replaced by another object encrypted with the same key. With
+-manifest_signing_key the proxy collects the name, generation, plaintext hashes and key version of
+every encrypted upload GCS accepted, by bucket and prefix (the object name up to its last /), and
+writes them as a manifest object next to the objects
+
+	gs://bucket/logs/2025/.gcsproxy-manifest/20250101T120000Z-3f2a9c1e.json
+
+every -manifest_interval, or earlier once a batch holds -manifest_max_objects objects. The
+manifest is signed with the KMS asymmetric signing key version, its signature and the key version
+are in its metadata, and it names the previous manifest of its prefix written by the same process
+with its SHA-256, so a removed manifest breaks the chain. go-gcsproxy verify-manifest checks a
+manifest and the objects it lists.
+
+Manifests are written with the proxy's own credentials, they need roles/storage.objectCreator in
+the buckets. The media and multipart uploads of the JSON API are listed, like the overhead
+accounting resumable, XML and csek uploads are not.
+*/
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsrewrite"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/logsample"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Version is the format version of the manifests
+const Version = 1
+
+// Folder holds the manifests of a prefix
+const Folder = ".gcsproxy-manifest/"
+
+// Written counts the manifests by bucket and result, ok or error. Set up by the binary when
+// metrics are exported.
+var Written metric.Int64Counter
+
+// Manifest lists the objects of one batch
+type Manifest struct {
+	Version  int       `json:"version"`
+	Bucket   string    `json:"bucket"`
+	Prefix   string    `json:"prefix"`
+	Created  time.Time `json:"created"`
+	Previous *Link     `json:"previous,omitempty"` // the manifest of the prefix written before by the same process
+	Objects  []Entry   `json:"objects"`
+}
+
+// Link names another manifest
+type Link struct {
+	Name   string `json:"name"`
+	Sha256 string `json:"sha256"` // hex of the signed manifest bytes
+}
+
+// Entry is one encrypted upload
+type Entry struct {
+	Name       string    `json:"name"`
+	Generation int64     `json:"generation,omitempty"` // 0 when GCS did not tell
+	Size       int64     `json:"size"`                 // of the plaintext
+	Md5Hash    string    `json:"md5Hash"`              // base64 of the plaintext
+	Crc32c     string    `json:"crc32c"`               // base64 of the plaintext
+	Key        string    `json:"key"`
+	KeyVersion string    `json:"keyVersion,omitempty"`
+	Uploaded   time.Time `json:"uploaded"`
+}
+
+type batchKey struct {
+	bucket string
+	prefix string
+}
+
+type batch struct {
+	objects []Entry
+}
+
+// writer collects the entries until their batch is written
+type writer struct {
+	signingKey string
+	maxObjects int
+	client     *storage.Client
+
+	mu       sync.Mutex
+	batches  map[batchKey]*batch
+	previous map[batchKey]*Link
+	full     chan struct{}
+}
+
+var current atomic.Pointer[writer]
+
+// Run writes the manifests of the uploads Record collects every interval, and a batch as soon as
+// it holds maxObjects objects, until ctx is done
+func Run(ctx context.Context, signingKey string, interval time.Duration, maxObjects int) {
+	client, err := gcsclient.Storage()
+	if err != nil {
+		log.Errorf("integrity manifests disabled: %v", err)
+		return
+	}
+	w := &writer{
+		signingKey: signingKey,
+		maxObjects: maxObjects,
+		client:     client,
+		batches:    map[batchKey]*batch{},
+		previous:   map[batchKey]*Link{},
+		full:       make(chan struct{}, 1),
+	}
+	current.Store(w)
+	defer current.Store(nil)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.flush(ctx, 0)
+		case <-w.full:
+			w.flush(ctx, maxObjects)
+		case <-ctx.Done():
+			// the uploads of the last batches are listed before the process ends
+			w.flush(context.Background(), 0)
+			return
+		}
+	}
+}
+
+// Record adds the encrypted upload GCS accepted in f to the batch of its prefix. It must run
+// before the upload response is rewritten to describe the plaintext.
+func Record(f *proxy.Flow) {
+	w := current.Load()
+	if w == nil || f.Request.Header.Get(hdl.CiphertextSizeHeader) == "" {
+		return
+	}
+	bucket := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	entry, ok := uploadEntry(f)
+	if !ok {
+		log.WithField(logsample.CategoryField, "encrypt").Errorf("integrity manifest of gs://%v: the upload response names no object", bucket)
+		return
+	}
+	prefix := ""
+	if i := strings.LastIndex(entry.Name, "/"); i >= 0 {
+		prefix = entry.Name[:i+1]
+	}
+
+	w.mu.Lock()
+	key := batchKey{bucket, prefix}
+	b := w.batches[key]
+	if b == nil {
+		b = &batch{}
+		w.batches[key] = b
+	}
+	b.objects = append(b.objects, entry)
+	full := len(b.objects) >= w.maxObjects
+	w.mu.Unlock()
+	if full {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// uploadEntry reads the object of an upload from the object resource GCS answered with
+func uploadEntry(f *proxy.Flow) (Entry, bool) {
+	var resource struct {
+		Name       string            `json:"name"`
+		Generation string            `json:"generation"`
+		Metadata   map[string]string `json:"metadata"`
+	}
+	if err := json.Unmarshal(f.Response.Body, &resource); err != nil || resource.Name == "" {
+		return Entry{}, false
+	}
+	metadata := resource.Metadata
+	size, _ := strconv.ParseInt(f.Request.Header.Get("gcs-proxy-unencrypted-file-size"), 10, 64)
+	generation, _ := strconv.ParseInt(resource.Generation, 10, 64)
+	return Entry{
+		Name:       resource.Name,
+		Generation: generation,
+		Size:       size,
+		Md5Hash:    util.Meta(metadata, util.MetaMd5Hash),
+		Crc32c:     util.Meta(metadata, util.MetaCrc32c),
+		Key:        util.Meta(metadata, util.MetaEncryptionKey),
+		KeyVersion: util.Meta(metadata, util.MetaEncryptionKeyVersion),
+		Uploaded:   time.Now().UTC(),
+	}, true
+}
+
+// flush writes the batches holding at least minObjects objects, all with 0
+func (w *writer) flush(ctx context.Context, minObjects int) {
+	w.mu.Lock()
+	ready := map[batchKey][]Entry{}
+	for key, b := range w.batches {
+		if len(b.objects) > 0 && len(b.objects) >= minObjects {
+			ready[key] = b.objects
+			delete(w.batches, key)
+		}
+	}
+	w.mu.Unlock()
+
+	for key, objects := range ready {
+		err := w.write(ctx, key, objects)
+		count(key.bucket, err)
+		if err != nil {
+			log.WithField(logsample.CategoryField, "encrypt").Errorf("integrity manifest of gs://%v/%v failed, retrying with the next: %v", key.bucket, key.prefix, err)
+			w.mu.Lock()
+			b := w.batches[key]
+			if b == nil {
+				b = &batch{}
+				w.batches[key] = b
+			}
+			b.objects = append(objects, b.objects...)
+			w.mu.Unlock()
+		}
+	}
+}
+
+// write signs and stores the manifest of one batch
+func (w *writer) write(ctx context.Context, key batchKey, objects []Entry) error {
+	w.mu.Lock()
+	previous := w.previous[key]
+	w.mu.Unlock()
+	m := Manifest{
+		Version:  Version,
+		Bucket:   key.bucket,
+		Prefix:   key.prefix,
+		Created:  time.Now().UTC(),
+		Previous: previous,
+		Objects:  objects,
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	signature, err := crypto.SignData(ctx, w.signingKey, data)
+	if err != nil {
+		return fmt.Errorf("unable to sign the manifest: %w", err)
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%v%v%v-%v.json", key.prefix, Folder, m.Created.Format("20060102T150405Z"), hex.EncodeToString(id))
+
+	writer := util.Bucket(ctx, w.client, key.bucket).Object(name).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	writer.Metadata = map[string]string{
+		util.MetaKey(util.MetaManifestSignature):  base64.StdEncoding.EncodeToString(signature),
+		util.MetaKey(util.MetaManifestSigningKey): w.signingKey,
+	}
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+	w.mu.Lock()
+	w.previous[key] = &Link{Name: name, Sha256: hex.EncodeToString(digest[:])}
+	w.mu.Unlock()
+	log.Debugf("wrote integrity manifest gs://%v/%v of %v objects", key.bucket, name, len(objects))
+	return nil
+}
+
+// Read returns the manifest gs://bucket/name after checking its signature by signingKey
+func Read(ctx context.Context, client *storage.Client, bucket string, name string, signingKey string) (*Manifest, []byte, error) {
+	obj := util.Bucket(ctx, client, bucket).Object(name)
+	reader, err := obj.NewReader(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+	var data bytes.Buffer
+	if _, err := data.ReadFrom(reader); err != nil {
+		return nil, nil, err
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if recorded := util.Meta(attrs.Metadata, util.MetaManifestSigningKey); recorded != signingKey {
+		return nil, nil, fmt.Errorf("manifest is signed by %q, expected %v", recorded, signingKey)
+	}
+	signature, err := base64.StdEncoding.DecodeString(util.Meta(attrs.Metadata, util.MetaManifestSignature))
+	if err != nil || len(signature) == 0 {
+		return nil, nil, fmt.Errorf("manifest has no valid signature")
+	}
+	if err := crypto.VerifySignature(ctx, signingKey, data.Bytes(), signature); err != nil {
+		return nil, nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data.Bytes(), m); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if m.Bucket != bucket || !strings.HasPrefix(name, m.Prefix+Folder) {
+		return nil, nil, fmt.Errorf("manifest of gs://%v/%v was moved to gs://%v/%v", m.Bucket, m.Prefix, bucket, name)
+	}
+	return m, data.Bytes(), nil
+}
+
+func count(bucket string, err error) {
+	if Written == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	Written.Add(context.Background(), 1, metric.WithAttributes(attribute.String("bucket", bucket), attribute.String("result", result)))
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package mirror copies the uploads the proxy encrypted to a second bucket for disaster recovery,
+possibly in another project or region. The copy is encrypted again with the key mapped to the
+mirror bucket, so losing one key or one region leaves the other copy readable.
+
+	-mirror_buckets=prod-data:prod-data-dr -kms_bucket_key_mappings=prod-data:KEY,prod-data-dr:DR_KEY
+
+Copies are written after GCS accepted the upload, in the background by MirrorWorkers workers, with
+the proxy's own credentials. At most MirrorQueueMB of plaintext waits in memory, the uploads that
+don't fit are not mirrored and counted as dropped, the client never waits for the mirror.
+*/
+package mirror
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/logsample"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Uploads counts the mirror copies by source bucket and result: ok, error or dropped when the
+// queue was full. Set up by the binary when metrics are exported.
+var Uploads metric.Int64Counter
+
+// upload is what Keep holds until the upload's response
+type upload struct {
+	bucket    string
+	plaintext []byte
+}
+
+// job is one copy waiting for a worker
+type job struct {
+	source      string // bucket
+	bucket      string
+	name        string
+	contentType string
+	metadata    map[string]string
+	keyName     string
+	format      string
+	chunkSize   uint32 // of the mirror bucket
+	credentials string // KMS credentials file of the client's tenant
+	userProject string // billed for a Requester Pays mirror bucket
+	policy      string // of the key mapping of the mirror bucket
+	plaintext   []byte
+}
+
+type queue struct {
+	jobs    chan job
+	size    atomic.Int64 // plaintext bytes queued
+	maxSize int64
+	client  *storage.Client
+}
+
+var (
+	kept       sync.Map // flow id -> upload
+	mirrors    *queue
+	mirrorOnce sync.Once
+)
+
+// getQueue starts the workers on first use, returns nil if the storage client can't be created
+func getQueue() *queue {
+	mirrorOnce.Do(func() {
+		client, err := gcsclient.Storage()
+		if err != nil {
+			log.Errorf("mirroring disabled: %v", err)
+			return
+		}
+		config := cfg.Current()
+		workers := max(config.MirrorWorkers, 1)
+		mirrors = &queue{
+			jobs:    make(chan job, 4096),
+			maxSize: int64(config.MirrorQueueMB) * 1024 * 1024,
+			client:  client,
+		}
+		for range workers {
+			go mirrors.work()
+		}
+	})
+	return mirrors
+}
+
+// Keep holds the plaintext of an upload to bucketName until the upload's response, if the bucket
+// is mirrored.
+func Keep(f *proxy.Flow, bucketName string, plaintext []byte) {
+	if util.KeyMapFor(f).Mirror(bucketName) == "" {
+		return
+	}
+	if _, loaded := kept.Swap(f.Id, upload{bucketName, plaintext}); !loaded {
+		go func() {
+			<-f.Done()
+			kept.Delete(f.Id)
+		}()
+	}
+}
+
+// Enqueue queues the copy of the upload GCS accepted in f, if Keep held its plaintext. It must run
+// before the upload response is rewritten to describe the plaintext.
+func Enqueue(f *proxy.Flow) {
+	value, ok := kept.LoadAndDelete(f.Id)
+	if !ok {
+		return
+	}
+	plaintext, source := value.(upload).plaintext, value.(upload).bucket
+	keyMap := util.KeyMapFor(f)
+	j := job{source: source, bucket: keyMap.Mirror(source), plaintext: plaintext}
+	logger := log.WithField(logsample.CategoryField, "encrypt")
+
+	var resource struct {
+		Name        string            `json:"name"`
+		ContentType string            `json:"contentType"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+	if err := json.Unmarshal(f.Response.Body, &resource); err != nil || resource.Name == "" {
+		logger.Errorf("mirror of an upload to gs://%v: upload response has no object name", source)
+		count(source, "error")
+		return
+	}
+	j.name, j.contentType, j.metadata = resource.Name, resource.ContentType, resource.Metadata
+	// a bucket without a key is never mirrored in plaintext
+	if j.keyName = keyMap.Key(j.bucket); j.keyName == "" {
+		logger.Errorf("mirror of gs://%v/%v: no key mapped for the mirror bucket %v", source, j.name, j.bucket)
+		count(source, "error")
+		return
+	}
+	j.format = keyMap.Format(j.bucket)
+	j.chunkSize = keyMap.ChunkSize(j.bucket)
+	j.policy = keyMap.Policy
+	j.userProject = util.UserProject(f)
+	if t := tenant.Of(f); t != nil {
+		j.credentials = t.KmsCredentialsFile
+	}
+
+	q := getQueue()
+	if q == nil {
+		count(source, "error")
+		return
+	}
+	if q.size.Add(int64(len(plaintext))) > q.maxSize {
+		q.size.Add(-int64(len(plaintext)))
+		logger.Warnf("mirror of gs://%v/%v dropped, %v MiB already queued", source, j.name, cfg.For(f).MirrorQueueMB)
+		count(source, "dropped")
+		return
+	}
+	select {
+	case q.jobs <- j:
+	default:
+		q.size.Add(-int64(len(plaintext)))
+		logger.Warnf("mirror of gs://%v/%v dropped, %v copies already queued", source, j.name, cap(q.jobs))
+		count(source, "dropped")
+	}
+}
+
+func (q *queue) work() {
+	for j := range q.jobs {
+		err := q.write(j)
+		q.size.Add(-int64(len(j.plaintext)))
+		if err != nil {
+			log.WithField(logsample.CategoryField, "encrypt").Errorf("mirror of gs://%v/%v to gs://%v failed: %v", j.source, j.name, j.bucket, err)
+			count(j.source, "error")
+			continue
+		}
+		log.Debugf("mirrored gs://%v/%v to gs://%v", j.source, j.name, j.bucket)
+		count(j.source, "ok")
+	}
+}
+
+// write stores the copy, encrypted with the mirror bucket's key like the proxy encrypts uploads
+func (q *queue) write(j job) error {
+	ctx := util.WithUserProject(crypto.WithKmsCredentials(context.Background(), j.credentials), j.userProject)
+	metadata := map[string]string{}
+	for key, value := range j.metadata {
+		metadata[key] = value
+	}
+	// the metadata the proxy writes for its own envelope, recomputed for the copy
+	util.DeleteMeta(metadata)
+	metadata[util.MetaKey(util.MetaMirroredFrom)] = "gs://" + j.source + "/" + j.name
+
+	obj := util.Bucket(ctx, q.client, j.bucket).Object(j.name).Retryer(storage.WithPolicy(storage.RetryAlways))
+	data := j.plaintext
+	switch j.format {
+	case util.EnvelopeFormatCsek:
+		key, err := crypto.DeriveCsekKey(ctx, j.keyName, j.bucket, j.name)
+		if err != nil {
+			return err
+		}
+		obj = obj.Key(key)
+	case util.EnvelopeFormatTink:
+		ciphertext, keyVersion, err := crypto.EncryptBytesWithKeyVersion(crypto.WithChunkSize(ctx, j.chunkSize), j.keyName, j.plaintext)
+		if err != nil {
+			return err
+		}
+		data = ciphertext
+		metadata[util.MetaKey(util.MetaUnencryptedLength)] = strconv.Itoa(len(j.plaintext))
+		metadata[util.MetaKey(util.MetaMd5Hash)] = crypto.Base64MD5Hash(j.plaintext)
+		metadata[util.MetaKey(util.MetaCrc32c)] = crypto.Base64Crc32cHash(j.plaintext)
+		metadata[util.MetaKey(util.MetaEncryptionKey)] = j.keyName
+		metadata[util.MetaKey(util.MetaEncryptionKeyVersion)] = keyVersion
+		metadata[util.MetaKey(util.MetaProxyVersion)] = cfg.Current().GCSProxyVersion
+		metadata[util.MetaKey(util.MetaEnvelopeVersion)] = strconv.Itoa(envelope.Version)
+		if crypto.EscrowKeyName != "" {
+			metadata[util.MetaKey(util.MetaEscrowKey)] = crypto.EscrowKeyName
+		}
+		maps.Copy(metadata, util.EncryptionProvenance(j.policy))
+	default:
+		return fmt.Errorf("unknown envelope format %q for bucket %v", j.format, j.bucket)
+	}
+
+	writer := obj.NewWriter(ctx)
+	writer.ContentType = j.contentType
+	writer.Metadata = metadata
+	md5Hash := md5.Sum(data)
+	writer.MD5 = md5Hash[:]
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to write object: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to write object: %w", err)
+	}
+	return nil
+}
+
+func count(source string, result string) {
+	if Uploads == nil {
+		return
+	}
+	Uploads.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("bucket", source), attribute.String("result", result)))
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package notifications keeps the caches and the policy of a proxy current when other clients or
+replicas change them, as the messages of a Pub/Sub subscription report it. The notifications of
+the mapped buckets drop the objects deleted or overwritten from the caches:
+
+	gcloud storage buckets notifications create gs://BUCKET --topic=TOPIC \
+	    --event-types=OBJECT_FINALIZE,OBJECT_DELETE,OBJECT_ARCHIVE --payload-format=none
+	gcloud pubsub subscriptions create NAME --topic=TOPIC
+	-notifications_subscription=projects/PROJECT/subscriptions/NAME
+
+A message with the attribute eventType=POLICY_UPDATE, or the notification of a new generation of a
+gs:// -policy_source, has the policy fetched right away instead of at the next poll:
+
+	gcloud pubsub topics publish TOPIC --attribute=eventType=POLICY_UPDATE
+
+Run pulls the subscription with the proxy's own credentials, which need roles/pubsub.subscriber on
+it. Every proxy replica needs its own subscription, a message is delivered to one subscriber. Only
+the attributes of the messages are read, the payload does not matter.
+*/
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsrewrite"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/oauth2"
+)
+
+// Received counts the messages pulled by bucket and event type, e.g. OBJECT_DELETE or
+// POLICY_UPDATE. Set up by the binary when metrics are exported.
+var Received metric.Int64Counter
+
+// PolicyUpdateEvent is the eventType attribute of the messages announcing a new policy
+const PolicyUpdateEvent = "POLICY_UPDATE"
+
+// policyUpdates is signaled when the policy changed, once for the updates the poller did not
+// get to yet
+var policyUpdates = make(chan struct{}, 1)
+
+// PolicyUpdates returns the channel signaled when a message reports that the policy changed
+func PolicyUpdates() <-chan struct{} {
+	return policyUpdates
+}
+
+const (
+	pubsubEndpoint = "https://pubsub.googleapis.com/v1/"
+	pubsubScope    = "https://www.googleapis.com/auth/pubsub"
+	maxMessages    = 1000
+	// a pull waits for messages, the connection is reset when they take longer
+	pullTimeout = 90 * time.Second
+	maxBackoff  = 5 * time.Minute
+)
+
+// message is a received message of a pull, the attributes of a GCS notification
+type message struct {
+	AckID   string `json:"ackId"`
+	Message struct {
+		Attributes map[string]string `json:"attributes"`
+	} `json:"message"`
+}
+
+// Run pulls the notifications of subscription until ctx is done, backing off while Pub/Sub fails
+func Run(ctx context.Context, subscription string) {
+	ts, err := gcsclient.TokenSource(ctx, pubsubScope)
+	if err != nil {
+		log.Fatalf("failed to create the notifications client: %v", err)
+	}
+	client := oauth2.NewClient(ctx, ts)
+	log.Infof("following the object and policy changes %v reports", subscription)
+
+	backoff := time.Second
+	for ctx.Err() == nil {
+		messages, err := pull(ctx, client, subscription)
+		if err == nil {
+			err = acknowledge(ctx, client, subscription, handle(messages))
+		}
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		log.Warnf("notifications of %v: %v, pulling again in %v", subscription, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// handle invalidates the objects of the notifications, it returns the ack ids of the messages
+func handle(messages []message) []string {
+	ackIDs := make([]string, 0, len(messages))
+	for _, m := range messages {
+		ackIDs = append(ackIDs, m.AckID)
+		attributes := m.Message.Attributes
+		event := attributes["eventType"]
+		if event == PolicyUpdateEvent {
+			updatePolicy()
+			count("", event)
+			continue
+		}
+		bucketName, objectName, generation := attributes["bucketId"], attributes["objectId"], attributes["objectGeneration"]
+		if bucketName == "" || objectName == "" {
+			continue
+		}
+		switch event {
+		case "OBJECT_FINALIZE":
+			hdl.InvalidateOverwritten(bucketName, objectName, generation)
+			if isPolicySource(bucketName, objectName) {
+				updatePolicy()
+			}
+		case "OBJECT_DELETE", "OBJECT_ARCHIVE":
+			hdl.InvalidateGeneration(bucketName, objectName, generation)
+		default:
+			// metadata updates don't change the data
+			continue
+		}
+		log.Debugf("%v of gs://%v/%v#%v", event, bucketName, objectName, generation)
+		count(bucketName, event)
+	}
+	return ackIDs
+}
+
+// updatePolicy has the policy poller fetch the policy
+func updatePolicy() {
+	if cfg.Current().PolicySource == "" {
+		return
+	}
+	select {
+	case policyUpdates <- struct{}{}:
+	default:
+	}
+}
+
+// isPolicySource reports whether gs://bucketName/objectName is the -policy_source
+func isPolicySource(bucketName string, objectName string) bool {
+	source := cfg.Current().PolicySource
+	if !strings.HasPrefix(source, "gs://") {
+		return false
+	}
+	policyBucket, policyObject, err := util.ParseGcsUrl(source)
+	return err == nil && policyBucket == bucketName && policyObject == objectName
+}
+
+func count(bucketName string, event string) {
+	if Received == nil {
+		return
+	}
+	Received.Add(context.Background(), 1, metric.WithAttributes(attribute.String("bucket", bucketName), attribute.String("event", event)))
+}
+
+func pull(ctx context.Context, client *http.Client, subscription string) ([]message, error) {
+	ctx, cancel := context.WithTimeout(ctx, pullTimeout)
+	defer cancel()
+	var response struct {
+		ReceivedMessages []message `json:"receivedMessages"`
+	}
+	err := call(ctx, client, subscription+":pull", map[string]interface{}{"maxMessages": maxMessages}, &response)
+	if ctx.Err() == context.DeadlineExceeded {
+		// no message in a while
+		return nil, nil
+	}
+	return response.ReceivedMessages, err
+}
+
+func acknowledge(ctx context.Context, client *http.Client, subscription string, ackIDs []string) error {
+	if len(ackIDs) == 0 {
+		return nil
+	}
+	return call(ctx, client, subscription+":acknowledge", map[string]interface{}{"ackIds": ackIDs}, nil)
+}
+
+// call POSTs request to method of the Pub/Sub API and decodes its response into response
+func call(ctx context.Context, client *http.Client, method string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pubsubEndpoint+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Pub/Sub answered %v: %s", resp.Status, data)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(data, response)
+}
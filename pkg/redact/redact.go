@@ -0,0 +1,173 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package redact removes credentials from what the proxy logs and dumps: authorization and
+cookie headers, customer-supplied encryption keys, the signature and credential of signed
+URLs, OAuth tokens and private keys.
+
+	log.SetFormatter(redact.NewFormatter(&log.TextFormatter{}))
+	dumped := redact.Header(f.Request.Header)
+
+Redaction is on unless SetEnabled(false) is called, for debugging with the real values.
+*/
+package redact
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Redacted replaces the redacted values
+const Redacted = "REDACTED"
+
+var disabled atomic.Bool
+
+// SetEnabled turns redaction on or off for the whole process.
+func SetEnabled(enabled bool) {
+	disabled.Store(!enabled)
+}
+
+// Enabled reports whether values are redacted.
+func Enabled() bool {
+	return !disabled.Load()
+}
+
+// headers whose values are credentials
+var secretHeaders = map[string]bool{
+	"Authorization":                     true,
+	"Proxy-Authorization":               true,
+	"Cookie":                            true,
+	"Set-Cookie":                        true,
+	"X-Goog-Encryption-Key":             true,
+	"X-Goog-Copy-Source-Encryption-Key": true,
+	"X-Goog-Iam-Authorization-Token":    true,
+	"X-Gcs-Proxy-Admin-Token":           true,
+}
+
+// query parameters of signed URLs and API keys, compared in lower case
+var secretParams = map[string]bool{
+	"x-goog-signature":  true,
+	"x-goog-credential": true,
+	"signature":         true,
+	"googleaccessid":    true,
+	"access_token":      true,
+	"key":               true,
+	"x-amz-signature":   true,
+	"x-amz-credential":  true,
+}
+
+// SecretHeader reports whether the values of the header name are redacted.
+func SecretHeader(name string) bool {
+	return secretHeaders[http.CanonicalHeaderKey(name)]
+}
+
+// Header returns a copy of header with the credential values redacted.
+func Header(header http.Header) http.Header {
+	if !Enabled() {
+		return header
+	}
+	redacted := header.Clone()
+	for name, values := range redacted {
+		if !SecretHeader(name) {
+			continue
+		}
+		for i := range values {
+			values[i] = Redacted
+		}
+	}
+	return redacted
+}
+
+// Query returns a copy of query with the signed URL signatures and tokens redacted.
+func Query(query url.Values) url.Values {
+	if !Enabled() {
+		return query
+	}
+	redacted := make(url.Values, len(query))
+	for name, values := range query {
+		if secretParams[strings.ToLower(name)] {
+			values = []string{Redacted}
+		}
+		redacted[name] = values
+	}
+	return redacted
+}
+
+// URL returns u as a string with the signed URL signatures and tokens redacted.
+func URL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	if !Enabled() || u.RawQuery == "" {
+		return u.String()
+	}
+	redacted := *u
+	redacted.RawQuery = Query(u.Query()).Encode()
+	return redacted.String()
+}
+
+// patterns of credentials in free text, each one keeps its first group and redacts the rest
+var secretPatterns = []*regexp.Regexp{
+	// Authorization: Bearer ya29...
+	regexp.MustCompile(`(?i)(\b(?:bearer|basic)\s+)[A-Za-z0-9._~+/=-]+`),
+	// headers written as "Name: value", Name=value or Go's "Name":[]string{"value"}
+	regexp.MustCompile(`(?i)("?\b(?:proxy-)?authorization|"?\b(?:set-)?cookie|"?\bx-goog-(?:copy-source-)?encryption-key|"?\bx-goog-iam-authorization-token|"?\bx-gcs-proxy-admin-token)("?\s*[:=]\s*(?:\[\]string\{)?"?)[^"\r\n}]+`),
+	// signed URL and API key query parameters
+	regexp.MustCompile(`(?i)([?&](?:x-goog-signature|x-goog-credential|signature|googleaccessid|access_token|key|x-amz-signature|x-amz-credential)=)[^&\s"']+`),
+	// OAuth tokens and service account keys in JSON
+	regexp.MustCompile(`(?i)("(?:access_token|refresh_token|id_token|client_secret|private_key|private_key_id)"\s*:\s*")[^"]*`),
+}
+
+var privateKeyPattern = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)
+
+// String returns s with the credentials it contains redacted.
+func String(s string) string {
+	if !Enabled() {
+		return s
+	}
+	for _, pattern := range secretPatterns {
+		if pattern.NumSubexp() == 2 {
+			s = pattern.ReplaceAllString(s, "${1}${2}"+Redacted)
+		} else {
+			s = pattern.ReplaceAllString(s, "${1}"+Redacted)
+		}
+	}
+	return privateKeyPattern.ReplaceAllString(s, Redacted+" PRIVATE KEY")
+}
+
+// Formatter redacts the message and the string fields of log entries before Next formats them.
+type Formatter struct {
+	Next log.Formatter
+}
+
+func NewFormatter(next log.Formatter) *Formatter {
+	return &Formatter{Next: next}
+}
+
+func (f *Formatter) Format(entry *log.Entry) ([]byte, error) {
+	if !Enabled() {
+		return f.Next.Format(entry)
+	}
+	redacted := *entry
+	redacted.Message = String(entry.Message)
+	redacted.Data = make(log.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			value = String(v)
+		case error:
+			value = String(v.Error())
+		}
+		redacted.Data[key] = value
+	}
+	return f.Next.Format(&redacted)
+}
@@ -0,0 +1,296 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package sigv4 recognizes and re-signs XML API requests signed with an HMAC key, the AWS Signature
+Version 4 scheme S3 compatible SDKs use with GCS (AWS4-HMAC-SHA256) and its GCS variant
+(GOOG4-HMAC-SHA256).
+
+	signature, signed := sigv4.Parse(f)
+	// ... the proxy rewrites the request ...
+	if signed && signature.Changed(f) {
+		secret, _ := sigv4.Secret(signature.AccessId)
+		err = signature.Resign(f, secret)
+	}
+
+The signature covers the method, path, query, the signed headers and, unless the client sent
+UNSIGNED-PAYLOAD, the SHA-256 of the body, so GCS refuses a request the proxy encrypted or whose
+headers it changed. Resign keeps the client's credential scope and request date. Requests signed
+in the query string (signed URLs) sign neither the body nor the headers the proxy changes.
+*/
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// the signing schemes and the names of their headers and constants
+type scheme struct {
+	algorithm     string
+	keyPrefix     string // of the secret in the signing key derivation
+	dateHeader    string
+	contentHeader string // SHA-256 of the body
+}
+
+var schemes = []scheme{
+	{"AWS4-HMAC-SHA256", "AWS4", "x-amz-date", "x-amz-content-sha256"},
+	{"GOOG4-HMAC-SHA256", "GOOG4", "x-goog-date", "x-goog-content-sha256"},
+}
+
+// the prefixes of the headers the proxy adds that GCS only accepts signed, either scheme
+var signedPrefixes = []string{"x-amz-", "x-goog-"}
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Signature is the Authorization header of a signed request and what it signed.
+type Signature struct {
+	scheme
+	AccessId      string
+	Scope         string   // date/region/service/request
+	SignedHeaders []string // lowercase, sorted
+	values        map[string]string
+	unsigned      map[string]string // the prefixed headers the client did not sign
+	body          string            // hex SHA-256
+	payload       string            // the content header, UNSIGNED-PAYLOAD when the body is not signed
+}
+
+// Parse recognizes a request signed in its Authorization header and remembers the signed
+// values, to tell later whether the proxy changed them.
+func Parse(f *proxy.Flow) (*Signature, bool) {
+	auth := f.Request.Header.Get("Authorization")
+	for _, s := range schemes {
+		rest, ok := strings.CutPrefix(auth, s.algorithm+" ")
+		if !ok {
+			continue
+		}
+		signature := &Signature{scheme: s}
+		for _, field := range strings.Split(rest, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "Credential":
+				signature.AccessId, signature.Scope, _ = strings.Cut(value, "/")
+			case "SignedHeaders":
+				signature.SignedHeaders = strings.Split(value, ";")
+			}
+		}
+		if signature.AccessId == "" || len(signature.SignedHeaders) == 0 {
+			return nil, false
+		}
+		sort.Strings(signature.SignedHeaders)
+		signature.values, signature.unsigned = signature.headerValues(f), signature.unsignedValues(f)
+		signature.body = bodyHash(f.Request.Body)
+		if signature.payload = f.Request.Header.Get(s.contentHeader); signature.payload == "" {
+			signature.payload = unsignedPayload
+		}
+		return signature, true
+	}
+	return nil, false
+}
+
+// Streaming reports whether the body is signed chunk by chunk (aws-chunked), Resign can't do that.
+func (s *Signature) Streaming() bool {
+	return strings.HasPrefix(s.payload, "STREAMING-")
+}
+
+// Changed reports whether the request no longer matches what the client signed: a signed header,
+// the path or query, or the body of a signed payload changed, or headers GCS wants signed were
+// added.
+func (s *Signature) Changed(f *proxy.Flow) bool {
+	for name, value := range s.headerValues(f) {
+		if s.values[name] != value {
+			return true
+		}
+	}
+	if bodyHash(f.Request.Body) != s.body && s.payload != unsignedPayload {
+		return true
+	}
+	return len(s.added(f)) > 0
+}
+
+// Resign signs the request again with secret, the secret of the client's access id. The headers
+// GCS wants signed that the proxy added are signed as well.
+func (s *Signature) Resign(f *proxy.Flow, secret string) error {
+	date := f.Request.Header.Get(s.dateHeader)
+	if date == "" {
+		return fmt.Errorf("signed request without %v header", s.dateHeader)
+	}
+	scope := strings.Split(s.Scope, "/")
+	if len(scope) != 4 {
+		return fmt.Errorf("invalid credential scope %v", s.Scope)
+	}
+
+	if s.signs("content-length") {
+		f.Request.Header.Set("Content-Length", strconv.Itoa(len(f.Request.Body)))
+	}
+	payload := s.payload
+	if payload != unsignedPayload {
+		payload = bodyHash(f.Request.Body)
+		f.Request.Header.Set(s.contentHeader, payload)
+	}
+
+	// sign the headers that have to be, and no longer the ones the proxy removed
+	var signedHeaders []string
+	for _, name := range s.SignedHeaders {
+		if name == "host" || name == "content-length" || len(f.Request.Header.Values(name)) > 0 {
+			signedHeaders = append(signedHeaders, name)
+		}
+	}
+	s.SignedHeaders = append(signedHeaders, s.added(f)...)
+	sort.Strings(s.SignedHeaders)
+
+	values := s.headerValues(f)
+	var canonicalHeaders strings.Builder
+	for _, name := range s.SignedHeaders {
+		canonicalHeaders.WriteString(name + ":" + values[name] + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		f.Request.Method,
+		uriEncode(f.Request.URL.Path, false),
+		canonicalQuery(f.Request.URL.Query()),
+		canonicalHeaders.String(),
+		strings.Join(s.SignedHeaders, ";"),
+		payload,
+	}, "\n")
+	stringToSign := strings.Join([]string{s.algorithm, date, s.Scope, bodyHash([]byte(canonicalRequest))}, "\n")
+
+	key := []byte(s.keyPrefix + secret)
+	for _, part := range scope {
+		key = hmacSha256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	f.Request.Header.Set("Authorization", fmt.Sprintf("%v Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s.algorithm, s.AccessId, s.Scope, strings.Join(s.SignedHeaders, ";"), signature))
+	s.values, s.unsigned = s.headerValues(f), s.unsignedValues(f)
+	s.body, s.payload = bodyHash(f.Request.Body), payload
+	return nil
+}
+
+func (s *Signature) signs(name string) bool {
+	i := sort.SearchStrings(s.SignedHeaders, name)
+	return i < len(s.SignedHeaders) && s.SignedHeaders[i] == name
+}
+
+// unsignedValues returns the canonical values of the prefixed headers that are not signed, the
+// proxy's own gcs-proxy- headers are not prefixed
+func (s *Signature) unsignedValues(f *proxy.Flow) map[string]string {
+	values := map[string]string{}
+	for name := range f.Request.Header {
+		name = strings.ToLower(name)
+		for _, prefix := range signedPrefixes {
+			if strings.HasPrefix(name, prefix) && !s.signs(name) {
+				values[name] = canonicalValue(f.Request.Header.Values(name))
+			}
+		}
+	}
+	return values
+}
+
+// added returns the prefixed headers the proxy added or changed without signing them
+func (s *Signature) added(f *proxy.Flow) []string {
+	var names []string
+	for name, value := range s.unsignedValues(f) {
+		if original, ok := s.unsigned[name]; !ok || original != value {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// headerValues returns the canonical values of the signed headers, the host is in the URL
+func (s *Signature) headerValues(f *proxy.Flow) map[string]string {
+	values := map[string]string{"": f.Request.Method + " " + f.Request.URL.RequestURI()}
+	for _, name := range s.SignedHeaders {
+		if name == "host" {
+			values[name] = f.Request.URL.Host
+			continue
+		}
+		values[name] = canonicalValue(f.Request.Header.Values(name))
+	}
+	return values
+}
+
+func canonicalValue(values []string) string {
+	var trimmed []string
+	for _, value := range values {
+		trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+	}
+	return strings.Join(trimmed, ",")
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode escapes every byte but the unreserved characters, and the slashes of paths
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+var secrets map[string]string // access id -> secret
+
+// LoadKeys reads the HMAC keys the proxy may re-sign requests with, a JSON object of access ids
+// to secrets.
+func LoadKeys(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read HMAC keys: %v", err)
+	}
+	keys := map[string]string{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("failed to parse HMAC keys %v: %v", path, err)
+	}
+	secrets = keys
+	return nil
+}
+
+// Secret returns the secret of an HMAC access id loaded by LoadKeys.
+func Secret(accessId string) (string, bool) {
+	secret, ok := secrets[accessId]
+	return secret, ok
+}
+
+// BypassHeader marks the signed requests the proxy sent unencrypted so GCS accepts their signature,
+// their responses are not rewritten either.
+const BypassHeader = "gcs-proxy-hmac-bypass"
@@ -0,0 +1,315 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package spool stores encrypted uploads on local disk and forwards them to GCS when it can be
+reached, for edge sites with unreliable connectivity.
+
+	-spool_dir=/var/spool/gcsproxy -spool_max_mb=10240 -spool_retry_interval=30s
+
+Uploads are spooled once the proxy encrypted them, so only ciphertext touches the disk, and the
+client gets the object resource right away. Run forwards the spooled uploads in arrival order with
+the proxy's own credentials; it stops a round at the first network or server error and starts
+again after the retry interval. Uploads GCS rejects for good are moved to the failed directory.
+*/
+package spool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Uploads counts the spooled uploads forwarded to GCS by result: ok, or rejected when GCS refused
+// them for good. Set up by the binary when metrics are exported.
+var Uploads metric.Int64Counter
+
+// FailedDir is the directory of the spool the uploads GCS rejected are moved to.
+const FailedDir = "failed"
+
+const spoolExt = ".upload"
+
+// headers of the client that are not written to disk, the forwarded uploads use the proxy's credentials
+var droppedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// upload is a spool file
+type upload struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+var (
+	depth     atomic.Int64 // spooled uploads
+	depthSize atomic.Int64 // bytes of the spool files
+	mu        sync.Mutex   // serializes the admission against the size limit
+)
+
+// Depth returns the number of spooled uploads waiting for GCS and their size in bytes.
+func Depth() (int64, int64) {
+	return depth.Load(), depthSize.Load()
+}
+
+// Spool writes the encrypted upload in f to the spool directory and answers it with the object
+// resource GCS would return. It returns false, leaving the upload to go to GCS directly, when
+// spooling is disabled or the spool is full.
+func Spool(f *proxy.Flow) (bool, error) {
+	dir := cfg.For(f).SpoolDir
+	if dir == "" {
+		return false, nil
+	}
+	resource, err := objectResource(f)
+	if err != nil {
+		return false, err
+	}
+
+	header := f.Request.Header.Clone()
+	for _, name := range droppedHeaders {
+		header.Del(name)
+	}
+	data, err := json.Marshal(upload{Method: f.Request.Method, URL: f.Request.URL.String(), Header: header, Body: f.Request.Body})
+	if err != nil {
+		return false, fmt.Errorf("error marshalling spooled upload: %v", err)
+	}
+	body, err := json.Marshal(resource)
+	if err != nil {
+		return false, fmt.Errorf("error marshalling JSON: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxSize := int64(cfg.For(f).SpoolMaxMB) * 1024 * 1024; depthSize.Load()+int64(len(data)) > maxSize {
+		log.Warnf("spool %v is full with %v uploads, sending the upload of gs://%v/%v to GCS directly",
+			dir, depth.Load(), resource["bucket"], resource["name"])
+		return false, nil
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%020d-%v%v", time.Now().UnixNano(), f.Id, spoolExt))
+	if err := writeFile(name, data); err != nil {
+		return false, fmt.Errorf("error spooling upload: %v", err)
+	}
+	depth.Add(1)
+	depthSize.Add(int64(len(data)))
+
+	f.Response = &proxy.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json; charset=UTF-8"}},
+		Body:       body,
+	}
+	log.Debugf("spooled the upload of gs://%v/%v to %v", resource["bucket"], resource["name"], name)
+	return true, nil
+}
+
+// writeFile writes data to a temporary file and renames it, so Run never sees a partial upload
+func writeFile(name string, data []byte) error {
+	tmp := name + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// the client is told the upload succeeded, it has to survive a power loss
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// objectResource returns the object resource of the multipart upload in f as the response handler
+// would rewrite it: the metadata part with the size and hashes of the plaintext. GCS assigns the
+// generation when the upload is forwarded, so there is none.
+func objectResource(f *proxy.Flow) (map[string]interface{}, error) {
+	_, params, err := mime.ParseMediaType(f.Request.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing multipart content type: %v", err)
+	}
+	part, err := multipart.NewReader(bytes.NewReader(f.Request.Body), params["boundary"]).NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("error reading multipart metadata: %v", err)
+	}
+	resource := map[string]interface{}{}
+	if err := json.NewDecoder(part).Decode(&resource); err != nil {
+		return nil, fmt.Errorf("error unmarshalling JSON: %v", err)
+	}
+	resource["kind"] = "storage#object"
+	if _, ok := resource["bucket"]; !ok {
+		resource["bucket"] = util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	}
+	if _, ok := resource["name"]; !ok {
+		resource["name"] = f.Request.URL.Query().Get("name")
+	}
+	resource["md5Hash"] = f.Request.Header.Get("gcs-proxy-original-md5-hash")
+	resource["crc32c"] = f.Request.Header.Get("gcs-proxy-original-crc32c")
+	resource["size"] = f.Request.Header.Get("gcs-proxy-unencrypted-file-size")
+	return resource, nil
+}
+
+// Open creates the spool directory and counts the uploads spooled before a restart. It must be
+// called before the proxy accepts uploads.
+func Open(dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, FailedDir), 0700); err != nil {
+		return fmt.Errorf("failed to create the spool directory %v: %v", dir, err)
+	}
+	names, err := spooled(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read the spool directory %v: %v", dir, err)
+	}
+	for _, name := range names {
+		if info, err := os.Stat(name); err == nil {
+			depth.Add(1)
+			depthSize.Add(info.Size())
+		}
+	}
+	if len(names) > 0 {
+		log.Infof("%v uploads spooled in %v", len(names), dir)
+	}
+	return nil
+}
+
+// Run forwards the spooled uploads to GCS every interval until ctx is done.
+func Run(ctx context.Context, dir string, interval time.Duration) {
+	client, err := gcsclient.HTTP()
+	if err != nil {
+		log.Fatalf("failed to create the spool client: %v", err)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		forward(ctx, client, dir)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// spooled returns the spool files of dir, oldest first
+func spooled(dir string) ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+spoolExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// forward sends the spooled uploads until one fails to reach GCS
+func forward(ctx context.Context, client *http.Client, dir string) {
+	names, err := spooled(dir)
+	if err != nil {
+		log.Errorf("failed to read the spool directory %v: %v", dir, err)
+		return
+	}
+	for i, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		err = send(ctx, client, name)
+		var rejected *rejectedError
+		switch {
+		case err == nil:
+			os.Remove(name)
+			count("ok")
+		case errors.As(err, &rejected):
+			log.Errorf("GCS rejected the spooled upload %v, moved to %v: %v", name, FailedDir, err)
+			if err := os.Rename(name, filepath.Join(dir, FailedDir, filepath.Base(name))); err != nil {
+				log.Errorf("failed to move the spooled upload %v: %v", name, err)
+				return
+			}
+			count("rejected")
+		default:
+			log.Warnf("GCS unreachable, %v spooled uploads wait for the next try: %v", len(names)-i, err)
+			return
+		}
+		depth.Add(-1)
+		depthSize.Add(-info.Size())
+	}
+}
+
+// rejectedError is a response of GCS that retrying the same upload won't change
+type rejectedError struct {
+	status int
+	body   string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("%v %v", e.status, e.body)
+}
+
+func send(ctx context.Context, client *http.Client, name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var u upload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return &rejectedError{body: fmt.Sprintf("corrupt spool file: %v", err)}
+	}
+	req, err := http.NewRequestWithContext(ctx, u.Method, u.URL, bytes.NewReader(u.Body))
+	if err != nil {
+		return &rejectedError{body: err.Error()}
+	}
+	req.Header = u.Header
+	req.ContentLength = int64(len(u.Body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(u.Body)))
+	util.BillRequest(ctx, req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusUnauthorized, resp.StatusCode >= 500:
+		return fmt.Errorf("%v %v", resp.StatusCode, strings.TrimSpace(string(body)))
+	default:
+		return &rejectedError{status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+}
+
+func count(result string) {
+	if Uploads == nil {
+		return
+	}
+	Uploads.Add(context.Background(), 1, metric.WithAttributes(attribute.String("result", result)))
+}
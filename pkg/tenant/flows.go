@@ -0,0 +1,33 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package tenant
+
+import (
+	"sync"
+
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+var flows sync.Map // flow id -> *Tenant
+
+// Assign records the tenant a flow was sent by.
+func Assign(f *proxy.Flow, t *Tenant) {
+	flows.Store(f.Id, t)
+}
+
+// Of returns the tenant of a flow, nil when the client belongs to none.
+func Of(f *proxy.Flow) *Tenant {
+	t, ok := flows.Load(f.Id)
+	if !ok {
+		return nil
+	}
+	return t.(*Tenant)
+}
+
+// Forget drops the tenant of a finished flow.
+func Forget(f *proxy.Flow) {
+	flows.Delete(f.Id)
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package tenant
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var tokenInfoUrl = "https://oauth2.googleapis.com/tokeninfo"
+
+// tokens that could not be looked up are retried after this long
+const failedLookupTtl = time.Minute
+
+var clientTokens tokenCache
+
+// Email returns the lower case email of the account the bearer token in authHeader belongs
+// to, "" when there is none or it is not known. The lookup may call the tokeninfo endpoint.
+func Email(authHeader string) string {
+	token, ok := strings.CutPrefix(authHeader, "Bearer ")
+	if !ok || token == "" {
+		return ""
+	}
+	return clientTokens.email(token)
+}
+
+// tokenCache remembers the email of access tokens until they expire, the proxy sees the same
+// token on every request of a client
+type tokenCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]tokenEntry
+}
+
+type tokenEntry struct {
+	email   string
+	expires time.Time
+}
+
+var tokenInfoClient = &http.Client{Timeout: 10 * time.Second}
+
+// email returns the lower case email of the account an access token belongs to, "" when
+// it is not known
+func (c *tokenCache) email(token string) string {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.email
+	}
+
+	email, expiresIn, err := lookupToken(token)
+	if err != nil {
+		log.Warnf("unable to identify the client's access token: %v", err)
+		email, expiresIn = "", failedLookupTtl
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[[sha256.Size]byte]tokenEntry{}
+	}
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = tokenEntry{email: email, expires: now.Add(expiresIn)}
+	return email
+}
+
+// lookupToken asks the Google OAuth2 tokeninfo endpoint who an access token belongs to
+func lookupToken(token string) (string, time.Duration, error) {
+	resp, err := tokenInfoClient.PostForm(tokenInfoUrl, url.Values{"access_token": {token}})
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// invalid or expired, GCS will reject the request anyway
+		return "", failedLookupTtl, nil
+	}
+
+	var info struct {
+		Email     string `json:"email"`
+		ExpiresIn string `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", 0, fmt.Errorf("error decoding tokeninfo response: %v", err)
+	}
+	seconds, err := strconv.Atoi(info.ExpiresIn)
+	if err != nil || seconds <= 0 {
+		seconds = int(failedLookupTtl.Seconds())
+	}
+	return strings.ToLower(info.Email), time.Duration(seconds) * time.Second, nil
+}
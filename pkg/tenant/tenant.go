@@ -0,0 +1,168 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package tenant lets one proxy serve many teams. Each tenant has its own bucket key mapping,
+KMS credentials, request rate limit and metric labels, and is recognized by the identity of
+the client's access token or by the client's source address:
+
+	{
+	  "tenants": [
+	    {
+	      "name": "payments",
+	      "identities": ["etl@payments-prod.iam.gserviceaccount.com"],
+	      "cidrs": ["10.20.0.0/16"],
+	      "keys": {"payments-data": "projects/payments-kms/locations/global/keyRings/r/cryptoKeys/k"},
+	      "kmsCredentialsFile": "/etc/gcsproxy/payments-kms.json",
+	      "requestsPerSecond": 50,
+	      "burst": 100,
+	      "labels": {"team": "payments", "cost_center": "cc-1234"}
+	    }
+	  ]
+	}
+
+Clients that match no tenant use the global bucket key mapping.
+*/
+package tenant
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/keymap"
+	"golang.org/x/time/rate"
+)
+
+type Tenant struct {
+	Name       string   `json:"name"`
+	Identities []string `json:"identities,omitempty"` // service account or user emails
+	Cidrs      []string `json:"cidrs,omitempty"`      // client source networks
+
+	keymap.KeyMap
+
+	KmsCredentialsFile string            `json:"kmsCredentialsFile,omitempty"` // KMS calls use application default credentials when empty
+	RequestsPerSecond  float64           `json:"requestsPerSecond,omitempty"`  // unlimited when 0
+	Burst              int               `json:"burst,omitempty"`              // requests allowed at once, RequestsPerSecond rounded up when 0
+	Labels             map[string]string `json:"labels,omitempty"`             // added to the tenant's metrics
+
+	networks []*net.IPNet
+	limiter  *rate.Limiter
+}
+
+// Allow reports whether the tenant may send another request now.
+func (t *Tenant) Allow() bool {
+	return t.limiter == nil || t.limiter.Allow()
+}
+
+// MetricLabels returns the labels of the tenant's metrics, its name as "tenant" and its Labels.
+func (t *Tenant) MetricLabels() map[string]string {
+	labels := maps.Clone(t.Labels)
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels["tenant"] = t.Name
+	return labels
+}
+
+type Registry struct {
+	tenants    []*Tenant
+	identities map[string]*Tenant // lower case email to tenant
+	tokens     tokenCache
+}
+
+// Load reads the tenants file at path.
+func Load(path string) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tenants file: %v", err)
+	}
+	var file struct {
+		Tenants []*Tenant `json:"tenants"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error unmarshalling tenants file %v: %v", path, err)
+	}
+	return NewRegistry(file.Tenants)
+}
+
+func NewRegistry(tenants []*Tenant) (*Registry, error) {
+	r := &Registry{identities: map[string]*Tenant{}}
+	names := map[string]bool{}
+	for _, t := range tenants {
+		if t.Name == "" {
+			return nil, fmt.Errorf("tenant without a name")
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("tenant %v is defined twice", t.Name)
+		}
+		names[t.Name] = true
+
+		for _, identity := range t.Identities {
+			identity = strings.ToLower(identity)
+			if other, ok := r.identities[identity]; ok {
+				return nil, fmt.Errorf("identity %v belongs to tenants %v and %v", identity, other.Name, t.Name)
+			}
+			r.identities[identity] = t
+		}
+		for _, cidr := range t.Cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("tenant %v: %v", t.Name, err)
+			}
+			t.networks = append(t.networks, network)
+		}
+		for bucket, format := range t.Formats {
+			if format != keymap.FormatTink && format != keymap.FormatCsek {
+				return nil, fmt.Errorf("tenant %v: unknown envelope format %q for bucket %v", t.Name, format, bucket)
+			}
+		}
+
+		if t.RequestsPerSecond < 0 || t.Burst < 0 {
+			return nil, fmt.Errorf("tenant %v: rate limits must not be negative", t.Name)
+		}
+		if t.RequestsPerSecond > 0 {
+			burst := t.Burst
+			if burst == 0 {
+				burst = int(t.RequestsPerSecond + 0.999)
+			}
+			t.limiter = rate.NewLimiter(rate.Limit(t.RequestsPerSecond), burst)
+		}
+		r.tenants = append(r.tenants, t)
+	}
+	return r, nil
+}
+
+func (r *Registry) Tenants() []*Tenant {
+	return r.tenants
+}
+
+// Identify returns the tenant of a client, nil when it belongs to none. The identity of the
+// bearer token in authHeader wins over the source address, the most specific network wins
+// when several tenants match the address.
+func (r *Registry) Identify(clientIP net.IP, authHeader string) *Tenant {
+	if len(r.identities) > 0 {
+		if token, ok := strings.CutPrefix(authHeader, "Bearer "); ok {
+			if t, ok := r.identities[r.tokens.email(token)]; ok {
+				return t
+			}
+		}
+	}
+
+	var found *Tenant
+	longest := -1
+	for _, t := range r.tenants {
+		for _, network := range t.networks {
+			if ones, _ := network.Mask.Size(); ones > longest && network.Contains(clientIP) {
+				found, longest = t, ones
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Package policy distributes the bucket key mapping to a fleet of proxies from a central
+document, a GCS object or a Firestore document:
+
+	{
+	  "version": 12,
+	  "keys": {"my-bucket": "projects/p/locations/global/keyRings/r/cryptoKeys/k"},
+	  "fallbackKeys": {"my-bucket": ["projects/p/locations/global/keyRings/r/cryptoKeys/old"]},
+	  "formats": {"my-bucket": "tink"}
+	}
+
+Every proxy polls the document and applies it when its version is higher than the one in use,
+or equal to the pinned version.
+
+The document must carry a signature made with the configured Cloud KMS asymmetric signing key:
+the x-policy-signature metadata of a GCS object, the signature field of a Firestore document.
+Both hold the base64 signature of the exact document bytes, see Sign. Without it anyone able to
+write the policy location could map buckets to passthrough. The signed version also keeps an
+old, validly signed document from being replayed.
+*/
+package policy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/keymap"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	log "github.com/sirupsen/logrus"
+)
+
+type Document struct {
+	Version int64 `json:"version"`
+	keymap.KeyMap
+}
+
+// signedDocument is a fetched policy document before it is verified and parsed
+type signedDocument struct {
+	data      []byte
+	signature string // base64, empty when unsigned
+}
+
+// source fetches the current policy document
+type source interface {
+	fetch(ctx context.Context) (*signedDocument, error)
+}
+
+type Distributor struct {
+	config  *cfg.Config
+	source  source
+	version int64 // version in use, 0 before the first one was applied
+}
+
+// NewDistributor returns a distributor for config.PolicySource, gs://bucket/object or
+// firestore://projects/<project>/databases/<database>/documents/<path>.
+func NewDistributor(ctx context.Context, config *cfg.Config) (*Distributor, error) {
+	if config.PolicySigningKey == "" {
+		if !config.PolicyAllowUnsigned {
+			return nil, fmt.Errorf("policy_source requires policy_signing_key, or policy_allow_unsigned to accept unsigned policies")
+		}
+		log.Warnf("applying unsigned policies from %v, anyone who can write it can disable encryption", config.PolicySource)
+	}
+
+	src, err := newSource(ctx, config.PolicySource)
+	if err != nil {
+		return nil, err
+	}
+	return &Distributor{config: config, source: src}, nil
+}
+
+// Update fetches the policy document and applies it when it is newer or pinned.
+func (d *Distributor) Update(ctx context.Context) error {
+	signed, err := d.source.fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("error fetching policy from %v: %v", d.config.PolicySource, err)
+	}
+	if err := d.verify(ctx, signed); err != nil {
+		return err
+	}
+
+	var doc Document
+	if err := json.Unmarshal(signed.data, &doc); err != nil {
+		return fmt.Errorf("error unmarshalling policy from %v: %v", d.config.PolicySource, err)
+	}
+
+	pinned := d.config.PolicyVersion
+	switch {
+	case pinned != 0 && doc.Version != pinned:
+		if d.version != pinned {
+			log.Warnf("policy %v is at version %v, waiting for pinned version %v", d.config.PolicySource, doc.Version, pinned)
+		}
+		return nil
+	case doc.Version == d.version:
+		return nil
+	case doc.Version < d.version:
+		// an older document is a rollback, never apply it unless pinned
+		log.Warnf("ignoring policy version %v from %v, version %v is in use", doc.Version, d.config.PolicySource, d.version)
+		return nil
+	}
+
+	// every key must be usable before the policy replaces the one in use
+	for bucket, keyName := range doc.Keys {
+		if err := interceptor.CheckKey(ctx, bucket, keyName, doc.Format(bucket)); err != nil {
+			return fmt.Errorf("rejecting policy version %v: unable to use key %v for bucket %v: %v", doc.Version, keyName, bucket, err)
+		}
+	}
+
+	current := util.KeyMap()
+	for bucket, keyName := range current.Keys {
+		if _, ok := doc.Keys[bucket]; !ok {
+			log.Warnf("policy version %v removes bucket %v (key %v), its objects are no longer encrypted", doc.Version, bucket, keyName)
+		}
+	}
+
+	doc.KeyMap.Policy = fmt.Sprintf("%v#%v", d.config.PolicySource, doc.Version)
+	util.KeyMaps().Set(doc.KeyMap)
+	d.version = doc.Version
+	log.Infof("applied policy version %v from %v: %v buckets", doc.Version, d.config.PolicySource, len(doc.Keys))
+	return nil
+}
+
+func (d *Distributor) verify(ctx context.Context, signed *signedDocument) error {
+	if d.config.PolicySigningKey == "" {
+		return nil
+	}
+	if signed.signature == "" {
+		return fmt.Errorf("policy from %v is not signed", d.config.PolicySource)
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.signature)
+	if err != nil {
+		return fmt.Errorf("invalid policy signature encoding: %v", err)
+	}
+	if err := crypto.VerifySignature(ctx, d.config.PolicySigningKey, signed.data, signature); err != nil {
+		return fmt.Errorf("policy from %v failed verification: %v", d.config.PolicySource, err)
+	}
+	return nil
+}
+
+// Sign returns the base64 signature of a policy document made with the KMS asymmetric signing
+// key version keyVersionName.
+func Sign(ctx context.Context, keyVersionName string, data []byte) (string, error) {
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return "", fmt.Errorf("invalid policy document: %v", err)
+	}
+	if doc.Version <= 0 {
+		return "", fmt.Errorf("policy document needs a positive version")
+	}
+	signature, err := crypto.SignData(ctx, keyVersionName, data)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// Poll updates the policy every interval, and whenever updated signals that it changed, until
+// ctx is done. Failures keep the policy in use.
+func (d *Distributor) Poll(ctx context.Context, interval time.Duration, updated <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-updated:
+			log.Debugf("policy %v changed, fetching it", d.config.PolicySource)
+		}
+		if err := d.Update(ctx); err != nil {
+			log.Errorf("policy update failed, keeping version %v: %v", d.version, err)
+		}
+	}
+}
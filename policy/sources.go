@@ -0,0 +1,120 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package policy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"google.golang.org/api/firestore/v1"
+)
+
+const signatureMetadataKey = "x-policy-signature"
+
+func newSource(ctx context.Context, location string) (source, error) {
+	switch {
+	case strings.HasPrefix(location, "gs://"):
+		bucket, object, err := util.ParseGcsUrl(location)
+		if err != nil {
+			return nil, err
+		}
+		if object == "" {
+			return nil, fmt.Errorf("missing object name in policy source %q", location)
+		}
+		client, err := gcsclient.Storage()
+		if err != nil {
+			return nil, err
+		}
+		return &gcsSource{client: client, bucket: bucket, object: object}, nil
+
+	case strings.HasPrefix(location, "firestore://"):
+		name := strings.TrimPrefix(location, "firestore://")
+		if !strings.HasPrefix(name, "projects/") || !strings.Contains(name, "/documents/") {
+			return nil, fmt.Errorf("expected firestore://projects/<project>/databases/<database>/documents/<path>, got %q", location)
+		}
+		service, err := firestore.NewService(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create firestore client: %v", err)
+		}
+		return &firestoreSource{service: service, name: name}, nil
+	}
+	return nil, fmt.Errorf("unsupported policy source %q, expected gs:// or firestore://", location)
+}
+
+// gcsSource reads the policy from an object, the signature from its metadata
+type gcsSource struct {
+	client *storage.Client
+	bucket string
+	object string
+}
+
+func (s *gcsSource) fetch(ctx context.Context) (*signedDocument, error) {
+	obj := s.client.Bucket(s.bucket).Object(s.object)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// read the generation the signature belongs to
+	reader, err := obj.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &signedDocument{data: data, signature: attrs.Metadata[signatureMetadataKey]}, nil
+}
+
+// firestoreSource reads the policy from the string field "policy" of a document and the
+// signature from its string field "signature"
+type firestoreSource struct {
+	service *firestore.Service
+	name    string
+}
+
+func (s *firestoreSource) fetch(ctx context.Context) (*signedDocument, error) {
+	doc, err := s.service.Projects.Databases.Documents.Get(s.name).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	policy, ok := doc.Fields["policy"]
+	if !ok || policy.StringValue == "" {
+		return nil, fmt.Errorf("document %v has no policy field", s.name)
+	}
+	return &signedDocument{data: []byte(policy.StringValue), signature: doc.Fields["signature"].StringValue}, nil
+}
+
+// Publish uploads a policy document and its signature to gs://bucket/object.
+func Publish(ctx context.Context, location string, data []byte, signature string) error {
+	bucket, object, err := util.ParseGcsUrl(location)
+	if err != nil {
+		return err
+	}
+	if object == "" {
+		return fmt.Errorf("missing object name in %q", location)
+	}
+	client, err := gcsclient.Storage()
+	if err != nil {
+		return err
+	}
+
+	writer := client.Bucket(bucket).Object(object).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	writer.Metadata = map[string]string{signatureMetadataKey: signature}
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return fmt.Errorf("error writing policy: %v", err)
+	}
+	return writer.Close()
+}
@@ -0,0 +1,430 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsrewrite"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// bucketMapping is the admin API representation of a bucket's encryption
+type bucketMapping struct {
+	Key    string `json:"key"`
+	Format string `json:"format"`
+}
+
+// bucketOverhead is the admin API representation of what encryption added to a bucket
+type bucketOverhead struct {
+	interceptor.Overhead
+	OverheadBytes int64   `json:"overheadBytes"`
+	OverheadRatio float64 `json:"overheadRatio"` // of the plaintext bytes
+}
+
+// bucketStats is the admin API representation of the requests to a bucket since the start
+type bucketStats struct {
+	interceptor.BucketStats
+	AverageLatencyMs float64 `json:"averageLatencyMs"`
+}
+
+// proxyStatus is the admin API representation of the proxy's mode
+type proxyStatus struct {
+	Version            string `json:"version"`
+	Profile            string `json:"profile,omitempty"` // applied from -config_file
+	EncryptionDisabled bool   `json:"encryptionDisabled"`
+	PlaintextRequests  int64  `json:"plaintextRequests"` // passed through since the start because encryption is disabled
+	WriteOnly          bool   `json:"writeOnly"`
+	Bypasses           int    `json:"bypasses"` // buckets in an emergency bypass
+
+	AesAcceleration crypto.Acceleration `json:"aesAcceleration"`
+}
+
+// bypassRequest is the admin API body starting an emergency bypass
+type bypassRequest struct {
+	Reason      string `json:"reason"`
+	Duration    string `json:"duration"` // e.g. 30m, at most config.BypassMaxDuration
+	RequestedBy string `json:"requestedBy"`
+}
+
+type adminApi struct {
+	config *cfg.Config
+	flows  *flowFeed
+	audit  *AuditLog // nil without -audit_log
+}
+
+/*
+startAdminApi serves the bucket onboarding API on ln, bound to config.AdminAddr:
+
+	GET    /v1/buckets           list the mapped buckets
+	GET    /v1/buckets/{bucket}   get one mapping
+	PUT    /v1/buckets/{bucket}   map a bucket, body {"key": "projects/...", "format": "tink"}
+	DELETE /v1/buckets/{bucket}   stop encrypting a bucket
+	GET    /v1/flows[?bucket=b]   stream the finished flows as JSON lines, see FlowEvent
+	GET    /v1/flows/history      search the flows of -flow_history, newest first, see searchFlows
+	GET    /v1/overhead           the bytes encryption added to the uploads of every bucket
+	GET    /v1/uploads            the uploads being sent to GCS and how far they are, see uploadStatus
+	GET    /v1/stats              the requests, bytes, KMS calls and failures of every mapped bucket, see interceptor.BucketStats
+	GET    /v1/status             the profile, whether encryption is disabled and AES is accelerated, see proxyStatus
+	GET    /v1/bypasses           list the emergency bypasses
+	PUT    /v1/bypasses/{bucket}  stop encrypting a bucket for a while, body {"reason": "...", "duration": "30m", "requestedBy": "..."}
+	DELETE /v1/bypasses/{bucket}  end a bypass before it expires
+	GET    /v1/fetch              the decrypted object ?bucket=b&object=o[&generation=g]&reason=..., with -admin_fetch
+	GET    /v1/objects            list ?bucket=b[&prefix=p][&pageToken=t][&limit=n] with the encryption of the objects, see objectStatus
+	GET    /ui/objects            the object browser page calling /v1/objects and /v1/fetch
+
+Every request but for the page needs the header "Authorization: Bearer <config.AdminToken>".
+The routes are described by docs/admin-api.yaml and called by pkg/adminclient, change all three
+together.
+*/
+func startAdminApi(config *cfg.Config, flows *flowFeed, audit *AuditLog, ln net.Listener) (*http.Server, error) {
+	if config.AdminToken == "" {
+		return nil, fmt.Errorf("the admin API requires -admin_token or GCS_PROXY_ADMIN_TOKEN")
+	}
+	api := &adminApi{config: config, flows: flows, audit: audit}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/buckets", api.listBuckets)
+	mux.HandleFunc("GET /v1/buckets/{bucket}", api.getBucket)
+	mux.HandleFunc("PUT /v1/buckets/{bucket}", api.putBucket)
+	mux.HandleFunc("DELETE /v1/buckets/{bucket}", api.deleteBucket)
+	mux.HandleFunc("GET /v1/flows", api.streamFlows)
+	mux.HandleFunc("GET /v1/flows/history", api.searchFlows)
+	mux.HandleFunc("GET /v1/overhead", api.getOverhead)
+	mux.HandleFunc("GET /v1/uploads", api.listUploads)
+	mux.HandleFunc("GET /v1/stats", api.getStats)
+	mux.HandleFunc("GET /v1/status", api.getStatus)
+	mux.HandleFunc("GET /v1/bypasses", api.listBypasses)
+	mux.HandleFunc("PUT /v1/bypasses/{bucket}", api.putBypass)
+	mux.HandleFunc("DELETE /v1/bypasses/{bucket}", api.deleteBypass)
+	mux.HandleFunc("GET /v1/fetch", api.fetchObject)
+	mux.HandleFunc("GET /v1/objects", api.listObjects)
+
+	root := http.NewServeMux()
+	root.HandleFunc("GET /ui/objects", api.objectBrowser)
+	root.Handle("/", api.authenticate(mux))
+	server := &http.Server{Handler: root}
+	go func() {
+		log.Infof("admin API listening on %v", config.AdminAddr)
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			log.Fatalf("admin API stopped: %v", err)
+		}
+	}()
+	return server, nil
+}
+
+func (a *adminApi) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.config.AdminToken)) != 1 {
+			log.Warnf("admin API: rejected unauthenticated %v %v from %v", r.Method, r.URL.Path, r.RemoteAddr)
+			writeJson(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *adminApi) listBuckets(w http.ResponseWriter, r *http.Request) {
+	keyMap := util.KeyMap()
+	buckets := make(map[string]bucketMapping, len(keyMap.Keys))
+	for bucket, key := range keyMap.Keys {
+		buckets[bucket] = bucketMapping{Key: key, Format: keyMap.Format(bucket)}
+	}
+	writeJson(w, http.StatusOK, buckets)
+}
+
+func (a *adminApi) getBucket(w http.ResponseWriter, r *http.Request) {
+	bucket := r.PathValue("bucket")
+	keyMap := util.KeyMap()
+	key, ok := keyMap.Keys[bucket]
+	if !ok {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("bucket %v is not mapped", bucket)})
+		return
+	}
+	writeJson(w, http.StatusOK, bucketMapping{Key: key, Format: keyMap.Format(bucket)})
+}
+
+func (a *adminApi) putBucket(w http.ResponseWriter, r *http.Request) {
+	bucket := r.PathValue("bucket")
+	var mapping bucketMapping
+	if err := json.NewDecoder(r.Body).Decode(&mapping); err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid mapping: %v", err)})
+		return
+	}
+	if mapping.Key == "" {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "missing key"})
+		return
+	}
+	if mapping.Format == "" {
+		mapping.Format = util.EnvelopeFormatTink
+	}
+
+	// the same check as at startup, a bucket is only onboarded once the proxy can use its key
+	if err := interceptor.CheckKey(r.Context(), bucket, mapping.Key, mapping.Format); err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("unable to use key %v: %v", mapping.Key, err)})
+		return
+	}
+
+	util.KeyMaps().SetBucket(bucket, mapping.Key, mapping.Format)
+	log.Infof("admin API: mapped bucket %v to key %v (%v)", bucket, mapping.Key, mapping.Format)
+	if err := a.save(); err != nil {
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, http.StatusOK, mapping)
+}
+
+func (a *adminApi) deleteBucket(w http.ResponseWriter, r *http.Request) {
+	bucket := r.PathValue("bucket")
+	if _, ok := util.KeyMap().Keys[bucket]; !ok {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("bucket %v is not mapped", bucket)})
+		return
+	}
+
+	util.KeyMaps().DeleteBucket(bucket)
+	log.Warnf("admin API: removed bucket %v, its objects are no longer encrypted or decrypted", bucket)
+	if err := a.save(); err != nil {
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// streamFlows writes a JSON line for every finished flow until the client disconnects
+func (a *adminApi) streamFlows(w http.ResponseWriter, r *http.Request) {
+	events, cancel := a.flows.subscribe(r.URL.Query()["bucket"])
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event := <-events:
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// searchFlows answers the flows of the history selected by the parameters bucket (repeatable),
+// object (a substring of the name), status, action, errors=true, since and until (RFC 3339) and
+// limit
+func (a *adminApi) searchFlows(w http.ResponseWriter, r *http.Request) {
+	if a.flows.history == nil {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": "the flow history is disabled, start the proxy with -flow_history"})
+		return
+	}
+	params := r.URL.Query()
+	q := flowQuery{Buckets: params["bucket"], Object: params.Get("object"), Action: params.Get("action")}
+	var err error
+	parse := func(name string, value func(string) error) {
+		if s := params.Get(name); s != "" && err == nil {
+			if err = value(s); err != nil {
+				err = fmt.Errorf("invalid %v: %v", name, err)
+			}
+		}
+	}
+	parse("status", func(s string) (err error) { q.Status, err = strconv.Atoi(s); return })
+	parse("errors", func(s string) (err error) { q.Errors, err = strconv.ParseBool(s); return })
+	parse("since", func(s string) (err error) { q.Since, err = time.Parse(time.RFC3339, s); return })
+	parse("until", func(s string) (err error) { q.Until, err = time.Parse(time.RFC3339, s); return })
+	parse("limit", func(s string) (err error) { q.Limit, err = strconv.Atoi(s); return })
+	if err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, http.StatusOK, a.flows.history.search(q))
+}
+
+func (a *adminApi) getOverhead(w http.ResponseWriter, r *http.Request) {
+	buckets := map[string]bucketOverhead{}
+	for bucket, o := range interceptor.Overheads() {
+		buckets[bucket] = bucketOverhead{Overhead: o, OverheadBytes: o.Bytes(), OverheadRatio: o.Ratio()}
+	}
+	writeJson(w, http.StatusOK, buckets)
+}
+
+func (a *adminApi) listUploads(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, uploadsInProgress())
+}
+
+func (a *adminApi) getStats(w http.ResponseWriter, r *http.Request) {
+	buckets := map[string]bucketStats{}
+	for bucket, s := range interceptor.AllBucketStats() {
+		buckets[bucket] = bucketStats{BucketStats: s, AverageLatencyMs: float64(s.AverageLatency().Microseconds()) / 1000}
+	}
+	writeJson(w, http.StatusOK, buckets)
+}
+
+func (a *adminApi) getStatus(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, proxyStatus{
+		Version:            a.config.GCSProxyVersion,
+		Profile:            a.config.Profile,
+		EncryptionDisabled: a.config.EncryptDisabled,
+		PlaintextRequests:  interceptor.DisabledRequests(),
+		WriteOnly:          a.config.WriteOnly,
+		Bypasses:           len(interceptor.Bypasses()),
+		AesAcceleration:    crypto.HardwareAcceleration(),
+	})
+}
+
+func (a *adminApi) listBypasses(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, interceptor.Bypasses())
+}
+
+func (a *adminApi) putBypass(w http.ResponseWriter, r *http.Request) {
+	bucket := r.PathValue("bucket")
+	var request bypassRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid bypass: %v", err)})
+		return
+	}
+	if strings.TrimSpace(request.Reason) == "" {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "missing reason"})
+		return
+	}
+	duration, err := time.ParseDuration(request.Duration)
+	if err != nil || duration <= 0 || duration > a.config.BypassMaxDuration {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("duration must be positive and at most %v, got %q", a.config.BypassMaxDuration, request.Duration)})
+		return
+	}
+	if _, ok := util.KeyMap().Keys[bucket]; !ok {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("bucket %v is not mapped", bucket)})
+		return
+	}
+
+	b, err := interceptor.StartBypass(bucket, request.Reason, request.RequestedBy, duration, remoteHost(r))
+	if err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, http.StatusOK, b)
+}
+
+func (a *adminApi) deleteBypass(w http.ResponseWriter, r *http.Request) {
+	bucket := r.PathValue("bucket")
+	if _, ok := interceptor.EndBypass(bucket, remoteHost(r)); !ok {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("bucket %v is not bypassed", bucket)})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fetchObject answers the plaintext of a generation of ?bucket=&object=, the live one unless
+// generation is given, decrypted with the proxy's own credentials. It lets operators inspect data
+// without setting up a client to use the proxy. reason is mandatory, every fetch is logged and
+// audited with requestedBy.
+func (a *adminApi) fetchObject(w http.ResponseWriter, r *http.Request) {
+	if !a.config.AdminFetch {
+		writeJson(w, http.StatusNotFound, map[string]string{"error": "fetching objects is disabled, start the proxy with -admin_fetch"})
+		return
+	}
+	params := r.URL.Query()
+	bucket, object, reason := params.Get("bucket"), params.Get("object"), strings.TrimSpace(params.Get("reason"))
+	if bucket == "" || object == "" {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "missing bucket or object"})
+		return
+	}
+	if reason == "" {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "missing reason"})
+		return
+	}
+	var generation int64
+	if g := params.Get("generation"); g != "" {
+		var err error
+		if generation, err = strconv.ParseInt(g, 10, 64); err != nil || generation < 0 {
+			writeJson(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid generation %q", g)})
+			return
+		}
+	}
+	if a.config.WriteOnly {
+		writeJson(w, http.StatusForbidden, map[string]string{"error": "the proxy is write-only and does not decrypt objects"})
+		return
+	}
+
+	requestedBy := params.Get("requestedBy")
+	log.Warnf("admin API: break-glass fetch of gs://%v/%v by %v from %v: %v", bucket, object, requestedBy, remoteHost(r), reason)
+	plaintext, attrs, err := hdl.FetchObject(r.Context(), bucket, object, generation)
+	status := http.StatusOK
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		status = http.StatusNotFound
+	case err != nil:
+		status = http.StatusInternalServerError
+	}
+	if a.audit != nil {
+		if attrs != nil {
+			generation = attrs.Generation
+		}
+		a.audit.auditFetch(remoteHost(r), requestedBy, reason, bucket, object, generation, status)
+	}
+	if err != nil {
+		log.Errorf("admin API: unable to fetch gs://%v/%v: %v", bucket, object, err)
+		writeJson(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+
+	contentType := attrs.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if attrs.ContentEncoding != "" {
+		w.Header().Set("Content-Encoding", attrs.ContentEncoding)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(plaintext)))
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(attrs.Generation, 10))
+	w.WriteHeader(http.StatusOK)
+	w.Write(plaintext)
+}
+
+// remoteHost is the address of the admin API caller without its port
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// save persists the mappings when a mappings file is configured
+func (a *adminApi) save() error {
+	if a.config.AdminMappingsFile == "" {
+		return nil
+	}
+	if err := util.KeyMaps().SaveFile(a.config.AdminMappingsFile); err != nil {
+		return fmt.Errorf("mapping applied but not saved: %v", err)
+	}
+	return nil
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("admin API: error writing response: %v", err)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/redact"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditRecord is one IAM or ACL change sent through the proxy, a line of the audit log
+type AuditRecord struct {
+	Time     time.Time       `json:"time"`
+	Client   string          `json:"client"`             // address of the client
+	Identity string          `json:"identity,omitempty"` // email of the client's access token
+	Tenant   string          `json:"tenant,omitempty"`
+	Method   string          `json:"method"`
+	Url      string          `json:"url"`
+	Bucket   string          `json:"bucket,omitempty"`
+	Object   string          `json:"object,omitempty"`
+	Resource string          `json:"resource"` // iam, acl, defaultObjectAcl, objectAcl, bucket, object, bypass or fetch
+	Status   int             `json:"status"`   // 0 when the call did not get a response
+	Change   json.RawMessage `json:"change,omitempty"`
+}
+
+// AuditLog appends the IAM policy and ACL changes clients send to GCS through the proxy to a
+// JSON lines file, with who sent them. Reads are not recorded, nothing is modified.
+type AuditLog struct {
+	proxy.BaseAddon
+	mu  sync.Mutex
+	out *os.File
+}
+
+func NewAuditLog(filename string) (*AuditLog, error) {
+	out, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %v", err)
+	}
+	return &AuditLog{out: out}, nil
+}
+
+// Request runs once the tenant addon identified the client, before the interceptor rewrites
+// the request
+func (a *AuditLog) Request(f *proxy.Flow) {
+	if !util.IsGcsHost(f.Request.URL.Host) {
+		return
+	}
+	resource, object := auditedResource(f.Request)
+	if resource == "" {
+		return
+	}
+	record := &AuditRecord{
+		Method:   f.Request.Method,
+		Url:      redact.URL(f.Request.URL),
+		Bucket:   util.GetBucketNameFromRequestUri(f.Request.URL.Path),
+		Object:   object,
+		Resource: resource,
+	}
+	if ip := clientIP(f); ip != nil {
+		record.Client = ip.String()
+	}
+	if t := tenant.Of(f); t != nil {
+		record.Tenant = t.Name
+	}
+	if resource != "object" && json.Valid(f.Request.Body) {
+		// the new policy or ACL, object resources may carry much more
+		record.Change = json.RawMessage(redact.String(string(f.Request.Body)))
+	}
+	authHeader := f.Request.Header.Get("Authorization")
+	go func() {
+		<-f.Done()
+		record.Time = time.Now()
+		record.Identity = tenant.Email(authHeader)
+		if f.Response != nil {
+			record.Status = f.Response.StatusCode
+		}
+		a.write(record)
+	}()
+}
+
+// bypassMethods are the admin API methods of the bypass events, an expiry has none
+var bypassMethods = map[string]string{"start": http.MethodPut, "end": http.MethodDelete}
+
+// auditBypass records an emergency bypass starting, ending or expiring, with the reason and who
+// the admin API caller said requested it
+func (a *AuditLog) auditBypass(event string, client string, b interceptor.Bypass) {
+	change, err := json.Marshal(struct {
+		Event  string             `json:"event"`
+		Bypass interceptor.Bypass `json:"bypass"`
+	}{event, b})
+	if err != nil {
+		log.Errorf("error marshalling audit record: %v", err)
+		return
+	}
+	a.write(&AuditRecord{
+		Time:     time.Now(),
+		Client:   client,
+		Identity: b.RequestedBy,
+		Method:   bypassMethods[event],
+		Url:      "/v1/bypasses/" + url.PathEscape(b.Bucket),
+		Bucket:   b.Bucket,
+		Resource: "bypass",
+		Change:   change,
+	})
+}
+
+// auditFetch records a break-glass fetch of a decrypted object through the admin API, with the
+// reason and who the caller said requested it
+func (a *AuditLog) auditFetch(client string, requestedBy string, reason string, bucket string, object string, generation int64, status int) {
+	change, err := json.Marshal(struct {
+		Reason     string `json:"reason"`
+		Generation int64  `json:"generation,omitempty"`
+	}{reason, generation})
+	if err != nil {
+		log.Errorf("error marshalling audit record: %v", err)
+		return
+	}
+	a.write(&AuditRecord{
+		Time:     time.Now(),
+		Client:   client,
+		Identity: requestedBy,
+		Method:   http.MethodGet,
+		Url:      "/v1/fetch?" + url.Values{"bucket": {bucket}, "object": {object}}.Encode(),
+		Bucket:   bucket,
+		Object:   object,
+		Resource: "fetch",
+		Status:   status,
+		Change:   change,
+	})
+}
+
+func (a *AuditLog) write(record *AuditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("error marshalling audit record: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		log.Errorf("error writing audit log: %v", err)
+	}
+}
+
+// auditedResource returns what an IAM or ACL change sets and the object it is about, "" for
+// any other request:
+//
+//	PUT    /storage/v1/b/bucket/iam                      iam
+//	POST   /storage/v1/b/bucket/acl, defaultObjectAcl    acl, defaultObjectAcl
+//	DELETE /storage/v1/b/bucket/o/object/acl/entity      objectAcl
+//	PATCH  /storage/v1/b/bucket with acl fields          bucket
+//	POST   /upload/storage/v1/b/bucket/o?predefinedAcl=  object
+//	PUT    /bucket/object?acl                            acl (XML API)
+func auditedResource(r *proxy.Request) (resource string, object string) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodConnect {
+		return "", ""
+	}
+	query := r.URL.Query()
+	path := r.URL.EscapedPath()
+
+	if jsonPath, ok := strings.CutPrefix(path, "/storage/v1/b/"); ok {
+		segments := strings.Split(jsonPath, "/")
+		if len(segments) >= 3 && segments[1] == "o" {
+			object, _ = url.PathUnescape(segments[2])
+		}
+		switch {
+		case len(segments) >= 2 && (segments[1] == "iam" || segments[1] == "acl" || segments[1] == "defaultObjectAcl"):
+			return segments[1], ""
+		case len(segments) >= 4 && segments[1] == "o" && segments[3] == "acl":
+			return "objectAcl", object
+		case len(segments) == 1 && (setsAcl(r, query) || query.Has("predefinedDefaultObjectAcl") || bodyHas(r, "defaultObjectAcl", "iamConfiguration")):
+			return "bucket", ""
+		case len(segments) == 3 && segments[1] == "o" && setsAcl(r, query):
+			return "object", object
+		}
+		return "", ""
+	}
+	if path == "/storage/v1/b" && (setsAcl(r, query) || query.Has("predefinedDefaultObjectAcl")) {
+		// a new bucket with an ACL
+		return "bucket", ""
+	}
+	if strings.HasPrefix(path, "/upload/storage/v1/b/") || strings.HasPrefix(path, "/resumable/upload/storage/v1/b/") {
+		if query.Has("predefinedAcl") {
+			return "object", query.Get("name")
+		}
+		return "", ""
+	}
+
+	// XML API, /bucket/object
+	object = util.GetObjectNameFromRequestUri(r.URL.Path)
+	if query.Has("acl") || query.Has("iam") || query.Has("defaultObjectAcl") {
+		return "acl", object
+	}
+	if r.Header.Get("X-Goog-Acl") != "" {
+		return "object", object
+	}
+	return "", ""
+}
+
+func setsAcl(r *proxy.Request, query url.Values) bool {
+	return query.Has("predefinedAcl") || bodyHas(r, "acl")
+}
+
+// bodyHas reports whether the JSON resource in the request body sets one of fields
+func bodyHas(r *proxy.Request, fields ...string) bool {
+	var resource map[string]json.RawMessage
+	if json.Unmarshal(r.Body, &resource) != nil {
+		return false
+	}
+	for _, field := range fields {
+		if _, ok := resource[field]; ok {
+			return true
+		}
+	}
+	return false
+}
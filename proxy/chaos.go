@@ -0,0 +1,65 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ChaosAddon fails flows on purpose so applications can be tested against a degraded proxy:
+a share of the requests is answered with a GCS style 503 instead of being sent upstream, and
+a share of the response bodies is cut short. It must be added after the interceptor addons,
+the request is encrypted before it fails and truncation applies to the body the client gets.
+*/
+type ChaosAddon struct {
+	proxy.BaseAddon
+	upstreamErrorRate float64
+	truncateRate      float64
+}
+
+func NewChaosAddon(upstreamErrorRate float64, truncateRate float64) *ChaosAddon {
+	return &ChaosAddon{upstreamErrorRate: upstreamErrorRate, truncateRate: truncateRate}
+}
+
+func (c *ChaosAddon) Request(f *proxy.Flow) {
+	if f.Response != nil || rand.Float64() >= c.upstreamErrorRate {
+		return
+	}
+	log.Warnf("chaos: failing %v %v with 503", f.Request.Method, f.Request.URL)
+	body, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    http.StatusServiceUnavailable,
+			"message": "Backend Error",
+			"errors": []map[string]interface{}{{
+				"domain":  "gcs-proxy-chaos",
+				"reason":  "backendError",
+				"message": "injected by gcs-proxy chaos mode",
+			}},
+		},
+	})
+	f.Response = &proxy.Response{StatusCode: http.StatusServiceUnavailable, Header: make(http.Header), Body: body}
+	f.Response.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	f.Response.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// Response keeps the Content-Length of the whole body and sends part of it, the client sees
+// the connection close early like a network failure in the middle of a download
+func (c *ChaosAddon) Response(f *proxy.Flow) {
+	if len(f.Response.Body) == 0 || rand.Float64() >= c.truncateRate {
+		return
+	}
+	size := rand.Intn(len(f.Response.Body))
+	log.Warnf("chaos: truncating the response of %v %v to %v of %v bytes", f.Request.Method, f.Request.URL, size, len(f.Response.Body))
+	f.Response.Header.Set("Content-Length", strconv.Itoa(len(f.Response.Body)))
+	f.Response.Body = f.Response.Body[:size]
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// clientRequests keeps a copy of each request as the client sent it, before the interceptor
+// rewrites it for GCS. Addons recording flows must be added before the interceptor addons.
+type clientRequests struct {
+	requests sync.Map // flow id -> *proxy.Request
+}
+
+func (c *clientRequests) record(f *proxy.Flow, withBody bool) {
+	u := *f.Request.URL
+	r := &proxy.Request{
+		Method: f.Request.Method,
+		URL:    &u,
+		Proto:  f.Request.Proto,
+		Header: f.Request.Header.Clone(),
+	}
+	if withBody {
+		r.Body = bytes.Clone(f.Request.Body)
+	}
+	c.requests.Store(f.Id, r)
+}
+
+// get returns the client's request, f.Request when none was recorded, e.g. for streamed bodies
+func (c *clientRequests) get(f *proxy.Flow) *proxy.Request {
+	if r, ok := c.requests.Load(f.Id); ok {
+		return r.(*proxy.Request)
+	}
+	return f.Request
+}
+
+func (c *clientRequests) forget(f *proxy.Flow) {
+	c.requests.Delete(f.Id)
+}
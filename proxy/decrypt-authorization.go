@@ -0,0 +1,101 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/logsample"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+DecryptAuthorization answers with a GCS style 403 when a client downloads an object the
+decrypt clients of the key map don't allow it to read in plaintext, before the interceptor
+calls KMS. It restricts the clients on top of the proxy's own KMS permissions, which every
+client shares: analytics hosts may read bucket-a but never bucket-b.
+
+Clients match by address or CIDR, by the email of their access token, by tenant:NAME or by *.
+*/
+type DecryptAuthorization struct {
+	proxy.BaseAddon
+}
+
+func NewDecryptAuthorization() *DecryptAuthorization {
+	return &DecryptAuthorization{}
+}
+
+func (a *DecryptAuthorization) Requestheaders(f *proxy.Flow) {
+	if f.Response != nil || f.Request.Method == http.MethodConnect {
+		return
+	}
+	bucketName, objectName, decrypts := interceptor.DecryptedObject(f)
+	if !decrypts {
+		return
+	}
+	clients, ok := util.KeyMapFor(f).AllowedDecryptClients(bucketName, objectName)
+	if !ok || clientAllowed(f, clients) {
+		return
+	}
+
+	client := "unknown"
+	if ip := clientIP(f); ip != nil {
+		client = ip.String()
+	}
+	log.WithField(logsample.CategoryField, "decrypt").Warnf("client %v may not decrypt gs://%v/%v, rejecting %v %v",
+		client, bucketName, objectName, f.Request.Method, f.Request.URL.Path)
+	interceptor.GcsErrorResponse(f, http.StatusForbidden, "forbidden", fmt.Sprintf("the proxy does not decrypt gs://%v/%v for this client", bucketName, objectName))
+}
+
+// clientAllowed reports whether the client of f is one of clients
+func clientAllowed(f *proxy.Flow, clients []string) bool {
+	return clientMatches(clientIP(f), tenant.Of(f), f.Request.Header.Get("Authorization"), clients)
+}
+
+// clientMatches reports whether the client at ip, of tenant t or nil and sending authHeader, is
+// one of clients
+func clientMatches(ip net.IP, t *tenant.Tenant, authHeader string, clients []string) bool {
+	var email *string // looked up once, only for rules naming an account
+	for _, client := range clients {
+		switch {
+		case client == "*":
+			return true
+		case strings.HasPrefix(client, "tenant:"):
+			if t != nil && t.Name == strings.TrimPrefix(client, "tenant:") {
+				return true
+			}
+		case strings.Contains(client, "@"):
+			if email == nil {
+				lookedUp := tenant.Email(authHeader)
+				email = &lookedUp
+			}
+			if *email != "" && strings.EqualFold(*email, client) {
+				return true
+			}
+		case strings.Contains(client, "/"):
+			_, network, err := net.ParseCIDR(client)
+			if err != nil {
+				log.Warnf("ignoring invalid client %q: %v", client, err)
+				continue
+			}
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+		default:
+			if ip != nil && ip.Equal(net.ParseIP(client)) {
+				return true
+			}
+		}
+	}
+	return false
+}
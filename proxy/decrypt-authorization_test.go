@@ -0,0 +1,46 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
+)
+
+func TestClientMatches(t *testing.T) {
+	analytics := &tenant.Tenant{Name: "analytics"}
+	tests := []struct {
+		name    string
+		ip      string
+		tenant  *tenant.Tenant
+		clients []string
+		want    bool
+	}{
+		{name: "any client", ip: "192.0.2.1", clients: []string{"*"}, want: true},
+		{name: "no clients", ip: "192.0.2.1", clients: nil, want: false},
+		{name: "address", ip: "192.0.2.1", clients: []string{"192.0.2.1"}, want: true},
+		{name: "other address", ip: "192.0.2.2", clients: []string{"192.0.2.1"}, want: false},
+		{name: "ipv6 address", ip: "2001:db8::1", clients: []string{"2001:db8::1"}, want: true},
+		{name: "network", ip: "10.8.1.2", clients: []string{"10.8.0.0/16"}, want: true},
+		{name: "outside the network", ip: "10.9.1.2", clients: []string{"10.8.0.0/16"}, want: false},
+		{name: "invalid network", ip: "10.8.1.2", clients: []string{"10.8.0.0/99", "10.8.1.2"}, want: true},
+		{name: "unknown address", clients: []string{"10.8.0.0/16", "192.0.2.1"}, want: false},
+		{name: "tenant", ip: "192.0.2.1", tenant: analytics, clients: []string{"tenant:analytics"}, want: true},
+		{name: "other tenant", ip: "192.0.2.1", tenant: analytics, clients: []string{"tenant:etl"}, want: false},
+		{name: "no tenant", ip: "192.0.2.1", clients: []string{"tenant:analytics"}, want: false},
+		// without a bearer token no account is looked up
+		{name: "account without token", ip: "192.0.2.1", clients: []string{"etl@p.iam.gserviceaccount.com"}, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := clientMatches(net.ParseIP(test.ip), test.tenant, "", test.clients); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
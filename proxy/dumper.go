@@ -0,0 +1,132 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/redact"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// DecisionDumper writes flows in the format of the go-mitmproxy dumper, the request as the
+// client sent it and the response it received, followed by the proxy's decision for the flow
+// as one JSON line:
+//
+//	GET /storage/v1/b/bucket/o/object?alt=media HTTP/1.1
+//	...headers and bodies...
+//	Gcs-Proxy-Decision: {"intercepted":true,"method":"simpleDownload","bucket":"bucket",...}
+type DecisionDumper struct {
+	proxy.BaseAddon
+	out      io.Writer
+	level    int // 0: header 1: header + body
+	requests clientRequests
+}
+
+func NewDecisionDumperWithFilename(filename string, level int) (*DecisionDumper, error) {
+	out, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening dump file: %v", err)
+	}
+	if level != 0 && level != 1 {
+		level = 0
+	}
+	interceptor.WatchDecisions()
+	return &DecisionDumper{out: out, level: level}, nil
+}
+
+func (d *DecisionDumper) Requestheaders(f *proxy.Flow) {
+	go func() {
+		<-f.Done()
+		d.dump(f)
+		interceptor.ForgetDecision(f)
+		d.requests.forget(f)
+	}()
+}
+
+func (d *DecisionDumper) Request(f *proxy.Flow) {
+	d.requests.record(f, d.level == 1)
+}
+
+func (d *DecisionDumper) dump(f *proxy.Flow) {
+	request := d.requests.get(f)
+	buf := bytes.NewBuffer(make([]byte, 0))
+	fmt.Fprintf(buf, "%s %s %s\r\n", request.Method, redact.String(request.URL.RequestURI()), request.Proto)
+	fmt.Fprintf(buf, "Host: %s\r\n", request.URL.Host)
+	if len(f.Request.Raw().TransferEncoding) > 0 {
+		fmt.Fprintf(buf, "Transfer-Encoding: %s\r\n", strings.Join(f.Request.Raw().TransferEncoding, ","))
+	}
+	if f.Request.Raw().Close {
+		fmt.Fprintf(buf, "Connection: close\r\n")
+	}
+	if err := redact.Header(request.Header).WriteSubset(buf, nil); err != nil {
+		log.Error(err)
+	}
+	buf.WriteString("\r\n")
+
+	if d.level == 1 && len(request.Body) > 0 && canPrint(request.Body) {
+		buf.Write(redactBody(request.Header, request.Body))
+		buf.WriteString("\r\n\r\n")
+	}
+
+	if f.Response != nil {
+		fmt.Fprintf(buf, "%v %v %v\r\n", f.Request.Proto, f.Response.StatusCode, http.StatusText(f.Response.StatusCode))
+		if err := redact.Header(f.Response.Header).WriteSubset(buf, nil); err != nil {
+			log.Error(err)
+		}
+		buf.WriteString("\r\n")
+
+		if d.level == 1 && len(f.Response.Body) > 0 && f.Response.IsTextContentType() {
+			body, err := f.Response.DecodedBody()
+			if err == nil && len(body) > 0 {
+				buf.Write(redactBody(f.Response.Header, body))
+				buf.WriteString("\r\n\r\n")
+			}
+		}
+	}
+
+	if decision, ok := interceptor.DecisionOf(f); ok {
+		record, err := json.Marshal(decision)
+		if err != nil {
+			log.Errorf("error marshalling decision: %v", err)
+		} else {
+			fmt.Fprintf(buf, "Gcs-Proxy-Decision: %s\r\n", record)
+		}
+	}
+
+	buf.WriteString("\r\n\r\n")
+
+	if _, err := d.out.Write(buf.Bytes()); err != nil {
+		log.Error(err)
+	}
+}
+
+// redactBody redacts the tokens of JSON API bodies, e.g. of the token endpoints. object data is
+// dumped as it is, dumps with bodies hold plaintext on purpose
+func redactBody(header http.Header, body []byte) []byte {
+	if !strings.Contains(header.Get("Content-Type"), "json") {
+		return body
+	}
+	return []byte(redact.String(string(body)))
+}
+
+func canPrint(content []byte) bool {
+	for _, c := range string(content) {
+		if !unicode.IsPrint(c) && !unicode.IsSpace(c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/redact"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// events buffered for a slow subscriber, further events are dropped for it
+const flowFeedBuffer = 256
+
+// FlowEvent is one finished flow as streamed by the admin API's GET /v1/flows
+type FlowEvent struct {
+	Time      time.Time             `json:"time"`
+	Method    string                `json:"method"` // HTTP method
+	Url       string                `json:"url"`
+	Status    int                   `json:"status"`    // 0 when the upstream call failed
+	LatencyMs float64               `json:"latencyMs"` // from the request headers to the end of the response
+	Decision  *interceptor.Decision `json:"decision,omitempty"`
+}
+
+// flowFeed publishes every finished flow with the proxy's decision to the subscribers and the history
+type flowFeed struct {
+	proxy.BaseAddon
+	mu          sync.Mutex
+	subscribers map[chan FlowEvent][]string // -> the buckets the subscriber follows, all when empty
+	started     sync.Map                    // flow id -> time.Time
+	requests    clientRequests
+	history     *flowHistory // nil without -flow_history
+}
+
+// newFlowFeed returns the feed of the flows, that also adds them to history unless it is nil
+func newFlowFeed(history *flowHistory) *flowFeed {
+	interceptor.WatchDecisions()
+	return &flowFeed{subscribers: map[chan FlowEvent][]string{}, history: history}
+}
+
+func (a *flowFeed) Requestheaders(f *proxy.Flow) {
+	if f.Request.Method == http.MethodConnect {
+		return
+	}
+	a.started.Store(f.Id, time.Now())
+	a.requests.record(f, false)
+	go func() {
+		<-f.Done()
+		a.publish(f)
+		a.started.Delete(f.Id)
+		a.requests.forget(f)
+		interceptor.ForgetDecision(f)
+	}()
+}
+
+func (a *flowFeed) publish(f *proxy.Flow) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.subscribers) == 0 && a.history == nil {
+		return
+	}
+
+	request := a.requests.get(f)
+	event := FlowEvent{Time: time.Now(), Method: request.Method, Url: redact.URL(request.URL)}
+	if started, ok := a.started.Load(f.Id); ok {
+		event.LatencyMs = float64(time.Since(started.(time.Time)).Microseconds()) / 1000
+	}
+	if f.Response != nil {
+		event.Status = f.Response.StatusCode
+	}
+	if decision, ok := interceptor.DecisionOf(f); ok {
+		event.Decision = decision
+	}
+	if a.history != nil {
+		a.history.add(event)
+	}
+	var bucket string
+	if event.Decision != nil {
+		bucket = event.Decision.Bucket
+	}
+	for subscriber, buckets := range a.subscribers {
+		if len(buckets) > 0 && !slices.Contains(buckets, bucket) {
+			continue
+		}
+		select {
+		case subscriber <- event:
+		default: // the client does not keep up
+		}
+	}
+}
+
+// subscribe returns the events of the flows to buckets, of every flow when buckets is empty.
+// cancel stops the subscription.
+func (a *flowFeed) subscribe(buckets []string) (events <-chan FlowEvent, cancel func()) {
+	subscriber := make(chan FlowEvent, flowFeedBuffer)
+	a.mu.Lock()
+	a.subscribers[subscriber] = buckets
+	a.mu.Unlock()
+	return subscriber, func() {
+		a.mu.Lock()
+		delete(a.subscribers, subscriber)
+		a.mu.Unlock()
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the most flows one search of the history returns
+const (
+	flowHistoryDefaultLimit = 100
+	flowHistoryMaxLimit     = 1000
+)
+
+// flowHistory keeps the finished flows in a JSON lines file, so they can be searched across
+// restarts. The flows kept are in memory too, the file is appended to and rewritten with the
+// flows kept once the dropped ones make up half of it.
+type flowHistory struct {
+	path       string
+	maxAge     time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	events  []FlowEvent // oldest first
+	file    *os.File
+	lines   int  // in the file, kept or dropped
+	failing bool // the last write failed, logged once
+}
+
+// flowQuery selects flows of the history, the zero value selects every flow
+type flowQuery struct {
+	Buckets []string  // any of these buckets, all when empty
+	Object  string    // a substring of the object name
+	Status  int       // the HTTP status, any when 0
+	Action  string    // the action of the decision, e.g. encrypt or refused
+	Errors  bool      // only the flows the proxy reported an error for
+	Since   time.Time // finished at or after
+	Until   time.Time // finished before
+	Limit   int       // the newest flows returned at most
+}
+
+// openFlowHistory loads the flows of path that are still within the retention limits, creating
+// the file when missing
+func openFlowHistory(path string, maxAge time.Duration, maxEntries int) (*flowHistory, error) {
+	h := &flowHistory{path: path, maxAge: maxAge, maxEntries: maxEntries}
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var event FlowEvent
+			// a line cut short by a crash is skipped
+			if json.Unmarshal(scanner.Bytes(), &event) == nil {
+				h.events = append(h.events, event)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading flow history %v: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading flow history %v: %v", path, err)
+	}
+	h.expire(time.Now())
+	if err := h.compact(); err != nil {
+		return nil, err
+	}
+	log.Infof("flow history %v: %v flows kept", path, len(h.events))
+	return h, nil
+}
+
+// add appends event to the history
+func (h *flowHistory) add(event FlowEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, event)
+	h.expire(event.Time)
+
+	if h.lines >= 2*len(h.events) && h.lines > 1000 {
+		err = h.compact()
+	} else if _, err = h.file.Write(append(line, '\n')); err == nil {
+		h.lines++
+	}
+	if err != nil && !h.failing {
+		log.Errorf("flow history %v: %v, flows are only kept in memory until it is writable", h.path, err)
+	}
+	h.failing = err != nil
+}
+
+// expire drops the flows beyond the retention limits at now
+func (h *flowHistory) expire(now time.Time) {
+	drop := max(len(h.events)-h.maxEntries, 0)
+	cutoff := now.Add(-h.maxAge)
+	for drop < len(h.events) && h.events[drop].Time.Before(cutoff) {
+		drop++
+	}
+	// the dropped flows are freed when append moves the slice
+	h.events = h.events[drop:]
+}
+
+// compact rewrites the file with the flows kept and appends to it from then on
+func (h *flowHistory) compact() error {
+	tmp := filepath.Join(filepath.Dir(h.path), "."+filepath.Base(h.path)+".tmp")
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing flow history: %v", err)
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, event := range h.events {
+		if err = encoder.Encode(event); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = os.Rename(tmp, h.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("error writing flow history: %v", err)
+	}
+	if h.file != nil {
+		h.file.Close()
+	}
+	// the renamed file is still open for writing, appends go to the new history
+	h.file, h.lines = file, len(h.events)
+	return nil
+}
+
+// search returns the flows q selects, newest first
+func (h *flowHistory) search(q flowQuery) []FlowEvent {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = flowHistoryDefaultLimit
+	}
+	limit = min(limit, flowHistoryMaxLimit)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	found := []FlowEvent{}
+	for i := len(h.events) - 1; i >= 0 && len(found) < limit; i-- {
+		if q.matches(&h.events[i]) {
+			found = append(found, h.events[i])
+		}
+	}
+	return found
+}
+
+func (q flowQuery) matches(event *FlowEvent) bool {
+	var bucket, object, action, errorMessage string
+	if d := event.Decision; d != nil {
+		bucket, object, action, errorMessage = d.Bucket, d.Object, d.Action, d.Error
+	}
+	switch {
+	case len(q.Buckets) > 0 && !slices.Contains(q.Buckets, bucket):
+		return false
+	case q.Object != "" && !strings.Contains(object, q.Object):
+		return false
+	case q.Status != 0 && event.Status != q.Status:
+		return false
+	case q.Action != "" && action != q.Action:
+		return false
+	case q.Errors && errorMessage == "":
+		return false
+	case !q.Since.IsZero() && event.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !event.Time.Before(q.Until):
+		return false
+	}
+	return true
+}
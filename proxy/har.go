@@ -0,0 +1,259 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/redact"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+const harRedacted = redact.Redacted
+
+// HarExporter writes the intercepted flows to a HAR 1.2 file that Chrome devtools and other
+// HAR viewers open. The file is a valid HAR document after every flow. Bodies are the ones
+// the client sent and received, i.e. plaintext, and are left out unless redactBodies is false.
+type HarExporter struct {
+	proxy.BaseAddon
+	mu           sync.Mutex
+	out          *os.File
+	entries      int
+	redactBodies bool
+	started      sync.Map // flow id -> time.Time
+	requests     clientRequests
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"` // HAR has no binary request bodies, base64 like the response content
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	Url         string         `json:"url"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime string                `json:"startedDateTime"`
+	Time            float64               `json:"time"`
+	Request         harRequest            `json:"request"`
+	Response        harResponse           `json:"response"`
+	Cache           struct{}              `json:"cache"`
+	Timings         harTimings            `json:"timings"`
+	Decision        *interceptor.Decision `json:"_gcsProxyDecision,omitempty"`
+}
+
+// the file always ends with harTrailer, each entry is written over it
+var harTrailer = []byte("\n]}}\n")
+
+func NewHarExporter(filename string, redactBodies bool, version string) (*HarExporter, error) {
+	out, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening HAR file: %v", err)
+	}
+	header := fmt.Sprintf(`{"log":{"version":"1.2","creator":{"name":"go-gcsproxy","version":%q},"entries":[`, version)
+	if _, err := out.Write(append([]byte(header), harTrailer...)); err != nil {
+		out.Close()
+		return nil, fmt.Errorf("error writing HAR file: %v", err)
+	}
+	interceptor.WatchDecisions()
+	return &HarExporter{out: out, redactBodies: redactBodies}, nil
+}
+
+func (h *HarExporter) Requestheaders(f *proxy.Flow) {
+	h.started.Store(f.Id, time.Now())
+	go func() {
+		<-f.Done()
+		h.export(f)
+		interceptor.ForgetDecision(f)
+		h.started.Delete(f.Id)
+		h.requests.forget(f)
+	}()
+}
+
+func (h *HarExporter) Request(f *proxy.Flow) {
+	h.requests.record(f, !h.redactBodies)
+}
+
+func (h *HarExporter) export(f *proxy.Flow) {
+	start := time.Now()
+	if started, ok := h.started.Load(f.Id); ok {
+		start = started.(time.Time)
+	}
+	elapsed := float64(time.Since(start).Microseconds()) / 1000
+
+	entry := harEntry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Time:            elapsed,
+		Request:         h.request(f),
+		Response:        h.response(f),
+		Timings:         harTimings{Wait: elapsed},
+	}
+	if decision, ok := interceptor.DecisionOf(f); ok {
+		entry.Decision = decision
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("error marshalling HAR entry: %v", err)
+		return
+	}
+	if err := h.append(data); err != nil {
+		log.Errorf("error writing HAR entry: %v", err)
+	}
+}
+
+// append writes entry over the trailer and writes the trailer again
+func (h *HarExporter) append(entry []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, err := h.out.Seek(-int64(len(harTrailer)), io.SeekEnd); err != nil {
+		return err
+	}
+	var data []byte
+	if h.entries > 0 {
+		data = append(data, ',')
+	}
+	data = append(data, '\n')
+	data = append(data, entry...)
+	data = append(data, harTrailer...)
+	if _, err := h.out.Write(data); err != nil {
+		return err
+	}
+	h.entries++
+	return nil
+}
+
+func (h *HarExporter) request(f *proxy.Flow) harRequest {
+	request := h.requests.get(f)
+	query := []harNameValue{}
+	for name, values := range redact.Query(request.URL.Query()) {
+		for _, value := range values {
+			query = append(query, harNameValue{Name: name, Value: value})
+		}
+	}
+	r := harRequest{
+		Method:      request.Method,
+		Url:         redact.URL(request.URL),
+		HttpVersion: request.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(request.Header),
+		QueryString: query,
+		HeadersSize: -1,
+		BodySize:    len(request.Body),
+	}
+	if len(request.Body) > 0 {
+		r.PostData = &harPostData{MimeType: request.Header.Get("Content-Type")}
+		switch {
+		case h.redactBodies:
+			r.PostData.Text = harRedacted
+		case utf8.Valid(request.Body):
+			r.PostData.Text = string(request.Body)
+		default:
+			r.PostData.Text = base64.StdEncoding.EncodeToString(request.Body)
+			r.PostData.Encoding = "base64"
+		}
+	}
+	return r
+}
+
+func (h *HarExporter) response(f *proxy.Flow) harResponse {
+	if f.Response == nil {
+		// the upstream call failed, HAR viewers show status 0 as a failed request
+		return harResponse{Cookies: []harNameValue{}, Headers: []harNameValue{}, HttpVersion: f.Request.Proto, HeadersSize: -1, BodySize: -1}
+	}
+	r := harResponse{
+		Status:      f.Response.StatusCode,
+		StatusText:  http.StatusText(f.Response.StatusCode),
+		HttpVersion: f.Request.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(f.Response.Header),
+		RedirectURL: f.Response.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    len(f.Response.Body),
+	}
+
+	body, err := f.Response.DecodedBody()
+	if err != nil {
+		body = f.Response.Body
+	}
+	r.Content = harContent{Size: len(body), MimeType: f.Response.Header.Get("Content-Type")}
+	switch {
+	case len(body) == 0:
+	case h.redactBodies:
+		r.Content.Comment = "body redacted"
+	case utf8.Valid(body):
+		r.Content.Text = string(body)
+	default:
+		r.Content.Text = base64.StdEncoding.EncodeToString(body)
+		r.Content.Encoding = "base64"
+	}
+	return r
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			if redact.Enabled() && redact.SecretHeader(name) {
+				value = harRedacted
+			}
+			headers = append(headers, harNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/logsample"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// skipEncryptHeader passes a request through as it is: an upload is stored in plaintext, a
+	// download answers the stored bytes
+	skipEncryptHeader = "X-Gcsproxy-Skip-Encrypt"
+	// keyOverrideHeader encrypts an upload with a fallback key of the bucket instead of its mapped key
+	keyOverrideHeader = "X-Gcsproxy-Key-Override"
+)
+
+/*
+HeaderOverrides lets trusted clients change the encryption of a single request: migration tools
+that copy ciphertext as it is, or pipelines that write with the new key of a rotation before it is
+mapped, without a proxy deployment of their own. Only the override clients of the request's bucket
+may send the headers, others get a 403. The headers are never sent to GCS.
+
+It must be added after the tenant addon, a tenant's own override clients apply to its requests.
+*/
+type HeaderOverrides struct {
+	proxy.BaseAddon
+}
+
+func NewHeaderOverrides() *HeaderOverrides {
+	return &HeaderOverrides{}
+}
+
+func (a *HeaderOverrides) Requestheaders(f *proxy.Flow) {
+	if f.Response != nil || f.Request.Method == http.MethodConnect {
+		return
+	}
+	skipEncrypt, keyName := f.Request.Header.Get(skipEncryptHeader), f.Request.Header.Get(keyOverrideHeader)
+	if skipEncrypt == "" && keyName == "" {
+		return
+	}
+	f.Request.Header.Del(skipEncryptHeader)
+	f.Request.Header.Del(keyOverrideHeader)
+
+	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	keyMap := util.KeyMapFor(f)
+	if !clientAllowed(f, keyMap.AllowedOverrideClients(bucketName)) {
+		client := "unknown"
+		if ip := clientIP(f); ip != nil {
+			client = ip.String()
+		}
+		log.WithField(logsample.CategoryField, "override").Warnf("client %v may not override the encryption of gs://%v, rejecting %v %v",
+			client, bucketName, f.Request.Method, f.Request.URL.Path)
+		interceptor.GcsErrorResponse(f, http.StatusForbidden, "forbidden", fmt.Sprintf("the proxy does not take encryption overrides for gs://%v from this client", bucketName))
+		return
+	}
+
+	var skip bool
+	var err error
+	if skipEncrypt != "" {
+		if skip, err = strconv.ParseBool(skipEncrypt); err != nil {
+			interceptor.GcsErrorResponse(f, http.StatusForbidden, "forbidden", fmt.Sprintf("invalid %v header %q", skipEncryptHeader, skipEncrypt))
+			return
+		}
+	}
+	switch {
+	case skip:
+		keyMap = keyMap.WithoutEncryption()
+		log.Infof("passing %v %v through unencrypted as the client requested", f.Request.Method, f.Request.URL.Path)
+	case keyName != "":
+		if keyMap, err = keyMap.WithKey(bucketName, keyName); err != nil {
+			interceptor.GcsErrorResponse(f, http.StatusForbidden, "forbidden", fmt.Sprintf("invalid %v header: %v", keyOverrideHeader, err))
+			return
+		}
+		log.Infof("encrypting %v %v with %v as the client requested", f.Request.Method, f.Request.URL.Path, keyName)
+	default:
+		// x-gcsproxy-skip-encrypt: false
+		return
+	}
+	util.OverrideKeyMap(f, keyMap)
+}
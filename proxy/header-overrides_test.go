@@ -0,0 +1,73 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/keymap"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestHeaderOverrides(t *testing.T) {
+	const (
+		mappedKey   = "projects/p/locations/global/keyRings/r/cryptoKeys/mapped"
+		fallbackKey = "projects/p/locations/global/keyRings/r/cryptoKeys/fallback"
+	)
+	util.KeyMaps().Set(keymap.KeyMap{
+		Keys:            map[string]string{"open": mappedKey, "closed": mappedKey, "cidr": mappedKey},
+		FallbackKeys:    map[string][]string{"open": {fallbackKey}},
+		OverrideClients: map[string][]string{"open": {"*"}, "cidr": {"10.0.0.0/8"}},
+	})
+
+	tests := []struct {
+		name    string
+		bucket  string
+		header  http.Header
+		status  int    // of the response the addon answers with, 0 for none
+		key     string // the key of the bucket the flow is encrypted with
+		removed bool   // the override headers are not sent to GCS
+	}{
+		{name: "no override", bucket: "closed", header: http.Header{}, key: mappedKey},
+		{name: "skip allowed", bucket: "open", header: http.Header{skipEncryptHeader: {"true"}}, key: "", removed: true},
+		{name: "skip false", bucket: "open", header: http.Header{skipEncryptHeader: {"false"}}, key: mappedKey, removed: true},
+		{name: "skip invalid", bucket: "open", header: http.Header{skipEncryptHeader: {"maybe"}}, status: http.StatusForbidden, key: mappedKey, removed: true},
+		{name: "fallback key", bucket: "open", header: http.Header{keyOverrideHeader: {fallbackKey}}, key: fallbackKey, removed: true},
+		{name: "unknown key", bucket: "open", header: http.Header{keyOverrideHeader: {"projects/p/locations/global/keyRings/r/cryptoKeys/other"}},
+			status: http.StatusForbidden, key: mappedKey, removed: true},
+		{name: "skip wins over key", bucket: "open", header: http.Header{skipEncryptHeader: {"1"}, keyOverrideHeader: {fallbackKey}}, key: "", removed: true},
+		{name: "bucket without override clients", bucket: "closed", header: http.Header{skipEncryptHeader: {"true"}},
+			status: http.StatusForbidden, key: mappedKey, removed: true},
+		{name: "client outside the network", bucket: "cidr", header: http.Header{skipEncryptHeader: {"true"}},
+			status: http.StatusForbidden, key: mappedKey, removed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u, _ := url.Parse("https://storage.googleapis.com/upload/storage/v1/b/" + test.bucket + "/o?uploadType=media&name=a.txt")
+			f := &proxy.Flow{Id: uuid.NewV4(), Request: &proxy.Request{Method: http.MethodPost, URL: u, Header: test.header}}
+			NewHeaderOverrides().Requestheaders(f)
+
+			status := 0
+			if f.Response != nil {
+				status = f.Response.StatusCode
+			}
+			if status != test.status {
+				t.Errorf("got status %v, want %v", status, test.status)
+			}
+			if key := util.KeyMapFor(f).Key(test.bucket); key != test.key {
+				t.Errorf("got key %q, want %q", key, test.key)
+			}
+			sent := f.Request.Header.Get(skipEncryptHeader) != "" || f.Request.Header.Get(keyOverrideHeader) != ""
+			if test.removed && sent {
+				t.Errorf("override headers are sent to GCS: %v", f.Request.Header)
+			}
+		})
+	}
+}
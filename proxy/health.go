@@ -0,0 +1,63 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	log "github.com/sirupsen/logrus"
+)
+
+// readiness is the body of /readyz
+type readiness struct {
+	Ready     bool                    `json:"ready"`
+	Listening bool                    `json:"listening"` // the proxy accepts client connections
+	Keys      []interceptor.KeyStatus `json:"keys"`      // the last check of every mapped key
+
+	MaxObjectSizes map[string]int64 `json:"maxObjectSizes,omitempty"` // bucket to the largest upload accepted, see ObjectSizeLimit
+}
+
+/*
+startHealthServer serves the probes of a load balancer or Kubernetes on ln, without
+authentication:
+
+	GET /healthz   200 while the process runs
+	GET /readyz    200 once the proxy listens and every mapped key passed its last check, else 503
+
+/readyz details the result of every key check, see interceptor.KeyStatus, and the upload size
+limits of -max_object_sizes.
+*/
+func startHealthServer(ln net.Listener, listening *atomic.Bool) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := readiness{Listening: listening.Load(), Keys: interceptor.KeyStatuses(), MaxObjectSizes: cfg.Current().MaxObjectSizes}
+		status.Ready = status.Listening
+		for _, key := range status.Keys {
+			status.Ready = status.Ready && key.Healthy
+		}
+		if !status.Ready {
+			writeJson(w, http.StatusServiceUnavailable, status)
+			return
+		}
+		writeJson(w, http.StatusOK, status)
+	})
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		log.Infof("health probes listening on %v", ln.Addr())
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			log.Fatalf("health probes stopped: %v", err)
+		}
+	}()
+	return server
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// listenerCertificate serves the proxy listener's certificate and loads it again when the
+// certificate or key file changes, so rotated certificates apply without a restart
+type listenerCertificate struct {
+	certFile  string
+	keyFile   string
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// files are checked for changes at most this often
+const certificateCheckInterval = 10 * time.Second
+
+func newListenerCertificate(certFile string, keyFile string) (*listenerCertificate, error) {
+	c := &listenerCertificate{certFile: certFile, keyFile: keyFile}
+	if _, err := c.get(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *listenerCertificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && time.Since(c.checkedAt) < certificateCheckInterval {
+		return c.cert, nil
+	}
+	c.checkedAt = time.Now()
+
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			log.Errorf("keeping the loaded proxy listener certificate: %v", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			log.Errorf("keeping the loaded proxy listener certificate, unable to load %v: %v", c.certFile, err)
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("unable to load the proxy listener certificate: %v", err)
+	}
+	if c.cert != nil {
+		log.Infof("loaded the rotated proxy listener certificate %v", c.certFile)
+	}
+	c.cert, c.modTime = &cert, modTime
+	return c.cert, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// withTls serves HTTPS on the TCP listeners, clients reach the proxy at https://host:port.
+// unix sockets are left alone, only processes that can open the socket file reach them.
+func withTls(listeners []net.Listener, certFile string, keyFile string) ([]net.Listener, error) {
+	cert, err := newListenerCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: cert.get,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"}, // the relay carries HTTP/1.1 to go-mitmproxy
+	}
+	wrapped := make([]net.Listener, 0, len(listeners))
+	for _, ln := range listeners {
+		if _, ok := ln.Addr().(*net.UnixAddr); ok {
+			wrapped = append(wrapped, ln)
+			continue
+		}
+		log.Infof("serving the proxy over TLS on %v", ln.Addr())
+		wrapped = append(wrapped, tls.NewListener(ln, config))
+	}
+	return wrapped, nil
+}
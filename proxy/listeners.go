@@ -0,0 +1,90 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+listen binds one listen address:
+
+	:9080                      all interfaces, IPv4 and IPv6
+	127.0.0.1:9080, [::1]:9080 one address
+	tcp4://:9080, tcp6://:9080 all interfaces of one IP version
+	unix:///run/gcsproxy.sock  a unix domain socket, created with socketMode
+*/
+func listen(addr string, socketMode string) (net.Listener, error) {
+	if path, ok := unixSocketPath(addr); ok {
+		return listenUnix(path, socketMode)
+	}
+	network := "tcp"
+	for _, prefix := range []string{"tcp4", "tcp6", "tcp"} {
+		if rest, ok := strings.CutPrefix(addr, prefix+"://"); ok {
+			network, addr = prefix, rest
+			break
+		}
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %v: %v", addr, err)
+	}
+	return ln, nil
+}
+
+func unixSocketPath(addr string) (string, bool) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		return path, true
+	}
+	return strings.CutPrefix(addr, "unix:")
+}
+
+func listenUnix(path string, socketMode string) (net.Listener, error) {
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unix socket mode %q: %v", socketMode, err)
+	}
+
+	// a socket left behind by a previous run would make the bind fail, anything else is kept
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("unable to listen on %v: the file exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket %v: %v", path, err)
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %v: %v", path, err)
+	}
+	if err := os.Chmod(path, fs.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("unable to set the mode of %v: %v", path, err)
+	}
+	log.Infof("listening on unix socket %v", path)
+	return ln, nil
+}
+
+// needsOwnListeners reports whether the proxy has to bind addrs itself, mitmproxy only binds
+// one TCP address
+func needsOwnListeners(addrs []string) bool {
+	if len(addrs) != 1 {
+		return true
+	}
+	if _, ok := unixSocketPath(addrs[0]); ok {
+		return true
+	}
+	return strings.Contains(addrs[0], "://")
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+/*
+startMetadataShim serves the part of the GCE metadata server the client libraries use for
+application default credentials on ln, for sandboxed clients that must not reach the metadata
+server or hold credentials of their own. The clients are pointed at it with
+GCE_METADATA_HOST=<addr>, their tokens are those of the proxy's identity:
+
+	GET /computeMetadata/v1/                                          the ping of the libraries
+	GET /computeMetadata/v1/project/project-id
+	GET /computeMetadata/v1/instance/service-accounts/                default/ and the email
+	GET /computeMetadata/v1/instance/service-accounts/{account}/      ?recursive=true for the JSON
+	GET /computeMetadata/v1/instance/service-accounts/{account}/email
+	GET /computeMetadata/v1/instance/service-accounts/{account}/scopes
+	GET /computeMetadata/v1/instance/service-accounts/{account}/token[?scopes=a,b]
+
+Like the metadata server every request needs the header "Metadata-Flavor: Google", which browsers
+can't send cross origin. A token is granted for the scopes it asks for, or all of scopes, and
+refused with 403 for any scope outside of them. Identity tokens and the other metadata are
+answered with 404.
+
+Clients other than those of clients, with the rules of -decrypt_clients and the tenants of
+tenants or nil, are refused with 403. Without clients the shim answers every client and only
+starts on a loopback address or a unix socket.
+*/
+func startMetadataShim(ln net.Listener, scopes []string, clients []string, tenants *tenant.Registry) (*http.Server, error) {
+	if len(clients) == 0 && !localListener(ln) {
+		return nil, fmt.Errorf("the metadata shim serves the proxy's tokens unauthenticated on %v, listen on a loopback address or a unix socket or set -metadata_shim_clients", ln.Addr())
+	}
+	credentials, err := google.FindDefaultCredentials(context.Background(), scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("the metadata shim needs application default credentials: %v", err)
+	}
+	shim := &metadataShim{credentials: credentials, scopes: scopes, email: "default", clients: clients, tenants: tenants,
+		tokens: map[string]oauth2.TokenSource{}}
+	var key struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if json.Unmarshal(credentials.JSON, &key) == nil && key.ClientEmail != "" {
+		shim.email = key.ClientEmail
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /computeMetadata/v1/{$}", func(w http.ResponseWriter, r *http.Request) {
+		writeMetadata(w, "instance/\nproject/\n")
+	})
+	mux.HandleFunc("GET /computeMetadata/v1/project/project-id", shim.projectId)
+	mux.HandleFunc("GET /computeMetadata/v1/instance/service-accounts/{$}", func(w http.ResponseWriter, r *http.Request) {
+		writeMetadata(w, "default/\n"+shim.email+"/\n")
+	})
+	mux.HandleFunc("GET /computeMetadata/v1/instance/service-accounts/{account}/{$}", shim.account(shim.describe))
+	mux.HandleFunc("GET /computeMetadata/v1/instance/service-accounts/{account}/email", shim.account(func(w http.ResponseWriter, r *http.Request) {
+		writeMetadata(w, shim.email)
+	}))
+	mux.HandleFunc("GET /computeMetadata/v1/instance/service-accounts/{account}/scopes", shim.account(func(w http.ResponseWriter, r *http.Request) {
+		writeMetadata(w, strings.Join(shim.scopes, "\n")+"\n")
+	}))
+	mux.HandleFunc("GET /computeMetadata/v1/instance/service-accounts/{account}/token", shim.account(shim.token))
+
+	server := &http.Server{Handler: shim.flavored(mux)}
+	go func() {
+		log.Infof("metadata shim listening on %v as %v", ln.Addr(), shim.email)
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			log.Fatalf("metadata shim stopped: %v", err)
+		}
+	}()
+	return server, nil
+}
+
+type metadataShim struct {
+	credentials *google.Credentials
+	scopes      []string
+	email       string // of a service account key, "default" for the other credentials
+	clients     []string
+	tenants     *tenant.Registry // nil without a tenants file
+
+	mu     sync.Mutex
+	tokens map[string]oauth2.TokenSource // sorted scopes -> cached tokens
+}
+
+// flavored answers the requests of other clients than s.clients and those without
+// "Metadata-Flavor: Google" with 403, and the others with the header, the libraries check it to
+// tell the metadata server from a captive portal
+func (s *metadataShim) flavored(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Metadata-Flavor", "Google")
+		w.Header().Set("Server", "Metadata Server for VM")
+		if !s.allowed(r) {
+			log.Warnf("metadata shim: refused %v %v from %v, see -metadata_shim_clients", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "client not allowed", http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			log.Warnf("metadata shim: refused %v %v from %v without Metadata-Flavor", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Missing Metadata-Flavor:Google header", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowed reports whether the client of r is one of s.clients, every client is without them
+func (s *metadataShim) allowed(r *http.Request) bool {
+	if len(s.clients) == 0 {
+		return true
+	}
+	var ip net.IP
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = net.ParseIP(host)
+	}
+	var t *tenant.Tenant
+	if s.tenants != nil && ip != nil {
+		t = s.tenants.Identify(ip, "")
+	}
+	// the clients asking for a token have none to identify them with
+	return clientMatches(ip, t, "", s.clients)
+}
+
+// localListener reports whether only the clients of this host reach ln
+func localListener(ln net.Listener) bool {
+	switch addr := ln.Addr().(type) {
+	case *net.UnixAddr:
+		return true
+	case *net.TCPAddr:
+		return addr.IP.IsLoopback()
+	}
+	return false
+}
+
+// account answers the requests of another service account than the proxy's with 404
+func (s *metadataShim) account(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if account := r.PathValue("account"); account != "default" && account != s.email {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *metadataShim) projectId(w http.ResponseWriter, r *http.Request) {
+	if s.credentials.ProjectID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	writeMetadata(w, s.credentials.ProjectID)
+}
+
+func (s *metadataShim) describe(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("recursive") != "true" {
+		writeMetadata(w, "aliases\nemail\nscopes\ntoken\n")
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]any{"aliases": []string{"default"}, "email": s.email, "scopes": s.scopes})
+}
+
+func (s *metadataShim) token(w http.ResponseWriter, r *http.Request) {
+	scopes := s.scopes
+	if requested := r.URL.Query().Get("scopes"); requested != "" {
+		scopes = strings.Split(requested, ",")
+		for _, scope := range scopes {
+			if !slices.Contains(s.scopes, scope) {
+				log.Warnf("metadata shim: refused a token for scope %v to %v, see -metadata_shim_scopes", scope, r.RemoteAddr)
+				http.Error(w, fmt.Sprintf("scope %v is not granted by the proxy", scope), http.StatusForbidden)
+				return
+			}
+		}
+	}
+	token, err := s.tokenSource(scopes).Token()
+	if err != nil {
+		log.Errorf("metadata shim: error getting a token for %v: %v", scopes, err)
+		http.Error(w, "error getting a token", http.StatusInternalServerError)
+		return
+	}
+	expiresIn := int64(0)
+	if !token.Expiry.IsZero() {
+		expiresIn = int64(time.Until(token.Expiry).Seconds())
+	}
+	log.Debugf("metadata shim: token for %v to %v", scopes, r.RemoteAddr)
+	writeJson(w, http.StatusOK, map[string]any{"access_token": token.AccessToken, "expires_in": expiresIn, "token_type": "Bearer"})
+}
+
+// tokenSource returns the cached tokens of the proxy's identity for scopes
+func (s *metadataShim) tokenSource(scopes []string) oauth2.TokenSource {
+	sorted := slices.Clone(scopes)
+	sort.Strings(sorted)
+	key := strings.Join(sorted, " ")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tokens, ok := s.tokens[key]; ok {
+		return tokens
+	}
+	tokens := s.credentials.TokenSource
+	if credentials, err := google.CredentialsFromJSON(context.Background(), s.credentials.JSON, sorted...); err == nil {
+		tokens = credentials.TokenSource
+	}
+	tokens = oauth2.ReuseTokenSource(nil, tokens)
+	s.tokens[key] = tokens
+	return tokens
+}
+
+func writeMetadata(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "application/text")
+	w.Write([]byte(text))
+}
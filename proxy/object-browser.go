@@ -0,0 +1,182 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+)
+
+/*
+The object browser is a page of the admin API listing a bucket with the proxy's own credentials,
+for onboarding and audits: which objects are encrypted, with which key and since when, read from
+their metadata without downloading them. The small text objects can be previewed decrypted, the
+preview is a break-glass fetch and needs -admin_fetch and a reason like any other.
+
+The page holds no data and is served without the token, it calls the API with the token typed in.
+*/
+
+//go:embed object-browser.html
+var objectBrowserPage []byte
+
+const (
+	// objects listed per page by default and at most
+	defaultListLimit = 100
+	maxListLimit     = 1000
+	// the objects larger than this are not offered for preview
+	previewMaxBytes = 64 * 1024
+)
+
+// Encryption statuses of the listed objects
+const (
+	encryptionEnvelope  = "envelope"  // encrypted by a proxy, in a Tink envelope
+	encryptionForeign   = "foreign"   // encrypted by another Tink client, see -cse_key_metadata
+	encryptionCsek      = "csek"      // encrypted by GCS with a customer-supplied key
+	encryptionPlaintext = "plaintext" // stored as is
+	encryptionEmpty     = "empty"     // empty, there is nothing to encrypt
+)
+
+// objectStatus is the admin API representation of a listed object
+type objectStatus struct {
+	Name          string    `json:"name"`
+	Generation    int64     `json:"generation"`
+	Size          int64     `json:"size"`                    // stored, the ciphertext of encrypted objects
+	PlaintextSize int64     `json:"plaintextSize,omitempty"` // of encrypted objects, when recorded
+	ContentType   string    `json:"contentType,omitempty"`
+	Updated       time.Time `json:"updated"`
+	Encryption    string    `json:"encryption"` // envelope, foreign, csek or plaintext
+	Key           string    `json:"key,omitempty"`
+	KeyVersion    string    `json:"keyVersion,omitempty"`
+	EncryptedAt   string    `json:"encryptedAt,omitempty"`
+	ProxyVersion  string    `json:"proxyVersion,omitempty"`
+	Previewable   bool      `json:"previewable"` // small text that /v1/fetch decrypts
+}
+
+// objectListing is a page of the objects of a bucket
+type objectListing struct {
+	Bucket        string         `json:"bucket"`
+	Mapped        bool           `json:"mapped"`             // the proxy encrypts the uploads to the bucket
+	Prefixes      []string       `json:"prefixes,omitempty"` // the "directories" under prefix
+	Objects       []objectStatus `json:"objects"`
+	NextPageToken string         `json:"nextPageToken,omitempty"`
+}
+
+func (a *adminApi) objectBrowser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(objectBrowserPage)
+}
+
+// listObjects answers a page of the objects of ?bucket= under prefix, one level deep, with their
+// encryption status from metadata
+func (a *adminApi) listObjects(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	bucket := params.Get("bucket")
+	if bucket == "" {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "missing bucket"})
+		return
+	}
+	limit := defaultListLimit
+	if l := params.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 || limit > maxListLimit {
+			writeJson(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("limit must be between 1 and %v, got %q", maxListLimit, l)})
+			return
+		}
+	}
+
+	client, err := gcsclient.Storage()
+	if err != nil {
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	it := util.Bucket(r.Context(), client, bucket).Objects(r.Context(), &storage.Query{Prefix: params.Get("prefix"), Delimiter: "/"})
+	var page []*storage.ObjectAttrs
+	next, err := iterator.NewPager(it, limit, params.Get("pageToken")).NextPage(&page)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrBucketNotExist) {
+			status = http.StatusNotFound
+		}
+		log.Errorf("admin API: unable to list gs://%v: %v", bucket, err)
+		writeJson(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+
+	_, mapped := util.KeyMap().Keys[bucket]
+	listing := objectListing{Bucket: bucket, Mapped: mapped, Objects: []objectStatus{}, NextPageToken: next}
+	for _, attrs := range page {
+		if attrs.Prefix != "" {
+			listing.Prefixes = append(listing.Prefixes, attrs.Prefix)
+			continue
+		}
+		listing.Objects = append(listing.Objects, a.objectStatus(attrs))
+	}
+	writeJson(w, http.StatusOK, listing)
+}
+
+// objectStatus tells how the object of attrs is encrypted from its metadata
+func (a *adminApi) objectStatus(attrs *storage.ObjectAttrs) objectStatus {
+	provenance := util.ProvenanceOf(attrs.Metadata)
+	o := objectStatus{
+		Name:        attrs.Name,
+		Generation:  attrs.Generation,
+		Size:        attrs.Size,
+		ContentType: attrs.ContentType,
+		Updated:     attrs.Updated,
+		Encryption:  encryptionPlaintext,
+	}
+	switch {
+	case attrs.CustomerKeySHA256 != "":
+		o.Encryption = encryptionCsek
+	case provenance.Key != "":
+		o.Encryption = encryptionEnvelope
+		if provenance.Foreign {
+			o.Encryption = encryptionForeign
+		}
+		o.Key, o.KeyVersion, o.EncryptedAt, o.ProxyVersion = provenance.Key, provenance.KeyVersion, provenance.EncryptedAt, provenance.ProxyVersion
+	case attrs.Size == 0:
+		o.Encryption = encryptionEmpty
+	}
+	o.PlaintextSize, _ = strconv.ParseInt(util.Meta(attrs.Metadata, util.MetaUnencryptedLength), 10, 64)
+
+	size := o.Size
+	if o.PlaintextSize > 0 {
+		size = o.PlaintextSize
+	}
+	o.Previewable = a.config.AdminFetch && !a.config.WriteOnly && size <= previewMaxBytes && isText(attrs.ContentType)
+	return o
+}
+
+// isText reports whether contentType is readable as text
+func isText(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/yaml", "application/x-yaml", "application/javascript", "application/x-ndjson":
+		return true
+	}
+	return false
+}
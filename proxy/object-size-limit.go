@@ -0,0 +1,126 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// OversizedUploads counts the uploads over -max_object_sizes rejected by bucket, set up by the
+// binary when metrics are exported.
+var OversizedUploads metric.Int64Counter
+
+/*
+ObjectSizeLimit rejects the uploads larger than -max_object_sizes allows for their bucket, before
+the proxy reads them into memory to encrypt them. The size is the one the client declares: the
+Content-Length of the request, the total of the Content-Range of a resumable upload chunk or the
+X-Upload-Content-Length of a resumable upload session, and the client gets a GCS style 413.
+
+A chunked upload declares no size, it is cut off once it is over the limit and the client gets a
+502. It must be added before the addons that read the body.
+*/
+type ObjectSizeLimit struct {
+	proxy.BaseAddon
+}
+
+func NewObjectSizeLimit() *ObjectSizeLimit {
+	return &ObjectSizeLimit{}
+}
+
+func (a *ObjectSizeLimit) Requestheaders(f *proxy.Flow) {
+	if f.Response != nil || (f.Request.Method != http.MethodPost && f.Request.Method != http.MethodPut) ||
+		!util.IsGcsHost(f.Request.URL.Host) {
+		return
+	}
+	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	limit := maxObjectSize(cfg.For(f), bucketName)
+	if limit <= 0 {
+		return
+	}
+
+	if size := declaredSize(f); size > limit {
+		message := fmt.Sprintf("gs://%v accepts uploads of at most %v bytes through the proxy, this one is %v bytes", bucketName, limit, size)
+		log.Warnf("%v, rejecting %v %v", message, f.Request.Method, f.Request.URL.Path)
+		recordOversized(bucketName)
+		setTooLargeResponse(f, message)
+		return
+	}
+	if raw := f.Request.Raw(); raw != nil && raw.ContentLength < 0 && raw.Body != nil {
+		raw.Body = &limitedBody{ReadCloser: raw.Body, remaining: limit, bucketName: bucketName, f: f}
+	}
+}
+
+// maxObjectSize returns the largest upload to bucketName config accepts, 0 when it has no limit
+func maxObjectSize(config *cfg.Config, bucketName string) int64 {
+	if size, ok := config.MaxObjectSizes[bucketName]; ok {
+		return size
+	}
+	return config.MaxObjectSizes["*"]
+}
+
+// declaredSize returns the largest size the headers of f announce for the object, -1 for none
+func declaredSize(f *proxy.Flow) int64 {
+	size := int64(-1)
+	if raw := f.Request.Raw(); raw != nil {
+		size = raw.ContentLength
+	} else if length, err := strconv.ParseInt(f.Request.Header.Get("Content-Length"), 10, 64); err == nil {
+		size = length
+	}
+	if length, err := strconv.ParseInt(f.Request.Header.Get("X-Upload-Content-Length"), 10, 64); err == nil {
+		size = max(size, length)
+	}
+	// bytes 0-8388607/1073741824, the total is * until the last chunk
+	if _, total, ok := strings.Cut(f.Request.Header.Get("Content-Range"), "/"); ok {
+		if length, err := strconv.ParseInt(total, 10, 64); err == nil {
+			size = max(size, length)
+		}
+	}
+	return size
+}
+
+// limitedBody fails the read of a request body once it is over the limit of its bucket
+type limitedBody struct {
+	io.ReadCloser
+	remaining  int64
+	bucketName string
+	f          *proxy.Flow
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		log.Warnf("chunked upload %v %v is over the size limit of gs://%v, cutting it off", b.f.Request.Method, b.f.Request.URL.Path, b.bucketName)
+		recordOversized(b.bucketName)
+		return 0, fmt.Errorf("upload over the size limit of gs://%v", b.bucketName)
+	}
+	return n, err
+}
+
+func recordOversized(bucketName string) {
+	if OversizedUploads == nil {
+		return
+	}
+	OversizedUploads.Add(context.Background(), 1, metric.WithAttributes(attribute.String("bucket", bucketName)))
+}
+
+func setTooLargeResponse(f *proxy.Flow, message string) {
+	interceptor.GcsErrorResponse(f, http.StatusRequestEntityTooLarge, "uploadTooLarge", message)
+	f.Response.Header.Set("Connection", "close")
+}
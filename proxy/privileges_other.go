@@ -0,0 +1,15 @@
+//go:build !unix
+
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+package proxy
+
+import "fmt"
+
+func dropPrivileges(username string) error {
+	return fmt.Errorf("dropping privileges to '%v' is not supported on this platform", username)
+}
@@ -0,0 +1,52 @@
+//go:build unix
+
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dropPrivileges switches the process to the given user (name or uid) and its primary group.
+// It must run after every privileged socket has been bound.
+func dropPrivileges(username string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		u, err = user.LookupId(username)
+		if err != nil {
+			return fmt.Errorf("unknown user '%v': %v", username, err)
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid '%v' for user '%v': %v", u.Uid, username, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid '%v' for user '%v': %v", u.Gid, username, err)
+	}
+
+	// order matters: groups and gid can't be changed once we are no longer root
+	if err = syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups failed: %v", err)
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid(%v) failed: %v", gid, err)
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid(%v) failed: %v", uid, err)
+	}
+
+	log.Infof("dropped privileges to user '%v' (uid=%v gid=%v)", u.Username, uid, gid)
+	return nil
+}
@@ -6,17 +6,46 @@ This software is provided as-is, without warranty or representation for any use
 package proxy
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
 	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/manifest"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/notifications"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/sigv4"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/spool"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
 
-	"github.com/byronwhitlock-google/go-mitmproxy/addon"
 	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
 	"github.com/byronwhitlock-google/go-mitmproxy/web"
 	log "github.com/sirupsen/logrus"
 )
 
 type ProxyRunner struct {
-	proxy  *proxy.Proxy
-	config *cfg.Config
+	proxy     *proxy.Proxy
+	config    *cfg.Config
+	tenants   *tenant.Registry // nil without a tenants file
+	listening atomic.Bool
+
+	inherited   map[string]net.Listener // sockets handed over by the old process of an upgrade, not used yet
+	handoffConn *net.UnixConn           // to the old process until the new one serves
+	sockets     []socket                // what an upgrade hands over
+	servers     []*http.Server          // closed once the sockets are handed over
+	activated   bool                    // the public sockets come from systemd
+	guard       *internalListenerGuard  // of the internal listener the public sockets are relayed to, nil without
+}
+
+// socket is a listening socket by its name in an upgrade handoff
+type socket struct {
+	name string
+	ln   net.Listener
 }
 
 func NewProxyRunner(config *cfg.Config) *ProxyRunner {
@@ -24,9 +53,33 @@ func NewProxyRunner(config *cfg.Config) *ProxyRunner {
 }
 
 func (r *ProxyRunner) Start() error {
+	if r.config.Upgrade {
+		inherited, conn, err := requestHandoff(r.config.UpgradeSocket)
+		if err != nil {
+			return err
+		}
+		r.inherited, r.handoffConn = inherited, conn
+	}
+	listeners, err := r.publicListeners()
+	if err != nil {
+		return err
+	}
+
+	// when we own the public sockets, mitmproxy listens on loopback and we forward to it
+	addr := r.config.ListenAddrs[0]
+	if len(listeners) > 0 {
+		addr, err = reserveLoopbackAddr()
+		if err != nil {
+			return err
+		}
+		if r.guard, err = newInternalListenerGuard(); err != nil {
+			return err
+		}
+	}
+
 	opts := &proxy.Options{
 		Debug:             r.config.Debug,
-		Addr:              r.config.Addr,
+		Addr:              addr,
 		StreamLargeBodies: 1024 * 1024 * 1024 * 1024 * 10, // TODO: we need to implement streaming intercept functions set to 10TB for now!
 		SslInsecure:       r.config.SslInsecure,
 		CaRootPath:        r.config.CertPath,
@@ -37,22 +90,307 @@ func (r *ProxyRunner) Start() error {
 	if err != nil {
 		log.Fatal(err)
 	}
+	r.proxy = p
+	if r.guard != nil {
+		p.AddAddon(r.guard)
+	}
+	p.AddAddon(interceptor.NewConfigAddon(cfg.Runtime))
 
 	if !r.config.UpstreamCert {
 		p.AddAddon(proxy.NewUpstreamCertAddon(false))
 	}
 
+	if r.config.MtlsPassthrough {
+		// tunnel mTLS endpoints untouched so the client certificate reaches GCS
+		p.SetShouldInterceptRule(func(req *http.Request) bool {
+			if util.IsMtlsHost(req.Host) {
+				log.Warnf("mtls_passthrough: tunneling %v without interception, objects will NOT be encrypted", req.Host)
+				return false
+			}
+			return true
+		})
+		p.AddAddon(NewTunnelAddon())
+	}
+
 	p.AddAddon(&proxy.LogAddon{})
 	p.AddAddon(web.NewWebAddon(r.config.WebAddr))
 
-	p.AddAddon(&EncryptGcsPayload{})
-	p.AddAddon(&DecryptGcsPayload{})
-	p.AddAddon(&GetReqHeader{})
-
+	// the recording addons see the request before the interceptor rewrites it
 	if r.config.Dump != "" {
-		dumper := addon.NewDumperWithFilename(r.config.Dump, r.config.DumpLevel)
+		dumper, err := NewDecisionDumperWithFilename(r.config.Dump, r.config.DumpLevel)
+		if err != nil {
+			return err
+		}
 		p.AddAddon(dumper)
 	}
 
+	if r.config.HarFile != "" {
+		harExporter, err := NewHarExporter(r.config.HarFile, r.config.HarRedactBodies, r.config.GCSProxyVersion)
+		if err != nil {
+			return err
+		}
+		p.AddAddon(harExporter)
+	}
+
+	var auditLog *AuditLog
+	if r.config.AuditLog != "" {
+		if auditLog, err = NewAuditLog(r.config.AuditLog); err != nil {
+			return err
+		}
+		p.AddAddon(auditLog)
+		interceptor.OnBypass = auditLog.auditBypass
+	}
+
+	var flows *flowFeed
+	if r.config.AdminAddr != "" {
+		var history *flowHistory
+		if r.config.FlowHistory != "" {
+			if history, err = openFlowHistory(r.config.FlowHistory, r.config.FlowHistoryMaxAge, r.config.FlowHistoryMaxEntries); err != nil {
+				return err
+			}
+		}
+		flows = newFlowFeed(history)
+		p.AddAddon(flows)
+	}
+
+	if r.config.TenantsFile != "" {
+		if err := r.startTenants(p); err != nil {
+			return err
+		}
+	}
+
+	limits := Limits{
+		ClientRequestsPerSecond: r.config.ClientRequestsPerSecond,
+		ClientBytesPerSecond:    r.config.ClientMBPerSecond * 1024 * 1024,
+		BucketRequestsPerSecond: r.config.BucketRequestsPerSecond,
+		BucketBytesPerSecond:    r.config.BucketMBPerSecond * 1024 * 1024,
+	}
+	if limits.Enabled() {
+		p.AddAddon(NewThrottleAddon(limits))
+	}
+
+	p.AddAddon(NewObjectSizeLimit())
+	p.AddAddon(NewHeaderOverrides())
+	p.AddAddon(NewDecryptAuthorization())
+
+	var slowRequests *SlowRequestAddon
+	if r.config.SlowRequestThreshold > 0 {
+		slowRequests = NewSlowRequestAddon(r.config.SlowRequestThreshold)
+		p.AddAddon(slowRequests)
+	}
+
+	for _, gcsAddon := range interceptor.Addons() {
+		p.AddAddon(gcsAddon)
+	}
+
+	r.startChaos(p)
+	if slowRequests != nil && r.config.SlowRequestHeader {
+		p.AddAddon(slowRequests.Header())
+	}
+	p.AddAddon(NewUploadProgress())
+	interceptor.OnCachedResponse = func(f *proxy.Flow) {
+		for _, addon := range p.Addons {
+			if !interceptor.IsAddon(addon) {
+				addon.Responseheaders(f)
+				addon.Response(f)
+			}
+		}
+	}
+
+	if r.config.AdminAddr != "" {
+		ln, err := r.bind("admin", r.config.AdminAddr)
+		if err != nil {
+			return err
+		}
+		server, err := startAdminApi(r.config, flows, auditLog, ln)
+		if err != nil {
+			return err
+		}
+		r.servers = append(r.servers, server)
+	}
+	crypto.LogHardwareAcceleration()
+	if r.config.KeyCheckInterval > 0 {
+		// finds the keys that break after the startup check, before the first request of their buckets
+		go interceptor.WatchKeys(context.Background(), r.config.KeyCheckInterval, r.tenants)
+	}
+	if r.config.EncryptDisabled {
+		go interceptor.WarnEncryptDisabled(context.Background())
+	} else if r.config.CanaryInterval > 0 {
+		go interceptor.RunCanary(context.Background(), r.config.CanaryInterval)
+	}
+	if r.config.ManifestSigningKey != "" {
+		go manifest.Run(context.Background(), r.config.ManifestSigningKey, r.config.ManifestInterval, r.config.ManifestMaxObjects)
+	}
+	if r.config.NotificationsSubscription != "" {
+		go notifications.Run(context.Background(), r.config.NotificationsSubscription)
+	}
+	if r.config.HmacKeysFile != "" {
+		if err := sigv4.LoadKeys(r.config.HmacKeysFile); err != nil {
+			return err
+		}
+	}
+	if r.config.SpoolDir != "" {
+		if err := spool.Open(r.config.SpoolDir); err != nil {
+			return err
+		}
+		go spool.Run(context.Background(), r.config.SpoolDir, r.config.SpoolRetryInterval)
+	}
+	if r.config.HealthAddr != "" {
+		ln, err := r.bind("health", r.config.HealthAddr)
+		if err != nil {
+			return err
+		}
+		r.servers = append(r.servers, startHealthServer(ln, &r.listening))
+	}
+	if r.config.MetadataShimAddr != "" {
+		ln, err := r.bind("metadata", r.config.MetadataShimAddr)
+		if err != nil {
+			return err
+		}
+		server, err := startMetadataShim(ln, r.config.MetadataShimScopes, r.config.MetadataShimClients, r.tenants)
+		if err != nil {
+			return err
+		}
+		r.servers = append(r.servers, server)
+	}
+
+	go r.onListening(addr, listeners)
+
 	return p.Start()
 }
+
+// publicListeners returns the client facing sockets we have to serve ourselves: the ones
+// inherited from systemd, or the configured addresses when there are several, unix sockets,
+// TLS, mTLS passthrough, or they have to be pre-bound so that privileges can be dropped afterwards. nil means
+// mitmproxy binds the configured address directly.
+func (r *ProxyRunner) publicListeners() ([]net.Listener, error) {
+	listeners, err := listenersFromSystemd()
+	if err != nil {
+		return nil, err
+	}
+	r.activated = len(listeners) > 0
+	if len(listeners) == 0 {
+		// upgrades hand over the public sockets, mitmproxy's own can't be. the relay counts the
+		// bytes of passed through tunnels.
+		if r.config.RunAsUser == "" && r.config.ListenTlsCert == "" && r.config.UpgradeSocket == "" && !r.config.MtlsPassthrough &&
+			!needsOwnListeners(r.config.ListenAddrs) {
+			return nil, nil
+		}
+		for _, addr := range r.config.ListenAddrs {
+			ln, err := r.bind("listen:"+addr, addr)
+			if err != nil {
+				closeListeners(listeners)
+				return nil, err
+			}
+			listeners = append(listeners, ln)
+		}
+	}
+	if r.config.ListenTlsCert != "" {
+		wrapped, err := withTls(listeners, r.config.ListenTlsCert, r.config.ListenTlsKey)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = wrapped
+	}
+	return listeners, nil
+}
+
+// bind returns the socket of addr handed over by the old process of an upgrade, else binds it
+func (r *ProxyRunner) bind(name string, addr string) (net.Listener, error) {
+	ln, ok := r.inherited[name]
+	delete(r.inherited, name)
+	if !ok {
+		var err error
+		if ln, err = listen(addr, r.config.UnixSocketMode); err != nil {
+			return nil, err
+		}
+	}
+	r.sockets = append(r.sockets, socket{name, ln})
+	return ln, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
+
+// onListening waits for the proxy to come up, then drops privileges,
+// starts serving the public sockets and signals readiness to systemd.
+func (r *ProxyRunner) onListening(addr string, listeners []net.Listener) {
+	if r.guard != nil {
+		if err := waitForProxy(addr, r.guard, 30*time.Second); err != nil {
+			log.Fatal(err)
+		}
+	} else if err := waitForListener(addr, 30*time.Second); err != nil {
+		log.Fatal(err)
+	}
+
+	if r.config.RunAsUser != "" {
+		if err := dropPrivileges(r.config.RunAsUser); err != nil {
+			log.Fatalf("unable to drop privileges: %v", err)
+		}
+	}
+
+	for _, ln := range listeners {
+		go forwardConnections(ln, addr)
+	}
+	r.listening.Store(true)
+
+	if err := sdNotify("READY=1"); err != nil {
+		log.Warnf("unable to notify systemd: %v", err)
+	}
+
+	if r.handoffConn != nil {
+		// the addresses the new configuration no longer listens on
+		for name, ln := range r.inherited {
+			log.Infof("closing handed over listener %v", name)
+			ln.Close()
+		}
+		if err := signalReady(r.handoffConn); err != nil {
+			log.Error(err)
+		}
+		log.Info("upgrade complete, the old process drains its connections")
+	}
+	if r.config.UpgradeSocket != "" {
+		if r.activated {
+			// systemd keeps the sockets across restarts itself
+			log.Warnf("socket activated, not serving upgrades on %v", r.config.UpgradeSocket)
+		} else {
+			go r.serveUpgrades(r.config.UpgradeSocket)
+		}
+	}
+}
+
+// startTenants loads the tenants file and checks the tenants' keys before serving them
+func (r *ProxyRunner) startTenants(p *proxy.Proxy) error {
+	registry, err := tenant.Load(r.config.TenantsFile)
+	if err != nil {
+		return err
+	}
+	if err := interceptor.CheckTenantKeys(context.Background(), registry); err != nil {
+		return fmt.Errorf("unable to initialize tenants: %v", err)
+	}
+	log.Infof("serving %v tenants from %v", len(registry.Tenants()), r.config.TenantsFile)
+	p.AddAddon(NewTenantAddon(registry))
+	r.tenants = registry
+	return nil
+}
+
+// startChaos turns on the configured fault injection
+func (r *ProxyRunner) startChaos(p *proxy.Proxy) {
+	kmsFaults := crypto.KmsFaults{
+		Latency:     r.config.ChaosKmsLatency,
+		LatencyRate: r.config.ChaosKmsLatencyRate,
+		ErrorRate:   r.config.ChaosKmsErrorRate,
+	}
+	if kmsFaults.Enabled() {
+		log.Warnf("chaos mode: KMS calls are delayed by %v at rate %v and fail at rate %v", kmsFaults.Latency, kmsFaults.LatencyRate, kmsFaults.ErrorRate)
+		crypto.InjectKmsFaults(kmsFaults)
+	}
+	if r.config.ChaosUpstreamErrorRate > 0 || r.config.ChaosTruncateRate > 0 {
+		log.Warnf("chaos mode: requests fail with 503 at rate %v, response bodies are truncated at rate %v", r.config.ChaosUpstreamErrorRate, r.config.ChaosTruncateRate)
+		p.AddAddon(NewChaosAddon(r.config.ChaosUpstreamErrorRate, r.config.ChaosTruncateRate))
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+)
+
+// dumpedFlow is one flow read back from a DecisionDumper file
+type dumpedFlow struct {
+	Method string
+	URI    string
+	Host   string
+	Header http.Header
+	Body   []byte
+
+	StatusCode     int // 0 when the dump has no response
+	ResponseHeader http.Header
+	ResponseBody   []byte
+
+	Decision *interceptor.Decision
+}
+
+var (
+	dumpRequestLine  = regexp.MustCompile(`^([A-Z]+) (\S+) HTTP/\d(\.\d)?$`)
+	dumpStatusLine   = regexp.MustCompile(`^HTTP/\d(\.\d)? (\d{3})( .*)?$`)
+	dumpDecisionLine = "Gcs-Proxy-Decision: "
+)
+
+/*
+parseDump reads the flows of a DecisionDumper file. The dump format does not delimit bodies,
+a body ends at the next line that looks like a status line, a decision or a request line.
+*/
+func parseDump(data []byte) ([]*dumpedFlow, error) {
+	lines := strings.SplitAfter(string(data), "\n")
+	var flows []*dumpedFlow
+	i := 0
+	for i < len(lines) {
+		line := trimLine(lines[i])
+		if line == "" {
+			i++
+			continue
+		}
+		match := dumpRequestLine.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("line %v: expected a request line, got %q", i+1, line)
+		}
+		flow := &dumpedFlow{Method: match[1], URI: match[2], Header: http.Header{}}
+		i++
+
+		i = parseDumpHeaders(lines, i, flow.Header)
+		flow.Host = flow.Header.Get("Host")
+		flow.Header.Del("Host")
+		flow.Body, i = parseDumpBody(lines, i)
+
+		if i < len(lines) {
+			if match := dumpStatusLine.FindStringSubmatch(trimLine(lines[i])); match != nil {
+				flow.StatusCode, _ = strconv.Atoi(match[2])
+				flow.ResponseHeader = http.Header{}
+				i = parseDumpHeaders(lines, i+1, flow.ResponseHeader)
+				flow.ResponseBody, i = parseDumpBody(lines, i)
+			}
+		}
+
+		if i < len(lines) && strings.HasPrefix(lines[i], dumpDecisionLine) {
+			flow.Decision = &interceptor.Decision{}
+			record := strings.TrimPrefix(trimLine(lines[i]), dumpDecisionLine)
+			if err := json.Unmarshal([]byte(record), flow.Decision); err != nil {
+				return nil, fmt.Errorf("line %v: invalid decision: %v", i+1, err)
+			}
+			i++
+		}
+		flows = append(flows, flow)
+	}
+	return flows, nil
+}
+
+func parseDumpHeaders(lines []string, i int, header http.Header) int {
+	for ; i < len(lines); i++ {
+		line := trimLine(lines[i])
+		if line == "" {
+			return i + 1
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok {
+			header.Add(name, strings.TrimSpace(value))
+		}
+	}
+	return i
+}
+
+// parseDumpBody returns the body starting at line i and the index of the line after it
+func parseDumpBody(lines []string, i int) ([]byte, int) {
+	start := i
+	for ; i < len(lines); i++ {
+		line := trimLine(lines[i])
+		if dumpStatusLine.MatchString(line) || dumpRequestLine.MatchString(line) || strings.HasPrefix(line, dumpDecisionLine) {
+			break
+		}
+	}
+	body := strings.Join(lines[start:i], "")
+
+	// the dumper ends bodies with a blank line, and flows with one more
+	trailers := 2
+	if i < len(lines) && !dumpRequestLine.MatchString(trimLine(lines[i])) {
+		trailers = 1
+	}
+	for ; trailers > 0 && strings.HasSuffix(body, "\r\n\r\n"); trailers-- {
+		body = strings.TrimSuffix(body, "\r\n\r\n")
+	}
+	if body == "" {
+		return nil, i
+	}
+	return []byte(body), i
+}
+
+func trimLine(line string) string {
+	return strings.TrimRight(line, "\r\n")
+}
@@ -0,0 +1,418 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/keymap"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// replayFlowHeader tells the fake upstream which dumped flow a request replays
+const replayFlowHeader = "X-Gcs-Proxy-Replay-Flow"
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+	metadata    map[string]interface{}
+	generation  int64
+}
+
+/*
+fakeUpstream is the upstream proxy of a replay. It terminates the proxy's CONNECT tunnels
+with a self-signed certificate and plays GCS: uploads are kept in memory so later downloads
+and metadata requests of the dump see what the proxy uploaded. Downloads of objects the dump
+did not upload are encrypted on the fly from the dumped plaintext, everything else is
+answered with the dumped response.
+*/
+type fakeUpstream struct {
+	listener net.Listener
+	tunnels  *tunnelListener
+	flows    []*dumpedFlow
+
+	mu         sync.Mutex
+	objects    map[string]*fakeObject // bucket/object -> object
+	generation int64
+}
+
+func newFakeUpstream(flows []*dumpedFlow) (*fakeUpstream, error) {
+	certificate, err := selfSignedCertificate()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	u := &fakeUpstream{
+		listener:   listener,
+		tunnels:    &tunnelListener{conns: make(chan net.Conn), done: make(chan struct{}), addr: listener.Addr()},
+		flows:      flows,
+		objects:    map[string]*fakeObject{},
+		generation: time.Now().UnixMicro(),
+	}
+
+	gcs := http.HandlerFunc(u.serveGcs)
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			u.tunnel(w, certificate)
+			return
+		}
+		gcs(w, r)
+	}))
+	go http.Serve(u.tunnels, gcs)
+	return u, nil
+}
+
+func (u *fakeUpstream) Url() string {
+	return "http://" + u.listener.Addr().String()
+}
+
+func (u *fakeUpstream) Close() {
+	u.listener.Close()
+	u.tunnels.Close()
+}
+
+// tunnel accepts a CONNECT and serves TLS on the hijacked connection
+func (u *fakeUpstream) tunnel(w http.ResponseWriter, certificate tls.Certificate) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("replay: unable to hijack CONNECT: %v", err)
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+	tlsConn := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		NextProtos:   []string{"http/1.1"},
+	})
+	select {
+	case u.tunnels.conns <- tlsConn:
+	case <-u.tunnels.done:
+		conn.Close()
+	}
+}
+
+func (u *fakeUpstream) serveGcs(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	index, err := strconv.Atoi(r.Header.Get(replayFlowHeader))
+	if err != nil || index < 0 || index >= len(u.flows) {
+		http.Error(w, "request is not part of the replay", http.StatusBadGateway)
+		return
+	}
+	flow := u.flows[index]
+
+	query := r.URL.Query()
+	bucket := util.GetBucketNameFromRequestUri(r.URL.Path)
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/") && query.Get("uploadType") == "multipart":
+		u.multipartUpload(w, r, bucket, body)
+
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/") && query.Get("uploadType") == "media":
+		u.store(w, bucket, query.Get("name"), &fakeObject{data: body, contentType: r.Header.Get("Content-Type")})
+
+	case r.Method == http.MethodPost && query.Get("uploadType") == "resumable" && query.Get("upload_id") == "":
+		u.startResumableUpload(w, r, flow)
+
+	case r.Method == http.MethodGet && isObjectPath(r.URL.Path):
+		object := util.GetObjectNameFromRequestUri(r.URL.Path)
+		if query.Get("alt") == "media" || strings.HasPrefix(r.URL.Path, "/download/") {
+			u.download(w, r, flow, bucket, object)
+		} else {
+			u.metadata(w, flow, bucket, object)
+		}
+
+	default:
+		writeDumpedResponse(w, flow)
+	}
+}
+
+// isObjectPath reports whether path is a JSON API path of an object
+func isObjectPath(path string) bool {
+	isJson := strings.HasPrefix(path, "/storage/v1/b/") || strings.HasPrefix(path, "/download/storage/v1/b/")
+	return isJson && util.GetObjectNameFromRequestUri(path) != ""
+}
+
+func (u *fakeUpstream) multipartUpload(w http.ResponseWriter, r *http.Request, bucket string, body []byte) {
+	// gsutil quotes the boundary with single quotes
+	_, params, err := mime.ParseMediaType(strings.ReplaceAll(r.Header.Get("Content-Type"), "'", "\""))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid multipart content type: %v", err), http.StatusBadRequest)
+		return
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	part, err := reader.NextPart()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("missing metadata part: %v", err), http.StatusBadRequest)
+		return
+	}
+	resource := map[string]interface{}{}
+	if err := json.NewDecoder(part).Decode(&resource); err != nil {
+		http.Error(w, fmt.Sprintf("invalid metadata part: %v", err), http.StatusBadRequest)
+		return
+	}
+	part, err = reader.NextPart()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("missing media part: %v", err), http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(part)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, _ := resource["name"].(string)
+	if name == "" {
+		name = r.URL.Query().Get("name")
+	}
+	object := &fakeObject{data: data, contentType: part.Header.Get("Content-Type")}
+	if contentType, ok := resource["contentType"].(string); ok && contentType != "" {
+		object.contentType = contentType
+	}
+	object.metadata, _ = resource["metadata"].(map[string]interface{})
+	u.store(w, bucket, name, object)
+}
+
+func (u *fakeUpstream) store(w http.ResponseWriter, bucket string, name string, object *fakeObject) {
+	if name == "" {
+		http.Error(w, "missing object name", http.StatusBadRequest)
+		return
+	}
+	u.mu.Lock()
+	u.generation++
+	object.generation = u.generation
+	u.objects[bucket+"/"+name] = object
+	u.mu.Unlock()
+	writeJson(w, http.StatusOK, objectResource(bucket, name, object))
+}
+
+// startResumableUpload reuses the dumped upload id, the dumped PUTs of the session refer to it
+func (u *fakeUpstream) startResumableUpload(w http.ResponseWriter, r *http.Request, flow *dumpedFlow) {
+	uploadId := ""
+	if flow.ResponseHeader != nil {
+		uploadId = flow.ResponseHeader.Get("X-GUploader-UploadID")
+	}
+	if uploadId == "" {
+		uploadId = fmt.Sprintf("replay-%d", time.Now().UnixNano())
+	}
+	query := r.URL.Query()
+	query.Set("upload_id", uploadId)
+	location := *r.URL
+	location.Scheme, location.Host, location.RawQuery = "https", r.Host, query.Encode()
+
+	w.Header().Set("X-GUploader-UploadID", uploadId)
+	w.Header().Set("Location", location.String())
+	w.WriteHeader(http.StatusOK)
+}
+
+func (u *fakeUpstream) download(w http.ResponseWriter, r *http.Request, flow *dumpedFlow, bucket string, name string) {
+	u.mu.Lock()
+	object, ok := u.objects[bucket+"/"+name]
+	u.mu.Unlock()
+	if !ok {
+		var err error
+		object, err = u.synthesizeObject(r.Context(), flow, bucket)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if object == nil {
+			writeDumpedResponse(w, flow)
+			return
+		}
+	}
+
+	for key, value := range object.metadata {
+		w.Header().Set("X-Goog-Meta-"+key, fmt.Sprint(value))
+	}
+	w.Header().Set("Content-Type", object.contentType)
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(object.generation, 10))
+	w.Header().Set("X-Goog-Stored-Content-Length", strconv.Itoa(len(object.data)))
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(object.data))
+}
+
+var dumpedContentRange = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+
+/*
+synthesizeObject rebuilds an object the dump only downloads, encrypted with the bucket's key
+like the proxy would have uploaded it. The plaintext is the dumped response body, zeros where
+the dump has no body, e.g. binary objects or ranged reads. It returns nil when the proxy does
+not decrypt the bucket's downloads or the dumped download failed.
+*/
+func (u *fakeUpstream) synthesizeObject(ctx context.Context, flow *dumpedFlow, bucket string) (*fakeObject, error) {
+	keyName := util.GetKMSKeyName(bucket)
+	if keyName == "" || util.GetEnvelopeFormat(bucket) != keymap.FormatTink {
+		return nil, nil
+	}
+	if flow.StatusCode != http.StatusOK && flow.StatusCode != http.StatusPartialContent {
+		return nil, nil
+	}
+
+	var plaintext []byte
+	if match := dumpedContentRange.FindStringSubmatch(flow.ResponseHeader.Get("Content-Range")); match != nil {
+		start, _ := strconv.Atoi(match[1])
+		size, _ := strconv.Atoi(match[3])
+		plaintext = make([]byte, size)
+		if start+len(flow.ResponseBody) <= size {
+			copy(plaintext[start:], flow.ResponseBody)
+		}
+	} else if size, err := strconv.Atoi(flow.ResponseHeader.Get("Content-Length")); err == nil && size != len(flow.ResponseBody) {
+		plaintext = make([]byte, size)
+	} else {
+		plaintext = flow.ResponseBody
+	}
+
+	data, err := crypto.EncryptBytes(ctx, keyName, plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt synthesized object: %v", err)
+	}
+	u.mu.Lock()
+	u.generation++
+	generation := u.generation
+	u.mu.Unlock()
+	return &fakeObject{
+		data:        data,
+		contentType: flow.ResponseHeader.Get("Content-Type"),
+		metadata: map[string]interface{}{
+			util.MetaKey(util.MetaEncryptionKey):     keyName,
+			util.MetaKey(util.MetaUnencryptedLength): len(plaintext),
+			util.MetaKey(util.MetaMd5Hash):           crypto.Base64MD5Hash(plaintext),
+			util.MetaKey(util.MetaCrc32c):            crypto.Base64Crc32cHash(plaintext),
+		},
+		generation: generation,
+	}, nil
+}
+
+func (u *fakeUpstream) metadata(w http.ResponseWriter, flow *dumpedFlow, bucket string, name string) {
+	u.mu.Lock()
+	object, ok := u.objects[bucket+"/"+name]
+	u.mu.Unlock()
+	if !ok {
+		writeDumpedResponse(w, flow)
+		return
+	}
+	writeJson(w, http.StatusOK, objectResource(bucket, name, object))
+}
+
+func objectResource(bucket string, name string, object *fakeObject) map[string]interface{} {
+	resource := map[string]interface{}{
+		"kind":        "storage#object",
+		"id":          fmt.Sprintf("%v/%v/%v", bucket, name, object.generation),
+		"bucket":      bucket,
+		"name":        name,
+		"generation":  strconv.FormatInt(object.generation, 10),
+		"contentType": object.contentType,
+		"size":        strconv.Itoa(len(object.data)),
+		"md5Hash":     crypto.Base64MD5Hash(object.data),
+		"crc32c":      crypto.Base64Crc32cHash(object.data),
+	}
+	if object.metadata != nil {
+		resource["metadata"] = object.metadata
+	}
+	return resource
+}
+
+// writeDumpedResponse answers with the response the dump recorded, or 502 when it has none
+func writeDumpedResponse(w http.ResponseWriter, flow *dumpedFlow) {
+	if flow.StatusCode == 0 {
+		http.Error(w, "the dump has no response for this request", http.StatusBadGateway)
+		return
+	}
+	for name, values := range flow.ResponseHeader {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Connection":
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(flow.ResponseBody)))
+	w.WriteHeader(flow.StatusCode)
+	w.Write(flow.ResponseBody)
+}
+
+// tunnelListener hands the TLS connections of CONNECT tunnels to an http.Server
+type tunnelListener struct {
+	conns  chan net.Conn
+	done   chan struct{}
+	closed sync.Once
+	addr   net.Addr
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tunnelListener) Close() error {
+	l.closed.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *tunnelListener) Addr() net.Addr {
+	return l.addr
+}
+
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "go-gcsproxy replay"},
+		DNSNames:     []string{"storage.googleapis.com", "*.googleapis.com", "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// headers the replay client sets itself
+var replaySkippedHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Accept-Encoding":   true, // dumps hold decoded bodies, compare those
+	"Proxy-Connection":  true,
+}
+
+/*
+Replay sends the requests of a DecisionDumper file through the interceptor addons again,
+against a fake GCS instead of the real one, and reports where the replayed status, decision
+or downloaded plaintext differ from the dump. It returns the number of flows that differ.
+The bucket key mapping comes from config, as for the proxy. Requests are replayed in order,
+one at a time.
+*/
+func Replay(config *cfg.Config, dumpFile string, out io.Writer) (int, error) {
+	data, err := os.ReadFile(dumpFile)
+	if err != nil {
+		return 0, err
+	}
+	flows, err := parseDump(data)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %v: %v", dumpFile, err)
+	}
+	if len(flows) == 0 {
+		return 0, fmt.Errorf("%v has no flows", dumpFile)
+	}
+
+	upstream, err := newFakeUpstream(flows)
+	if err != nil {
+		return 0, fmt.Errorf("error starting fake upstream: %v", err)
+	}
+	defer upstream.Close()
+
+	addr, err := reserveLoopbackAddr()
+	if err != nil {
+		return 0, err
+	}
+	certPath, err := os.MkdirTemp("", "gcsproxy-replay-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(certPath)
+
+	p, err := proxy.NewProxy(&proxy.Options{
+		Debug:             config.Debug,
+		Addr:              addr,
+		StreamLargeBodies: 1024 * 1024 * 1024 * 1024 * 10,
+		SslInsecure:       true,
+		CaRootPath:        certPath,
+		Upstream:          upstream.Url(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	recorder := newReplayRecorder()
+	p.AddAddon(proxy.NewUpstreamCertAddon(false))
+	p.AddAddon(recorder)
+	if config.TenantsFile != "" {
+		registry, err := tenant.Load(config.TenantsFile)
+		if err != nil {
+			return 0, err
+		}
+		p.AddAddon(NewTenantAddon(registry))
+	}
+	for _, gcsAddon := range interceptor.Addons() {
+		p.AddAddon(gcsAddon)
+	}
+	go p.Start()
+	defer p.Close()
+	if err := waitForListener(addr, 30*time.Second); err != nil {
+		return 0, err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(&url.URL{Scheme: "http", Host: addr}),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		Timeout:       5 * time.Minute,
+	}
+
+	failures := 0
+	for i, flow := range flows {
+		if !replayFlow(client, recorder, i, flow, out) {
+			failures++
+		}
+	}
+	fmt.Fprintf(out, "replayed %v flows, %v differ from the dump\n", len(flows), failures)
+	return failures, nil
+}
+
+// replayFlow replays one flow and prints the result, it returns false if it differs from the dump
+func replayFlow(client *http.Client, recorder *replayRecorder, i int, flow *dumpedFlow, out io.Writer) bool {
+	fmt.Fprintf(out, "#%d %v %v%v\n", i+1, flow.Method, flow.Host, flow.URI)
+	if len(flow.Body) == 0 && flow.Header.Get("Content-Length") != "" && flow.Header.Get("Content-Length") != "0" {
+		fmt.Fprintf(out, "  warning: the dump has no request body, dump with -dump_level=1 to replay uploads\n")
+	}
+
+	req, err := http.NewRequest(flow.Method, replayUrl(flow), bytes.NewReader(flow.Body))
+	if err != nil {
+		fmt.Fprintf(out, "  error: %v\n", err)
+		return false
+	}
+	for name, values := range flow.Header {
+		if replaySkippedHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	id := strconv.Itoa(i)
+	req.Header.Set(replayFlowHeader, id)
+	decision := recorder.expect(id)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(out, "  error: %v\n", err)
+		return false
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		fmt.Fprintf(out, "  error reading response: %v\n", err)
+		return false
+	}
+
+	var replayed *interceptor.Decision
+	select {
+	case replayed = <-decision:
+	case <-time.After(10 * time.Second):
+	}
+	record, _ := json.Marshal(replayed)
+	fmt.Fprintf(out, "  status %v, decision %s\n", resp.StatusCode, record)
+
+	same := true
+	if flow.StatusCode != 0 && resp.StatusCode != flow.StatusCode {
+		fmt.Fprintf(out, "  DIFF status: dumped %v, replayed %v\n", flow.StatusCode, resp.StatusCode)
+		same = false
+	}
+	if flow.Decision != nil {
+		for _, diff := range decisionDiffs(flow.Decision, replayed) {
+			fmt.Fprintf(out, "  DIFF %v\n", diff)
+			same = false
+		}
+	}
+	// upload and metadata responses describe the fake upstream's objects, only plaintext compares
+	if replayed != nil && replayed.Action == "decrypt" && len(flow.ResponseBody) > 0 && !bytes.Equal(body, flow.ResponseBody) {
+		fmt.Fprintf(out, "  DIFF body: dumped %v bytes, replayed %v bytes\n", len(flow.ResponseBody), len(body))
+		same = false
+	}
+	return same
+}
+
+// replayUrl guesses the scheme, the dump only has the host. GCS clients use https
+func replayUrl(flow *dumpedFlow) string {
+	scheme := "https"
+	if _, port, err := net.SplitHostPort(flow.Host); err == nil && port != "443" {
+		scheme = "http"
+	}
+	return scheme + "://" + flow.Host + flow.URI
+}
+
+func decisionDiffs(dumped *interceptor.Decision, replayed *interceptor.Decision) []string {
+	if replayed == nil {
+		return []string{"decision: the replay recorded none"}
+	}
+	var diffs []string
+	compare := func(field string, dumped string, replayed string) {
+		if dumped != replayed {
+			diffs = append(diffs, fmt.Sprintf("%v: dumped %q, replayed %q", field, dumped, replayed))
+		}
+	}
+	compare("method", dumped.Method, replayed.Method)
+	compare("action", dumped.Action, replayed.Action)
+	compare("mapping", dumped.Mapping, replayed.Mapping)
+	compare("key", dumped.Key, replayed.Key)
+	compare("format", dumped.Format, replayed.Format)
+	compare("error", dumped.Error, replayed.Error)
+	return diffs
+}
+
+// replayRecorder hands the decision of each replayed flow to the request waiting for it
+type replayRecorder struct {
+	proxy.BaseAddon
+	mu      sync.Mutex
+	waiting map[string]chan *interceptor.Decision
+}
+
+func newReplayRecorder() *replayRecorder {
+	interceptor.WatchDecisions()
+	return &replayRecorder{waiting: map[string]chan *interceptor.Decision{}}
+}
+
+func (r *replayRecorder) expect(id string) chan *interceptor.Decision {
+	c := make(chan *interceptor.Decision, 1)
+	r.mu.Lock()
+	r.waiting[id] = c
+	r.mu.Unlock()
+	return c
+}
+
+func (r *replayRecorder) Requestheaders(f *proxy.Flow) {
+	id := f.Request.Header.Get(replayFlowHeader)
+	go func() {
+		<-f.Done()
+		decision, _ := interceptor.DecisionOf(f)
+		interceptor.ForgetDecision(f)
+
+		r.mu.Lock()
+		c, ok := r.waiting[id]
+		delete(r.waiting, id)
+		r.mu.Unlock()
+		if ok {
+			c <- decision
+		}
+	}()
+}
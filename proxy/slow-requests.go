@@ -0,0 +1,96 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/latency"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/logsample"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/redact"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+SlowRequestAddon logs the flows that took longer than its threshold with where their time went,
+see latency.Breakdown. It must be added right before the interceptor addons so its marks bound
+what they do: the request is read when its Request event runs and the response when its Response
+event runs, before the interceptor decrypts it. Header, added after the interceptor addons,
+answers the slow flows with a Server-Timing header.
+*/
+type SlowRequestAddon struct {
+	proxy.BaseAddon
+	threshold time.Duration
+}
+
+func NewSlowRequestAddon(threshold time.Duration) *SlowRequestAddon {
+	return &SlowRequestAddon{threshold: threshold}
+}
+
+func (a *SlowRequestAddon) Requestheaders(f *proxy.Flow) {
+	if f.Request.Method == http.MethodConnect {
+		return
+	}
+	b := latency.Track(f)
+	go func() {
+		<-f.Done()
+		a.report(f, b)
+		latency.Forget(f)
+	}()
+}
+
+func (a *SlowRequestAddon) Request(f *proxy.Flow) {
+	if b := latency.Of(f); b != nil {
+		b.RequestRead()
+	}
+}
+
+func (a *SlowRequestAddon) Responseheaders(f *proxy.Flow) {
+	if b := latency.Of(f); b != nil {
+		b.ResponseArrived()
+	}
+}
+
+func (a *SlowRequestAddon) Response(f *proxy.Flow) {
+	if b := latency.Of(f); b != nil {
+		b.ResponseRead()
+	}
+}
+
+func (a *SlowRequestAddon) report(f *proxy.Flow, b *latency.Budget) {
+	breakdown := b.Breakdown()
+	if breakdown.Total < a.threshold {
+		return
+	}
+	entry := log.WithField(logsample.CategoryField, "slow").WithFields(breakdown.Fields())
+	if f.Response != nil {
+		entry = entry.WithField("status", f.Response.StatusCode)
+	}
+	entry.Warnf("slow request %v %v took %v", f.Request.Method, redact.URL(f.Request.URL), breakdown.Total.Round(time.Millisecond))
+}
+
+// Header returns the addon answering the flows slower than the threshold with their breakdown
+// until the response is sent
+func (a *SlowRequestAddon) Header() proxy.Addon {
+	return &slowRequestHeader{threshold: a.threshold}
+}
+
+type slowRequestHeader struct {
+	proxy.BaseAddon
+	threshold time.Duration
+}
+
+func (h *slowRequestHeader) Response(f *proxy.Flow) {
+	b := latency.Of(f)
+	if b == nil {
+		return
+	}
+	if breakdown := b.Breakdown(); breakdown.Total >= h.threshold {
+		f.Response.Header.Add("Server-Timing", breakdown.ServerTiming())
+	}
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// first file descriptor passed by systemd socket activation, see sd_listen_fds(3)
+const listenFdsStart = 3
+
+// listenersFromSystemd returns the sockets handed over through LISTEN_PID/LISTEN_FDS.
+// It returns nil when the proxy was not socket activated.
+func listenersFromSystemd() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+
+	// don't leak the activation environment to anything we exec
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, nfds)
+	for fd := listenFdsStart; fd < listenFdsStart+nfds; fd++ {
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		ln, err := net.FileListener(file)
+		file.Close() // FileListener dups the descriptor
+		if err != nil {
+			return nil, fmt.Errorf("socket activation fd %d is not a listening socket: %v", fd, err)
+		}
+		log.Infof("using socket activated listener %v", ln.Addr())
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state string such as "READY=1" to the systemd notification
+// socket. It is a no-op when NOTIFY_SOCKET is not set.
+func sdNotify(state string) error {
+	socketAddr := &net.UnixAddr{Name: os.Getenv("NOTIFY_SOCKET"), Net: "unixgram"}
+	if socketAddr.Name == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix(socketAddr.Net, nil, socketAddr)
+	if err != nil {
+		return fmt.Errorf("unable to connect to NOTIFY_SOCKET: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("unable to write to NOTIFY_SOCKET: %v", err)
+	}
+	return nil
+}
+
+// reserveLoopbackAddr picks a free loopback port for the internal mitmproxy listener
+// when the public socket is owned by us instead of the proxy library. go-mitmproxy binds the
+// port itself once it is closed here, so another local process may take it in between: the
+// relay checks with waitForProxy that the proxy answers on it, see internalListenerGuard.
+func reserveLoopbackAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// waitForListener blocks until addr accepts connections or the timeout expires.
+func waitForListener(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("proxy did not start listening on %v: %v", addr, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// internalProbePath is answered on the internal listener with the token of internalListenerGuard
+const internalProbePath = "/.gcsproxy-internal-listener"
+
+/*
+internalListenerGuard is the first addon of a proxy whose public sockets are relayed to its
+internal listener. Every local process can reach that loopback port, around the TLS and mTLS of
+the public sockets and with the client address of forwardedClients unknown, so the flows of the
+connections the relay did not open are refused with 403 and their connection closed. The relay
+stores a connection in forwardedClients before it sends the client's first byte, a flow of it
+is always known.
+
+It also answers internalProbePath with a random token, for waitForProxy to tell the proxy from
+another process listening on its port.
+*/
+type internalListenerGuard struct {
+	proxy.BaseAddon
+	token string
+}
+
+func newInternalListenerGuard() (*internalListenerGuard, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("unable to generate the internal listener token: %v", err)
+	}
+	return &internalListenerGuard{token: hex.EncodeToString(token)}, nil
+}
+
+func (g *internalListenerGuard) AccessProxyServer(req *http.Request, res http.ResponseWriter) {
+	if req.URL.Path == internalProbePath {
+		io.WriteString(res, g.token)
+	}
+}
+
+func (g *internalListenerGuard) Requestheaders(f *proxy.Flow) {
+	if f.ConnContext == nil || f.ConnContext.ClientConn == nil || f.ConnContext.ClientConn.Conn == nil {
+		return
+	}
+	conn := f.ConnContext.ClientConn.Conn
+	if _, ok := forwardedClients.Load(conn.RemoteAddr().String()); ok {
+		return
+	}
+	log.Warnf("refusing %v %v from %v, it connected to the internal listener directly", f.Request.Method, f.Request.URL, conn.RemoteAddr())
+	if f.Request.Method == http.MethodConnect {
+		// tunnels are established whatever the addons answer
+		conn.Close()
+		return
+	}
+	f.Response = &proxy.Response{StatusCode: http.StatusForbidden, Header: make(http.Header), Body: []byte("connect through the proxy's listeners\n")}
+	f.Response.Header.Set("Connection", "close")
+}
+
+// waitForProxy blocks until the proxy of guard answers on addr or the timeout expires, and fails
+// right away when another process does
+func waitForProxy(addr string, guard *internalListenerGuard, timeout time.Duration) error {
+	client := &http.Client{Transport: &http.Transport{Proxy: nil}, Timeout: time.Second}
+	deadline := time.Now().Add(timeout)
+	for {
+		res, err := client.Get("http://" + addr + internalProbePath)
+		if err == nil {
+			body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+			res.Body.Close()
+			if string(body) != guard.token {
+				return fmt.Errorf("another process listens on the internal proxy address %v", addr)
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("proxy did not start listening on %v: %v", addr, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// forwardedClients maps the local address of each relayed loopback connection to the
+// *relayedConn it carries, the internal proxy only sees the loopback peer
+var forwardedClients sync.Map
+
+// relayedConn is a client connection relayed to the internal proxy
+type relayedConn struct {
+	client net.Addr
+	tunnel atomic.Pointer[tunnel] // set when the client's CONNECT is tunneled, see TunnelAddon
+}
+
+// relayed counts the open client connections, an upgraded process exits once they are done
+var relayed atomic.Int64
+
+func activeConnections() int64 {
+	return relayed.Load()
+}
+
+// halfCloser is implemented by TCP and unix connections
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// forwardConnections relays every connection accepted on ln to the internal proxy address.
+// go-mitmproxy can only listen on a TCP address it binds itself, so inherited or
+// pre-bound sockets are bridged to it over loopback, guarded by internalListenerGuard.
+func forwardConnections(ln net.Listener, target string) {
+	for {
+		client, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return // handed over to the new process of an upgrade
+		}
+		if err != nil {
+			log.Errorf("listener %v stopped accepting: %v", ln.Addr(), err)
+			return
+		}
+		relayed.Add(1)
+		go func() {
+			defer relayed.Add(-1)
+			defer client.Close()
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				log.Errorf("unable to reach internal proxy listener %v: %v", target, err)
+				return
+			}
+			defer upstream.Close()
+			relayed := upstream.LocalAddr().String()
+			conn := &relayedConn{client: client.RemoteAddr()}
+			forwardedClients.Store(relayed, conn)
+			defer forwardedClients.Delete(relayed)
+
+			sent, received := relay(client, upstream)
+			if t := conn.tunnel.Load(); t != nil {
+				t.report(sent, received)
+			}
+		}()
+	}
+}
+
+// relay copies between two connections until both directions are done and returns the bytes
+// the client sent and received
+func relay(client net.Conn, upstream net.Conn) (int64, int64) {
+	done := make(chan struct{}, 2)
+	var sent, received int64
+	go func() {
+		sent, _ = io.Copy(upstream, client)
+		if conn, ok := upstream.(halfCloser); ok {
+			conn.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		received, _ = io.Copy(client, upstream)
+		if conn, ok := client.(halfCloser); ok {
+			conn.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	return sent, received
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/interceptor"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// TenantAddon assigns every flow to the tenant of its client, see pkg/tenant, and answers
+// with a GCS style 429 when the tenant is over its request rate. It must be added before the
+// interceptor addons, they encrypt with the key mapping of the flow's tenant.
+type TenantAddon struct {
+	proxy.BaseAddon
+	registry *tenant.Registry
+}
+
+func NewTenantAddon(registry *tenant.Registry) *TenantAddon {
+	return &TenantAddon{registry: registry}
+}
+
+func (a *TenantAddon) Requestheaders(f *proxy.Flow) {
+	if f.Request.Method == http.MethodConnect {
+		return
+	}
+	t := a.registry.Identify(clientIP(f), f.Request.Header.Get("Authorization"))
+	if t == nil {
+		return
+	}
+	tenant.Assign(f, t)
+	go func() {
+		<-f.Done()
+		tenant.Forget(f)
+	}()
+
+	if !t.Allow() {
+		log.Warnf("tenant %v is over its rate limit, rejecting %v %v", t.Name, f.Request.Method, f.Request.URL)
+		recordThrottled("tenant", "requests")
+		setRateLimitedResponse(f, "tenant "+t.Name+" is over its request rate limit")
+	}
+}
+
+// setRateLimitedResponse answers f with a 429 that GCS clients retry with backoff
+func setRateLimitedResponse(f *proxy.Flow, message string) {
+	interceptor.GcsErrorResponse(f, http.StatusTooManyRequests, "rateLimitExceeded", message)
+	f.Response.Header.Set("Retry-After", "1")
+}
+
+// clientIP returns the address of the client that sent f, through the loopback relay of
+// forwardConnections when the proxy serves pre-bound or socket activated listeners
+func clientIP(f *proxy.Flow) net.IP {
+	if f.ConnContext == nil || f.ConnContext.ClientConn == nil || f.ConnContext.ClientConn.Conn == nil {
+		return nil
+	}
+	addr := f.ConnContext.ClientConn.Conn.RemoteAddr()
+	if conn, ok := forwardedClients.Load(addr.String()); ok {
+		addr = conn.(*relayedConn).client
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/backend"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/time/rate"
+)
+
+// ThrottledRequests counts the requests answered with 429 by scope (client, bucket or tenant)
+// and limit (requests or bandwidth), set up by the binary when metrics are exported.
+var ThrottledRequests metric.Int64Counter
+
+// limiters of clients and buckets idle for this long are dropped
+const throttleIdleTimeout = 10 * time.Minute
+
+// Limits are the throttles applied to every client and to every bucket, 0 is unlimited.
+// Clients are told apart by their address.
+type Limits struct {
+	ClientRequestsPerSecond float64
+	ClientBytesPerSecond    float64
+	BucketRequestsPerSecond float64
+	BucketBytesPerSecond    float64
+}
+
+func (l Limits) Enabled() bool {
+	return l.ClientRequestsPerSecond > 0 || l.ClientBytesPerSecond > 0 || l.BucketRequestsPerSecond > 0 || l.BucketBytesPerSecond > 0
+}
+
+/*
+ThrottleAddon answers with a GCS style 429 when a client or a bucket is over its request rate
+or bandwidth, so one noisy workload can't use up the KMS quota and the proxy's memory for the
+others. Request and response bodies are counted once they are read, a large body is let
+through and the client or bucket is throttled until its bandwidth has paid for it.
+*/
+type ThrottleAddon struct {
+	proxy.BaseAddon
+	clients throttles
+	buckets throttles
+}
+
+func NewThrottleAddon(limits Limits) *ThrottleAddon {
+	a := &ThrottleAddon{
+		clients: throttles{requestRate: limits.ClientRequestsPerSecond, byteRate: limits.ClientBytesPerSecond},
+		buckets: throttles{requestRate: limits.BucketRequestsPerSecond, byteRate: limits.BucketBytesPerSecond},
+	}
+	go func() {
+		for range time.Tick(throttleIdleTimeout) {
+			a.clients.dropIdle()
+			a.buckets.dropIdle()
+		}
+	}()
+	return a
+}
+
+func (a *ThrottleAddon) Requestheaders(f *proxy.Flow) {
+	if f.Response != nil || f.Request.Method == http.MethodConnect {
+		return
+	}
+	client, bucket := a.keys(f)
+	if limit := a.clients.allow(client); limit != "" {
+		a.reject(f, "client", limit, fmt.Sprintf("client %v is over its %v limit", client, limit))
+		return
+	}
+	if bucket == "" {
+		return
+	}
+	if limit := a.buckets.allow(bucket); limit != "" {
+		a.reject(f, "bucket", limit, fmt.Sprintf("bucket %v is over its %v limit", bucket, limit))
+	}
+}
+
+func (a *ThrottleAddon) Request(f *proxy.Flow) {
+	a.count(f, len(f.Request.Body))
+}
+
+func (a *ThrottleAddon) Response(f *proxy.Flow) {
+	if f.Response != nil {
+		a.count(f, len(f.Response.Body))
+	}
+}
+
+func (a *ThrottleAddon) count(f *proxy.Flow, n int) {
+	if n == 0 || f.Request.Method == http.MethodConnect {
+		return
+	}
+	client, bucket := a.keys(f)
+	a.clients.take(client, n)
+	if bucket != "" {
+		a.buckets.take(bucket, n)
+	}
+}
+
+// keys returns the client address of f and the bucket it targets, "" when it targets none
+func (a *ThrottleAddon) keys(f *proxy.Flow) (string, string) {
+	client := "unknown"
+	if ip := clientIP(f); ip != nil {
+		client = ip.String()
+	}
+	var bucket string
+	if o, ok := backend.Of(f); ok {
+		bucket = o.Bucket
+	} else if util.IsGcsHost(f.Request.URL.Host) {
+		bucket = util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+	}
+	return client, bucket
+}
+
+func (a *ThrottleAddon) reject(f *proxy.Flow, scope string, limit string, message string) {
+	log.Warnf("%v, rejecting %v %v", message, f.Request.Method, f.Request.URL)
+	recordThrottled(scope, limit)
+	setRateLimitedResponse(f, message)
+}
+
+func recordThrottled(scope string, limit string) {
+	if ThrottledRequests == nil {
+		return
+	}
+	ThrottledRequests.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("scope", scope),
+		attribute.String("limit", limit)))
+}
+
+// throttles holds the limiters of every client or every bucket
+type throttles struct {
+	requestRate float64
+	byteRate    float64
+	mu          sync.Mutex
+	entries     map[string]*throttle
+}
+
+type throttle struct {
+	requests *rate.Limiter
+	bytes    byteBudget
+	used     time.Time
+}
+
+func (t *throttles) get(key string) *throttle {
+	if t.entries == nil {
+		t.entries = map[string]*throttle{}
+	}
+	entry, ok := t.entries[key]
+	if !ok {
+		entry = &throttle{bytes: byteBudget{rate: t.byteRate, tokens: t.byteRate, updated: time.Now()}}
+		if t.requestRate > 0 {
+			entry.requests = rate.NewLimiter(rate.Limit(t.requestRate), int(math.Ceil(t.requestRate)))
+		}
+		t.entries[key] = entry
+	}
+	entry.used = time.Now()
+	return entry
+}
+
+// allow returns the limit key is over, requests or bandwidth, "" when it may send a request
+func (t *throttles) allow(key string) string {
+	if t.requestRate <= 0 && t.byteRate <= 0 {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry := t.get(key)
+	if t.byteRate > 0 && !entry.bytes.available() {
+		return "bandwidth"
+	}
+	if entry.requests != nil && !entry.requests.Allow() {
+		return "requests"
+	}
+	return ""
+}
+
+func (t *throttles) take(key string, n int) {
+	if t.byteRate <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(key).bytes.take(n)
+}
+
+func (t *throttles) dropIdle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, entry := range t.entries {
+		if time.Since(entry.used) > throttleIdleTimeout {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// byteBudget is a token bucket that holds up to one second of bandwidth and goes into debt
+// for bodies larger than that
+type byteBudget struct {
+	rate    float64
+	tokens  float64
+	updated time.Time
+}
+
+func (b *byteBudget) refill() {
+	now := time.Now()
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated = now
+}
+
+func (b *byteBudget) available() bool {
+	b.refill()
+	return b.tokens > 0
+}
+
+func (b *byteBudget) take(n int) {
+	b.refill()
+	b.tokens -= float64(n)
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/logsample"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// TunneledConnections counts the CONNECT tunnels the proxy did not intercept by host, and
+// TunneledBytes their bytes by host and direction (sent by the client, or received). Set up by the
+// binary when metrics are exported.
+var (
+	TunneledConnections metric.Int64Counter
+	TunneledBytes       metric.Int64Counter
+)
+
+/*
+TunnelAddon summarizes every CONNECT tunnel the proxy passes through without intercepting it,
+traffic that reaches GCS unencrypted: one log entry of category tunnel per connection with the
+host, the client, the bytes each way and the duration, once the tunnel closed. The bytes are
+counted by the relay of forwardConnections, which the proxy runs whenever it tunnels; they include
+the CONNECT request and its response.
+*/
+type TunnelAddon struct {
+	proxy.BaseAddon
+}
+
+func NewTunnelAddon() *TunnelAddon {
+	return &TunnelAddon{}
+}
+
+// tunnel is a CONNECT tunnel being passed through
+type tunnel struct {
+	host   string
+	client net.Addr
+	start  time.Time
+}
+
+func (a *TunnelAddon) Requestheaders(f *proxy.Flow) {
+	if f.Request.Method != http.MethodConnect || f.ConnContext == nil || f.ConnContext.Intercept {
+		return
+	}
+	if f.ConnContext.ClientConn == nil || f.ConnContext.ClientConn.Conn == nil {
+		return
+	}
+	addr := f.ConnContext.ClientConn.Conn.RemoteAddr()
+	t := &tunnel{host: f.Request.URL.Host, client: addr, start: time.Now()}
+	if conn, ok := forwardedClients.Load(addr.String()); ok {
+		t.client = conn.(*relayedConn).client
+		conn.(*relayedConn).tunnel.Store(t)
+		return
+	}
+	// mitmproxy serves the client itself, the bytes are unknown
+	go func() {
+		<-f.Done()
+		t.report(-1, -1)
+	}()
+}
+
+// report logs and counts the closed tunnel, sent and received are -1 when unknown
+func (t *tunnel) report(sent int64, received int64) {
+	duration := time.Since(t.start).Round(time.Millisecond)
+	entry := log.WithField(logsample.CategoryField, "tunnel").WithFields(log.Fields{
+		"host":     t.host,
+		"client":   t.client.String(),
+		"duration": duration.String(),
+	})
+	if sent >= 0 {
+		entry = entry.WithFields(log.Fields{"sent": sent, "received": received})
+	}
+	entry.Infof("tunneled %v for %v without interception", t.host, duration)
+
+	ctx := context.Background()
+	host := attribute.String("host", t.host)
+	if TunneledConnections != nil {
+		TunneledConnections.Add(ctx, 1, metric.WithAttributes(host))
+	}
+	if TunneledBytes != nil && sent >= 0 {
+		TunneledBytes.Add(ctx, sent, metric.WithAttributes(host, attribute.String("direction", "sent")))
+		TunneledBytes.Add(ctx, received, metric.WithAttributes(host, attribute.String("direction", "received")))
+	}
+}
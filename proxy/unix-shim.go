@@ -0,0 +1,52 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ServeUnixShim lets clients that only speak HTTP(S)_PROXY over TCP use a proxy listening on a
+unix socket: every connection accepted on listenAddr, normally a loopback address of the
+client's own network namespace, is relayed to the socket at proxySocket (unix:///path or a
+plain path). CONNECT and plain proxy requests go through unchanged.
+*/
+func ServeUnixShim(listenAddr string, proxySocket string) error {
+	socketPath, ok := unixSocketPath(proxySocket)
+	if !ok {
+		socketPath = proxySocket
+	}
+	ln, err := listen(listenAddr, "")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	if tcp, ok := ln.Addr().(*net.TCPAddr); ok && !tcp.IP.IsLoopback() {
+		log.Warnf("the unix socket shim listens on %v, clients outside this host can use the proxy", ln.Addr())
+	}
+	log.Infof("relaying %v to unix socket %v", ln.Addr(), socketPath)
+
+	for {
+		client, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("listener %v stopped accepting: %v", ln.Addr(), err)
+		}
+		go func() {
+			defer client.Close()
+			upstream, err := net.Dial("unix", socketPath)
+			if err != nil {
+				log.Errorf("unable to reach the proxy socket %v: %v", socketPath, err)
+				return
+			}
+			defer upstream.Close()
+			relay(client, upstream)
+		}()
+	}
+}
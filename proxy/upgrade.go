@@ -0,0 +1,213 @@
+//go:build unix
+
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Binary and configuration upgrades hand the listening sockets over to the new process, so clients
+never see a refused connection. The running proxy serves -upgrade_socket; a process started with
+-upgrade connects to it:
+
+	new -> old   "upgrade\n"
+	old -> new   handoff JSON, the sockets' descriptors attached (SCM_RIGHTS) in the same order
+	new -> old   "ready\n" once it serves them
+	old          stops accepting, unbinds -upgrade_socket and closes the connection, then drains
+	new          serves -upgrade_socket when the connection closes
+
+The old process exits once its connections are done, at the latest after -upgrade_drain_timeout.
+A new process that fails before it is ready leaves the old one serving.
+*/
+
+// handoff names the sockets passed to the new process: "listen:<addr>" per listen address, "health",
+// "admin" and "metadata"
+type handoff struct {
+	Names []string `json:"names"`
+}
+
+// requestHandoff takes over the sockets of the proxy serving path. The connection stays open until
+// the new process is ready, see signalReady.
+func requestHandoff(path string) (map[string]net.Listener, *net.UnixConn, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to reach the running proxy on %v: %v", path, err)
+	}
+	if _, err := conn.Write([]byte("upgrade\n")); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unable to request the handoff: %v", err)
+	}
+
+	buf, oob := make([]byte, 64*1024), make([]byte, syscall.CmsgSpace(64*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unable to receive the sockets: %v", err)
+	}
+	var fds []int
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err == nil {
+		for _, message := range messages {
+			rights, err := syscall.ParseUnixRights(&message)
+			if err == nil {
+				fds = append(fds, rights...)
+			}
+		}
+	}
+	var h handoff
+	if err := json.Unmarshal(buf[:n], &h); err != nil || len(h.Names) != len(fds) {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		conn.Close()
+		return nil, nil, fmt.Errorf("invalid handoff of %v sockets: %s", len(fds), buf[:n])
+	}
+
+	listeners := make(map[string]net.Listener, len(fds))
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), h.Names[i])
+		ln, err := net.FileListener(file)
+		file.Close() // FileListener dups the descriptor
+		if err != nil {
+			closeListeners(mapValues(listeners))
+			conn.Close()
+			return nil, nil, fmt.Errorf("handed over socket %v is not a listening socket: %v", h.Names[i], err)
+		}
+		log.Infof("took over listener %v (%v)", h.Names[i], ln.Addr())
+		listeners[h.Names[i]] = ln
+	}
+	return listeners, conn, nil
+}
+
+// signalReady tells the old process to stop accepting and waits until it let go of the upgrade socket
+func signalReady(conn *net.UnixConn) error {
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ready\n")); err != nil {
+		return fmt.Errorf("unable to signal the running proxy: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Minute))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("running proxy did not release the upgrade socket: %v", err)
+	}
+	return nil
+}
+
+// serveUpgrades hands the sockets over to the first process that asks for them on path and is ready
+// to serve them, then drains this one.
+func (r *ProxyRunner) serveUpgrades(path string) {
+	ln, err := listenUnix(path, "0600")
+	if err != nil {
+		log.Errorf("upgrades disabled: %v", err)
+		return
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Errorf("upgrade socket %v stopped accepting: %v", path, err)
+			return
+		}
+		if r.handOver(conn.(*net.UnixConn)) {
+			r.stopAccepting()
+			ln.Close() // unlinks path, the new process binds it once conn is closed
+			conn.Close()
+			r.drain()
+			return
+		}
+		conn.Close()
+	}
+}
+
+// handOver passes the sockets over conn and reports whether the new process serves them
+func (r *ProxyRunner) handOver(conn *net.UnixConn) bool {
+	reader := bufio.NewReader(conn)
+	if request, err := reader.ReadString('\n'); err != nil || strings.TrimSpace(request) != "upgrade" {
+		log.Warnf("invalid request on the upgrade socket: %q", request)
+		return false
+	}
+
+	var h handoff
+	var fds []int
+	for _, s := range r.sockets {
+		filer, ok := s.ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			log.Errorf("upgrade refused, listener %v can't be handed over", s.name)
+			return false
+		}
+		file, err := filer.File()
+		if err != nil {
+			log.Errorf("upgrade refused, listener %v: %v", s.name, err)
+			return false
+		}
+		defer file.Close()
+		h.Names = append(h.Names, s.name)
+		fds = append(fds, int(file.Fd()))
+	}
+	data, _ := json.Marshal(h)
+	if _, _, err := conn.WriteMsgUnix(data, syscall.UnixRights(fds...), nil); err != nil {
+		log.Errorf("upgrade failed, unable to pass the sockets: %v", err)
+		return false
+	}
+	log.Infof("handed %v sockets over to the new process, waiting for it to be ready", len(fds))
+
+	if ready, err := reader.ReadString('\n'); err != nil || strings.TrimSpace(ready) != "ready" {
+		log.Errorf("new process failed before serving, keeping on serving: %v", err)
+		return false
+	}
+	return true
+}
+
+// stopAccepting closes this process's copy of the handed over sockets
+func (r *ProxyRunner) stopAccepting() {
+	r.listening.Store(false)
+	for _, s := range r.sockets {
+		if unix, ok := s.ln.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false) // the socket file is the new process's now
+		}
+	}
+	for _, server := range r.servers {
+		server.Close()
+	}
+	for _, s := range r.sockets {
+		s.ln.Close() // the new process holds its own descriptors
+	}
+}
+
+// drain waits for the open connections to finish and exits
+func (r *ProxyRunner) drain() {
+	log.Infof("upgraded, draining %v connections for at most %v", activeConnections(), r.config.UpgradeDrainTimeout)
+	deadline := time.Now().Add(r.config.UpgradeDrainTimeout)
+	for activeConnections() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := activeConnections(); n > 0 {
+		log.Warnf("drain timeout, closing %v connections", n)
+	}
+	log.Info("drained, exiting")
+	os.Exit(0)
+}
+
+func mapValues(listeners map[string]net.Listener) []net.Listener {
+	values := make([]net.Listener, 0, len(listeners))
+	for _, ln := range listeners {
+		values = append(values, ln)
+	}
+	return values
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func requestHandoff(path string) (map[string]net.Listener, *net.UnixConn, error) {
+	return nil, nil, fmt.Errorf("upgrades are not supported on this platform")
+}
+
+func signalReady(conn *net.UnixConn) error {
+	return fmt.Errorf("upgrades are not supported on this platform")
+}
+
+func (r *ProxyRunner) serveUpgrades(path string) {
+	log.Errorf("upgrades are not supported on this platform, not serving %v", path)
+}
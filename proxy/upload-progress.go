@@ -0,0 +1,125 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsrewrite"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+/*
+The proxy reads a whole upload before it encrypts it, so the progress bar of the client reaches
+100% once the proxy has the data, long before GCS has it. UploadProgress counts the bytes of every
+upload as they are sent to GCS, GET /v1/uploads of the admin API reports how far each one is.
+Resumable uploads are reported by chunk, GCS persists their progress across chunks itself.
+
+The client sees the count too: the response of an upload has the bytes that reached GCS in
+X-Gcs-Proxy-Upstream-Bytes, the 308 answering a chunk the proxy buffers has 0.
+*/
+type UploadProgress struct {
+	proxy.BaseAddon
+}
+
+func NewUploadProgress() *UploadProgress {
+	return &UploadProgress{}
+}
+
+// uploadStatus is the admin API representation of an upload being sent to GCS
+type uploadStatus struct {
+	Bucket    string    `json:"bucket"`
+	Object    string    `json:"object,omitempty"` // absent when the request names it in its body
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Started   time.Time `json:"started"`   // when the proxy started sending it to GCS
+	Bytes     int64     `json:"bytes"`     // sent to GCS in total, the ciphertext of encrypted uploads
+	SentBytes int64     `json:"sentBytes"` // sent to GCS so far
+}
+
+type upload struct {
+	status uploadStatus
+	sent   atomic.Int64
+}
+
+var uploads sync.Map // flow id -> *upload
+
+// StreamRequestModifier counts the bytes the upstream request reads from the upload body. It must be
+// the last addon to wrap the body, what it counts is what leaves for GCS.
+func (a *UploadProgress) StreamRequestModifier(f *proxy.Flow, in io.Reader) io.Reader {
+	if f.Response != nil || (f.Request.Method != http.MethodPost && f.Request.Method != http.MethodPut) ||
+		!util.IsGcsHost(f.Request.URL.Host) {
+		return in
+	}
+	size := int64(len(f.Request.Body))
+	if f.Stream {
+		// too large to read first, sent as the client sends it
+		size, _ = strconv.ParseInt(f.Request.Header.Get("Content-Length"), 10, 64)
+	}
+	if size <= 0 {
+		return in
+	}
+	path := f.Request.URL.Path
+	object := f.Request.URL.Query().Get("name")
+	if object == "" {
+		object = util.GetObjectNameFromRequestUri(path)
+	}
+	u := &upload{status: uploadStatus{
+		Bucket:  util.GetBucketNameFromRequestUri(path),
+		Object:  object,
+		Method:  f.Request.Method,
+		Path:    path,
+		Started: time.Now(),
+		Bytes:   size,
+	}}
+	uploads.Store(f.Id, u)
+	go func() {
+		<-f.Done()
+		uploads.Delete(f.Id)
+	}()
+	return &countingReader{reader: in, count: &u.sent}
+}
+
+// Response tells the client how much of its upload GCS received, see hdl.UpstreamBytesHeader
+func (a *UploadProgress) Response(f *proxy.Flow) {
+	value, ok := uploads.Load(f.Id)
+	if !ok || f.Response == nil {
+		return
+	}
+	f.Response.Header.Set(hdl.UpstreamBytesHeader, strconv.FormatInt(value.(*upload).sent.Load(), 10))
+}
+
+// uploadsInProgress returns the uploads being sent to GCS, the oldest first
+func uploadsInProgress() []uploadStatus {
+	statuses := []uploadStatus{}
+	uploads.Range(func(_, value any) bool {
+		u := value.(*upload)
+		status := u.status
+		status.SentBytes = u.sent.Load()
+		statuses = append(statuses, status)
+		return true
+	})
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Started.Before(statuses[j].Started) })
+	return statuses
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,494 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+
+/*
+Conformance runs every operation the proxy supports through a running proxy against a real bucket
+and writes a compatibility report. Each object is uploaded with every upload type, size and content
+encoding, checked to be encrypted at rest by reading it without the proxy, and read back through
+the proxy with the JSON and XML APIs, its metadata and a set of ranges. Started by make conformance,
+see run.sh:
+
+	go run ./test/conformance -bucket=my-test-bucket -proxy=http://127.0.0.1:19080 -ca_bundle=certs/mitmproxy-ca.pem
+
+The report is written to -report_dir as report.json and report.md, the exit status is 1 if a check
+failed. The objects are deleted afterwards.
+*/
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// upload types of the matrix
+const (
+	uploadMedia            = "media"
+	uploadMultipart        = "multipart"
+	uploadResumable        = "resumable"
+	uploadResumableChunked = "resumable-chunked" // 256 KiB chunks from a Java SDK user agent
+	uploadXml              = "xml"
+)
+
+// check results
+const (
+	resultPass = "pass"
+	resultFail = "FAIL"
+	resultSkip = "skip"
+)
+
+const chunkSize = 256 * 1024
+
+// Case is the outcome of one check of one object
+type Case struct {
+	Upload     string  `json:"upload"`
+	Size       int     `json:"size"`
+	Encoding   string  `json:"encoding"`
+	Check      string  `json:"check"`
+	Result     string  `json:"result"`
+	Detail     string  `json:"detail,omitempty"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+// Report is the compatibility report of a run
+type Report struct {
+	Started time.Time      `json:"started"`
+	Bucket  string         `json:"bucket"`
+	Proxy   string         `json:"proxy"`
+	Cases   []Case         `json:"cases"`
+	Summary map[string]int `json:"summary"` // cases by result
+}
+
+type runner struct {
+	bucket  string
+	prefix  string
+	proxied *http.Client // through the proxy
+	direct  *http.Client // to GCS, to see what is stored
+	report  *Report
+}
+
+func main() {
+	bucket := flag.String("bucket", os.Getenv("BUCKET"), "test bucket the proxy encrypts, its objects under the prefix conformance/ are overwritten")
+	proxyUrl := flag.String("proxy", "http://127.0.0.1:19080", "the running proxy")
+	caBundle := flag.String("ca_bundle", "", "PEM file of the proxy's CA, e.g. the mitmproxy-ca.pem of its -cert_path")
+	reportDir := flag.String("report_dir", "conformance-report", "directory the report is written to")
+	sizesString := flag.String("sizes", "0,1,1000,262145,5242881", "object sizes in bytes, comma separated")
+	flag.Parse()
+	if *bucket == "" || *caBundle == "" {
+		fmt.Fprintln(os.Stderr, "usage: conformance -bucket=BUCKET -ca_bundle=mitmproxy-ca.pem [-proxy=URL] [-report_dir=DIR]")
+		os.Exit(2)
+	}
+	var sizes []int
+	for _, s := range strings.Split(*sizesString, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || size < 0 {
+			fmt.Fprintf(os.Stderr, "invalid size %q\n", s)
+			os.Exit(2)
+		}
+		sizes = append(sizes, size)
+	}
+
+	ctx := context.Background()
+	r, err := newRunner(ctx, *bucket, *proxyUrl, *caBundle)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, upload := range []string{uploadMedia, uploadMultipart, uploadResumable, uploadResumableChunked, uploadXml} {
+		for _, size := range sizes {
+			for _, encoding := range []string{"identity", "gzip"} {
+				r.run(upload, size, encoding)
+			}
+		}
+	}
+
+	r.report.Summary = map[string]int{}
+	for _, c := range r.report.Cases {
+		r.report.Summary[c.Result]++
+	}
+	if err := writeReport(r.report, *reportDir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%v passed, %v failed, %v skipped, report in %v\n",
+		r.report.Summary[resultPass], r.report.Summary[resultFail], r.report.Summary[resultSkip], *reportDir)
+	if r.report.Summary[resultFail] > 0 {
+		os.Exit(1)
+	}
+}
+
+func newRunner(ctx context.Context, bucket string, proxyUrl string, caBundle string) (*runner, error) {
+	tokens, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/devstorage.read_write")
+	if err != nil {
+		return nil, fmt.Errorf("no application default credentials: %v", err)
+	}
+	pem, err := os.ReadFile(caBundle)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in %v", caBundle)
+	}
+	proxyAddr, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -proxy: %v", err)
+	}
+	client := func(transport *http.Transport) *http.Client {
+		return &http.Client{
+			Transport: &oauth2.Transport{Source: tokens, Base: transport},
+			Timeout:   5 * time.Minute,
+			// the checks look at every status themselves
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+	}
+	started := time.Now().UTC()
+	id := make([]byte, 2)
+	rand.Read(id)
+	return &runner{
+		bucket:  bucket,
+		prefix:  fmt.Sprintf("conformance/%v-%v/", started.Format("20060102T150405Z"), hex.EncodeToString(id)),
+		proxied: client(&http.Transport{Proxy: http.ProxyURL(proxyAddr), TLSClientConfig: &tls.Config{RootCAs: roots}}),
+		direct:  client(&http.Transport{}),
+		report:  &Report{Started: started, Bucket: bucket, Proxy: proxyUrl},
+	}, nil
+}
+
+// run uploads one object of the matrix and checks it
+func (r *runner) run(upload string, size int, encoding string) {
+	name := fmt.Sprintf("%v%v-%v-%v", r.prefix, upload, size, encoding)
+	plaintext := make([]byte, size)
+	rand.Read(plaintext)
+	stored := plaintext
+	if encoding == "gzip" {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(plaintext)
+		writer.Close()
+		stored = compressed.Bytes()
+	}
+	record := func(check string, start time.Time, err error) {
+		c := Case{Upload: upload, Size: size, Encoding: encoding, Check: check, Result: resultPass,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			c.Result, c.Detail = resultFail, err.Error()
+			if skip, ok := err.(skipped); ok {
+				c.Result, c.Detail = resultSkip, string(skip)
+			}
+		}
+		r.report.Cases = append(r.report.Cases, c)
+		fmt.Printf("%-4v %-17v %8v %-8v %-16v %v\n", c.Result, upload, size, encoding, check, c.Detail)
+	}
+
+	start := time.Now()
+	err := r.upload(upload, name, stored, encoding)
+	record("upload", start, err)
+	if err != nil {
+		return
+	}
+	defer r.delete(name)
+
+	start = time.Now()
+	record("encrypted-at-rest", start, r.checkEncrypted(name, stored))
+	start = time.Now()
+	record("metadata", start, r.checkMetadata(name, stored))
+	for _, api := range []string{"json", "xml"} {
+		start = time.Now()
+		record("download-"+api, start, r.checkDownload(api, name, stored, plaintext, ""))
+	}
+	for _, rg := range ranges(size) {
+		start = time.Now()
+		if encoding == "gzip" {
+			record("range "+rg.header, start, skipped("ranges of gzip objects are served by GCS as a whole"))
+			continue
+		}
+		record("range "+rg.header, start, r.checkDownload("json", name, stored, plaintext[rg.start:rg.end], rg.header))
+	}
+}
+
+// skipped is a check that does not apply
+type skipped string
+
+func (s skipped) Error() string { return string(s) }
+
+type byteRange struct {
+	header     string
+	start, end int // of the expected slice
+}
+
+// ranges are the reads of an object of size bytes, first bytes, middle, suffix, open and beyond the end
+func ranges(size int) []byteRange {
+	if size == 0 {
+		return nil
+	}
+	first := min(10, size)
+	middle := size / 2
+	return []byteRange{
+		{fmt.Sprintf("bytes=0-%d", first-1), 0, first},
+		{fmt.Sprintf("bytes=%d-%d", middle, min(middle+chunkSize, size)-1), middle, min(middle+chunkSize, size)},
+		{fmt.Sprintf("bytes=-%d", first), size - first, size},
+		{fmt.Sprintf("bytes=%d-", middle), middle, size},
+		{fmt.Sprintf("bytes=0-%d", size+1000), 0, size},
+	}
+}
+
+func (r *runner) objectUrl(name string) string {
+	return fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%v/o/%v", r.bucket, url.PathEscape(name))
+}
+
+func (r *runner) upload(upload string, name string, data []byte, encoding string) error {
+	query := url.Values{"name": {name}}
+	resource := map[string]string{"name": name}
+	if encoding == "gzip" {
+		query.Set("contentEncoding", "gzip")
+		resource["contentEncoding"] = "gzip"
+	}
+	uploadUrl := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%v/o", r.bucket)
+
+	switch upload {
+	case uploadMedia:
+		query.Set("uploadType", "media")
+		return r.expect(r.proxied, http.MethodPost, uploadUrl+"?"+query.Encode(), data, http.Header{"Content-Type": {"application/octet-stream"}}, http.StatusOK)
+
+	case uploadMultipart:
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		metadata, _ := json.Marshal(resource)
+		part, _ := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+		part.Write(metadata)
+		part, _ = writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/octet-stream"}})
+		part.Write(data)
+		writer.Close()
+		header := http.Header{"Content-Type": {"multipart/related; boundary=" + writer.Boundary()}}
+		return r.expect(r.proxied, http.MethodPost, uploadUrl+"?uploadType=multipart", body.Bytes(), header, http.StatusOK)
+
+	case uploadResumable, uploadResumableChunked:
+		header := http.Header{}
+		if upload == uploadResumableChunked {
+			header.Set("User-Agent", "gcloud-java/2.40.0 conformance")
+			header.Set("X-Goog-Api-Client", "gl-java/17 gccl/2.40.0")
+		}
+		metadata, _ := json.Marshal(resource)
+		header.Set("Content-Type", "application/json; charset=UTF-8")
+		resp, err := r.send(r.proxied, http.MethodPost, uploadUrl+"?uploadType=resumable", metadata, header)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		header.Set("Content-Type", "application/octet-stream")
+		session := resp.Header.Get("Location")
+		if resp.StatusCode != http.StatusOK || session == "" {
+			return fmt.Errorf("starting the session answered %v", resp.Status)
+		}
+		step := len(data)
+		if upload == uploadResumableChunked {
+			step = chunkSize
+		}
+		for offset := 0; ; offset += step {
+			end := min(offset+step, len(data))
+			last := end == len(data)
+			total := "*"
+			if last {
+				total = strconv.Itoa(len(data))
+			}
+			contentRange := fmt.Sprintf("bytes %d-%d/%v", offset, end-1, total)
+			if offset == end {
+				contentRange = "bytes */" + total
+			}
+			header.Set("Content-Range", contentRange)
+			status := http.StatusPermanentRedirect
+			if last {
+				status = http.StatusOK
+			}
+			if err := r.expect(r.proxied, http.MethodPut, session, data[offset:end], header, status); err != nil {
+				return fmt.Errorf("chunk %v: %v", contentRange, err)
+			}
+			if last {
+				return nil
+			}
+		}
+
+	case uploadXml:
+		header := http.Header{"Content-Type": {"application/octet-stream"}}
+		if encoding == "gzip" {
+			header.Set("Content-Encoding", "gzip")
+		}
+		return r.expect(r.proxied, http.MethodPut, fmt.Sprintf("https://storage.googleapis.com/%v/%v", r.bucket, name), data, header, http.StatusOK)
+	}
+	return fmt.Errorf("unknown upload type %v", upload)
+}
+
+// checkEncrypted reads the object without the proxy, it must be recorded as encrypted and differ
+func (r *runner) checkEncrypted(name string, data []byte) error {
+	var resource struct {
+		Metadata map[string]string `json:"metadata"`
+	}
+	if err := r.getJson(r.direct, r.objectUrl(name)+"?alt=json", &resource); err != nil {
+		return err
+	}
+	if util.Meta(resource.Metadata, util.MetaEncryptionKey) == "" {
+		return fmt.Errorf("stored without the encryption key metadata, in plaintext")
+	}
+	resp, err := r.send(r.direct, http.MethodGet, r.objectUrl(name)+"?alt=media", nil, http.Header{"Accept-Encoding": {"gzip"}})
+	if err != nil {
+		return err
+	}
+	stored, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 && bytes.Contains(stored, data) {
+		return fmt.Errorf("the stored object holds the uploaded bytes")
+	}
+	return nil
+}
+
+// checkMetadata compares the object resource the proxy returns with the uploaded bytes
+func (r *runner) checkMetadata(name string, data []byte) error {
+	var resource struct {
+		Size    string `json:"size"`
+		Md5Hash string `json:"md5Hash"`
+	}
+	if err := r.getJson(r.proxied, r.objectUrl(name)+"?alt=json", &resource); err != nil {
+		return err
+	}
+	digest := md5.Sum(data)
+	if resource.Size != strconv.Itoa(len(data)) {
+		return fmt.Errorf("size %v, uploaded %v bytes", resource.Size, len(data))
+	}
+	if expected := base64.StdEncoding.EncodeToString(digest[:]); resource.Md5Hash != expected {
+		return fmt.Errorf("md5Hash %v, expected %v", resource.Md5Hash, expected)
+	}
+	return nil
+}
+
+// checkDownload reads the object, or rangeHeader of it, through the proxy. A gzip answer must be
+// the uploaded bytes, any other the plaintext.
+func (r *runner) checkDownload(api string, name string, stored []byte, plaintext []byte, rangeHeader string) error {
+	downloadUrl := r.objectUrl(name) + "?alt=media"
+	if api == "xml" {
+		downloadUrl = fmt.Sprintf("https://storage.googleapis.com/%v/%v", r.bucket, name)
+	}
+	header := http.Header{"Accept-Encoding": {"gzip"}}
+	if rangeHeader != "" {
+		header.Set("Range", rangeHeader)
+	}
+	resp, err := r.send(r.proxied, http.MethodGet, downloadUrl, nil, header)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("answered %v: %.200s", resp.Status, body)
+	}
+	expected := plaintext
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		expected = stored
+	}
+	if !bytes.Equal(body, expected) {
+		return fmt.Errorf("got %v bytes (%v), expected %v", len(body), resp.Header.Get("Content-Range"), len(expected))
+	}
+	return nil
+}
+
+func (r *runner) delete(name string) {
+	if resp, err := r.send(r.direct, http.MethodDelete, r.objectUrl(name), nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (r *runner) send(client *http.Client, method string, target string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	return client.Do(req)
+}
+
+// expect sends the request and fails unless it is answered with status
+func (r *runner) expect(client *http.Client, method string, target string, body []byte, header http.Header, status int) error {
+	resp, err := r.send(client, method, target, body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		answer, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("answered %v: %.200s", resp.Status, answer)
+	}
+	return nil
+}
+
+func (r *runner) getJson(client *http.Client, target string, v any) error {
+	resp, err := r.send(client, http.MethodGet, target, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		answer, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("answered %v: %.200s", resp.Status, answer)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// writeReport writes report.json and a markdown table of the results by object and check
+func writeReport(report *Report, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "report.json"), data, 0644); err != nil {
+		return err
+	}
+
+	var md bytes.Buffer
+	fmt.Fprintf(&md, "# go-gcsproxy conformance\n\nbucket `%v`, proxy `%v`, started %v\n\n", report.Bucket, report.Proxy, report.Started.Format(time.RFC3339))
+	fmt.Fprintf(&md, "%v passed, %v failed, %v skipped\n\n", report.Summary[resultPass], report.Summary[resultFail], report.Summary[resultSkip])
+	fmt.Fprintln(&md, "| upload | size | encoding | check | result | detail |")
+	fmt.Fprintln(&md, "| --- | --- | --- | --- | --- | --- |")
+	for _, c := range report.Cases {
+		fmt.Fprintf(&md, "| %v | %v | %v | %v | %v | %v |\n", c.Upload, c.Size, c.Encoding, c.Check, c.Result, strings.ReplaceAll(c.Detail, "|", "\\|"))
+	}
+	return os.WriteFile(filepath.Join(dir, "report.md"), md.Bytes(), 0644)
+}
@@ -0,0 +1,44 @@
+#!/bin/bash
+#
+# Runs the conformance suite against a real bucket and KMS key: starts the proxy built by
+# make server with the bucket mapped to the key, runs test/conformance through it and stops it.
+# The report and the proxy log are written to $REPORT_DIR.
+#
+#   BUCKET=my-test-bucket KMS_KEY=projects/p/locations/global/keyRings/r/cryptoKeys/k make conformance
+
+if [[ -z "$BUCKET" || -z "$KMS_KEY" ]]; then
+  echo "Error: set BUCKET to a test bucket and KMS_KEY to a KMS key the proxy may encrypt and decrypt with." >&2
+  exit 2
+fi
+
+REPORT_DIR=${REPORT_DIR:-conformance-report}
+PROXY_ADDR=${PROXY_ADDR:-127.0.0.1:19080}
+HEALTH_ADDR=${HEALTH_ADDR:-127.0.0.1:19083}
+CERT_PATH=$(mktemp -d)
+mkdir -p "$REPORT_DIR"
+
+bin/go-gcsproxy -port="$PROXY_ADDR" -health_port="$HEALTH_ADDR" -cert_path="$CERT_PATH" \
+  -kms_bucket_key_mappings="$BUCKET:$KMS_KEY" > "$REPORT_DIR/proxy.log" 2>&1 &
+PROXY_PID=$!
+
+teardown() {
+  kill $PROXY_PID 2> /dev/null
+  wait $PROXY_PID 2> /dev/null
+  rm -rf "$CERT_PATH"
+}
+trap teardown EXIT
+
+# the proxy checks the key at startup before it is ready
+for _ in $(seq 60); do
+  if curl -sf "http://$HEALTH_ADDR/readyz" > /dev/null; then
+    break
+  fi
+  if ! kill -0 $PROXY_PID 2> /dev/null; then
+    echo "Error: the proxy exited, see $REPORT_DIR/proxy.log" >&2
+    exit 1
+  fi
+  sleep 1
+done
+
+go run ./test/conformance -bucket="$BUCKET" -proxy="http://$PROXY_ADDR" \
+  -ca_bundle="$CERT_PATH/mitmproxy-ca.pem" -report_dir="$REPORT_DIR" ${SIZES:+-sizes="$SIZES"}
@@ -90,7 +90,7 @@ def test_resumable_upload_byterange_download(setup_data):
     get_metadata_response = _get_object_metadata(
         TEST_BUCKET, object_name, access_token)
     content = json.loads(get_metadata_response.content.decode("utf-8"))
-    metadata_uncrypted_content_length = content["metadata"]["x-unencrypted-content-length"]
+    metadata_uncrypted_content_length = content["metadata"]["gcsproxy-unencrypted-content-length"]
     size = content["size"]
     generation = content["generation"]
 
@@ -1,5 +1,9 @@
 #!/bin/bash
 #
+# Optional, the tests needing them skip without:
+#   MAX_OBJECT_SIZE_BUCKET, MAX_OBJECT_SIZE  a -max_object_sizes entry of the proxy
+#   RESTRICTED_BUCKET                        a -decrypt_clients bucket this machine may not decrypt
+#   ADMIN_URL, ADMIN_TOKEN                   the admin API of the proxy, for the bypass tests
 
 if [[ -z "$CA_BUNDLE" ]]; then
   echo "Error: CA_BUNDLE environment variable is not set. eg: /Users/<USERNAME>/certs/mitmproxy-ca.pem" >&2
@@ -0,0 +1,69 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+# Needs a proxy started with -admin_port and -admin_token, ADMIN_URL is its admin API,
+# e.g. http://127.0.0.1:9082, and ADMIN_TOKEN the token. $BUCKET must be mapped.
+
+setup() {
+    if [[ -z "$ADMIN_URL" || -z "$ADMIN_TOKEN" ]]; then
+        skip "ADMIN_URL and ADMIN_TOKEN are not set"
+    fi
+    export TESTFILE="bypass_expiry.txt"
+    echo "This is a bypass expiry test file" > $TESTFILE
+    export TOKEN=$(gcloud auth print-access-token)
+    export UPLOAD="https://storage.googleapis.com/upload/storage/v1/b/$BUCKET/o?uploadType=media"
+    export MEDIA="https://storage.googleapis.com/storage/v1/b/$BUCKET/o"
+}
+
+teardown() {
+    rm -f $TESTFILE $TESTFILE.out
+}
+
+upload() {
+    curl -s -o /dev/null -w "%{http_code}" -X POST --data-binary @$TESTFILE \
+            -H "Authorization: Bearer $TOKEN" \
+            -H "Content-Type: text/plain" \
+            "$UPLOAD&name=$1" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+}
+
+# downloads $1 straight from GCS, as it is stored
+download_stored() {
+    curl -s --noproxy "*" -o $TESTFILE.out "$MEDIA/$1?alt=media" -H "Authorization: Bearer $TOKEN"
+}
+
+@test "Test bypass expiry - bypass stores uploads in plaintext until it expires" {
+    run curl -s -o /dev/null -w "%{http_code}" -X PUT "$ADMIN_URL/v1/bypasses/$BUCKET" \
+            -H "Authorization: Bearer $ADMIN_TOKEN" \
+            -d '{"reason":"regression test of the bypass expiry","duration":"5s","requestedBy":"bats"}'
+    assert_output "200"
+
+    run upload $TESTFILE.bypassed
+    assert_output "200"
+    download_stored $TESTFILE.bypassed
+    run cmp $TESTFILE $TESTFILE.out
+    assert_success
+
+    sleep 6
+    run curl -s "$ADMIN_URL/v1/bypasses" -H "Authorization: Bearer $ADMIN_TOKEN"
+    assert_success
+    refute_output --partial "\"bucket\":\"$BUCKET\""
+
+    run upload $TESTFILE.encrypted
+    assert_output "200"
+    download_stored $TESTFILE.encrypted
+    run cmp $TESTFILE $TESTFILE.out
+    assert_failure
+}
+
+@test "Test bypass expiry - deleting an expired bypass is answered 404" {
+    run curl -s -o /dev/null -w "%{http_code}" -X DELETE "$ADMIN_URL/v1/bypasses/$BUCKET" \
+            -H "Authorization: Bearer $ADMIN_TOKEN"
+    assert_output "404"
+}
+
+@test "Test bypass expiry - cleanup" {
+    run gcloud storage rm gs://$BUCKET/$TESTFILE.bypassed gs://$BUCKET/$TESTFILE.encrypted
+    assert_success
+}
@@ -27,7 +27,7 @@ download_range() {
 
 @test "GCS byte range: download first 10 bytes" {
   
-  run download_range 0 10
+  run download_range 0 9
   assert_success
   # Assuming your object contains predictable content, like "0123456789ABCDEF..."
   assert_output "0123456789"
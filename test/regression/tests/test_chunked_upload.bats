@@ -0,0 +1,63 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+setup() {
+    export TESTFILE="chunked_file.bin"
+    # the same content in every test, setup runs before each
+    yes "chunked upload test content" | head -c 3145728 > $TESTFILE
+    export TOKEN=$(gcloud auth print-access-token)
+}
+
+teardown() {
+    rm -f $TESTFILE $TESTFILE.out
+}
+
+# curl streams stdin with Transfer-Encoding: chunked and no Content-Length
+@test "Test chunked upload - uploadType=media from stdin" {
+    run bash -c "cat $TESTFILE | curl -s -X POST -T - \
+            -H 'Authorization: Bearer $TOKEN' \
+            -H 'Content-Type: application/octet-stream' \
+            'https://storage.googleapis.com/upload/storage/v1/b/$BUCKET/o?uploadType=media&name=$TESTFILE' \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY"
+    assert_success
+    assert_output --partial "$TESTFILE"
+}
+
+@test "Test chunked upload - download matches" {
+    run curl -s -o $TESTFILE.out \
+            "https://storage.googleapis.com/storage/v1/b/$BUCKET/o/$TESTFILE?alt=media" \
+            -H "Authorization: Bearer $TOKEN" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_success
+    run cmp $TESTFILE $TESTFILE.out
+    assert_success
+}
+
+@test "Test chunked upload - plaintext size in metadata" {
+    local expected_size=$(xargs <<< $(wc -c < $TESTFILE))
+    run curl -s -I https://storage.googleapis.com/$BUCKET/$TESTFILE \
+            -H "Authorization: Bearer $TOKEN" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_output --partial "X-Goog-Meta-X-Unencrypted-Content-Length: $expected_size"
+}
+
+@test "Test chunked upload - explicit Transfer-Encoding header" {
+    run curl -s -X POST \
+            -H "Authorization: Bearer $TOKEN" \
+            -H "Content-Type: text/plain" \
+            -H "Transfer-Encoding: chunked" \
+            --data-binary @$TESTFILE \
+            "https://storage.googleapis.com/upload/storage/v1/b/$BUCKET/o?uploadType=media&name=$TESTFILE" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_success
+    assert_output --partial "$TESTFILE"
+}
+
+@test "Test chunked upload - cleanup" {
+    run gcloud storage rm gs://$BUCKET/$TESTFILE
+    assert_success
+}
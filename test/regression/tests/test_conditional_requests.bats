@@ -0,0 +1,62 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+setup() {
+  export TESTFILE="conditional-requests.txt"
+  echo "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ" > $TESTFILE
+}
+
+teardown() {
+  rm -f $TESTFILE headers.txt
+}
+
+# GET the object through the proxy, passing any extra curl arguments
+download() {
+  curl -s https://storage.googleapis.com/$BUCKET/$TESTFILE \
+        -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+        --cacert $CA_BUNDLE \
+        --proxy $HTTPS_PROXY \
+        "$@"
+}
+
+get_etag() {
+  download -D - -o /dev/null | grep -i '^etag:' | cut -d' ' -f2 | tr -d '\r'
+}
+
+@test "Setup - gcloud storage cp" {
+  run gcloud storage cp $TESTFILE gs://$BUCKET/$TESTFILE
+  assert_success
+}
+
+@test "ETag: download exposes the plaintext hash" {
+  run bash -c "curl -s https://storage.googleapis.com/$BUCKET/$TESTFILE \
+        -H \"Authorization: Bearer $(gcloud auth print-access-token)\" \
+        --cacert $CA_BUNDLE --proxy $HTTPS_PROXY -D - -o /dev/null | grep -i '^x-gcs-proxy-plaintext-etag:' | cut -d' ' -f2 | tr -d '\r\"'"
+  assert_success
+  assert_output "$(md5sum $TESTFILE | cut -d' ' -f1)"
+}
+
+@test "ETag: If-None-Match with the current ETag returns 304" {
+  etag=$(get_etag)
+  run download -o /dev/null -w "%{http_code}" -H "If-None-Match: $etag"
+  assert_success
+  assert_output "304"
+}
+
+@test "ETag: If-Match with a stale ETag returns 412" {
+  run download -o /dev/null -w "%{http_code}" -H 'If-Match: "stale"'
+  assert_success
+  assert_output "412"
+}
+
+@test "ETag: If-Match with the current ETag returns the plaintext" {
+  etag=$(get_etag)
+  run download -H "If-Match: $etag"
+  assert_success
+  assert_output "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+}
+
+@test "Cleanup - gcloud storage rm" {
+  run gcloud storage rm gs://$BUCKET/$TESTFILE
+  assert_success
+}
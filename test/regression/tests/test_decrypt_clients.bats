@@ -0,0 +1,52 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+# Needs a proxy started with a -decrypt_clients entry for $RESTRICTED_BUCKET which does not
+# list the machine running the tests, e.g. -decrypt_clients="$RESTRICTED_BUCKET:10.255.255.255".
+
+setup() {
+    if [[ -z "$RESTRICTED_BUCKET" ]]; then
+        skip "RESTRICTED_BUCKET is not set"
+    fi
+    export TESTFILE="decrypt_clients.txt"
+    echo "This is a decrypt restriction test file" > $TESTFILE
+    export TOKEN=$(gcloud auth print-access-token)
+}
+
+teardown() {
+    rm -f $TESTFILE $TESTFILE.out
+}
+
+@test "Test decrypt clients - upload is encrypted for any client" {
+    run curl -s -o /dev/null -w "%{http_code}" -X POST --data-binary @$TESTFILE \
+            -H "Authorization: Bearer $TOKEN" \
+            -H "Content-Type: text/plain" \
+            "https://storage.googleapis.com/upload/storage/v1/b/$RESTRICTED_BUCKET/o?uploadType=media&name=$TESTFILE" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_output "200"
+}
+
+@test "Test decrypt clients - download is refused with 403" {
+    run curl -s -w "\n%{http_code}" \
+            "https://storage.googleapis.com/storage/v1/b/$RESTRICTED_BUCKET/o/$TESTFILE?alt=media" \
+            -H "Authorization: Bearer $TOKEN" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_output --partial "\"reason\":\"forbidden\""
+    assert_line --index 1 "403"
+}
+
+@test "Test decrypt clients - ranged download is refused with 403" {
+    run curl -s -o /dev/null -w "%{http_code}" -H "Range: bytes=0-9" \
+            "https://storage.googleapis.com/storage/v1/b/$RESTRICTED_BUCKET/o/$TESTFILE?alt=media" \
+            -H "Authorization: Bearer $TOKEN" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_output "403"
+}
+
+@test "Test decrypt clients - cleanup" {
+    run gcloud storage rm gs://$RESTRICTED_BUCKET/$TESTFILE
+    assert_success
+}
@@ -0,0 +1,83 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+setup() {
+  export PLACEHOLDER="empty-objects-dir/"
+  export EMPTYFILE="empty-objects.txt"
+  export TESTFILE="empty-objects-size.txt"
+  export UPLOADED="empty-objects-uploaded/"
+  : > $EMPTYFILE
+  echo "0123456789" > $TESTFILE
+}
+
+teardown() {
+  rm -f $EMPTYFILE $TESTFILE
+}
+
+# GET a path of storage.googleapis.com through the proxy
+get() {
+  curl -s "https://storage.googleapis.com/$1" \
+        -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+        --cacert $CA_BUNDLE \
+        --proxy $HTTPS_PROXY \
+        -w "%{http_code}"
+}
+
+@test "Setup - empty objects written without the proxy, an object through it" {
+  # like the directory placeholders of the console and the Hadoop connector
+  run env -u HTTPS_PROXY -u https_proxy curl -s -X POST --data-binary @$EMPTYFILE \
+        "https://storage.googleapis.com/upload/storage/v1/b/$BUCKET/o?uploadType=media&name=$PLACEHOLDER" \
+        -H "Authorization: Bearer $(gcloud auth print-access-token)" -o /dev/null -w "%{http_code}"
+  assert_output "200"
+  run env -u HTTPS_PROXY -u https_proxy gcloud storage cp $EMPTYFILE gs://$BUCKET/$EMPTYFILE
+  assert_success
+  run gcloud storage cp $TESTFILE gs://$BUCKET/$TESTFILE
+  assert_success
+}
+
+@test "Empty objects: JSON API alt=media download of a directory placeholder" {
+  run get "storage/v1/b/$BUCKET/o/empty-objects-dir%2F?alt=media"
+  assert_output "200"
+}
+
+@test "Empty objects: XML API download" {
+  run get "$BUCKET/$EMPTYFILE"
+  assert_output "200"
+}
+
+@test "Empty objects: gcloud storage cat" {
+  run gcloud storage cat gs://$BUCKET/$EMPTYFILE
+  assert_success
+  assert_output ""
+}
+
+@test "Empty objects: an upload through the proxy is stored as it is with the plaintext marker" {
+  run curl -s -X POST --data-binary @$EMPTYFILE \
+        "https://storage.googleapis.com/upload/storage/v1/b/$BUCKET/o?uploadType=media&name=$UPLOADED" \
+        -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+        --cacert $CA_BUNDLE \
+        --proxy $HTTPS_PROXY
+  assert_success
+  assert_output --regexp '"size": ?"0"'
+  run env -u HTTPS_PROXY -u https_proxy gcloud storage objects describe gs://$BUCKET/$UPLOADED --format="value(metadata)"
+  assert_success
+  assert_output --partial "'gcsproxy-plaintext': 'empty'"
+  refute_output --partial "gcsproxy-encryption-key"
+}
+
+@test "Empty objects: the uploaded placeholder downloads empty" {
+  run gcloud storage cat gs://$BUCKET/$UPLOADED
+  assert_success
+  assert_output ""
+}
+
+@test "alt defaults to json: the resource reports the plaintext size" {
+  run get "storage/v1/b/$BUCKET/o/$TESTFILE"
+  assert_output --regexp '"size": ?"11"'
+  assert_output --partial "200"
+}
+
+@test "Cleanup - gcloud storage rm" {
+  run gcloud storage rm gs://$BUCKET/$PLACEHOLDER gs://$BUCKET/$UPLOADED gs://$BUCKET/$EMPTYFILE gs://$BUCKET/$TESTFILE
+  assert_success
+}
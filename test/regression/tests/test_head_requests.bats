@@ -0,0 +1,53 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+setup() {
+  export TESTFILE="head-requests.txt"
+  echo "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ" > $TESTFILE
+  export EXPECTED_SIZE=$(xargs <<< $(wc -c < $TESTFILE))
+}
+
+teardown() {
+  rm -f $TESTFILE
+}
+
+# HEAD a path of storage.googleapis.com through the proxy, with the extra curl arguments of $2...
+head_object() {
+  local path=$1
+  shift
+  curl -s -I "https://storage.googleapis.com/$path" \
+        -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+        --cacert $CA_BUNDLE \
+        --proxy $HTTPS_PROXY "$@"
+}
+
+@test "Setup - gcloud storage cp" {
+  run gcloud storage cp $TESTFILE gs://$BUCKET/$TESTFILE
+  assert_success
+}
+
+@test "HEAD: XML API reports the plaintext length" {
+  run head_object "$BUCKET/$TESTFILE"
+  assert_success
+  assert_output --regexp "[Cc]ontent-[Ll]ength: $EXPECTED_SIZE"
+  assert_output --regexp "[Xx]-[Gg]oog-[Ss]tored-[Cc]ontent-[Ll]ength: $EXPECTED_SIZE"
+}
+
+@test "HEAD: XML API reports the plaintext md5" {
+  local expected_md5=$(xargs <<< $(openssl base64 -in <(openssl dgst -md5 -binary $TESTFILE)))
+  run head_object "$BUCKET/$TESTFILE"
+  assert_success
+  assert_output --partial "md5=$expected_md5"
+}
+
+@test "HEAD: a range is resolved against the plaintext" {
+  run head_object "$BUCKET/$TESTFILE" -H "Range: bytes=0-9"
+  assert_success
+  assert_output --partial " 206"
+  assert_output --regexp "[Cc]ontent-[Rr]ange: bytes 0-9/$EXPECTED_SIZE"
+}
+
+@test "Cleanup - gcloud storage rm" {
+  run gcloud storage rm gs://$BUCKET/$TESTFILE
+  assert_success
+}
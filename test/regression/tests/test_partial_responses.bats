@@ -0,0 +1,68 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+setup() {
+  export TESTFILE="partial-responses.txt"
+  echo "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ" > $TESTFILE
+  export EXPECTED_SIZE=$(xargs <<< $(wc -c < $TESTFILE))
+}
+
+teardown() {
+  rm -f $TESTFILE
+}
+
+# GET a JSON API path through the proxy with the fields mask $2
+get_fields() {
+  curl -s -G "https://storage.googleapis.com/storage/v1/b/$BUCKET/$1" \
+        --data-urlencode "fields=$2" \
+        -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+        --cacert $CA_BUNDLE \
+        --proxy $HTTPS_PROXY
+}
+
+@test "Setup - gcloud storage cp" {
+  run gcloud storage cp $TESTFILE gs://$BUCKET/$TESTFILE
+  assert_success
+}
+
+@test "Partial response: fields=size reports the plaintext size only" {
+  run get_fields "o/$TESTFILE" "size"
+  assert_success
+  assert_output --regexp "\"size\": ?\"$EXPECTED_SIZE\""
+  refute_output --partial '"metadata"'
+  refute_output --partial '"md5Hash"'
+}
+
+@test "Partial response: fields=name,md5Hash reports the plaintext hash" {
+  local expected_md5=$(xargs <<< $(openssl base64 -in <(openssl dgst -md5 -binary $TESTFILE)))
+  run get_fields "o/$TESTFILE" "name,md5Hash"
+  assert_success
+  assert_output --regexp "\"md5Hash\": ?\"$expected_md5\""
+  refute_output --partial '"size"'
+}
+
+@test "Partial response: a metadata subfield is kept, the others are not" {
+  run get_fields "o/$TESTFILE" "metadata/gcsproxy-unencrypted-content-length"
+  assert_success
+  assert_output --regexp "\"gcsproxy-unencrypted-content-length\": ?\"$EXPECTED_SIZE\""
+  refute_output --partial 'gcsproxy-encryption-key'
+}
+
+@test "Partial response: listing with fields=items(name,size),nextPageToken" {
+  run get_fields "o?prefix=$TESTFILE" "items(name,size),nextPageToken"
+  assert_success
+  assert_output --partial "{\"name\":\"$TESTFILE\",\"size\":\"$EXPECTED_SIZE\"}"
+  refute_output --partial '"kind"'
+  refute_output --partial '"metadata"'
+}
+
+@test "Partial response: listing with fields=items/size" {
+  run get_fields "o?prefix=$TESTFILE" "items/size"
+  assert_success
+  assert_output "{\"items\":[{\"size\":\"$EXPECTED_SIZE\"}]}"
+}
+
+@test "Cleanup - gcloud storage rm" {
+  run gcloud storage rm gs://$BUCKET/$TESTFILE
+  assert_success
+}
@@ -0,0 +1,92 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+setup() {
+    export TESTFILE="simple_upload.txt"
+    echo "This is a simple upload test file" > $TESTFILE
+    export TOKEN=$(gcloud auth print-access-token)
+    export UPLOAD="https://storage.googleapis.com/upload/storage/v1/b/$BUCKET/o?uploadType=media"
+}
+
+teardown() {
+    rm -f $TESTFILE $TESTFILE.gz $TESTFILE.out
+}
+
+@test "Test simple upload - missing name is refused" {
+    run curl -s -o /dev/null -w "%{http_code}" -X POST --data-binary @$TESTFILE \
+            -H "Authorization: Bearer $TOKEN" \
+            -H "Content-Type: text/plain" \
+            "$UPLOAD" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_output "400"
+}
+
+@test "Test simple upload - ifGenerationMatch=0 creates the object once" {
+    run curl -s -o /dev/null -w "%{http_code}" -X POST --data-binary @$TESTFILE \
+            -H "Authorization: Bearer $TOKEN" \
+            -H "Content-Type: text/plain" \
+            "$UPLOAD&name=$TESTFILE&ifGenerationMatch=0&predefinedAcl=projectPrivate" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_output "200"
+
+    run curl -s -o /dev/null -w "%{http_code}" -X POST --data-binary @$TESTFILE \
+            -H "Authorization: Bearer $TOKEN" \
+            -H "Content-Type: text/plain" \
+            "$UPLOAD&name=$TESTFILE&ifGenerationMatch=0" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_output "412"
+}
+
+@test "Test simple upload - object resource describes the plaintext" {
+    local expected_size=$(xargs <<< $(wc -c < $TESTFILE))
+    local expected_md5=$(xargs <<< $(openssl base64 -in <(openssl dgst -md5 -binary $TESTFILE)))
+    run curl -s -X POST --data-binary @$TESTFILE \
+            -H "Authorization: Bearer $TOKEN" \
+            -H "Content-Type: text/plain" \
+            -H "X-Goog-Hash: md5=$expected_md5" \
+            "$UPLOAD&name=$TESTFILE" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_success
+    assert_output --partial "\"size\":\"$expected_size\""
+    assert_output --partial "\"md5Hash\":\"$expected_md5\""
+}
+
+@test "Test simple upload - mismatching X-Goog-Hash is refused" {
+    run curl -s -o /dev/null -w "%{http_code}" -X POST --data-binary @$TESTFILE \
+            -H "Authorization: Bearer $TOKEN" \
+            -H "Content-Type: text/plain" \
+            -H "X-Goog-Hash: md5=AAAAAAAAAAAAAAAAAAAAAA==" \
+            "$UPLOAD&name=$TESTFILE" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_output "400"
+}
+
+@test "Test simple upload - contentEncoding=gzip round trips" {
+    gzip -c $TESTFILE > $TESTFILE.gz
+    run curl -s -o /dev/null -w "%{http_code}" -X POST --data-binary @$TESTFILE.gz \
+            -H "Authorization: Bearer $TOKEN" \
+            -H "Content-Type: text/plain" \
+            "$UPLOAD&name=$TESTFILE.gz&contentEncoding=gzip" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_output "200"
+
+    run curl -s --compressed -o $TESTFILE.out \
+            "https://storage.googleapis.com/storage/v1/b/$BUCKET/o/$TESTFILE.gz?alt=media" \
+            -H "Authorization: Bearer $TOKEN" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_success
+    run cmp $TESTFILE $TESTFILE.out
+    assert_success
+}
+
+@test "Test simple upload - cleanup" {
+    run gcloud storage rm gs://$BUCKET/$TESTFILE gs://$BUCKET/$TESTFILE.gz
+    assert_success
+}
@@ -0,0 +1,43 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+setup() {
+  export TESTFILE="sliced-download.txt"
+  export DOWNLOADED="sliced-download.out"
+  # ~4MB of predictable content (setup runs before every test) so gcloud splits the download into several slices
+  seq 1 600000 > $TESTFILE
+  # force sliced downloads for small objects
+  export CLOUDSDK_STORAGE_SLICED_OBJECT_DOWNLOAD_THRESHOLD=1M
+  export CLOUDSDK_STORAGE_SLICED_OBJECT_DOWNLOAD_COMPONENT_SIZE=1M
+  export CLOUDSDK_STORAGE_SLICED_OBJECT_DOWNLOAD_MAX_COMPONENTS=4
+}
+
+teardown() {
+  rm -f $TESTFILE $DOWNLOADED
+}
+
+@test "Setup - gcloud storage cp" {
+  run gcloud storage cp $TESTFILE gs://$BUCKET/$TESTFILE
+  assert_success
+}
+
+@test "Sliced download - gcloud storage cp decrypts every slice" {
+  run gcloud storage cp gs://$BUCKET/$TESTFILE $DOWNLOADED
+  assert_success
+
+  run cmp $TESTFILE $DOWNLOADED
+  assert_success
+}
+
+@test "Sliced download - crc32c reported for the plaintext" {
+  local expected_crc32c=$(gcloud storage hash $TESTFILE --skip-md5 --format="value(crc32c_hash)")
+
+  run gcloud storage objects describe gs://$BUCKET/$TESTFILE --format="value(crc32c_hash)"
+  assert_success
+  assert_output "$expected_crc32c"
+}
+
+@test "Teardown - gcloud storage rm" {
+  run gcloud storage rm gs://$BUCKET/$TESTFILE
+  assert_success
+}
@@ -0,0 +1,102 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+# Exercises terraform's gcs backend through the proxy: state writes with preconditions,
+# lock files created with ifGenerationMatch=0 and deleted by generation, and state reads
+# validated against the reported hashes.
+
+setup() {
+  if ! command -v terraform &> /dev/null; then
+    skip "terraform is not installed"
+  fi
+  export TF_DIR="terraform-gcs-backend"
+  export STATE_PREFIX="go-gcsproxy-regression/terraform"
+  # terraform is a go binary: it honors HTTPS_PROXY and SSL_CERT_FILE
+  export SSL_CERT_FILE=$CA_BUNDLE
+  export TF_IN_AUTOMATION=1
+  export GOOGLE_OAUTH_ACCESS_TOKEN=$(gcloud auth print-access-token)
+
+  mkdir -p $TF_DIR
+  cat > $TF_DIR/main.tf <<TF
+terraform {
+  backend "gcs" {
+    bucket = "$BUCKET"
+    prefix = "$STATE_PREFIX"
+  }
+}
+
+variable "revision" {
+  default = "1"
+}
+
+resource "terraform_data" "proxy_test" {
+  input = var.revision
+}
+
+output "revision" {
+  value = terraform_data.proxy_test.output
+}
+TF
+}
+
+teardown() {
+  rm -rf $TF_DIR
+}
+
+@test "Terraform gcs backend - init" {
+  run terraform -chdir=$TF_DIR init -input=false -reconfigure
+  assert_success
+}
+
+@test "Terraform gcs backend - plan" {
+  terraform -chdir=$TF_DIR init -input=false -reconfigure > /dev/null
+  run terraform -chdir=$TF_DIR plan -input=false -lock-timeout=30s
+  assert_success
+}
+
+@test "Terraform gcs backend - apply writes state" {
+  terraform -chdir=$TF_DIR init -input=false -reconfigure > /dev/null
+  run terraform -chdir=$TF_DIR apply -input=false -auto-approve -lock-timeout=30s
+  assert_success
+}
+
+@test "Terraform gcs backend - state is read back and decrypted" {
+  terraform -chdir=$TF_DIR init -input=false -reconfigure > /dev/null
+  run terraform -chdir=$TF_DIR state list
+  assert_success
+  assert_output --partial "terraform_data.proxy_test"
+
+  run terraform -chdir=$TF_DIR output -raw revision
+  assert_success
+  assert_output "1"
+}
+
+@test "Terraform gcs backend - apply updates existing state" {
+  terraform -chdir=$TF_DIR init -input=false -reconfigure > /dev/null
+  run terraform -chdir=$TF_DIR apply -input=false -auto-approve -lock-timeout=30s -var revision=2
+  assert_success
+
+  run terraform -chdir=$TF_DIR output -raw revision
+  assert_success
+  assert_output "2"
+}
+
+@test "Terraform gcs backend - state object is encrypted at rest" {
+  run gcloud storage objects describe gs://$BUCKET/$STATE_PREFIX/default.tfstate --format="value(metadata.gcsproxy-encryption-key)"
+  assert_success
+  assert_output --partial "cryptoKeys/"
+}
+
+@test "Terraform gcs backend - lock file is released" {
+  run gcloud storage ls gs://$BUCKET/$STATE_PREFIX/default.tflock
+  assert_failure
+}
+
+@test "Teardown - terraform destroy and remove state" {
+  terraform -chdir=$TF_DIR init -input=false -reconfigure > /dev/null
+  run terraform -chdir=$TF_DIR destroy -input=false -auto-approve -lock-timeout=30s
+  assert_success
+
+  run gcloud storage rm -r gs://$BUCKET/$STATE_PREFIX
+  assert_success
+}
@@ -0,0 +1,46 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+# Needs a proxy started with a -max_object_sizes entry for $MAX_OBJECT_SIZE_BUCKET, e.g.
+# -max_object_sizes="$MAX_OBJECT_SIZE_BUCKET:1MiB" with MAX_OBJECT_SIZE=1048576.
+
+setup() {
+    if [[ -z "$MAX_OBJECT_SIZE_BUCKET" || -z "$MAX_OBJECT_SIZE" ]]; then
+        skip "MAX_OBJECT_SIZE_BUCKET and MAX_OBJECT_SIZE are not set"
+    fi
+    export TESTFILE="oversized_upload.bin"
+    head -c $((MAX_OBJECT_SIZE + 1)) /dev/zero > $TESTFILE
+    export TOKEN=$(gcloud auth print-access-token)
+}
+
+teardown() {
+    rm -f $TESTFILE
+}
+
+@test "Test upload size limit - oversized simple upload is refused with 413" {
+    run curl -s -w "\n%{http_code}" -X POST --data-binary @$TESTFILE \
+            -H "Authorization: Bearer $TOKEN" \
+            -H "Content-Type: application/octet-stream" \
+            "https://storage.googleapis.com/upload/storage/v1/b/$MAX_OBJECT_SIZE_BUCKET/o?uploadType=media&name=$TESTFILE" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_output --partial "\"reason\":\"uploadTooLarge\""
+    assert_line --index 1 "413"
+}
+
+@test "Test upload size limit - oversized resumable upload is refused when it starts" {
+    run curl -s -o /dev/null -w "%{http_code}" -X POST \
+            -H "Authorization: Bearer $TOKEN" \
+            -H "Content-Type: application/json" \
+            -H "X-Upload-Content-Length: $((MAX_OBJECT_SIZE + 1))" \
+            -d "{\"name\":\"$TESTFILE\"}" \
+            "https://storage.googleapis.com/upload/storage/v1/b/$MAX_OBJECT_SIZE_BUCKET/o?uploadType=resumable" \
+            --cacert $CA_BUNDLE \
+            --proxy $HTTPS_PROXY
+    assert_output "413"
+}
+
+@test "Test upload size limit - refused upload is not stored" {
+    run gcloud storage ls gs://$MAX_OBJECT_SIZE_BUCKET/$TESTFILE
+    assert_failure
+}
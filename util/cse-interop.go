@@ -0,0 +1,53 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"strings"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+)
+
+/*
+The client-side encryption samples for GCS in Java and Python, and other clients built on Tink,
+store the plain ciphertext of Tink's KMS envelope AEAD, without the proxy's envelope header, and
+record the KMS key URI in a custom metadata key of their own, e.g. kek-uri:
+gcp-kms://projects/.../cryptoKeys/kek. -cse_key_metadata names those keys. An object that carries
+one of them and no key recorded by the proxy is decrypted as such a ciphertext, with the
+associated data -cse_associated_data describes.
+*/
+
+// kmsKeyUriPrefix starts the Tink key URIs of Cloud KMS keys
+const kmsKeyUriPrefix = "gcp-kms://"
+
+// ForeignEncryptionKey returns the KMS key another Tink client recorded in the custom metadata of
+// an object, empty when it recorded none
+func ForeignEncryptionKey(metadata map[string]string) string {
+	config := cfg.Current()
+	if config == nil {
+		return ""
+	}
+	for _, name := range config.CseKeyMetadata {
+		for key, value := range metadata {
+			// the XML API and some clients change the case of the keys
+			if strings.EqualFold(key, name) && value != "" {
+				return strings.TrimPrefix(value, kmsKeyUriPrefix)
+			}
+		}
+	}
+	return ""
+}
+
+// ForeignAssociatedData returns the associated data other Tink clients encrypt
+// gs://bucketName/objectName with: -cse_associated_data with {bucket} and {object} replaced
+func ForeignAssociatedData(bucketName string, objectName string) []byte {
+	config := cfg.Current()
+	if config == nil || config.CseAssociatedData == "" {
+		return nil
+	}
+	replacer := strings.NewReplacer("{bucket}", bucketName, "{object}", objectName)
+	return []byte(replacer.Replace(config.CseAssociatedData))
+}
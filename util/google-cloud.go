@@ -11,14 +11,15 @@ package util
 */
 import (
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"strings"
 
 	"cloud.google.com/go/storage"
 	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/gcsclient"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/oauth2"
-	"google.golang.org/api/option"
 )
 
 func parseBearerToken(authHeader string) (string, error) {
@@ -46,10 +47,9 @@ func updateGcsMetadata(ctx context.Context, authHeader string, bucketName string
 	// Create a new storage client with the bearer token
 	log.Debugf("updating  gs://%v/%v metadata.", bucketName, objectName)
 
-	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: bearerToken})
-	client, err := storage.NewClient(ctx, option.WithTokenSource(tokenSource))
+	client, err := gcsclient.WithToken(ctx, bearerToken)
 	if err != nil {
-		return fmt.Errorf("failed to create client: %v", err)
+		return err
 	}
 	defer client.Close()
 
@@ -59,39 +59,106 @@ func updateGcsMetadata(ctx context.Context, authHeader string, bucketName string
 	// Update the object's metadata
 	objectAttrsToUpdate := storage.ObjectAttrsToUpdate{
 		Metadata: map[string]string{
-			"x-unencrypted-content-length": unencryptedContentLength,
-			"x-md5Hash":                    md5Hash,
-			"x-encryption-key":             GetKMSKeyName(bucketName),
-			"x-proxy-version":              cfg.GlobalConfig.GCSProxyVersion,
+			MetaKey(MetaUnencryptedLength): unencryptedContentLength,
+			MetaKey(MetaMd5Hash):           md5Hash,
+			MetaKey(MetaEncryptionKey):     GetKMSKeyName(bucketName),
+			MetaKey(MetaProxyVersion):      cfg.Current().GCSProxyVersion,
 		},
 	}
 	if _, err := obj.Update(ctx, objectAttrsToUpdate); err != nil {
 		return fmt.Errorf("failed to update object metadata: %v", err)
 	}
-	log.Debug("Object metadata updated successfully for gs://%v/%v.", bucketName, objectName)
+	log.Debugf("Object metadata updated successfully for gs://%v/%v.", bucketName, objectName)
 	return nil
 }
 
+// clientFor returns a storage client with the client's bearer token when authHeader has one, the
+// proxy's shared client otherwise, and the function releasing it
+func clientFor(ctx context.Context, authHeader string) (*storage.Client, func(), error) {
+	bearerToken, err := parseBearerToken(authHeader)
+	if err != nil {
+		client, err := gcsclient.Storage()
+		return client, func() {}, err
+	}
+	client, err := gcsclient.WithToken(ctx, bearerToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, func() { client.Close() }, nil
+}
+
+// GetObjectProvenance returns the encryption provenance, the KMS key among it, recorded in the
+// metadata of one generation of an object. generation 0 means the live generation.
+func GetObjectProvenance(ctx context.Context, bucketName string, objectName string, generation int64) (Provenance, error) {
+	metadata, err := GetObjectMetadata(ctx, bucketName, objectName, generation)
+	if err != nil {
+		return Provenance{}, err
+	}
+	provenance := ProvenanceOf(metadata)
+	log.Debugf("Encryption Key ID %v (version %v) fetched successfully for gs://%v/%v#%v.",
+		provenance.Key, provenance.KeyVersion, bucketName, objectName, generation)
+	return provenance, nil
+}
 
-func GetObjectEncryptionKeyId(ctx context.Context, bucketName string, objectName string) (string,error) {
+// GetObjectMetadata returns the custom metadata of one generation of an object, generation 0
+// means the live generation.
+func GetObjectMetadata(ctx context.Context, bucketName string, objectName string, generation int64) (map[string]string, error) {
 
 	// lets use the google SDK so we get some error handling and such.
-	// Create a new storage client with the bearer token
-	log.Debugf("updating  gs://%v/%v metadata.", bucketName, objectName)
-	
-	client, err := storage.NewClient(ctx)
+	log.Debugf("fetching gs://%v/%v#%v metadata.", bucketName, objectName, generation)
+
+	client, err := gcsclient.Storage()
 	if err != nil {
-		return "", fmt.Errorf("failed to create client: %v", err)
+		return nil, err
 	}
-	defer client.Close()
 
 	// Get a handle to the object
-	obj := client.Bucket(bucketName).Object(objectName)
+	obj := Bucket(ctx, client, bucketName).Object(objectName)
+	if generation != 0 {
+		obj = obj.Generation(generation)
+	}
 
 	attrs, err := obj.Attrs(ctx)
 	if err != nil {
-		return "",fmt.Errorf("failed to get object attributes: %v", err)
+		return nil, fmt.Errorf("failed to get object attributes: %v", err)
+	}
+	return attrs.Metadata, nil
+}
+
+// UpdateObjectMetadata sets custom metadata keys of the live generation of an object, with the
+// client's bearer token when it has one and the proxy's credentials otherwise.
+func UpdateObjectMetadata(ctx context.Context, authHeader string, bucketName string, objectName string, metadata map[string]string) error {
+	client, release, err := clientFor(ctx, authHeader)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if _, err := Bucket(ctx, client, bucketName).Object(objectName).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata}); err != nil {
+		return fmt.Errorf("failed to update object metadata: %v", err)
+	}
+	log.Debugf("Object metadata updated successfully for gs://%v/%v.", bucketName, objectName)
+	return nil
+}
+
+// GetStoredObjectHashes reads the base64 MD5 and CRC32C hashes GCS computed for one generation
+// of an object, with the client's bearer token when it has one so the check needs no extra
+// permissions for the proxy. md5Hash is empty for composite objects.
+func GetStoredObjectHashes(ctx context.Context, authHeader string, bucketName string, objectName string, generation int64) (md5Hash string, crc32c string, err error) {
+	client, release, err := clientFor(ctx, authHeader)
+	if err != nil {
+		return "", "", err
+	}
+	defer release()
+
+	attrs, err := Bucket(ctx, client, bucketName).Object(objectName).Generation(generation).Attrs(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get object attributes: %v", err)
+	}
+	if len(attrs.MD5) > 0 {
+		md5Hash = base64.StdEncoding.EncodeToString(attrs.MD5)
 	}
-	log.Debug("Encryption Key ID %v fetched successfully for gs://%v/%v.",attrs.Metadata["x-encryption-key"], bucketName, objectName)
-	return attrs.Metadata["x-encryption-key"], nil
+	encoded := make([]byte, 4)
+	binary.BigEndian.PutUint32(encoded, attrs.CRC32C)
+	return md5Hash, base64.StdEncoding.EncodeToString(encoded), nil
 }
@@ -8,39 +8,129 @@ package util
 import (
 	"fmt"
 	"math/rand"
+	"net"
 	"net/textproto"
 	"strconv"
 	"strings"
+	"sync"
 
 	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
 	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/keymap"
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/tenant"
 	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
 	log "github.com/sirupsen/logrus"
 )
 
-func GetKMSKeyName(bucketName string) string {
+// IsGcsHost reports whether host is a GCS JSON/XML API endpoint: the global hostnames, the
+// mTLS endpoint (storage.mtls.googleapis.com) and regional endpoints such as
+// storage.europe-west1.rep.googleapis.com, including their mTLS variants.
+func IsGcsHost(host string) bool {
+	host = strings.ToLower(stripPort(host))
+	if host == "www.googleapis.com" {
+		return true
+	}
+	host = strings.Replace(host, ".mtls.googleapis.com", ".googleapis.com", 1)
+	if host == "storage.googleapis.com" {
+		return true
+	}
+
+	// storage.<region>.rep.googleapis.com
+	labels := strings.Split(host, ".")
+	return len(labels) == 5 && labels[0] == "storage" && labels[1] != "" && labels[2] == "rep" &&
+		labels[3] == "googleapis" && labels[4] == "com"
+}
+
+// IsMtlsHost reports whether host is one of the mTLS GCS endpoints.
+func IsMtlsHost(host string) bool {
+	return IsGcsHost(host) && strings.HasSuffix(strings.ToLower(stripPort(host)), ".mtls.googleapis.com")
+}
+
+// NonMtlsHost returns the regular TLS endpoint serving the same API as the mTLS host.
+func NonMtlsHost(host string) string {
+	return strings.Replace(strings.ToLower(host), ".mtls.googleapis.com", ".googleapis.com", 1)
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+var keyMaps keymap.Store
 
-	bucketMap := cfg.GlobalConfig.KmsBucketKeyMapping
+// KeyMaps holds the bucket key mapping once it was set, e.g. by the admin API.
+func KeyMaps() *keymap.Store {
+	return &keyMaps
+}
 
-	if bucketMap == nil {
-		log.Debug("No bucket mapping found")
-		return ""
+// KeyMap returns the bucket key mapping in use, the one of the global configuration until
+// KeyMaps is set.
+func KeyMap() keymap.KeyMap {
+	if m, ok := keyMaps.Load(); ok {
+		return m
 	}
+	config := cfg.Current()
+	return keymap.KeyMap{
+		Keys:         config.KmsBucketKeyMapping,
+		FallbackKeys: config.KmsFallbackKeys,
+		Formats:      config.EnvelopeFormats,
+
+		EncryptContentTypes: config.EncryptContentTypes,
+		SkipContentTypes:    config.SkipContentTypes,
+		MinSizes:            config.EncryptMinSizes,
+		MaxSizes:            config.EncryptMaxSizes,
+		ChunkSizes:          config.ChunkSizes,
+		DecryptClients:      config.DecryptClients,
+		OverrideClients:     config.OverrideClients,
+		ResponseHeaders:     config.ResponseHeaders,
+		Mirrors:             config.MirrorBuckets,
+	}
+}
+
+var flowKeyMaps sync.Map // flow id -> keymap.KeyMap
 
-	// Global key is highest priority
-	if value, exists := bucketMap["*"]; exists {
-		log.Debugf("Global KMS Key entry exists with value: %v", value)
-		return value
+// OverrideKeyMap has KeyMapFor return m for f until it is done, the mapping a trusted client
+// chose for its request with the override headers.
+func OverrideKeyMap(f *proxy.Flow, m keymap.KeyMap) {
+	flowKeyMaps.Store(f.Id, m)
+	go func() {
+		<-f.Done()
+		flowKeyMaps.Delete(f.Id)
+	}()
+}
+
+// KeyMapFor returns the bucket key mapping of f: the one its client overrode, else the one of the
+// tenant that sent it, KeyMap when the client belongs to no tenant.
+func KeyMapFor(f *proxy.Flow) keymap.KeyMap {
+	if m, ok := flowKeyMaps.Load(f.Id); ok {
+		return m.(keymap.KeyMap)
 	}
-	// If Global key , then check other bucket to KMS key mapping
-	if value, exists := bucketMap[bucketName]; exists {
-		log.Debugf(" KMS Key entry exists with value: %v", value)
-		return value
-	} else {
-		log.Debug("KMS key entry does not exist")
-		return ""
+	if t := tenant.Of(f); t != nil {
+		return t.KeyMap
 	}
+	return KeyMap()
+}
 
+func GetKMSKeyName(bucketName string) string {
+	return KeyMap().Key(bucketName)
+}
+
+const (
+	EnvelopeFormatTink = keymap.FormatTink
+	EnvelopeFormatCsek = keymap.FormatCsek
+)
+
+// GetEnvelopeFormat returns how objects of bucketName are encrypted.
+func GetEnvelopeFormat(bucketName string) string {
+	return KeyMap().Format(bucketName)
+}
+
+// GetDecryptionCandidateKeys lists the keys to try, in order, for an object of bucketName.
+func GetDecryptionCandidateKeys(recordedKey string, bucketName string) []string {
+	return KeyMap().CandidateKeys(recordedKey, bucketName)
 }
 
 func GetBucketNameFromGcsMetadata(bucketNameMap map[string]interface{}) string {
@@ -75,57 +165,29 @@ func GenerateHeadersList(f *proxy.Flow) (map[string]string, string) {
 	return defaultMap, boundary
 }
 
-// f.Request.URL.Path
-// "/download/storage/v1/b/ehorning-axlearn/o/README.md"
-// "/bucket-name/object-path"
-func GetBucketNameFromRequestUri(urlPath string) string {
-	var bucketName string
-	if strings.Contains(urlPath, "/b/") {
-		//Splits for the filepath with b in between
-		arr := strings.Split(urlPath, "/b/") //["/download/storage/v1/","ehorning-axlearn/o/README.md"]
-
-		//Splits for the filepath with o in between to get exact path
-		res := strings.Split(arr[1], "/o") // ["ehorning-axlearn/","/README.md"]
-
-		// Adding this because there might be a path for bucket, so grabbing only bucket name
-		bucketName = strings.Split(res[0], "/")[0]
-	} else {
-		// handle path=/bucket-name/object-path
-		bucketName = strings.Split(urlPath, "/")[1]
-	}
-	log.Debugf("getBucketNameFromRequestUri bucketName: %v", bucketName)
-	return bucketName
-}
-
-func GetObjectNameFromRequestUri(urlPath string) string {
-	var objectName string
-	if strings.Contains(urlPath, "/o/") {
-		//Splits for the filepath with b in between
-		arr := strings.Split(urlPath, "/o/") //["/download/storage/v1/ehorning-axlearn","README.md"]
-		// Adding this because there might be a path for bucket, so grabbing only bucket name
-		objectName = arr[1]
-	} else {
-		// handle path=/bucket-name/object-path
-		objectName = ""
-	}
-	log.Debugf("GetObjectNameFromRequestUri objectName: %v", objectName)
-	return objectName
-}
-
 // TODO: move this back to handle-singlepart-upload for clarity
-func GenerateMetadata(f *proxy.Flow, contentType string, objectName string) map[string]interface{} {
+func GenerateMetadata(f *proxy.Flow, contentType string, objectName string, keyVersion string) map[string]interface{} {
 	bucketName := GetBucketNameFromRequestUri(f.Request.URL.Path)
 	defaultMap := map[string]interface{}{
 		"bucket":      bucketName,
 		"contentType": contentType,
 		"name":        objectName,
 		"metadata": map[string]interface{}{
-			"x-unencrypted-content-length": len(f.Request.Body),
-			"x-md5Hash":                    crypto.Base64MD5Hash(f.Request.Body),
-			"x-encryption-key":             GetKMSKeyName(bucketName),
-			"x-proxy-version":              cfg.GlobalConfig.GCSProxyVersion,
+			MetaKey(MetaUnencryptedLength):    len(f.Request.Body),
+			MetaKey(MetaMd5Hash):              crypto.Base64MD5Hash(f.Request.Body),
+			MetaKey(MetaCrc32c):               crypto.Base64Crc32cHash(f.Request.Body),
+			MetaKey(MetaEncryptionKey):        KeyMapFor(f).Key(bucketName),
+			MetaKey(MetaEncryptionKeyVersion): keyVersion,
+			MetaKey(MetaProxyVersion):         cfg.For(f).GCSProxyVersion,
+			MetaKey(MetaEnvelopeVersion):      envelope.Version,
 		},
 	}
+	if crypto.EscrowKeyName != "" {
+		defaultMap["metadata"].(map[string]interface{})[MetaKey(MetaEscrowKey)] = crypto.EscrowKeyName
+	}
+	for key, value := range EncryptionProvenance(KeyMapFor(f).Policy) {
+		defaultMap["metadata"].(map[string]interface{})[key] = value
+	}
 	return defaultMap
 }
 
@@ -173,3 +235,18 @@ func generateRandom19DigitNumber() int {
 
 	return int(number)
 }
+
+// ParseGcsUrl splits gs://bucket/prefix into bucket and prefix.
+func ParseGcsUrl(gcsUrl string) (string, string, error) {
+	if !strings.HasPrefix(gcsUrl, "gs://") {
+		return "", "", fmt.Errorf("expected gs://bucket[/prefix], got %q", gcsUrl)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(gcsUrl, "gs://"), "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("missing bucket name in %q", gcsUrl)
+	}
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+	return parts[0], parts[1], nil
+}
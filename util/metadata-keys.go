@@ -0,0 +1,148 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"encoding/base64"
+	"net/http"
+	"sort"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+)
+
+/*
+The proxy records how it encrypted an object in custom metadata keys named with -metadata_prefix,
+gcsproxy- by default: gcsproxy-encryption-key is sent as x-goog-meta-gcsproxy-encryption-key.
+Proxies before -metadata_prefix wrote the keys with the x- prefix. The x- keys are read only of
+the objects such a proxy wrote, those with an x-proxy-version and none under the prefix, so the
+application's own x- metadata of other objects is left alone.
+*/
+
+// names of the custom metadata the proxy writes, without the prefix
+const (
+	MetaUnencryptedLength    = "unencrypted-content-length"
+	MetaMd5Hash              = "md5Hash"
+	MetaCrc32c               = "crc32c"
+	MetaEncryptionKey        = "encryption-key"
+	MetaEncryptionKeyVersion = "encryption-key-version"
+	MetaProxyVersion         = "proxy-version"
+	MetaEnvelopeVersion      = "envelope-version"
+	MetaEscrowKey            = "escrow-key"
+	MetaEncryptedAt          = "encrypted-at"
+	MetaPolicy               = "policy"
+	MetaMirroredFrom         = "mirrored-from"
+	MetaPlaintext            = "plaintext" // why the proxy stored the object as it is, PlaintextEmpty
+	MetaParts                = "parts"     // sealed part manifest of an XML multipart upload, base64
+
+	// of the integrity manifests, see pkg/manifest
+	MetaManifestSignature  = "manifest-signature"
+	MetaManifestSigningKey = "manifest-signing-key"
+)
+
+// LegacyMetadataPrefix is the prefix of the metadata written before -metadata_prefix
+const LegacyMetadataPrefix = "x-"
+
+// DefaultMetadataPrefix is the -metadata_prefix of the proxy
+const DefaultMetadataPrefix = "gcsproxy-"
+
+// ProxyMetadataNames lists the custom metadata the proxy owns
+var ProxyMetadataNames = []string{MetaUnencryptedLength, MetaMd5Hash, MetaCrc32c, MetaEncryptionKey,
+	MetaEncryptionKeyVersion, MetaProxyVersion, MetaEnvelopeVersion, MetaEscrowKey, MetaEncryptedAt, MetaPolicy,
+	MetaMirroredFrom, MetaPlaintext, MetaParts}
+
+// PlaintextEmpty is the MetaPlaintext of the empty objects the proxy stores as they are
+const PlaintextEmpty = "empty"
+
+// MetaKey returns the custom metadata key the proxy writes name under
+func MetaKey(name string) string {
+	config := cfg.Current()
+	if config == nil || config.MetadataPrefix == "" {
+		return DefaultMetadataPrefix + name
+	}
+	return config.MetadataPrefix + name
+}
+
+// LookupMeta returns the proxy metadata name of an object's custom metadata
+func LookupMeta[V any](metadata map[string]V, name string) (V, bool) {
+	if value, ok := metadata[MetaKey(name)]; ok {
+		return value, true
+	}
+	if !legacyMeta(func(key string) bool { _, ok := metadata[key]; return ok }) {
+		var none V
+		return none, false
+	}
+	value, ok := metadata[LegacyMetadataPrefix+name]
+	return value, ok
+}
+
+// legacyMeta reports whether custom metadata was written by a proxy before -metadata_prefix: it
+// has the legacy proxy version and none under the prefix
+func legacyMeta(has func(key string) bool) bool {
+	return MetaKey(MetaProxyVersion) != LegacyMetadataPrefix+MetaProxyVersion &&
+		!has(MetaKey(MetaProxyVersion)) && has(LegacyMetadataPrefix+MetaProxyVersion)
+}
+
+// Meta returns the proxy metadata name of an object's custom metadata, empty when it has none
+func Meta(metadata map[string]string, name string) string {
+	value, _ := LookupMeta(metadata, name)
+	return value
+}
+
+// DeleteMeta removes the proxy metadata from an object's custom metadata, the legacy keys too when
+// a proxy before -metadata_prefix wrote them
+func DeleteMeta(metadata map[string]string) {
+	legacy := legacyMeta(func(key string) bool { _, ok := metadata[key]; return ok })
+	for _, name := range ProxyMetadataNames {
+		delete(metadata, MetaKey(name))
+		if legacy {
+			delete(metadata, LegacyMetadataPrefix+name)
+		}
+	}
+}
+
+// MetaHeader returns the proxy metadata name of an XML API response or a download
+func MetaHeader(header http.Header, name string) string {
+	if value := header.Get("X-Goog-Meta-" + MetaKey(name)); value != "" {
+		return value
+	}
+	if !legacyMeta(func(key string) bool { return header.Get("X-Goog-Meta-"+key) != "" }) {
+		return ""
+	}
+	return header.Get("X-Goog-Meta-" + LegacyMetadataPrefix + name)
+}
+
+// PartManifest returns the sealed part manifest of an object's custom metadata, nil unless it is
+// an XML multipart upload, see crypto.WithPartManifest
+func PartManifest(metadata map[string]string) []byte {
+	manifest, _ := base64.StdEncoding.DecodeString(Meta(metadata, MetaParts))
+	return manifest
+}
+
+// PartManifestHeader returns the sealed part manifest of an XML API response or a download
+func PartManifestHeader(header http.Header) []byte {
+	manifest, _ := base64.StdEncoding.DecodeString(MetaHeader(header, MetaParts))
+	return manifest
+}
+
+// ReservedMetadata returns the keys of client supplied custom metadata the proxy would overwrite,
+// and the legacy proxy version, which would have the x- keys read as the proxy's. Uploads are
+// refused with them whatever else the metadata has, only the server side copies the proxy
+// recognises keep the metadata of their source and are not checked.
+func ReservedMetadata[V any](metadata map[string]V) []string {
+	var keys []string
+	for _, name := range ProxyMetadataNames {
+		if _, ok := metadata[MetaKey(name)]; ok {
+			keys = append(keys, MetaKey(name))
+		}
+	}
+	if legacy := LegacyMetadataPrefix + MetaProxyVersion; legacy != MetaKey(MetaProxyVersion) {
+		if _, ok := metadata[legacy]; ok {
+			keys = append(keys, legacy)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
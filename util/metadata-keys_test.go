@@ -0,0 +1,78 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestLookupMeta(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		key      string
+		ok       bool
+	}{
+		{"prefixed", map[string]string{"gcsproxy-proxy-version": "1", "gcsproxy-encryption-key": "k"}, "k", true},
+		{"legacy object", map[string]string{"x-proxy-version": "1", "x-encryption-key": "legacy"}, "legacy", true},
+		// the x- metadata of the application, not of an earlier proxy
+		{"application metadata", map[string]string{"x-encryption-key": "app"}, "", false},
+		{"prefix wins", map[string]string{"gcsproxy-proxy-version": "1", "x-proxy-version": "1", "x-encryption-key": "app"}, "", false},
+		{"none", map[string]string{}, "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			key, ok := LookupMeta(tc.metadata, MetaEncryptionKey)
+			if key != tc.key || ok != tc.ok {
+				t.Errorf("LookupMeta() = %q, %v, want %q, %v", key, ok, tc.key, tc.ok)
+			}
+			header := http.Header{}
+			for name, value := range tc.metadata {
+				header.Set("X-Goog-Meta-"+name, value)
+			}
+			if key := MetaHeader(header, MetaEncryptionKey); key != tc.key {
+				t.Errorf("MetaHeader() = %q, want %q", key, tc.key)
+			}
+		})
+	}
+}
+
+func TestReservedMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     []string
+	}{
+		{"application metadata", map[string]string{"owner": "me", "x-encryption-key": "app"}, nil},
+		{"proxy key", map[string]string{"gcsproxy-encryption-key": "k"}, []string{"gcsproxy-encryption-key"}},
+		// a client copying an object the proxy wrote, the proxy version no longer exempts it
+		{"copied", map[string]string{"gcsproxy-proxy-version": "1", "gcsproxy-encryption-key": "k"}, []string{"gcsproxy-encryption-key", "gcsproxy-proxy-version"}},
+		{"legacy proxy version", map[string]string{"x-proxy-version": "1", "x-encryption-key": "k"}, []string{"x-proxy-version"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ReservedMetadata(tc.metadata); !slices.Equal(got, tc.want) {
+				t.Errorf("ReservedMetadata() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeleteMeta(t *testing.T) {
+	metadata := map[string]string{"gcsproxy-encryption-key": "k", "x-encryption-key": "app", "owner": "me"}
+	DeleteMeta(metadata)
+	if len(metadata) != 2 || metadata["x-encryption-key"] != "app" || metadata["owner"] != "me" {
+		t.Errorf("DeleteMeta() left %v", metadata)
+	}
+
+	legacy := map[string]string{"x-proxy-version": "1", "x-encryption-key": "k", "owner": "me"}
+	DeleteMeta(legacy)
+	if len(legacy) != 1 || legacy["owner"] != "me" {
+		t.Errorf("DeleteMeta() of a legacy object left %v", legacy)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+GCS object names are any UTF-8 string: "/" is a character like any other, a name may start with
+it or repeat it, and it may hold spaces, "%", "+", "*", "?", "#" or "/o/". GCS neither cleans nor
+normalizes them, "café" written in NFC and in NFD are two objects. The proxy does the same: a
+name is only ever compared byte for byte, never cleaned of its slashes, unescaped twice or
+Unicode normalized, or the key of one object could be chosen for another.
+
+A request carries the name percent-encoded in its path, e.g. a%2Fb for a/b, or in its name query
+parameter. net/url decodes both once, the decoded URL.Path is what the functions here take.
+Encoded and plain slashes are the same to GCS, so they are to the proxy.
+
+The JSON API paths name the bucket after /b/ and the object after the /o/ that follows it:
+
+	/storage/v1/b/BUCKET/o/OBJECT
+	/download/storage/v1/b/BUCKET/o/OBJECT
+	/upload/storage/v1/b/BUCKET/o?name=OBJECT
+
+and the XML API paths, of the path style, /BUCKET/OBJECT.
+*/
+
+// jsonApiBucketPaths are the JSON API paths the bucket name follows
+var jsonApiBucketPaths = []string{
+	"/storage/v1/b/",
+	"/download/storage/v1/b/",
+	"/upload/storage/v1/b/",
+	"/resumable/upload/storage/v1/b/",
+	"/batch/storage/v1/b/",
+	"/b/", // the destination of a rewrite or copy, bucket names are at least 3 characters long
+}
+
+// jsonApiPaths are the JSON API paths that name no bucket when they are not followed by one
+var jsonApiPaths = []string{"/storage/v1", "/download/storage/v1", "/upload/storage/v1", "/resumable/upload/storage/v1", "/batch/storage/v1"}
+
+// SplitRequestPath returns the bucket and object the decoded path of a GCS request names. The
+// object is "" for bucket requests, and both are "" for the JSON API requests naming no bucket,
+// e.g. the bucket listing /storage/v1/b.
+func SplitRequestPath(urlPath string) (bucketName string, objectName string) {
+	for _, prefix := range jsonApiBucketPaths {
+		if rest, ok := strings.CutPrefix(urlPath, prefix); ok {
+			bucketName, rest, _ = strings.Cut(rest, "/")
+			// everything after the first /o/ is the name, a /o/ in it included
+			if name, ok := strings.CutPrefix(rest, "o/"); ok {
+				objectName = name
+			}
+			return bucketName, objectName
+		}
+	}
+	for _, prefix := range jsonApiPaths {
+		if urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/") {
+			return "", ""
+		}
+	}
+	bucketName, objectName, _ = strings.Cut(strings.TrimPrefix(urlPath, "/"), "/")
+	return bucketName, objectName
+}
+
+// GetBucketNameFromRequestUri returns the bucket the decoded f.Request.URL.Path names, e.g.
+// "/download/storage/v1/b/ehorning-axlearn/o/README.md" or "/bucket-name/object-path"
+func GetBucketNameFromRequestUri(urlPath string) string {
+	bucketName, _ := SplitRequestPath(urlPath)
+	log.Debugf("getBucketNameFromRequestUri bucketName: %v", bucketName)
+	return bucketName
+}
+
+// GetObjectNameFromRequestUri returns the object the decoded f.Request.URL.Path names, "" for
+// the requests of buckets and the uploads naming it in their query or body
+func GetObjectNameFromRequestUri(urlPath string) string {
+	_, objectName := SplitRequestPath(urlPath)
+	log.Debugf("GetObjectNameFromRequestUri objectName: %v", objectName)
+	return objectName
+}
+
+// ParseGcsPrefix splits gs://bucket/prefix like ParseGcsUrl for the tools taking a prefix. They
+// don't expand wildcards, a trailing * or ** as in gs://bucket/logs/* is dropped so it selects
+// the objects gcloud would, any other * is part of the names.
+func ParseGcsPrefix(gcsUrl string) (string, string, error) {
+	bucketName, prefix, err := ParseGcsUrl(gcsUrl)
+	if err != nil {
+		return "", "", err
+	}
+	prefix = strings.TrimSuffix(strings.TrimSuffix(prefix, "*"), "*")
+	return bucketName, prefix, nil
+}
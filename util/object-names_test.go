@@ -0,0 +1,53 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import "testing"
+
+func TestSplitRequestPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		bucket string
+		object string
+	}{
+		{"/storage/v1/b/bucket/o/a.txt", "bucket", "a.txt"},
+		{"/download/storage/v1/b/bucket/o/dir/a.txt", "bucket", "dir/a.txt"},
+		{"/upload/storage/v1/b/bucket/o", "bucket", ""},
+		{"/resumable/upload/storage/v1/b/bucket/o", "bucket", ""},
+		{"/storage/v1/b/bucket", "bucket", ""},
+		{"/storage/v1/b/bucket/o", "bucket", ""},
+		{"/storage/v1/b", "", ""},
+		{"/storage/v1/b/", "", ""},
+		{"/storage/v1", "", ""},
+		{"/batch/storage/v1", "", ""},
+		// names are kept byte for byte
+		{"/storage/v1/b/bucket/o//leading", "bucket", "/leading"},
+		{"/storage/v1/b/bucket/o/a//b/", "bucket", "a//b/"},
+		{"/storage/v1/b/bucket/o/x/o/y", "bucket", "x/o/y"},
+		{"/storage/v1/b/bucket/o/a b+c%d*?#", "bucket", "a b+c%d*?#"},
+		{"/storage/v1/b/bucket/o/caf\u00e9", "bucket", "caf\u00e9"},
+		{"/storage/v1/b/bucket/o/cafe\u0301", "bucket", "cafe\u0301"},
+		{"/storage/v1/b/bucket/o/../other", "bucket", "../other"},
+		// the destination of a rewrite or copy
+		{"/b/dest/o/copy.txt", "dest", "copy.txt"},
+		// XML API, path style
+		{"/bucket/a.txt", "bucket", "a.txt"},
+		{"/bucket/dir/", "bucket", "dir/"},
+		{"/bucket//a", "bucket", "/a"},
+		{"/bucket", "bucket", ""},
+		{"/bucket/storage/v1/b/x", "bucket", "storage/v1/b/x"},
+		{"/storage/v1x/a", "storage", "v1x/a"},
+		{"/", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			bucket, object := SplitRequestPath(test.path)
+			if bucket != test.bucket || object != test.object {
+				t.Fatalf("got %q, %q, want %q, %q", bucket, object, test.bucket, test.object)
+			}
+		})
+	}
+}
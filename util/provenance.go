@@ -0,0 +1,97 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/pkg/envelope"
+)
+
+// Provenance is what the metadata of an object records about its encryption, empty fields were
+// not recorded: objects written by earlier proxy versions lack the newer ones.
+type Provenance struct {
+	ProxyVersion    string
+	EnvelopeVersion string
+	Key             string
+	KeyVersion      string
+	EncryptedAt     string // RFC 3339, UTC
+	Policy          string // policy document the key mapping came from, source#version
+	Foreign         bool   // written by another Tink client, Key is from -cse_key_metadata
+}
+
+// EncryptionProvenance returns the metadata stamped on an object when it is encrypted now, besides
+// the key and versions recorded with it. policy is the Policy of the key mapping in use.
+func EncryptionProvenance(policy string) map[string]string {
+	metadata := map[string]string{MetaKey(MetaEncryptedAt): time.Now().UTC().Format(time.RFC3339)}
+	if policy != "" {
+		metadata[MetaKey(MetaPolicy)] = policy
+	}
+	return metadata
+}
+
+// ProvenanceOf reads the provenance of an object from its custom metadata
+func ProvenanceOf(metadata map[string]string) Provenance {
+	p := Provenance{
+		ProxyVersion:    Meta(metadata, MetaProxyVersion),
+		EnvelopeVersion: Meta(metadata, MetaEnvelopeVersion),
+		Key:             Meta(metadata, MetaEncryptionKey),
+		KeyVersion:      Meta(metadata, MetaEncryptionKeyVersion),
+		EncryptedAt:     Meta(metadata, MetaEncryptedAt),
+		Policy:          Meta(metadata, MetaPolicy),
+	}
+	if p.Key == "" {
+		if key := ForeignEncryptionKey(metadata); key != "" {
+			p.Key, p.Foreign = key, true
+		}
+	}
+	return p
+}
+
+// ProvenanceOfHeader reads the provenance of an object from the X-Goog-Meta- headers of an XML API
+// response
+func ProvenanceOfHeader(header http.Header) Provenance {
+	metadata := make(map[string]string)
+	for name := range header {
+		if key, ok := strings.CutPrefix(strings.ToLower(name), "x-goog-meta-"); ok {
+			metadata[key] = header.Get(name)
+		}
+	}
+	return ProvenanceOf(metadata)
+}
+
+// Newer reports whether the object was written with an envelope version this proxy does not know
+func (p Provenance) Newer() bool {
+	version, err := strconv.Atoi(p.EnvelopeVersion)
+	return err == nil && version > envelope.Version
+}
+
+// String describes the recorded fields, e.g. for the errors of objects that do not decrypt
+func (p Provenance) String() string {
+	var fields []string
+	add := func(name string, value string) {
+		if value != "" {
+			fields = append(fields, name+" "+value)
+		}
+	}
+	add("proxy version", p.ProxyVersion)
+	add("envelope version", p.EnvelopeVersion)
+	add("key", p.Key)
+	add("key version", p.KeyVersion)
+	add("encrypted at", p.EncryptedAt)
+	add("policy", p.Policy)
+	if p.Foreign {
+		fields = append(fields, "another Tink client")
+	}
+	if len(fields) == 0 {
+		return "no provenance recorded"
+	}
+	return fmt.Sprintf("written with %v", strings.Join(fields, ", "))
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"context"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+/*
+Requests to Requester Pays buckets name the project billed for them, in the userProject query
+parameter of the JSON API or the x-goog-user-project header of both APIs. The requests the proxy
+makes itself on behalf of a client (key lookups, upload verification, prefetches, mirrored and
+spooled uploads) bill the client's project, or -user_project when the client named none. The
+subcommands bill -user_project.
+*/
+
+// UserProjectHeader names the project billed for a request to a Requester Pays bucket
+const UserProjectHeader = "X-Goog-User-Project"
+
+type userProjectKey struct{}
+
+// UserProject returns the project the request in f bills, empty when it names none
+func UserProject(f *proxy.Flow) string {
+	if project := f.Request.URL.Query().Get("userProject"); project != "" {
+		return project
+	}
+	return f.Request.Header.Get(UserProjectHeader)
+}
+
+// WithUserProject returns a context billing project for the GCS requests made with it, by default
+// -user_project
+func WithUserProject(ctx context.Context, project string) context.Context {
+	if project == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, userProjectKey{}, project)
+}
+
+// BilledProject returns the project the GCS requests made with ctx bill, empty for none
+func BilledProject(ctx context.Context) string {
+	if project, ok := ctx.Value(userProjectKey{}).(string); ok {
+		return project
+	}
+	return cfg.Current().UserProject
+}
+
+// Bucket returns the handle of bucketName billing the project of ctx
+func Bucket(ctx context.Context, client *storage.Client, bucketName string) *storage.BucketHandle {
+	bucket := client.Bucket(bucketName)
+	if project := BilledProject(ctx); project != "" {
+		bucket = bucket.UserProject(project)
+	}
+	return bucket
+}
+
+// BillRequest makes the JSON or XML API request req bill the project of ctx, unless it names one
+func BillRequest(ctx context.Context, req *http.Request) {
+	project := BilledProject(ctx)
+	if project == "" || req.URL.Query().Get("userProject") != "" || req.Header.Get(UserProjectHeader) != "" {
+		return
+	}
+	req.Header.Set(UserProjectHeader, project)
+}